@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// downloadCounter keeps hourly download counts for the last week so stats
+// can report recent activity. Counts live in memory only and start from zero
+// after a restart.
+type downloadCounter struct {
+	mutex   sync.Mutex
+	buckets [7 * 24]int64
+	hours   [7 * 24]int64 // hour (Unix time / 3600) each bucket belongs to
+}
+
+func (c *downloadCounter) record(now time.Time) {
+	hour := now.Unix() / 3600
+	i := hour % int64(len(c.buckets))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.hours[i] != hour {
+		c.hours[i] = hour
+		c.buckets[i] = 0
+	}
+	c.buckets[i]++
+}
+
+// since sums the downloads in the window ending now, at hour granularity.
+func (c *downloadCounter) since(now time.Time, window time.Duration) int64 {
+	hour := now.Unix() / 3600
+	oldest := hour - int64(window/time.Hour) + 1
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var total int64
+	for i, h := range c.hours {
+		if h >= oldest && h <= hour {
+			total += c.buckets[i]
+		}
+	}
+	return total
+}
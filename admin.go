@@ -0,0 +1,380 @@
+package main
+
+import (
+	"cmp"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AdminFileView is the full admin-only picture of a stored file. It mirrors
+// FileInfo but never carries the download password itself.
+type AdminFileView struct {
+	ID                string            `json:"id"`
+	Filename          string            `json:"filename"`
+	OriginalName      string            `json:"original_name"`
+	Title             string            `json:"title"`
+	Size              int64             `json:"size"`
+	ContentType       string            `json:"content_type"`
+	Checksum          string            `json:"checksum"`
+	UploadTime        time.Time         `json:"upload_time"`
+	ExpiresAt         time.Time         `json:"expires_at"`
+	TTLSource         string            `json:"ttl_source,omitempty"` // explicit, default or extended, see resolveTTL
+	Description       string            `json:"description"`
+	Tags              []string          `json:"tags"`
+	UploaderIP        string            `json:"uploader_ip"`
+	StorageKey        string            `json:"storage_key"`
+	StoragePath       string            `json:"storage_path"`
+	Tier              string            `json:"tier"`
+	PasswordProtected bool              `json:"password_protected"`
+	Status            FileStatus        `json:"status"`
+	GraceUntil        *time.Time        `json:"grace_until,omitempty"`
+	Collected         string            `json:"collected,omitempty"` // recipients progress, see recipients.go
+	Downloads         DownloadSummary   `json:"downloads"`
+	Metadata          map[string]string `json:"metadata"`
+	Email             *EmailDelivery    `json:"email,omitempty"` // notify_email delivery, since the last restart
+	Revision          int64             `json:"revision"`        // sent as the ETag, see checkIfMatch
+}
+
+// ETag is the revision as sent in the ETag header.
+func (v AdminFileView) ETag() string {
+	return revisionETag(v.Revision)
+}
+
+type DownloadSummary struct {
+	Count        int       `json:"count"`
+	MaxDownloads int       `json:"max_downloads"`
+	Remaining    int       `json:"remaining"` // -1 when unlimited
+	LastDownload time.Time `json:"last_download"`
+}
+
+func (fm *FileManager) newAdminFileView(fileInfo *FileInfo) AdminFileView {
+	storagePath := fm.contentStorage(fileInfo).Locate(fileInfo.StorageKey)
+
+	remaining := -1
+	if fileInfo.MaxDownloads > 0 {
+		remaining = fileInfo.MaxDownloads - fileInfo.Downloads
+		if remaining < 0 {
+			remaining = 0
+		}
+	}
+
+	metadata := make(map[string]string, len(fileInfo.Metadata))
+	for k, v := range fileInfo.Metadata {
+		metadata[k] = v
+	}
+
+	return AdminFileView{
+		ID:                fileInfo.ID,
+		Filename:          fileInfo.Filename,
+		OriginalName:      fileInfo.OriginalName,
+		Title:             fileInfo.Title,
+		Size:              fileInfo.Size,
+		ContentType:       fileInfo.effectiveContentType(),
+		Checksum:          fileInfo.Checksum,
+		UploadTime:        fileInfo.UploadTime,
+		ExpiresAt:         fileInfo.ExpiresAt,
+		TTLSource:         fileInfo.TTLSource,
+		Description:       fileInfo.Description,
+		Tags:              append([]string(nil), fileInfo.Tags...),
+		UploaderIP:        fileInfo.UploaderIP,
+		StorageKey:        fileInfo.StorageKey,
+		StoragePath:       storagePath,
+		Tier:              fileInfo.tier(),
+		PasswordProtected: fileInfo.Password != "",
+		Status:            fileInfo.Status(),
+		GraceUntil:        fileInfo.GraceUntil,
+		Collected:         fileInfo.collectionStatus(),
+		Downloads: DownloadSummary{
+			Count:        fileInfo.Downloads,
+			MaxDownloads: fileInfo.MaxDownloads,
+			Remaining:    remaining,
+			LastDownload: fileInfo.LastDownload,
+		},
+		Metadata: metadata,
+		Email:    fm.emails.delivery(fileInfo.ID),
+		Revision: fileInfo.Revision,
+	}
+}
+
+// adminFileView snapshots a file under the read lock.
+func (fm *FileManager) adminFileView(fileID string) (AdminFileView, bool) {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+
+	fileInfo, exists := fm.files[fileID]
+	if !exists {
+		return AdminFileView{}, false
+	}
+	return fm.newAdminFileView(fileInfo), true
+}
+
+// adminRouteRole names the role an /api/admin/... request needs: owner for
+// API keys, bans, protected tags, admin users, backups and the configuration,
+// viewer for reading anything else and editor for changing it.
+func adminRouteRole(r *http.Request, parts []string) string {
+	if len(parts) > 0 {
+		switch parts[0] {
+		case "keys", "blocked-hashes", "tag-protection", "users", "backup", "config", "notifications":
+			return roleOwner
+		}
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return roleViewer
+	}
+	return roleEditor
+}
+
+// adminAPI routes /api/admin/... requests. parts excludes the "admin" segment.
+func (fm *FileManager) adminAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	if !fm.requireRole(w, r, adminRouteRole(r, parts)) {
+		return
+	}
+
+	if len(parts) >= 2 && parts[0] == "files" {
+		fileID := parts[1]
+		switch {
+		case len(parts) == 2 && r.Method == "GET":
+			fm.adminFileDetail(w, r, fileID)
+		case len(parts) == 3 && r.Method == "POST" && (parts[2] == "archive" || parts[2] == "rehydrate"):
+			fm.adminMoveTier(w, r, fileID, parts[2])
+		case len(parts) == 3 && r.Method == "POST":
+			fm.adminFileAction(w, r, fileID, parts[2])
+		case len(parts) > 3:
+			respondError(w, r, "Invalid API endpoint", http.StatusNotFound)
+		default:
+			respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch {
+	case len(parts) >= 1 && parts[0] == "blocked-hashes":
+		fm.blockedHashesAPI(w, r, parts[1:])
+	case len(parts) >= 1 && parts[0] == "tag-protection":
+		fm.tagProtectionAPI(w, r, parts[1:])
+	case len(parts) >= 1 && parts[0] == "config":
+		fm.configAPI(w, r, parts[1:])
+	case len(parts) >= 1 && parts[0] == "keys":
+		fm.apiKeysAPI(w, r, parts[1:])
+	case len(parts) >= 1 && parts[0] == "users":
+		fm.adminUsersAPI(w, r, parts[1:])
+	case len(parts) == 1 && parts[0] == "jobs":
+		fm.listJobs(w, r)
+	case len(parts) == 2 && parts[0] == "jobs":
+		fm.getJob(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "verify" && r.Method == "POST":
+		fm.startVerify(w, r)
+	case len(parts) == 1 && parts[0] == "tier" && r.Method == "POST":
+		fm.startTier(w, r)
+	case len(parts) == 1 && parts[0] == "rehash" && r.Method == "POST":
+		fm.startRehash(w, r)
+	case len(parts) == 1 && parts[0] == "content-types" && r.Method == "POST":
+		fm.startContentTypeBackfill(w, r)
+	case len(parts) == 2 && parts[0] == "notifications" && parts[1] == "preview" && r.Method == "POST":
+		fm.previewNotification(w, r)
+	case len(parts) == 1 && parts[0] == "backup":
+		fm.backupAPI(w, r)
+	case len(parts) == 1 && parts[0] == "activity":
+		fm.listActivity(w, r)
+	case len(parts) == 2 && parts[0] == "activity" && parts[1] == "stream":
+		fm.streamActivity(w, r)
+	case len(parts) == 1 && parts[0] == "type-mismatches":
+		fm.typeMismatchReport(w, r)
+	case len(parts) == 2 && parts[0] == "cache" && parts[1] == "purge" && r.Method == "POST":
+		fm.purgeCache(w, r)
+	default:
+		respondError(w, r, "Unknown API endpoint", http.StatusNotFound)
+	}
+}
+
+func (fm *FileManager) adminFileDetail(w http.ResponseWriter, r *http.Request, fileID string) {
+	view, exists := fm.adminFileView(fileID)
+	if !exists {
+		respondError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", view.ETag())
+	respondJSON(w, http.StatusOK, view)
+}
+
+// adminFileAction applies one of the admin actions offered on the detail page.
+func (fm *FileManager) adminFileAction(w http.ResponseWriter, r *http.Request, fileID, action string) {
+	fm.mutex.Lock()
+	fileInfo, exists := fm.files[fileID]
+	if !exists {
+		fm.mutex.Unlock()
+		respondError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+	// The detail page's forms send the revision they were rendered with
+	ifMatch := cmp.Or(r.Header.Get("If-Match"), r.PostFormValue("if_match"))
+	if err := fm.checkIfMatch(ifMatch, fileInfo); err != nil {
+		fm.mutex.Unlock()
+		writePreconditionError(w, r, err)
+		return
+	}
+
+	switch action {
+	case "extend":
+		seconds, err := strconv.Atoi(r.FormValue("ttl"))
+		if err != nil || seconds <= 0 {
+			fm.mutex.Unlock()
+			respondError(w, r, "ttl must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		base := fileInfo.ExpiresAt
+		if now := time.Now(); base.Before(now) {
+			base = now
+		}
+		fileInfo.ExpiresAt = base.Add(time.Duration(seconds) * time.Second)
+		fileInfo.TTLSource = ttlExtended
+	case "reset-downloads":
+		fileInfo.Downloads = 0
+		fileInfo.GraceUntil = nil
+		for i := range fileInfo.Recipients {
+			fileInfo.Recipients[i].Collected = nil
+		}
+	case "set-limit":
+		limit, err := strconv.Atoi(r.FormValue("max_downloads"))
+		if err != nil || limit < 0 {
+			fm.mutex.Unlock()
+			respondError(w, r, "max_downloads must be a number of downloads, 0 for unlimited", http.StatusBadRequest)
+			return
+		}
+		if limit > 0 && fileInfo.hasRecipients() {
+			fm.mutex.Unlock()
+			respondError(w, r, errRecipientsLimit.Error(), http.StatusBadRequest)
+			return
+		}
+		fileInfo.MaxDownloads = limit
+		if limit == 0 || fileInfo.Downloads < limit {
+			fileInfo.GraceUntil = nil
+		}
+	case "set-title":
+		title, err := parseTitle(r.FormValue("title"))
+		if err != nil {
+			fm.mutex.Unlock()
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fileInfo.Title = title
+	default:
+		fm.mutex.Unlock()
+		respondError(w, r, "Unknown action", http.StatusNotFound)
+		return
+	}
+	fm.recordChange(changeUpdated, fileID, fileInfo)
+	view := fm.newAdminFileView(fileInfo)
+	fm.mutex.Unlock()
+
+	fm.requestSave()
+	w.Header().Set("ETag", view.ETag())
+
+	if wantsJSON(r) {
+		respondJSON(w, http.StatusOK, view)
+		return
+	}
+	http.Redirect(w, r, fm.appPath("/admin/files/"+fileID), http.StatusSeeOther)
+}
+
+var adminFileTemplate = template.Must(template.New("admin-file").Funcs(parseFuncs).Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{or .Title (displayName .OriginalName)}} - File Details</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; background: #f5f5f5; }
+        .container { max-width: 900px; margin: 0 auto; background: white; padding: 20px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); }
+        h1 { color: #007bff; word-break: break-all; }
+        table { border-collapse: collapse; width: 100%; margin: 20px 0; }
+        th, td { border: 1px solid #ddd; padding: 10px; text-align: left; vertical-align: top; }
+        th { background-color: #f8f9fa; width: 200px; }
+        .mono { font-family: monospace; font-size: 0.9em; word-break: break-all; }
+        .actions form { display: inline-block; margin-right: 10px; }
+        .btn { background: #007bff; color: white; padding: 8px 16px; border: none; border-radius: 4px; cursor: pointer; text-decoration: none; display: inline-block; }
+        .btn:hover { background: #0056b3; }
+        input[type=number] { padding: 7px; width: 120px; border: 1px solid #ddd; border-radius: 4px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <p><a href="{{path "/manage"}}">&larr; Back to files</a></p>
+        <h1>{{or .Title (displayName .OriginalName)}}</h1>
+        <table>
+            <tr><th>ID</th><td class="mono">{{.ID}}</td></tr>
+            <tr><th>Original name</th><td class="mono">{{.OriginalName}}</td></tr>
+            <tr><th>Stored name</th><td class="mono">{{.Filename}}</td></tr>
+            <tr><th>Storage key</th><td class="mono">{{.StorageKey}}</td></tr>
+            <tr><th>Storage path</th><td class="mono">{{.StoragePath}}</td></tr>
+            <tr><th>Storage tier</th><td>{{.Tier}}</td></tr>
+            <tr><th>Size</th><td>{{formatBytes .Size}} ({{.Size}} bytes)</td></tr>
+            <tr><th>Content type</th><td>{{.ContentType}}</td></tr>
+            <tr><th>Checksum</th><td class="mono">{{.Checksum}}</td></tr>
+            <tr><th>Uploaded</th><td>{{.UploadTime.Format "2006-01-02 15:04:05"}} ({{relativeTime .UploadTime}})</td></tr>
+            <tr><th>Expires</th><td>{{expiryTime .ExpiresAt}} ({{expiresIn .ExpiresAt}}){{with .TTLSource}}, {{.}} TTL{{end}}</td></tr>
+            <tr><th>Uploader IP</th><td class="mono">{{.UploaderIP}}</td></tr>
+            <tr><th>Status</th><td>{{.Status}}{{with .Collected}}, {{.}}{{end}}{{with .GraceUntil}}, kept until {{.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+            <tr><th>Password protected</th><td>{{if .PasswordProtected}}Yes{{else}}No{{end}}</td></tr>
+            <tr><th>Downloads</th><td>{{.Downloads.Count}}{{if gt .Downloads.MaxDownloads 0}} of {{.Downloads.MaxDownloads}} ({{.Downloads.Remaining}} remaining){{end}}{{if not .Downloads.LastDownload.IsZero}}, last {{relativeTime .Downloads.LastDownload}}{{end}}</td></tr>
+            <tr><th>Description</th><td>{{.Description}}</td></tr>
+            <tr><th>Tags</th><td>{{range .Tags}}{{.}} {{end}}</td></tr>
+            <tr><th>Metadata</th><td class="mono">{{range $k, $v := .Metadata}}{{$k}} = {{$v}}<br>{{end}}</td></tr>
+            {{with .Email}}<tr><th>Email</th><td>{{.Status}} to {{.Recipient}} ({{.Attempts}} attempts, updated {{.Updated.Format "2006-01-02 15:04:05"}}){{with .LastError}}<br>Last error: {{.}}{{end}}</td></tr>{{end}}
+        </table>
+        <div class="actions">
+            <form action="{{path "/api/admin/files/"}}{{.ID}}/extend" method="post">
+                <input type="hidden" name="if_match" value="{{.ETag}}">
+                <input type="number" name="ttl" min="1" placeholder="Seconds" required>
+                <input type="submit" value="Extend TTL" class="btn">
+            </form>
+            <form action="{{path "/api/admin/files/"}}{{.ID}}/reset-downloads" method="post">
+                <input type="hidden" name="if_match" value="{{.ETag}}">
+                <input type="submit" value="Reset Downloads" class="btn">
+            </form>
+            <form action="{{path "/api/admin/files/"}}{{.ID}}/set-limit" method="post">
+                <input type="hidden" name="if_match" value="{{.ETag}}">
+                <input type="number" name="max_downloads" min="0" placeholder="Max downloads" required>
+                <input type="submit" value="Set Download Limit" class="btn">
+            </form>
+            <form action="{{path "/api/admin/files/"}}{{.ID}}/set-title" method="post">
+                <input type="hidden" name="if_match" value="{{.ETag}}">
+                <input type="text" name="title" maxlength="200" value="{{.Title}}" placeholder="Title">
+                <input type="submit" value="Set Title" class="btn">
+            </form>
+            {{if eq .Tier "cold"}}<form action="{{path "/api/admin/files/"}}{{.ID}}/rehydrate" method="post">
+                <input type="submit" value="Rehydrate" class="btn">
+            </form>{{else}}<form action="{{path "/api/admin/files/"}}{{.ID}}/archive" method="post">
+                <input type="submit" value="Move to Cold Storage" class="btn">
+            </form>{{end}}
+        </div>
+    </div>
+</body>
+</html>`))
+
+// adminFilePage renders the admin detail view as HTML for the manage UI.
+func (fm *FileManager) adminFilePage(w http.ResponseWriter, r *http.Request) {
+	if !fm.requireRole(w, r, roleViewer) {
+		return
+	}
+
+	fileID, err := pathID(r, "/admin/files/")
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	view, exists := fm.adminFileView(fileID)
+	if !exists {
+		respondError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+	if wantsJSON(r) {
+		respondJSON(w, http.StatusOK, view)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	fm.renderHTML(w, r, adminFileTemplate, view)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AdminUser is a named admin, configured in admins or added through
+// /api/admin/users. Only the bcrypt hash of the password is kept.
+type AdminUser struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	Role         string    `json:"role"`
+	Created      time.Time `json:"created,omitzero"`
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// validate checks a user's fields, not whether the name is taken.
+func (u *AdminUser) validate() error {
+	if !usernamePattern.MatchString(u.Username) {
+		return errors.New("usernames must be 1-64 letters, digits, '.', '_', '@' or '-'")
+	}
+	if roleRanks[u.Role] == 0 {
+		return fmt.Errorf("role must be %s, %s or %s", roleViewer, roleEditor, roleOwner)
+	}
+	if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+		return errors.New("password_hash must be a bcrypt hash")
+	}
+	return nil
+}
+
+type adminUserStore struct {
+	mutex sync.Mutex
+	users map[string]*AdminUser // added through the API, by username
+	// verified remembers the last password that matched each user, as the
+	// SHA-256 of hash and password, since bcrypt is slow by design
+	verified map[string][sha256.Size]byte
+}
+
+func (fm *FileManager) adminUsersFile() string {
+	return fm.config().MetadataFile + ".admins"
+}
+
+func (fm *FileManager) loadAdminUsers() {
+	s := &fm.adminUsers
+	s.users = make(map[string]*AdminUser)
+	s.verified = make(map[string][sha256.Size]byte)
+	data, err := fm.metadata.ReadFile(fm.adminUsersFile())
+	if err != nil {
+		return
+	}
+	var users []*AdminUser
+	if err := json.Unmarshal(data, &users); err != nil {
+		log.Printf("Error loading admin users: %v", err)
+		return
+	}
+	for _, user := range users {
+		s.users[user.Username] = user
+	}
+}
+
+func (fm *FileManager) saveAdminUsers() error {
+	s := &fm.adminUsers
+	s.mutex.Lock()
+	users := make([]*AdminUser, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	s.mutex.Unlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fm.metadata.WriteFile(fm.adminUsersFile(), data, 0600)
+}
+
+// admin returns the configured admin named username, or nil.
+func (c *Config) admin(username string) *AdminUser {
+	for i := range c.Admins {
+		if c.Admins[i].Username == username {
+			return &c.Admins[i]
+		}
+	}
+	return nil
+}
+
+// lookup finds username among the configured admins, which take precedence,
+// then among those added through the API. Callers must hold s.mutex.
+func (s *adminUserStore) lookup(config *Config, username string) (*AdminUser, bool) {
+	if user := config.admin(username); user != nil {
+		return user, true
+	}
+	user, exists := s.users[username]
+	return user, exists
+}
+
+// verify returns the admin user named username if password is theirs.
+func (s *adminUserStore) verify(config *Config, username, password string) *AdminUser {
+	s.mutex.Lock()
+	user, exists := s.lookup(config, username)
+	if !exists {
+		s.mutex.Unlock()
+		return nil
+	}
+	sum := sha256.Sum256([]byte(user.PasswordHash + "\x00" + password))
+	known := s.verified[username] == sum
+	s.mutex.Unlock()
+
+	if !known {
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+			return nil
+		}
+		s.mutex.Lock()
+		s.verified[username] = sum
+		s.mutex.Unlock()
+	}
+	view := *user
+	view.PasswordHash = ""
+	return &view
+}
+
+// adminUsersAPI handles /api/admin/users: GET lists the admins without their
+// password hashes, POST adds one and DELETE /{username} removes one. Admins
+// from config.json are listed with "configured": true and can only be changed
+// there.
+func (fm *FileManager) adminUsersAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	type userView struct {
+		AdminUser
+		Configured bool `json:"configured"`
+	}
+	s := &fm.adminUsers
+	config := fm.config()
+
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		users := []userView{}
+		for _, user := range config.Admins {
+			user.PasswordHash = ""
+			users = append(users, userView{user, true})
+		}
+		s.mutex.Lock()
+		for _, user := range s.users {
+			if config.admin(user.Username) != nil {
+				continue // shadowed by config.json
+			}
+			view := *user
+			view.PasswordHash = ""
+			users = append(users, userView{view, false})
+		}
+		s.mutex.Unlock()
+		sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+		respondJSON(w, http.StatusOK, users)
+
+	case len(parts) == 0 && r.Method == "POST":
+		var request struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondError(w, r, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if len(request.Password) < 8 || len(request.Password) > 72 {
+			respondError(w, r, "password must be 8-72 bytes", http.StatusBadRequest)
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+		if err != nil {
+			respondError(w, r, "Server error", http.StatusInternalServerError)
+			return
+		}
+		user := &AdminUser{Username: request.Username, PasswordHash: string(hash), Role: request.Role, Created: time.Now()}
+		if err := user.validate(); err != nil {
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mutex.Lock()
+		if _, exists := s.lookup(config, user.Username); exists {
+			s.mutex.Unlock()
+			respondError(w, r, "Username is already in use", http.StatusConflict)
+			return
+		}
+		s.users[user.Username] = user
+		s.mutex.Unlock()
+		if err := fm.saveAdminUsers(); err != nil {
+			writeStorageError(w, r, fm.storageFailure(err))
+			return
+		}
+		log.Printf("Admin user %s added with role %s", user.Username, user.Role)
+
+		view := *user
+		view.PasswordHash = ""
+		respondJSON(w, http.StatusCreated, userView{view, false})
+
+	case len(parts) == 1 && r.Method == "DELETE":
+		s.mutex.Lock()
+		_, added := s.users[parts[0]]
+		configured := config.admin(parts[0]) != nil
+		if added && !configured {
+			delete(s.users, parts[0])
+			delete(s.verified, parts[0])
+		}
+		s.mutex.Unlock()
+		switch {
+		case configured:
+			respondError(w, r, "Admins from config.json can only be removed there", http.StatusConflict)
+			return
+		case !added:
+			respondError(w, r, "User not found", http.StatusNotFound)
+			return
+		}
+		if err := fm.saveAdminUsers(); err != nil {
+			writeStorageError(w, r, fm.storageFailure(err))
+			return
+		}
+		log.Printf("Admin user %s removed", parts[0])
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
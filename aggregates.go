@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxAggregates bounds the number of cached aggregates; each distinct
+// filter (API key, hidden tags, tag, type) has its own.
+const maxAggregates = 256
+
+// aggregateCache keeps values derived from all files, such as the stats
+// totals and the tag tree, so listings don't walk every file per request.
+// An entry is current while no file changed since it was computed and it is
+// younger than stats_max_staleness; statuses also change with time alone.
+// While one request recomputes an outdated entry, others get the old value
+// if it is younger than stats_max_staleness rather than waiting for it.
+type aggregateCache struct {
+	generation atomic.Uint64 // bumped on every file change
+	mutex      sync.Mutex
+	entries    map[string]*aggregate
+}
+
+type aggregate struct {
+	value      interface{}
+	generation uint64
+	computed   time.Time
+	refreshing chan struct{} // closed when the recomputation in flight ends
+}
+
+// invalidate marks every cached aggregate as outdated.
+func (c *aggregateCache) invalidate() {
+	c.generation.Add(1)
+}
+
+// aggregate returns the value cached under key, computing it if needed,
+// and its age. With stats_max_staleness 0 nothing is cached.
+func (fm *FileManager) aggregate(key string, compute func() interface{}) (interface{}, time.Duration) {
+	maxStaleness := fm.config().StatsMaxStaleness
+	if maxStaleness <= 0 {
+		return compute(), 0
+	}
+	c := &fm.aggregates
+
+	c.mutex.Lock()
+	for {
+		if c.entries == nil {
+			c.entries = make(map[string]*aggregate)
+		}
+		entry := c.entries[key]
+		if entry == nil {
+			c.pruneLocked(maxStaleness)
+			entry = &aggregate{}
+			c.entries[key] = entry
+		}
+		now := time.Now()
+		age := now.Sub(entry.computed)
+		fresh := entry.value != nil && age < maxStaleness
+		if fresh && entry.generation == c.generation.Load() {
+			c.mutex.Unlock()
+			return entry.value, age
+		}
+		if entry.refreshing != nil {
+			if fresh {
+				c.mutex.Unlock()
+				return entry.value, age
+			}
+			refreshing := entry.refreshing
+			c.mutex.Unlock()
+			<-refreshing
+			c.mutex.Lock()
+			continue
+		}
+
+		entry.refreshing = make(chan struct{})
+		generation := c.generation.Load()
+		c.mutex.Unlock()
+
+		value := compute()
+		c.mutex.Lock()
+		entry.value, entry.generation, entry.computed = value, generation, now
+		close(entry.refreshing)
+		entry.refreshing = nil
+		c.mutex.Unlock()
+		return value, 0
+	}
+}
+
+// pruneLocked drops outdated entries once the cache is full. Callers must
+// hold c.mutex.
+func (c *aggregateCache) pruneLocked(maxStaleness time.Duration) {
+	if len(c.entries) < maxAggregates {
+		return
+	}
+	for key, entry := range c.entries {
+		if entry.refreshing == nil && time.Since(entry.computed) >= maxStaleness {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// cacheKey identifies the files f selects.
+func (f statsFilter) cacheKey() string {
+	var key strings.Builder
+	key.WriteString(f.Tag.Tag + "\x00" + strconv.FormatBool(f.Tag.Subtree) + "\x00" + f.Type + "\x00" + strconv.FormatBool(f.IncludeExpired))
+	if f.Key != nil {
+		key.WriteString("\x00key:" + f.Key.ID + "\x00" + f.Key.Tag)
+	}
+	for _, rule := range f.Hidden {
+		key.WriteString("\x00hidden:" + rule.Tag)
+	}
+	return key.String()
+}
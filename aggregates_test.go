@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAggregateCache(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) { c.StatsMaxStaleness = time.Hour })
+	defer fm.Close()
+	var computed atomic.Int64
+	compute := func() interface{} { return computed.Add(1) }
+
+	if value, age := fm.aggregate("k", compute); value != int64(1) || age != 0 {
+		t.Fatalf("first call: %v, age %v", value, age)
+	}
+	if value, age := fm.aggregate("k", compute); value != int64(1) || age <= 0 {
+		t.Fatalf("unchanged files: %v, age %v, want the cached value", value, age)
+	}
+	if value, _ := fm.aggregate("other", compute); value != int64(2) {
+		t.Fatalf("another key got %v, want its own computation", value)
+	}
+
+	fm.aggregates.invalidate()
+	if value, age := fm.aggregate("k", compute); value != int64(3) || age != 0 {
+		t.Fatalf("after a change: %v, age %v, want a recomputation", value, age)
+	}
+
+	// Past stats_max_staleness values are recomputed even without changes
+	fm.aggregates.mutex.Lock()
+	fm.aggregates.entries["k"].computed = time.Now().Add(-2 * time.Hour)
+	fm.aggregates.mutex.Unlock()
+	if value, _ := fm.aggregate("k", compute); value != int64(4) {
+		t.Fatalf("past max staleness: %v, want a recomputation", value)
+	}
+
+	config := *fm.config()
+	config.StatsMaxStaleness = 0
+	fm.cfg.Store(&config)
+	fm.aggregate("k", compute)
+	fm.aggregate("k", compute)
+	if computed.Load() != 6 {
+		t.Fatalf("%d computations with caching off, want one per call", computed.Load()-4)
+	}
+}
+
+func TestAggregateServedStaleWhileRecomputing(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) { c.StatsMaxStaleness = time.Hour })
+	defer fm.Close()
+	fm.aggregate("k", func() interface{} { return "old" })
+	fm.aggregates.invalidate()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan interface{})
+	go func() {
+		value, _ := fm.aggregate("k", func() interface{} {
+			close(started)
+			<-release
+			return "new"
+		})
+		done <- value
+	}()
+	<-started
+
+	// A second request doesn't wait for the recomputation in flight
+	if value, _ := fm.aggregate("k", func() interface{} {
+		t.Error("computed twice at once")
+		return nil
+	}); value != "old" {
+		t.Errorf("during the recomputation: %v, want the previous value", value)
+	}
+	close(release)
+	if value := <-done; value != "new" {
+		t.Fatalf("recomputation returned %v", value)
+	}
+	if value, _ := fm.aggregate("k", nil); value != "new" {
+		t.Fatalf("after the recomputation: %v", value)
+	}
+
+	// Past max staleness the old value isn't good enough: wait instead
+	fm.aggregates.invalidate()
+	fm.aggregates.mutex.Lock()
+	fm.aggregates.entries["k"].computed = time.Now().Add(-2 * time.Hour)
+	fm.aggregates.mutex.Unlock()
+	started, release = make(chan struct{}), make(chan struct{})
+	go func() {
+		value, _ := fm.aggregate("k", func() interface{} {
+			close(started)
+			<-release
+			return "newer"
+		})
+		done <- value
+	}()
+	<-started
+	waited := make(chan interface{})
+	go func() {
+		value, _ := fm.aggregate("k", nil)
+		waited <- value
+	}()
+	select {
+	case value := <-waited:
+		t.Fatalf("got %v while a recomputation of an expired value was in flight", value)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-done
+	if value := <-waited; value != "newer" {
+		t.Fatalf("waiting request got %v", value)
+	}
+}
+
+func TestAggregateCachePruned(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) { c.StatsMaxStaleness = time.Minute })
+	defer fm.Close()
+	for i := 0; i < maxAggregates; i++ {
+		fm.aggregate(fmt.Sprint(i), func() interface{} { return i })
+	}
+	fm.aggregates.mutex.Lock()
+	for _, entry := range fm.aggregates.entries {
+		entry.computed = time.Now().Add(-time.Hour)
+	}
+	fm.aggregates.mutex.Unlock()
+	fm.aggregate("new", func() interface{} { return 0 })
+	if n := len(fm.aggregates.entries); n != 1 {
+		t.Fatalf("%d entries after pruning, want only the new one", n)
+	}
+}
+
+func TestStatsFollowChanges(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) { c.StatsMaxStaleness = time.Hour })
+	if _, stats := getJSON(t, server, "/stats"); stats["total_files"] != 0.0 {
+		t.Fatalf("empty server: %v", stats)
+	}
+
+	// An upload invalidates the cached totals despite the long staleness
+	status, body := uploadTestFile(t, server, "a.txt", []byte("hello"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	_, stats := getJSON(t, server, "/stats")
+	if stats["total_files"] != 1.0 || stats["total_size"] != 5.0 {
+		t.Fatalf("after an upload: %v", stats)
+	}
+	if _, ok := stats["aggregates_age_seconds"]; !ok {
+		t.Error("admin stats lack aggregates_age_seconds")
+	}
+	downloadStatus(t, server.URL, body["id"].(string), nil)
+	if _, stats := getJSON(t, server, "/stats"); stats["total_downloads"] != 1.0 {
+		t.Fatalf("after a download: %v", stats)
+	}
+}
+
+// BenchmarkStats shows the cost of /stats as the number of files grows,
+// computed on every request and from the aggregate cache.
+func BenchmarkStats(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		for _, staleness := range []time.Duration{0, 2 * time.Second} {
+			name := fmt.Sprintf("files=%d/uncached", n)
+			if staleness > 0 {
+				name = fmt.Sprintf("files=%d/cached", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				fm := NewTestFileManager(func(c *Config) { c.StatsMaxStaleness = staleness })
+				defer fm.Close()
+				seedFiles(fm, "f", n, time.Now())
+				handler := fm.Handler()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions an API key can be scoped to.
+const (
+	scopeUpload   = "upload"
+	scopeDownload = "download"
+	scopeDelete   = "delete"
+	scopeList     = "list"
+)
+
+var validScopes = map[string]bool{scopeUpload: true, scopeDownload: true, scopeDelete: true, scopeList: true}
+
+// apiKeyPrefix marks API keys so they can't be mistaken for the admin
+// password when sent as a bearer token.
+const apiKeyPrefix = "upk_"
+
+// APIKey is a scoped credential. Only the SHA-256 of the key is kept; the
+// key itself is shown once, when it is created.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash,omitempty"`
+	Scopes    []string  `json:"scopes"`
+	Tag       string    `json:"tag,omitempty"`        // uploads gain it; other actions only see files carrying it
+	OwnFiles  bool      `json:"own_files"`            // deletes limited to files uploaded with this key
+	RateLimit int       `json:"rate_limit,omitempty"` // requests per minute, 0 = unlimited
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"last_used,omitempty"`
+	Requests  int64     `json:"requests"`
+}
+
+func (k *APIKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// permits reports whether the key's tag constraint admits fileInfo. A nil
+// key, for requests without one, permits everything.
+func (k *APIKey) permits(fileInfo *FileInfo) bool {
+	return k == nil || k.Tag == "" || hasAnyTag(fileInfo.Tags, []string{k.Tag})
+}
+
+type apiKeyStore struct {
+	mutex   sync.Mutex
+	keys    map[string]*APIKey // by hash
+	dirty   bool
+	limiter listingLimiter
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (fm *FileManager) apiKeysFile() string {
+	return fm.config().MetadataFile + ".keys"
+}
+
+func (fm *FileManager) loadAPIKeys() {
+	s := &fm.apiKeys
+	s.keys = make(map[string]*APIKey)
+	data, err := fm.metadata.ReadFile(fm.apiKeysFile())
+	if err != nil {
+		return
+	}
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		log.Printf("Error loading API keys: %v", err)
+		return
+	}
+	for _, key := range keys {
+		s.keys[key.Hash] = key
+	}
+}
+
+// saveAPIKeys writes the key store if it changed since the last save.
+// Usage counters make it change often, so it is saved with the periodic
+// metadata save rather than on every request.
+func (fm *FileManager) saveAPIKeys() {
+	s := &fm.apiKeys
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return
+	}
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	s.dirty = false
+	s.mutex.Unlock()
+	if err != nil {
+		log.Printf("Error encoding API keys: %v", err)
+		return
+	}
+	if err := fm.metadata.WriteFile(fm.apiKeysFile(), data, 0600); err != nil {
+		log.Printf("Error saving API keys: %v", err)
+	}
+}
+
+// name returns the name of the key with the given ID, or "" if there is
+// none.
+func (s *apiKeyStore) name(id string) string {
+	if id == "" {
+		return ""
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key.Name
+		}
+	}
+	return ""
+}
+
+// sorted returns the keys oldest first. Callers must hold s.mutex.
+func (s *apiKeyStore) sorted() []*APIKey {
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	return keys
+}
+
+// presentedAPIKey returns the API key sent with r as "Authorization: Bearer
+// upk_..." or in X-API-Key, or "" when there is none.
+func presentedAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && strings.HasPrefix(token, apiKeyPrefix) {
+		return token
+	}
+	return ""
+}
+
+// requestKey returns the API key presented with r, or nil when there is none
+// or it is unknown.
+func (fm *FileManager) requestKey(r *http.Request) *APIKey {
+	presented := presentedAPIKey(r)
+	if presented == "" {
+		return nil
+	}
+	s := &fm.apiKeys
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.keys[hashAPIKey(presented)]
+}
+
+// authorizeKey holds a request that carries an API key to the key's scope
+// and rate limit, and counts its use. Requests without a key pass through
+// with a nil key and are subject to the usual rules. It answers the request
+// itself and returns false when the key is unknown (401), lacks scope (403)
+// or is over its limit (429).
+func (fm *FileManager) authorizeKey(w http.ResponseWriter, r *http.Request, scope string) (*APIKey, bool) {
+	presented := presentedAPIKey(r)
+	if presented == "" {
+		return nil, true
+	}
+
+	s := &fm.apiKeys
+	s.mutex.Lock()
+	key := s.keys[hashAPIKey(presented)]
+	if key != nil {
+		key.Requests++
+		key.LastUsed = time.Now()
+		s.dirty = true
+	}
+	s.mutex.Unlock()
+
+	if key == nil {
+		respondError(w, r, "Unknown API key", http.StatusUnauthorized)
+		return nil, false
+	}
+	if !key.allows(scope) {
+		respondError(w, r, fmt.Sprintf("API key lacks the %q scope", scope), http.StatusForbidden)
+		return nil, false
+	}
+	if key.RateLimit > 0 {
+		if ok, retry := s.limiter.allow(key.ID, key.RateLimit, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			respondError(w, r, "Too many requests", http.StatusTooManyRequests)
+			return nil, false
+		}
+	}
+	return key, true
+}
+
+// writeKeyForbidden answers a request for a file outside the key's tag.
+func writeKeyForbidden(w http.ResponseWriter, r *http.Request, key *APIKey) {
+	respondError(w, r, fmt.Sprintf("API key is restricted to files tagged %q", key.Tag), http.StatusForbidden)
+}
+
+// canDelete reports whether key may delete fileInfo.
+func (k *APIKey) canDelete(fileInfo *FileInfo) bool {
+	return k.permits(fileInfo) && (!k.OwnFiles || fileInfo.KeyID == k.ID)
+}
+
+// apiKeysAPI handles /api/admin/keys: GET lists the keys without their
+// hashes, POST creates one and returns it once, DELETE /{id} revokes one.
+func (fm *FileManager) apiKeysAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	s := &fm.apiKeys
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		s.mutex.Lock()
+		keys := make([]APIKey, 0, len(s.keys))
+		for _, key := range s.sorted() {
+			view := *key
+			view.Hash = ""
+			keys = append(keys, view)
+		}
+		s.mutex.Unlock()
+		respondJSON(w, http.StatusOK, keys)
+
+	case len(parts) == 0 && r.Method == "POST":
+		var request struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			Tag       string   `json:"tag"`
+			OwnFiles  bool     `json:"own_files"`
+			RateLimit int      `json:"rate_limit"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			respondError(w, r, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if len(request.Scopes) == 0 {
+			respondError(w, r, "At least one scope is required", http.StatusBadRequest)
+			return
+		}
+		for _, scope := range request.Scopes {
+			if !validScopes[scope] {
+				respondError(w, r, "Unknown scope: "+scope, http.StatusBadRequest)
+				return
+			}
+		}
+		if request.RateLimit < 0 {
+			respondError(w, r, "rate_limit must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		secret := apiKeyPrefix + generateID()
+		key := &APIKey{
+			ID:        generateID()[:12],
+			Name:      request.Name,
+			Hash:      hashAPIKey(secret),
+			Scopes:    request.Scopes,
+			Tag:       request.Tag,
+			OwnFiles:  request.OwnFiles,
+			RateLimit: request.RateLimit,
+			Created:   time.Now(),
+		}
+		s.mutex.Lock()
+		s.keys[key.Hash] = key
+		s.dirty = true
+		s.mutex.Unlock()
+		fm.saveAPIKeys()
+
+		view := *key
+		view.Hash = ""
+		respondJSON(w, http.StatusCreated, struct {
+			APIKey
+			Key string `json:"key"`
+		}{view, secret})
+
+	case len(parts) == 1 && r.Method == "DELETE":
+		s.mutex.Lock()
+		found := false
+		for hash, key := range s.keys {
+			if key.ID == parts[0] {
+				delete(s.keys, hash)
+				found = true
+			}
+		}
+		s.dirty = s.dirty || found
+		s.mutex.Unlock()
+		if !found {
+			respondError(w, r, "Key not found", http.StatusNotFound)
+			return
+		}
+		fm.saveAPIKeys()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// appendLocks serializes appends and finalization per file, so concurrent
+// PATCH requests to the same file can't interleave their bytes.
+type appendLocks struct {
+	mutex sync.Mutex
+	files map[string]*appendLock
+}
+
+type appendLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock waits for the file's append lock and returns its release.
+func (a *appendLocks) lock(fileID string) func() {
+	a.mutex.Lock()
+	if a.files == nil {
+		a.files = make(map[string]*appendLock)
+	}
+	l := a.files[fileID]
+	if l == nil {
+		l = &appendLock{}
+		a.files[fileID] = l
+	}
+	l.users++
+	a.mutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		a.mutex.Lock()
+		if l.users--; l.users == 0 {
+			delete(a.files, fileID)
+		}
+		a.mutex.Unlock()
+	}
+}
+
+// parseAppendRange reads a Content-Range header of the form
+// "bytes <first>-<last>/<total or *>" and returns the offset and length of
+// the bytes it announces.
+func parseAppendRange(header string) (offset, length int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, errors.New("Content-Range must be in bytes")
+	}
+	span, _, _ := strings.Cut(spec, "/")
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, errors.New("invalid Content-Range")
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return 0, 0, errors.New("invalid Content-Range")
+	}
+	return start, end - start + 1, nil
+}
+
+// putHandler serves /put/{id}: PATCH appends to a file uploaded with
+// appendable=true, POST /put/{id}/finalize closes it for appends and records
+// its checksum.
+func (fm *FileManager) putHandler(w http.ResponseWriter, r *http.Request) {
+	parts, err := pathSegments(r, "/put/")
+	if err != nil || len(parts) == 0 || len(parts) > 2 {
+		respondError(w, r, "malformed path: expected /put/{id} or /put/{id}/finalize", http.StatusBadRequest)
+		return
+	}
+	fileID, action := parts[0], ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == "PATCH":
+		fm.appendFile(w, r, fileID)
+	case action == "finalize" && r.Method == "POST":
+		fm.finalizeFile(w, r, fileID)
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// appendTarget looks up a file the request may append to: with an API key
+// the key must have the upload scope and may only touch files it could
+// delete, without one the request needs admin rights. An If-Match header
+// must name the current revision; appends and finalizing hold the file's
+// append lock, so no other content change can slip in after the check. It
+// writes the error response and returns nil otherwise.
+func (fm *FileManager) appendTarget(w http.ResponseWriter, r *http.Request, fileID string) *FileInfo {
+	key, ok := fm.authorizeKey(w, r, scopeUpload)
+	if !ok {
+		return nil
+	}
+	if key == nil && !fm.requireRole(w, r, roleEditor) {
+		return nil
+	}
+
+	fm.mutex.RLock()
+	fileInfo, exists := fm.files[fileID]
+	var precondition error
+	if exists {
+		precondition = fm.checkIfMatch(r.Header.Get("If-Match"), fileInfo)
+	}
+	fm.mutex.RUnlock()
+	switch {
+	case !exists:
+		writeDownloadError(w, r, fm.missingFileError(fileID))
+	case key != nil && !key.canDelete(fileInfo):
+		respondError(w, r, "API key may not modify this file", http.StatusForbidden)
+	case fileInfo.Status() == StatusExpired:
+		writeDownloadError(w, r, errFileExpired)
+	case !fileInfo.Appendable:
+		respondError(w, r, "File is not open for appends", http.StatusConflict)
+	case precondition != nil:
+		writePreconditionError(w, r, precondition)
+	default:
+		return fileInfo
+	}
+	return nil
+}
+
+// appendFile handles PATCH /put/{id}. The body is appended at the offset
+// given by Content-Range, which must be the current size so a retried
+// request can't add its bytes twice, or at the end with append=true.
+func (fm *FileManager) appendFile(w http.ResponseWriter, r *http.Request, fileID string) {
+	unlock := fm.appendLocks.lock(fileID)
+	defer unlock()
+
+	fileInfo := fm.appendTarget(w, r, fileID)
+	if fileInfo == nil {
+		return
+	}
+	w.Header().Set("X-Append-Offset", strconv.FormatInt(fileInfo.Size, 10))
+
+	expected := int64(-1)
+	if header := r.Header.Get("Content-Range"); header != "" {
+		offset, length, err := parseAppendRange(header)
+		if err != nil {
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if offset != fileInfo.Size {
+			respondError(w, r, fmt.Sprintf("Appends must start at the current size, %d", fileInfo.Size), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		expected = length
+	} else if r.URL.Query().Get("append") != "true" {
+		respondError(w, r, "Content-Range or append=true required", http.StatusBadRequest)
+		return
+	}
+
+	// The file may grow to max_file_size and within max_total_size. The room
+	// under max_total_size is reserved, so concurrent appends and uploads
+	// can't both count on it; a body with a length needs no more than that.
+	room := max(fm.config().MaxFileSize-fileInfo.Size, 0)
+	limitErr := errFileTooLarge
+	want := room
+	if r.ContentLength >= 0 {
+		want = min(want, r.ContentLength)
+	}
+	reservation := fm.reserveRoom(want)
+	defer fm.releaseStorage(reservation)
+	if fm.config().MaxTotalSize > 0 && reservation.size < want {
+		room, limitErr = reservation.size, errStorageFull
+	}
+
+	f, err := fm.storage.OpenFile(fileInfo.StorageKey, os.O_WRONLY, 0)
+	if err != nil {
+		writeStorageError(w, r, fm.storageFailure(err))
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(fileInfo.Size, io.SeekStart); err != nil {
+		writeStorageError(w, r, fm.storageFailure(err))
+		return
+	}
+
+	written, err := io.Copy(f, io.LimitReader(newContextReader(r.Context(), r.Body), room+1))
+	if err == nil && written > room {
+		err = limitErr
+	}
+	short := err == nil && expected >= 0 && written != expected
+	if err != nil || short {
+		// Drop the partial append so the file stays as it was
+		if truncErr := f.Truncate(fileInfo.Size); truncErr != nil {
+			log.Printf("Error rolling back append to %s: %v", fileID, truncErr)
+		}
+		if short {
+			respondError(w, r, fmt.Sprintf("Content-Range announced %d bytes, got %d", expected, written), http.StatusBadRequest)
+		} else {
+			fm.writeUploadError(w, r, fileInfo.OriginalName, err)
+		}
+		return
+	}
+
+	// The checksum no longer matches; finalize computes the new one
+	fm.mutex.Lock()
+	fileInfo.Size += written
+	fm.takeReservation(reservation, written)
+	fileInfo.Checksum = ""
+	fm.recordChange(changeUpdated, fileID, fileInfo)
+	size, etag := fileInfo.Size, fileInfo.ETag()
+	fm.mutex.Unlock()
+	fm.cache.invalidate(fileID)
+	fm.requestSave()
+	fm.checkStorageThresholds()
+	fm.recordEvent(r, "append", fileInfo, fileID, "ok")
+
+	w.Header().Set("X-Append-Offset", strconv.FormatInt(size, 10))
+	w.Header().Set("ETag", etag)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"id":       fileID,
+		"appended": written,
+		"size":     size,
+	})
+}
+
+// finalizeFile handles POST /put/{id}/finalize: it computes the checksum of
+// the whole file, verifies it against an optional checksum= and closes the
+// file for further appends.
+func (fm *FileManager) finalizeFile(w http.ResponseWriter, r *http.Request, fileID string) {
+	unlock := fm.appendLocks.lock(fileID)
+	defer unlock()
+
+	fileInfo := fm.appendTarget(w, r, fileID)
+	if fileInfo == nil {
+		return
+	}
+
+	var expected string
+	if raw := r.FormValue("checksum"); raw != "" {
+		normalized, err := normalizeChecksum(raw)
+		if err != nil {
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		expected = normalized
+	}
+
+	f, err := fm.openContent(fileInfo)
+	if err != nil {
+		writeStorageError(w, r, fm.storageFailure(err))
+		return
+	}
+	defer f.Close()
+	checksum, err := fm.calculateChecksum(newContextReader(r.Context(), f))
+	if err == nil {
+		err = verifyChecksum(f, checksum, expected)
+	}
+	if err == nil {
+		err = fm.checkBlocked(checksum, fileInfo.OriginalName, fm.clientIP(r))
+		if err != nil {
+			fm.removeFile(r, fileID)
+		}
+	}
+	if err != nil {
+		fm.writeUploadError(w, r, fileInfo.OriginalName, err)
+		return
+	}
+
+	fm.mutex.Lock()
+	fileInfo.Checksum = checksum
+	fileInfo.Appendable = false
+	fm.recordChange(changeUpdated, fileID, fileInfo)
+	fm.mutex.Unlock()
+	fm.requestSave()
+	fm.recordEvent(r, "finalize", fileInfo, fileID, "ok")
+
+	fm.writeUploadResponse(w, r, fileInfo)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Admin roles, from least to most privileged. Viewers see listings, stats,
+// file details and the activity log; editors can also change and delete
+// files; owners can also manage API keys, bans, protected tags, admin users,
+// backups and the configuration.
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{roleViewer: 1, roleEditor: 2, roleOwner: 3}
+
+// passwordAdmin is who presents admin_password: an owner, since the shared
+// password predates roles.
+var passwordAdmin = AdminUser{Username: "admin", Role: roleOwner}
+
+// isAdmin reports whether the request carries admin credentials, either as
+// HTTP Basic auth or as a bearer token. When require_password is off the
+// management surface is open, as it always was.
+func (fm *FileManager) isAdmin(r *http.Request) bool {
+	if !fm.config().RequirePassword {
+		return true
+	}
+	return fm.hasAdminCredentials(r)
+}
+
+// hasAdminCredentials reports whether the request authenticates as an admin
+// of any role, regardless of require_password.
+func (fm *FileManager) hasAdminCredentials(r *http.Request) bool {
+	return fm.authenticateAdmin(r) != nil
+}
+
+// authenticateAdmin returns the admin the request authenticates as, or nil.
+// Admin users sign in with HTTP Basic auth or through /login; admin_password
+// is accepted as the Basic auth password with any username, or as a bearer
+// token. Credentials from a client IP throttled by login_rate_limit are not
+// checked at all, so they can't be guessed through any route.
+func (fm *FileManager) authenticateAdmin(r *http.Request) *AdminUser {
+	if r.Header.Get("Authorization") != "" {
+		if throttled, _ := fm.loginThrottled(r); throttled {
+			return nil
+		}
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if fm.adminPasswordMatches(token) {
+			return &passwordAdmin
+		}
+		return nil
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		return fm.checkLogin(username, password)
+	}
+	return fm.sessionAdmin(r)
+}
+
+func (fm *FileManager) adminPasswordMatches(password string) bool {
+	if fm.config().AdminPassword == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(fm.config().AdminPassword)) == 1
+}
+
+// requireRole is the authorization check of every admin route. It writes a
+// 401 challenge when the request doesn't authenticate as an admin, or 403
+// when the admin's role ranks below role, and returns false in both cases.
+// Browsers are sent to /login instead of being challenged. Wrong credentials
+// count against login_rate_limit, after which the client IP gets 429 until
+// the minute is over. When require_password is off the management surface
+// is open.
+func (fm *FileManager) requireRole(w http.ResponseWriter, r *http.Request, role string) bool {
+	if !fm.config().RequirePassword {
+		return true
+	}
+	presented := r.Header.Get("Authorization") != ""
+	if presented && !fm.loginAllowed(w, r) {
+		return false
+	}
+	admin := fm.authenticateAdmin(r)
+	if admin == nil {
+		if presented {
+			fm.loginFailed(r)
+		} else if r.Method == "GET" && wantsHTML(r) {
+			fm.loginRedirect(w, r)
+			return false
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="uploads admin"`)
+		respondError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if roleRanks[admin.Role] < roleRanks[role] {
+		respondError(w, r, fmt.Sprintf("Requires the %s role", role), http.StatusForbidden)
+		return false
+	}
+	return true
+}
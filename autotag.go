@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// autoTagKey is the metadata key listing the auto_tag_rules that tagged an
+// upload, so it can be traced why a file carries a tag nobody sent.
+const autoTagKey = "auto_tag_rules"
+
+// AutoTagRule adds Tags to uploads that meet every condition it sets, so
+// tags such as the network an upload came from don't depend on clients
+// sending them.
+type AutoTagRule struct {
+	Name        string   `json:"name"`         // recorded in the metadata; defaults to its position, e.g. #1
+	CIDR        string   `json:"cidr"`         // client address, a CIDR range or a single IP
+	ContentType string   `json:"content_type"` // prefix of the declared or the sniffed type
+	Filename    string   `json:"filename"`     // glob on the file name, case-insensitive
+	APIKey      string   `json:"api_key"`      // ID of the API key used for the upload
+	Tags        []string `json:"tags"`
+}
+
+// autoTagSubject is what auto_tag_rules match an upload on.
+type autoTagSubject struct {
+	ip       net.IP
+	types    []string // declared and sniffed content type
+	filename string   // lowercased
+	keyID    string
+}
+
+// validate checks the rule at position i of auto_tag_rules.
+func (rule AutoTagRule) validate(i int) error {
+	label := rule.label(i)
+	if strings.Contains(rule.Name, ",") {
+		return fmt.Errorf("auto_tag_rules %s: the name must not contain commas", label)
+	}
+	if rule.CIDR == "" && rule.ContentType == "" && rule.Filename == "" && rule.APIKey == "" {
+		return fmt.Errorf("auto_tag_rules %s: set at least one of cidr, content_type, filename or api_key", label)
+	}
+	if rule.CIDR != "" && rule.network() == nil {
+		return fmt.Errorf("auto_tag_rules %s: invalid cidr %q", label, rule.CIDR)
+	}
+	if _, err := path.Match(strings.ToLower(rule.Filename), ""); err != nil {
+		return fmt.Errorf("auto_tag_rules %s: invalid filename pattern %q", label, rule.Filename)
+	}
+	if len(normalizeTags(rule.Tags)) == 0 {
+		return fmt.Errorf("auto_tag_rules %s: tags must not be empty", label)
+	}
+	return nil
+}
+
+// label names the rule at position i in metadata and errors.
+func (rule AutoTagRule) label(i int) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// network parses CIDR, taking a plain IP as a range of one address.
+func (rule AutoTagRule) network() *net.IPNet {
+	if _, network, err := net.ParseCIDR(rule.CIDR); err == nil {
+		return network
+	}
+	ip := net.ParseIP(rule.CIDR)
+	if ip == nil {
+		return nil
+	}
+	bits := 8 * net.IPv6len
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits = v4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func (rule AutoTagRule) matches(subject autoTagSubject) bool {
+	if rule.CIDR != "" {
+		network := rule.network()
+		if subject.ip == nil || network == nil || !network.Contains(subject.ip) {
+			return false
+		}
+	}
+	if rule.ContentType != "" {
+		prefix := strings.ToLower(rule.ContentType)
+		matched := false
+		for _, contentType := range subject.types {
+			matched = matched || strings.HasPrefix(strings.ToLower(contentType), prefix)
+		}
+		if !matched {
+			return false
+		}
+	}
+	if rule.Filename != "" {
+		if ok, _ := path.Match(strings.ToLower(rule.Filename), subject.filename); !ok {
+			return false
+		}
+	}
+	return rule.APIKey == "" || rule.APIKey == subject.keyID
+}
+
+// applyAutoTags adds the tags of the auto_tag_rules that match an upload of
+// part, stored as filename, and records the rules under autoTagKey. A value
+// for that key sent by the client is dropped, as it would claim rules that
+// never ran.
+func (fm *FileManager) applyAutoTags(part File, req uploadRequest, filename string, tags []string, metadata map[string]string) []string {
+	delete(metadata, autoTagKey)
+	rules := fm.config().AutoTagRules
+	if len(rules) == 0 {
+		return tags
+	}
+
+	subject := autoTagSubject{
+		ip:       net.ParseIP(uploaderHost(req.UploaderIP)),
+		filename: strings.ToLower(path.Base(filename)),
+		keyID:    req.KeyID,
+	}
+	if !vagueContentType(req.ContentType) {
+		subject.types = append(subject.types, req.ContentType)
+	} else if byExt := mime.TypeByExtension(path.Ext(subject.filename)); byExt != "" {
+		subject.types = append(subject.types, byExt)
+	}
+	head := make([]byte, 512)
+	if n, _ := part.ReadAt(head, 0); n > 0 {
+		subject.types = append(subject.types, http.DetectContentType(head[:n]))
+	}
+
+	var applied []string
+	for i, rule := range rules {
+		if !rule.matches(subject) {
+			continue
+		}
+		applied = append(applied, rule.label(i))
+		for _, tag := range normalizeTags(rule.Tags) {
+			if !hasAnyTag(tags, []string{tag}) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(applied) > 0 {
+		metadata[autoTagKey] = strings.Join(applied, ",")
+	}
+	return tags
+}
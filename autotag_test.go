@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestAutoTagRuleMatches(t *testing.T) {
+	subject := autoTagSubject{
+		ip:       net.ParseIP("10.1.2.3"),
+		types:    []string{"application/octet-stream", "image/png"},
+		filename: "scan-0042.png",
+		keyID:    "key1",
+	}
+	tests := []struct {
+		name string
+		rule AutoTagRule
+		want bool
+	}{
+		{"cidr inside", AutoTagRule{CIDR: "10.0.0.0/8"}, true},
+		{"cidr outside", AutoTagRule{CIDR: "192.168.0.0/16"}, false},
+		{"single ip", AutoTagRule{CIDR: "10.1.2.3"}, true},
+		{"other single ip", AutoTagRule{CIDR: "10.1.2.4"}, false},
+		{"ipv6 range", AutoTagRule{CIDR: "fd00::/8"}, false},
+		{"content type prefix", AutoTagRule{ContentType: "image/"}, true},
+		{"content type case-insensitive", AutoTagRule{ContentType: "IMAGE/PNG"}, true},
+		{"content type of neither", AutoTagRule{ContentType: "video/"}, false},
+		{"filename glob", AutoTagRule{Filename: "scan-*.png"}, true},
+		{"filename glob case-insensitive", AutoTagRule{Filename: "SCAN-*.PNG"}, true},
+		{"filename glob mismatch", AutoTagRule{Filename: "*.pdf"}, false},
+		{"api key", AutoTagRule{APIKey: "key1"}, true},
+		{"other api key", AutoTagRule{APIKey: "key2"}, false},
+		{"all conditions", AutoTagRule{CIDR: "10.1.0.0/16", ContentType: "image/", Filename: "*.png", APIKey: "key1"}, true},
+		{"one condition fails", AutoTagRule{CIDR: "10.1.0.0/16", ContentType: "image/", Filename: "*.png", APIKey: "key2"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.matches(subject); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if (AutoTagRule{CIDR: "10.0.0.0/8"}).matches(autoTagSubject{}) {
+		t.Error("cidr rule matched an upload without a client address")
+	}
+	if (AutoTagRule{APIKey: "key1"}).matches(autoTagSubject{}) {
+		t.Error("api_key rule matched an upload without a key")
+	}
+}
+
+func TestApplyAutoTags(t *testing.T) {
+	rules := []AutoTagRule{
+		{Name: "office", CIDR: "10.0.0.0/8", Tags: []string{"internal"}},
+		{ContentType: "image/", Tags: []string{"Images", "internal"}},
+		{Filename: "*.pdf", Tags: []string{"docs"}},
+		{APIKey: "ci", Tags: []string{"build"}},
+	}
+	fm := NewTestFileManager(func(c *Config) { c.AutoTagRules = rules })
+	defer fm.Close()
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	tests := []struct {
+		name     string
+		content  []byte
+		req      uploadRequest
+		filename string
+		tags     []string
+		metadata map[string]string
+		wantTags []string
+		wantKey  string
+	}{
+		{
+			name:     "nothing matches",
+			content:  []byte("plain text"),
+			req:      uploadRequest{UploaderIP: "192.168.1.5:4000", ContentType: "text/plain"},
+			filename: "notes.txt",
+			tags:     []string{"mine"},
+			wantTags: []string{"mine"},
+		},
+		{
+			name:     "cidr on host and port",
+			content:  []byte("plain text"),
+			req:      uploadRequest{UploaderIP: "10.4.4.4:4000", ContentType: "text/plain"},
+			filename: "notes.txt",
+			wantTags: []string{"internal"},
+			wantKey:  "office",
+		},
+		{
+			name:     "sniffed type and tags not repeated",
+			content:  png,
+			req:      uploadRequest{UploaderIP: "10.4.4.4", ContentType: "application/octet-stream"},
+			filename: "upload",
+			tags:     []string{"internal"},
+			wantTags: []string{"internal", "Images"},
+			wantKey:  "office,#2",
+		},
+		{
+			name:     "type from the extension",
+			content:  []byte("%PDF-1.7"),
+			req:      uploadRequest{UploaderIP: "172.16.0.1", ContentType: "application/octet-stream"},
+			filename: "dir/Report.PDF",
+			wantTags: []string{"docs"},
+			wantKey:  "#3",
+		},
+		{
+			name:     "api key",
+			content:  []byte("artifact"),
+			req:      uploadRequest{UploaderIP: "172.16.0.1", ContentType: "application/zip", KeyID: "ci"},
+			filename: "build.zip",
+			wantTags: []string{"build"},
+			wantKey:  "#4",
+		},
+		{
+			name:     "client value for the key dropped",
+			content:  []byte("plain text"),
+			req:      uploadRequest{UploaderIP: "172.16.0.1", ContentType: "text/plain"},
+			filename: "notes.txt",
+			metadata: map[string]string{autoTagKey: "office", "project": "x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part, err := os.CreateTemp(t.TempDir(), "part")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer part.Close()
+			part.Write(tt.content)
+
+			metadata := tt.metadata
+			if metadata == nil {
+				metadata = map[string]string{}
+			}
+			tags := fm.applyAutoTags(part, tt.req, tt.filename, tt.tags, metadata)
+			if !slices.Equal(tags, tt.wantTags) {
+				t.Errorf("tags = %q, want %q", tags, tt.wantTags)
+			}
+			if got, ok := metadata[autoTagKey]; got != tt.wantKey || ok != (tt.wantKey != "") {
+				t.Errorf("metadata[%s] = %q (set %v), want %q", autoTagKey, got, ok, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestUploadRecordsAutoTags(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) {
+		c.AutoTagRules = []AutoTagRule{{Name: "loopback", CIDR: "127.0.0.0/8", Tags: []string{"local"}}}
+	})
+
+	status, uploaded := uploadTestFile(t, server, "a.txt", []byte("hello"), url.Values{"metadata": {`{"` + autoTagKey + `":"forged"}`}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	status, info := getJSON(t, server, "/info/"+uploaded["id"].(string))
+	if status != http.StatusOK {
+		t.Fatalf("info: status %d, body %v", status, info)
+	}
+	if tags, _ := info["tags"].([]interface{}); len(tags) != 1 || tags[0] != "local" {
+		t.Errorf("tags = %v, want [local]", info["tags"])
+	}
+	if metadata, _ := info["metadata"].(map[string]interface{}); metadata[autoTagKey] != "loopback" {
+		t.Errorf("metadata = %v, want %s=loopback", info["metadata"], autoTagKey)
+	}
+}
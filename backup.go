@@ -0,0 +1,459 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	jobRunners["backup"] = runBackup
+}
+
+// BackupConfig is the backup section of the configuration.
+type BackupConfig struct {
+	Schedule       string `json:"schedule"`         // a duration such as "6h", or a cron spec "m h dom mon dow"; empty disables scheduled backups
+	Dir            string `json:"dir"`              // where archives are written
+	Retention      int    `json:"retention"`        // archives kept, 0 keeps all
+	BytesPerSecond int64  `json:"bytes_per_second"` // read throttle, 0 = unlimited
+}
+
+// backupMetadataName is the archive entry holding the metadata of the
+// files in it, in the format of metadata_file. Content is stored under
+// files/ by storage key.
+const backupMetadataName = "metadata.json"
+
+// BackupStatus reports the outcome of the latest backups, for /api/health.
+type BackupStatus struct {
+	Schedule    string     `json:"schedule,omitempty"`
+	NextRun     *time.Time `json:"next_run,omitempty"`
+	Running     bool       `json:"running"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastArchive string     `json:"last_archive,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// failing reports whether the latest backup attempt failed.
+func (s BackupStatus) failing() bool {
+	return s.LastErrorAt != nil && (s.LastSuccess == nil || s.LastErrorAt.After(*s.LastSuccess))
+}
+
+type backupState struct {
+	mutex  sync.Mutex
+	status BackupStatus
+	run    sync.Mutex // held while a backup is being written
+}
+
+func (fm *FileManager) backupStatus() BackupStatus {
+	fm.backups.mutex.Lock()
+	defer fm.backups.mutex.Unlock()
+	status := fm.backups.status
+	status.Schedule = fm.config().Backup.Schedule
+	return status
+}
+
+// backupSchedule yields the times scheduled backups run at.
+type backupSchedule interface {
+	next(after time.Time) time.Time
+}
+
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) next(after time.Time) time.Time {
+	return after.Add(time.Duration(s))
+}
+
+// cronSchedule is a five-field cron spec: minute, hour, day of month, month
+// and day of week (0 = Sunday), each *, */n, a number, a range a-b, or a
+// comma-separated list of those. As in cron, a day matches when either day
+// field does if both are restricted.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+// parseBackupSchedule reads backup.schedule, returning nil when it is empty.
+func parseBackupSchedule(spec string) (backupSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d < time.Minute {
+			return nil, fmt.Errorf("backup schedule %q: the interval must be at least a minute", spec)
+		}
+		return intervalSchedule(d), nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("backup schedule %q: want a duration such as 6h or a cron spec with 5 fields", spec)
+	}
+	ranges := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	var sets [5]map[int]bool
+	for i, field := range fields {
+		set, err := parseCronField(field, ranges[i][0], ranges[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("backup schedule %q: %w", spec, err)
+		}
+		sets[i] = set
+	}
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, low, high int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if base, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part, step = base, n
+		}
+		from, to := low, high
+		if part != "*" {
+			a, b, isRange := strings.Cut(part, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			}
+			if from < low || to > high || from > to {
+				return nil, fmt.Errorf("%q is outside %d-%d", part, low, high)
+			}
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (s *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// Every valid spec matches at least once in four years
+	for limit := t.AddDate(4, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if !s.month[int(t.Month())] || !s.hour[t.Hour()] || !s.minute[t.Minute()] {
+			continue
+		}
+		domMatch, dowMatch := s.dom[t.Day()], s.dow[int(t.Weekday())]
+		switch {
+		case s.domAny && s.dowAny,
+			s.domAny && dowMatch,
+			s.dowAny && domMatch,
+			!s.domAny && !s.dowAny && (domMatch || dowMatch):
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// backupRoutine runs scheduled backups. It rereads backup.schedule after
+// every run, so a reload takes effect from the next one.
+func (fm *FileManager) backupRoutine() {
+	for {
+		schedule, err := parseBackupSchedule(fm.config().Backup.Schedule)
+		if err != nil || schedule == nil {
+			if !fm.sleep(time.Minute) {
+				return
+			}
+			continue
+		}
+		next := schedule.next(time.Now())
+		if next.IsZero() {
+			if !fm.sleep(time.Minute) {
+				return
+			}
+			continue
+		}
+		fm.backups.mutex.Lock()
+		fm.backups.status.NextRun = &next
+		fm.backups.mutex.Unlock()
+
+		if !fm.sleep(time.Until(next)) {
+			return
+		}
+		fm.startJob("backup", nil)
+	}
+}
+
+// runBackup writes a snapshot archive to backup.dir, verifies it and
+// rotates old archives. Failures are reported to the notify webhook.
+func runBackup(fm *FileManager, job *Job, params map[string]string) error {
+	path, err := fm.writeBackupArchive(job)
+	now := time.Now()
+	fm.backups.mutex.Lock()
+	if err != nil {
+		fm.backups.status.LastError, fm.backups.status.LastErrorAt = err.Error(), &now
+	} else {
+		fm.backups.status.LastSuccess, fm.backups.status.LastArchive = &now, path
+	}
+	fm.backups.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Backup failed: %v", err)
+		fm.notify("backup_failed", map[string]interface{}{
+			"error": err.Error(),
+			"dir":   fm.config().Backup.Dir,
+		})
+		return err
+	}
+	log.Printf("Backup written to %s", path)
+	fm.rotateBackups()
+	return nil
+}
+
+func (fm *FileManager) writeBackupArchive(job *Job) (string, error) {
+	// One backup at a time; a run that finds another in progress waits
+	fm.backups.run.Lock()
+	defer fm.backups.run.Unlock()
+	fm.backups.mutex.Lock()
+	fm.backups.status.Running = true
+	fm.backups.mutex.Unlock()
+	defer func() {
+		fm.backups.mutex.Lock()
+		fm.backups.status.Running = false
+		fm.backups.mutex.Unlock()
+	}()
+
+	dir := fm.config().Backup.Dir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := "backup-" + time.Now().UTC().Format("20060102T150405.000Z") + ".tar.gz"
+	path := filepath.Join(dir, name)
+	temp := path + ".tmp"
+	f, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	entries, err := fm.writeBackup(f, job)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verifyBackup(temp, entries)
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return "", err
+	}
+	return path, nil
+}
+
+// writeBackup writes a tar.gz snapshot of every file and its metadata to w
+// and returns the number of archive entries. The metadata is copied in
+// small batches under the read lock, like cleanup, and the content is read
+// without holding it, throttled to backup.bytes_per_second. Files removed
+// while the backup runs are left out of both. job may be nil.
+func (fm *FileManager) writeBackup(w io.Writer, job *Job) (int, error) {
+	fm.mutex.RLock()
+	ids := make([]string, 0, len(fm.files))
+	for id := range fm.files {
+		ids = append(ids, id)
+	}
+	fm.mutex.RUnlock()
+	sort.Strings(ids)
+	if job != nil {
+		job.setTotal(len(ids))
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	stored := make(map[string]json.RawMessage, len(ids))
+	entries := 0
+	rate := fm.config().Backup.BytesPerSecond
+
+	for start := 0; start < len(ids); start += cleanupBatchSize {
+		batch := ids[start:min(start+cleanupBatchSize, len(ids))]
+		type item struct {
+			info *FileInfo
+			data json.RawMessage
+		}
+		var items []item
+		fm.mutex.RLock()
+		for _, id := range batch {
+			fileInfo, exists := fm.files[id]
+			if !exists {
+				continue
+			}
+			data, err := json.Marshal((*storedFileInfo)(fileInfo))
+			if err != nil {
+				fm.mutex.RUnlock()
+				return entries, err
+			}
+			copied := *fileInfo
+			items = append(items, item{&copied, data})
+		}
+		fm.mutex.RUnlock()
+
+		for _, it := range items {
+			err := fm.backupContent(tw, it.info, rate)
+			if errors.Is(err, os.ErrNotExist) {
+				// Removed since the batch was copied
+				if job != nil {
+					job.advance(nil)
+				}
+				continue
+			}
+			if job != nil {
+				job.advance(err)
+			}
+			if err != nil {
+				return entries, fmt.Errorf("backing up %s: %w", it.info.ID, err)
+			}
+			if !it.info.isLink() {
+				entries++
+			}
+			stored[it.info.ID] = it.data
+		}
+	}
+
+	metadata, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return entries, err
+	}
+	header := &tar.Header{Name: backupMetadataName, Mode: 0644, Size: int64(len(metadata)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return entries, err
+	}
+	if _, err := tw.Write(metadata); err != nil {
+		return entries, err
+	}
+	entries++
+	if err := tw.Close(); err != nil {
+		return entries, err
+	}
+	return entries, gz.Close()
+}
+
+// backupContent adds the content of one file under files/. Links have none.
+func (fm *FileManager) backupContent(tw *tar.Writer, fileInfo *FileInfo, rate int64) error {
+	if fileInfo.isLink() {
+		return nil
+	}
+	src, err := fm.openContent(fileInfo)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    "files/" + fileInfo.StorageKey,
+		Mode:    0644,
+		Size:    stat.Size(),
+		ModTime: fileInfo.UploadTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, newThrottledReader(src, rate), stat.Size())
+	return err
+}
+
+// verifyBackup reads an archive back to the end, checking that it
+// decompresses and holds the expected number of entries including the
+// metadata.
+func verifyBackup(path string, want int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("verifying backup: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	entries, hasMetadata := 0, false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("verifying backup: %w", err)
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return fmt.Errorf("verifying backup: %s: %w", header.Name, err)
+		}
+		entries++
+		hasMetadata = hasMetadata || header.Name == backupMetadataName
+	}
+	switch {
+	case !hasMetadata:
+		return fmt.Errorf("verifying backup: %s is missing", backupMetadataName)
+	case entries != want:
+		return fmt.Errorf("verifying backup: found %d entries, wrote %d", entries, want)
+	}
+	return nil
+}
+
+// rotateBackups removes the oldest archives in backup.dir beyond
+// backup.retention.
+func (fm *FileManager) rotateBackups() {
+	config := fm.config().Backup
+	if config.Retention <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(config.Dir, "backup-*.tar.gz"))
+	if err != nil || len(matches) <= config.Retention {
+		return
+	}
+	// The timestamp in the name sorts chronologically
+	sort.Strings(matches)
+	for _, old := range matches[:len(matches)-config.Retention] {
+		if err := os.Remove(old); err != nil {
+			log.Printf("Error removing old backup %s: %v", old, err)
+		} else {
+			log.Printf("Removed old backup %s", old)
+		}
+	}
+}
+
+// backupAPI handles /api/admin/backup: GET streams a snapshot archive, POST
+// writes one to backup.dir as a background job.
+func (fm *FileManager) backupAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", attachmentDisposition("backup-"+time.Now().UTC().Format("20060102T150405Z")+".tar.gz"))
+		if _, err := fm.writeBackup(w, nil); err != nil {
+			// Too late for an error status; the truncated archive fails to unpack
+			log.Printf("Error streaming backup: %v", err)
+		}
+	case "POST":
+		fm.writeJobAccepted(w, fm.startJob("backup", nil))
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxBatchInfoIDs is the most file IDs one POST /api/files/info may ask for.
+const maxBatchInfoIDs = 500
+
+// batchFileInfo handles POST /api/files/info: {"file_ids": [...]} answers
+// with the /info details of every file found, keyed by ID, and the IDs that
+// weren't, so dashboards don't need a request per file. As with /info,
+// admins get the admin view, and files /info hides are reported as not
+// found. IDs are looked up in one pass under the read
+// lock, so the answer is a consistent snapshot.
+func (fm *FileManager) batchFileInfo(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		FileIDs []string `json:"file_ids"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		respondError(w, r, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(request.FileIDs) > maxBatchInfoIDs {
+		respondError(w, r, fmt.Sprintf("At most %d file_ids per request", maxBatchInfoIDs), http.StatusBadRequest)
+		return
+	}
+
+	admin := fm.hasAdminCredentials(r)
+	filter := fm.infoFilter(r)
+	files := make(map[string]json.RawMessage, len(request.FileIDs))
+	notFound := []string{}
+	seen := make(map[string]bool, len(request.FileIDs))
+	var err error
+	fm.mutex.RLock()
+	for _, fileID := range request.FileIDs {
+		if seen[fileID] {
+			continue
+		}
+		seen[fileID] = true
+		fileInfo, exists := fm.files[fileID]
+		if !exists || !filter.shows(fileInfo) {
+			notFound = append(notFound, fileID)
+			continue
+		}
+		if files[fileID], err = fileInfo.marshalView(admin); err != nil {
+			break
+		}
+	}
+	fm.mutex.RUnlock()
+	if err != nil {
+		respondError(w, r, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"files":     files,
+		"not_found": notFound,
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func batchInfo(t *testing.T, server *httptest.Server, token string, ids []string) (int, map[string]interface{}) {
+	t.Helper()
+	body, _ := json.Marshal(map[string][]string{"file_ids": ids})
+	req, _ := http.NewRequest("POST", server.URL+"/api/files/info", strings.NewReader(string(body)))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return doJSON(t, req)
+}
+
+func TestBatchFileInfo(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.AdminPassword = "secret"
+		c.TagPasswords = map[string]string{"legal": "objection"}
+	})
+	var ids []string
+	for _, fields := range []url.Values{nil, nil, {"tags": {"legal"}}} {
+		status, body := uploadTestFile(t, server, "a.txt", []byte("content"), fields)
+		if status != http.StatusOK {
+			t.Fatalf("upload: status %d, body %v", status, body)
+		}
+		ids = append(ids, body["id"].(string))
+	}
+	open, expired, protected := ids[0], ids[1], ids[2]
+	fm.mutex.Lock()
+	fm.files[expired].ExpiresAt = time.Now().Add(-time.Minute)
+	fm.mutex.Unlock()
+
+	// Each file reads as it does on /info, in one answer
+	status, body := batchInfo(t, server, "", []string{open, "nosuchfile", expired, open, protected})
+	if status != http.StatusOK {
+		t.Fatalf("status %d, body %v", status, body)
+	}
+	files := body["files"].(map[string]interface{})
+	for _, id := range []string{open, expired} {
+		_, info := getJSON(t, server, "/info/"+id)
+		got, _ := files[id].(map[string]interface{})
+		if got["id"] != id || got["status"] != info["status"] {
+			t.Errorf("%s: %v, /info has %v", id, got, info)
+		}
+	}
+	if files[expired].(map[string]interface{})["status"] != string(StatusExpired) {
+		t.Errorf("expired file: %v", files[expired])
+	}
+	if _, ok := files[open].(map[string]interface{})["uploader_ip"]; ok {
+		t.Error("uploader_ip shown without admin credentials")
+	}
+	if notFound := fmt.Sprint(body["not_found"]); len(files) != 2 || notFound != fmt.Sprintf("[nosuchfile %s]", protected) {
+		t.Errorf("%d files, not_found %s; want the protected file reported as not found", len(files), notFound)
+	}
+
+	// Admins see protected files and the admin fields
+	_, body = batchInfo(t, server, "secret", []string{open, protected})
+	files = body["files"].(map[string]interface{})
+	if len(files) != 2 || len(body["not_found"].([]interface{})) != 0 {
+		t.Fatalf("as admin: %v", body)
+	}
+	if _, ok := files[protected].(map[string]interface{})["uploader_ip"]; !ok {
+		t.Error("uploader_ip missing for an admin")
+	}
+
+	// Up to maxBatchInfoIDs at once
+	many := make([]string, maxBatchInfoIDs)
+	for i := range many {
+		many[i] = fmt.Sprint("missing", i)
+	}
+	if status, body := batchInfo(t, server, "", many); status != http.StatusOK || len(body["not_found"].([]interface{})) != maxBatchInfoIDs {
+		t.Errorf("%d IDs: status %d", maxBatchInfoIDs, status)
+	}
+	if status, _ := batchInfo(t, server, "", append(many, open)); status != http.StatusBadRequest {
+		t.Errorf("%d IDs: status %d, want 400", maxBatchInfoIDs+1, status)
+	}
+	req, _ := http.NewRequest("POST", server.URL+"/api/files/info", strings.NewReader(`{"file_ids": "`+open+`"}`))
+	if status, _ := doJSON(t, req); status != http.StatusBadRequest {
+		t.Errorf("file_ids as a string: status %d, want 400", status)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errBlockedContent = errors.New("this content may not be hosted here")
+
+// BlockedHash is an entry of the banned content list.
+type BlockedHash struct {
+	Checksum string    `json:"checksum"`
+	Reason   string    `json:"reason,omitempty"`
+	Added    time.Time `json:"added"`
+}
+
+// hashBlocklist holds checksums that uploads may never match, keyed by the
+// stored checksum form so the check is a single map lookup.
+type hashBlocklist struct {
+	mutex   sync.RWMutex
+	entries map[string]BlockedHash
+}
+
+func (b *hashBlocklist) blocked(checksum string) (BlockedHash, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	entry, ok := b.entries[checksum]
+	return entry, ok
+}
+
+func (fm *FileManager) blocklistFile() string {
+	return fm.config().MetadataFile + ".blocked"
+}
+
+func (fm *FileManager) loadBlocklist() {
+	b := &fm.blocklist
+	b.entries = make(map[string]BlockedHash)
+	data, err := fm.metadata.ReadFile(fm.blocklistFile())
+	if err != nil {
+		return
+	}
+	var entries []BlockedHash
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Printf("Error loading blocked hashes: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		b.entries[entry.Checksum] = entry
+	}
+}
+
+func (fm *FileManager) saveBlocklist() error {
+	data, err := json.MarshalIndent(fm.blockedHashes(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return fm.metadata.WriteFile(fm.blocklistFile(), data, 0644)
+}
+
+func (fm *FileManager) blockedHashes() []BlockedHash {
+	b := &fm.blocklist
+	b.mutex.RLock()
+	entries := make([]BlockedHash, 0, len(b.entries))
+	for _, entry := range b.entries {
+		entries = append(entries, entry)
+	}
+	b.mutex.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Checksum < entries[j].Checksum })
+	return entries
+}
+
+// checkBlocked rejects content on the blocklist.
+func (fm *FileManager) checkBlocked(checksum, filename, uploader string) error {
+	entry, blocked := fm.blocklist.blocked(checksum)
+	if !blocked {
+		return nil
+	}
+	log.Printf("Rejected upload of blocked content %s (%s) from %s: %s", filename, checksum, uploader, entry.Reason)
+	return errBlockedContent
+}
+
+// blockedHashesAPI handles /api/admin/blocked-hashes. POST adds hashes, given
+// as {"hashes": [...], "reason": "...", "purge": true} or as a plain text body
+// with one hash per line; purge=true deletes stored files that match.
+// DELETE /{checksum} removes an entry.
+func (fm *FileManager) blockedHashesAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		respondJSON(w, http.StatusOK, fm.blockedHashes())
+
+	case len(parts) == 0 && r.Method == "POST":
+		var request struct {
+			Hashes []string `json:"hashes"`
+			Reason string   `json:"reason"`
+			Purge  bool     `json:"purge"`
+		}
+		body := http.MaxBytesReader(w, r.Body, 64<<20)
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+			lines, err := readHashLines(body)
+			if err != nil {
+				respondError(w, r, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			request.Hashes = lines
+			request.Reason = r.URL.Query().Get("reason")
+			request.Purge = r.URL.Query().Get("purge") == "true"
+		} else if err := json.NewDecoder(body).Decode(&request); err != nil {
+			respondError(w, r, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		checksums := make([]string, 0, len(request.Hashes))
+		for _, raw := range request.Hashes {
+			checksum, err := normalizeChecksum(raw)
+			if err != nil {
+				respondError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			checksums = append(checksums, checksum)
+		}
+
+		b := &fm.blocklist
+		now := time.Now()
+		added := 0
+		b.mutex.Lock()
+		for _, checksum := range checksums {
+			if _, exists := b.entries[checksum]; !exists {
+				added++
+			}
+			b.entries[checksum] = BlockedHash{Checksum: checksum, Reason: request.Reason, Added: now}
+		}
+		b.mutex.Unlock()
+		if err := fm.saveBlocklist(); err != nil {
+			writeStorageError(w, r, fm.storageFailure(err))
+			return
+		}
+
+		matching, purged := fm.blockedFiles(r, request.Purge)
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"added":    added,
+			"total":    len(checksums),
+			"matching": matching,
+			"purged":   purged,
+		})
+
+	case len(parts) == 1 && r.Method == "DELETE":
+		checksum, err := normalizeChecksum(parts[0])
+		if err != nil {
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b := &fm.blocklist
+		b.mutex.Lock()
+		_, exists := b.entries[checksum]
+		delete(b.entries, checksum)
+		b.mutex.Unlock()
+		if !exists {
+			respondError(w, r, "Hash not blocked", http.StatusNotFound)
+			return
+		}
+		if err := fm.saveBlocklist(); err != nil {
+			writeStorageError(w, r, fm.storageFailure(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// blockedFiles reports the IDs of stored files on the blocklist, deleting
+// them when purge is set.
+func (fm *FileManager) blockedFiles(r *http.Request, purge bool) (matching, purged []string) {
+	fm.mutex.RLock()
+	for id, fileInfo := range fm.files {
+		if _, blocked := fm.blocklist.blocked(fileInfo.Checksum); blocked {
+			matching = append(matching, id)
+		}
+	}
+	fm.mutex.RUnlock()
+	sort.Strings(matching)
+
+	if purge {
+		for _, id := range matching {
+			if fm.removeFile(r, id) {
+				log.Printf("Purged blocked file %s", id)
+				purged = append(purged, id)
+			}
+		}
+	}
+	return matching, purged
+}
+
+// readHashLines reads one hash per line, skipping blank lines and # comments.
+// sha256sum-style lines ("<hash>  <name>") are accepted too.
+func readHashLines(r io.Reader) ([]string, error) {
+	var hashes []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hashes = append(hashes, strings.Fields(line)[0])
+	}
+	return hashes, scanner.Err()
+}
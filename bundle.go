@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// publicFile holds the fields of a file that are safe to hand to anyone who
+// may download it: no password, uploader address or storage details. It is
+// the manifest.json of a share bundle.
+type publicFile struct {
+	ID           string            `json:"id"`
+	Filename     string            `json:"filename"`
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"content_type"`
+	Checksum     string            `json:"checksum"`
+	UploadTime   time.Time         `json:"upload_time"`
+	ExpiresAt    time.Time         `json:"expires_at"`
+	MaxDownloads int               `json:"max_downloads"`
+	Tags         []string          `json:"tags"`
+	Description  string            `json:"description"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+func newPublicFile(fileInfo *FileInfo) publicFile {
+	return publicFile{
+		ID:           fileInfo.ID,
+		Filename:     fileInfo.OriginalName,
+		Size:         fileInfo.Size,
+		ContentType:  fileInfo.effectiveContentType(),
+		Checksum:     fileInfo.Checksum,
+		UploadTime:   fileInfo.UploadTime,
+		ExpiresAt:    fileInfo.ExpiresAt,
+		MaxDownloads: fileInfo.MaxDownloads,
+		Tags:         fileInfo.Tags,
+		Description:  fileInfo.Description,
+		Metadata:     fileInfo.Metadata,
+	}
+}
+
+// downloadBundle handles GET /api/files/{id}/bundle: a zip holding the file,
+// a manifest.json and a README.txt with verification instructions, plus a
+// detached checksum file with checksum_file=true. It counts as one download.
+// Large bundles, or any with spool=true, are built in the archive spool first
+// so they can be resumed with Range requests; others are streamed from disk.
+func (fm *FileManager) downloadBundle(w http.ResponseWriter, r *http.Request, fileID string) {
+	if r.Method != "GET" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := fm.authorizeKey(w, r, scopeDownload); !ok {
+		return
+	}
+
+	creds := fm.credentialsFor(r)
+	creds.SkipPassword = creds.Admin
+
+	fm.mutex.RLock()
+	existing, ok := fm.files[fileID]
+	fm.mutex.RUnlock()
+	if ok && existing.isLink() {
+		respondError(w, r, "Links have no stored content to bundle", http.StatusConflict)
+		return
+	}
+
+	opened, src := fm.openStored(fileID)
+	defer func() {
+		if src != nil {
+			src.Close()
+		}
+	}()
+	if key := fm.requestKey(r); opened != nil && !key.permits(opened) {
+		writeKeyForbidden(w, r, key)
+		return
+	}
+
+	withChecksum := r.URL.Query().Get("checksum_file") == "true"
+
+	// A Range request for a bundle that is still spooled continues a
+	// download that was already counted
+	if opened != nil && r.Header.Get("Range") != "" && opened.Status() != StatusExpired {
+		if spooled := fm.spool.open(bundleKey(opened, withChecksum)); spooled != nil {
+			defer spooled.Close()
+			if writeDownloadError(w, r, fm.checkPassword(opened, creds)) {
+				return
+			}
+			if writeDownloadError(w, r, fm.tagRules().unlock(opened, creds, &fm.verifiedPasswords)) {
+				return
+			}
+			keepWriting(w)
+			fm.serveSpooled(w, r, opened, withChecksum, spooled)
+			fm.recordEvent(r, "download", opened, fileID, "resumed")
+			return
+		}
+	}
+
+	fileInfo, last, err := fm.claimDownload(fileID, creds)
+	if err != nil {
+		fm.recordEvent(r, "download", nil, fileID, downloadOutcome(err))
+	}
+	if writeDownloadError(w, r, err) {
+		return
+	}
+	if fileInfo != opened {
+		// Replaced under the same ID since the handle was opened
+		if src != nil {
+			src.Close()
+		}
+		_, src = fm.openStored(fileID)
+	}
+
+	if src == nil {
+		respondError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+
+	keepWriting(w)
+	if fm.wantSpool(r, fileInfo) {
+		err = fm.spoolBundle(w, r, fileInfo, withChecksum, src)
+	} else {
+		err = streamBundle(w, r, fileInfo, withChecksum, src)
+	}
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "aborted"
+		if r.Context().Err() != nil {
+			fm.transfers.abortedDownloads.Add(1)
+		}
+	}
+	fm.recordEvent(r, "download", fileInfo, fileID, outcome)
+	fm.finishDownload(fileInfo, last && outcome == "ok")
+}
+
+// wantSpool decides whether a bundle is built in the spool: spool=true and
+// spool=false force it either way, otherwise bundles of files of at least
+// archive_spool_threshold bytes are spooled.
+func (fm *FileManager) wantSpool(r *http.Request, fileInfo *FileInfo) bool {
+	if fm.spool == nil {
+		return false
+	}
+	switch r.URL.Query().Get("spool") {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	threshold := fm.config().ArchiveSpoolThreshold
+	return threshold > 0 && fileInfo.Size >= threshold
+}
+
+// spoolBundle builds the bundle in the spool, unless an identical one is
+// there already, and serves it with Range support. When the spool budget is
+// exhausted the bundle is streamed instead.
+func (fm *FileManager) spoolBundle(w http.ResponseWriter, r *http.Request, fileInfo *FileInfo, withChecksum bool, src io.Reader) error {
+	key := bundleKey(fileInfo, withChecksum)
+	spooled := fm.spool.open(key)
+	if spooled == nil {
+		// The archive adds a few KB of manifest, README and headers
+		entry, ok := fm.spool.reserve(key, fileInfo.Size+64*1024, fm.config().ArchiveSpoolBudget)
+		if !ok {
+			return streamBundle(w, r, fileInfo, withChecksum, src)
+		}
+
+		f, err := os.Create(entry.path)
+		if err == nil {
+			err = writeBundle(f, newContextReader(r.Context(), src), fileInfo, withChecksum)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		var stat os.FileInfo
+		if err == nil {
+			stat, err = os.Stat(entry.path)
+		}
+		if err != nil {
+			fm.spool.abort(key, entry)
+			if r.Context().Err() == nil {
+				log.Printf("Error spooling bundle of %s: %v", fileInfo.ID, err)
+				respondError(w, r, "Server error", http.StatusInternalServerError)
+			}
+			return err
+		}
+		fm.spool.finish(key, entry, stat.Size())
+
+		if spooled = fm.spool.open(key); spooled == nil {
+			respondError(w, r, "Server error", http.StatusInternalServerError)
+			return errFileNotFound
+		}
+	}
+	defer spooled.Close()
+
+	fm.serveSpooled(w, r, fileInfo, withChecksum, spooled)
+	return r.Context().Err()
+}
+
+// streamBundle writes the bundle straight to the client; it can't be resumed.
+func streamBundle(w http.ResponseWriter, r *http.Request, fileInfo *FileInfo, withChecksum bool, src io.Reader) error {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", attachmentDisposition(fileInfo.ID+".zip"))
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("X-Archive-Resumable", "false")
+	return writeBundle(w, newContextReader(r.Context(), src), fileInfo, withChecksum)
+}
+
+// serveSpooled sends a spooled bundle. Its ETag identifies the archive
+// content, so If-Range lets clients resume only the archive they started.
+func (fm *FileManager) serveSpooled(w http.ResponseWriter, r *http.Request, fileInfo *FileInfo, withChecksum bool, spooled *os.File) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", attachmentDisposition(fileInfo.ID+".zip"))
+	w.Header().Set("ETag", `"`+bundleKey(fileInfo, withChecksum)+`"`)
+	w.Header().Set("X-Archive-Resumable", "true")
+	http.ServeContent(w, r, fileInfo.ID+".zip", fileInfo.UploadTime, spooled)
+}
+
+// bundleKey identifies the bytes of a bundle: the same record and options
+// always produce the same archive.
+func bundleKey(fileInfo *FileInfo, withChecksum bool) string {
+	manifest, _ := json.Marshal(newPublicFile(fileInfo))
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%t\x00", fileInfo.StorageKey, fileInfo.Checksum, withChecksum)
+	h.Write(manifest)
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// writeBundle writes the bundle zip. The output is deterministic: entries
+// come in a fixed order and all carry the upload time as their timestamp.
+func writeBundle(dst io.Writer, src io.Reader, fileInfo *FileInfo, withChecksum bool) error {
+	name := entryNames([]*FileInfo{fileInfo})[0]
+	algorithm := checksumAlgorithm(fileInfo.Checksum)
+	digest := strings.TrimPrefix(fileInfo.Checksum, algorithm+":")
+
+	zw := zip.NewWriter(dst)
+	create := func(name string, method uint16) (io.Writer, error) {
+		return zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: fileInfo.UploadTime})
+	}
+
+	// The payload is stored as is; it is often already compressed
+	entry, err := create(name, zip.Store)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(entry, src); err != nil {
+		return err
+	}
+
+	entry, err = create("manifest.json", zip.Deflate)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(entry)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(newPublicFile(fileInfo)); err != nil {
+		return err
+	}
+
+	entry, err = create("README.txt", zip.Deflate)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(entry, bundleReadme(fileInfo, name, algorithm, digest)); err != nil {
+		return err
+	}
+
+	if withChecksum && algorithm != "" {
+		entry, err = create(name+"."+algorithm, zip.Deflate)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(entry, "%s  %s\n", digest, name); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func bundleReadme(fileInfo *FileInfo, name, algorithm, digest string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "File:        %s\n", name)
+	fmt.Fprintf(&b, "Size:        %d bytes\n", fileInfo.Size)
+	if fileInfo.Description != "" {
+		fmt.Fprintf(&b, "Description: %s\n", fileInfo.Description)
+	}
+	fmt.Fprintf(&b, "Uploaded:    %s\n", fileInfo.UploadTime.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Expires:     %s\n", fileInfo.ExpiresAt.UTC().Format(time.RFC3339))
+	if algorithm == "" {
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Checksum:    %s %s\n\n", algorithm, digest)
+	fmt.Fprintf(&b, "To verify the file, run\n\n    %ssum %s\n\n", algorithm, name)
+	fmt.Fprintf(&b, "and compare the output with the checksum above. If the bundle\n")
+	fmt.Fprintf(&b, "includes %s.%s, running\n\n    %ssum -c %s.%s\n\n", name, algorithm, algorithm, name, algorithm)
+	fmt.Fprintf(&b, "in this directory checks it for you.\n")
+	return b.String()
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// downloadCache keeps copies of recently downloaded files on fast local disk
+// (cache_dir) for deployments whose upload_dir sits on slow or remote
+// storage. Entries are evicted least-recently-used once cache_max_bytes is
+// exceeded. A copy is only admitted after its checksum matched the file's
+// recorded checksum, and a hit is only served while the two still agree.
+type downloadCache struct {
+	dir      string
+	maxBytes int64
+	wait     time.Duration
+
+	mutex   sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	filling map[string]*cacheFill
+	size    int64
+
+	hits, misses, evictions int64
+
+	// Requests that found a fill in progress: served from its copy, or
+	// falling back to primary storage after a failed or slow fill
+	coalesced, coalesceFallbacks int64
+}
+
+var errCacheAborted = errors.New("cache fill aborted")
+
+type cacheEntry struct {
+	id       string
+	checksum string
+	path     string
+	size     int64
+}
+
+type CacheStats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+
+	Coalesced         int64 `json:"coalesced"`
+	CoalesceFallbacks int64 `json:"coalesce_fallbacks"`
+}
+
+// newDownloadCache returns nil when no cache_dir is configured. Copies left
+// over from a previous run are discarded since nothing records what they
+// belong to.
+func newDownloadCache(config Config) (*downloadCache, error) {
+	if config.CacheDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(config.CacheDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, pattern := range []string{"*.cache", "*.fill"} {
+		stale, _ := filepath.Glob(filepath.Join(config.CacheDir, pattern))
+		for _, path := range stale {
+			os.Remove(path)
+		}
+	}
+
+	return &downloadCache{
+		dir:      config.CacheDir,
+		maxBytes: config.CacheMaxBytes,
+		wait:     config.CacheWaitTimeout,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		filling:  make(map[string]*cacheFill),
+	}, nil
+}
+
+// lookup returns the cached copy of fileInfo if there is a valid one. Stale
+// copies, whose checksum no longer matches, are dropped. Callers must hold
+// c.mutex.
+func (c *downloadCache) lookup(fileInfo *FileInfo) (string, bool) {
+	elem, ok := c.entries[fileInfo.ID]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.checksum != fileInfo.Checksum {
+		c.remove(elem)
+		return "", false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.path, true
+}
+
+// acquire decides how a download of fileInfo is served. It returns the path
+// of a cached copy on a hit, or a fill the caller must complete while
+// streaming from primary storage. When neither is returned the caller serves
+// straight from primary storage. If another request is already filling the
+// same file, acquire waits at most cache_wait_timeout for it.
+func (c *downloadCache) acquire(fileInfo *FileInfo) (string, *cacheFill) {
+	c.mutex.Lock()
+	if path, ok := c.lookup(fileInfo); ok {
+		c.hits++
+		c.mutex.Unlock()
+		return path, nil
+	}
+
+	if fill, busy := c.filling[fileInfo.ID]; busy {
+		c.mutex.Unlock()
+		timer := time.NewTimer(c.wait)
+		defer timer.Stop()
+		select {
+		case <-fill.done:
+		case <-timer.C:
+		}
+
+		// A failed fill closes done as well, so waiters never hang on it
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if path, ok := c.lookup(fileInfo); ok {
+			c.hits++
+			c.coalesced++
+			return path, nil
+		}
+		c.misses++
+		c.coalesceFallbacks++
+		return "", nil
+	}
+
+	defer c.mutex.Unlock()
+	c.misses++
+	if fileInfo.Size > c.maxBytes {
+		return "", nil
+	}
+	hasher, err := newHasher(checksumAlgorithm(fileInfo.Checksum))
+	if err != nil {
+		return "", nil
+	}
+	file, err := os.CreateTemp(c.dir, "*.fill")
+	if err != nil {
+		log.Printf("Error creating cache file: %v", err)
+		return "", nil
+	}
+
+	fill := &cacheFill{
+		cache:    c,
+		id:       fileInfo.ID,
+		checksum: fileInfo.Checksum,
+		file:     file,
+		hash:     hasher,
+		done:     make(chan struct{}),
+	}
+	c.filling[fileInfo.ID] = fill
+	return "", fill
+}
+
+// remove drops an entry and its copy. Callers must hold c.mutex.
+func (c *downloadCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.id)
+	c.size -= entry.size
+	os.Remove(entry.path)
+}
+
+// invalidate drops the cached copy of a file and abandons any fill in
+// progress for it.
+func (c *downloadCache) invalidate(fileID string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[fileID]; ok {
+		c.remove(elem)
+	}
+	delete(c.filling, fileID)
+}
+
+// purge empties the cache and reports how many entries and bytes it freed.
+func (c *downloadCache) purge() (int, int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entries, size := c.lru.Len(), c.size
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	return entries, size
+}
+
+func (c *downloadCache) stats() *CacheStats {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return &CacheStats{
+		Entries:   c.lru.Len(),
+		Bytes:     c.size,
+		MaxBytes:  c.maxBytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+
+		Coalesced:         c.coalesced,
+		CoalesceFallbacks: c.coalesceFallbacks,
+	}
+}
+
+// cacheFill copies a file into the cache as it is streamed to the first
+// client that asked for it.
+type cacheFill struct {
+	cache    *downloadCache
+	id       string
+	checksum string
+	file     *os.File
+	hash     hash.Hash
+	size     int64
+	err      error
+	done     chan struct{}
+}
+
+// Write copies p into the cache. Errors are remembered rather than returned
+// so a failing cache never interrupts the download itself.
+func (f *cacheFill) Write(p []byte) (int, error) {
+	if f.err == nil {
+		if _, f.err = f.file.Write(p); f.err == nil {
+			f.hash.Write(p)
+			f.size += int64(len(p))
+		}
+	}
+	return len(p), nil
+}
+
+// commit admits the copy if it is complete and matches the recorded
+// checksum, evicting older entries to make room.
+func (f *cacheFill) commit() {
+	c := f.cache
+	closeErr := f.file.Close()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer close(f.done)
+
+	current := c.filling[f.id] == f
+	if current {
+		delete(c.filling, f.id)
+	}
+
+	algorithm := checksumAlgorithm(f.checksum)
+	switch {
+	case errors.Is(f.err, errCacheAborted):
+	case f.err != nil || closeErr != nil:
+		log.Printf("Error writing cache copy of %s: %v", f.id, errors.Join(f.err, closeErr))
+	case formatChecksum(algorithm, f.hash.Sum(nil)) != f.checksum:
+		log.Printf("Cache copy of %s failed checksum verification, discarding", f.id)
+	case current:
+		path := filepath.Join(c.dir, f.id+".cache")
+		if err := os.Rename(f.file.Name(), path); err != nil {
+			log.Printf("Error storing cache copy of %s: %v", f.id, err)
+			break
+		}
+		entry := &cacheEntry{id: f.id, checksum: f.checksum, path: path, size: f.size}
+		c.entries[f.id] = c.lru.PushFront(entry)
+		c.size += f.size
+		for c.size > c.maxBytes && c.lru.Len() > 1 {
+			c.remove(c.lru.Back())
+			c.evictions++
+		}
+		return
+	}
+	os.Remove(f.file.Name())
+}
+
+// abort discards a partial copy.
+func (f *cacheFill) abort() {
+	f.err = errCacheAborted
+	f.commit()
+}
+
+// serveStored sends a file's content from src, the handle opened by
+// openStored, or from the download cache when possible. Cache misses stream
+// from src while the copy is being written, so they are never slower to start
+// than an uncached download.
+func (fm *FileManager) serveStored(w http.ResponseWriter, r *http.Request, fileInfo *FileInfo, src File) {
+	if src == nil {
+		respondError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+	stat, err := src.Stat()
+	if err != nil {
+		respondError(w, r, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if fm.cache == nil || r.Method != "GET" || r.Header.Get("Range") != "" {
+		http.ServeContent(w, r, fileInfo.OriginalName, stat.ModTime(), src)
+		return
+	}
+
+	cached, fill := fm.cache.acquire(fileInfo)
+	if fill == nil {
+		if cached != "" {
+			if f, err := os.Open(cached); err == nil {
+				defer f.Close()
+				http.ServeContent(w, r, fileInfo.OriginalName, stat.ModTime(), f)
+				return
+			}
+		}
+		http.ServeContent(w, r, fileInfo.OriginalName, stat.ModTime(), src)
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+
+	if _, err := io.Copy(w, io.TeeReader(newContextReader(r.Context(), src), fill)); err != nil {
+		fill.abort()
+		return
+	}
+	fill.commit()
+}
+
+func (fm *FileManager) purgeCache(w http.ResponseWriter, r *http.Request) {
+	if fm.cache == nil {
+		respondError(w, r, "Download cache is not enabled", http.StatusNotFound)
+		return
+	}
+	entries, size := fm.cache.purge()
+	log.Printf("Purged download cache: %d entries, %s", entries, formatBytes(size))
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"purged_entries": entries,
+		"purged_bytes":   size,
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// apiVersion is the version of the HTTP API. It goes up when a change would
+// break existing clients; additions keep it.
+const apiVersion = 1
+
+// Capabilities is the document served on /api/capabilities, so clients can
+// check what this deployment accepts before sending any bytes.
+type Capabilities struct {
+	APIVersion    int                `json:"api_version"`
+	ServerVersion string             `json:"server_version"`
+	BaseURL       string             `json:"base_url"`
+	PathPrefix    string             `json:"path_prefix"`
+	Uploads       UploadCapabilities `json:"uploads"`
+	Features      map[string]bool    `json:"features"`
+	Deprecations  []Deprecation      `json:"deprecations"`
+	// InfoHeaders maps the headers of HEAD /info/{id} to the /info fields
+	// they carry.
+	InfoHeaders map[string]string `json:"info_headers"`
+}
+
+// UploadCapabilities are the limits an upload is checked against.
+type UploadCapabilities struct {
+	Endpoint          string           `json:"endpoint"`
+	MaxFileSize       int64            `json:"max_file_size"`
+	AllowedTypes      []string         `json:"allowed_types"` // empty admits every type not denied
+	DeniedTypes       []string         `json:"denied_types"`
+	DefaultTTL        int64            `json:"default_ttl_seconds"`
+	ExpiryTimezone    string           `json:"expiry_timezone"` // of date-only expires_at values
+	TTLOverride       bool             `json:"ttl_override"`
+	Passwords         bool             `json:"passwords"`
+	MaxPasswordLength int              `json:"max_password_length"`
+	MaxTitleLength    int              `json:"max_title_length"`
+	ChecksumAlgorithm string           `json:"checksum_algorithm"`
+	FieldLimits       map[string]int64 `json:"field_limits"`
+	MaxFieldLength    int64            `json:"max_field_length"`
+	MaxFormFields     int64            `json:"max_form_fields"`
+}
+
+// Deprecation announces an endpoint that still works but will be removed.
+type Deprecation struct {
+	Endpoint    string `json:"endpoint"`
+	Replacement string `json:"replacement"`
+	Note        string `json:"note,omitempty"`
+}
+
+// deprecations lists the endpoints kept for older clients. Their responses
+// carry a Deprecation header as well.
+var deprecations = []Deprecation{
+	{Endpoint: "POST /api/upload", Replacement: "POST /upload", Note: "same form and response"},
+}
+
+// capabilities describes the running configuration as seen by r.
+func (fm *FileManager) capabilities(r *http.Request) Capabilities {
+	config := fm.config()
+	deprecated := make([]Deprecation, len(deprecations))
+	for i, d := range deprecations {
+		d.Endpoint, d.Replacement = fm.appEndpoint(d.Endpoint), fm.appEndpoint(d.Replacement)
+		deprecated[i] = d
+	}
+	return Capabilities{
+		APIVersion:    apiVersion,
+		ServerVersion: currentBuild().Version,
+		BaseURL:       fm.baseURL(r),
+		PathPrefix:    config.PathPrefix,
+		Uploads: UploadCapabilities{
+			Endpoint:          fm.appPath("/upload"),
+			MaxFileSize:       config.MaxFileSize,
+			AllowedTypes:      nonNil(config.AllowedTypes),
+			DeniedTypes:       nonNil(config.DeniedTypes),
+			DefaultTTL:        int64(config.DefaultTTL.Seconds()),
+			ExpiryTimezone:    fm.expiryLocation().String(),
+			TTLOverride:       true,
+			Passwords:         true,
+			MaxPasswordLength: maxFilePassword,
+			MaxTitleLength:    maxTitleLength,
+			ChecksumAlgorithm: config.ChecksumAlgorithm,
+			FieldLimits:       formFieldLimits,
+			MaxFieldLength:    maxFieldLength,
+			MaxFormFields:     maxFormFields,
+		},
+		Features: map[string]bool{
+			"resumable_uploads": true,
+			"appendable":        true,
+			"links":             true,
+			"file_requests":     true,
+			"archives":          true,
+			"dedup":             config.DuplicateWindow > 0,
+			"signed_urls":       config.LinkSigningKey != "",
+			"receipts":          fm.receipts != nil,
+			"email":             config.SMTPHost != "",
+			"s3":                len(config.S3Credentials) > 0,
+			"grpc":              config.GRPCPort != "",
+			"metrics":           config.MetricsEnabled,
+			"public_listings":   config.PublicListings,
+			"if_match":          true,
+			"file_edits":        true,
+			"raw_uploads":       true,
+			"require_if_match":  config.RequireIfMatch,
+		},
+		Deprecations: deprecated,
+		InfoHeaders:  infoHeaders,
+	}
+}
+
+// appEndpoint prefixes the path of "METHOD /path" with path_prefix.
+func (fm *FileManager) appEndpoint(endpoint string) string {
+	method, route, _ := strings.Cut(endpoint, " ")
+	return method + " " + fm.appPath(route)
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// serveCapabilities handles GET /api/capabilities. The ETag is a hash of
+// the document, so it changes whenever a reload changes what it says.
+func (fm *FileManager) serveCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := json.Marshal(fm.capabilities(r))
+	if err != nil {
+		respondError(w, r, "Server error", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// markDeprecated flags a response of a deprecated endpoint with a
+// Deprecation header and a link to its replacement.
+func (fm *FileManager) markDeprecated(w http.ResponseWriter, replacement string) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Add("Link", "<"+fm.appPath(replacement)+`>; rel="successor-version"`)
+}
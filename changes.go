@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Change types recorded in the change log.
+const (
+	changeCreated = "created"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+	changeExpired = "expired"
+)
+
+// maxChanges bounds the change log independently of change_log_retention.
+const maxChanges = 100000
+
+// FileChange is an entry of the change log served by GET /api/changes. It
+// carries just enough for a mirror to decide whether to fetch the file.
+type FileChange struct {
+	Seq       int64      `json:"seq"`
+	Time      time.Time  `json:"time"`
+	Type      string     `json:"type"`
+	FileID    string     `json:"file_id"`
+	Filename  string     `json:"filename,omitempty"`
+	Title     string     `json:"title,omitempty"`
+	Size      int64      `json:"size,omitempty"`
+	Checksum  string     `json:"checksum,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+}
+
+// changeLog records every change to the file index under increasing
+// sequence numbers. Entries are appended while fm.mutex is held, so a
+// metadata snapshot and the log written with it always agree; see
+// saveMetadata.
+type changeLog struct {
+	mutex   sync.Mutex
+	changes []FileChange // oldest first
+	lastSeq int64
+	// floor is the highest sequence number compacted away, and floorTime
+	// its time. Cursors before them can no longer be served.
+	floor     int64
+	floorTime time.Time
+	dirty     bool
+}
+
+// storedChangeLog is the on-disk form of the change log.
+type storedChangeLog struct {
+	LastSeq   int64        `json:"last_seq"`
+	Floor     int64        `json:"floor"`
+	FloorTime time.Time    `json:"floor_time"`
+	Changes   []FileChange `json:"changes"`
+}
+
+// recordChange appends a change for fileInfo. Callers must hold fm.mutex.
+// Updates also bump the file's revision, and created files start at 1.
+func (fm *FileManager) recordChange(changeType, fileID string, fileInfo *FileInfo) {
+	fm.aggregates.invalidate()
+	fm.markDirty()
+	if fileInfo != nil {
+		switch {
+		case changeType == changeUpdated:
+			fileInfo.Revision++
+		case changeType == changeCreated && fileInfo.Revision == 0:
+			fileInfo.Revision = 1
+		}
+	}
+	change := FileChange{Type: changeType, FileID: fileID, Time: time.Now()}
+	if fileInfo != nil {
+		change.Filename = fileInfo.OriginalName
+		change.Title = fileInfo.Title
+		change.Size = fileInfo.Size
+		change.Checksum = fileInfo.Checksum
+		change.Tags = fileInfo.Tags
+		if !fileInfo.ExpiresAt.IsZero() {
+			expiresAt := fileInfo.ExpiresAt
+			change.ExpiresAt = &expiresAt
+		}
+	}
+
+	c := &fm.changes
+	c.mutex.Lock()
+	c.lastSeq++
+	change.Seq = c.lastSeq
+	c.changes = append(c.changes, change)
+	if len(c.changes) > maxChanges {
+		c.compactTo(len(c.changes) - maxChanges)
+	}
+	c.dirty = true
+	c.mutex.Unlock()
+}
+
+// compactTo drops the first n changes. Callers must hold c.mutex.
+func (c *changeLog) compactTo(n int) {
+	if n <= 0 {
+		return
+	}
+	c.floor = c.changes[n-1].Seq
+	c.floorTime = c.changes[n-1].Time
+	c.changes = append([]FileChange(nil), c.changes[n:]...)
+	c.dirty = true
+}
+
+// compact drops changes older than retention.
+func (c *changeLog) compact(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-retention)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.compactTo(sort.Search(len(c.changes), func(i int) bool { return c.changes[i].Time.After(cutoff) }))
+}
+
+// since returns up to limit changes after seq, or from time t when seq is
+// negative, along with the cursor to continue from. ok is false when the
+// position is no longer covered by the log, or lies ahead of it.
+func (c *changeLog) since(seq int64, t time.Time, limit int, keep func(FileChange) bool) (changes []FileChange, cursor int64, more, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var start int
+	if seq >= 0 {
+		if seq < c.floor || seq > c.lastSeq {
+			return nil, c.lastSeq, false, false
+		}
+		start = sort.Search(len(c.changes), func(i int) bool { return c.changes[i].Seq > seq })
+	} else {
+		// Changes at exactly t are repeated rather than risk missing one
+		if c.floor > 0 && t.Before(c.floorTime) {
+			return nil, c.lastSeq, false, false
+		}
+		start = sort.Search(len(c.changes), func(i int) bool { return !c.changes[i].Time.Before(t) })
+	}
+
+	changes = []FileChange{}
+	cursor = c.lastSeq
+	for _, change := range c.changes[start:] {
+		if len(changes) == limit {
+			more = true
+			break
+		}
+		cursor = change.Seq
+		if keep(change) {
+			changes = append(changes, change)
+		}
+	}
+	if !more {
+		cursor = c.lastSeq
+	}
+	return changes, cursor, more, true
+}
+
+func (fm *FileManager) changesFile() string {
+	return fm.config().MetadataFile + ".changes"
+}
+
+func (fm *FileManager) loadChanges() {
+	data, err := fm.metadata.ReadFile(fm.changesFile())
+	if err != nil {
+		return
+	}
+	var stored storedChangeLog
+	if err := json.Unmarshal(data, &stored); err != nil {
+		log.Printf("Error loading change log: %v", err)
+		return
+	}
+
+	c := &fm.changes
+	c.mutex.Lock()
+	c.changes = stored.Changes
+	c.lastSeq = stored.LastSeq
+	c.floor = stored.Floor
+	c.floorTime = stored.FloorTime
+	c.mutex.Unlock()
+}
+
+// encodeChanges returns the change log for writing, or nil if it is
+// unchanged since the last save.
+func (fm *FileManager) encodeChanges() ([]byte, error) {
+	c := &fm.changes
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.dirty {
+		return nil, nil
+	}
+	c.dirty = false
+	return json.Marshal(storedChangeLog{
+		LastSeq:   c.lastSeq,
+		Floor:     c.floor,
+		FloorTime: c.floorTime,
+		Changes:   c.changes,
+	})
+}
+
+// listChanges handles GET /api/changes?since=: the changes after a cursor
+// (a sequence number from an earlier response) or an RFC3339 time, oldest
+// first. Every response carries the cursor to pass next; a cursor the log no
+// longer covers gets 410 and the client must resync from /api/files.
+func (fm *FileManager) listChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !fm.requireListingAccess(w, r) {
+		return
+	}
+
+	seq, t := int64(0), time.Time{}
+	if since := r.URL.Query().Get("since"); since != "" {
+		if parsed, err := strconv.ParseInt(since, 10, 64); err == nil && parsed >= 0 {
+			seq = parsed
+		} else if parsed, err := time.Parse(time.RFC3339, since); err == nil {
+			seq, t = -1, parsed
+		} else {
+			respondError(w, r, "since must be a cursor or an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	key := fm.requestKey(r)
+	hidden := fm.hiddenTags(r)
+	keep := func(change FileChange) bool {
+		if hidden.protects(change.Tags) {
+			return false
+		}
+		return key == nil || key.Tag == "" || hasAnyTag(change.Tags, []string{key.Tag})
+	}
+	changes, cursor, more, ok := fm.changes.since(seq, t, pageLimit(r), keep)
+
+	if !ok {
+		respondJSON(w, http.StatusGone, map[string]interface{}{
+			"error":  "cursor is no longer covered by the change log; list /api/files for a full resync, then continue from cursor",
+			"cursor": strconv.FormatInt(cursor, 10),
+		})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"changes": changes,
+		"cursor":  strconv.FormatInt(cursor, 10),
+		"more":    more,
+	})
+}
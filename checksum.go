@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Checksums are stored as bare hex for sha256, which is what every file
+// uploaded before configurable algorithms has, and as "<algo>:<hex>" for
+// everything else.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"sha1":   sha1.New,
+}
+
+func newHasher(algorithm string) (hash.Hash, error) {
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	return newHash(), nil
+}
+
+func formatChecksum(algorithm string, sum []byte) string {
+	digest := hex.EncodeToString(sum)
+	if algorithm == "sha256" {
+		return digest
+	}
+	return algorithm + ":" + digest
+}
+
+// checksumAlgorithm returns the algorithm a stored checksum was computed
+// with, or "" when there is no checksum.
+func checksumAlgorithm(checksum string) string {
+	if checksum == "" {
+		return ""
+	}
+	if algorithm, _, ok := strings.Cut(checksum, ":"); ok {
+		return algorithm
+	}
+	return "sha256"
+}
+
+// calculateChecksum hashes r with the configured algorithm.
+func (fm *FileManager) calculateChecksum(r io.Reader) (string, error) {
+	algorithm := fm.config().ChecksumAlgorithm
+	hasher, err := newHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return formatChecksum(algorithm, hasher.Sum(nil)), nil
+}
+
+// normalizeChecksum converts "<algo>:<hex>" or bare hex into the form
+// checksums are stored in. Bare hex is taken to be the algorithm whose
+// digest has that length.
+func normalizeChecksum(raw string) (string, error) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	algorithm, digest, ok := strings.Cut(raw, ":")
+	if !ok {
+		digest = raw
+		switch len(digest) {
+		case 40:
+			algorithm = "sha1"
+		case 64:
+			algorithm = "sha256"
+		case 128:
+			algorithm = "sha512"
+		default:
+			return "", fmt.Errorf("%q is not a sha1, sha256 or sha512 digest", raw)
+		}
+	}
+	hasher, err := newHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != hasher.Size() {
+		return "", fmt.Errorf("%q is not a valid %s digest", raw, algorithm)
+	}
+	return formatChecksum(algorithm, sum), nil
+}
+
+// verifyChecksum checks content whose stored checksum is actual against the
+// checksum a client expects, rehashing it when the client used another
+// algorithm. An empty expected checksum always passes.
+func verifyChecksum(content io.ReadSeeker, actual, expected string) error {
+	if expected == "" || expected == actual {
+		return nil
+	}
+	algorithm := checksumAlgorithm(expected)
+	if algorithm != checksumAlgorithm(actual) {
+		hasher, err := newHasher(algorithm)
+		if err != nil {
+			return err
+		}
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(hasher, content); err != nil {
+			return err
+		}
+		if formatChecksum(algorithm, hasher.Sum(nil)) == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: content does not match %s", errChecksumMismatch, expected)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+func init() {
+	jobRunners["checksum"] = runChecksum
+}
+
+var errChecksumPending = errors.New("checksum is still being computed")
+
+// asyncChecksum reports whether an upload is stored before its checksum is
+// computed: when asked for with async_checksum=true, and always past
+// async_checksum_size bytes. Uploads that must be verified against a
+// client's checksum, and appendable ones, are hashed inline as usual.
+func (fm *FileManager) asyncChecksum(req uploadRequest) (requested bool, threshold int64) {
+	if req.Checksum != "" || req.Appendable {
+		return false, 0
+	}
+	return req.AsyncHash, fm.config().AsyncChecksumSize
+}
+
+// queueChecksum starts the job computing the checksum of a file stored with
+// checksum_pending.
+func (fm *FileManager) queueChecksum(fileID string) {
+	fm.startJob("checksum", map[string]string{"id": fileID})
+}
+
+// runChecksum computes the checksum of the file params["id"] once it is
+// stored. Blocked content is removed like at upload time. The activity
+// stream and webhook announce the result.
+func runChecksum(fm *FileManager, job *Job, params map[string]string) error {
+	fileID := params["id"]
+	fm.mutex.RLock()
+	fileInfo, exists := fm.files[fileID]
+	pending := exists && fileInfo.HashPending
+	var store Storage
+	var key string
+	if pending {
+		store, key = fm.contentStorage(fileInfo), fileInfo.StorageKey
+	}
+	fm.mutex.RUnlock()
+	if !pending {
+		return nil // deleted, or computed before a restart
+	}
+
+	job.setTotal(1)
+	checksum, err := fm.rehashFile(store, key, 0)
+	if err == nil {
+		if err = fm.checkBlocked(checksum, fileInfo.OriginalName, fileInfo.UploaderIP); err != nil {
+			fm.removeFile(nil, fileID)
+		}
+	}
+	if err != nil {
+		log.Printf("Error computing checksum of %s: %v", fileID, err)
+		fm.activity.record(ActivityEvent{Type: "checksum", FileID: fileID, Filename: fileInfo.OriginalName, Outcome: "error"})
+		job.advance(err)
+		return err
+	}
+
+	fm.mutex.Lock()
+	if fm.files[fileID] != fileInfo {
+		fm.mutex.Unlock()
+		job.advance(errFileNotFound)
+		return errFileNotFound
+	}
+	fileInfo.Checksum = checksum
+	fileInfo.HashPending = false
+	fm.recordChange(changeUpdated, fileID, fileInfo)
+	fm.mutex.Unlock()
+	fm.saveMetadata()
+
+	fm.activity.record(ActivityEvent{Type: "checksum", FileID: fileID, Filename: fileInfo.OriginalName, Outcome: "ok"})
+	fm.notifyFile("checksum_ready", fileInfo, map[string]interface{}{
+		"id":       fileID,
+		"filename": fileInfo.OriginalName,
+		"checksum": checksum,
+	})
+	job.advance(nil)
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// cleanupBatchSize is how many files cleanup unregisters per acquisition of
+// fm.mutex. Between batches the lock is released so requests can get in.
+const cleanupBatchSize = 100
+
+// CleanupStats describes the cleanup routine's progress, for /stats.
+type CleanupStats struct {
+	Backlog      int       `json:"backlog"`       // removable files left after the last run
+	LastDeleted  int       `json:"last_deleted"`  // files removed by the last run
+	TotalDeleted int64     `json:"total_deleted"` // since startup
+	LastRun      time.Time `json:"last_run,omitempty"`
+	LastDuration string    `json:"last_duration,omitempty"`
+}
+
+type cleanupState struct {
+	mu    sync.Mutex
+	stats CleanupStats
+}
+
+func (fm *FileManager) cleanupStats() CleanupStats {
+	fm.cleanupState.mu.Lock()
+	defer fm.cleanupState.mu.Unlock()
+	return fm.cleanupState.stats
+}
+
+func (fm *FileManager) cleanupRoutine() {
+	ticker := time.NewTicker(fm.config().CleanupInterval)
+	defer ticker.Stop()
+
+	for fm.tick(ticker) {
+		fm.cleanup()
+		fm.uploadLimits.prune(time.Now())
+	}
+}
+
+type expiredFile struct {
+	id       string
+	fileInfo *FileInfo
+	status   FileStatus
+}
+
+// cleanup removes expired and used-up files. Mass expiry is spread over
+// several runs: each run stops after cleanup_max_files files or
+// cleanup_max_duration, whichever comes first, and the rest waits for the
+// next tick. Files are unregistered in small batches and their content is
+// deleted from disk without holding the lock.
+func (fm *FileManager) cleanup() {
+	config := fm.config()
+	start := time.Now()
+
+	fm.mutex.RLock()
+	var worklist []expiredFile
+	for id, fileInfo := range fm.files {
+		if status := fileInfo.statusAt(start); status != StatusActive && status != StatusLimitGrace {
+			worklist = append(worklist, expiredFile{id, fileInfo, status})
+		}
+	}
+	fm.mutex.RUnlock()
+
+	todo := worklist
+	if config.CleanupMaxFiles > 0 && len(todo) > config.CleanupMaxFiles {
+		todo = todo[:config.CleanupMaxFiles]
+	}
+
+	deleted, processed := 0, 0
+	for processed < len(todo) {
+		if config.CleanupMaxDuration > 0 && time.Since(start) > config.CleanupMaxDuration {
+			break
+		}
+		batch := todo[processed:min(processed+cleanupBatchSize, len(todo))]
+		processed += len(batch)
+
+		var removed []*FileInfo
+		fm.mutex.Lock()
+		for _, f := range batch {
+			if fm.expireFile(f.id, f.fileInfo, f.status) {
+				removed = append(removed, f.fileInfo)
+			}
+		}
+		fm.mutex.Unlock()
+
+		for _, fileInfo := range removed {
+			fm.deleteExpiredContent(fileInfo)
+		}
+		deleted += len(removed)
+	}
+
+	fm.mutex.Lock()
+	compacted := fm.compactMetadata()
+	fm.pruneTombstones()
+	fm.mutex.Unlock()
+	retryDeferredDeletes()
+	fm.pruneUploadSessions()
+	fm.spool.prune(config.ArchiveSpoolTTL)
+	fm.changes.compact(config.ChangeLogRetention)
+
+	if compacted || deleted > 0 {
+		fm.requestSave()
+	}
+	fm.checkStorageThresholds()
+
+	fm.cleanupState.mu.Lock()
+	stats := &fm.cleanupState.stats
+	stats.Backlog = len(worklist) - processed
+	stats.LastDeleted = deleted
+	stats.TotalDeleted += int64(deleted)
+	stats.LastRun = start
+	stats.LastDuration = time.Since(start).Round(time.Millisecond).String()
+	fm.cleanupState.mu.Unlock()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCleanupDrainsMassExpiry(t *testing.T) {
+	const expired, perRun = 10000, 2500
+	fm, server := newTestServer(t, func(c *Config) { c.CleanupMaxFiles = perRun })
+	log.SetOutput(io.Discard) // a line per removed file
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	status, uploaded := uploadTestFile(t, server, "live.txt", []byte("still here"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	live := uploaded["id"].(string)
+
+	past := time.Now().Add(-time.Hour)
+	for i := range expired {
+		id := fmt.Sprintf("exp%05d", i)
+		key := "seed/" + id
+		f, err := fm.storage.OpenFile(key, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("x"))
+		f.Close()
+		fm.mutex.Lock()
+		fm.files[id] = &FileInfo{ID: id, Filename: id, OriginalName: id, StorageKey: key, Size: 1, UploadTime: past, ExpiresAt: past}
+		fm.mutex.Unlock()
+	}
+
+	// Foreground requests keep being answered while cleanup runs tick
+	// after tick
+	done := make(chan struct{})
+	runs := 0
+	go func() {
+		defer close(done)
+		for fm.cleanupStats().TotalDeleted < expired && runs < 10 {
+			fm.cleanup()
+			runs++
+			if stats := fm.cleanupStats(); stats.LastDeleted > perRun {
+				t.Errorf("run %d deleted %d files, budget is %d", runs, stats.LastDeleted, perRun)
+			}
+		}
+	}()
+
+	var slowest time.Duration
+	requests := 0
+	for draining := true; draining; requests++ {
+		select {
+		case <-done:
+			draining = false
+		default:
+		}
+		start := time.Now()
+		if status, _ := getJSON(t, server, "/info/"+live); status != http.StatusOK {
+			t.Fatalf("info of the live file: status %d", status)
+		}
+		slowest = max(slowest, time.Since(start))
+	}
+	if slowest > 500*time.Millisecond {
+		t.Errorf("slowest of %d requests during cleanup took %v", requests, slowest)
+	}
+
+	stats := fm.cleanupStats()
+	if runs != expired/perRun || stats.TotalDeleted != expired || stats.Backlog != 0 {
+		t.Errorf("after %d runs: %+v, want %d runs deleting %d", runs, stats, expired/perRun, expired)
+	}
+	fm.mutex.RLock()
+	remaining := len(fm.files)
+	fm.mutex.RUnlock()
+	if remaining != 1 {
+		t.Errorf("%d files left in the index, want only the live one", remaining)
+	}
+	if keys := storedKeys(fm); len(keys) != 1 {
+		t.Errorf("%d stored files left, want only the live one", len(keys))
+	}
+}
+
+func TestCleanupBacklogCarriesOver(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) { c.CleanupMaxFiles = 3 })
+	defer fm.Close()
+	seedFiles(fm, "f", 7, time.Now().Add(-48*time.Hour))
+
+	for _, want := range []CleanupStats{{Backlog: 4, LastDeleted: 3}, {Backlog: 1, LastDeleted: 3}, {Backlog: 0, LastDeleted: 1}} {
+		fm.cleanup()
+		if stats := fm.cleanupStats(); stats.Backlog != want.Backlog || stats.LastDeleted != want.LastDeleted {
+			t.Errorf("backlog %d, deleted %d; want %d, %d", stats.Backlog, stats.LastDeleted, want.Backlog, want.LastDeleted)
+		}
+	}
+}
+
+// stallingStorage holds each Remove, once armed, until release is closed,
+// announcing it on removing.
+type stallingStorage struct {
+	Storage
+	armed    atomic.Bool
+	removing chan string
+	release  chan struct{}
+}
+
+func (s *stallingStorage) Remove(key string) error {
+	if s.armed.Load() {
+		s.removing <- key
+		<-s.release
+	}
+	return s.Storage.Remove(key)
+}
+
+func TestBulkDeleteReleasesLockForStorage(t *testing.T) {
+	fm := NewTestFileManager(nil)
+	stall := &stallingStorage{Storage: fm.storage, removing: make(chan string, 16), release: make(chan struct{})}
+	fm.storage = stall
+	server := httptest.NewServer(fm.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		fm.Close()
+	})
+
+	for i := range 3 {
+		if status, body := uploadTestFile(t, server, fmt.Sprintf("old%d.txt", i), []byte("old"), url.Values{"tags": {"batch"}}); status != http.StatusOK {
+			t.Fatalf("upload: status %d, body %v", status, body)
+		}
+	}
+	status, uploaded := uploadTestFile(t, server, "keep.txt", []byte("keep"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	keep := uploaded["id"].(string)
+
+	stall.armed.Store(true)
+	done := make(chan map[string]interface{})
+	go func() {
+		req, _ := http.NewRequest("POST", server.URL+"/bulk-delete", strings.NewReader(`{"tag": "batch"}`))
+		_, body := doJSON(t, req)
+		done <- body
+	}()
+	select {
+	case <-stall.removing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bulk delete never removed stored content")
+	}
+
+	// Storage is stuck, yet requests for other files are answered
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(server.URL + "/info/" + keep)
+	if err != nil {
+		t.Errorf("info while bulk delete waits on storage: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	close(stall.release)
+	if body := <-done; body["deleted"] != 3.0 {
+		t.Errorf("bulk delete answered %v, want 3 deleted", body)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"uploads/client"
+)
+
+const cliUsage = `Usage: uploads [command] [options]
+
+Commands:
+  serve [-strict]        Run the upload server (default); -strict refuses
+                         to start with an insecure configuration
+  put <file>             Upload a file and print its download URL
+  get <id> [-o path]     Download a file and verify its checksum
+  ls                     List files
+  rm <id>                Delete a file
+  stat <id>              Show file details
+  version                Print version and build information
+  print-config           Print the effective configuration, secrets redacted
+  relocate-files <old> <new> [-move]
+                         Point metadata at a moved upload_dir, optionally
+                         moving the files; run with the server stopped
+
+Client options (also read from UPLOADS_SERVER/UPLOADS_TOKEN or ~/.uploads.json):
+  --server URL           Server base URL
+  --token TOKEN          Admin token
+`
+
+// clientSettings is the shape of ~/.uploads.json.
+type clientSettings struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+// loadClientSettings merges ~/.uploads.json and the environment; flags are
+// applied on top by the caller.
+func loadClientSettings() clientSettings {
+	settings := clientSettings{Server: "http://localhost:8080"}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		if data, err := os.ReadFile(filepath.Join(home, ".uploads.json")); err == nil {
+			json.Unmarshal(data, &settings)
+		}
+	}
+
+	// UPLOAD_SERVER is what upload.sh has always used
+	for _, name := range []string{"UPLOAD_SERVER", "UPLOADS_SERVER"} {
+		if v := os.Getenv(name); v != "" {
+			settings.Server = v
+		}
+	}
+	if v := os.Getenv("UPLOADS_TOKEN"); v != "" {
+		settings.Token = v
+	}
+	return settings
+}
+
+// parseInterleaved parses flags that may appear before or after positional
+// arguments, e.g. "put file.pdf --ttl 24h".
+func parseInterleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func runClient(command string, args []string) error {
+	settings := loadClientSettings()
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.StringVar(&settings.Server, "server", settings.Server, "server base URL")
+	fs.StringVar(&settings.Token, "token", settings.Token, "admin token")
+	quiet := fs.Bool("q", false, "no progress output")
+
+	var (
+		ttl          = fs.Duration("ttl", 0, "time to live, e.g. 24h")
+		maxDownloads = fs.Int("max-downloads", 0, "maximum downloads")
+		password     = fs.String("password", "", "file password")
+		description  = fs.String("description", "", "file description")
+		tags         = fs.String("tags", "", "comma-separated tags")
+		output       = fs.String("o", "", "output path")
+		limit        = fs.Int("limit", 50, "files per page")
+		offset       = fs.Int("offset", 0, "files to skip")
+	)
+
+	positional, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+
+	c := client.New(settings.Server, settings.Token)
+	if !*quiet {
+		c.Progress = os.Stderr
+	}
+	ctx := context.Background()
+
+	needArg := func() (string, error) {
+		if len(positional) != 1 {
+			return "", fmt.Errorf("%s expects exactly one argument\n\n%s", command, cliUsage)
+		}
+		return positional[0], nil
+	}
+
+	switch command {
+	case "put":
+		path, err := needArg()
+		if err != nil {
+			return err
+		}
+		opts := client.UploadOptions{
+			TTL:          *ttl,
+			MaxDownloads: *maxDownloads,
+			Password:     *password,
+			Description:  *description,
+		}
+		if *tags != "" {
+			opts.Tags = strings.Split(*tags, ",")
+		}
+		result, err := c.Put(ctx, path, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Println(result.DownloadURL)
+
+	case "get":
+		id, err := needArg()
+		if err != nil {
+			return err
+		}
+		written, err := c.Get(ctx, id, *password, *output)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Saved %s (checksum verified)\n", written)
+
+	case "ls":
+		result, err := c.List(ctx, *limit, *offset)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSIZE\tEXPIRES\tDOWNLOADS")
+		for _, f := range result.Files {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", f.ID, f.OriginalName, formatBytes(f.Size),
+				f.ExpiresAt.Local().Format(time.DateTime), f.Downloads)
+		}
+		tw.Flush()
+		fmt.Fprintf(os.Stderr, "%d of %d files\n", len(result.Files), result.Total)
+
+	case "rm":
+		id, err := needArg()
+		if err != nil {
+			return err
+		}
+		if err := c.Delete(ctx, id); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Deleted %s\n", id)
+
+	case "stat":
+		id, err := needArg()
+		if err != nil {
+			return err
+		}
+		info, err := c.Stat(ctx, id)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(info)
+	}
+	return nil
+}
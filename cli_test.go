@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"uploads/client"
+)
+
+func TestClientRoundTrip(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) {
+		c.RequirePassword = true
+		c.AdminPassword = "secret"
+	})
+	c := client.New(server.URL+"/", "secret")
+	var progress bytes.Buffer
+	c.Progress = &progress
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	content := testContent(100 << 10)
+	path := filepath.Join(dir, "report.bin")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded, err := c.Put(ctx, path, client.UploadOptions{
+		TTL:         24 * time.Hour,
+		Description: "quarterly",
+		Tags:        []string{"finance", "q3"},
+	})
+	if err != nil {
+		t.Fatal("put:", err)
+	}
+	if uploaded.ID == "" || uploaded.DownloadURL == "" || uploaded.Size != int64(len(content)) {
+		t.Fatalf("put result %+v", uploaded)
+	}
+	if !bytes.Contains(progress.Bytes(), []byte("(100%)")) {
+		t.Errorf("progress output %q doesn't reach 100%%", progress.String())
+	}
+
+	info, err := c.Stat(ctx, uploaded.ID)
+	if err != nil {
+		t.Fatal("stat:", err)
+	}
+	if info.OriginalName != "report.bin" || info.Description != "quarterly" || !slices.Equal(info.Tags, []string{"finance", "q3"}) {
+		t.Errorf("stat %+v", info)
+	}
+	if ttl := time.Until(info.ExpiresAt); ttl < 23*time.Hour || ttl > 25*time.Hour {
+		t.Errorf("expires in %v, want about 24h", ttl)
+	}
+
+	list, err := c.List(ctx, 10, 0)
+	if err != nil {
+		t.Fatal("ls:", err)
+	}
+	if list.Total != 1 || len(list.Files) != 1 || list.Files[0].ID != uploaded.ID {
+		t.Errorf("ls %+v", list)
+	}
+
+	out := filepath.Join(dir, "out.bin")
+	written, err := c.Get(ctx, uploaded.ID, "", out)
+	if err != nil {
+		t.Fatal("get:", err)
+	}
+	if got, _ := os.ReadFile(written); !bytes.Equal(got, content) {
+		t.Error("downloaded content differs")
+	}
+
+	// Without -o the file is named after the upload
+	t.Chdir(dir)
+	os.Remove(path)
+	if written, err := c.Get(ctx, uploaded.ID, "", ""); err != nil || written != "report.bin" {
+		t.Errorf("get without a path wrote %q, %v", written, err)
+	}
+
+	if err := c.Delete(ctx, uploaded.ID); err != nil {
+		t.Fatal("rm:", err)
+	}
+	var statusErr *client.StatusError
+	if _, err := c.Stat(ctx, uploaded.ID); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusGone {
+		t.Errorf("stat after rm: %v, want a 410", err)
+	}
+}
+
+func TestClientChecksLimitsBeforeSending(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.MaxFileSize = 1024
+	})
+	c := client.New(server.URL, "")
+	path := filepath.Join(t.TempDir(), "big.bin")
+	os.WriteFile(path, testContent(2048), 0644)
+
+	if _, err := c.Put(context.Background(), path, client.UploadOptions{}); err == nil {
+		t.Fatal("put of a file over max_file_size succeeded")
+	}
+	if n := len(storedKeys(fm)); n != 0 {
+		t.Errorf("%d files stored, want none", n)
+	}
+}
+
+func TestClientGetVerifiesChecksum(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Checksum", "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+		w.Write([]byte("tampered"))
+	}))
+	defer server.Close()
+
+	out := filepath.Join(t.TempDir(), "out.bin")
+	if _, err := client.New(server.URL, "").Get(context.Background(), "abc", "", out); err == nil {
+		t.Fatal("get accepted content that doesn't match X-Checksum")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("the mismatched download was left behind")
+	}
+}
+
+func TestClientRetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"id":"abc","original_name":"a.txt"}`))
+		}
+	}))
+	defer server.Close()
+
+	info, err := client.New(server.URL, "").Stat(context.Background(), "abc")
+	if err != nil || info.ID != "abc" {
+		t.Fatalf("stat: %+v, %v", info, err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("%d requests, want a retry after the 503", calls.Load())
+	}
+
+	// Client errors aren't retried
+	calls.Store(0)
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer missing.Close()
+	if _, err := client.New(missing.URL, "").Stat(context.Background(), "abc"); err == nil || calls.Load() != 1 {
+		t.Errorf("404: %v after %d requests, want an error after one", err, calls.Load())
+	}
+}
+
+func TestLoadClientSettings(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("UPLOAD_SERVER", "")
+	t.Setenv("UPLOADS_SERVER", "")
+	t.Setenv("UPLOADS_TOKEN", "")
+
+	if got := loadClientSettings(); got.Server != "http://localhost:8080" || got.Token != "" {
+		t.Errorf("defaults %+v", got)
+	}
+
+	os.WriteFile(filepath.Join(home, ".uploads.json"), []byte(`{"server":"https://file.example","token":"from-file"}`), 0600)
+	if got := loadClientSettings(); got.Server != "https://file.example" || got.Token != "from-file" {
+		t.Errorf("from ~/.uploads.json %+v", got)
+	}
+
+	// The environment wins over the file, and UPLOADS_SERVER over the
+	// older UPLOAD_SERVER
+	t.Setenv("UPLOAD_SERVER", "https://old.example")
+	t.Setenv("UPLOADS_SERVER", "https://env.example")
+	t.Setenv("UPLOADS_TOKEN", "from-env")
+	if got := loadClientSettings(); got.Server != "https://env.example" || got.Token != "from-env" {
+		t.Errorf("from the environment %+v", got)
+	}
+}
+
+func TestParseInterleaved(t *testing.T) {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "")
+	quiet := fs.Bool("q", false, "")
+	positional, err := parseInterleaved(fs, []string{"-q", "file.pdf", "--ttl", "24h", "other.pdf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(positional, []string{"file.pdf", "other.pdf"}) || *ttl != 24*time.Hour || !*quiet {
+		t.Errorf("positional %q, ttl %v, quiet %v", positional, *ttl, *quiet)
+	}
+}
@@ -0,0 +1,421 @@
+// Package client talks to an uploads server over its JSON API.
+package client
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a small API client with retries. Progress, when set, receives
+// human-readable transfer progress.
+type Client struct {
+	Server   string
+	Token    string
+	HTTP     *http.Client
+	Retries  int
+	Progress io.Writer
+}
+
+func New(server, token string) *Client {
+	return &Client{
+		Server:  strings.TrimSuffix(server, "/"),
+		Token:   token,
+		HTTP:    &http.Client{},
+		Retries: 3,
+	}
+}
+
+// FileInfo is the subset of the server's file record the client uses.
+type FileInfo struct {
+	ID           string            `json:"id"`
+	Filename     string            `json:"filename"`
+	OriginalName string            `json:"original_name"`
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"content_type"`
+	Checksum     string            `json:"checksum"`
+	UploadTime   time.Time         `json:"upload_time"`
+	ExpiresAt    time.Time         `json:"expires_at"`
+	Downloads    int               `json:"downloads"`
+	MaxDownloads int               `json:"max_downloads"`
+	Tags         []string          `json:"tags"`
+	Description  string            `json:"description"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+type UploadOptions struct {
+	TTL          time.Duration
+	MaxDownloads int
+	Password     string
+	Description  string
+	Tags         []string
+}
+
+type UploadResult struct {
+	ID          string `json:"id"`
+	DownloadURL string `json:"download_url"`
+	LandingURL  string `json:"landing_url"`
+	Checksum    string `json:"checksum"`
+	Size        int64  `json:"size"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+type ListResult struct {
+	Files  []FileInfo `json:"files"`
+	Total  int        `json:"total"`
+	Limit  int        `json:"limit"`
+	Offset int        `json:"offset"`
+}
+
+// Capabilities is the subset of the server's /api/capabilities the client
+// checks uploads against.
+type Capabilities struct {
+	APIVersion int `json:"api_version"`
+	Uploads    struct {
+		MaxFileSize       int64            `json:"max_file_size"`
+		MaxPasswordLength int              `json:"max_password_length"`
+		FieldLimits       map[string]int64 `json:"field_limits"`
+		MaxFieldLength    int64            `json:"max_field_length"`
+	} `json:"uploads"`
+}
+
+// StatusError is returned for non-2xx responses.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// do sends the request built by newRequest, retrying network errors and 5xx
+// responses with exponential backoff. newRequest is called once per attempt
+// so request bodies can be recreated.
+func (c *Client) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(1<<(attempt-1)) * 500 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Accept", "application/json")
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+
+		resp, err := c.HTTP.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			lastErr = readStatusError(resp)
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return nil, readStatusError(resp)
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+func readStatusError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("GET", c.Server+path, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Capabilities fetches what the server accepts. Servers older than
+// /api/capabilities answer with a *StatusError of 404.
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+	var caps Capabilities
+	if err := c.getJSON(ctx, "/api/capabilities", &caps); err != nil {
+		return nil, err
+	}
+	return &caps, nil
+}
+
+// checkUpload returns the reason the server would refuse an upload of size
+// bytes with opts, or nil.
+func (caps *Capabilities) checkUpload(size int64, opts UploadOptions) error {
+	u := caps.Uploads
+	if u.MaxFileSize > 0 && size > u.MaxFileSize {
+		return fmt.Errorf("file is %d bytes, the server accepts at most %d", size, u.MaxFileSize)
+	}
+	if u.MaxPasswordLength > 0 && len(opts.Password) > u.MaxPasswordLength {
+		return fmt.Errorf("password is longer than %d bytes", u.MaxPasswordLength)
+	}
+	fields := map[string]int{"description": len(opts.Description), "tags": len(strings.Join(opts.Tags, ","))}
+	for name, length := range fields {
+		limit, ok := u.FieldLimits[name]
+		if !ok {
+			limit = u.MaxFieldLength
+		}
+		if limit > 0 && int64(length) > limit {
+			return fmt.Errorf("%s is longer than %d bytes", name, limit)
+		}
+	}
+	return nil
+}
+
+// Put uploads the file at path. When the server describes its limits, an
+// upload it would refuse fails before any content is sent.
+func (c *Client) Put(ctx context.Context, path string, opts UploadOptions) (*UploadResult, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	caps, err := c.Capabilities(ctx)
+	var statusErr *StatusError
+	switch {
+	case err == nil:
+		if err := caps.checkUpload(stat.Size(), opts); err != nil {
+			return nil, err
+		}
+	case !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound:
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		go func() {
+			defer f.Close()
+			pw.CloseWithError(writeUploadForm(mw, f, filepath.Base(path), opts, c.progress(stat.Size())))
+		}()
+
+		req, err := http.NewRequest("POST", c.Server+"/upload", pr)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result UploadResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func writeUploadForm(mw *multipart.Writer, f io.Reader, name string, opts UploadOptions, progress io.Writer) error {
+	fields := map[string]string{}
+	if opts.TTL > 0 {
+		fields["ttl"] = strconv.Itoa(int(opts.TTL / time.Second))
+	}
+	if opts.MaxDownloads > 0 {
+		fields["max_downloads"] = strconv.Itoa(opts.MaxDownloads)
+	}
+	if opts.Password != "" {
+		fields["password"] = opts.Password
+	}
+	if opts.Description != "" {
+		fields["description"] = opts.Description
+	}
+	if len(opts.Tags) > 0 {
+		fields["tags"] = strings.Join(opts.Tags, ",")
+	}
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			return err
+		}
+	}
+
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.MultiWriter(part, progress), f); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// Get downloads a file to outPath, or to its original name in the current
+// directory when outPath is empty, and verifies the server's X-Checksum.
+// It returns the path written.
+func (c *Client) Get(ctx context.Context, id, password, outPath string) (string, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		u := c.Server + "/download/" + url.PathEscape(id)
+		if password != "" {
+			u += "?password=" + url.QueryEscape(password)
+		}
+		return http.NewRequest("GET", u, nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if outPath == "" {
+		outPath = id
+		if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+			outPath = filepath.Base(params["filename"])
+		}
+	}
+
+	checksum := resp.Header.Get("X-Checksum")
+	hasher, err := hasherFor(checksum)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return "", err
+	}
+
+	writers := []io.Writer{out, c.progress(resp.ContentLength)}
+	if hasher != nil {
+		writers = append(writers, hasher)
+	}
+	_, err = io.Copy(io.MultiWriter(writers...), resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+
+	if hasher != nil {
+		want := checksum
+		if _, digest, ok := strings.Cut(checksum, ":"); ok {
+			want = digest
+		}
+		if got := hex.EncodeToString(hasher.Sum(nil)); got != want {
+			os.Remove(outPath)
+			return "", fmt.Errorf("checksum mismatch: expected %s, got %s", want, got)
+		}
+	}
+	return outPath, nil
+}
+
+// hasherFor returns a hash matching the server's checksum format, or nil when
+// the server sent none.
+func hasherFor(checksum string) (hash.Hash, error) {
+	if checksum == "" {
+		return nil, nil
+	}
+	algorithm := "sha256"
+	if a, _, ok := strings.Cut(checksum, ":"); ok {
+		algorithm = a
+	}
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	}
+	return nil, errors.New("unsupported checksum algorithm " + algorithm)
+}
+
+func (c *Client) List(ctx context.Context, limit, offset int) (*ListResult, error) {
+	var result ListResult
+	path := fmt.Sprintf("/api/files?limit=%d&offset=%d", limit, offset)
+	if err := c.getJSON(ctx, path, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *Client) Stat(ctx context.Context, id string) (*FileInfo, error) {
+	var info FileInfo
+	if err := c.getJSON(ctx, "/info/"+url.PathEscape(id), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) Delete(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("GET", c.Server+"/delete/"+url.PathEscape(id), nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// progress returns a writer that reports bytes passing through it.
+func (c *Client) progress(total int64) io.Writer {
+	if c.Progress == nil {
+		return io.Discard
+	}
+	return &progressWriter{out: c.Progress, total: total}
+}
+
+type progressWriter struct {
+	out     io.Writer
+	total   int64
+	written int64
+	last    time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	done := p.total > 0 && p.written >= p.total
+	if done || time.Since(p.last) >= 200*time.Millisecond {
+		p.last = time.Now()
+		if p.total > 0 {
+			fmt.Fprintf(p.out, "\r%d / %d bytes (%d%%)", p.written, p.total, p.written*100/p.total)
+		} else {
+			fmt.Fprintf(p.out, "\r%d bytes", p.written)
+		}
+		if done {
+			fmt.Fprintln(p.out)
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+// Config sources: a setting comes from config.json or is a built-in default.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+)
+
+// ConfigValue is a setting as shown by GET /api/admin/config.
+type ConfigValue struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// describeConfig lists every setting of config under its JSON name, with
+// secret fields redacted. A setting's source is "file" when config.json sets
+// it and "default" otherwise.
+func describeConfig(config Config) (map[string]ConfigValue, error) {
+	var fileKeys map[string]json.RawMessage
+	if data, err := os.ReadFile(configFile); err == nil {
+		if err := json.Unmarshal(data, &fileKeys); err != nil {
+			return nil, fmt.Errorf("%s: %w", configFile, err)
+		}
+	}
+
+	described := make(map[string]ConfigValue)
+	v := reflect.ValueOf(config)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		value := v.Field(i).Interface()
+		if field.Tag.Get("secret") == "true" {
+			value = redact(v.Field(i))
+		}
+		source := sourceDefault
+		if _, ok := fileKeys[name]; ok {
+			source = sourceFile
+		}
+		described[name] = ConfigValue{Value: value, Source: source}
+	}
+	return described, nil
+}
+
+// redact hides a secret while showing whether it is set. For maps, such as
+// s3_credentials, the keys stay visible and only the values are hidden.
+func redact(v reflect.Value) interface{} {
+	if v.IsZero() {
+		return v.Interface()
+	}
+	if v.Kind() == reflect.Map {
+		masked := make(map[string]string, v.Len())
+		for _, key := range v.MapKeys() {
+			masked[fmt.Sprint(key.Interface())] = redacted
+		}
+		return masked
+	}
+	return redacted
+}
+
+// configAPI handles /api/admin/config: GET shows the running configuration,
+// POST /validate checks a candidate config.json without applying it.
+func (fm *FileManager) configAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		described, err := describeConfig(*fm.config())
+		if err != nil {
+			respondError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(described)
+
+	case len(parts) == 1 && parts[0] == "validate" && r.Method == "POST":
+		var body bytes.Buffer
+		if _, err := body.ReadFrom(http.MaxBytesReader(w, r.Body, 1<<20)); err != nil {
+			respondError(w, r, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		respondJSON(w, http.StatusOK, fm.validateCandidate(body.Bytes()))
+
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validateCandidate reports what would happen if data became config.json:
+// problems that would stop the service from starting or reloading, and
+// changed settings that only take effect after a restart.
+func (fm *FileManager) validateCandidate(data []byte) map[string]interface{} {
+	problems := []string{}
+	candidate := defaultConfig()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&candidate); err != nil {
+		problems = append(problems, err.Error())
+	} else if err := candidate.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	restart := []string{}
+	if len(problems) == 0 {
+		current := reflect.ValueOf(*fm.config())
+		next := reflect.ValueOf(candidate)
+		t := current.Type()
+		for _, name := range restartOnlySettings {
+			if !reflect.DeepEqual(current.FieldByName(name).Interface(), next.FieldByName(name).Interface()) {
+				field, _ := t.FieldByName(name)
+				jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+				restart = append(restart, jsonName)
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"valid":            len(problems) == 0,
+		"problems":         problems,
+		"restart_required": restart,
+	}
+}
+
+// printConfig implements the print-config command: the configuration the
+// server would start with, redacted like GET /api/admin/config.
+func printConfig() error {
+	config := loadConfig()
+	described, err := describeConfig(config)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(described); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return nil
+}
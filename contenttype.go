@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+func init() {
+	jobRunners["content-types"] = runContentTypeBackfill
+}
+
+// sniffedTypes caches content types detected from file contents, keyed by
+// checksum so identical content is only sniffed once.
+var sniffedTypes sync.Map
+
+// vagueContentType reports whether a stored type says nothing useful, i.e.
+// the client sent none or the generic octet-stream.
+func vagueContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err != nil || mediaType == "application/octet-stream"
+}
+
+// effectiveContentType is the type reported for a file. A specific stored type
+// is always kept; a vague one is replaced by the type implied by the file
+// extension or, failing that, one sniffed earlier from the content.
+func (f *FileInfo) effectiveContentType() string {
+	if !vagueContentType(f.ContentType) {
+		return f.ContentType
+	}
+	if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(f.OriginalName))); byExt != "" {
+		return byExt
+	}
+	if sniffed, ok := sniffedTypes.Load(f.Checksum); ok {
+		return sniffed.(string)
+	}
+	return f.ContentType
+}
+
+// detectContentType is effectiveContentType, sniffing the file's leading
+// bytes when neither the stored type nor the extension help.
+func (fm *FileManager) detectContentType(fileInfo *FileInfo) string {
+	contentType := fileInfo.effectiveContentType()
+	if !vagueContentType(contentType) {
+		return contentType
+	}
+
+	f, err := fm.openContent(fileInfo)
+	if err != nil {
+		return contentType
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return contentType
+	}
+	sniffed := http.DetectContentType(head[:n])
+	if fileInfo.Checksum != "" {
+		sniffedTypes.Store(fileInfo.Checksum, sniffed)
+	}
+	return sniffed
+}
+
+// runContentTypeBackfill stores the detected type for every file whose stored
+// type is vague. Files are skipped when nothing better than octet-stream can
+// be found, so rerunning the job is harmless.
+func runContentTypeBackfill(fm *FileManager, job *Job, params map[string]string) error {
+	fm.mutex.RLock()
+	var targets []*FileInfo
+	for _, fileInfo := range fm.files {
+		if !fileInfo.isLink() && vagueContentType(fileInfo.ContentType) {
+			targets = append(targets, fileInfo)
+		}
+	}
+	fm.mutex.RUnlock()
+
+	job.setTotal(len(targets))
+
+	for _, fileInfo := range targets {
+		if contentType := fm.detectContentType(fileInfo); !vagueContentType(contentType) {
+			fm.mutex.Lock()
+			fileInfo.ContentType = contentType
+			fm.mutex.Unlock()
+		}
+		job.advance(nil)
+	}
+
+	return fm.saveMetadata()
+}
+
+func (fm *FileManager) startContentTypeBackfill(w http.ResponseWriter, r *http.Request) {
+	job := fm.startJob("content-types", nil)
+	fm.writeJobAccepted(w, job)
+}
+
+// attachmentDisposition is the Content-Disposition of a download saved as
+// name, built with mime.FormatMediaType so quotes, semicolons and line
+// breaks in a name can't break or extend the header. Per RFC 6266, names
+// that aren't plain printable ASCII, or contain path separators, get an
+// ASCII filename for old clients, with those characters as "_", followed by
+// the exact name percent-encoded as filename* (RFC 5987), which browsers
+// prefer.
+func attachmentDisposition(name string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' || r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": fallback})
+	if disposition == "" {
+		return "attachment"
+	}
+	if fallback != name {
+		disposition += "; filename*=UTF-8''" + encodeExtValue(name)
+	}
+	return disposition
+}
+
+// encodeExtValue percent-encodes s as an RFC 5987 ext-value, leaving only
+// attr-chars as they are.
+func encodeExtValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
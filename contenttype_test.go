@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachmentDisposition(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		fallback string // the ASCII filename; "" when filename* isn't needed
+	}{
+		{"report.pdf", ""},
+		{`say "hi".txt`, ""},
+		{"a; filename=evil.exe", ""},
+		{"line\r\nSet-Cookie: x=1.txt", "line__Set-Cookie: x=1.txt"},
+		{`back\slash.txt`, "back_slash.txt"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{"party 🎉.png", "party _.png"},
+		{"отчёт.pdf", "_____.pdf"},
+		{"報告書.docx", "___.docx"},
+		{"tab\there.txt", "tab_here.txt"},
+	} {
+		header := attachmentDisposition(tc.name)
+		if strings.ContainsAny(header, "\r\n") {
+			t.Errorf("%q: header %q contains a line break", tc.name, header)
+			continue
+		}
+
+		// Clients that know filename* get the exact name
+		disposition, params, err := mime.ParseMediaType(header)
+		if err != nil || disposition != "attachment" || params["filename"] != tc.name {
+			t.Errorf("%q: %q parses as %q %v (%v), want the exact name", tc.name, header, disposition, params, err)
+		}
+
+		// The others get the ASCII fallback
+		plain, ext, extended := strings.Cut(header, "; filename*=")
+		if extended != (tc.fallback != "") {
+			t.Errorf("%q: header %q, want filename* only for the fallback %q", tc.name, header, tc.fallback)
+		}
+		if extended && !strings.HasPrefix(ext, "UTF-8''") {
+			t.Errorf("%q: filename* %q lacks the UTF-8 charset", tc.name, ext)
+		}
+		want := tc.fallback
+		if want == "" {
+			want = tc.name
+		}
+		if _, params, err := mime.ParseMediaType(plain); err != nil || params["filename"] != want {
+			t.Errorf("%q: fallback in %q is %q (%v), want %q", tc.name, plain, params["filename"], err, want)
+		}
+	}
+}
+
+func TestDownloadDispositionWellFormed(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	for _, name := range []string{`q"uote;d.txt`, "émoji 🎉.txt", `..\..\win.ini`} {
+		status, uploaded := uploadTestFile(t, server, name, []byte("content"), nil)
+		if status != http.StatusOK {
+			t.Fatalf("upload %q: status %d, body %v", name, status, uploaded)
+		}
+		resp, err := http.Get(server.URL + "/download/" + uploaded["id"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		header := resp.Header.Get("Content-Disposition")
+		if _, params, err := mime.ParseMediaType(header); err != nil || params["filename"] != uploaded["original_name"] {
+			t.Errorf("%q: Content-Disposition %q parses as %v (%v), want original_name %q", name, header, params, err, uploaded["original_name"])
+		}
+		plain, _, _ := strings.Cut(header, "; filename*=")
+		if _, params, err := mime.ParseMediaType(plain); err != nil || strings.ContainsAny(params["filename"], `/\`) {
+			t.Errorf("%q: fallback filename %q (%v) keeps a path separator", name, params["filename"], err)
+		}
+	}
+}
+
+func TestVagueContentTypesCorrected(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	png := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), testContent(64)...)
+	pdf := []byte("%PDF-1.4\n1 0 obj << /Type /Catalog >> endobj\n")
+
+	ids := make(map[string]string)
+	for _, file := range []struct {
+		name, stored string
+		content      []byte
+	}{
+		{"scan.pdf", "", pdf},
+		{"photo.png", "application/octet-stream", png},
+		{"screenshot", "application/octet-stream", png}, // no extension: sniffed
+		{"notes.png", "text/plain; charset=utf-8", png}, // explicit: kept
+	} {
+		status, uploaded := uploadTestFile(t, server, file.name, file.content, nil)
+		if status != http.StatusOK {
+			t.Fatalf("upload of %s: status %d, body %v", file.name, status, uploaded)
+		}
+		id := uploaded["id"].(string)
+		ids[file.name] = id
+		fm.mutex.Lock()
+		fm.files[id].ContentType = file.stored
+		fm.mutex.Unlock()
+	}
+
+	want := map[string]string{
+		"scan.pdf":   "application/pdf",
+		"photo.png":  "image/png",
+		"screenshot": "image/png",
+		"notes.png":  "text/plain; charset=utf-8",
+	}
+	for name, contentType := range want {
+		resp, err := http.Get(server.URL + "/download/" + ids[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Content-Type"); got != contentType {
+			t.Errorf("download of %s: Content-Type %q, want %q", name, got, contentType)
+		}
+	}
+
+	// Listings use the extension, or a type sniffed by an earlier download
+	_, info := getJSON(t, server, "/info/"+ids["scan.pdf"])
+	if info["content_type"] != "application/pdf" {
+		t.Errorf("/info content_type %v, want application/pdf", info["content_type"])
+	}
+	resp, err := http.Get(server.URL + "/search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	for _, file := range listed {
+		if name := file["original_name"].(string); file["content_type"] != want[name] {
+			t.Errorf("listed %s as %v, want %q", name, file["content_type"], want[name])
+		}
+	}
+
+	// The backfill job stores the corrected types, except the explicit one
+	req, _ := http.NewRequest("POST", server.URL+"/api/admin/content-types", nil)
+	status, job := doJSON(t, req)
+	if status != http.StatusAccepted {
+		t.Fatalf("starting the backfill: status %d, body %v", status, job)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for job["status"] == "running" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, job = getJSON(t, server, "/api/admin/jobs/"+job["id"].(string))
+	}
+	if job["status"] != "completed" {
+		t.Fatalf("backfill job %v", job)
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	for name, contentType := range want {
+		if stored := fm.files[ids[name]].ContentType; stored != contentType {
+			t.Errorf("stored type of %s after the backfill %q, want %q", name, stored, contentType)
+		}
+	}
+}
@@ -1,36 +1,137 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"mime/multipart"
 	"net/http"
+	"net/mail"
 	"os"
-	"path/filepath"
+	"path"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Config holds the service settings. Fields tagged secret:"true" are
+// redacted wherever the configuration is shown.
 type Config struct {
-	Port            string        `json:"port"`
-	UploadDir       string        `json:"upload_dir"`
-	MetadataFile    string        `json:"metadata_file"`
-	DefaultTTL      time.Duration `json:"default_ttl"`
-	MaxFileSize     int64         `json:"max_file_size"`
-	AllowedOrigins  []string      `json:"allowed_origins"`
-	CleanupInterval time.Duration `json:"cleanup_interval"`
-	MaxDownloads    int           `json:"max_downloads"`
-	RequirePassword bool          `json:"require_password"`
-	AdminPassword   string        `json:"admin_password"`
-	AllowedTypes    []string      `json:"allowed_types"`
+	Port                  string                   `json:"port"`
+	Listen                string                   `json:"listen"`
+	SocketMode            string                   `json:"socket_mode"`
+	UploadDir             string                   `json:"upload_dir"`
+	StorageBackend        string                   `json:"storage_backend"`
+	MemoryBudget          int64                    `json:"memory_budget"`
+	MaxPathLength         int                      `json:"max_path_length"`
+	MetadataFile          string                   `json:"metadata_file"`
+	MetadataBackend       string                   `json:"metadata_backend"`
+	MetadataDatabase      string                   `json:"metadata_database"`
+	DefaultTTL            time.Duration            `json:"default_ttl"`
+	MaxTTL                time.Duration            `json:"max_ttl"`
+	MaxDecompressionRatio float64                  `json:"max_decompression_ratio"`
+	ExpiryTimezone        string                   `json:"expiry_timezone"`
+	MaxFileSize           int64                    `json:"max_file_size"`
+	AllowedOrigins        []string                 `json:"allowed_origins"`
+	CleanupInterval       time.Duration            `json:"cleanup_interval"`
+	MaxDownloads          int                      `json:"max_downloads"`
+	RequirePassword       bool                     `json:"require_password"`
+	AdminPassword         string                   `json:"admin_password" secret:"true"`
+	Admins                []AdminUser              `json:"admins" secret:"true"`
+	AdminSessionTTL       time.Duration            `json:"admin_session_ttl"`
+	LoginRateLimit        int                      `json:"login_rate_limit"`
+	AllowedTypes          []string                 `json:"allowed_types"`
+	DeniedTypes           []string                 `json:"denied_types"`
+	BaseURL               string                   `json:"base_url"`
+	PathPrefix            string                   `json:"path_prefix"`
+	HealthAtRoot          bool                     `json:"health_at_root"`
+	TrustedProxies        []string                 `json:"trusted_proxies"`
+	ResponseFields        []string                 `json:"upload_response_fields"`
+	MetadataSchema        map[string]MetadataField `json:"metadata_schema"`
+	ChecksumAlgorithm     string                   `json:"checksum_algorithm"`
+	RehashBytesPerSecond  int64                    `json:"rehash_bytes_per_second"`
+	GRPCPort              string                   `json:"grpc_port"`
+	S3Credentials         map[string]string        `json:"s3_credentials" secret:"true"`
+	NotifyWebhookURL      string                   `json:"notify_webhook_url" secret:"true"`
+	MetadataSaveInterval  time.Duration            `json:"metadata_save_interval"`
+	ReadTimeout           time.Duration            `json:"read_timeout"`
+	WriteTimeout          time.Duration            `json:"write_timeout"`
+	IdleTimeout           time.Duration            `json:"idle_timeout"`
+	ShutdownTimeout       time.Duration            `json:"shutdown_timeout"`
+	CacheDir              string                   `json:"cache_dir"`
+	CacheMaxBytes         int64                    `json:"cache_max_bytes"`
+	CacheWaitTimeout      time.Duration            `json:"cache_wait_timeout"`
+	ExpiryWarningRatio    float64                  `json:"expiry_warning_ratio"`
+	PublicListings        bool                     `json:"public_listings"`
+	StripExifLocation     bool                     `json:"strip_exif_location"`
+	TypeMismatchPolicy    string                   `json:"type_mismatch_policy"`
+	ReservedIDs           []string                 `json:"reserved_ids"`
+	FeatureFlags          map[string]bool          `json:"feature_flags"`
+	ReceiptKeyFile        string                   `json:"receipt_key_file"`
+	TombstoneWindow       time.Duration            `json:"tombstone_window"`
+	CleanupMaxFiles       int                      `json:"cleanup_max_files"`
+	CleanupMaxDuration    time.Duration            `json:"cleanup_max_duration"`
+	LinkSigningKey        string                   `json:"link_signing_key" secret:"true"`
+	LinkSigningTTL        time.Duration            `json:"link_signing_ttl"`
+	MaxMetadataKeys       int                      `json:"max_metadata_keys"`
+	MaxMetadataValueLen   int                      `json:"max_metadata_value_length"`
+	SendfileMode          string                   `json:"sendfile_mode"`
+	SendfileLocation      string                   `json:"sendfile_location"`
+	ServeOnSizeMismatch   bool                     `json:"serve_on_size_mismatch"`
+	ListingRateLimit      int                      `json:"listing_rate_limit"`
+	PostLimitGrace        time.Duration            `json:"post_limit_grace"`
+	SMTPHost              string                   `json:"smtp_host"`
+	SMTPPort              int                      `json:"smtp_port"`
+	SMTPUsername          string                   `json:"smtp_username"`
+	SMTPPassword          string                   `json:"smtp_password" secret:"true"`
+	SMTPFrom              string                   `json:"smtp_from"`
+	EmailRateLimit        int                      `json:"email_rate_limit"`
+	NotificationTemplates string                   `json:"notification_template_dir"`
+	LinkPreviews          bool                     `json:"link_previews"`
+	UploadSessionTTL      time.Duration            `json:"upload_session_ttl"`
+	ArchiveSpoolDir       string                   `json:"archive_spool_dir"`
+	ArchiveSpoolThreshold int64                    `json:"archive_spool_threshold"`
+	ArchiveSpoolBudget    int64                    `json:"archive_spool_budget"`
+	ArchiveSpoolTTL       time.Duration            `json:"archive_spool_ttl"`
+	TagHierarchy          bool                     `json:"tag_hierarchy"`
+	MaxTotalSize          int64                    `json:"max_total_size"`
+	EvictOnFull           bool                     `json:"evict_on_full"`
+	StorageWarnings       []float64                `json:"storage_warning_thresholds"`
+	StorageHysteresis     float64                  `json:"storage_warning_hysteresis"`
+	StorageLatencyLimits  map[string]time.Duration `json:"storage_latency_thresholds"`
+	ChangeLogRetention    time.Duration            `json:"change_log_retention"`
+	SlowRequestThreshold  time.Duration            `json:"slow_request_threshold"`
+	LargeTransferBytes    int64                    `json:"large_transfer_threshold"`
+	MetricsEnabled        bool                     `json:"metrics_enabled"`
+	Backup                BackupConfig             `json:"backup"`
+	DuplicateWindow       time.Duration            `json:"duplicate_window"`
+	DevMode               bool                     `json:"dev_mode"`
+	StatsMaxStaleness     time.Duration            `json:"stats_max_staleness"`
+	ColdStorageDir        string                   `json:"cold_storage_dir"`
+	ColdAfter             time.Duration            `json:"cold_after"`
+	ColdMinSize           int64                    `json:"cold_min_size"`
+	RehydrateOnAccess     bool                     `json:"rehydrate_on_access"`
+	MissingFilesLimit     float64                  `json:"missing_files_limit"`
+	AsyncChecksumSize     int64                    `json:"async_checksum_size"`
+	RequireIfMatch        bool                     `json:"require_if_match"`
+	TagPasswords          map[string]string        `json:"tag_passwords" secret:"true"`
+	AutoTagRules          []AutoTagRule            `json:"auto_tag_rules"`
+	Strict                bool                     `json:"strict"`
+	UploadRateLimit       int                      `json:"upload_rate_limit"`
+	UploadBytesPerHour    int64                    `json:"upload_bytes_per_hour"`
+	MaxBytesPerUploader   int64                    `json:"max_bytes_per_uploader"`
 }
 
 type FileInfo struct {
@@ -48,14 +149,86 @@ type FileInfo struct {
 	UploaderIP   string            `json:"uploader_ip"`
 	Tags         []string          `json:"tags"`
 	Description  string            `json:"description"`
-	Path         string            `json:"path"`
+	Title        string            `json:"title"` // display name, see Label
+	StorageKey   string            `json:"path"`
 	Metadata     map[string]string `json:"metadata"`
+	LastDownload time.Time         `json:"last_download"`
+	Appendable   bool              `json:"appendable,omitempty"`       // open for PATCH /put/{id} until finalized
+	Tier         string            `json:"tier,omitempty"`             // "cold" once moved to cold_storage_dir, see tiering.go
+	HashPending  bool              `json:"checksum_pending,omitempty"` // stored before being hashed, see checksumjob.go
+	GraceUntil   *time.Time        `json:"grace_until,omitempty"`      // kept until then once the download limit is reached
+	LinkTarget   string            `json:"link_target,omitempty"`      // external URL for links, see links.go
+	KeyID        string            `json:"key_id,omitempty"`           // API key the file was uploaded with
+	Recipients   []Recipient       `json:"recipients,omitempty"`       // see recipients.go
+	TTLSource    string            `json:"ttl_source,omitempty"`       // how ExpiresAt was determined, see resolveTTL
+	Encoding     string            `json:"content_encoding,omitempty"` // Content-Encoding the upload was sent with, see putUpload
+	WireSize     int64             `json:"wire_size,omitempty"`        // bytes received for an encoded upload; Size is what was stored
+	Revision     int64             `json:"revision"`                   // bumped by recordChange, see ETag
+
+	recipientTokens []string // plain recipient tokens, only known to the upload response
 }
 
 type FileManager struct {
-	config Config
-	files  map[string]*FileInfo
-	mutex  sync.RWMutex
+	cfg   atomic.Pointer[Config] // see config()
+	files map[string]*FileInfo
+	mutex sync.RWMutex
+	// reservedBytes is the space set aside by uploads in progress, see
+	// reserveStorage. Guarded by mutex.
+	reservedBytes int64
+
+	jobs        map[string]*Job
+	pendingJobs map[string]pendingJob
+	jobsMutex   sync.Mutex
+
+	persistence  persistenceState
+	persister    *metadataPersister
+	stop         chan struct{}  // closed by Close to end the background routines
+	routines     sync.WaitGroup // the background routines started by NewFileManager
+	closeOnce    sync.Once
+	saveMutex    sync.Mutex
+	cleanupState cleanupState
+
+	storage  Storage
+	cold     Storage // cold_storage_dir, nil unless configured
+	metadata MetadataStore
+	index    FileIndex // the file records, see fileindex.go
+	cache    *downloadCache
+	spool    *archiveSpool
+
+	storageAlerts storageAlerts
+	inodeAlerts   storageAlerts
+	latency       storageLatency
+	metrics       phaseMetrics
+	backups       backupState
+	submissions   submissionGuard
+	aggregates    aggregateCache
+	migrations    tierMigrations
+
+	transfers         transferStats
+	downloads         downloadCounter
+	listingLimiter    listingLimiter
+	loginLimiter      listingLimiter
+	uploadLimits      uploadLimiter
+	adminSessions     adminSessionStore
+	verifiedPasswords passwordCache
+	activity          activityLog
+	tagProtection     tagRuleStore
+	appendLocks       appendLocks
+	emails            emailQueue
+	changes           changeLog
+	fileRequests      fileRequestStore
+
+	notifyTemplates atomic.Pointer[notificationTemplates] // see loadCustomNotifications
+
+	mux         *http.ServeMux
+	reservedIDs map[string]bool // first path segments of registered routes
+	tombstones  map[string]tombstone
+	buried      bool // tombstones changed since the last saveTombstones
+	receipts    *receiptSigner
+	apiKeys     apiKeyStore
+	adminUsers  adminUserStore
+	blocklist   hashBlocklist
+	sessions    uploadSessions
 }
 
 type UploadStats struct {
@@ -63,388 +236,1163 @@ type UploadStats struct {
 	TotalSize      int64 `json:"total_size"`
 	TotalDownloads int   `json:"total_downloads"`
 	ActiveFiles    int   `json:"active_files"`
+
+	AbortedUploads   int64 `json:"aborted_uploads"`
+	AbortedDownloads int64 `json:"aborted_downloads"`
+
+	ByStatus     map[FileStatus]StatusStats `json:"by_status"`
+	ByTier       map[string]StatusStats     `json:"by_tier"`
+	Downloads24h int64                      `json:"downloads_24h"`
+	Downloads7d  int64                      `json:"downloads_7d"`
+
+	Cache   *CacheStats  `json:"cache,omitempty"`
+	Cleanup CleanupStats `json:"cleanup"`
+
+	// AggregatesAge is how old the cached file totals are, for admins.
+	AggregatesAge *float64 `json:"aggregates_age_seconds,omitempty"`
+	// TopUploaders are the clients storing the most, for admins.
+	TopUploaders []UploaderStats `json:"top_uploaders,omitempty"`
+	// Storage is the space used against max_total_size, when it is set.
+	Storage *StorageUsage `json:"storage,omitempty"`
+
+	age time.Duration
+}
+
+type StatusStats struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+// Status returns the counts for one status, for use in templates.
+func (s UploadStats) Status(status string) StatusStats {
+	return s.ByStatus[FileStatus(status)]
+}
+
+// statsFilter narrows the files counted by computeStats. Empty fields match
+// everything; expired files are left out unless IncludeExpired is set.
+type statsFilter struct {
+	Tag            tagFilter
+	Type           string // content type prefix, e.g. "image/"
+	IncludeExpired bool
+	Key            *APIKey  // limits the files to those the key may see
+	Hidden         tagRules // protected tags whose files are left out
+}
+
+func (f statsFilter) matches(fileInfo *FileInfo) bool {
+	if !f.IncludeExpired && fileInfo.Status() == StatusExpired {
+		return false
+	}
+	if !f.Key.permits(fileInfo) || f.Hidden.protects(fileInfo.Tags) {
+		return false
+	}
+	if !f.Tag.matches(fileInfo.Tags) {
+		return false
+	}
+	return f.Type == "" || strings.HasPrefix(fileInfo.effectiveContentType(), f.Type)
 }
 
 func NewFileManager(config Config) *FileManager {
 	fm := &FileManager{
-		config: config,
-		files:  make(map[string]*FileInfo),
+		files:       make(map[string]*FileInfo),
+		jobs:        make(map[string]*Job),
+		pendingJobs: make(map[string]pendingJob),
+		persister:   newMetadataPersister(),
+		stop:        make(chan struct{}),
+		mux:         http.NewServeMux(),
+		reservedIDs: make(map[string]bool),
+	}
+	fm.cfg.Store(&config)
+	fm.storage, fm.metadata = newStorage(config)
+	fm.storage = timedStorage{fm.storage, fm}
+	index, err := newFileIndex(&config, fm.metadata)
+	if err != nil {
+		log.Fatalf("Error opening the %s metadata backend: %v", config.MetadataBackend, err)
 	}
+	fm.index = index
+
+	if config.ColdStorageDir != "" && config.StorageBackend != storageMemory {
+		fm.cold = localStorage{dir: config.ColdStorageDir}
+		if err := fm.cold.MkdirAll("", 0755); err != nil {
+			log.Printf("Cold storage unavailable: %v", err)
+		}
+	}
+
+	cache, err := newDownloadCache(config)
+	if err != nil {
+		log.Printf("Download cache disabled: %v", err)
+	}
+	fm.cache = cache
+
+	// Spooled archives live on disk, which the memory backend must not need
+	if config.StorageBackend != storageMemory {
+		spool, err := newArchiveSpool(config.ArchiveSpoolDir)
+		if err != nil {
+			log.Printf("Archive spooling disabled: %v", err)
+		}
+		fm.spool = spool
+	}
+
+	receipts, err := loadReceiptSigner(fm.metadata, config.ReceiptKeyFile)
+	if err != nil {
+		log.Printf("Upload receipts disabled: %v", err)
+	}
+	fm.receipts = receipts
 
 	// Load existing file metadata
+	fm.loadChanges()
 	fm.loadMetadata()
+	fm.loadTombstones()
+	fm.loadActivity()
+	fm.loadAPIKeys()
+	fm.loadAdminUsers()
+	fm.loadFileRequests()
+	fm.loadBlocklist()
+	fm.loadTagRules()
+	fm.loadUploadSessions()
+	fm.loadCustomNotifications()
+	fm.warnOpenAdmin()
+
+	// Partial uploads can't be resumed, so a crash mid-upload leaves garbage
+	fm.removeStaleParts()
+
+	// Pick up background jobs interrupted by a restart
+	fm.resumeJobs()
 
 	// Start cleanup routine
-	go fm.cleanupRoutine()
+	fm.goRoutine(fm.cleanupRoutine)
 
 	// Save metadata periodically
-	go fm.saveMetadataPeriodically()
+	fm.goRoutine(fm.saveMetadataPeriodically)
+
+	// Coalesce saves requested by downloads
+	go fm.runPersister()
+
+	// Write scheduled backups
+	fm.goRoutine(fm.backupRoutine)
+
+	// Move unused files to cold storage
+	fm.goRoutine(fm.tieringRoutine)
 
 	return fm
 }
 
 func (fm *FileManager) loadMetadata() {
-	data, err := os.ReadFile(fm.config.MetadataFile)
-	if err != nil {
+	records, err := fm.index.Load()
+	if errors.Is(err, fs.ErrNotExist) {
 		log.Printf("No existing metadata file found, starting fresh")
 		return
 	}
-
-	var files map[string]*FileInfo
-	if err := json.Unmarshal(data, &files); err != nil {
-		log.Printf("Error loading metadata: %v", err)
+	if err != nil {
+		log.Printf("WARNING: %v. Starting with no files; the stored files are left in place.", err)
 		return
 	}
 
+	files := make(map[string]*FileInfo, len(records))
+	for id, record := range records {
+		var fileInfo FileInfo
+		if err := json.Unmarshal(record, &fileInfo); err != nil {
+			log.Printf("Error loading metadata of %s: %v", id, err)
+			continue
+		}
+		files[id] = &fileInfo
+	}
+
 	// Verify files still exist on disk
 	validFiles := make(map[string]*FileInfo)
+	missing := make(map[string]*FileInfo)
 	for id, fileInfo := range files {
-		if _, err := os.Stat(fileInfo.Path); err == nil {
+		fileInfo.StorageKey = fm.normalizeStorageKey(fileInfo.StorageKey)
+		if _, err := fm.contentStorage(fileInfo).Stat(fileInfo.StorageKey); err == nil || fileInfo.isLink() {
+			validFiles[id] = fileInfo
+		} else if fileInfo.tier() == tierCold && fm.cold == nil {
+			// Kept for when cold_storage_dir is configured again
+			log.Printf("Cold storage not configured, %s is unavailable", fileInfo.Filename)
 			validFiles[id] = fileInfo
 		} else {
+			missing[id] = fileInfo
+		}
+	}
+
+	if tooManyMissing(fm.config(), len(missing), len(files)) {
+		// More likely a moved or unmounted upload_dir than lost files, so
+		// the index is kept for when the files are back
+		log.Printf("WARNING: %d of %d files are missing from %s; keeping them in the index. "+
+			"If upload_dir was moved, update it or run \"uploads relocate-files <old> <new>\".",
+			len(missing), len(files), fm.config().UploadDir)
+		maps.Copy(validFiles, missing)
+	} else {
+		for id, fileInfo := range missing {
 			log.Printf("File not found on disk, removing from metadata: %s", fileInfo.Filename)
+			fm.recordChange(changeDeleted, id, fileInfo)
 		}
 	}
 
+	if hashed := hashPlainPasswords(validFiles); hashed > 0 {
+		log.Printf("Hashed the plain-text passwords of %d files", hashed)
+		fm.requestSave()
+	}
 	fm.files = validFiles
 	log.Printf("Loaded %d files from metadata", len(fm.files))
 }
 
+// missingFilesMinimum is the smallest index missing_files_limit applies to,
+// so a few stale entries in a small index are still dropped.
+const missingFilesMinimum = 10
+
+// tooManyMissing reports whether missing of total indexed files exceeds
+// missing_files_limit, which 1 disables.
+func tooManyMissing(config *Config, missing, total int) bool {
+	if total < missingFilesMinimum || config.MissingFilesLimit >= 1 {
+		return false
+	}
+	return float64(missing) > config.MissingFilesLimit*float64(total)
+}
+
 func (fm *FileManager) saveMetadata() error {
-	fm.mutex.RLock()
-	defer fm.mutex.RUnlock()
+	// Writers are serialized so concurrent saves cannot interleave
+	fm.saveMutex.Lock()
+	defer fm.saveMutex.Unlock()
 
-	data, err := json.MarshalIndent(fm.files, "", "  ")
+	// Read first: a change counted after this is saved now or next time
+	changes := fm.persister.changes.Load()
+	fm.mutex.RLock()
+	records := make(map[string]json.RawMessage, len(fm.files))
+	var err error
+	for id, fileInfo := range fm.files {
+		if records[id], err = fileInfo.record(); err != nil {
+			break
+		}
+	}
+	// Taken under the same lock, so the change log on disk covers every
+	// change in the metadata written after it
+	changeLog, changeLogErr := fm.encodeChanges()
+	fm.mutex.RUnlock()
 	if err != nil {
 		return err
 	}
+	if changeLogErr != nil {
+		return changeLogErr
+	}
+
+	if changeLog != nil {
+		if err := fm.metadata.WriteFile(fm.changesFile(), changeLog, 0644); err != nil {
+			fm.changes.mutex.Lock()
+			fm.changes.dirty = true
+			fm.changes.mutex.Unlock()
+			fm.recordPersistence(err)
+			return err
+		}
+	}
+	err = fm.index.Save(records)
+	fm.recordPersistence(err)
+	if err == nil {
+		fm.persister.saved.Store(changes)
+	}
+	return err
+}
+
+// record encodes a file for the index as recorded, without the fields
+// derived for API responses. Callers must hold fm.mutex.
+func (f *FileInfo) record() (json.RawMessage, error) {
+	return json.Marshal((*storedFileInfo)(f))
+}
 
-	return os.WriteFile(fm.config.MetadataFile, data, 0644)
+// persistDownload saves a file's new download count. Indexes that can
+// write a single record do so right away; the JSON index is rewritten by
+// the persister.
+func (fm *FileManager) persistDownload(fileInfo *FileInfo) {
+	index, ok := fm.index.(recordIndex)
+	if !ok {
+		fm.requestSave()
+		return
+	}
+	fm.saveMutex.Lock()
+	defer fm.saveMutex.Unlock()
+	fm.mutex.RLock()
+	if fm.files[fileInfo.ID] != fileInfo {
+		// Deleted or replaced since, which a full save records
+		fm.mutex.RUnlock()
+		fm.requestSave()
+		return
+	}
+	record, err := fileInfo.record()
+	fm.mutex.RUnlock()
+	if err == nil {
+		err = index.SaveRecord(fileInfo.ID, record)
+	}
+	if err != nil {
+		log.Printf("Error saving the download count of %s: %v", fileInfo.ID, err)
+		fm.requestSave()
+	}
 }
 
+// saveMetadataPeriodically saves the side stores every 30 seconds, and the
+// file index when it has unsaved changes, such as ones whose save failed.
 func (fm *FileManager) saveMetadataPeriodically() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if err := fm.saveMetadata(); err != nil {
-			log.Printf("Error saving metadata: %v", err)
+	for fm.tick(ticker) {
+		if fm.metadataDirty() {
+			if err := fm.saveMetadata(); err != nil {
+				log.Printf("Error saving metadata: %v", err)
+			}
 		}
+		fm.saveActivity()
+		fm.saveAPIKeys()
+		fm.saveTombstones()
+		fm.saveFileRequests()
 	}
 }
 
-func (fm *FileManager) cleanupRoutine() {
-	ticker := time.NewTicker(fm.config.CleanupInterval)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		fm.cleanup()
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
 	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
-func (fm *FileManager) cleanup() {
-	fm.mutex.Lock()
-	defer fm.mutex.Unlock()
+func generateID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
 
-	now := time.Now()
-	cleaned := 0
+// uploadRequest carries the parsed upload parameters shared by the HTTP and
+// gRPC upload paths.
+type uploadRequest struct {
+	ID           string // optional client-chosen file ID
+	Filename     string // name as sent by the client
+	ContentType  string
+	TTL          time.Duration
+	TTLSource    string    // see resolveTTL
+	ExpiresAt    time.Time // from expires_at, see parseExpiresAt; zero to use TTL
+	MaxDownloads int
+	Password     string
+	Description  string
+	Title        string // display name, checked by parseTitle
+	Tags         []string
+	Metadata     map[string]string
+	UploaderIP   string // client address, see clientIP
+	UserAgent    string
+	KeyID        string              // API key used for the upload, if any
+	AsyncHash    bool                // store before hashing, see asyncChecksum
+	Admin        string              // admin username used for the upload, if any
+	Checksum     string              // expected checksum in stored form, verified before storing
+	Appendable   bool                // accept appends until finalized
+	NotifyEmail  string              // address to send the link to, checked by parseNotifyEmail
+	Recipients   []string            // recipient tokens, see parseRecipients
+	Encoded      *encodedBody        // body of a raw upload sent with a Content-Encoding
+	Reservation  *storageReservation // space set aside for the upload, see reserveStorage
+}
 
-	for id, fileInfo := range fm.files {
-		shouldDelete := false
+// uploadParams reads the upload options shared by form uploads and upload
+// sessions. The caller fills in the file name and content type.
+func (fm *FileManager) uploadParams(r *http.Request, key *APIKey) (uploadRequest, error) {
+	req := uploadRequest{
+		ID:          r.FormValue("id"),
+		Password:    r.FormValue("password"),
+		Description: r.FormValue("description"),
+		Appendable:  r.FormValue("appendable") == "true",
+		AsyncHash:   r.FormValue("async_checksum") == "true",
+		UploaderIP:  fm.clientIP(r),
+		UserAgent:   r.UserAgent(),
+	}
+	if admin := fm.authenticateAdmin(r); admin != nil {
+		req.Admin = admin.Username
+	}
 
-		// Check expiration
-		if now.After(fileInfo.ExpiresAt) {
-			shouldDelete = true
+	if len(req.Password) > maxFilePassword {
+		return req, errPasswordTooLong
+	}
+
+	ttl, err := resolveTTL(r.FormValue("ttl"), fm.config().DefaultTTL)
+	if err != nil {
+		return req, err
+	}
+	if req.ExpiresAt, err = fm.resolveExpiresAt(r.FormValue("expires_at"), &ttl); err != nil {
+		return req, err
+	}
+	req.TTL, req.TTLSource = ttl.TTL, ttl.Source
+
+	title, err := parseTitle(r.FormValue("title"))
+	if err != nil {
+		return req, err
+	}
+	req.Title = title
+
+	// Parse max downloads
+	if maxDownloadsStr := r.FormValue("max_downloads"); maxDownloadsStr != "" {
+		if md, err := strconv.Atoi(maxDownloadsStr); err == nil {
+			req.MaxDownloads = md
 		}
+	}
 
-		// Check max downloads
-		if fileInfo.MaxDownloads > 0 && fileInfo.Downloads >= fileInfo.MaxDownloads {
-			shouldDelete = true
+	if raw := r.FormValue("recipients"); raw != "" {
+		if req.MaxDownloads > 0 {
+			return req, errRecipientsLimit
+		}
+		tokens, err := parseRecipients(raw)
+		if err != nil {
+			return req, err
 		}
+		req.Recipients = tokens
+	}
 
-		if shouldDelete {
-			// Delete file from disk
-			if err := os.Remove(fileInfo.Path); err != nil {
-				log.Printf("Error deleting file %s: %v", fileInfo.Path, err)
-			}
-			// Remove from memory
-			delete(fm.files, id)
-			cleaned++
-			log.Printf("Cleaned up file: %s (reason: %s)", fileInfo.Filename,
-				func() string {
-					if now.After(fileInfo.ExpiresAt) {
-						return "expired"
-					}
-					return "max downloads reached"
-				}())
+	req.Tags = parseTags(r.FormValue("tags"))
+
+	// Uploads with a tag-scoped key always carry the tag
+	if key != nil {
+		req.KeyID = key.ID
+		if key.Tag != "" && !hasAnyTag(req.Tags, []string{key.Tag}) {
+			req.Tags = append(req.Tags, key.Tag)
 		}
 	}
 
-	if cleaned > 0 {
-		fm.saveMetadata()
+	if raw := r.FormValue("notify_email"); raw != "" {
+		address, err := fm.parseNotifyEmail(raw)
+		if err != nil {
+			return req, err
+		}
+		req.NotifyEmail = address
 	}
-}
 
-func generateID() string {
-	bytes := make([]byte, 16)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)
-}
+	if checksum := r.FormValue("checksum"); checksum != "" {
+		normalized, err := normalizeChecksum(checksum)
+		if err != nil {
+			return req, err
+		}
+		req.Checksum = normalized
+	}
 
-func calculateChecksum(file io.Reader) (string, error) {
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
+	// Parse custom metadata; the caller validates it
+	metadata, err := parseMetadata(r.FormValue("metadata"))
+	if err != nil {
+		return req, err
 	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	req.Metadata = metadata
+	return req, nil
 }
 
+var (
+	errFileTooLarge     = errors.New("file too large")
+	errFileNotFound     = errors.New("file not found")
+	errPasswordRequired = errors.New("password required")
+	errFileExpired      = errors.New("file expired")
+	errDownloadLimit    = errors.New("download limit reached")
+	errChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// uploadFile handles POST /upload in three stages, each timed as a phase:
+// receiveUpload reads and checks the form, storeFile hashes, stores and
+// persists the file, and the response goes out.
 func (fm *FileManager) uploadFile(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	timerFrom(r.Context()).begin(opUpload)
 
-	// Parse multipart form
-	err := r.ParseMultipartForm(fm.config.MaxFileSize)
-	if err != nil {
-		http.Error(w, "File too large", http.StatusBadRequest)
+	upload, ok := fm.receiveUpload(w, r)
+	if !ok {
 		return
 	}
+	defer upload.file.Close()
+	defer fm.releaseStorage(upload.req.Reservation)
 
-	file, header, err := r.FormFile("file")
+	fileInfo, duplicate, err := fm.dedupUpload(r, upload.req, upload.size, func() (*FileInfo, error) {
+		return fm.storeFile(r.Context(), upload.file, upload.req)
+	})
 	if err != nil {
-		http.Error(w, "No file provided", http.StatusBadRequest)
+		fm.writeUploadError(w, r, upload.req.Filename, err)
 		return
 	}
-	defer file.Close()
+	if duplicate {
+		w.Header().Set("X-Duplicate-Submission", "true")
+	} else {
+		fm.queueUploadEmail(r, "upload", fileInfo, nil, upload.req)
+	}
 
-	// Check file type if restricted
-	if len(fm.config.AllowedTypes) > 0 {
-		contentType := header.Header.Get("Content-Type")
-		allowed := false
-		for _, allowedType := range fm.config.AllowedTypes {
-			if strings.Contains(contentType, allowedType) {
-				allowed = true
-				break
-			}
+	// Return response
+	fm.writeUploadResponse(w, r, fileInfo)
+}
+
+// receivedUpload is a form upload read and checked by receiveUpload, ready
+// for storeFile.
+type receivedUpload struct {
+	file multipart.File
+	size int64
+	req  uploadRequest
+}
+
+// receiveUpload reads the multipart form of an upload and checks its
+// parameters. It answers the request itself and returns false when they are
+// refused. The caller releases the storage reservation of an accepted one.
+func (fm *FileManager) receiveUpload(w http.ResponseWriter, r *http.Request) (upload *receivedUpload, ok bool) {
+	key, ok := fm.authorizeKey(w, r, scopeUpload)
+	if !ok || !fm.requireUploadKey(w, r, key) || !fm.admitUploader(w, r, r.ContentLength) {
+		return nil, false
+	}
+	reservation, ok := fm.admitStorage(w, r)
+	if !ok {
+		return nil, false
+	}
+	defer func() {
+		if !ok {
+			fm.releaseStorage(reservation)
 		}
-		if !allowed {
-			http.Error(w, "File type not allowed", http.StatusBadRequest)
-			return
+	}()
+
+	// Parse multipart form
+	if err := limitForm(r, fm.config().MaxFileSize); err != nil {
+		if clientGone(r.Context(), err) {
+			fm.transfers.abortedUploads.Add(1)
+			log.Printf("Form upload aborted by client (499): %v", err)
+			return nil, false
 		}
+		respondFormError(w, r, err, "File too large")
+		return nil, false
 	}
 
-	// Get parameters from form
-	ttlStr := r.FormValue("ttl")
-	maxDownloadsStr := r.FormValue("max_downloads")
-	password := r.FormValue("password")
-	description := r.FormValue("description")
-	tagsStr := r.FormValue("tags")
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, r, "No file provided", http.StatusBadRequest)
+		return nil, false
+	}
 
-	// Parse TTL
-	var ttl time.Duration
-	if ttlStr != "" {
-		if ttlInt, err := strconv.Atoi(ttlStr); err == nil {
-			ttl = time.Duration(ttlInt) * time.Second
-		} else {
-			ttl = fm.config.DefaultTTL
-		}
-	} else {
-		ttl = fm.config.DefaultTTL
+	// Check file type if restricted
+	if !fm.typeAllowed(header.Header.Get("Content-Type")) {
+		file.Close()
+		respondError(w, r, "File type not allowed", http.StatusBadRequest)
+		return nil, false
 	}
 
-	// Parse max downloads
-	var maxDownloads int
-	if maxDownloadsStr != "" {
-		if md, err := strconv.Atoi(maxDownloadsStr); err == nil {
-			maxDownloads = md
-		}
+	req, err := fm.uploadParams(r, key)
+	if err != nil {
+		file.Close()
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if violations := fm.validateMetadata(req.Metadata, req.Tags); len(violations) > 0 {
+		file.Close()
+		writeViolations(w, r, violations)
+		return nil, false
 	}
+	req.Filename = header.Filename
+	req.ContentType = header.Header.Get("Content-Type")
+	req.Reservation = reservation
 
-	// Parse tags
-	var tags []string
-	if tagsStr != "" {
-		tags = strings.Split(strings.ReplaceAll(tagsStr, " ", ""), ",")
+	timerFrom(r.Context()).mark(phaseReceive)
+	return &receivedUpload{file: file, size: header.Size, req: req}, true
+}
+
+// writeUploadError answers an upload that storeFile refused or failed, with
+// a code from uploadProblem. Failures on the server's side are logged with
+// their full cause under an error_id that the response carries, so users can
+// quote it to support. Aborted uploads are only logged, as nobody is left to
+// answer.
+func (fm *FileManager) writeUploadError(w http.ResponseWriter, r *http.Request, filename string, err error) {
+	if clientGone(r.Context(), err) {
+		fm.transfers.abortedUploads.Add(1)
+		log.Printf("Upload of %s aborted by client (499): %v", filename, err)
+		return
 	}
+	problem := problemResponse{downloadProblem: uploadProblem(err)}
+	if problem.Status >= http.StatusInternalServerError {
+		problem.ErrorID = generateID()[:12]
+		log.Printf("Upload of %s failed [error_id %s]: %v", filename, problem.ErrorID, err)
+	}
+	writeProblem(w, r, problem)
+}
 
-	// Generate unique ID and filename
-	fileID := generateID()
-	safeFilename := strings.ReplaceAll(header.Filename, " ", "_")
-	storedFilename := fileID + "_" + safeFilename
+// storeFile writes the upload to the upload directory and registers it.
+// Content beyond MaxFileSize is rejected with errFileTooLarge. When ctx is
+// canceled the upload is abandoned and nothing is left behind.
+func (fm *FileManager) storeFile(ctx context.Context, src io.Reader, req uploadRequest) (*FileInfo, error) {
+	timer := timerFrom(ctx)
+	timer.begin(opUpload)
+	src = newContextReader(ctx, src)
+	req.Tags = normalizeTags(req.Tags)
+
+	metadata := req.Metadata
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
 
-	// Calculate checksum
-	tempFile, err := os.CreateTemp("", "upload_*")
+	// Generate unique ID, unless the client picked one, and filename. The
+	// stored name always uses a generated ID so it can't clash on disk.
+	storageID := generateID()
+	fileID := storageID
+	if req.ID != "" {
+		if err := fm.checkCustomID(req.ID); err != nil {
+			return nil, err
+		}
+		fm.mutex.RLock()
+		_, taken := fm.files[req.ID]
+		fm.mutex.RUnlock()
+		if taken {
+			return nil, errIDTaken
+		}
+		fileID = req.ID
+	}
+	originalName := normalizeName(req.Filename)
+	if originalName != req.Filename {
+		metadata["raw_name"] = rawName(req.Filename)
+	}
+	safeFilename := sanitizeFilename(originalName)
+	storedFilename := storageID + "_" + safeFilename
+	if err := fm.checkUploadKey(storedFilename); err != nil {
+		return nil, err
+	}
+	if err := fm.checkStoragePath(storedFilename); err != nil {
+		return nil, err
+	}
+
+	// Stream the content into a partial file in the upload directory,
+	// hashing it on the way; it is renamed into place once the checks pass
+	// and removed if anything fails before that
+	if err := fm.storage.MkdirAll(partsDir, 0755); err != nil {
+		return nil, fm.storageFailure(fmt.Errorf("creating %s: %w", partsDir, err))
+	}
+	if err := fm.checkFilesystem(0); err != nil {
+		return nil, fm.storageFailure(err)
+	}
+	partKey := path.Join(partsDir, storageID)
+	part, err := fm.storage.OpenFile(partKey, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		return nil, fm.storageFailure(fmt.Errorf("creating partial file: %w", err))
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
+	placed := false
+	defer func() {
+		if !placed {
+			part.Close()
+			fm.storage.Remove(partKey)
+		}
+	}()
 
-	// Copy file for checksum calculation
-	fileSize, err := io.Copy(tempFile, file)
+	algorithm := fm.config().ChecksumAlgorithm
+	hasher, err := newHasher(algorithm)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("hashing: %w", err)
+	}
+	pending, threshold := fm.asyncChecksum(req)
+	sink := io.MultiWriter(part, hasher)
+	if pending {
+		sink = part
 	}
+	received := io.LimitReader(src, fm.config().MaxFileSize+1)
+	var fileSize int64
+	if threshold > 0 && !pending {
+		// Hashed inline up to the threshold; anything larger is hashed
+		// by the checksum job once stored
+		fileSize, err = io.CopyN(sink, received, threshold)
+		if err == nil {
+			pending, sink = true, part
+		} else if err == io.EOF {
+			err = nil
+		}
+	}
+	if err == nil {
+		var n int64
+		n, err = io.Copy(sink, received)
+		fileSize += n
+	}
+	if err != nil {
+		return nil, fm.storageFailure(fmt.Errorf("receiving upload: %w", err))
+	}
+	if fileSize > fm.config().MaxFileSize {
+		return nil, errFileTooLarge
+	}
+	timer.mark(phaseReceive)
 
-	// Reset file pointer for checksum
-	tempFile.Seek(0, 0)
-	checksum, err := calculateChecksum(tempFile)
+	// Compare the content with what the extension promises
+	tags, err := fm.checkContentType(part, originalName, metadata, req.Tags)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	tags = fm.applyAutoTags(part, req, originalName, tags, metadata)
+
+	// Record dimensions, page counts etc.; this never fails the upload
+	checksum := formatChecksum(algorithm, hasher.Sum(nil))
+	if pending {
+		checksum = ""
+		fm.extractMetadata(part, metadata)
+	} else if fm.extractMetadata(part, metadata) {
+		// Location data was blanked out, so the checksum must describe
+		// the content as stored rather than as received
+		part.Seek(0, io.SeekStart)
+		if checksum, err = fm.calculateChecksum(newContextReader(ctx, part)); err != nil {
+			return nil, fmt.Errorf("hashing: %w", err)
+		}
+	}
+	if err := verifyChecksum(part, checksum, req.Checksum); err != nil {
+		return nil, err
+	}
+	if !pending {
+		if err := fm.checkBlocked(checksum, originalName, req.UploaderIP); err != nil {
+			return nil, err
+		}
+	}
+	timer.setFile(fileID)
+	timer.mark(phaseHash)
+
+	password := req.Password
+	if password != "" {
+		if password, err = hashFilePassword(password); err != nil {
+			return nil, err
+		}
+	}
+
+	// An expires_at is kept as sent rather than recomputed from the TTL
+	expiresAt := req.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(req.TTL).UTC()
 	}
 
 	// Create file info
 	fileInfo := &FileInfo{
 		ID:           fileID,
 		Filename:     safeFilename,
-		OriginalName: header.Filename,
+		OriginalName: originalName,
 		Size:         fileSize,
-		ContentType:  header.Header.Get("Content-Type"),
+		ContentType:  req.ContentType,
 		Checksum:     checksum,
+		HashPending:  pending,
 		UploadTime:   time.Now(),
-		ExpiresAt:    time.Now().Add(ttl),
+		ExpiresAt:    expiresAt,
+		TTLSource:    req.TTLSource,
 		Downloads:    0,
-		MaxDownloads: maxDownloads,
+		MaxDownloads: req.MaxDownloads,
 		Password:     password,
-		UploaderIP:   r.RemoteAddr,
+		UploaderIP:   req.UploaderIP,
 		Tags:         tags,
-		Description:  description,
-		Path:         filepath.Join(fm.config.UploadDir, storedFilename),
-		Metadata:     make(map[string]string),
+		Description:  req.Description,
+		Title:        req.Title,
+		StorageKey:   storedFilename,
+		Metadata:     metadata,
+		KeyID:        req.KeyID,
+		Appendable:   req.Appendable,
+		Recipients:   newRecipients(req.Recipients),
+
+		recipientTokens: req.Recipients,
 	}
-
-	// Create upload directory if it doesn't exist
-	if err := os.MkdirAll(fm.config.UploadDir, 0755); err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+	if req.Encoded != nil {
+		fileInfo.Encoding, fileInfo.WireSize = req.Encoded.Encoding, req.Encoded.WireSize()
 	}
 
-	// Move temp file to final location
-	tempFile.Seek(0, 0)
-	dst, err := os.Create(fileInfo.Path)
-	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+	// Move the partial file into place
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	err = part.Close()
+	if err == nil {
+		err = fm.storage.Rename(partKey, fileInfo.StorageKey)
 	}
-	defer dst.Close()
-
-	_, err = io.Copy(dst, tempFile)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		return nil, fm.storageFailure(fmt.Errorf("moving upload into place: %w", err))
 	}
+	placed = true
 
 	// Store file info
 	fm.mutex.Lock()
+	if _, taken := fm.files[fileID]; taken {
+		fm.mutex.Unlock()
+		fm.storage.Remove(fileInfo.StorageKey)
+		return nil, errIDTaken
+	}
+	// Room the upload reserved is its own; others' is taken
+	reserved := fm.takeReservation(req.Reservation, fileSize)
+	evicted, fits := fm.makeRoom(fileSize - reserved)
+	if !fits {
+		fm.mutex.Unlock()
+		fm.storage.Remove(fileInfo.StorageKey)
+		return nil, errStorageFull
+	}
 	fm.files[fileID] = fileInfo
+	fm.recordChange(changeCreated, fileID, fileInfo)
 	fm.mutex.Unlock()
+	fm.removeEvicted(evicted)
+	fm.uploadLimits.addBytes(req.UploaderIP, fileSize, time.Now())
+	timer.mark(phaseStore)
+	fm.checkStorageThresholds()
+
+	// Saved in the background, right away unless a save just happened
+	fm.requestSave()
+	timer.mark(phasePersist)
+	if pending {
+		fm.queueChecksum(fileID)
+	}
 
-	// Save metadata immediately for new uploads
-	fm.saveMetadata()
+	fm.activity.record(ActivityEvent{
+		Type:      "upload",
+		FileID:    fileID,
+		Filename:  originalName,
+		Actor:     req.UploaderIP,
+		User:      req.Admin,
+		UserAgent: req.UserAgent,
+		Bot:       botUserAgent.MatchString(req.UserAgent),
+		Outcome:   "ok",
+	})
 
-	// Return response
-	downloadURL := fmt.Sprintf("http://%s/download/%s", r.Host, fileID)
-
-	if strings.Contains(r.Header.Get("Accept"), "application/json") {
-		w.Header().Set("Content-Type", "application/json")
-		response := map[string]interface{}{
-			"id":            fileID,
-			"filename":      fileInfo.Filename,
-			"original_name": fileInfo.OriginalName,
-			"size":          fileInfo.Size,
-			"checksum":      fileInfo.Checksum,
-			"download_url":  downloadURL,
-			"expires_at":    fileInfo.ExpiresAt.Format(time.RFC3339),
-			"max_downloads": fileInfo.MaxDownloads,
-		}
-		json.NewEncoder(w).Encode(response)
-	} else {
-		fmt.Fprintf(w, "File uploaded successfully!\n\nDownload URL: %s\nExpires: %s\nChecksum: %s\n",
-			downloadURL, fileInfo.ExpiresAt.Format("2006-01-02 15:04:05"), fileInfo.Checksum)
-	}
+	return fileInfo, nil
 }
 
-func (fm *FileManager) downloadFile(w http.ResponseWriter, r *http.Request) {
-	fileID := strings.TrimPrefix(r.URL.Path, "/download/")
-	password := r.URL.Query().Get("password")
+// claimDownload performs the password, expiry and limit checks for a
+// download and counts it. last reports that it took the final download the
+// limit allows, so the caller removes the file once it has been served.
+func (fm *FileManager) claimDownload(fileID string, creds downloadCredentials) (fileInfo *FileInfo, last bool, err error) {
+	return fm.admitDownload(fileID, creds, true)
+}
+
+// checkDownload performs the password, expiry and limit checks for a
+// download without counting it.
+func (fm *FileManager) checkDownload(fileID string, creds downloadCredentials) (*FileInfo, error) {
+	fileInfo, _, err := fm.admitDownload(fileID, creds, false)
+	return fileInfo, err
+}
 
+// admitDownload is claimDownload, or checkDownload unless count is set.
+// Passwords are checked first without the lock, as bcrypt is slow on
+// purpose; the status is then checked and the download counted under one
+// write lock, so concurrent downloads can't both take the last one. Expired
+// files are removed on the spot.
+func (fm *FileManager) admitDownload(fileID string, creds downloadCredentials, count bool) (*FileInfo, bool, error) {
 	fm.mutex.RLock()
 	fileInfo, exists := fm.files[fileID]
 	fm.mutex.RUnlock()
 
 	if !exists {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
+		return nil, false, fm.missingFileError(fileID)
 	}
 
-	// Check password if required
-	if fileInfo.Password != "" && fileInfo.Password != password {
-		http.Error(w, "Password required", http.StatusUnauthorized)
-		return
+	// Check password if required, then the passwords of protected tags
+	if err := fm.checkPassword(fileInfo, creds); err != nil {
+		return nil, false, err
+	}
+	if err := fm.tagRules().unlock(fileInfo, creds, &fm.verifiedPasswords); err != nil {
+		return nil, false, err
 	}
 
-	// Check expiration
-	if time.Now().After(fileInfo.ExpiresAt) {
-		fm.mutex.Lock()
-		delete(fm.files, fileID)
+	fm.mutex.Lock()
+	if current, exists := fm.files[fileID]; current != fileInfo {
 		fm.mutex.Unlock()
-		os.Remove(fileInfo.Path)
-		fm.saveMetadata()
-		http.Error(w, "File expired", http.StatusNotFound)
-		return
+		if exists {
+			// Replaced under the same ID; its passwords may differ
+			return fm.admitDownload(fileID, creds, count)
+		}
+		return nil, false, fm.missingFileError(fileID)
+	}
+	if err := fileInfo.checkRecipient(creds); err != nil {
+		fm.mutex.Unlock()
+		return nil, false, err
 	}
 
-	// Check max downloads
-	if fileInfo.MaxDownloads > 0 && fileInfo.Downloads >= fileInfo.MaxDownloads {
-		http.Error(w, "Download limit reached", http.StatusForbidden)
-		return
+	switch fileInfo.Status() {
+	case StatusExpired:
+		// Concurrent downloads may race here; only the first removes it
+		removed := fm.expireFile(fileID, fileInfo, StatusExpired)
+		fm.mutex.Unlock()
+		if removed {
+			fm.deleteExpiredContent(fileInfo)
+			fm.requestSave()
+		}
+		return nil, false, errFileExpired
+	case StatusLimitReached, StatusLimitGrace:
+		fm.mutex.Unlock()
+		return nil, false, errDownloadLimit
+	}
+	if !count {
+		fm.mutex.Unlock()
+		return fileInfo, false, nil
 	}
 
 	// Increment download counter
-	fm.mutex.Lock()
+	now := time.Now()
 	fileInfo.Downloads++
+	fileInfo.LastDownload = now
+	fm.aggregates.invalidate()
+	fm.markDirty()
+	var last bool
+	if fileInfo.MaxDownloads > 0 && fileInfo.Downloads >= fileInfo.MaxDownloads && !fileInfo.hasRecipients() {
+		// With a grace period the file stays for an admin to raise the limit
+		if grace := fm.config().PostLimitGrace; grace > 0 {
+			graceUntil := now.Add(grace)
+			fileInfo.GraceUntil = &graceUntil
+		} else {
+			last = true
+		}
+	}
 	fm.mutex.Unlock()
+	fm.downloads.record(now)
+
+	return fileInfo, last, nil
+}
+
+// rangeStartsDownload reports whether a request with the given Range header
+// starts a download of a size-byte file, so it counts against
+// max_downloads: it has no Range, one of its ranges covers byte 0, or its
+// ranges add up to more than the file, which ServeContent answers with the
+// whole file. Other ranges resume a counted download; unsatisfiable ones are
+// refused with 416.
+func rangeStartsDownload(header string, size int64) bool {
+	if header == "" {
+		return true
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return false // refused by ServeContent
+	}
+	var total int64
+	for _, ra := range strings.Split(spec, ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(ra, "-")
+		if !ok {
+			return false
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		if first == "" {
+			// The last n bytes, all of them when n reaches the size
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return false
+			}
+			if n >= size {
+				return true
+			}
+			total += n
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return false
+		}
+		if start == 0 {
+			return true
+		}
+		if start >= size {
+			continue // not satisfiable, skipped by ServeContent
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return false
+			}
+			end = min(end, size-1)
+		}
+		total += end - start + 1
+	}
+	return total > size
+}
+
+// resolveIfRange settles If-Range the way ServeContent would for content with
+// the given ETag and modification time, before the download is counted: when
+// it names another version, Range is dropped and the whole file is sent.
+// If-Range is removed either way, so counting and serving agree.
+func resolveIfRange(r *http.Request, etag string, modTime time.Time) {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return
+	}
+	r.Header.Del("If-Range")
+	var matched bool
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// Only a strong ETag match resumes
+		matched = etag != "" && ifRange == etag && !strings.HasPrefix(etag, "W/")
+	} else if t, err := http.ParseTime(ifRange); err == nil && !modTime.IsZero() {
+		matched = t.Unix() == modTime.Unix()
+	}
+	if !matched {
+		r.Header.Del("Range")
+	}
+}
+
+func (fm *FileManager) downloadFile(w http.ResponseWriter, r *http.Request) {
+	if _, ok := fm.authorizeKey(w, r, scopeDownload); !ok {
+		return
+	}
+	fileID, err := pathID(r, "/download/")
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	creds := fm.credentialsFor(r)
+	timer := timerFrom(r.Context())
+	timer.setFile(fileID)
+
+	if r.Method != "HEAD" {
+		timer.begin(opDownload)
+	}
+
+	// Open the content first so a concurrent delete can't pull it away
+	// between the checks and the response
+	opened, src := fm.openStored(fileID)
+	defer func() {
+		if src != nil {
+			src.Close()
+		}
+	}()
+
+	// HEAD requests inspect a file without using up a download, and neither
+	// do Range requests resuming one or, when flagged, bots
+	var size int64
+	var modTime time.Time
+	if src != nil {
+		if stat, err := src.Stat(); err == nil {
+			size, modTime = stat.Size(), stat.ModTime()
+		}
+	}
+	resolveIfRange(r, "", modTime)
+	counted := r.Method != "HEAD" && rangeStartsDownload(r.Header.Get("Range"), size) &&
+		!(fm.flag(flagUncountedBots) && botUserAgent.MatchString(r.UserAgent()))
+	if key := fm.requestKey(r); opened != nil && !key.permits(opened) {
+		writeKeyForbidden(w, r, key)
+		return
+	}
+	// A stored copy whose size changed out of band would be served under a
+	// checksum it no longer has
+	if opened != nil {
+		if err := fm.checkStoredSize(opened, src); err != nil {
+			fm.recordEvent(r, "download", opened, fileID, downloadOutcome(err))
+			writeDownloadError(w, r, err)
+			return
+		}
+	}
+
+	var fileInfo *FileInfo
+	var last bool
+	if counted {
+		fileInfo, last, err = fm.claimDownload(fileID, creds)
+	} else {
+		fileInfo, err = fm.checkDownload(fileID, creds)
+	}
+	timer.mark(phaseOpen)
+	if err != nil && r.Method != "HEAD" {
+		fm.recordEvent(r, "download", nil, fileID, downloadOutcome(err))
+	}
+	if writeDownloadError(w, r, err) {
+		return
+	}
+	if fileInfo != opened {
+		// Replaced under the same ID since the handle was opened
+		if src != nil {
+			src.Close()
+		}
+		_, src = fm.openStored(fileID)
+	}
+
+	if fileInfo.isLink() {
+		fm.writeExpiryHeaders(w, fileInfo)
+		http.Redirect(w, r, fm.linkLocation(fileInfo), http.StatusFound)
+		if r.Method != "HEAD" {
+			fm.recordEvent(r, "download", fileInfo, fileID, "redirect")
+			fm.finishDownload(fileInfo, last)
+		}
+		return
+	}
 
 	// Serve file
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileInfo.OriginalName))
-	w.Header().Set("Content-Type", fileInfo.ContentType)
-	w.Header().Set("X-Checksum", fileInfo.Checksum)
-	http.ServeFile(w, r, fileInfo.Path)
+	w.Header().Set("Content-Disposition", attachmentDisposition(fileInfo.OriginalName))
+	w.Header().Set("Content-Type", fm.detectContentType(fileInfo))
+	if fm.forceOpaqueDownload(fileInfo) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	if fileInfo.Checksum != "" && !fm.sizeMismatched(fileInfo) {
+		w.Header().Set("X-Checksum", fileInfo.Checksum)
+	}
+	fm.writeExpiryHeaders(w, fileInfo)
+	cold := fileInfo.tier() == tierCold
+	if cold {
+		// Slower to start; lets clients tell why
+		w.Header().Set("X-Storage-Tier", tierCold)
+		keepWriting(w)
+	}
+	if fm.offloadDownload(w, r, fileInfo) {
+		// The proxy reads the file after this returns; cleanup removes it
+		last = false
+	} else {
+		// Ranged responses replace Content-Length with the range's
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size, 10))
+		fm.serveStored(w, r, fileInfo, src)
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+
+	outcome := "ok"
+	if responseCut(w, r) {
+		fm.transfers.abortedDownloads.Add(1)
+		outcome = "aborted"
+	}
+	fm.recordEvent(r, "download", fileInfo, fileID, outcome)
+	if outcome == "ok" && fileInfo.hasRecipients() && rangeReachesEnd(r.Header.Get("Range"), fileInfo.Size) {
+		fm.collectDownload(r, fileInfo, creds.Recipient)
+	}
+	if cold && outcome == "ok" && !last && fm.config().RehydrateOnAccess {
+		go fm.rehydrate(fileInfo)
+	}
 
-	// Save metadata after download
-	go fm.saveMetadata()
+	// Persist the new download count, or remove a file that is used up;
+	// an aborted last download leaves it to cleanup
+	fm.finishDownload(fileInfo, last && outcome == "ok")
 }
 
 func (fm *FileManager) searchFiles(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	tag := r.URL.Query().Get("tag")
+	if !fm.requireListingAccess(w, r) {
+		return
+	}
+
+	query := searchKey(r.URL.Query().Get("q"))
+	tag := fm.tagFilterFor(r)
 	sortBy := r.URL.Query().Get("sort")
+	status, ok := statusFilter(w, r)
+	if !ok {
+		return
+	}
+
+	metaFilters := make(map[string][]string)
+	for param, values := range r.URL.Query() {
+		if key, ok := strings.CutPrefix(param, "meta."); ok {
+			metaFilters[key] = values
+		}
+	}
 
+	includeExpired := fm.showExpired(r)
+	key := fm.requestKey(r)
+	hidden := fm.hiddenTags(r)
 	fm.mutex.RLock()
 	var matchingFiles []*FileInfo
 	for _, fileInfo := range fm.files {
-		matches := true
+		matches := (includeExpired || fileInfo.Status() != StatusExpired) && key.permits(fileInfo) && !hidden.protects(fileInfo.Tags)
 
-		// Text search in filename and description
+		// Text search in filename, title and description
 		if query != "" {
-			matches = matches && (strings.Contains(strings.ToLower(fileInfo.Filename), strings.ToLower(query)) ||
-				strings.Contains(strings.ToLower(fileInfo.Description), strings.ToLower(query)))
-		}
-
-		// Tag filter
-		if tag != "" {
-			tagMatches := false
-			for _, t := range fileInfo.Tags {
-				if strings.EqualFold(t, tag) {
-					tagMatches = true
-					break
-				}
-			}
-			matches = matches && tagMatches
+			matches = matches && (strings.Contains(searchKey(fileInfo.Filename), query) ||
+				strings.Contains(searchKey(fileInfo.Title), query) ||
+				strings.Contains(searchKey(fileInfo.Description), query))
+		}
+
+		// Tag filter, including child tags unless exact_tag=true
+		matches = matches && tag.matches(fileInfo.Tags)
+
+		// Status filter
+		if status != "" {
+			matches = matches && fileInfo.Status() == status
+		}
+
+		// Metadata filters, e.g. meta.pages=3
+		for key, values := range metaFilters {
+			matches = matches && fileInfo.Metadata[key] == values[0]
 		}
 
 		if matches {
@@ -453,52 +1401,160 @@ func (fm *FileManager) searchFiles(w http.ResponseWriter, r *http.Request) {
 	}
 	fm.mutex.RUnlock()
 
-	// Sort results
-	switch sortBy {
-	case "size":
-		sort.Slice(matchingFiles, func(i, j int) bool {
-			return matchingFiles[i].Size > matchingFiles[j].Size
-		})
-	case "downloads":
-		sort.Slice(matchingFiles, func(i, j int) bool {
-			return matchingFiles[i].Downloads > matchingFiles[j].Downloads
-		})
-	default: // default to upload time
-		sort.Slice(matchingFiles, func(i, j int) bool {
-			return matchingFiles[i].UploadTime.After(matchingFiles[j].UploadTime)
-		})
+	// Sort results, defaulting to upload time
+	if fileOrders[sortBy] == nil {
+		sortBy = "upload_time"
+	}
+	sortFiles(matchingFiles, sortBy)
+
+	// Paginate only when asked to, keeping the plain array response otherwise
+	cursorToken := r.URL.Query().Get("cursor")
+	if r.URL.Query().Get("limit") == "" && cursorToken == "" {
+		respondJSON(w, http.StatusOK, fm.fileViews(r, matchingFiles))
+		return
+	}
+
+	var page []*FileInfo
+	var nextCursor string
+	if cursorToken != "" {
+		cursor, err := decodeCursor(cursorToken, sortBy)
+		if err != nil {
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, nextCursor = pageAfter(matchingFiles, cursor, pageLimit(r))
+	} else {
+		page, nextCursor = firstPage(matchingFiles, sortBy, pageLimit(r))
+	}
+	if page == nil {
+		page = []*FileInfo{}
+	}
+
+	response := map[string]interface{}{"files": fm.fileViews(r, page)}
+	if nextCursor != "" {
+		response["next_cursor"] = nextCursor
 	}
+	respondJSON(w, http.StatusOK, response)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(matchingFiles)
+// computeStats aggregates counters over the files matching filter. The file
+// totals come from the aggregate cache; recent download counts are
+// service-wide and ignore the filter.
+func (fm *FileManager) computeStats(filter statsFilter) UploadStats {
+	cached, age := fm.aggregate("stats\x00"+filter.cacheKey(), func() interface{} {
+		return fm.fileStats(filter)
+	})
+	totals := cached.(UploadStats)
+
+	now := time.Now()
+	stats := UploadStats{
+		TotalFiles:       totals.TotalFiles,
+		TotalSize:        totals.TotalSize,
+		TotalDownloads:   totals.TotalDownloads,
+		ActiveFiles:      totals.ActiveFiles,
+		AbortedUploads:   fm.transfers.abortedUploads.Load(),
+		AbortedDownloads: fm.transfers.abortedDownloads.Load(),
+		ByStatus:         make(map[FileStatus]StatusStats, len(totals.ByStatus)),
+		ByTier:           make(map[string]StatusStats, len(totals.ByTier)),
+		Downloads24h:     fm.downloads.since(now, 24*time.Hour),
+		Downloads7d:      fm.downloads.since(now, 7*24*time.Hour),
+		Cache:            fm.cache.stats(),
+		Cleanup:          fm.cleanupStats(),
+		age:              age,
+	}
+	for status, byStatus := range totals.ByStatus {
+		stats.ByStatus[status] = byStatus
+	}
+	for tier, byTier := range totals.ByTier {
+		stats.ByTier[tier] = byTier
+	}
+	return stats
 }
 
-func (fm *FileManager) getStats(w http.ResponseWriter, r *http.Request) {
+// fileStats walks the files matching filter for the totals of computeStats.
+func (fm *FileManager) fileStats(filter statsFilter) UploadStats {
 	fm.mutex.RLock()
 	defer fm.mutex.RUnlock()
 
-	stats := UploadStats{}
 	now := time.Now()
+	stats := UploadStats{ByStatus: make(map[FileStatus]StatusStats), ByTier: make(map[string]StatusStats)}
+	for _, status := range []FileStatus{StatusActive, StatusExpired, StatusLimitReached, StatusLimitGrace} {
+		stats.ByStatus[status] = StatusStats{}
+	}
+	stats.ByTier[tierHot] = StatusStats{}
+	if fm.cold != nil {
+		stats.ByTier[tierCold] = StatusStats{}
+	}
 
 	for _, fileInfo := range fm.files {
+		if !filter.matches(fileInfo) {
+			continue
+		}
 		stats.TotalFiles++
 		stats.TotalSize += fileInfo.Size
 		stats.TotalDownloads += fileInfo.Downloads
 
-		if now.Before(fileInfo.ExpiresAt) {
+		status := fileInfo.statusAt(now)
+		if status == StatusActive {
 			stats.ActiveFiles++
 		}
+		byStatus := stats.ByStatus[status]
+		byStatus.Files++
+		byStatus.Size += fileInfo.Size
+		stats.ByStatus[status] = byStatus
+
+		if !fileInfo.isLink() {
+			byTier := stats.ByTier[fileInfo.tier()]
+			byTier.Files++
+			byTier.Size += fileInfo.Size
+			stats.ByTier[fileInfo.tier()] = byTier
+		}
+	}
+	return stats
+}
+
+func (fm *FileManager) getStats(w http.ResponseWriter, r *http.Request) {
+	if !fm.requireListingAccess(w, r) {
+		return
+	}
+
+	stats := fm.computeStats(statsFilter{
+		Tag:            fm.tagFilterFor(r),
+		Type:           r.URL.Query().Get("type"),
+		IncludeExpired: fm.showExpired(r),
+		Key:            fm.requestKey(r),
+		Hidden:         fm.hiddenTags(r),
+	})
+	if fm.isAdmin(r) {
+		age := stats.age.Seconds()
+		stats.AggregatesAge = &age
+	}
+	// Like uploader_ip, only for requests with admin credentials
+	if fm.hasAdminCredentials(r) {
+		stats.TopUploaders = fm.topUploaders()
+	}
+	if fm.config().MaxTotalSize > 0 {
+		usage := fm.storageUsage()
+		stats.Storage = &usage
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	respondJSON(w, http.StatusOK, stats)
 }
 
 func (fm *FileManager) manageFiles(w http.ResponseWriter, r *http.Request) {
+	if !fm.requireListingAccess(w, r) {
+		return
+	}
+
+	includeExpired := fm.showExpired(r)
+	key := fm.requestKey(r)
+	hidden := fm.hiddenTags(r)
 	fm.mutex.RLock()
 	files := make([]*FileInfo, 0, len(fm.files))
 	for _, fileInfo := range fm.files {
-		files = append(files, fileInfo)
+		if (includeExpired || fileInfo.Status() != StatusExpired) && key.permits(fileInfo) && !hidden.protects(fileInfo.Tags) {
+			files = append(files, fileInfo)
+		}
 	}
 	fm.mutex.RUnlock()
 
@@ -507,9 +1563,8 @@ func (fm *FileManager) manageFiles(w http.ResponseWriter, r *http.Request) {
 		return files[i].UploadTime.After(files[j].UploadTime)
 	})
 
-	if strings.Contains(r.Header.Get("Accept"), "application/json") {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(files)
+	if wantsJSON(r) {
+		respondJSON(w, http.StatusOK, fm.fileViews(r, files))
 		return
 	}
 
@@ -528,6 +1583,8 @@ func (fm *FileManager) manageFiles(w http.ResponseWriter, r *http.Request) {
         .stat-card { background: #007bff; color: white; padding: 15px; border-radius: 5px; text-align: center; }
         .stat-value { font-size: 2em; font-weight: bold; }
         .stat-label { font-size: 0.9em; opacity: 0.9; }
+        .stat-minor { background: #6c757d; }
+        .stat-minor .stat-value { font-size: 1.5em; }
         table { border-collapse: collapse; width: 100%; margin-top: 20px; }
         th, td { border: 1px solid #ddd; padding: 12px; text-align: left; }
         th { background-color: #f8f9fa; font-weight: bold; position: sticky; top: 0; }
@@ -543,16 +1600,34 @@ func (fm *FileManager) manageFiles(w http.ResponseWriter, r *http.Request) {
         .btn:hover { background: #0056b3; }
         .btn-danger { background: #dc3545; }
         .btn-danger:hover { background: #c82333; }
+        form.inline { display: inline; }
+        .btn-disabled, .btn-disabled:hover { background: #adb5bd; cursor: not-allowed; }
+        .status { font-size: 0.85em; }
         .tags { display: flex; flex-wrap: wrap; gap: 5px; }
         .tag { background: #e9ecef; padding: 2px 8px; border-radius: 12px; font-size: 0.8em; }
         .search-form { margin: 20px 0; padding: 15px; background: #e9ecef; border-radius: 5px; }
         .checksum { font-family: monospace; font-size: 0.8em; color: #666; }
+        .warning { color: #dc3545; cursor: help; }
+        .lock { cursor: help; }
+        .edit summary { list-style: none; margin-top: 5px; }
+        .edit-form { white-space: normal; min-width: 260px; margin-top: 10px; }
+        .edit-form label { display: block; font-size: 0.85em; font-weight: bold; margin-top: 6px; }
+        .edit-form input, .edit-form textarea { width: 100%; padding: 5px; border: 1px solid #ddd; border-radius: 4px; box-sizing: border-box; }
+        .edit-form .inline { display: inline; font-weight: normal; }
+        .edit-form .inline input { width: auto; }
+        .storage { margin-bottom: 20px; }
+        .storage-bar { position: relative; height: 18px; background: #e9ecef; border-radius: 9px; overflow: hidden; }
+        .storage-fill { height: 100%; background: #28a745; }
+        .storage-fill.level-1 { background: #ffc107; }
+        .storage-fill.level-2 { background: #dc3545; }
+        .storage-mark { position: absolute; top: 0; bottom: 0; width: 2px; background: #343a40; }
     </style>
 </head>
 <body>
     <div class="container">
         <div class="header">
             <h1>Enhanced File Upload Service</h1>
+            {{if .SignedIn}}<form method="post" action="{{path "/logout"}}" class="inline"><button type="submit" class="btn">Sign out</button></form>{{end}}
         </div>
         
         <div class="stats">
@@ -573,10 +1648,44 @@ func (fm *FileManager) manageFiles(w http.ResponseWriter, r *http.Request) {
                 <div class="stat-label">Total Size</div>
             </div>
         </div>
-        
+        <div class="stats">
+            {{with .Stats.Status "expired"}}<div class="stat-card stat-minor">
+                <div class="stat-value">{{.Files}}</div>
+                <div class="stat-label">Expired, pending cleanup ({{formatBytes .Size}})</div>
+            </div>{{end}}
+            {{with .Stats.Status "limit_reached"}}<div class="stat-card stat-minor">
+                <div class="stat-value">{{.Files}}</div>
+                <div class="stat-label">Download limit reached ({{formatBytes .Size}})</div>
+            </div>{{end}}
+            {{with .Stats.Status "limit_reached_grace"}}<div class="stat-card stat-minor">
+                <div class="stat-value">{{.Files}}</div>
+                <div class="stat-label">Limit reached, in grace period ({{formatBytes .Size}})</div>
+            </div>{{end}}
+            <div class="stat-card stat-minor">
+                <div class="stat-value">{{.Stats.Downloads24h}}</div>
+                <div class="stat-label">Downloads, last 24h</div>
+            </div>
+            <div class="stat-card stat-minor">
+                <div class="stat-value">{{.Stats.Downloads7d}}</div>
+                <div class="stat-label">Downloads, last 7 days</div>
+            </div>
+        </div>
+
+        {{with .Storage}}{{if gt .Max 0}}
+        <div class="storage">
+            <div>Storage: {{formatBytes .Used}} of {{formatBytes .Max}} ({{percent .Ratio}})</div>
+            <div class="storage-bar" title="Warning thresholds:{{range .Thresholds}} {{percent .}}{{end}}">
+                <div class="storage-fill{{if .Level}} level-{{if eq .Level (len .Thresholds)}}2{{else}}1{{end}}{{end}}" style="width: {{barWidth .Ratio}}"></div>
+                {{range .Thresholds}}<div class="storage-mark" style="left: {{barWidth .}}"></div>{{end}}
+            </div>
+            {{if .Warning}}<div class="warning">{{.Warning}}</div>{{end}}
+        </div>
+        {{end}}{{end}}
+
         <div class="upload-form">
             <h2>Upload File</h2>
-            <form action="/upload" method="post" enctype="multipart/form-data">
+            <form id="upload-form" action="{{path "/upload"}}" method="post" enctype="multipart/form-data">
+                <input type="hidden" name="dedup" value="true">
                 <div class="form-grid">
                     <div class="form-group">
                         <label>File:</label>
@@ -594,6 +1703,18 @@ func (fm *FileManager) manageFiles(w http.ResponseWriter, r *http.Request) {
                         <label>Password:</label>
                         <input type="password" name="password" placeholder="Optional">
                     </div>
+                    <div class="form-group">
+                        <label>Custom ID:</label>
+                        <input type="text" name="id" placeholder="Optional, e.g. q3-report">
+                    </div>
+                    {{if .EmailEnabled}}<div class="form-group">
+                        <label>Email me the link:</label>
+                        <input type="email" name="notify_email" placeholder="Optional">
+                    </div>{{end}}
+                </div>
+                <div class="form-group">
+                    <label>Title:</label>
+                    <input type="text" name="title" maxlength="200" placeholder="Optional, shown instead of the filename">
                 </div>
                 <div class="form-group">
                     <label>Description:</label>
@@ -612,7 +1733,7 @@ func (fm *FileManager) manageFiles(w http.ResponseWriter, r *http.Request) {
             <form method="get">
                 <div class="form-grid">
                     <div class="form-group">
-                        <input type="text" name="q" placeholder="Search filename or description..." value="{{.Query}}">
+                        <input type="text" name="q" placeholder="Search filename, title or description..." value="{{.Query}}">
                     </div>
                     <div class="form-group">
                         <input type="text" name="tag" placeholder="Filter by tag..." value="{{.TagFilter}}">
@@ -633,19 +1754,21 @@ func (fm *FileManager) manageFiles(w http.ResponseWriter, r *http.Request) {
                     <th>Uploaded</th>
                     <th>Expires</th>
                     <th>Downloads</th>
+                    <th>Status</th>
                     <th>Tags</th>
                     <th>Checksum</th>
                     <th>Actions</th>
                 </tr>
                 {{range .Files}}
-                <tr{{if .IsExpired}} class="expired"{{else if .NearLimit}} class="near-limit"{{end}}>
-                    <td><strong>{{.OriginalName}}</strong></td>
+                <tr{{if .Inactive}} class="expired"{{else if .NearLimit}} class="near-limit"{{end}}>
+                    <td><strong><a href="{{path "/admin/files/"}}{{.ID}}">{{.Label}}</a></strong>{{if .Title}}<br><small>{{displayName .OriginalName}}</small>{{end}}{{with index .Metadata "type_mismatch"}} <span class="warning" title="Type mismatch: {{.}}">&#9888;</span>{{end}}{{with index .Metadata "integrity_error"}} <span class="warning" title="Integrity error: {{.}}">&#9888;</span>{{end}}{{with .ProtectedBy}} <span class="lock" title="Protected by tag: {{join . ", "}}">&#128274;</span>{{end}}</td>
                     <td>{{.Description}}</td>
                     <td>{{formatBytes .Size}}</td>
                     <td>{{.ContentType}}</td>
                     <td>{{.UploadTime.Format "2006-01-02 15:04:05"}}</td>
-                    <td>{{.ExpiresAt.Format "2006-01-02 15:04:05"}}</td>
+                    <td title="{{expiresIn .ExpiresAt}}{{with .TTLSource}} ({{.}} TTL){{end}}">{{expiryTime .ExpiresAt}}</td>
                     <td>{{.Downloads}}{{if gt .MaxDownloads 0}}/{{.MaxDownloads}}{{end}}</td>
+                    <td class="status">{{.Status}}{{with .Collected}}<br>{{.}}{{end}}</td>
                     <td>
                         <div class="tags">
                             {{range .Tags}}<span class="tag">{{.}}</span>{{end}}
@@ -653,204 +1776,517 @@ func (fm *FileManager) manageFiles(w http.ResponseWriter, r *http.Request) {
                     </td>
                     <td class="checksum">{{substr .Checksum 0 12}}...</td>
                     <td class="actions">
-                        <a href="/download/{{.ID}}{{if .Password}}?password={{.Password}}{{end}}" target="_blank" class="btn">Download</a>
-                        <a href="/delete/{{.ID}}" onclick="return confirm('Delete this file?')" class="btn btn-danger">Delete</a>
+                        {{if .Inactive}}<span class="btn btn-disabled" title="{{.Status}}">Download</span>{{else}}<a href="{{path "/download/"}}{{.ID}}" target="_blank" class="btn">Download</a>{{end}}
+                        <form method="post" action="{{path "/delete/"}}{{.ID}}" class="inline" onsubmit="return confirm('Delete this file?')"><button type="submit" class="btn btn-danger">Delete</button></form>
+                        <details class="edit">
+                            <summary class="btn">Edit</summary>
+                            <form class="edit-form" data-id="{{.ID}}" data-etag="{{.ETag}}" data-downloads="{{.Downloads}}">
+                                <label>Description</label>
+                                <textarea name="description" rows="2">{{.Description}}</textarea>
+                                <label>Tags (comma-separated)</label>
+                                <input type="text" name="tags" value="{{join .Tags ", "}}">
+                                <label>Extend by (seconds)</label>
+                                <input type="number" name="ttl" min="1" placeholder="Keep the expiry">
+                                <label>Max downloads (0 = unlimited)</label>
+                                <input type="number" name="max_downloads" min="0" value="{{.MaxDownloads}}">
+                                <label>New password</label>
+                                <input type="password" name="password" autocomplete="new-password" placeholder="Keep the password">
+                                {{if .Password}}<label class="inline"><input type="checkbox" name="clear_password"> Remove the password</label>{{end}}
+                                <label>Metadata (JSON object)</label>
+                                <textarea name="metadata" rows="3">{{json .Metadata}}</textarea>
+                                <p><button type="submit" class="btn">Save</button></p>
+                            </form>
+                        </details>
                     </td>
                 </tr>
                 {{end}}
             </table>
         </div>
+
+        <h2>Recent Activity</h2>
+        <div style="overflow-x: auto;">
+            <table>
+                <tr>
+                    <th>Time</th>
+                    <th>Event</th>
+                    <th>File</th>
+                    <th>Actor</th>
+                    <th>Outcome</th>
+                </tr>
+                {{range .Activity}}
+                <tr>
+                    <td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+                    <td>{{.Type}}</td>
+                    <td>{{if .Filename}}{{displayName .Filename}}{{else}}<span class="checksum">{{.FileID}}</span>{{end}}</td>
+                    <td>{{.Actor}}{{if .Bot}} (bot){{end}}</td>
+                    <td>{{.Outcome}}</td>
+                </tr>
+                {{else}}
+                <tr><td colspan="5">No activity yet</td></tr>
+                {{end}}
+            </table>
+        </div>
     </div>
+    <script>
+    // Refuses what the server would refuse before the file is sent
+    (function () {
+        var form = document.getElementById('upload-form');
+        var caps = null;
+        fetch({{path "/api/capabilities"}}, {headers: {Accept: 'application/json'}})
+            .then(function (r) { return r.ok ? r.json() : null; })
+            .then(function (c) { caps = c && c.uploads; })
+            .catch(function () {});
+        function matches(patterns, type) {
+            return patterns.some(function (p) {
+                p = p.trim().toLowerCase();
+                if (p.endsWith('/')) p += '*';
+                return p === '*/*' || p === type || (p.endsWith('/*') && type.indexOf(p.slice(0, -1)) === 0);
+            });
+        }
+        form.addEventListener('submit', function (e) {
+            var file = form.elements.file.files[0];
+            if (!caps || !file) return;
+            var type = (file.type || 'application/octet-stream').toLowerCase();
+            var problem = '';
+            if (file.size > caps.max_file_size) {
+                problem = file.name + ' is larger than the ' + caps.max_file_size + ' bytes allowed';
+            } else if (matches(caps.denied_types, type) || (caps.allowed_types.length && !matches(caps.allowed_types, type))) {
+                problem = type + ' files are not accepted';
+            } else if (new TextEncoder().encode(form.elements.password.value).length > caps.max_password_length) {
+                problem = 'The password may be at most ' + caps.max_password_length + ' bytes';
+            }
+            if (problem) {
+                e.preventDefault();
+                alert(problem);
+            }
+        });
+    })();
+
+    // Sends only what was changed in an edit form, as a PATCH
+    document.querySelectorAll('.edit-form').forEach(function (form) {
+        var original = {
+            description: form.elements.description.value,
+            tags: form.elements.tags.value,
+            max_downloads: form.elements.max_downloads.value,
+            metadata: JSON.parse(form.elements.metadata.value || 'null') || {}
+        };
+        form.addEventListener('submit', function (e) {
+            e.preventDefault();
+            var el = form.elements, patch = {};
+            if (el.description.value !== original.description) patch.description = el.description.value;
+            if (el.tags.value !== original.tags) patch.tags = el.tags.value.split(',');
+            if (el.ttl.value) patch.ttl = parseInt(el.ttl.value, 10);
+            if (el.max_downloads.value !== original.max_downloads) {
+                patch.max_downloads = parseInt(el.max_downloads.value || '0', 10);
+                if (patch.max_downloads > 0 && patch.max_downloads < parseInt(form.dataset.downloads, 10)) {
+                    alert('The file was downloaded ' + form.dataset.downloads + ' times already');
+                    return;
+                }
+            }
+            if (el.password.value) patch.password = el.password.value;
+            else if (el.clear_password && el.clear_password.checked) patch.password = '';
+            var metadata;
+            try {
+                metadata = JSON.parse(el.metadata.value || '{}');
+            } catch (err) {
+                alert('Metadata must be a JSON object: ' + err.message);
+                return;
+            }
+            var changed = {}, any = false;
+            Object.keys(original.metadata).forEach(function (k) {
+                if (!(k in metadata)) { changed[k] = null; any = true; }
+            });
+            Object.keys(metadata).forEach(function (k) {
+                if (metadata[k] !== original.metadata[k]) { changed[k] = String(metadata[k]); any = true; }
+            });
+            if (any) patch.metadata = changed;
+            if (!Object.keys(patch).length) return;
+            fetch({{path "/api/files/"}} + encodeURIComponent(form.dataset.id), {
+                method: 'PATCH',
+                headers: {'Content-Type': 'application/json', Accept: 'application/json', 'If-Match': form.dataset.etag},
+                body: JSON.stringify(patch)
+            }).then(function (r) {
+                if (r.ok) return location.reload();
+                return r.json().then(function (body) {
+                    alert((body.error || r.statusText) + (body.violations ? ':\n' + body.violations.join('\n') : ''));
+                }, function () { alert(r.statusText); });
+            }).catch(function (err) { alert(err.message); });
+        });
+    });
+    </script>
 </body>
 </html>`
 
-	t := template.Must(template.New("manage").Funcs(template.FuncMap{
-		"formatBytes": func(bytes int64) string {
-			const unit = 1024
-			if bytes < unit {
-				return fmt.Sprintf("%d B", bytes)
-			}
-			div, exp := int64(unit), 0
-			for n := bytes / unit; n >= unit; n /= unit {
-				div *= unit
-				exp++
-			}
-			return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
-		},
-		"substr": func(s string, start, length int) string {
-			if start >= len(s) {
-				return ""
-			}
-			end := start + length
-			if end > len(s) {
-				end = len(s)
-			}
-			return s[start:end]
-		},
-	}).Parse(tmpl))
+	t := template.Must(template.New("manage").Funcs(fm.templateFuncs(r)).Parse(tmpl))
 
 	type TemplateFile struct {
 		*FileInfo
-		IsExpired bool
-		NearLimit bool
+		ContentType string
+		Status      FileStatus
+		Inactive    bool
+		NearLimit   bool
+		Collected   string   // e.g. "2 of 3 collected" for files with recipients
+		ProtectedBy []string // tags whose password the file requires
 	}
 
 	// Get stats
-	fm.mutex.RLock()
-	stats := UploadStats{}
-	now := time.Now()
-	for _, fileInfo := range fm.files {
-		stats.TotalFiles++
-		stats.TotalSize += fileInfo.Size
-		stats.TotalDownloads += fileInfo.Downloads
-		if now.Before(fileInfo.ExpiresAt) {
-			stats.ActiveFiles++
-		}
-	}
-	fm.mutex.RUnlock()
+	stats := fm.computeStats(statsFilter{IncludeExpired: includeExpired, Key: key, Hidden: hidden})
 
+	rules := fm.tagRules()
 	templateFiles := make([]TemplateFile, len(files))
 	for i, f := range files {
-		isExpired := time.Now().After(f.ExpiresAt)
+		status := f.Status()
 		nearLimit := f.MaxDownloads > 0 && f.Downloads >= f.MaxDownloads-1
 		templateFiles[i] = TemplateFile{
-			FileInfo:  f,
-			IsExpired: isExpired,
-			NearLimit: nearLimit && !isExpired,
+			FileInfo:    f,
+			ContentType: f.effectiveContentType(),
+			Status:      status,
+			Inactive:    status != StatusActive,
+			NearLimit:   nearLimit && status == StatusActive,
+			Collected:   f.collectionStatus(),
+			ProtectedBy: rules.protecting(f.Tags).names(),
 		}
 	}
 
 	data := struct {
-		Files     []TemplateFile
-		Stats     UploadStats
-		Query     string
-		TagFilter string
+		Files        []TemplateFile
+		Stats        UploadStats
+		Activity     []ActivityEvent
+		Query        string
+		TagFilter    string
+		Storage      StorageUsage
+		EmailEnabled bool
+		SignedIn     bool
 	}{
-		Files:     templateFiles,
-		Stats:     stats,
-		Query:     r.URL.Query().Get("q"),
-		TagFilter: r.URL.Query().Get("tag"),
+		Files:        templateFiles,
+		Stats:        stats,
+		Storage:      fm.storageUsage(),
+		Activity:     fm.activity.latest(20),
+		Query:        r.URL.Query().Get("q"),
+		TagFilter:    r.URL.Query().Get("tag"),
+		EmailEnabled: fm.config().SMTPHost != "",
+		SignedIn:     fm.sessionAdmin(r) != nil,
 	}
 
 	w.Header().Set("Content-Type", "text/html")
 	t.Execute(w, data)
 }
 
-func (fm *FileManager) deleteFile(w http.ResponseWriter, r *http.Request) {
-	fileID := strings.TrimPrefix(r.URL.Path, "/delete/")
-
+// removeFile deletes a file from the index and from disk on behalf of the
+// request r, which may be nil. It reports whether the file existed.
+func (fm *FileManager) removeFile(r *http.Request, fileID string) bool {
 	fm.mutex.Lock()
 	fileInfo, exists := fm.files[fileID]
 	if exists {
 		delete(fm.files, fileID)
+		fm.bury(fileID, fileInfo, "deleted")
+		fm.recordChange(changeDeleted, fileID, fileInfo)
 	}
 	fm.mutex.Unlock()
 
 	if exists {
-		os.Remove(fileInfo.Path)
-		fm.saveMetadata()
+		fm.deleteStoredFile(fileInfo)
+		fm.requestSave()
+		fm.recordEvent(r, "delete", fileInfo, fileID, "ok")
+		fm.checkStorageThresholds()
+	}
+	return exists
+}
+
+func (fm *FileManager) deleteFile(w http.ResponseWriter, r *http.Request) {
+	fileID, err := pathID(r, "/delete/")
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Links and prefetches follow GETs, so strict mode only deletes on
+	// POST and DELETE
+	if r.Method == "GET" && fm.config().Strict {
+		w.Header().Set("Allow", "POST, DELETE")
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := fm.authorizeKey(w, r, scopeDelete)
+	if !ok {
+		return
+	}
+	if key == nil && !fm.requireRole(w, r, roleEditor) {
+		return
+	}
+	if key != nil {
+		fm.mutex.RLock()
+		fileInfo, exists := fm.files[fileID]
+		fm.mutex.RUnlock()
+		if exists && !key.canDelete(fileInfo) {
+			respondError(w, r, "API key may not delete this file", http.StatusForbidden)
+			return
+		}
+	}
 
-		if strings.Contains(r.Header.Get("Accept"), "application/json") {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+	if fm.removeFile(r, fileID) {
+		if wantsJSON(r) {
+			respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
 		} else {
-			http.Redirect(w, r, "/manage", http.StatusSeeOther)
+			http.Redirect(w, r, fm.appPath("/manage"), http.StatusSeeOther)
 		}
 	} else {
-		http.Error(w, "File not found", http.StatusNotFound)
+		respondError(w, r, "File not found", http.StatusNotFound)
 	}
 }
 
 func (fm *FileManager) fileInfo(w http.ResponseWriter, r *http.Request) {
-	fileID := strings.TrimPrefix(r.URL.Path, "/info/")
+	fileID, err := pathID(r, "/info/")
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method == "HEAD" {
+		fm.headFileInfo(w, r, fileID)
+		return
+	}
+	fm.serveFileInfo(w, r, fileID)
+}
+
+// infoFilter tells which files /info and its variants report to r: files
+// with a protected tag need admin credentials and keys only see their tag,
+// as in listings and over gRPC. Others are answered as not found.
+type infoFilter struct {
+	hidden tagRules
+	key    *APIKey
+}
+
+func (fm *FileManager) infoFilter(r *http.Request) infoFilter {
+	return infoFilter{hidden: fm.hiddenTags(r), key: fm.requestKey(r)}
+}
+
+// shows reports whether fileInfo is visible; call it under the read lock.
+func (f infoFilter) shows(fileInfo *FileInfo) bool {
+	return !f.hidden.protects(fileInfo.Tags) && f.key.permits(fileInfo)
+}
+
+// infoHeaders are the fields of /info/{id} that HEAD sends as headers, by
+// header name, as listed on /api/capabilities.
+var infoHeaders = map[string]string{
+	"X-File-Size":  "size",
+	"X-Expires-At": "expires_at",
+	"X-Downloads":  "downloads",
+	"X-Status":     "status",
+}
+
+// headFileInfo answers HEAD /info/{id} with the infoHeaders and no body, for
+// monitoring that only needs those. Values read the same as in the JSON of
+// GET. Missing files get the status GET would answer with and no headers.
+func (fm *FileManager) headFileInfo(w http.ResponseWriter, r *http.Request, fileID string) {
+	filter := fm.infoFilter(r)
+	fm.mutex.RLock()
+	fileInfo, exists := fm.files[fileID]
+	hidden := exists && !filter.shows(fileInfo)
+	var header map[string]string
+	if exists && !hidden {
+		header = map[string]string{
+			"X-File-Size":  strconv.FormatInt(fileInfo.Size, 10),
+			"X-Expires-At": fileInfo.ExpiresAt.Format(time.RFC3339Nano),
+			"X-Downloads":  strconv.Itoa(fileInfo.Downloads),
+			"X-Status":     string(fileInfo.Status()),
+			"ETag":         fileInfo.ETag(),
+		}
+	}
+	fm.mutex.RUnlock()
+
+	if hidden {
+		w.WriteHeader(problemFor(errFileNotFound).Status)
+		return
+	}
+	if !exists {
+		w.WriteHeader(problemFor(fm.missingFileError(fileID)).Status)
+		return
+	}
+	for name, value := range header {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
+// serveFileInfo answers /info/{id} and GET /api/files/{id} with the file's
+// details and its revision as the ETag.
+func (fm *FileManager) serveFileInfo(w http.ResponseWriter, r *http.Request, fileID string) {
+	filter := fm.infoFilter(r)
 	fm.mutex.RLock()
 	fileInfo, exists := fm.files[fileID]
+	hidden := exists && !filter.shows(fileInfo)
+	var etag string
+	if exists {
+		etag = fileInfo.ETag()
+	}
 	fm.mutex.RUnlock()
 
+	if hidden {
+		writeDownloadError(w, r, errFileNotFound)
+		return
+	}
 	if !exists {
-		http.Error(w, "File not found", http.StatusNotFound)
+		if !fm.writeTombstone(w, r, fileID, false) {
+			fm.writeNotFound(w, r, fileID)
+		}
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(fileInfo)
+	w.Header().Set("ETag", etag)
+	respondJSON(w, http.StatusOK, fm.fileView(r, fileInfo))
 }
 
 func (fm *FileManager) bulkDelete(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, ok := fm.authorizeKey(w, r, scopeDelete)
+	if !ok {
+		return
+	}
+	if key == nil && !fm.requireRole(w, r, roleEditor) {
 		return
 	}
 
 	var request struct {
-		FileIDs []string `json:"file_ids"`
+		FileIDs  []string `json:"file_ids"`
+		Tag      string   `json:"tag"`
+		ExactTag bool     `json:"exact_tag"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		respondError(w, r, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
+	tag := fm.newTagFilter(request.Tag, request.ExactTag)
+
 	deleted := 0
 	fm.mutex.Lock()
+	if tag.Tag != "" {
+		// In a fixed order, so the change feed and activity log read the same
+		// whichever way the map iterates
+		var matching []*FileInfo
+		for _, fileInfo := range fm.files {
+			if tag.matches(fileInfo.Tags) {
+				matching = append(matching, fileInfo)
+			}
+		}
+		sortEntries(matching)
+		for _, fileInfo := range matching {
+			request.FileIDs = append(request.FileIDs, fileInfo.ID)
+		}
+	}
+	var removed []*FileInfo
 	for _, fileID := range request.FileIDs {
-		if fileInfo, exists := fm.files[fileID]; exists {
-			os.Remove(fileInfo.Path)
+		if fileInfo, exists := fm.files[fileID]; exists && (key == nil || key.canDelete(fileInfo)) {
 			delete(fm.files, fileID)
+			fm.bury(fileID, fileInfo, "deleted")
+			fm.recordChange(changeDeleted, fileID, fileInfo)
 			deleted++
+			fm.recordEvent(r, "delete", fileInfo, fileID, "ok")
+			removed = append(removed, fileInfo)
 		}
 	}
 	fm.mutex.Unlock()
 
+	// Like removeFile, the content goes once the lock is released, so
+	// downloads and uploads don't wait on storage
+	for _, fileInfo := range removed {
+		fm.deleteStoredFile(fileInfo)
+	}
 	if deleted > 0 {
-		fm.saveMetadata()
+		fm.requestSave()
+		fm.checkStorageThresholds()
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"deleted": deleted,
 		"total":   len(request.FileIDs),
 	})
 }
 
 func (fm *FileManager) apiHandler(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/api/")
-	parts := strings.Split(path, "/")
-
+	parts, err := pathSegments(r, "/api/")
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if len(parts) == 0 {
-		http.Error(w, "Invalid API endpoint", http.StatusNotFound)
+		respondError(w, r, "Invalid API endpoint", http.StatusNotFound)
 		return
 	}
 
 	switch parts[0] {
 	case "files":
-		if r.Method == "GET" {
+		if len(parts) == 3 && parts[2] == "bundle" {
+			fm.downloadBundle(w, r, parts[1])
+		} else if len(parts) == 3 && parts[2] == "receipt" {
+			fm.fileReceipt(w, r, parts[1])
+		} else if len(parts) == 2 && parts[1] == "info" && r.Method == "POST" {
+			fm.batchFileInfo(w, r)
+		} else if len(parts) == 2 && r.Method == "GET" {
+			fm.serveFileInfo(w, r, parts[1])
+		} else if len(parts) == 2 && r.Method == "PATCH" {
+			fm.patchFile(w, r, parts[1])
+		} else if len(parts) == 1 && r.Method == "GET" {
 			fm.listFilesAPI(w, r)
+		} else if len(parts) > 2 {
+			respondError(w, r, "Invalid API endpoint", http.StatusNotFound)
+		} else {
+			respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "links":
+		fm.createLink(w, r)
+	case "public-key":
+		fm.publicKeyInfo(w, r)
+	case "receipts":
+		if len(parts) == 2 && parts[1] == "verify" {
+			fm.verifyReceipt(w, r)
 		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			respondError(w, r, "Unknown API endpoint", http.StatusNotFound)
 		}
+	case "checksums":
+		fm.lookupChecksum(w, r, parts[1:])
+	case "tags":
+		fm.listTags(w, r)
+	case "changes":
+		fm.listChanges(w, r)
+	case "uploads":
+		fm.uploadSessionsAPI(w, r, parts[1:])
 	case "upload":
 		if r.Method == "POST" {
+			fm.markDeprecated(w, "/upload")
 			fm.uploadFile(w, r)
 		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	case "health":
 		fm.healthCheck(w, r)
+	case "version":
+		fm.versionInfo(w, r)
+	case "capabilities":
+		fm.serveCapabilities(w, r)
+	case "admin":
+		fm.adminAPI(w, r, parts[1:])
+	case "requests":
+		fm.fileRequestsAPI(w, r, parts[1:])
+	case "metadata-schema":
+		fm.metadataSchema(w, r)
+	case "template-functions":
+		fm.templateFunctions(w, r)
 	default:
-		http.Error(w, "Unknown API endpoint", http.StatusNotFound)
+		respondError(w, r, "Unknown API endpoint", http.StatusNotFound)
 	}
 }
 
 func (fm *FileManager) listFilesAPI(w http.ResponseWriter, r *http.Request) {
-	limit := 50 // default limit
-	if l := r.URL.Query().Get("limit"); l != "" {
-		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 1000 {
-			limit = parsed
-		}
+	if !fm.requireListingAccess(w, r) {
+		return
 	}
 
+	limit := pageLimit(r)
+
 	offset := 0
 	if o := r.URL.Query().Get("offset"); o != "" {
 		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
@@ -858,39 +2294,77 @@ func (fm *FileManager) listFilesAPI(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	status, ok := statusFilter(w, r)
+	if !ok {
+		return
+	}
+
+	fields, err := parseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	includeExpired := fm.showExpired(r)
+	key := fm.requestKey(r)
+	hidden := fm.hiddenTags(r)
 	fm.mutex.RLock()
 	files := make([]*FileInfo, 0, len(fm.files))
 	for _, fileInfo := range fm.files {
-		files = append(files, fileInfo)
+		fileStatus := fileInfo.Status()
+		if (fileStatus == StatusExpired && !includeExpired) || !key.permits(fileInfo) || hidden.protects(fileInfo.Tags) {
+			continue
+		}
+		if status == "" || fileStatus == status {
+			files = append(files, fileInfo)
+		}
 	}
 	fm.mutex.RUnlock()
 
+	if r.URL.Query().Get("count_only") == "true" {
+		respondJSON(w, http.StatusOK, map[string]int{"total": len(files)})
+		return
+	}
+
 	// Sort by upload time (newest first)
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].UploadTime.After(files[j].UploadTime)
-	})
+	sortFiles(files, "upload_time")
 
-	// Apply pagination
+	// Apply pagination, by cursor when one is given
 	total := len(files)
-	end := offset + limit
-	if end > total {
-		end = total
-	}
-	if offset >= total {
+	var nextCursor string
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		cursor, err := decodeCursor(token, "upload_time")
+		if err != nil {
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		files, nextCursor = pageAfter(files, cursor, limit)
+	} else if offset >= total {
 		files = []*FileInfo{}
 	} else {
-		files = files[offset:end]
+		files, nextCursor = firstPage(files[offset:], "upload_time", limit)
+	}
+
+	// Project after paginating so only the returned page is re-encoded
+	fm.mutex.RLock()
+	projected, err := projectFiles(files, fields, fm.hasAdminCredentials(r))
+	fm.mutex.RUnlock()
+	if err != nil {
+		respondError(w, r, "Server error", http.StatusInternalServerError)
+		return
 	}
 
 	response := map[string]interface{}{
-		"files":  files,
+		"files":  projected,
 		"total":  total,
 		"limit":  limit,
 		"offset": offset,
 	}
+	if nextCursor != "" {
+		response["next_cursor"] = nextCursor
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	respondJSON(w, http.StatusOK, response)
 }
 
 func (fm *FileManager) healthCheck(w http.ResponseWriter, r *http.Request) {
@@ -898,38 +2372,308 @@ func (fm *FileManager) healthCheck(w http.ResponseWriter, r *http.Request) {
 	fileCount := len(fm.files)
 	fm.mutex.RUnlock()
 
+	persistence := fm.persistenceStatus()
+	storage := fm.storageUsage()
+	filesystem := fm.filesystemUsage()
+	backup := fm.backupStatus()
+	latency, slow := fm.storageLatencyStatus()
+	status := "healthy"
+	if persistence.Degraded || storage.degraded() || filesystem.degraded(storage.Thresholds) || backup.failing() || slow {
+		status = "degraded"
+	}
+
 	health := map[string]interface{}{
-		"status":     "healthy",
-		"timestamp":  time.Now().Format(time.RFC3339),
-		"file_count": fileCount,
-		"uptime":     time.Since(startTime).String(),
+		"status":      status,
+		"timestamp":   time.Now().Format(time.RFC3339),
+		"file_count":  fileCount,
+		"uptime":      time.Since(startTime).String(),
+		"persistence": persistence,
+		"build":       currentBuild(),
+	}
+	if storage.Max > 0 {
+		health["storage"] = storage
+	}
+	if filesystem != nil {
+		health["filesystem"] = filesystem
+	}
+	if backup.Schedule != "" || backup.LastSuccess != nil || backup.LastErrorAt != nil {
+		health["backup"] = backup
+	}
+	health["storage_latency"] = latency
+	// Without public listings the file count is for admins only
+	if !fm.config().PublicListings && !fm.hasAdminCredentials(r) {
+		delete(health, "file_count")
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(health)
+	respondJSON(w, http.StatusOK, health)
 }
 
 var startTime = time.Now()
 
-func loadConfig() Config {
-	config := Config{
-		Port:            "8080",
-		UploadDir:       "./files",
-		MetadataFile:    "./metadata.json",
-		DefaultTTL:      1 * time.Hour,
-		MaxFileSize:     100 * 1024 * 1024, // 100MB
-		AllowedOrigins:  []string{"*"},
-		CleanupInterval: 5 * time.Minute,
-		MaxDownloads:    0, // unlimited by default
-		RequirePassword: false,
-		AdminPassword:   "",
-		AllowedTypes:    []string{}, // all types allowed by default
+// configFile is read at startup and on SIGHUP.
+const configFile = "config.json"
+
+// defaultConfig returns the settings used for everything config.json leaves
+// out.
+func defaultConfig() Config {
+	return Config{
+		Port:                  "8080",
+		SocketMode:            "0660",
+		UploadDir:             "./files",
+		StorageBackend:        storageLocal,
+		SMTPPort:              587,
+		EmailRateLimit:        10,
+		MemoryBudget:          256 * 1024 * 1024, // 256MB
+		MaxPathLength:         1024,
+		MetadataFile:          "./metadata.json",
+		MetadataBackend:       metadataJSON,
+		MetadataDatabase:      "./metadata.db",
+		DefaultTTL:            1 * time.Hour,
+		MaxDecompressionRatio: 100,
+		ExpiryTimezone:        "UTC",
+		MaxFileSize:           100 * 1024 * 1024, // 100MB
+		AllowedOrigins:        []string{"*"},
+		CleanupInterval:       5 * time.Minute,
+		MaxDownloads:          0, // unlimited by default
+		RequirePassword:       false,
+		AdminPassword:         "",
+		AllowedTypes:          []string{}, // all types allowed by default
+		ChecksumAlgorithm:     "sha256",
+		RehashBytesPerSecond:  50 * 1024 * 1024, // 50MB/s
+		TrustedProxies:        []string{},
+		ResponseFields:        []string{"landing_url", "download_url", "curl", "expires_in", "delete_url"},
+		MetadataSaveInterval:  5 * time.Second,
+		IdleTimeout:           2 * time.Minute,
+		ShutdownTimeout:       30 * time.Second,
+		CacheMaxBytes:         1024 * 1024 * 1024, // 1GB
+		CacheWaitTimeout:      100 * time.Millisecond,
+		ExpiryWarningRatio:    0.1,
+		PublicListings:        true,
+		LinkPreviews:          true,
+		UploadSessionTTL:      24 * time.Hour,
+		ArchiveSpoolThreshold: 256 * 1024 * 1024,      // 256MB
+		ArchiveSpoolBudget:    2 * 1024 * 1024 * 1024, // 2GB
+		ArchiveSpoolTTL:       time.Hour,
+		TagHierarchy:          true,
+		StorageWarnings:       []float64{0.8, 0.9},
+		StorageHysteresis:     0.05,
+		StorageLatencyLimits:  map[string]time.Duration{storageOpCreate: time.Second, storageOpOpen: time.Second, storageOpRemove: time.Second},
+		ChangeLogRetention:    7 * 24 * time.Hour,
+		SlowRequestThreshold:  10 * time.Second,
+		DuplicateWindow:       10 * time.Second,
+		StatsMaxStaleness:     2 * time.Second,
+		MissingFilesLimit:     0.5,
+		AdminSessionTTL:       12 * time.Hour,
+		LoginRateLimit:        5,
+		LargeTransferBytes:    1024 * 1024 * 1024, // 1GB
+		TypeMismatchPolicy:    mismatchTag,
+		SendfileMode:          sendfileNone,
+		ReceiptKeyFile:        "./receipt_key.pem",
+		TombstoneWindow:       24 * time.Hour,
+		CleanupMaxFiles:       1000,
+		CleanupMaxDuration:    2 * time.Second,
+		LinkSigningTTL:        5 * time.Minute,
+		MaxMetadataKeys:       64,
+		MaxMetadataValueLen:   4096,
+		SendfileLocation:      "/protected-files",
+		Backup: BackupConfig{
+			Dir:            "./backups",
+			Retention:      7,
+			BytesPerSecond: 50 * 1024 * 1024, // 50MB/s
+		},
 	}
+}
+
+func loadConfig() Config {
+	config := defaultConfig()
 
 	// Load from config file if exists
-	if data, err := os.ReadFile("config.json"); err == nil {
+	if data, err := os.ReadFile(configFile); err == nil {
 		json.Unmarshal(data, &config)
 	}
 
 	return config
 }
+
+// Validate reports configuration mistakes that should stop the server from
+// starting.
+func (c Config) Validate() error {
+	if _, err := newHasher(c.ChecksumAlgorithm); err != nil {
+		return err
+	}
+	if _, err := loadLocation(c.ExpiryTimezone); err != nil {
+		return fmt.Errorf("invalid expiry_timezone %q: %v", c.ExpiryTimezone, err)
+	}
+	if c.CleanupMaxFiles < 0 || c.CleanupMaxDuration < 0 {
+		return fmt.Errorf("cleanup_max_files and cleanup_max_duration must not be negative")
+	}
+	for _, threshold := range c.StorageWarnings {
+		if threshold <= 0 || threshold > 1 {
+			return fmt.Errorf("storage_warning_thresholds must be fractions between 0 and 1, got %v", threshold)
+		}
+	}
+	if c.StorageHysteresis < 0 {
+		return fmt.Errorf("storage_warning_hysteresis must not be negative")
+	}
+	for op, limit := range c.StorageLatencyLimits {
+		if !slices.Contains(storageOps, op) {
+			return fmt.Errorf("storage_latency_thresholds: unknown operation %q, expected create, open or remove", op)
+		}
+		if limit < 0 {
+			return fmt.Errorf("storage_latency_thresholds.%s must not be negative", op)
+		}
+	}
+	for _, pattern := range append(append([]string(nil), c.AllowedTypes...), c.DeniedTypes...) {
+		if _, err := parseTypePattern(pattern); err != nil {
+			return err
+		}
+	}
+	if c.SMTPHost != "" {
+		if _, err := mail.ParseAddress(c.SMTPFrom); err != nil {
+			return fmt.Errorf("smtp_from must be an email address when smtp_host is set")
+		}
+		if c.SMTPPort <= 0 || c.SMTPPort > 65535 {
+			return fmt.Errorf("invalid smtp_port %d", c.SMTPPort)
+		}
+	}
+	if c.MaxPathLength < 0 {
+		return fmt.Errorf("max_path_length must not be negative")
+	}
+	if c.EmailRateLimit < 0 {
+		return fmt.Errorf("email_rate_limit must not be negative")
+	}
+	if _, err := loadNotificationTemplates(c.NotificationTemplates); err != nil {
+		return err
+	}
+	if c.PostLimitGrace < 0 {
+		return fmt.Errorf("post_limit_grace must not be negative")
+	}
+	if _, err := parseBackupSchedule(c.Backup.Schedule); err != nil {
+		return err
+	}
+	if c.Backup.Schedule != "" && c.Backup.Dir == "" {
+		return fmt.Errorf("backup.dir is required with backup.schedule")
+	}
+	if c.Backup.Retention < 0 || c.Backup.BytesPerSecond < 0 {
+		return fmt.Errorf("backup.retention and backup.bytes_per_second must not be negative")
+	}
+	if c.MaxTTL < 0 {
+		return fmt.Errorf("max_ttl must not be negative")
+	}
+	if c.MaxDecompressionRatio < 0 {
+		return fmt.Errorf("max_decompression_ratio must not be negative")
+	}
+	if c.DuplicateWindow < 0 {
+		return fmt.Errorf("duplicate_window must not be negative")
+	}
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 || c.ShutdownTimeout < 0 {
+		return fmt.Errorf("read_timeout, write_timeout, idle_timeout and shutdown_timeout must not be negative")
+	}
+	if c.StatsMaxStaleness < 0 {
+		return fmt.Errorf("stats_max_staleness must not be negative")
+	}
+	seen := make(map[string]bool)
+	for i, admin := range c.Admins {
+		if err := admin.validate(); err != nil {
+			return fmt.Errorf("admins[%d]: %v", i, err)
+		}
+		if seen[admin.Username] {
+			return fmt.Errorf("admins[%d]: username %q is listed twice", i, admin.Username)
+		}
+		seen[admin.Username] = true
+	}
+	if len(c.Admins) > 0 && !c.RequirePassword {
+		return fmt.Errorf("admins need require_password: without it every admin route, users and API keys included, is open to anyone")
+	}
+	if c.AdminSessionTTL <= 0 {
+		return fmt.Errorf("admin_session_ttl must be positive")
+	}
+	if c.LoginRateLimit < 0 {
+		return fmt.Errorf("login_rate_limit must not be negative")
+	}
+	if c.PathPrefix != "" && (!strings.HasPrefix(c.PathPrefix, "/") || path.Clean(c.PathPrefix) != c.PathPrefix ||
+		c.PathPrefix == "/" || strings.ContainsAny(c.PathPrefix, "?#")) {
+		return fmt.Errorf("path_prefix must look like /uploads: a leading slash and no trailing one")
+	}
+	if c.AsyncChecksumSize < 0 {
+		return fmt.Errorf("async_checksum_size must not be negative")
+	}
+	if c.MissingFilesLimit < 0 || c.MissingFilesLimit > 1 {
+		return fmt.Errorf("missing_files_limit must be between 0 and 1")
+	}
+	if c.ColdAfter < 0 || c.ColdMinSize < 0 {
+		return fmt.Errorf("cold_after and cold_min_size must not be negative")
+	}
+	if c.ColdAfter > 0 && c.ColdStorageDir == "" {
+		return fmt.Errorf("cold_after requires cold_storage_dir")
+	}
+	if c.SlowRequestThreshold < 0 || c.LargeTransferBytes < 0 {
+		return fmt.Errorf("slow_request_threshold and large_transfer_threshold must not be negative")
+	}
+	if c.ChangeLogRetention < 0 {
+		return fmt.Errorf("change_log_retention must not be negative")
+	}
+	if c.MaxMetadataKeys < 0 || c.MaxMetadataValueLen < 0 {
+		return fmt.Errorf("max_metadata_keys and max_metadata_value_length must not be negative")
+	}
+	if c.SocketMode != "" {
+		if _, err := strconv.ParseUint(c.SocketMode, 8, 32); err != nil {
+			return fmt.Errorf("invalid socket_mode %q: must be octal, e.g. 0660", c.SocketMode)
+		}
+	}
+	switch c.SendfileMode {
+	case "", sendfileNone, sendfileXAccel, sendfileXSendfile:
+	default:
+		return fmt.Errorf("unknown sendfile_mode %q", c.SendfileMode)
+	}
+	switch c.StorageBackend {
+	case "", storageLocal:
+	case storageMemory:
+		// Both hand the proxy or the cache a path on disk
+		if c.SendfileMode != "" && c.SendfileMode != sendfileNone {
+			return fmt.Errorf("sendfile_mode needs storage_backend %q", storageLocal)
+		}
+		if c.CacheDir != "" {
+			return fmt.Errorf("cache_dir needs storage_backend %q", storageLocal)
+		}
+		if c.MemoryBudget <= 0 {
+			return fmt.Errorf("memory_budget must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown storage_backend %q", c.StorageBackend)
+	}
+	switch c.MetadataBackend {
+	case "", metadataJSON:
+	case metadataSQLite:
+		if c.StorageBackend == storageMemory {
+			return fmt.Errorf("metadata_backend %q needs storage_backend %q", metadataSQLite, storageLocal)
+		}
+		if c.MetadataDatabase == "" {
+			return fmt.Errorf("metadata_database must be set")
+		}
+	default:
+		return fmt.Errorf("unknown metadata_backend %q", c.MetadataBackend)
+	}
+	switch c.TypeMismatchPolicy {
+	case mismatchTag, mismatchAttachment, mismatchReject:
+	default:
+		return fmt.Errorf("unknown type_mismatch_policy %q", c.TypeMismatchPolicy)
+	}
+	for key, field := range c.MetadataSchema {
+		if err := field.validate(key); err != nil {
+			return err
+		}
+	}
+	if c.UploadRateLimit < 0 || c.UploadBytesPerHour < 0 || c.MaxBytesPerUploader < 0 {
+		return fmt.Errorf("upload_rate_limit, upload_bytes_per_hour and max_bytes_per_uploader must not be negative")
+	}
+	for i, rule := range c.AutoTagRules {
+		if err := rule.validate(i); err != nil {
+			return err
+		}
+	}
+	if c.Strict {
+		return c.strictViolations()
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// submissionGuard catches the same upload submitted twice in quick
+// succession, e.g. by a double click: an upload with the same original
+// name, size and uploader as one completed within duplicate_window gets the
+// earlier result instead of being stored again. Uploads opt in with
+// dedup=true, which the upload form sends.
+type submissionGuard struct {
+	mutex       sync.Mutex
+	submissions map[string]*submission
+}
+
+type submission struct {
+	done     chan struct{} // closed once fileInfo and finished are set
+	fileInfo *FileInfo     // nil when the upload failed
+	finished time.Time
+}
+
+// uploaderIdentity names who uploads for rate limits and duplicate checks:
+// the API key when one is used, the client address otherwise.
+func (fm *FileManager) uploaderIdentity(r *http.Request, req uploadRequest) string {
+	if req.KeyID != "" {
+		return "key:" + req.KeyID
+	}
+	return fm.clientIP(r)
+}
+
+// dedupUpload stores an upload through store unless an identical one
+// completed within duplicate_window, or is still in progress and then
+// succeeds; in those cases it returns the earlier file and true.
+func (fm *FileManager) dedupUpload(r *http.Request, req uploadRequest, size int64, store func() (*FileInfo, error)) (*FileInfo, bool, error) {
+	window := fm.config().DuplicateWindow
+	if window <= 0 || r.FormValue("dedup") != "true" {
+		fileInfo, err := store()
+		return fileInfo, false, err
+	}
+	key := req.Filename + "\x00" + strconv.FormatInt(size, 10) + "\x00" + fm.uploaderIdentity(r, req)
+	g := &fm.submissions
+
+	for {
+		g.mutex.Lock()
+		if g.submissions == nil {
+			g.submissions = make(map[string]*submission)
+		}
+		now := time.Now()
+		for k, s := range g.submissions {
+			if !s.finished.IsZero() && now.Sub(s.finished) > window {
+				delete(g.submissions, k)
+			}
+		}
+		earlier, exists := g.submissions[key]
+		if !exists {
+			current := &submission{done: make(chan struct{})}
+			g.submissions[key] = current
+			g.mutex.Unlock()
+
+			fileInfo, err := store()
+			g.mutex.Lock()
+			current.fileInfo, current.finished = fileInfo, time.Now()
+			if err != nil {
+				delete(g.submissions, key)
+			}
+			g.mutex.Unlock()
+			close(current.done)
+			return fileInfo, false, err
+		}
+		g.mutex.Unlock()
+
+		// Wait for an identical upload still in progress
+		<-earlier.done
+		if earlier.fileInfo != nil && fm.stillStored(earlier.fileInfo) {
+			return earlier.fileInfo, true, nil
+		}
+		// It failed or is gone already; store this one after all
+		g.mutex.Lock()
+		if g.submissions[key] == earlier {
+			delete(g.submissions, key)
+		}
+		g.mutex.Unlock()
+	}
+}
+
+// stillStored reports whether fileInfo is still registered under its ID.
+func (fm *FileManager) stillStored(fileInfo *FileInfo) bool {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	return fm.files[fileInfo.ID] == fileInfo
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDuplicateSubmission(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.DuplicateWindow = 200 * time.Millisecond
+	})
+
+	// One multipart body, sent as a double click sends it
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("dedup", "true")
+	part, _ := form.CreateFormFile("file", "slides.bin")
+	part.Write(testContent(1 << 20))
+	form.Close()
+	submit := func() (int, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", server.URL+"/upload", bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		return doJSON(t, req)
+	}
+
+	const clicks = 4
+	results := make([]map[string]interface{}, clicks)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range clicks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			status, uploaded := submit()
+			if status != http.StatusOK {
+				t.Errorf("submission %d: status %d, body %v", i, status, uploaded)
+			}
+			results[i] = uploaded
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	duplicates := 0
+	for _, uploaded := range results {
+		if uploaded["id"] != results[0]["id"] {
+			t.Errorf("submissions got IDs %v and %v, want the same file", results[0]["id"], uploaded["id"])
+		}
+		if uploaded["duplicate_submission"] == true {
+			duplicates++
+		}
+	}
+	if duplicates != clicks-1 {
+		t.Errorf("%d responses flagged duplicate_submission, want %d", duplicates, clicks-1)
+	}
+	if n := len(storedKeys(fm)); n != 1 {
+		t.Errorf("%d files stored, want 1", n)
+	}
+
+	// After the window the same file is a new upload
+	time.Sleep(300 * time.Millisecond)
+	if _, uploaded := submit(); uploaded["id"] == results[0]["id"] || uploaded["duplicate_submission"] != nil {
+		t.Errorf("submission after the window: %v, want a new file", uploaded)
+	}
+}
+
+func TestDuplicateSubmissionKey(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	upload := func(name string, size int, fields url.Values) string {
+		t.Helper()
+		status, uploaded := uploadTestFile(t, server, name, testContent(size), fields)
+		if status != http.StatusOK {
+			t.Fatalf("upload: status %d, body %v", status, uploaded)
+		}
+		return uploaded["id"].(string)
+	}
+	form := url.Values{"dedup": {"true"}}
+
+	first := upload("a.bin", 100, form)
+	if id := upload("a.bin", 100, form); id != first {
+		t.Errorf("identical form upload stored again as %s", id)
+	}
+	// API clients that don't ask for it are never deduplicated
+	if id := upload("a.bin", 100, nil); id == first {
+		t.Error("upload without dedup=true answered with the earlier file")
+	}
+	if id := upload("b.bin", 100, form); id == first {
+		t.Error("a different name answered with the earlier file")
+	}
+	if id := upload("a.bin", 101, form); id == first {
+		t.Error("a different size answered with the earlier file")
+	}
+
+	// A deleted file isn't handed out again
+	req, _ := http.NewRequest("DELETE", server.URL+"/delete/"+first, nil)
+	if status, _ := doJSON(t, req); status != http.StatusOK {
+		t.Fatalf("delete: status %d", status)
+	}
+	if id := upload("a.bin", 100, form); id == first {
+		t.Error("identical upload after deleting the first answered with the deleted file")
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSingleUseDownloadServedOnce(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	status, uploaded := uploadTestFile(t, server, "once.txt", []byte("only once"), url.Values{"max_downloads": {"1"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+
+	const downloaders = 20
+	statuses := make([]int, downloaders)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			resp, err := http.Get(server.URL + "/download/" + id)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	served := 0
+	for _, status := range statuses {
+		if status == http.StatusOK {
+			served++
+		}
+	}
+	if served != 1 {
+		t.Fatalf("%d of %d downloads served, want exactly 1 (statuses %v)", served, downloaders, statuses)
+	}
+
+	// The last allowed download removed the file right away
+	fm.mutex.RLock()
+	_, exists := fm.files[id]
+	fm.mutex.RUnlock()
+	if exists {
+		t.Fatal("file still registered after its last allowed download")
+	}
+}
+
+func TestRangedDownloadCountsOnce(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	content := make([]byte, 10<<20)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	put, _ := http.NewRequest("PUT", server.URL+"/upload/big.bin?max_downloads=2", bytes.NewReader(content))
+	status, uploaded := doJSON(t, put)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+
+	// The first range starts the download, the others resume it
+	var got []byte
+	third := len(content) / 3
+	for _, spec := range []string{
+		fmt.Sprintf("bytes=0-%d", third-1),
+		fmt.Sprintf("bytes=%d-%d", third, 2*third-1),
+		fmt.Sprintf("bytes=%d-", 2*third),
+	} {
+		req, _ := http.NewRequest("GET", server.URL+"/download/"+id, nil)
+		req.Header.Set("Range", spec)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Accept-Ranges") != "bytes" ||
+			resp.Header.Get("Content-Length") != strconv.Itoa(len(part)) {
+			t.Fatalf("%s: status %d, headers %v", spec, resp.StatusCode, resp.Header)
+		}
+		got = append(got, part...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("reassembled %d bytes differ from the %d uploaded", len(got), len(content))
+	}
+
+	if _, info := getJSON(t, server, "/info/"+id); info["downloads"] != 1.0 {
+		t.Errorf("downloads after three ranged requests = %v, want 1", info["downloads"])
+	}
+}
+
+func TestRangeStartsDownload(t *testing.T) {
+	const size = 100
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"", true},
+		{"bytes=0-", true},
+		{"bytes=0-9", true},
+		{"bytes=10-", false},
+		{"bytes=10-19", false},
+		{"bytes=-100", true},
+		{"bytes=-500", true},
+		{"bytes=-99", false},
+		{"bytes=5-,0-4", true},
+		{"bytes=50-59, 0-9", true},
+		{"bytes=10-19,30-39", false},
+		{"bytes=1-,1-", true}, // more than the file, served whole
+		{"bytes=200-", false},
+		{"bytes=x-y", false},
+		{"items=0-", false},
+	} {
+		if got := rangeStartsDownload(tc.header, size); got != tc.want {
+			t.Errorf("rangeStartsDownload(%q, %d) = %v, want %v", tc.header, size, got, tc.want)
+		}
+	}
+}
+
+// rangedGet fetches a file with the given Range, and If-Range when set.
+func rangedGet(t *testing.T, url, spec, ifRange string) (int, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Range", spec)
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+func TestRangesCoveringTheStartUseUpDownloads(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	for _, tc := range []struct{ name, spec, ifRange string }{
+		{"suffix", fmt.Sprintf("bytes=-%d", len(content)), ""},
+		{"longer suffix", "bytes=-1000", ""},
+		{"out of order", "bytes=5-,0-4", ""},
+		{"overlapping", "bytes=1-,1-", ""},
+		{"stale If-Range", "bytes=5-", `"stale"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fm, server := newTestServer(t, nil)
+			status, uploaded := uploadTestFile(t, server, "once.txt", content, url.Values{"max_downloads": {"1"}})
+			if status != http.StatusOK {
+				t.Fatalf("upload: status %d, body %v", status, uploaded)
+			}
+			id := uploaded["id"].(string)
+
+			if status, _ := rangedGet(t, server.URL+"/download/"+id, tc.spec, tc.ifRange); status != http.StatusOK && status != http.StatusPartialContent {
+				t.Fatalf("first download: status %d", status)
+			}
+			fm.mutex.RLock()
+			_, exists := fm.files[id]
+			fm.mutex.RUnlock()
+			if exists {
+				t.Error("file still registered after its only download")
+			}
+			if status, _ := rangedGet(t, server.URL+"/download/"+id, tc.spec, tc.ifRange); status == http.StatusOK || status == http.StatusPartialContent {
+				t.Errorf("second download: status %d, want it refused", status)
+			}
+		})
+	}
+}
+
+func TestResumedRangeNotCounted(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	content := []byte("0123456789abcdefghij")
+	status, uploaded := uploadTestFile(t, server, "resume.txt", content, url.Values{"max_downloads": {"2"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+
+	if status, body := rangedGet(t, server.URL+"/download/"+id, "bytes=0-9", ""); status != http.StatusPartialContent || string(body) != "0123456789" {
+		t.Fatalf("first part: status %d, body %q", status, body)
+	}
+	if status, body := rangedGet(t, server.URL+"/download/"+id, "bytes=10-", ""); status != http.StatusPartialContent || string(body) != "abcdefghij" {
+		t.Fatalf("second part: status %d, body %q", status, body)
+	}
+	if _, info := getJSON(t, server, "/info/"+id); info["downloads"] != 1.0 {
+		t.Errorf("downloads after a resumed download = %v, want 1", info["downloads"])
+	}
+}
+
+func TestDownloadExpiryHeaders(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	fetch := func(method, id string) http.Header {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+"/download/"+id, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: status %d", method, id, resp.StatusCode)
+		}
+		return resp.Header
+	}
+
+	status, uploaded := uploadTestFile(t, server, "limited.txt", []byte("three times"), url.Values{"max_downloads": {"3"}, "ttl": {"3600"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	limited := uploaded["id"].(string)
+
+	header := fetch("GET", limited)
+	if got := header.Get("X-Downloads-Remaining"); got != "2" {
+		t.Errorf("X-Downloads-Remaining after the first download %q, want 2", got)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, header.Get("X-Expires-At"))
+	if err != nil {
+		t.Fatalf("X-Expires-At %q: %v", header.Get("X-Expires-At"), err)
+	}
+	if until := time.Until(expiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("X-Expires-At is %v away, want about an hour", until)
+	}
+	if header.Get("X-Expiring-Soon") != "" || header.Get("Warning") != "" {
+		t.Error("a fresh file is reported as expiring soon")
+	}
+	// HEAD reports the same without using a download up
+	if got := fetch("HEAD", limited).Get("X-Downloads-Remaining"); got != "2" {
+		t.Errorf("X-Downloads-Remaining on HEAD %q, want 2", got)
+	}
+
+	status, uploaded = uploadTestFile(t, server, "open.txt", []byte("any number"), url.Values{"ttl": {"1000"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	open := uploaded["id"].(string)
+	if got := fetch("GET", open).Get("X-Downloads-Remaining"); got != "unlimited" {
+		t.Errorf("X-Downloads-Remaining without a limit %q, want unlimited", got)
+	}
+
+	// With less than expiry_warning_ratio (10%) of the TTL left
+	fm.mutex.Lock()
+	fm.files[open].UploadTime = time.Now().Add(-950 * time.Second)
+	fm.files[open].ExpiresAt = time.Now().Add(50 * time.Second)
+	fm.mutex.Unlock()
+	for _, method := range []string{"GET", "HEAD"} {
+		header := fetch(method, open)
+		if header.Get("X-Expiring-Soon") != "true" || !strings.HasPrefix(header.Get("Warning"), `299 - "File expires in`) {
+			t.Errorf("%s of a file about to expire: X-Expiring-Soon %q, Warning %q", method, header.Get("X-Expiring-Soon"), header.Get("Warning"))
+		}
+	}
+}
+
+func TestDeleteDuringSlowDownload(t *testing.T) {
+	for _, backend := range []string{"memory", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			fm := NewTestFileManager(nil)
+			stored := func() []string { return storedKeys(fm) }
+			if backend == "local" {
+				dir := t.TempDir()
+				fm.storage = localStorage{dir: dir}
+				stored = func() []string {
+					var files []string
+					filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+						if err == nil && !d.IsDir() {
+							files = append(files, path)
+						}
+						return err
+					})
+					return files
+				}
+			}
+			server := httptest.NewServer(fm.Handler())
+			t.Cleanup(func() {
+				server.Close()
+				fm.Close()
+			})
+
+			// Large enough that the response can't sit in socket buffers
+			content := testContent(16 << 20)
+			status, uploaded := uploadTestFile(t, server, "big.bin", content, nil)
+			if status != http.StatusOK {
+				t.Fatalf("upload: status %d, body %v", status, uploaded)
+			}
+			id := uploaded["id"].(string)
+
+			resp, err := http.Get(server.URL + "/download/" + id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			head := make([]byte, 64<<10)
+			if _, err := io.ReadFull(resp.Body, head); err != nil {
+				t.Fatal(err)
+			}
+
+			req, _ := http.NewRequest("POST", server.URL+"/delete/"+id, nil)
+			if status, body := doJSON(t, req); status != http.StatusOK {
+				t.Fatalf("delete: status %d, body %v", status, body)
+			}
+
+			// New requests learn it was deleted, not that it never existed
+			for _, path := range []string{"/download/", "/info/"} {
+				status, body := getJSON(t, server, path+id)
+				if status != http.StatusGone || body["code"] != "file_deleted" || body["hint"] == "" {
+					t.Errorf("%s after the delete: status %d, body %v, want 410 file_deleted with a hint", path, status, body)
+				}
+			}
+
+			// The download in flight still gets every byte
+			rest, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("reading the rest of the download: %v", err)
+			}
+			if !bytes.Equal(append(head, rest...), content) {
+				t.Fatalf("download in flight got %d bytes, not the original %d", len(head)+len(rest), len(content))
+			}
+			if keys := stored(); len(keys) != 0 {
+				t.Errorf("content still stored after the delete: %v", keys)
+			}
+		})
+	}
+}
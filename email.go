@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var errEmailNotConfigured = errors.New("notify_email needs smtp_host to be configured")
+
+// Email delivery states, also the outcomes of "email" activity events.
+const (
+	emailQueued      = "queued"
+	emailSent        = "sent"
+	emailFailed      = "failed"
+	emailRateLimited = "rate_limited"
+)
+
+// emailRetryDelays are the waits between delivery attempts; a message is
+// given up after one more attempt than there are delays.
+var emailRetryDelays = []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour}
+
+// sendMail is smtp.SendMail, which uses STARTTLS when the server offers it.
+var sendMail = smtp.SendMail
+
+// EmailDelivery is the state of the notification email for one upload. It is
+// kept in memory only, like the queue itself.
+type EmailDelivery struct {
+	Recipient string    `json:"recipient"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+type emailMessage struct {
+	fileID   string
+	filename string
+	actor    string
+	to       string
+	data     []byte
+}
+
+// emailQueue sends upload notifications in the background, so a slow or
+// unreachable SMTP server never holds up or fails an upload.
+type emailQueue struct {
+	once    sync.Once
+	pending chan *emailMessage
+
+	mutex      sync.Mutex
+	deliveries map[string]*EmailDelivery // by file ID
+	window     time.Time                 // current hour of the rate limit
+	counts     map[string]int            // emails per uploader in window
+}
+
+var uploadEmailTemplate = template.Must(template.New("email").Parse(`{{.Filename}} was uploaded and can be downloaded from:
+
+{{.URL}}
+
+Size:     {{.Size}}
+Expires:  {{.Expires}}
+Checksum: {{.Checksum}}
+{{if .Protected}}
+The download needs the password set when the file was uploaded.
+{{end}}`))
+
+// parseNotifyEmail checks the notify_email form value and returns the bare
+// address.
+func (fm *FileManager) parseNotifyEmail(raw string) (string, error) {
+	if fm.config().SMTPHost == "" {
+		return "", errEmailNotConfigured
+	}
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || strings.ContainsAny(addr.Address, "\r\n") {
+		return "", fmt.Errorf("invalid notify_email %q", raw)
+	}
+	return addr.Address, nil
+}
+
+// allowEmail counts an email for uploader and reports whether it is within
+// email_rate_limit for the current hour.
+func (q *emailQueue) allowEmail(uploader string, limit int, now time.Time) bool {
+	if limit <= 0 {
+		return true
+	}
+	window := now.Truncate(time.Hour)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !window.Equal(q.window) || q.counts == nil {
+		q.window = window
+		q.counts = make(map[string]int)
+	}
+	if q.counts[uploader] >= limit {
+		return false
+	}
+	q.counts[uploader]++
+	return true
+}
+
+func (q *emailQueue) setDelivery(fileID string, update func(*EmailDelivery)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.deliveries == nil {
+		q.deliveries = make(map[string]*EmailDelivery)
+	}
+	delivery := q.deliveries[fileID]
+	if delivery == nil {
+		delivery = &EmailDelivery{}
+		q.deliveries[fileID] = delivery
+	}
+	update(delivery)
+	delivery.Updated = time.Now()
+}
+
+// delivery returns a copy of the delivery state of fileID, or nil.
+func (q *emailQueue) delivery(fileID string) *EmailDelivery {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if delivery, exists := q.deliveries[fileID]; exists {
+		copied := *delivery
+		return &copied
+	}
+	return nil
+}
+
+// queueUploadEmail sends the upload's landing page link to the notify_email
+// given with it, along with its expiry, size and checksum but never the
+// password. event is upload or file_request_upload, whose templates in
+// notification_template_dir replace the built-in wording, and details are
+// what the webhook gets for it. Uploaders are limited to email_rate_limit
+// emails an hour.
+func (fm *FileManager) queueUploadEmail(r *http.Request, event string, fileInfo *FileInfo, details map[string]interface{}, req uploadRequest) {
+	if req.NotifyEmail == "" {
+		return
+	}
+	q := &fm.emails
+	uploader := fm.uploaderIdentity(r, req)
+	if !q.allowEmail(uploader, fm.config().EmailRateLimit, time.Now()) {
+		log.Printf("Not emailing the link to %s for %s: rate limit reached for %s", req.NotifyEmail, fileInfo.ID, uploader)
+		q.setDelivery(fileInfo.ID, func(d *EmailDelivery) {
+			d.Recipient, d.Status = req.NotifyEmail, emailRateLimited
+		})
+		fm.recordEvent(r, "email", fileInfo, fileInfo.ID, emailRateLimited)
+		return
+	}
+
+	fm.mutex.RLock()
+	content := newNotificationData(event, fileInfo, details, "")
+	fm.mutex.RUnlock()
+	content.URL = fm.landingURL(r, fileInfo.ID)
+	email, _ := fm.renderNotification(r, fm.customNotification(event), &builtinUploadEmail, content)
+	config := fm.config()
+	var data bytes.Buffer
+	fmt.Fprintf(&data, "From: %s\r\n", config.SMTPFrom)
+	fmt.Fprintf(&data, "To: %s\r\n", req.NotifyEmail)
+	fmt.Fprintf(&data, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&data, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	data.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	data.WriteString(strings.ReplaceAll(email.Body, "\n", "\r\n"))
+
+	message := &emailMessage{
+		fileID:   fileInfo.ID,
+		filename: fileInfo.OriginalName,
+		actor:    fm.clientIP(r),
+		to:       req.NotifyEmail,
+		data:     data.Bytes(),
+	}
+	q.once.Do(func() {
+		q.pending = make(chan *emailMessage, 1000)
+		go fm.runEmailQueue()
+	})
+	select {
+	case q.pending <- message:
+		q.setDelivery(fileInfo.ID, func(d *EmailDelivery) {
+			d.Recipient, d.Status = req.NotifyEmail, emailQueued
+		})
+	default:
+		q.setDelivery(fileInfo.ID, func(d *EmailDelivery) {
+			d.Recipient, d.Status, d.LastError = req.NotifyEmail, emailFailed, "email queue full"
+		})
+		fm.recordEvent(r, "email", fileInfo, fileInfo.ID, emailFailed)
+	}
+}
+
+// runEmailQueue sends queued messages one at a time, scheduling failed ones
+// for another attempt after the next of emailRetryDelays.
+func (fm *FileManager) runEmailQueue() {
+	q := &fm.emails
+	for message := range q.pending {
+		err := fm.sendEmail(message)
+		var attempts int
+		q.setDelivery(message.fileID, func(d *EmailDelivery) {
+			d.Attempts++
+			attempts = d.Attempts
+			if err == nil {
+				d.Status, d.LastError = emailSent, ""
+			} else {
+				d.LastError = err.Error()
+			}
+		})
+		switch {
+		case err == nil:
+			fm.activity.record(ActivityEvent{Type: "email", FileID: message.fileID, Filename: message.filename, Actor: message.actor, Outcome: emailSent})
+		case attempts <= len(emailRetryDelays):
+			log.Printf("Error emailing %s about %s, retrying: %v", message.to, message.fileID, err)
+			time.AfterFunc(emailRetryDelays[attempts-1], func() { q.pending <- message })
+		default:
+			log.Printf("Giving up emailing %s about %s after %d attempts: %v", message.to, message.fileID, attempts, err)
+			q.setDelivery(message.fileID, func(d *EmailDelivery) { d.Status = emailFailed })
+			fm.activity.record(ActivityEvent{Type: "email", FileID: message.fileID, Filename: message.filename, Actor: message.actor, Outcome: emailFailed})
+		}
+	}
+}
+
+func (fm *FileManager) sendEmail(message *emailMessage) error {
+	config := fm.config()
+	from, err := mail.ParseAddress(config.SMTPFrom)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, config.SMTPHost)
+	}
+	addr := net.JoinHostPort(config.SMTPHost, strconv.Itoa(config.SMTPPort))
+	return sendMail(addr, auth, from.Address, []string{message.to}, message.data)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ActivityEvent is one entry of the activity timeline.
+type ActivityEvent struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"` // upload, download, delete, expire, email, ...
+	FileID    string    `json:"file_id"`
+	Filename  string    `json:"filename,omitempty"`
+	Actor     string    `json:"actor,omitempty"` // client IP, when known
+	User      string    `json:"user,omitempty"`  // admin username, when signed in
+	UserAgent string    `json:"user_agent,omitempty"`
+	Bot       bool      `json:"bot,omitempty"`
+	Outcome   string    `json:"outcome"`
+}
+
+const activityCapacity = 10000
+
+var botUserAgent = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|facebookexternalhit|preview`)
+
+// activityLog is the event bus behind the activity timeline: it keeps the
+// most recent events for queries and fans new ones out to live subscribers,
+// so the stream and the query endpoint always agree.
+type activityLog struct {
+	mutex       sync.Mutex
+	events      []ActivityEvent // oldest first
+	lastID      int64
+	dirty       bool
+	subscribers map[chan ActivityEvent]struct{}
+	closed      chan struct{} // closed by closeStreams, see streamsClosed
+}
+
+func (a *activityLog) record(event ActivityEvent) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.lastID++
+	event.ID = a.lastID
+	event.Time = time.Now()
+	a.events = append(a.events, event)
+	if len(a.events) > activityCapacity {
+		a.events = a.events[len(a.events)-activityCapacity:]
+	}
+	a.dirty = true
+
+	for ch := range a.subscribers {
+		select {
+		case ch <- event:
+		default: // slow subscribers miss events rather than stall the server
+		}
+	}
+}
+
+func (a *activityLog) subscribe() chan ActivityEvent {
+	ch := make(chan ActivityEvent, 64)
+	a.mutex.Lock()
+	if a.subscribers == nil {
+		a.subscribers = make(map[chan ActivityEvent]struct{})
+	}
+	a.subscribers[ch] = struct{}{}
+	a.mutex.Unlock()
+	return ch
+}
+
+func (a *activityLog) unsubscribe(ch chan ActivityEvent) {
+	a.mutex.Lock()
+	delete(a.subscribers, ch)
+	a.mutex.Unlock()
+}
+
+// streamsClosed is closed once closeStreams ends the live streams.
+func (a *activityLog) streamsClosed() <-chan struct{} {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.closed == nil {
+		a.closed = make(chan struct{})
+	}
+	return a.closed
+}
+
+// closeStreams ends the live streams, so a graceful shutdown doesn't wait
+// shutdown_timeout for connections that never finish on their own.
+func (a *activityLog) closeStreams() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.closed == nil {
+		a.closed = make(chan struct{})
+	}
+	select {
+	case <-a.closed:
+	default:
+		close(a.closed)
+	}
+}
+
+// activityFilter selects events for queries and streams. Zero fields match
+// everything.
+type activityFilter struct {
+	Since, Until time.Time
+	Type         string
+	After        int64
+	ExcludeBots  bool
+}
+
+func (f activityFilter) matches(e ActivityEvent) bool {
+	return e.ID > f.After &&
+		(f.Type == "" || e.Type == f.Type) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until)) &&
+		!(f.ExcludeBots && e.Bot)
+}
+
+// query returns up to limit matching events in chronological order.
+func (a *activityLog) query(filter activityFilter, limit int) []ActivityEvent {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	events := []ActivityEvent{}
+	for _, e := range a.events {
+		if filter.matches(e) {
+			events = append(events, e)
+			if len(events) == limit {
+				break
+			}
+		}
+	}
+	return events
+}
+
+// latest returns the n most recent events, newest first.
+func (a *activityLog) latest(n int) []ActivityEvent {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	events := make([]ActivityEvent, 0, n)
+	for i := len(a.events) - 1; i >= 0 && len(events) < n; i-- {
+		events = append(events, a.events[i])
+	}
+	return events
+}
+
+func (fm *FileManager) activityFile() string {
+	return fm.config().MetadataFile + ".activity"
+}
+
+func (fm *FileManager) loadActivity() {
+	data, err := fm.metadata.ReadFile(fm.activityFile())
+	if err != nil {
+		return
+	}
+	var events []ActivityEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		log.Printf("Error loading activity log: %v", err)
+		return
+	}
+
+	a := &fm.activity
+	a.mutex.Lock()
+	a.events = events
+	if len(events) > 0 {
+		a.lastID = events[len(events)-1].ID
+	}
+	a.mutex.Unlock()
+}
+
+// saveActivity writes the timeline if it changed since the last save.
+func (fm *FileManager) saveActivity() {
+	a := &fm.activity
+	a.mutex.Lock()
+	if !a.dirty {
+		a.mutex.Unlock()
+		return
+	}
+	data, err := json.Marshal(a.events)
+	a.dirty = false
+	a.mutex.Unlock()
+	if err != nil {
+		log.Printf("Error encoding activity log: %v", err)
+		return
+	}
+	if err := fm.metadata.WriteFile(fm.activityFile(), data, 0644); err != nil {
+		log.Printf("Error saving activity log: %v", err)
+	}
+}
+
+// recordEvent adds an event for a request, filling in the actor from r.
+func (fm *FileManager) recordEvent(r *http.Request, eventType string, fileInfo *FileInfo, fileID, outcome string) {
+	event := ActivityEvent{Type: eventType, FileID: fileID, Outcome: outcome}
+	if fileInfo != nil {
+		event.Filename = fileInfo.OriginalName
+	}
+	if r != nil {
+		event.Actor = fm.clientIP(r)
+		if admin := fm.authenticateAdmin(r); admin != nil {
+			event.User = admin.Username
+		}
+		event.UserAgent = r.UserAgent()
+		event.Bot = botUserAgent.MatchString(event.UserAgent)
+	}
+	fm.activity.record(event)
+}
+
+func parseActivityFilter(r *http.Request) (activityFilter, error) {
+	query := r.URL.Query()
+	filter := activityFilter{
+		Type:        query.Get("type"),
+		ExcludeBots: query.Get("exclude_bots") == "true",
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC3339 time", name)
+			}
+			*t = parsed
+		}
+	}
+	if value := query.Get("after"); value != "" {
+		after, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("after must be an event ID")
+		}
+		filter.After = after
+	}
+	return filter, nil
+}
+
+// listActivity serves the timeline. Pages are chained by passing the last
+// event ID of a page as after=.
+func (fm *FileManager) listActivity(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseActivityFilter(r)
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := pageLimit(r)
+	events := fm.activity.query(filter, limit)
+
+	response := map[string]interface{}{"events": events}
+	if len(events) == limit {
+		response["next_after"] = events[len(events)-1].ID
+	}
+	respondJSON(w, http.StatusOK, response)
+}
+
+// streamActivity sends new events as server-sent events until the client
+// disconnects.
+func (fm *FileManager) streamActivity(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseActivityFilter(r)
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, r, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := fm.activity.subscribe()
+	defer fm.activity.unsubscribe(events)
+	closed := fm.activity.streamsClosed()
+
+	// The stream stays open far longer than write_timeout
+	keepWriting(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-closed:
+			return
+		case event := <-events:
+			if !filter.matches(event) {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// downloadOutcome names the reason a download was refused.
+func downloadOutcome(err error) string {
+	switch err {
+	case errFileNotFound:
+		return "not_found"
+	case errFileGone:
+		return "gone"
+	case errPasswordRequired:
+		return "password_required"
+	case errPasswordIncorrect:
+		return "password_incorrect"
+	case errTagPasswordRequired:
+		return "tag_password_required"
+	case errFileExpired:
+		return "expired"
+	case errDownloadLimit:
+		return "limit_reached"
+	case errRecipientRequired:
+		return "recipient_required"
+	case errRecipientCollected:
+		return "recipient_collected"
+	case errIntegrity:
+		return "integrity_error"
+	}
+	return "error"
+}
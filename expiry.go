@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // expiry_timezone works without a zone database installed
+)
+
+// How a file's expiry was determined, recorded as ttl_source.
+const (
+	ttlExplicit = "explicit" // the ttl sent with the upload
+	ttlDefault  = "default"  // default_ttl, as no ttl was sent
+	ttlExtended = "extended" // moved by an admin since the upload
+)
+
+var errInvalidTTL = errors.New("ttl must be a whole number of seconds")
+
+// ttlResolution is an upload's TTL and where it came from.
+type ttlResolution struct {
+	TTL    time.Duration
+	Source string
+}
+
+// resolveTTL works out an upload's TTL from its ttl field, in seconds. Only
+// an empty field gets defaultTTL; anything else that isn't a number of
+// seconds is refused rather than quietly replaced by the default.
+func resolveTTL(raw string, defaultTTL time.Duration) (ttlResolution, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ttlResolution{defaultTTL, ttlDefault}, nil
+	}
+	seconds, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || seconds < 0 || seconds > math.MaxInt64/int64(time.Second) {
+		return ttlResolution{}, errInvalidTTL
+	}
+	return ttlResolution{time.Duration(seconds) * time.Second, ttlExplicit}, nil
+}
+
+var (
+	errInvalidExpiry = errors.New("expires_at must be a date such as 2025-03-31 or an RFC 3339 time")
+	errExpiryPast    = errors.New("expires_at is in the past")
+	errTTLAndExpiry  = errors.New("send either ttl or expires_at, not both")
+)
+
+// Layouts accepted for expires_at besides RFC 3339.
+const (
+	expiryDate     = "2006-01-02"
+	expiryDateTime = "2006-01-02T15:04:05"
+)
+
+// parseExpiresAt reads an absolute expiry. A date means the end of that day
+// and a time without an offset that time of day, both in loc; RFC 3339
+// times carry their own offset. The result is in UTC.
+func parseExpiresAt(raw string, loc *time.Location, now time.Time) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	expiresAt, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		expiresAt, err = time.ParseInLocation(expiryDateTime, raw, loc)
+	}
+	if err != nil {
+		day, dateErr := time.ParseInLocation(expiryDate, raw, loc)
+		if dateErr != nil {
+			return time.Time{}, errInvalidExpiry
+		}
+		// Built from the date rather than added to midnight, so days that
+		// are 23 or 25 hours long across a DST change still end at 23:59:59
+		expiresAt = time.Date(day.Year(), day.Month(), day.Day(), 23, 59, 59, int(999*time.Millisecond), loc)
+	}
+	if !expiresAt.After(now) {
+		return time.Time{}, errExpiryPast
+	}
+	return expiresAt.UTC(), nil
+}
+
+// resolveExpiresAt applies an upload's expires_at field to its ttl, as
+// resolved by resolveTTL, and returns the expiry it names, or the zero time
+// when none was sent. Only one of the two may be sent.
+func (fm *FileManager) resolveExpiresAt(raw string, ttl *ttlResolution) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if ttl.Source == ttlExplicit {
+		return time.Time{}, errTTLAndExpiry
+	}
+	expiresAt, err := parseExpiresAt(raw, fm.expiryLocation(), time.Now())
+	if err != nil {
+		return time.Time{}, err
+	}
+	ttl.TTL, ttl.Source = time.Until(expiresAt), ttlExplicit
+	return expiresAt, nil
+}
+
+// locations caches the zones loaded by loadLocation, by name.
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// expiryLocation returns expiry_timezone, in which date-only expiries are
+// read and expiry times are shown.
+func (fm *FileManager) expiryLocation() *time.Location {
+	if fm == nil {
+		return time.UTC
+	}
+	loc, err := loadLocation(fm.config().ExpiryTimezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// formatExpiry shows t in loc with the zone named, e.g.
+// "2025-03-31 23:59:59 CEST".
+func formatExpiry(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("2006-01-02 15:04:05 MST")
+}
+
+// writeExpiryHeaders tells clients how much longer a file stays available,
+// so automation doesn't need a separate /info call. X-Expiring-Soon is set
+// once less than expiry_warning_ratio of the file's TTL remains.
+func (fm *FileManager) writeExpiryHeaders(w http.ResponseWriter, fileInfo *FileInfo) {
+	fm.mutex.RLock()
+	expiresAt := fileInfo.ExpiresAt
+	ttl := fileInfo.ExpiresAt.Sub(fileInfo.UploadTime)
+	remaining := "unlimited"
+	if fileInfo.hasRecipients() {
+		remaining = strconv.Itoa(len(fileInfo.Recipients) - fileInfo.collectedCount())
+	} else if fileInfo.MaxDownloads > 0 {
+		remaining = strconv.Itoa(max(fileInfo.MaxDownloads-fileInfo.Downloads, 0))
+	}
+	fm.mutex.RUnlock()
+
+	w.Header().Set("X-Expires-At", expiresAt.Format(time.RFC3339))
+	w.Header().Set("X-Downloads-Remaining", remaining)
+
+	left := time.Until(expiresAt)
+	if ttl > 0 && float64(left) < float64(ttl)*fm.config().ExpiryWarningRatio {
+		w.Header().Set("X-Expiring-Soon", "true")
+		w.Header().Set("Warning", `299 - "File expires in `+humanizeDuration(left)+`"`)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpiresAtAcrossDST(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		zone, raw string
+		want      string // UTC, RFC 3339
+		shown     string // formatExpiry in the zone
+	}{
+		{"UTC", "2025-03-31", "2025-03-31T23:59:59.999Z", "2025-03-31 23:59:59 UTC"},
+		{"Europe/Berlin", "2025-03-29", "2025-03-29T22:59:59.999Z", "2025-03-29 23:59:59 CET"},
+		{"Europe/Berlin", "2025-03-30", "2025-03-30T21:59:59.999Z", "2025-03-30 23:59:59 CEST"}, // 23 hours long
+		{"Europe/Berlin", "2025-10-26", "2025-10-26T22:59:59.999Z", "2025-10-26 23:59:59 CET"},  // 25 hours long
+		{"America/New_York", "2025-03-09", "2025-03-10T03:59:59.999Z", "2025-03-09 23:59:59 EDT"},
+		{"America/New_York", "2025-11-02", "2025-11-03T04:59:59.999Z", "2025-11-02 23:59:59 EST"},
+		{"Australia/Sydney", "2025-04-06", "2025-04-06T13:59:59.999Z", "2025-04-06 23:59:59 AEST"},
+		{"Australia/Sydney", "2025-10-05", "2025-10-05T12:59:59.999Z", "2025-10-05 23:59:59 AEDT"},
+		{"Asia/Kolkata", "2025-03-31", "2025-03-31T18:29:59.999Z", "2025-03-31 23:59:59 IST"},
+		{"Europe/Berlin", "2025-07-01T18:00:00", "2025-07-01T16:00:00Z", "2025-07-01 18:00:00 CEST"},
+		{"Europe/Berlin", "2025-07-01T18:00:00+05:00", "2025-07-01T13:00:00Z", "2025-07-01 15:00:00 CEST"}, // the offset wins
+	} {
+		loc, err := loadLocation(tc.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseExpiresAt(tc.raw, loc, now)
+		if err != nil || got.Format(time.RFC3339Nano) != tc.want || got.Location() != time.UTC {
+			t.Errorf("%s in %s: %v, %v; want %s", tc.raw, tc.zone, got, err, tc.want)
+			continue
+		}
+		if shown := formatExpiry(got, loc); shown != tc.shown {
+			t.Errorf("%s in %s shown as %q, want %q", tc.raw, tc.zone, shown, tc.shown)
+		}
+	}
+
+	// The last day of 2024 is over in UTC, but not yet in New York
+	newYork, _ := loadLocation("America/New_York")
+	for _, tc := range []struct {
+		raw  string
+		loc  *time.Location
+		want error
+	}{
+		{"2025-02-30", time.UTC, errInvalidExpiry},
+		{"tomorrow", time.UTC, errInvalidExpiry},
+		{"31/03/2025", time.UTC, errInvalidExpiry},
+		{"2024-12-31", time.UTC, errExpiryPast},
+		{"2024-12-31", newYork, nil},
+	} {
+		if _, err := parseExpiresAt(tc.raw, tc.loc, now); !errors.Is(err, tc.want) {
+			t.Errorf("%s in %s: %v, want %v", tc.raw, tc.loc, err, tc.want)
+		}
+	}
+}
+
+func TestExpiresAtUpload(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) { c.ExpiryTimezone = "Europe/Berlin" })
+	berlin, _ := loadLocation("Europe/Berlin")
+	year := time.Now().Year() + 1
+	want := time.Date(year, 6, 15, 23, 59, 59, int(999*time.Millisecond), berlin).UTC()
+
+	status, body := uploadTestFile(t, server, "a.txt", []byte("content"), url.Values{"expires_at": {fmt.Sprintf("%d-06-15", year)}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+
+	// Stored and returned in UTC, shown in expiry_timezone with the zone named
+	_, info := getJSON(t, server, "/info/"+id)
+	if info["expires_at"] != want.Format(time.RFC3339Nano) || info["ttl_source"] != ttlExplicit {
+		t.Errorf("info: expires_at %v, ttl_source %v, want %s", info["expires_at"], info["ttl_source"], want.Format(time.RFC3339Nano))
+	}
+	shown := fmt.Sprintf("%d-06-15 23:59:59 CEST", year)
+	for _, page := range []string{"/f/" + id, "/manage", "/admin/files/" + id} {
+		resp, err := http.Get(server.URL + page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		html, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(html), shown) {
+			t.Errorf("%s doesn't show the expiry as %s", page, shown)
+		}
+	}
+
+	for _, fields := range []url.Values{
+		{"expires_at": {"2020-01-01"}},
+		{"expires_at": {"next week"}},
+		{"expires_at": {fmt.Sprintf("%d-06-15", year)}, "ttl": {"3600"}},
+	} {
+		if status, body := uploadTestFile(t, server, "a.txt", []byte("content"), fields); status != http.StatusBadRequest {
+			t.Errorf("upload with %v: status %d, body %v, want 400", fields, status, body)
+		}
+	}
+}
+
+func TestExpiryTimezoneValidated(t *testing.T) {
+	config := defaultConfig()
+	config.ExpiryTimezone = "Mars/Olympus_Mons"
+	if err := config.Validate(); err == nil {
+		t.Error("unknown expiry_timezone accepted")
+	}
+}
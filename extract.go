@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Standard metadata keys filled in from the content of recognized files.
+// Extraction only reads headers (plus a bounded prefix and suffix of PDFs),
+// so it stays cheap for large uploads.
+const (
+	metaWidth           = "width"
+	metaHeight          = "height"
+	metaCapturedAt      = "captured_at"
+	metaPages           = "pages"
+	metaTitle           = "title"
+	metaDurationSeconds = "duration_seconds"
+)
+
+const (
+	pdfHeadScan = 8 << 20
+	pdfTailScan = 1 << 20
+	headerScan  = 1 << 20
+)
+
+var errMalformed = errors.New("malformed header")
+
+// extractMetadata adds intrinsic properties of the uploaded content to
+// metadata, never overwriting values the client supplied. Failures are only
+// logged. With strip_exif_location on, GPS data is also blanked out of JPEG
+// files in place, and extractMetadata reports whether it did so.
+func (fm *FileManager) extractMetadata(f File, metadata map[string]string) (rewritten bool) {
+	head := make([]byte, 512)
+	n, _ := f.ReadAt(head, 0)
+
+	var props map[string]string
+	var err error
+	switch http.DetectContentType(head[:n]) {
+	case "image/jpeg":
+		props, rewritten, err = extractJPEG(f, fm.config().StripExifLocation)
+	case "image/png", "image/gif":
+		props, err = extractImageSize(f)
+	case "application/pdf":
+		props, err = extractPDF(f)
+	case "audio/wave":
+		props, err = extractWAV(f)
+	case "video/mp4":
+		props, err = extractMP4(f)
+	}
+	if err != nil {
+		log.Printf("Skipping metadata extraction for %s: %v", f.Name(), err)
+	}
+
+	for key, value := range props {
+		if _, set := metadata[key]; !set {
+			metadata[key] = value
+		}
+	}
+	return rewritten
+}
+
+func extractImageSize(f File) (map[string]string, error) {
+	config, _, err := image.DecodeConfig(io.NewSectionReader(f, 0, math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		metaWidth:  strconv.Itoa(config.Width),
+		metaHeight: strconv.Itoa(config.Height),
+	}, nil
+}
+
+// extractJPEG also reports whether it wrote to f to strip the location.
+func extractJPEG(f File, stripLocation bool) (map[string]string, bool, error) {
+	props, err := extractImageSize(f)
+	if err != nil {
+		return nil, false, err
+	}
+
+	offset, exif, err := findExif(f)
+	if err != nil || exif == nil {
+		return props, false, err
+	}
+	capturedAt, stripped, err := parseExif(exif, stripLocation)
+	if err != nil {
+		return props, false, err
+	}
+	if capturedAt != "" {
+		props[metaCapturedAt] = capturedAt
+	}
+	if stripped {
+		if _, err := f.WriteAt(exif, offset); err != nil {
+			return props, true, err
+		}
+	}
+	return props, stripped, nil
+}
+
+// findExif locates the TIFF structure of a JPEG's Exif segment, returning its
+// file offset and content, or nil if there is none.
+func findExif(f File) (int64, []byte, error) {
+	r := io.NewSectionReader(f, 0, headerScan)
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return 0, nil, errMalformed
+	}
+
+	pos := int64(2)
+	for {
+		var marker [4]byte
+		if _, err := r.ReadAt(marker[:], pos); err != nil {
+			return 0, nil, nil
+		}
+		if marker[0] != 0xFF || marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 0, nil, nil // start of image data: no Exif
+		}
+		length := int64(binary.BigEndian.Uint16(marker[2:]))
+		if length < 2 {
+			return 0, nil, errMalformed
+		}
+		if marker[1] == 0xE1 && length > 8 {
+			segment := make([]byte, length-2)
+			if _, err := r.ReadAt(segment, pos+4); err != nil {
+				return 0, nil, errMalformed
+			}
+			if tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+				return pos + 4 + 6, tiff, nil
+			}
+		}
+		pos += 2 + length
+	}
+}
+
+// tiff reads IFD entries out of an Exif TIFF structure.
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	tag   uint16
+	data  []byte // the entry's value, inline or referenced
+	value uint32 // raw value field, the offset for pointer tags
+}
+
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func (t tiff) ifd(offset uint32) ([]tiffEntry, error) {
+	start := int(offset)
+	if start+2 > len(t.b) {
+		return nil, errMalformed
+	}
+	count := int(t.order.Uint16(t.b[start:]))
+	if start+2+count*12 > len(t.b) {
+		return nil, errMalformed
+	}
+
+	entries := make([]tiffEntry, 0, count)
+	for i := 0; i < count; i++ {
+		raw := t.b[start+2+i*12:]
+		entry := tiffEntry{tag: t.order.Uint16(raw), value: t.order.Uint32(raw[8:])}
+		size := tiffTypeSizes[t.order.Uint16(raw[2:])] * int(t.order.Uint32(raw[4:]))
+		switch {
+		case size <= 4:
+			entry.data = raw[8 : 8+size]
+		case int(entry.value)+size <= len(t.b):
+			entry.data = t.b[entry.value : int(entry.value)+size]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// parseExif returns the DateTimeOriginal of an Exif block in RFC 3339 form
+// without zone, as Exif records local time. With stripLocation it zeroes
+// every GPS value in place and reports whether there were any.
+func parseExif(b []byte, stripLocation bool) (string, bool, error) {
+	if len(b) < 8 {
+		return "", false, errMalformed
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return "", false, errMalformed
+	}
+
+	ifd0, err := t.ifd(t.order.Uint32(b[4:]))
+	if err != nil {
+		return "", false, err
+	}
+
+	var capturedAt string
+	stripped := false
+	for _, entry := range ifd0 {
+		switch entry.tag {
+		case 0x8769: // Exif sub-IFD
+			sub, err := t.ifd(entry.value)
+			if err != nil {
+				continue
+			}
+			for _, e := range sub {
+				if e.tag != 0x9003 { // DateTimeOriginal
+					continue
+				}
+				raw := strings.TrimRight(string(e.data), "\x00 ")
+				if taken, err := time.Parse("2006:01:02 15:04:05", raw); err == nil {
+					capturedAt = taken.Format("2006-01-02T15:04:05")
+				}
+			}
+		case 0x8825: // GPS IFD
+			if !stripLocation {
+				continue
+			}
+			gps, err := t.ifd(entry.value)
+			if err != nil {
+				continue
+			}
+			for _, e := range gps {
+				clear(e.data)
+				stripped = true
+			}
+		}
+	}
+	return capturedAt, stripped, nil
+}
+
+var (
+	pdfCount = regexp.MustCompile(`/Count\s+(\d+)`)
+	pdfTitle = regexp.MustCompile(`/Title\s*\(((?:\\.|[^\\)])*)\)`)
+)
+
+// extractPDF reads the page count from the page tree and the document title
+// from the info dictionary. Only the start and end of the file are scanned,
+// where these normally live; compressed object streams are not decoded.
+func extractPDF(f File) (map[string]string, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, min(stat.Size(), pdfHeadScan))
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if stat.Size() > pdfHeadScan {
+		tail := make([]byte, min(stat.Size()-pdfHeadScan, pdfTailScan))
+		if _, err := f.ReadAt(tail, stat.Size()-int64(len(tail))); err != nil && err != io.EOF {
+			return nil, err
+		}
+		data = append(data, tail...)
+	}
+
+	props := make(map[string]string)
+	if bytes.Contains(data, []byte("/Pages")) {
+		pages := 0
+		for _, m := range pdfCount.FindAllSubmatch(data, -1) {
+			if n, err := strconv.Atoi(string(m[1])); err == nil && n > pages {
+				pages = n
+			}
+		}
+		if pages > 0 {
+			props[metaPages] = strconv.Itoa(pages)
+		}
+	}
+	if m := pdfTitle.FindSubmatch(data); m != nil {
+		if title := pdfUnescape(m[1]); title != "" && utf8.ValidString(title) {
+			props[metaTitle] = title
+		}
+	}
+	return props, nil
+}
+
+// pdfUnescape decodes the common escapes of a PDF literal string.
+func pdfUnescape(s []byte) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r', '\n':
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// extractWAV computes the duration from the fmt chunk's byte rate and the
+// size of the data chunk.
+func extractWAV(f File) (map[string]string, error) {
+	r := io.NewSectionReader(f, 0, headerScan)
+	var byteRate, dataSize uint32
+	for pos := int64(12); byteRate == 0 || dataSize == 0; {
+		var header [8]byte
+		if _, err := r.ReadAt(header[:], pos); err != nil {
+			return nil, errMalformed
+		}
+		size := binary.LittleEndian.Uint32(header[4:])
+		switch string(header[:4]) {
+		case "fmt ":
+			var fmtChunk [12]byte
+			if _, err := r.ReadAt(fmtChunk[:], pos+8); err != nil {
+				return nil, errMalformed
+			}
+			byteRate = binary.LittleEndian.Uint32(fmtChunk[8:])
+		case "data":
+			dataSize = size
+		}
+		pos += 8 + int64(size) + int64(size%2)
+	}
+	return map[string]string{
+		metaDurationSeconds: formatSeconds(float64(dataSize) / float64(byteRate)),
+	}, nil
+}
+
+// extractMP4 reads the duration from the movie header box, walking box
+// headers only.
+func extractMP4(f File) (map[string]string, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	moov, moovSize, err := findBox(f, 0, stat.Size(), "moov")
+	if err != nil {
+		return nil, err
+	}
+	mvhd, _, err := findBox(f, moov, moovSize, "mvhd")
+	if err != nil {
+		return nil, err
+	}
+
+	var header [32]byte
+	if _, err := f.ReadAt(header[:], mvhd); err != nil {
+		return nil, errMalformed
+	}
+	var timescale uint32
+	var duration uint64
+	if header[0] == 1 {
+		timescale = binary.BigEndian.Uint32(header[20:])
+		duration = binary.BigEndian.Uint64(header[24:])
+	} else {
+		timescale = binary.BigEndian.Uint32(header[12:])
+		duration = uint64(binary.BigEndian.Uint32(header[16:]))
+	}
+	if timescale == 0 {
+		return nil, errMalformed
+	}
+	return map[string]string{
+		metaDurationSeconds: formatSeconds(float64(duration) / float64(timescale)),
+	}, nil
+}
+
+// findBox returns the content offset and size of the first box of the given
+// type among the boxes in [start, start+size).
+func findBox(f File, start, size int64, boxType string) (int64, int64, error) {
+	for pos, end := start, start+size; pos+8 <= end; {
+		var header [16]byte
+		if _, err := f.ReadAt(header[:8], pos); err != nil {
+			return 0, 0, errMalformed
+		}
+		boxSize, headerSize := int64(binary.BigEndian.Uint32(header[:4])), int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = end - pos
+		case 1:
+			if _, err := f.ReadAt(header[8:], pos+8); err != nil {
+				return 0, 0, errMalformed
+			}
+			boxSize, headerSize = int64(binary.BigEndian.Uint64(header[8:])), 16
+		}
+		if boxSize < headerSize {
+			return 0, 0, errMalformed
+		}
+		if string(header[4:8]) == boxType {
+			return pos + headerSize, boxSize - headerSize, nil
+		}
+		pos += boxSize
+	}
+	return 0, 0, fmt.Errorf("no %s box", boxType)
+}
+
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(math.Round(seconds*100)/100, 'f', -1, 64)
+}
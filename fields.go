@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// fileFields lists the JSON field names of a serialized FileInfo, which are
+// the names accepted by the fields= projection. The password and storage
+// path are never serialized; uploader_ip only for admins.
+var fileFields = func() map[string]bool {
+	fields := map[string]bool{"status": true, "password_protected": true}
+	t := reflect.TypeOf(FileInfo{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" && name != "password" && name != "path" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// parseFields parses a comma-separated fields= value. An empty value selects
+// every field and yields nil.
+func parseFields(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var fields, unknown []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !fileFields[field] {
+			unknown = append(unknown, field)
+			continue
+		}
+		fields = append(fields, field)
+	}
+	if len(unknown) > 0 {
+		valid := make([]string, 0, len(fileFields))
+		for field := range fileFields {
+			valid = append(valid, field)
+		}
+		sort.Strings(valid)
+		return nil, fmt.Errorf("unknown fields: %s (valid fields: %s)",
+			strings.Join(unknown, ", "), strings.Join(valid, ", "))
+	}
+	return fields, nil
+}
+
+// projectFiles reduces each file to the selected fields, as seen by an admin
+// when admin is set. With no selection the files are returned as they are.
+func projectFiles(files []*FileInfo, fields []string, admin bool) (interface{}, error) {
+	if fields == nil {
+		if admin {
+			return adminViews(files), nil
+		}
+		return files, nil
+	}
+
+	projected := make([]map[string]json.RawMessage, len(files))
+	for i, fileInfo := range files {
+		var view interface{} = fileInfo
+		if admin {
+			view = (*adminFileInfo)(fileInfo)
+		}
+		data, err := json.Marshal(view)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(data, &all); err != nil {
+			return nil, err
+		}
+		projected[i] = make(map[string]json.RawMessage, len(fields))
+		for _, field := range fields {
+			if value, ok := all[field]; ok {
+				projected[i][field] = value
+			}
+		}
+	}
+	return projected, nil
+}
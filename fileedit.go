@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// systemMetadataKeys are set by the server itself and can't be edited.
+var systemMetadataKeys = []string{integrityKey, typeMismatchKey, s3ETagKey, autoTagKey}
+
+// filePatch is the body of PATCH /api/files/{id}. Left out fields are kept.
+type filePatch struct {
+	Description  *string            `json:"description"`
+	Tags         *[]string          `json:"tags"`          // replaces the tags
+	TTL          *int64             `json:"ttl"`           // seconds to extend the expiry by
+	MaxDownloads *int               `json:"max_downloads"` // 0 = unlimited
+	Password     *string            `json:"password"`      // empty to remove it
+	Metadata     map[string]*string `json:"metadata"`      // null removes a key
+}
+
+var errNothingToUpdate = errors.New("send at least one of description, tags, ttl, max_downloads, password or metadata")
+
+// patchFile handles PATCH /api/files/{id}, which edits a file after its
+// upload. It takes an editor, or an API key with the upload scope that may
+// delete the file, and honors If-Match like the admin actions. Every field
+// is checked before any is applied, so a rejected request changes nothing.
+func (fm *FileManager) patchFile(w http.ResponseWriter, r *http.Request, fileID string) {
+	key, ok := fm.authorizeKey(w, r, scopeUpload)
+	if !ok {
+		return
+	}
+	if key == nil && !fm.requireRole(w, r, roleEditor) {
+		return
+	}
+
+	var patch filePatch
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		respondError(w, r, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if patch.Description == nil && patch.Tags == nil && patch.TTL == nil && patch.MaxDownloads == nil &&
+		patch.Password == nil && len(patch.Metadata) == 0 {
+		respondError(w, r, errNothingToUpdate.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Hashed before taking the lock, as bcrypt is slow on purpose
+	var password string
+	if patch.Password != nil && *patch.Password != "" {
+		var err error
+		if password, err = hashFilePassword(*patch.Password); err != nil {
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rules := fm.tagRules()
+	admin := fm.hasAdminCredentials(r)
+
+	fm.mutex.Lock()
+	fileInfo, exists := fm.files[fileID]
+	if !exists || (key != nil && !key.canDelete(fileInfo)) {
+		fm.mutex.Unlock()
+		if !exists && fm.writeTombstone(w, r, fileID, false) {
+			return
+		}
+		fm.writeNotFound(w, r, fileID)
+		return
+	}
+	if err := fm.checkIfMatch(r.Header.Get("If-Match"), fileInfo); err != nil {
+		fm.mutex.Unlock()
+		writePreconditionError(w, r, err)
+		return
+	}
+
+	tags := fileInfo.Tags
+	if patch.Tags != nil {
+		tags = normalizeTags(*patch.Tags)
+		// Like uploads, files of a tag-scoped key keep its tag
+		if key != nil && key.Tag != "" && !hasAnyTag(tags, []string{key.Tag}) {
+			tags = append(tags, key.Tag)
+		}
+		if !admin && len(rules.protecting(tags)) < len(rules.protecting(fileInfo.Tags)) {
+			fm.mutex.Unlock()
+			respondError(w, r, "Only admins may remove tags that protect a file", http.StatusForbidden)
+			return
+		}
+	}
+
+	expiresAt := fileInfo.ExpiresAt
+	if patch.TTL != nil {
+		if *patch.TTL <= 0 || *patch.TTL > int64(maxPatchTTL/time.Second) {
+			fm.mutex.Unlock()
+			respondError(w, r, "ttl must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		if expiresAt.Before(now) {
+			expiresAt = now
+		}
+		expiresAt = expiresAt.Add(time.Duration(*patch.TTL) * time.Second)
+		if limit := fm.config().MaxTTL; limit > 0 && expiresAt.Sub(now) > limit {
+			fm.mutex.Unlock()
+			respondError(w, r, fmt.Sprintf("ttl would keep the file for more than max_ttl (%s)", formatDuration(limit)), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if limit := patch.MaxDownloads; limit != nil {
+		var problem string
+		switch {
+		case *limit < 0:
+			problem = "max_downloads must be a number of downloads, 0 for unlimited"
+		case *limit > 0 && *limit < fileInfo.Downloads:
+			problem = fmt.Sprintf("max_downloads can't be below the %d downloads made already", fileInfo.Downloads)
+		case *limit > 0 && fileInfo.hasRecipients():
+			problem = errRecipientsLimit.Error()
+		}
+		if problem != "" {
+			fm.mutex.Unlock()
+			respondError(w, r, problem, http.StatusBadRequest)
+			return
+		}
+	}
+
+	metadata := fileInfo.Metadata
+	if len(patch.Metadata) > 0 {
+		metadata = make(map[string]string, len(fileInfo.Metadata)+len(patch.Metadata))
+		for k, v := range fileInfo.Metadata {
+			metadata[k] = v
+		}
+		for k, v := range patch.Metadata {
+			if v == nil {
+				delete(metadata, k)
+			} else {
+				metadata[k] = *v
+			}
+		}
+		if violations := fm.metadataPatchViolations(patch.Metadata, metadata, tags); len(violations) > 0 {
+			fm.mutex.Unlock()
+			writeViolations(w, r, violations)
+			return
+		}
+	}
+
+	// Everything checked; the record is only changed from here on
+	if patch.Description != nil {
+		fileInfo.Description = *patch.Description
+	}
+	fileInfo.Tags = tags
+	if patch.TTL != nil {
+		fileInfo.ExpiresAt = expiresAt
+		fileInfo.TTLSource = ttlExtended
+	}
+	if limit := patch.MaxDownloads; limit != nil {
+		fileInfo.MaxDownloads = *limit
+		if *limit == 0 || fileInfo.Downloads < *limit {
+			fileInfo.GraceUntil = nil
+		}
+	}
+	if patch.Password != nil {
+		fileInfo.Password = password
+		fm.verifiedPasswords.forget(fileID)
+	}
+	fileInfo.Metadata = metadata
+	fm.recordChange(changeUpdated, fileID, fileInfo)
+	etag := fileInfo.ETag()
+	view, err := json.Marshal(fm.fileView(r, fileInfo))
+	fm.mutex.Unlock()
+
+	fm.requestSave()
+	fm.recordEvent(r, "edit", fileInfo, fileID, "ok")
+	if err != nil {
+		respondError(w, r, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	respondJSON(w, http.StatusOK, json.RawMessage(view))
+}
+
+// maxPatchTTL bounds ttl so the new expiry can't overflow.
+const maxPatchTTL = 100 * 365 * 24 * time.Hour
+
+// metadataPatchViolations checks the metadata keys a PATCH sets or removes.
+// The limits apply to the resulting metadata, the schema to the keys that
+// were sent: the rest were accepted on upload or extracted from the
+// content, which the schema doesn't describe.
+func (fm *FileManager) metadataPatchViolations(changed map[string]*string, result map[string]string, tags []string) []string {
+	violations := fm.metadataLimitViolations(result)
+	schema := fm.config().MetadataSchema
+	for key, value := range changed {
+		if slices.Contains(systemMetadataKeys, key) {
+			violations = append(violations, fmt.Sprintf("%s: set by the server", key))
+			continue
+		}
+		if len(schema) == 0 {
+			continue
+		}
+		field, known := schema[key]
+		switch {
+		case !known && value != nil:
+			violations = append(violations, fmt.Sprintf("%s: unknown key", key))
+		case value != nil:
+			if msg := checkMetadataValue(field, *value); msg != "" {
+				violations = append(violations, fmt.Sprintf("%s: %s", key, msg))
+			}
+		case field.Required && (len(field.RequiredFor) == 0 || hasAnyTag(tags, field.RequiredFor)):
+			violations = append(violations, fmt.Sprintf("%s: required", key))
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
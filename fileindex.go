@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// Values of metadata_backend.
+const (
+	metadataJSON   = "json"
+	metadataSQLite = "sqlite"
+)
+
+// FileIndex persists the file index, one JSON record per file ID:
+// metadata_file as a single JSON document, or with metadata_backend
+// "sqlite" a database at metadata_database.
+type FileIndex interface {
+	// Load returns the stored records, or fs.ErrNotExist when nothing
+	// was saved yet.
+	Load() (map[string]json.RawMessage, error)
+	// Save stores the records of every file, dropping those of files no
+	// longer listed.
+	Save(records map[string]json.RawMessage) error
+	Close() error
+}
+
+// recordIndex is implemented by indexes that can store a single file's
+// record without writing the rest, see persistDownload.
+type recordIndex interface {
+	SaveRecord(id string, record json.RawMessage) error
+}
+
+// newFileIndex opens the index selected by metadata_backend.
+func newFileIndex(config *Config, store MetadataStore) (FileIndex, error) {
+	if config.MetadataBackend == metadataSQLite {
+		return openSQLiteIndex(config.MetadataDatabase, jsonIndex{store, config.MetadataFile})
+	}
+	return jsonIndex{store, config.MetadataFile}, nil
+}
+
+// jsonIndex is metadata_file, replaced as a whole on every save. The file
+// it replaces is kept as <metadata_file>.bak.
+type jsonIndex struct {
+	store MetadataStore
+	name  string
+}
+
+// Load reads metadata_file, falling back to its backup when it can't be
+// parsed. The unparsable file is kept as <metadata_file>.corrupt, since the
+// next save replaces it.
+func (j jsonIndex) Load() (map[string]json.RawMessage, error) {
+	data, err := j.store.ReadFile(j.name)
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseIndex(data)
+	if err == nil {
+		return records, nil
+	}
+	err = fmt.Errorf("reading %s: %w", j.name, err)
+	if keepErr := j.store.WriteFile(j.name+".corrupt", data, 0644); keepErr != nil {
+		log.Printf("Error keeping a copy of %s: %v", j.name, keepErr)
+	}
+
+	backup := j.name + ".bak"
+	data, backupErr := j.store.ReadFile(backup)
+	if backupErr == nil {
+		records, backupErr = parseIndex(data)
+	}
+	if backupErr != nil {
+		return nil, fmt.Errorf("%w, and its backup %s can't be used either: %v", err, backup, backupErr)
+	}
+	log.Printf("WARNING: %v; loaded %s from before the last save instead, "+
+		"so changes since then are lost. The unreadable file is kept as %s.corrupt.", err, backup, j.name)
+	return records, nil
+}
+
+func parseIndex(data []byte) (map[string]json.RawMessage, error) {
+	var records map[string]json.RawMessage
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (j jsonIndex) Save(records map[string]json.RawMessage) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := j.store.Backup(j.name, j.name+".bak"); err != nil {
+		return fmt.Errorf("backing up %s: %w", j.name, err)
+	}
+	return j.store.WriteFile(j.name, data, 0644)
+}
+
+func (jsonIndex) Close() error { return nil }
+
+// sqliteIndex keeps the records in the files table of a SQLite database.
+// The size, times, download count, tags and metadata are copied out of each
+// record into columns for querying; the record stays authoritative. Saves
+// only write the records that changed since they were loaded or saved.
+type sqliteIndex struct {
+	db *sql.DB
+
+	mutex  sync.Mutex
+	stored map[string][sha256.Size]byte // record hashes by ID, as in the database
+}
+
+const sqliteSchema = `
+CREATE TABLE files (
+	id            TEXT PRIMARY KEY,
+	original_name TEXT,
+	size          INTEGER,
+	upload_time   TEXT,
+	expires_at    TEXT,
+	downloads     INTEGER,
+	last_download TEXT,
+	tags          TEXT NOT NULL, -- JSON array
+	metadata      TEXT NOT NULL, -- JSON object
+	record        TEXT NOT NULL  -- the whole file record as JSON
+);
+CREATE INDEX files_expires_at ON files (expires_at);
+`
+
+const sqliteUpsert = `
+INSERT INTO files (id, original_name, size, upload_time, expires_at, downloads, last_download, tags, metadata, record)
+VALUES (?1, json_extract(?2, '$.original_name'), json_extract(?2, '$.size'), json_extract(?2, '$.upload_time'),
+	json_extract(?2, '$.expires_at'), json_extract(?2, '$.downloads'), json_extract(?2, '$.last_download'),
+	coalesce(json_extract(?2, '$.tags'), '[]'), coalesce(json_extract(?2, '$.metadata'), '{}'), ?2)
+ON CONFLICT (id) DO UPDATE SET
+	original_name = excluded.original_name, size = excluded.size, upload_time = excluded.upload_time,
+	expires_at = excluded.expires_at, downloads = excluded.downloads, last_download = excluded.last_download,
+	tags = excluded.tags, metadata = excluded.metadata, record = excluded.record`
+
+// openSQLiteIndex opens the database at path, creating it on first boot and
+// importing the records of legacy, the JSON index, if there are any. The
+// schema version is kept in user_version.
+func openSQLiteIndex(path string, legacy jsonIndex) (*sqliteIndex, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// One connection serializes writers, which SQLite would do anyway
+	db.SetMaxOpenConns(1)
+	index := &sqliteIndex{db: db, stored: make(map[string][sha256.Size]byte)}
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	if version == 0 {
+		if err := index.create(legacy); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating %s: %w", path, err)
+		}
+	}
+	return index, nil
+}
+
+// create sets up the schema and imports the JSON index in one transaction,
+// so an interrupted first boot simply starts over.
+func (s *sqliteIndex) create(legacy jsonIndex) error {
+	records, err := legacy.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(sqliteSchema); err != nil {
+		return err
+	}
+	for id, record := range records {
+		if _, err := tx.Exec(sqliteUpsert, id, string(record)); err != nil {
+			return fmt.Errorf("importing %s: %w", id, err)
+		}
+	}
+	if _, err := tx.Exec("PRAGMA user_version = 1"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(records) > 0 {
+		log.Printf("Imported %d files from %s; it is no longer written", len(records), legacy.name)
+	}
+	return nil
+}
+
+func (s *sqliteIndex) Load() (map[string]json.RawMessage, error) {
+	rows, err := s.db.Query("SELECT id, record FROM files")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	records := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var id, record string
+		if err := rows.Scan(&id, &record); err != nil {
+			return nil, err
+		}
+		records[id] = json.RawMessage(record)
+		s.stored[id] = sha256.Sum256([]byte(record))
+	}
+	return records, rows.Err()
+}
+
+func (s *sqliteIndex) Save(records map[string]json.RawMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	written := make(map[string][sha256.Size]byte)
+	for id, record := range records {
+		sum := sha256.Sum256(record)
+		if s.stored[id] == sum {
+			continue
+		}
+		if _, err := tx.Exec(sqliteUpsert, id, string(record)); err != nil {
+			return err
+		}
+		written[id] = sum
+	}
+	var removed []string
+	for id := range s.stored {
+		if _, exists := records[id]; !exists {
+			if _, err := tx.Exec("DELETE FROM files WHERE id = ?", id); err != nil {
+				return err
+			}
+			removed = append(removed, id)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for id, sum := range written {
+		s.stored[id] = sum
+	}
+	for _, id := range removed {
+		delete(s.stored, id)
+	}
+	return nil
+}
+
+// SaveRecord writes one file's record, e.g. after a download.
+func (s *sqliteIndex) SaveRecord(id string, record json.RawMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.db.Exec(sqliteUpsert, id, string(record)); err != nil {
+		return err
+	}
+	s.stored[id] = sha256.Sum256(record)
+	return nil
+}
+
+func (s *sqliteIndex) Close() error {
+	return s.db.Close()
+}
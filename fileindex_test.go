@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONIndexRecoversFromBackup(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "metadata.json")
+	index := jsonIndex{localMetadata{}, name}
+
+	older := map[string]json.RawMessage{"a": json.RawMessage(`{"id":"a"}`)}
+	newer := map[string]json.RawMessage{"a": json.RawMessage(`{"id":"a"}`), "b": json.RawMessage(`{"id":"b"}`)}
+	if err := index.Save(older); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Save(newer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left after saving: %v", err)
+	}
+
+	// A crash mid-write cut the file short
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := data[:len(data)/2]
+	if err := os.WriteFile(name, truncated, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := index.Load()
+	if err != nil {
+		t.Fatalf("Load with a truncated file: %v", err)
+	}
+	if len(records) != len(older) || records["a"] == nil {
+		t.Errorf("loaded %v, want the backup %v", records, older)
+	}
+	if kept, err := os.ReadFile(name + ".corrupt"); err != nil || string(kept) != string(truncated) {
+		t.Errorf("truncated file not kept as .corrupt: %q, %v", kept, err)
+	}
+
+	// With the backup unusable too, Load fails rather than starting fresh
+	if err := os.WriteFile(name+".bak", []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := index.Load(); err == nil {
+		t.Errorf("Load with both files truncated returned %v", records)
+	}
+}
+
+func TestJSONIndexMissingFile(t *testing.T) {
+	index := jsonIndex{localMetadata{}, filepath.Join(t.TempDir(), "metadata.json")}
+	if _, err := index.Load(); !os.IsNotExist(err) {
+		t.Errorf("Load without a file: %v, want not exist", err)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errRequestNotFound = errors.New("file request not found")
+	errRequestClosed   = errors.New("this file request has been closed")
+	errRequestExpired  = errors.New("this file request has expired")
+	errRequestFull     = errors.New("this file request has received all the files it asked for")
+)
+
+// defaultRequestTTL is how long a file request stays open without a ttl.
+const defaultRequestTTL = 7 * 24 * time.Hour
+
+// FileRequest asks someone to send files: its public page at
+// /request/{id} accepts uploads until the request is closed, expires or has
+// received MaxFiles files. Every file it receives is tagged with requestTag
+// and Tags, and reported to NotifyEmail and the webhook.
+type FileRequest struct {
+	ID           string     `json:"id"`
+	Title        string     `json:"title"`
+	Instructions string     `json:"instructions,omitempty"` // Markdown, see the markdown template function
+	Created      time.Time  `json:"created"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	MaxFiles     int        `json:"max_files"` // 0 = unlimited
+	Tags         []string   `json:"tags,omitempty"`
+	NotifyEmail  string     `json:"notify_email,omitempty"`
+	Closed       *time.Time `json:"closed,omitempty"`
+	FileIDs      []string   `json:"file_ids"`
+
+	pending int // uploads in progress, counted against MaxFiles
+}
+
+type fileRequestStore struct {
+	mutex    sync.Mutex
+	requests map[string]*FileRequest
+	dirty    bool
+}
+
+// requestTag is the tag of the files received through request id.
+func requestTag(id string) string {
+	return "file-request" + tagSeparator + id
+}
+
+// check reports why the request can't take another file, if it can't.
+// Callers must hold the store's mutex.
+func (req *FileRequest) check(now time.Time) error {
+	switch {
+	case req.Closed != nil:
+		return errRequestClosed
+	case now.After(req.ExpiresAt):
+		return errRequestExpired
+	case req.MaxFiles > 0 && len(req.FileIDs)+req.pending >= req.MaxFiles:
+		return errRequestFull
+	}
+	return nil
+}
+
+// status is "open", or why the request takes no more files. Callers must
+// hold the store's mutex.
+func (req *FileRequest) status(now time.Time) string {
+	switch req.check(now) {
+	case errRequestClosed:
+		return "closed"
+	case errRequestExpired:
+		return "expired"
+	case errRequestFull:
+		if req.pending == 0 {
+			return "complete"
+		}
+	}
+	return "open"
+}
+
+func (fm *FileManager) fileRequestsFile() string {
+	return fm.config().MetadataFile + ".requests"
+}
+
+func (fm *FileManager) loadFileRequests() {
+	s := &fm.fileRequests
+	s.requests = make(map[string]*FileRequest)
+	data, err := fm.metadata.ReadFile(fm.fileRequestsFile())
+	if err != nil {
+		return
+	}
+	var requests []*FileRequest
+	if err := json.Unmarshal(data, &requests); err != nil {
+		log.Printf("Error loading file requests: %v", err)
+		return
+	}
+	for _, req := range requests {
+		s.requests[req.ID] = req
+	}
+}
+
+// saveFileRequests writes the requests if they changed since the last save.
+func (fm *FileManager) saveFileRequests() {
+	s := &fm.fileRequests
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return
+	}
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	s.dirty = false
+	s.mutex.Unlock()
+	if err != nil {
+		log.Printf("Error encoding file requests: %v", err)
+		return
+	}
+	if err := fm.metadata.WriteFile(fm.fileRequestsFile(), data, 0600); err != nil {
+		log.Printf("Error saving file requests: %v", err)
+	}
+}
+
+// sorted returns the requests newest first. Callers must hold s.mutex.
+func (s *fileRequestStore) sorted() []*FileRequest {
+	requests := make([]*FileRequest, 0, len(s.requests))
+	for _, req := range s.requests {
+		requests = append(requests, req)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Created.After(requests[j].Created) })
+	return requests
+}
+
+// fileRequestView is a request as the admin API shows it, with the files it
+// received that are still stored.
+type fileRequestView struct {
+	FileRequest
+	URL    string      `json:"url"`
+	Status string      `json:"status"` // open, complete, closed or expired
+	Files  []*FileInfo `json:"files"`
+}
+
+// viewOf describes req. Callers must hold the store's mutex.
+func (fm *FileManager) viewOf(r *http.Request, req *FileRequest) fileRequestView {
+	view := fileRequestView{
+		FileRequest: *req,
+		URL:         fm.baseURL(r) + "/request/" + req.ID,
+		Status:      req.status(time.Now()),
+		Files:       []*FileInfo{},
+	}
+	fm.mutex.RLock()
+	for _, id := range req.FileIDs {
+		if fileInfo, exists := fm.files[id]; exists {
+			view.Files = append(view.Files, fileInfo)
+		}
+	}
+	fm.mutex.RUnlock()
+	return view
+}
+
+// fileRequestsAPI handles /api/requests: GET lists the requests with their
+// files, POST creates one, GET /{id} shows one and POST /{id}/close stops it
+// from taking files.
+func (fm *FileManager) fileRequestsAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	role := roleEditor
+	if r.Method == "GET" {
+		role = roleViewer
+	}
+	if !fm.requireRole(w, r, role) {
+		return
+	}
+	s := &fm.fileRequests
+
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		s.mutex.Lock()
+		views := make([]fileRequestView, 0, len(s.requests))
+		for _, req := range s.sorted() {
+			views = append(views, fm.viewOf(r, req))
+		}
+		s.mutex.Unlock()
+		respondJSON(w, http.StatusOK, views)
+
+	case len(parts) == 0 && r.Method == "POST":
+		var request struct {
+			Title        string   `json:"title"`
+			Instructions string   `json:"instructions"`
+			TTL          int      `json:"ttl"` // seconds
+			MaxFiles     int      `json:"max_files"`
+			Tags         []string `json:"tags"`
+			NotifyEmail  string   `json:"notify_email"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&request); err != nil {
+			respondError(w, r, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		title, err := parseTitle(request.Title)
+		if err != nil {
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if title == "" {
+			respondError(w, r, "title is required", http.StatusBadRequest)
+			return
+		}
+		if request.TTL < 0 || request.MaxFiles < 0 {
+			respondError(w, r, "ttl and max_files must not be negative", http.StatusBadRequest)
+			return
+		}
+		ttl := defaultRequestTTL
+		if request.TTL > 0 {
+			ttl = time.Duration(request.TTL) * time.Second
+		}
+		if request.NotifyEmail != "" {
+			address, err := fm.parseNotifyEmail(request.NotifyEmail)
+			if err != nil {
+				respondError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			request.NotifyEmail = address
+		}
+
+		now := time.Now()
+		req := &FileRequest{
+			ID:           generateID(),
+			Title:        title,
+			Instructions: strings.TrimSpace(request.Instructions),
+			Created:      now,
+			ExpiresAt:    now.Add(ttl),
+			MaxFiles:     request.MaxFiles,
+			Tags:         normalizeTags(request.Tags),
+			NotifyEmail:  request.NotifyEmail,
+			FileIDs:      []string{},
+		}
+		s.mutex.Lock()
+		s.requests[req.ID] = req
+		s.dirty = true
+		view := fm.viewOf(r, req)
+		s.mutex.Unlock()
+		fm.saveFileRequests()
+		log.Printf("Created file request %s: %s", req.ID, req.Title)
+		respondJSON(w, http.StatusCreated, view)
+
+	case len(parts) == 1 && r.Method == "GET":
+		s.mutex.Lock()
+		req, exists := s.requests[parts[0]]
+		var view fileRequestView
+		if exists {
+			view = fm.viewOf(r, req)
+		}
+		s.mutex.Unlock()
+		if !exists {
+			respondError(w, r, errRequestNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		respondJSON(w, http.StatusOK, view)
+
+	case len(parts) == 2 && parts[1] == "close" && r.Method == "POST":
+		s.mutex.Lock()
+		req, exists := s.requests[parts[0]]
+		var view fileRequestView
+		if exists {
+			if req.Closed == nil {
+				closed := time.Now()
+				req.Closed = &closed
+				s.dirty = true
+			}
+			view = fm.viewOf(r, req)
+		}
+		s.mutex.Unlock()
+		if !exists {
+			respondError(w, r, errRequestNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		fm.saveFileRequests()
+		respondJSON(w, http.StatusOK, view)
+
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// requestPage serves /request/{id}: GET renders the upload page of an open
+// request, POST receives its files. No credentials are needed; knowing the
+// URL is enough.
+func (fm *FileManager) requestPage(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "/request/")
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := &fm.fileRequests
+	s.mutex.Lock()
+	req, exists := s.requests[id]
+	var page FileRequest
+	if exists {
+		err = req.check(time.Now())
+		page = *req
+	}
+	s.mutex.Unlock()
+	if !exists {
+		respondError(w, r, errRequestNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if err != nil {
+			respondError(w, r, err.Error(), http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fm.renderHTML(w, r, requestTemplate, page)
+	case "POST":
+		fm.receiveRequestFiles(w, r, id)
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// receiveRequestFiles stores the files of a form posted to a request page.
+// Each file takes a slot of the request before it is stored, so concurrent
+// uploads can't exceed max_files.
+func (fm *FileManager) receiveRequestFiles(w http.ResponseWriter, r *http.Request, id string) {
+	timerFrom(r.Context()).begin(opUpload)
+	if !fm.admitUploader(w, r, r.ContentLength) {
+		return
+	}
+	reservation, ok := fm.admitStorage(w, r)
+	if !ok {
+		return
+	}
+	defer fm.releaseStorage(reservation)
+	if err := limitForm(r, fm.config().MaxFileSize); err != nil {
+		respondFormError(w, r, err, "File too large")
+		return
+	}
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		respondError(w, r, "No file provided", http.StatusBadRequest)
+		return
+	}
+	for _, header := range headers {
+		if !fm.typeAllowed(header.Header.Get("Content-Type")) {
+			respondError(w, r, "File type not allowed", http.StatusBadRequest)
+			return
+		}
+	}
+	s := &fm.fileRequests
+	s.mutex.Lock()
+	tags := append(append([]string{}, s.requests[id].Tags...), requestTag(id))
+	s.mutex.Unlock()
+	if violations := fm.validateMetadata(nil, tags); len(violations) > 0 {
+		writeViolations(w, r, violations)
+		return
+	}
+	timerFrom(r.Context()).mark(phaseReceive)
+
+	var received []*FileInfo
+	for _, header := range headers {
+		s.mutex.Lock()
+		req := s.requests[id]
+		if err := req.check(time.Now()); err != nil {
+			s.mutex.Unlock()
+			if len(received) == 0 {
+				respondError(w, r, err.Error(), http.StatusGone)
+				return
+			}
+			break
+		}
+		req.pending++
+		upload := uploadRequest{
+			Filename:    header.Filename,
+			ContentType: header.Header.Get("Content-Type"),
+			TTL:         fm.config().DefaultTTL,
+			TTLSource:   ttlDefault,
+			Description: r.FormValue("message"),
+			Tags:        tags,
+			UploaderIP:  fm.clientIP(r),
+			UserAgent:   r.UserAgent(),
+			NotifyEmail: req.NotifyEmail,
+			Reservation: reservation,
+		}
+		title := req.Title
+		s.mutex.Unlock()
+
+		fileInfo, err := fm.storeRequestFile(r, header, upload)
+
+		s.mutex.Lock()
+		req.pending--
+		if err == nil {
+			req.FileIDs = append(req.FileIDs, fileInfo.ID)
+			s.dirty = true
+		}
+		s.mutex.Unlock()
+		if err != nil {
+			fm.saveFileRequests()
+			fm.writeUploadError(w, r, upload.Filename, err)
+			return
+		}
+		received = append(received, fileInfo)
+
+		log.Printf("File request %s received %s", id, fileInfo.OriginalName)
+		details := map[string]interface{}{
+			"request_id": id,
+			"title":      title,
+			"file_id":    fileInfo.ID,
+			"filename":   fileInfo.OriginalName,
+			"size":       fileInfo.Size,
+		}
+		fm.notifyFile("file_request_upload", fileInfo, details)
+		fm.queueUploadEmail(r, "file_request_upload", fileInfo, details, upload)
+	}
+	fm.saveFileRequests()
+	fm.writeRequestReceipt(w, r, received)
+}
+
+func (fm *FileManager) storeRequestFile(r *http.Request, header *multipart.FileHeader, upload uploadRequest) (*FileInfo, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return fm.storeFile(r.Context(), file, upload)
+}
+
+// writeRequestReceipt confirms the files received through a request page.
+// The sender gets no download links: the files are for the requester.
+func (fm *FileManager) writeRequestReceipt(w http.ResponseWriter, r *http.Request, received []*FileInfo) {
+	type receivedFile struct {
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+		Checksum string `json:"checksum"`
+	}
+	files := make([]receivedFile, len(received))
+	for i, fileInfo := range received {
+		files[i] = receivedFile{fileInfo.OriginalName, fileInfo.Size, fileInfo.Checksum}
+	}
+
+	switch negotiate(r) {
+	case mediaJSON:
+		respondJSON(w, http.StatusCreated, map[string]interface{}{"received": files})
+	case mediaHTML:
+		respondHTML(w, http.StatusCreated, requestReceivedTemplate, files)
+	default:
+		var text strings.Builder
+		for _, f := range files {
+			fmt.Fprintf(&text, "Received %s (%s)\n", f.Filename, formatBytes(f.Size))
+		}
+		respondText(w, http.StatusCreated, text.String())
+	}
+}
+
+var requestTemplate = template.Must(template.New("request").Funcs(parseFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.Title}}</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; background: #f5f5f5; }
+        .container { max-width: 600px; margin: 40px auto; background: white; padding: 30px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); }
+        h1 { color: #007bff; font-size: 1.5em; word-break: break-word; }
+        .meta { color: #666; margin: 15px 0; }
+        .form-group { margin: 15px 0; }
+        textarea { width: 100%; padding: 8px; border: 1px solid #ddd; border-radius: 4px; box-sizing: border-box; }
+        .btn { background: #007bff; color: white; padding: 12px 24px; border: none; border-radius: 4px; cursor: pointer; font-size: 1em; }
+        .btn:hover { background: #0056b3; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Title}}</h1>
+        {{with .Instructions}}{{markdown .}}{{end}}
+        <div class="meta">
+            <div>Open until {{.ExpiresAt.Format "2006-01-02 15:04:05"}} ({{expiresIn .ExpiresAt}})</div>
+            {{if gt .MaxFiles 0}}<div>{{len .FileIDs}} of {{.MaxFiles}} files received</div>{{end}}
+        </div>
+        <form method="post" enctype="multipart/form-data">
+            <div class="form-group"><input type="file" name="file" multiple required></div>
+            <div class="form-group"><textarea name="message" rows="3" placeholder="Optional message"></textarea></div>
+            <input type="submit" value="Send" class="btn">
+        </form>
+    </div>
+</body>
+</html>
+`))
+
+var requestReceivedTemplate = template.Must(template.New("request-received").Funcs(parseFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>Files received</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; background: #f5f5f5; }
+        .container { max-width: 600px; margin: 40px auto; background: white; padding: 30px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); }
+        h1 { color: #28a745; font-size: 1.5em; }
+        li { margin: 5px 0; word-break: break-all; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>Thank you, your files were received</h1>
+        <ul>{{range .}}<li>{{displayName .Filename}} ({{formatBytes .Size}})</li>{{end}}</ul>
+    </div>
+</body>
+</html>
+`))
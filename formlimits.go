@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// Caps on the non-file fields of upload forms, in bytes. Left to itself,
+// ParseMultipartForm keeps up to its memory limit plus 10MB of them, and
+// ParseForm up to 10MB.
+const (
+	maxFieldLength  = 4 << 10   // any field not in formFieldLimits
+	maxFormFields   = 128 << 10 // all fields together, names included
+	maxMetadataForm = 64 << 10  // the metadata JSON, or the x-amz-meta-* headers
+)
+
+var formFieldLimits = map[string]int64{
+	"description": 4 << 10,
+	"message":     4 << 10,
+	"tags":        2 << 10,
+	"metadata":    maxMetadataForm,
+	"url":         8 << 10,
+}
+
+func fieldLimit(name string) int64 {
+	if limit, ok := formFieldLimits[name]; ok {
+		return limit
+	}
+	return maxFieldLength
+}
+
+// formFieldError is a form field limitForm refused, answered with 422.
+type formFieldError struct {
+	field   string // empty when the fields are too large as a whole
+	problem string
+}
+
+func (e *formFieldError) Error() string {
+	if e.field == "" {
+		return "form fields " + e.problem
+	}
+	return fmt.Sprintf("form field %q %s", e.field, e.problem)
+}
+
+// formLimits tracks the fields of one form against the caps. Every field
+// is expected once; a repeated one is refused rather than one of its
+// values picked.
+type formLimits struct {
+	seen  map[string]bool
+	total int64
+}
+
+func (l *formLimits) check(name string, size int64) error {
+	if l.seen[name] {
+		return &formFieldError{name, "is repeated"}
+	}
+	if limit := fieldLimit(name); size > limit {
+		return &formFieldError{name, fmt.Sprintf("is longer than %d bytes", limit)}
+	}
+	l.total += int64(len(name)) + size
+	if l.total > maxFormFields {
+		return &formFieldError{"", fmt.Sprintf("are longer than %d bytes together", maxFormFields)}
+	}
+	if l.seen == nil {
+		l.seen = make(map[string]bool)
+	}
+	l.seen[name] = true
+	return nil
+}
+
+// limitForm parses the form of r like ParseMultipartForm(maxMemory), but
+// holds its non-file fields to the caps above. Multipart bodies are checked
+// part by part as ParseMultipartForm reads them, so an oversized field is
+// refused after at most its cap was read; URL-encoded bodies are cut off
+// at maxFormFields. Refused fields are returned as *formFieldError.
+func limitForm(r *http.Request, maxMemory int64) error {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(nil, r.Body, maxFormFields)
+		}
+		if err := r.ParseForm(); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return &formFieldError{"", fmt.Sprintf("are longer than %d bytes together", maxFormFields)}
+			}
+			return err
+		}
+		return limitQuery(r.PostForm)
+	}
+
+	pr, pw := io.Pipe()
+	out := multipart.NewWriter(pw)
+	if err := out.SetBoundary(params["boundary"]); err != nil {
+		return err
+	}
+	in := multipart.NewReader(r.Body, params["boundary"])
+	r.Body = pr
+	go func() {
+		pw.CloseWithError(copyLimitedForm(out, in))
+	}()
+	err = r.ParseMultipartForm(maxMemory)
+	// Unblocks the copy when parsing stopped early
+	pr.Close()
+
+	var fieldErr *formFieldError
+	if errors.As(err, &fieldErr) {
+		return fieldErr
+	}
+	return err
+}
+
+// limitQuery holds the fields of a query string to the caps of form fields,
+// for uploads that take their fields from the URL.
+func limitQuery(query url.Values) error {
+	var limits formLimits
+	for name, values := range query {
+		for _, value := range values {
+			if err := limits.check(name, int64(len(value))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyLimitedForm copies the parts of in to out, stopping with a
+// *formFieldError at the first field past its cap. File parts are copied
+// as they are.
+func copyLimitedForm(out *multipart.Writer, in *multipart.Reader) error {
+	var limits formLimits
+	for {
+		part, err := in.NextPart()
+		if err == io.EOF {
+			return out.Close()
+		}
+		if err != nil {
+			return err
+		}
+		w, err := out.CreatePart(part.Header)
+		if err != nil {
+			return err
+		}
+		name := part.FormName()
+		if name == "" || part.FileName() != "" {
+			if _, err := io.Copy(w, part); err != nil {
+				return err
+			}
+			continue
+		}
+		n, err := io.Copy(w, io.LimitReader(part, fieldLimit(name)+1))
+		if err != nil {
+			return err
+		}
+		if err := limits.check(name, n); err != nil {
+			return err
+		}
+	}
+}
+
+// respondFormError answers a form limitForm refused: 422 naming the field
+// for a *formFieldError, otherwise fallback with 400.
+func respondFormError(w http.ResponseWriter, r *http.Request, err error, fallback string) {
+	var fieldErr *formFieldError
+	if errors.As(err, &fieldErr) {
+		respondError(w, r, fieldErr.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	respondError(w, r, fallback, http.StatusBadRequest)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// formField is one non-file field of a test form.
+type formField struct {
+	name  string
+	value string
+}
+
+// postForm sends a multipart upload of fields and a small file straight to
+// the handler and returns the status and the decoded JSON body.
+func postForm(t *testing.T, handler http.Handler, path string, fields []formField) (int, map[string]interface{}) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, field := range fields {
+		form.WriteField(field.name, field.value)
+	}
+	part, _ := form.CreateFormFile("file", "notes.txt")
+	part.Write([]byte("content"))
+	form.Close()
+	req := httptest.NewRequest("POST", path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var decoded map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &decoded)
+	return rec.Code, decoded
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// filler is an endless stream of x.
+type filler struct{}
+
+func (filler) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestFormFieldLimits(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	handler := fm.Handler()
+	status, body := uploadTestFile(t, server, "notes.txt", []byte("content"), url.Values{"description": {"one", "two"}})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body["error"].(string), `"description" is repeated`) {
+		t.Errorf("repeated form field: status %d, body %v, want 422 naming it", status, body)
+	}
+	status, body = uploadTestFile(t, server, "notes.txt", []byte("content"), url.Values{"tags": {strings.Repeat("t", 2<<10+1)}})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body["error"].(string), `"tags" is longer than`) {
+		t.Errorf("oversized form field: status %d, body %v, want 422 naming it", status, body)
+	}
+
+	thousandTags := make([]formField, 5000)
+	for i := range thousandTags {
+		thousandTags[i] = formField{"tags", fmt.Sprint("t", i)}
+	}
+	manyFields := make([]formField, 40)
+	for i := range manyFields {
+		manyFields[i] = formField{fmt.Sprint("field", i), strings.Repeat("v", 4<<10)}
+	}
+	for _, tc := range []struct {
+		name   string
+		fields []formField
+		want   string
+	}{
+		{"thousands of tags", thousandTags, `form field "tags" is repeated`},
+		{"fields past the total", manyFields, "form fields are longer than 131072 bytes together"},
+		{"oversized metadata", []formField{{"metadata", `{"k":"` + strings.Repeat("x", 64<<10) + `"}`}}, `form field "metadata" is longer than 65536 bytes`},
+		{"oversized unknown field", []formField{{"note", strings.Repeat("x", 4<<10+1)}}, `form field "note" is longer than 4096 bytes`},
+	} {
+		status, body := postForm(t, handler, "/upload", tc.fields)
+		if status != http.StatusUnprocessableEntity || body["error"] != tc.want {
+			t.Errorf("%s: status %d, error %v, want 422 %q", tc.name, status, body["error"], tc.want)
+		}
+	}
+
+	// Fields at their caps pass
+	status, body = postForm(t, handler, "/upload", []formField{
+		{"description", strings.Repeat("d", 4<<10)},
+		{"tags", strings.Repeat("t", 100)},
+	})
+	if status != http.StatusOK {
+		t.Errorf("fields at their caps: status %d, body %v", status, body)
+	}
+
+	// Starting a session, creating a link and answering a file request take
+	// the same caps
+	for _, path := range []string{"/api/uploads", "/api/links"} {
+		if status, body := postForm(t, handler, path, []formField{{"description", "a"}, {"description", "b"}}); status != http.StatusUnprocessableEntity {
+			t.Errorf("repeated field on %s: status %d, body %v, want 422", path, status, body)
+		}
+	}
+
+	fm.mutex.RLock()
+	stored := len(fm.files)
+	fm.mutex.RUnlock()
+	if stored != 1 {
+		t.Errorf("%d files stored, want only the one within the caps", stored)
+	}
+}
+
+func TestOversizedFieldNotBuffered(t *testing.T) {
+	fm := NewTestFileManager(nil)
+	defer fm.Close()
+
+	// A 512MB description, streamed: only its cap is read before the refusal
+	const size = 512 << 20
+	boundary := "adversarial"
+	body := &countingReader{r: io.MultiReader(
+		strings.NewReader("--"+boundary+"\r\nContent-Disposition: form-data; name=\"description\"\r\n\r\n"),
+		io.LimitReader(filler{}, size),
+		strings.NewReader("\r\n--"+boundary+"--\r\n"),
+	)}
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+	req.Header.Set("Accept", "application/json")
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	rec := httptest.NewRecorder()
+	fm.Handler().ServeHTTP(rec, req)
+	runtime.ReadMemStats(&after)
+
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `\"description\" is longer than`) {
+		t.Fatalf("512MB description: status %d, body %s", rec.Code, rec.Body.String())
+	}
+	if body.n > 1<<20 {
+		t.Errorf("read %d bytes of the body before refusing it", body.n)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("allocated %d bytes refusing the field", allocated)
+	}
+}
+
+// TestAdversarialForms throws random mixes of repeated, oversized and
+// plentiful fields at the upload form and checks each gets the answer its
+// fields call for, never a server error.
+func TestAdversarialForms(t *testing.T) {
+	fm := NewTestFileManager(nil)
+	defer fm.Close()
+	handler := fm.Handler()
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"description", "message", "note", "extra"}
+
+	for i := 0; i < 200; i++ {
+		var fields []formField
+		var limits formLimits
+		var refused error
+		for n := rng.Intn(40); n > 0; n-- {
+			name := names[rng.Intn(len(names))]
+			if rng.Intn(4) > 0 {
+				name = fmt.Sprint(name, rng.Intn(1000)) // mostly distinct names
+			}
+			limit := int(fieldLimit(name))
+			size := []int{0, 1, limit - 1, limit, limit + 1, rng.Intn(limit)}[rng.Intn(6)]
+			fields = append(fields, formField{name, strings.Repeat("v", size)})
+			if refused == nil {
+				refused = limits.check(name, int64(size))
+			}
+		}
+		status, body := postForm(t, handler, "/upload", fields)
+		switch {
+		case refused != nil && (status != http.StatusUnprocessableEntity || body["error"] != refused.Error()):
+			t.Errorf("form %d: status %d, error %v, want 422 %q", i, status, body["error"], refused)
+		case refused == nil && status != http.StatusOK:
+			t.Errorf("form %d within the caps: status %d, body %v", i, status, body)
+		}
+	}
+}
+
+func TestS3MetadataHeaderLimits(t *testing.T) {
+	_, c := newS3Client(t)
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		code   string
+	}{
+		{"repeated", http.Header{"X-Amz-Meta-Note": {"a", "b"}}, "InvalidArgument"},
+		{"oversized", http.Header{"X-Amz-Meta-Note": {strings.Repeat("x", 64<<10)}}, "MetadataTooLarge"},
+	} {
+		resp, body := c.do("PUT", "/s3/photos/a.txt", []byte("content"), "", tc.header)
+		if resp.StatusCode != http.StatusBadRequest || !bytes.Contains(body, []byte("<Code>"+tc.code+"</Code>")) {
+			t.Errorf("%s metadata header: status %d, body %s, want 400 %s", tc.name, resp.StatusCode, body, tc.code)
+		}
+	}
+}
+
+func TestRawUploadQueryLimits(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	for _, tc := range []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"within the caps", "description=notes&tags=a,b", http.StatusOK},
+		{"repeated description", "description=one&description=two", http.StatusBadRequest},
+		{"repeated tags", "tags=a&tags=b", http.StatusBadRequest},
+		{"oversized metadata", "metadata=" + url.QueryEscape(`{"k":"`+strings.Repeat("x", 64<<10)+`"}`), http.StatusBadRequest},
+		{"oversized description", "description=" + strings.Repeat("x", 4<<10+1), http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest("PUT", server.URL+"/upload/notes.txt?"+tc.query, strings.NewReader("content"))
+		status, body := doJSON(t, req)
+		if status != tc.want {
+			t.Errorf("%s: status %d, body %v, want %d", tc.name, status, body, tc.want)
+		}
+	}
+
+	fm.mutex.RLock()
+	stored := len(fm.files)
+	fm.mutex.RUnlock()
+	if stored != 1 {
+		t.Errorf("%d files stored, want only the one within the caps", stored)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"syscall"
+)
+
+var (
+	errPathTooLong = errors.New("storage path too long")
+	errNoInodes    = errors.New("no free inodes on the upload filesystem")
+)
+
+// maxNameLength is the longest file name nearly all filesystems accept
+// (NAME_MAX).
+const maxNameLength = 255
+
+// FilesystemUsage reports free space and inodes on upload_dir's filesystem.
+// InodeLevel counts the storage_warning_thresholds raised for inode usage.
+type FilesystemUsage struct {
+	BytesFree   uint64  `json:"bytes_free"`
+	BytesTotal  uint64  `json:"bytes_total"`
+	InodesFree  uint64  `json:"inodes_free"`
+	InodesTotal uint64  `json:"inodes_total"` // 0 when the filesystem doesn't count inodes
+	InodeRatio  float64 `json:"inode_ratio"`
+	InodeLevel  int     `json:"inode_level"`
+	Warning     string  `json:"warning,omitempty"`
+}
+
+// filesystemUsage stats upload_dir, or returns nil when that isn't possible:
+// on the memory backend and on platforms without statfs.
+func (fm *FileManager) filesystemUsage() *FilesystemUsage {
+	config := fm.config()
+	if config.StorageBackend == storageMemory {
+		return nil
+	}
+	usage, ok := statFilesystem(config.UploadDir)
+	if !ok {
+		return nil
+	}
+	if usage.InodesTotal == 0 {
+		return &usage
+	}
+	usage.InodeRatio = float64(usage.InodesTotal-usage.InodesFree) / float64(usage.InodesTotal)
+	fm.inodeAlerts.mutex.Lock()
+	usage.InodeLevel = fm.inodeAlerts.level
+	fm.inodeAlerts.mutex.Unlock()
+
+	thresholds := fm.warningThresholds()
+	for i := len(thresholds) - 1; i >= 0; i-- {
+		if usage.InodeRatio >= thresholds[i] {
+			usage.Warning = fmt.Sprintf("%.0f%% of inodes are in use (warning threshold %.0f%%); uploads are refused once none are free",
+				usage.InodeRatio*100, thresholds[i]*100)
+			break
+		}
+	}
+	return &usage
+}
+
+// inodesExhausted reports whether the upload filesystem counts inodes and
+// has none left.
+func (u *FilesystemUsage) inodesExhausted() bool {
+	return u != nil && u.InodesTotal > 0 && u.InodesFree == 0
+}
+
+// degraded reports whether the highest inode warning threshold is raised.
+func (u *FilesystemUsage) degraded(thresholds []float64) bool {
+	return u != nil && len(thresholds) > 0 && u.InodeLevel == len(thresholds)
+}
+
+// checkStoragePath refuses a storage key whose file name, or whose path
+// within upload_dir, is longer than the filesystem or max_path_length
+// allows, before anything is written.
+func (fm *FileManager) checkStoragePath(key string) error {
+	if n := len(path.Base(key)); n > maxNameLength {
+		return fmt.Errorf("%w: the stored file name would be %d bytes, over the %d-byte file name limit", errPathTooLong, n, maxNameLength)
+	}
+	limit := fm.config().MaxPathLength
+	if n := len(fm.storage.Locate(key)); limit > 0 && n > limit {
+		return fmt.Errorf("%w: the stored path would be %d bytes, over max_path_length %d", errPathTooLong, n, limit)
+	}
+	return nil
+}
+
+// checkFilesystem refuses an upload of size bytes when the upload
+// filesystem has no inode or not enough space left for it. Both errors
+// count as a full disk.
+func (fm *FileManager) checkFilesystem(size int64) error {
+	usage := fm.filesystemUsage()
+	switch {
+	case usage == nil:
+		return nil
+	case usage.inodesExhausted():
+		return fmt.Errorf("%w: %w", errNoInodes, syscall.ENOSPC)
+	case size > 0 && usage.BytesFree < uint64(size):
+		return fmt.Errorf("%d bytes free on the upload filesystem, %d needed: %w", usage.BytesFree, size, syscall.ENOSPC)
+	}
+	return nil
+}
+
+// explainStorageError names the limit behind a failed write: a path the
+// filesystem refused as too long, or a full disk that is really out of
+// inodes.
+func (fm *FileManager) explainStorageError(err error) error {
+	switch {
+	case errors.Is(err, syscall.ENAMETOOLONG):
+		return fmt.Errorf("%w: %w", errPathTooLong, err)
+	case isDiskFull(err) && !errors.Is(err, errNoInodes) && fm.filesystemUsage().inodesExhausted():
+		return fmt.Errorf("%w: %w", errNoInodes, err)
+	}
+	return err
+}
+
+// checkInodeThresholds raises and clears inode warning thresholds like
+// checkStorageThresholds does for stored bytes.
+func (fm *FileManager) checkInodeThresholds() {
+	usage := fm.filesystemUsage()
+	if usage == nil || usage.InodesTotal == 0 {
+		return
+	}
+	details := func(threshold float64) map[string]interface{} {
+		return map[string]interface{}{
+			"threshold":    threshold,
+			"inodes_free":  usage.InodesFree,
+			"inodes_total": usage.InodesTotal,
+			"ratio":        usage.InodeRatio,
+		}
+	}
+	fm.inodeAlerts.update(usage.InodeRatio, fm.warningThresholds(), fm.config().StorageHysteresis,
+		func(threshold float64) {
+			log.Printf("Inode usage %.0f%% crossed the %.0f%% warning threshold", usage.InodeRatio*100, threshold*100)
+			fm.notify("inode_threshold_crossed", details(threshold))
+		},
+		func(threshold float64) {
+			log.Printf("Inode usage %.0f%% is back below the %.0f%% warning threshold", usage.InodeRatio*100, threshold*100)
+			fm.notify("inode_threshold_cleared", details(threshold))
+		})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLongFilenameRefused(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+
+	// Sanitizing keeps the length; the stored name adds the storage ID
+	name := strings.Repeat("quarterly report ", 20) + ".pdf"
+	status, body := uploadTestFile(t, server, name, []byte("content"), nil)
+	if status != http.StatusUnprocessableEntity || body["code"] != "path_too_long" || !strings.Contains(body["error"].(string), "255-byte file name limit") {
+		t.Errorf("upload of a %d-byte name: status %d, body %v, want 422 naming the limit", len(name), status, body)
+	}
+	if n := len(storedKeys(fm)); n != 0 {
+		t.Errorf("%d files stored, want none", n)
+	}
+	// Up to the limit is fine
+	if status, body := uploadTestFile(t, server, strings.Repeat("a", 200)+".pdf", []byte("content"), nil); status != http.StatusOK {
+		t.Errorf("upload of a 204-byte name: status %d, body %v", status, body)
+	}
+}
+
+func TestCheckStoragePath(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) {
+		c.MaxPathLength = 64
+	})
+	defer fm.Close()
+	for key, want := range map[string]string{
+		"abc_report.pdf":                     "",
+		strings.Repeat("x", 256):             "255-byte file name limit",
+		"abc_" + strings.Repeat("x", 60):     "max_path_length 64",
+		strings.Repeat("d/", 10) + "a.pdf":   "",
+		strings.Repeat("dir/", 15) + "a.pdf": "max_path_length 64",
+	} {
+		err := fm.checkStoragePath(key)
+		if want == "" {
+			if err != nil {
+				t.Errorf("checkStoragePath(%q) = %v", key, err)
+			}
+		} else if !errors.Is(err, errPathTooLong) || !strings.Contains(err.Error(), want) {
+			t.Errorf("checkStoragePath(%q) = %v, want errPathTooLong naming %s", key, err, want)
+		}
+	}
+}
+
+func TestFilesystemLimitErrors(t *testing.T) {
+	fm := NewTestFileManager(nil)
+	failing := &failingStorage{Storage: fm.storage}
+	fm.storage = failing
+	server := httptest.NewServer(fm.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		fm.Close()
+	})
+
+	// A name the filesystem itself refuses is the client's to shorten
+	failing.fail(syscall.ENAMETOOLONG)
+	if status, body := uploadTestFile(t, server, "a.txt", []byte("content"), nil); status != http.StatusUnprocessableEntity || body["code"] != "path_too_long" {
+		t.Errorf("ENAMETOOLONG: status %d, body %v, want 422", status, body)
+	}
+	failing.fail(nil)
+
+	if err := fm.explainStorageError(syscall.ENOSPC); !errors.Is(err, syscall.ENOSPC) || errors.Is(err, errNoInodes) {
+		t.Errorf("ENOSPC without inode counts explained as %v", err)
+	}
+	if problem := uploadProblem(errNoInodes); problem.Status != http.StatusInsufficientStorage || problem.Code != "no_inodes" {
+		t.Errorf("errNoInodes maps to %+v, want 507 no_inodes", problem)
+	}
+
+	thresholds := []float64{0.8, 0.9}
+	for _, tc := range []struct {
+		usage     *FilesystemUsage
+		exhausted bool
+		degraded  bool
+	}{
+		{nil, false, false},
+		{&FilesystemUsage{InodesTotal: 0}, false, false}, // doesn't count inodes
+		{&FilesystemUsage{InodesTotal: 100, InodesFree: 50}, false, false},
+		{&FilesystemUsage{InodesTotal: 100, InodesFree: 5, InodeLevel: 2}, false, true},
+		{&FilesystemUsage{InodesTotal: 100, InodesFree: 0, InodeLevel: 2}, true, true},
+	} {
+		if got := tc.usage.inodesExhausted(); got != tc.exhausted {
+			t.Errorf("%+v: exhausted %v", tc.usage, got)
+		}
+		if got := tc.usage.degraded(thresholds); got != tc.degraded {
+			t.Errorf("%+v: degraded %v", tc.usage, got)
+		}
+	}
+}
+
+func TestHealthReportsInodes(t *testing.T) {
+	dir := t.TempDir()
+	fm, server := newTestServer(t, nil)
+	// Only upload_dir is statted, so the stored files can stay in memory
+	config := *fm.config()
+	config.StorageBackend = storageLocal
+	config.UploadDir = dir
+	fm.cfg.Store(&config)
+	usage, ok := statFilesystem(dir)
+	if !ok || usage.InodesTotal == 0 {
+		t.Skip("the filesystem of the temporary directory doesn't count inodes")
+	}
+	_, health := getJSON(t, server, "/api/health")
+	filesystem, _ := health["filesystem"].(map[string]interface{})
+	if filesystem["inodes_total"] == nil || filesystem["inode_ratio"] == nil {
+		t.Errorf("health lacks inode usage: %v", health)
+	}
+}
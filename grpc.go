@@ -0,0 +1,393 @@
+package main
+
+//go:generate protoc -I proto --go_out=. --go_opt=module=uploads --go-grpc_out=. --go-grpc_opt=module=uploads uploads.proto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"uploads/uploadspb"
+)
+
+const grpcChunkSize = 64 * 1024
+
+// grpcServer exposes the FileManager over gRPC on grpc_port.
+type grpcServer struct {
+	uploadspb.UnimplementedUploadsServer
+	fm *FileManager
+}
+
+// newGRPCServer returns the gRPC API server, for serveGRPC.
+func (fm *FileManager) newGRPCServer() *grpc.Server {
+	server := grpc.NewServer()
+	uploadspb.RegisterUploadsServer(server, &grpcServer{fm: fm})
+	return server
+}
+
+// serveGRPC serves server on grpc_port until it is stopped.
+func (fm *FileManager) serveGRPC(server *grpc.Server) error {
+	lis, err := net.Listen("tcp", ":"+fm.config().GRPCPort)
+	if err != nil {
+		return err
+	}
+	return server.Serve(lis)
+}
+
+// requireAdmin checks the per-RPC bearer token against the admin password,
+// mirroring requireRole for HTTP. Only admin_password is accepted, so gRPC
+// callers act as owners.
+func (s *grpcServer) requireAdmin(ctx context.Context) error {
+	if !s.fm.config().RequirePassword {
+		return nil
+	}
+	if s.tokenThrottled(ctx) {
+		return status.Error(codes.ResourceExhausted, "too many failed logins")
+	}
+	if s.hasAdminToken(ctx) {
+		return nil
+	}
+	return status.Error(codes.Unauthenticated, "admin token required")
+}
+
+// hasAdminToken reports whether the call carries the admin password as a
+// bearer token, regardless of require_password. Wrong tokens count against
+// login_rate_limit for the peer's address like failed sign-ins, and once it
+// is reached no token from that address is checked until the minute is
+// over.
+func (s *grpcServer) hasAdminToken(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var tokens []string
+	for _, value := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(value, "Bearer "); ok {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 || s.tokenThrottled(ctx) {
+		return false
+	}
+	for _, token := range tokens {
+		if s.fm.adminPasswordMatches(token) {
+			return true
+		}
+	}
+	if limit := s.fm.config().LoginRateLimit; limit > 0 {
+		addr := peerHost(ctx)
+		if ok, _ := s.fm.loginLimiter.allow(addr, limit, time.Now()); !ok {
+			log.Printf("Too many failed logins from %s", addr)
+		}
+	}
+	return false
+}
+
+// tokenThrottled reports whether the peer has used up login_rate_limit.
+func (s *grpcServer) tokenThrottled(ctx context.Context) bool {
+	limit := s.fm.config().LoginRateLimit
+	if limit == 0 {
+		return false
+	}
+	throttled, _ := s.fm.loginLimiter.exhausted(peerHost(ctx), limit, time.Now())
+	return throttled
+}
+
+// peerHost is the address of the caller without its port, as clientIP is
+// for HTTP.
+func peerHost(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return uploaderHost(p.Addr.String())
+	}
+	return ""
+}
+
+func (s *grpcServer) toProto(fileInfo *FileInfo) *uploadspb.FileInfo {
+	info := &uploadspb.FileInfo{
+		Id:           fileInfo.ID,
+		Filename:     fileInfo.Filename,
+		OriginalName: fileInfo.OriginalName,
+		Size:         fileInfo.Size,
+		ContentType:  fileInfo.effectiveContentType(),
+		Checksum:     fileInfo.Checksum,
+		UploadTime:   timestamppb.New(fileInfo.UploadTime),
+		ExpiresAt:    timestamppb.New(fileInfo.ExpiresAt),
+		Downloads:    int32(fileInfo.Downloads),
+		MaxDownloads: int32(fileInfo.MaxDownloads),
+		Description:  fileInfo.Description,
+		Tags:         fileInfo.Tags,
+		Metadata:     fileInfo.Metadata,
+	}
+	if s.fm.config().BaseURL != "" {
+		info.DownloadUrl = s.fm.withPathPrefix(strings.TrimSuffix(s.fm.config().BaseURL, "/")) + "/download/" + fileInfo.ID
+	}
+	return info
+}
+
+// chunkReader adapts the client stream's chunk messages to an io.Reader.
+type chunkReader struct {
+	stream uploadspb.Uploads_UploadFileServer
+	buf    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		msg, err := c.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		c.buf = msg.GetChunk()
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (s *grpcServer) UploadFile(stream uploadspb.Uploads_UploadFileServer) error {
+	// gRPC has no API keys, so strict mode takes the admin token
+	if s.fm.config().Strict && !s.hasAdminToken(stream.Context()) {
+		return status.Error(codes.Unauthenticated, errUploadKeyRequired.Error())
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	meta := first.GetMetadata()
+	if meta == nil {
+		return status.Error(codes.InvalidArgument, "first message must carry upload metadata")
+	}
+
+	if !s.fm.typeAllowed(meta.ContentType) {
+		return status.Error(codes.InvalidArgument, "file type not allowed")
+	}
+
+	ttl := ttlResolution{s.fm.config().DefaultTTL, ttlDefault}
+	if meta.TtlSeconds > 0 {
+		ttl = ttlResolution{time.Duration(meta.TtlSeconds) * time.Second, ttlExplicit}
+	}
+
+	fileMetadata := make(map[string]string, len(meta.Metadata))
+	for k, v := range meta.Metadata {
+		fileMetadata[k] = v
+	}
+	if violations := s.fm.validateMetadata(fileMetadata, meta.Tags); len(violations) > 0 {
+		return status.Error(codes.InvalidArgument, "metadata validation failed: "+strings.Join(violations, "; "))
+	}
+
+	uploaderIP := peerHost(stream.Context())
+
+	// The size, if known, travels as x-upload-size metadata
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	var size int64
+	if values := md.Get("x-upload-size"); len(values) > 0 {
+		size, _ = strconv.ParseInt(values[0], 10, 64)
+	}
+	reservation, err := s.fm.reserveStorage(size)
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	defer s.fm.releaseStorage(reservation)
+
+	fileInfo, err := s.fm.storeFile(stream.Context(), &chunkReader{stream: stream}, uploadRequest{
+		Filename:     meta.Filename,
+		ContentType:  meta.ContentType,
+		TTL:          ttl.TTL,
+		TTLSource:    ttl.Source,
+		MaxDownloads: int(meta.MaxDownloads),
+		Password:     meta.Password,
+		Description:  meta.Description,
+		Tags:         meta.Tags,
+		Metadata:     fileMetadata,
+		UploaderIP:   uploaderIP,
+		Reservation:  reservation,
+	})
+	if errors.Is(err, errFileTooLarge) {
+		return status.Error(codes.ResourceExhausted, "file too large")
+	}
+	if isDiskFull(err) || errors.Is(err, errStorageFull) {
+		return status.Error(codes.ResourceExhausted, "insufficient storage")
+	}
+	if errors.Is(err, errTypeMismatch) || errors.Is(err, errTypeNotAllowed) || errors.Is(err, errPathTooLong) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if errors.Is(err, errBlockedContent) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if clientGone(stream.Context(), err) {
+		s.fm.transfers.abortedUploads.Add(1)
+		return status.FromContextError(stream.Context().Err()).Err()
+	}
+	if err != nil {
+		return status.Error(codes.Internal, "server error")
+	}
+
+	return stream.SendAndClose(s.toProto(fileInfo))
+}
+
+func (s *grpcServer) DownloadFile(req *uploadspb.DownloadFileRequest, stream uploadspb.Uploads_DownloadFileServer) error {
+	// Passwords of protected tags travel as x-tag-password metadata
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	fileInfo, last, err := s.fm.claimDownload(req.Id, downloadCredentials{
+		Password:     req.Password,
+		TagPasswords: md.Get("x-tag-password"),
+		Admin:        s.hasAdminToken(stream.Context()),
+	})
+
+	event := ActivityEvent{Type: "download", FileID: req.Id, Outcome: "ok"}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		event.Actor = p.Addr.String()
+	}
+	if err != nil {
+		event.Outcome = downloadOutcome(err)
+	} else {
+		event.Filename = fileInfo.OriginalName
+	}
+	s.fm.activity.record(event)
+
+	switch err {
+	case nil:
+	case errFileNotFound, errFileExpired:
+		return status.Error(codes.NotFound, err.Error())
+	case errPasswordRequired, errTagPasswordRequired:
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errPasswordIncorrect:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errDownloadLimit, errRecipientCollected:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errRecipientRequired:
+		// Recipients collect files over HTTP, where completion is known
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	completed := false
+	defer func() { s.fm.finishDownload(fileInfo, last && completed) }()
+
+	f, err := s.fm.openContent(fileInfo)
+	if err != nil {
+		return status.Error(codes.Internal, "server error")
+	}
+	defer f.Close()
+	if err := s.fm.checkStoredSize(fileInfo, f); err != nil {
+		return status.Error(codes.DataLoss, err.Error())
+	}
+
+	if err := stream.Send(&uploadspb.DownloadFileResponse{
+		Data: &uploadspb.DownloadFileResponse_Info{Info: s.toProto(fileInfo)},
+	}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&uploadspb.DownloadFileResponse{
+				Data: &uploadspb.DownloadFileResponse_Chunk{Chunk: buf[:n]},
+			}); err != nil {
+				if stream.Context().Err() != nil {
+					s.fm.transfers.abortedDownloads.Add(1)
+				}
+				return err
+			}
+		}
+		if err == io.EOF {
+			completed = true
+			return nil
+		}
+		if err != nil {
+			return status.Error(codes.Internal, "server error")
+		}
+	}
+}
+
+// GetInfo answers with a file's details. Files with a protected tag are
+// left out as in ListFiles, and reported as not found, unless the call
+// carries the admin token.
+func (s *grpcServer) GetInfo(ctx context.Context, req *uploadspb.GetInfoRequest) (*uploadspb.FileInfo, error) {
+	var hidden tagRules
+	if !s.hasAdminToken(ctx) {
+		hidden = s.fm.tagRules()
+	}
+
+	s.fm.mutex.RLock()
+	defer s.fm.mutex.RUnlock()
+
+	fileInfo, exists := s.fm.files[req.Id]
+	if !exists || hidden.protects(fileInfo.Tags) {
+		return nil, status.Error(codes.NotFound, "file not found")
+	}
+	return s.toProto(fileInfo), nil
+}
+
+func (s *grpcServer) ListFiles(ctx context.Context, req *uploadspb.ListFilesRequest) (*uploadspb.ListFilesResponse, error) {
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	limit := 50 // default limit, as for /api/files
+	if req.Limit > 0 && req.Limit <= 1000 {
+		limit = int(req.Limit)
+	}
+	offset := 0
+	if req.Offset > 0 {
+		offset = int(req.Offset)
+	}
+
+	var hidden tagRules
+	if !s.hasAdminToken(ctx) {
+		hidden = s.fm.tagRules()
+	}
+
+	s.fm.mutex.RLock()
+	files := make([]*FileInfo, 0, len(s.fm.files))
+	for _, fileInfo := range s.fm.files {
+		if fileInfo.Status() != StatusExpired && !hidden.protects(fileInfo.Tags) {
+			files = append(files, fileInfo)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].UploadTime.After(files[j].UploadTime)
+	})
+
+	resp := &uploadspb.ListFilesResponse{Total: int32(len(files))}
+	for i := offset; i < len(files) && i < offset+limit; i++ {
+		resp.Files = append(resp.Files, s.toProto(files[i]))
+	}
+	s.fm.mutex.RUnlock()
+
+	return resp, nil
+}
+
+func (s *grpcServer) DeleteFile(ctx context.Context, req *uploadspb.DeleteFileRequest) (*uploadspb.DeleteFileResponse, error) {
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if !s.fm.removeFile(nil, req.Id) {
+		return nil, status.Error(codes.NotFound, "file not found")
+	}
+	return &uploadspb.DeleteFileResponse{Deleted: true}, nil
+}
+
+func (s *grpcServer) GetStats(ctx context.Context, req *uploadspb.GetStatsRequest) (*uploadspb.Stats, error) {
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	stats := s.fm.computeStats(statsFilter{})
+	return &uploadspb.Stats{
+		TotalFiles:     int32(stats.TotalFiles),
+		TotalSize:      stats.TotalSize,
+		TotalDownloads: int32(stats.TotalDownloads),
+		ActiveFiles:    int32(stats.ActiveFiles),
+	}, nil
+}
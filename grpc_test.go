@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"uploads/uploadspb"
+)
+
+// newTestGRPC serves fm's gRPC API on a loopback port and returns a client
+// for it, both stopped when the test ends.
+func newTestGRPC(t *testing.T, fm *FileManager) uploadspb.UploadsClient {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fm.newGRPCServer()
+	go server.Serve(lis)
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+	return uploadspb.NewUploadsClient(conn)
+}
+
+// withToken returns ctx carrying token as the bearer token of calls.
+func withToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+func TestGRPCAdminTokenThrottled(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) {
+		c.RequirePassword = true
+		c.AdminPassword = "secret"
+		c.LoginRateLimit = 2
+	})
+	defer fm.Close()
+	client := newTestGRPC(t, fm)
+	ctx := context.Background()
+
+	if _, err := client.GetStats(withToken(ctx, "secret"), &uploadspb.GetStatsRequest{}); err != nil {
+		t.Fatalf("GetStats with the admin token: %v", err)
+	}
+	for i := range 2 {
+		_, err := client.GetStats(withToken(ctx, "guess"), &uploadspb.GetStatsRequest{})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("wrong token %d: %v, want Unauthenticated", i+1, err)
+		}
+	}
+	// The limit is used up, so even the right token isn't checked
+	_, err := client.GetStats(withToken(ctx, "secret"), &uploadspb.GetStatsRequest{})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("admin token after the limit: %v, want ResourceExhausted", err)
+	}
+	// Shared with HTTP sign-ins from the same address
+	if throttled, _ := fm.loginLimiter.exhausted("127.0.0.1", 2, time.Now()); !throttled {
+		t.Error("failed gRPC tokens not counted against the address")
+	}
+}
+
+// grpcUpload is how a client uploads over gRPC: the metadata first, then the
+// content in chunks.
+func grpcUpload(ctx context.Context, client uploadspb.UploadsClient, meta *uploadspb.UploadMetadata, content []byte) (*uploadspb.FileInfo, error) {
+	stream, err := client.UploadFile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&uploadspb.UploadFileRequest{Data: &uploadspb.UploadFileRequest_Metadata{Metadata: meta}}); err != nil {
+		return nil, err
+	}
+	for chunk := range slices.Chunk(content, 32<<10) {
+		if err := stream.Send(&uploadspb.UploadFileRequest{Data: &uploadspb.UploadFileRequest_Chunk{Chunk: chunk}}); err != nil {
+			break // the server's answer says why
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+// grpcDownload is how a client downloads over gRPC: the FileInfo first, then
+// the content in chunks.
+func grpcDownload(ctx context.Context, client uploadspb.UploadsClient, req *uploadspb.DownloadFileRequest) (*uploadspb.FileInfo, []byte, error) {
+	stream, err := client.DownloadFile(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	var info *uploadspb.FileInfo
+	var content []byte
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return info, content, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if msg.GetInfo() != nil {
+			info = msg.GetInfo()
+		}
+		content = append(content, msg.GetChunk()...)
+	}
+}
+
+// testContent is n bytes that differ at every position within a chunk.
+func testContent(n int) []byte {
+	content := make([]byte, n)
+	for i := range content {
+		content[i] = byte(i * 31 >> 3)
+	}
+	return content
+}
+
+func TestGRPCUploadDownloadsOverHTTP(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) { c.DefaultTTL = 2 * time.Hour })
+	client := newTestGRPC(t, fm)
+	ctx := context.Background()
+	content := testContent(300 << 10)
+
+	info, err := grpcUpload(ctx, client, &uploadspb.UploadMetadata{Filename: "data.bin", Tags: []string{"grpc"}}, content)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if info.Size != int64(len(content)) || info.OriginalName != "data.bin" {
+		t.Errorf("UploadFile answered %v", info)
+	}
+	// The same TTL default as over HTTP
+	if ttl := info.ExpiresAt.AsTime().Sub(info.UploadTime.AsTime()).Round(time.Second); ttl != 2*time.Hour {
+		t.Errorf("TTL %v, want the default of 2h", ttl)
+	}
+
+	resp, err := http.Get(server.URL + "/download/" + info.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(downloaded, content) {
+		t.Fatalf("HTTP download: status %d, %d bytes, want the %d uploaded", resp.StatusCode, len(downloaded), len(content))
+	}
+	sum := sha256.Sum256(content)
+	if info.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum %q, want the SHA-256 of the content", info.Checksum)
+	}
+}
+
+func TestHTTPUploadDownloadsOverGRPC(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	client := newTestGRPC(t, fm)
+	content := testContent(200 << 10)
+
+	code, uploaded := uploadTestFile(t, server, "report.bin", content, url.Values{"password": {"hunter2"}})
+	if code != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", code, uploaded)
+	}
+	id := uploaded["id"].(string)
+
+	_, _, err := grpcDownload(context.Background(), client, &uploadspb.DownloadFileRequest{Id: id})
+	if status.Code(err) != codes.PermissionDenied && status.Code(err) != codes.Unauthenticated {
+		t.Errorf("DownloadFile without the password: %v", err)
+	}
+	info, downloaded, err := grpcDownload(context.Background(), client, &uploadspb.DownloadFileRequest{Id: id, Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	if info.GetId() != id || !bytes.Equal(downloaded, content) {
+		t.Fatalf("DownloadFile: info %v, %d bytes, want the %d uploaded", info, len(downloaded), len(content))
+	}
+	if _, body := getJSON(t, server, "/info/"+id); body["downloads"] != 1.0 {
+		t.Errorf("downloads after the gRPC download = %v, want 1", body["downloads"])
+	}
+}
+
+func TestGRPCUploadSizeLimit(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) { c.MaxFileSize = 64 << 10 })
+	defer fm.Close()
+	client := newTestGRPC(t, fm)
+
+	_, err := grpcUpload(context.Background(), client, &uploadspb.UploadMetadata{Filename: "big.bin"}, testContent(100<<10))
+	if code := status.Code(err); code != codes.InvalidArgument && code != codes.ResourceExhausted {
+		t.Errorf("upload over max_file_size: %v", err)
+	}
+	fm.mutex.RLock()
+	files := len(fm.files)
+	fm.mutex.RUnlock()
+	if files != 0 {
+		t.Errorf("%d files stored after a refused upload", files)
+	}
+}
+
+func TestGRPCGetInfoHidesProtectedTags(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) {
+		c.AdminPassword = "secret"
+		c.TagPasswords = map[string]string{"legal": "objection"}
+	})
+	defer fm.Close()
+	client := newTestGRPC(t, fm)
+	ctx := context.Background()
+
+	open, err := grpcUpload(ctx, client, &uploadspb.UploadMetadata{Filename: "open.txt"}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected, err := grpcUpload(ctx, client, &uploadspb.UploadMetadata{Filename: "brief.txt", Tags: []string{"legal"}}, []byte("privileged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.GetInfo(ctx, &uploadspb.GetInfoRequest{Id: open.Id}); err != nil {
+		t.Errorf("GetInfo of an unprotected file: %v", err)
+	}
+	if _, err := client.GetInfo(ctx, &uploadspb.GetInfoRequest{Id: protected.Id}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetInfo of a protected file without the admin token: %v, want NotFound", err)
+	}
+	if info, err := client.GetInfo(withToken(ctx, "secret"), &uploadspb.GetInfoRequest{Id: protected.Id}); err != nil || info.Id != protected.Id {
+		t.Errorf("GetInfo of a protected file with the admin token: %v, %v", info, err)
+	}
+
+	list, err := client.ListFiles(ctx, &uploadspb.ListFilesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 1 || list.Files[0].Id != open.Id {
+		t.Errorf("ListFiles without the admin token: %v", list)
+	}
+}
+
+func TestHTTPInfoHidesProtectedFiles(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.AdminPassword = "secret"
+		c.TagPasswords = map[string]string{"legal": "objection"}
+	})
+	client := newTestGRPC(t, fm)
+	fm.apiKeys.mutex.Lock()
+	fm.apiKeys.keys[hashAPIKey("upk_ci")] = &APIKey{ID: "ci", Scopes: []string{scopeDownload}, Tag: "ci"}
+	fm.apiKeys.mutex.Unlock()
+
+	upload := func(name string, tags string) string {
+		status, body := uploadTestFile(t, server, name, []byte("content"), url.Values{"tags": {tags}})
+		if status != http.StatusOK {
+			t.Fatalf("upload %s: status %d, body %v", name, status, body)
+		}
+		return body["id"].(string)
+	}
+	open, protected, build := upload("open.txt", ""), upload("brief.txt", "legal"), upload("build.log", "ci")
+
+	info := func(method, id string, header http.Header) int {
+		req, _ := http.NewRequest(method, server.URL+"/info/"+id, nil)
+		for name := range header {
+			req.Header.Set(name, header.Get(name))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	admin := http.Header{"Authorization": {"Bearer secret"}}
+	ciKey := http.Header{"X-Api-Key": {"upk_ci"}}
+	for _, tc := range []struct {
+		name   string
+		id     string
+		header http.Header
+		want   int
+	}{
+		{"unprotected", open, nil, http.StatusOK},
+		{"protected tag", protected, nil, http.StatusNotFound},
+		{"protected tag as admin", protected, admin, http.StatusOK},
+		{"other tag than the key's", open, ciKey, http.StatusNotFound},
+		{"the key's tag", build, ciKey, http.StatusOK},
+	} {
+		for _, method := range []string{"GET", "HEAD"} {
+			if got := info(method, tc.id, tc.header); got != tc.want {
+				t.Errorf("%s /info of %s: status %d, want %d", method, tc.name, got, tc.want)
+			}
+		}
+	}
+
+	// gRPC agrees on the protected tag
+	if _, err := client.GetInfo(context.Background(), &uploadspb.GetInfoRequest{Id: protected}); status.Code(err) != codes.NotFound {
+		t.Errorf("gRPC GetInfo of the protected file: %v, want NotFound", err)
+	}
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/files/info", bytes.NewReader([]byte(`{"file_ids":["`+open+`","`+protected+`"]}`)))
+	if code, body := doJSON(t, req); code != http.StatusOK || len(body["not_found"].([]interface{})) != 1 || body["not_found"].([]interface{})[0] != protected {
+		t.Errorf("batch info: status %d, body %v, want the protected file not found", code, body)
+	}
+}
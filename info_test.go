@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// headInfo sends HEAD /info/{id} and returns the response with its body read.
+func headInfo(t *testing.T, server *httptest.Server, id string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest("HEAD", server.URL+"/info/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+func TestHeadInfoMatchesGet(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+
+	status, uploaded := uploadTestFile(t, server, "report.txt", []byte("quarterly numbers"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+
+	check := func(when string) {
+		t.Helper()
+		status, info := getJSON(t, server, "/info/"+id)
+		if status != http.StatusOK {
+			t.Fatalf("%s: GET /info: status %d, body %v", when, status, info)
+		}
+		resp, body := headInfo(t, server, id)
+		if resp.StatusCode != http.StatusOK || len(body) != 0 {
+			t.Fatalf("%s: HEAD /info: status %d, body %q", when, resp.StatusCode, body)
+		}
+		want := map[string]string{
+			"X-File-Size":  strconv.FormatFloat(info["size"].(float64), 'f', -1, 64),
+			"X-Expires-At": info["expires_at"].(string),
+			"X-Downloads":  strconv.FormatFloat(info["downloads"].(float64), 'f', -1, 64),
+			"X-Status":     info["status"].(string),
+		}
+		for name, value := range want {
+			if got := resp.Header.Get(name); got != value {
+				t.Errorf("%s: %s = %q, want %q as in GET", when, name, got, value)
+			}
+		}
+		if len(want) != len(infoHeaders) {
+			t.Errorf("%s: checked %d headers, infoHeaders has %d", when, len(want), len(infoHeaders))
+		}
+	}
+	check("after upload")
+
+	resp, err := http.Get(server.URL + "/download/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	check("after a download")
+
+	// Missing files answer like GET, without the headers
+	fm.removeFile(httptest.NewRequest("DELETE", "/delete/"+id, nil), id)
+	for _, missing := range []string{id, "doesnotexist"} {
+		getStatus, _ := getJSON(t, server, "/info/"+missing)
+		resp, body := headInfo(t, server, missing)
+		if resp.StatusCode != getStatus || len(body) != 0 {
+			t.Errorf("HEAD /info/%s: status %d, body %q; GET answered %d", missing, resp.StatusCode, body, getStatus)
+		}
+		for name := range infoHeaders {
+			if value := resp.Header.Get(name); value != "" {
+				t.Errorf("HEAD /info/%s: %s = %q, want none", missing, name, value)
+			}
+		}
+	}
+	if resp, _ := headInfo(t, server, "doesnotexist"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD of an unknown ID: status %d, want 404", resp.StatusCode)
+	}
+}
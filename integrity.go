@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	jobRunners["verify"] = runVerify
+}
+
+// integrityKey is the metadata key of the problem found with a file's stored
+// content, set by downloads and the verify job and cleared by the latter.
+const integrityKey = "integrity_error"
+
+var errIntegrity = errors.New("stored file failed an integrity check")
+
+// checkStoredSize compares the size of the open content src with the
+// metadata of fileInfo before a download. A mismatch flags the file and
+// notifies the webhook once, and is returned as errIntegrity unless
+// serve_on_size_mismatch is on. Files open for appends are skipped, since
+// their size moves.
+func (fm *FileManager) checkStoredSize(fileInfo *FileInfo, src File) error {
+	if src == nil || fileInfo.Appendable {
+		return nil
+	}
+	stat, err := src.Stat()
+	if err != nil || stat.Size() == fileInfo.Size {
+		return nil
+	}
+	problem := fmt.Sprintf("size mismatch: expected %d bytes, found %d", fileInfo.Size, stat.Size())
+	if fm.flagIntegrity(fileInfo, problem) {
+		fm.requestSave()
+	}
+	if fm.config().ServeOnSizeMismatch {
+		return nil
+	}
+	return errIntegrity
+}
+
+// flagIntegrity records problem on fileInfo and reports whether it is new.
+// New problems are logged and sent to the webhook as integrity_error.
+func (fm *FileManager) flagIntegrity(fileInfo *FileInfo, problem string) bool {
+	fm.mutex.Lock()
+	if fileInfo.Metadata[integrityKey] == problem {
+		fm.mutex.Unlock()
+		return false
+	}
+	if fileInfo.Metadata == nil {
+		fileInfo.Metadata = make(map[string]string)
+	}
+	fileInfo.Metadata[integrityKey] = problem
+	fm.recordChange(changeUpdated, fileInfo.ID, fileInfo)
+	fm.mutex.Unlock()
+
+	log.Printf("Integrity problem with %s (%s): %s", fileInfo.ID, fileInfo.OriginalName, problem)
+	fm.notifyFile("integrity_error", fileInfo, map[string]interface{}{
+		"file_id":  fileInfo.ID,
+		"filename": fileInfo.OriginalName,
+		"problem":  problem,
+	})
+	return true
+}
+
+// sizeMismatched reports whether fileInfo is flagged for a size mismatch,
+// so the checksum it was uploaded with no longer describes what is served.
+func (fm *FileManager) sizeMismatched(fileInfo *FileInfo) bool {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	return strings.HasPrefix(fileInfo.Metadata[integrityKey], "size mismatch")
+}
+
+// clearIntegrity removes the integrity flag of fileInfo, if any.
+func (fm *FileManager) clearIntegrity(fileInfo *FileInfo) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	if _, flagged := fileInfo.Metadata[integrityKey]; flagged {
+		delete(fileInfo.Metadata, integrityKey)
+		fm.recordChange(changeUpdated, fileInfo.ID, fileInfo)
+	}
+}
+
+// runVerify checks the stored content of every file against its metadata:
+// the size always, and with checksums=true the checksum as well, read at
+// rehash_bytes_per_second. Files that pass lose their integrity flag, the
+// others are flagged.
+func runVerify(fm *FileManager, job *Job, params map[string]string) error {
+	checksums := params["checksums"] == "true"
+	algorithm := fm.config().ChecksumAlgorithm
+
+	fm.mutex.RLock()
+	var targets []*FileInfo
+	for _, fileInfo := range fm.files {
+		if !fileInfo.isLink() && !fileInfo.Appendable {
+			targets = append(targets, fileInfo)
+		}
+	}
+	fm.mutex.RUnlock()
+
+	job.setTotal(len(targets))
+	for _, fileInfo := range targets {
+		fm.mutex.RLock()
+		store, key, size, checksum := fm.contentStorage(fileInfo), fileInfo.StorageKey, fileInfo.Size, fileInfo.Checksum
+		fm.mutex.RUnlock()
+
+		problem := ""
+		stat, err := store.Stat(key)
+		switch {
+		case err != nil:
+			problem = "content missing: " + err.Error()
+		case stat.Size() != size:
+			problem = fmt.Sprintf("size mismatch: expected %d bytes, found %d", size, stat.Size())
+		case checksums && checksumAlgorithm(checksum) == algorithm:
+			actual, err := fm.rehashFile(store, key, fm.config().RehashBytesPerSecond)
+			if err != nil {
+				job.advance(err)
+				continue
+			}
+			if actual != checksum {
+				problem = "checksum mismatch: found " + actual
+			}
+		}
+		if problem != "" {
+			fm.flagIntegrity(fileInfo, problem)
+		} else {
+			fm.clearIntegrity(fileInfo)
+		}
+		job.advance(nil)
+	}
+	return fm.saveMetadata()
+}
+
+func (fm *FileManager) startVerify(w http.ResponseWriter, r *http.Request) {
+	job := fm.startJob("verify", map[string]string{
+		"checksums": r.URL.Query().Get("checksums"),
+	})
+	fm.writeJobAccepted(w, job)
+}
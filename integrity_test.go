@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replaceStored overwrites the stored content of id behind the server's
+// back.
+func replaceStored(t *testing.T, fm *FileManager, id string, content []byte) {
+	t.Helper()
+	fm.mutex.RLock()
+	fileInfo := fm.files[id]
+	store, key := fm.contentStorage(fileInfo), fileInfo.StorageKey
+	fm.mutex.RUnlock()
+	f, err := store.OpenFile(key, os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runJob starts an admin job with a POST to path and waits for it to end.
+func runJob(t *testing.T, server *httptest.Server, path string) map[string]interface{} {
+	t.Helper()
+	req, _ := http.NewRequest("POST", server.URL+path, nil)
+	status, job := doJSON(t, req)
+	if status != http.StatusAccepted {
+		t.Fatalf("starting %s: status %d, body %v", path, status, job)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for job["status"] == "running" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, job = getJSON(t, server, "/api/admin/jobs/"+job["id"].(string))
+	}
+	if job["status"] != "completed" {
+		t.Fatalf("job %v", job)
+	}
+	return job
+}
+
+func integrityFlag(t *testing.T, server *httptest.Server, id string) string {
+	t.Helper()
+	_, info := getJSON(t, server, "/info/"+id)
+	metadata, _ := info["metadata"].(map[string]interface{})
+	flag, _ := metadata[integrityKey].(string)
+	return flag
+}
+
+func TestTruncatedFileRefused(t *testing.T) {
+	events := make(chan map[string]interface{}, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		events <- payload
+	}))
+	defer webhook.Close()
+	fm, server := newTestServer(t, func(c *Config) { c.NotifyWebhookURL = webhook.URL })
+
+	content := testContent(4096)
+	status, body := uploadTestFile(t, server, "data.bin", content, nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+	for len(events) > 0 {
+		<-events
+	}
+	replaceStored(t, fm, id, content[:100])
+
+	// Both attempts are refused, and only the first one notifies
+	for attempt := 1; attempt <= 2; attempt++ {
+		req, _ := http.NewRequest("GET", server.URL+"/download/"+id, nil)
+		req.Header.Set("Accept", "application/json")
+		status, problem := doJSON(t, req)
+		if status != http.StatusInternalServerError || problem["code"] != "integrity_error" {
+			t.Fatalf("download %d of a truncated file: status %d, body %v, want 500 integrity_error", attempt, status, problem)
+		}
+	}
+	select {
+	case payload := <-events:
+		details, _ := payload["details"].(map[string]interface{})
+		if payload["event"] != "integrity_error" || details["problem"] != "size mismatch: expected 4096 bytes, found 100" {
+			t.Errorf("notification %v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no integrity_error notification")
+	}
+	select {
+	case payload := <-events:
+		t.Errorf("notified again: %v", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if flag := integrityFlag(t, server, id); flag != "size mismatch: expected 4096 bytes, found 100" {
+		t.Fatalf("flag %q", flag)
+	}
+	fm.mutex.RLock()
+	downloads := fm.files[id].Downloads
+	fm.mutex.RUnlock()
+	if downloads != 0 {
+		t.Errorf("refused downloads counted: %d", downloads)
+	}
+
+	// The verify job confirms the flag while the size is wrong and clears it
+	// once the content is back
+	runJob(t, server, "/api/admin/verify")
+	if flag := integrityFlag(t, server, id); !strings.HasPrefix(flag, "size mismatch") {
+		t.Fatalf("flag after verifying the truncated file: %q", flag)
+	}
+	replaceStored(t, fm, id, content)
+	runJob(t, server, "/api/admin/verify?checksums=true")
+	if flag := integrityFlag(t, server, id); flag != "" {
+		t.Fatalf("flag after verifying the restored file: %q", flag)
+	}
+	resp, err := http.Get(server.URL + "/download/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, content) || resp.Header.Get("X-Checksum") != body["checksum"] {
+		t.Fatalf("download of the restored file: status %d, X-Checksum %q", resp.StatusCode, resp.Header.Get("X-Checksum"))
+	}
+
+	// Content of the right size but the wrong bytes takes checksums=true
+	replaceStored(t, fm, id, bytes.Repeat([]byte("z"), len(content)))
+	runJob(t, server, "/api/admin/verify")
+	if flag := integrityFlag(t, server, id); flag != "" {
+		t.Fatalf("size-only verify flagged %q", flag)
+	}
+	runJob(t, server, "/api/admin/verify?checksums=true")
+	if flag := integrityFlag(t, server, id); !strings.HasPrefix(flag, "checksum mismatch") {
+		t.Fatalf("flag after verifying checksums: %q", flag)
+	}
+}
+
+func TestServeOnSizeMismatch(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) { c.ServeOnSizeMismatch = true })
+	content := testContent(4096)
+	status, body := uploadTestFile(t, server, "data.bin", content, nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+	replaceStored(t, fm, id, content[:100])
+
+	// Served as it is, without the checksum it no longer has
+	resp, err := http.Get(server.URL + "/download/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, content[:100]) || resp.Header.Get("X-Checksum") != "" {
+		t.Fatalf("download: status %d, %d bytes, X-Checksum %q", resp.StatusCode, len(got), resp.Header.Get("X-Checksum"))
+	}
+	if flag := integrityFlag(t, server, id); !strings.HasPrefix(flag, "size mismatch") {
+		t.Fatalf("served file not flagged: %q", flag)
+	}
+}
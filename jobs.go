@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job is a long-running admin task executed in the background. Progress is
+// reported through Total and Done.
+type Job struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Status     string    `json:"status"` // running, completed or failed
+	Total      int       `json:"total"`
+	Done       int       `json:"done"`
+	Failed     int       `json:"failed"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+
+	mutex sync.Mutex
+}
+
+func (j *Job) setTotal(total int) {
+	j.mutex.Lock()
+	j.Total = total
+	j.mutex.Unlock()
+}
+
+// advance records one processed item, successful or not.
+func (j *Job) advance(err error) {
+	j.mutex.Lock()
+	j.Done++
+	if err != nil {
+		j.Failed++
+	}
+	j.mutex.Unlock()
+}
+
+func (j *Job) snapshot() Job {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return Job{
+		ID:         j.ID,
+		Type:       j.Type,
+		Status:     j.Status,
+		Total:      j.Total,
+		Done:       j.Done,
+		Failed:     j.Failed,
+		Error:      j.Error,
+		StartedAt:  j.StartedAt,
+		FinishedAt: j.FinishedAt,
+	}
+}
+
+// pendingJob is the persisted record of a job that must be resumed if the
+// server restarts before it finishes.
+type pendingJob struct {
+	Type   string            `json:"type"`
+	Params map[string]string `json:"params"`
+}
+
+// jobRunners maps resumable job types to their implementation.
+var jobRunners = map[string]func(fm *FileManager, job *Job, params map[string]string) error{}
+
+func (fm *FileManager) jobStateFile() string {
+	return fm.config().MetadataFile + ".jobs"
+}
+
+func (fm *FileManager) savePendingJobs() {
+	fm.jobsMutex.Lock()
+	data, err := json.MarshalIndent(fm.pendingJobs, "", "  ")
+	fm.jobsMutex.Unlock()
+	if err != nil {
+		log.Printf("Error encoding job state: %v", err)
+		return
+	}
+	if err := fm.metadata.WriteFile(fm.jobStateFile(), data, 0644); err != nil {
+		log.Printf("Error saving job state: %v", err)
+	}
+}
+
+// resumeJobs restarts jobs that were still running when the server stopped.
+func (fm *FileManager) resumeJobs() {
+	data, err := fm.metadata.ReadFile(fm.jobStateFile())
+	if err != nil {
+		return
+	}
+
+	var pending map[string]pendingJob
+	if err := json.Unmarshal(data, &pending); err != nil {
+		log.Printf("Error loading job state: %v", err)
+		return
+	}
+
+	for _, p := range pending {
+		if jobRunners[p.Type] == nil {
+			log.Printf("Skipping unknown pending job type %q", p.Type)
+			continue
+		}
+		log.Printf("Resuming interrupted %s job", p.Type)
+		fm.startJob(p.Type, p.Params)
+	}
+}
+
+// startJob launches a registered job type in the background. The job is
+// detached from any request context so it outlives the triggering request.
+func (fm *FileManager) startJob(jobType string, params map[string]string) *Job {
+	job := &Job{
+		ID:        generateID(),
+		Type:      jobType,
+		Status:    "running",
+		StartedAt: time.Now(),
+	}
+
+	fm.jobsMutex.Lock()
+	fm.jobs[job.ID] = job
+	fm.pendingJobs[job.ID] = pendingJob{Type: jobType, Params: params}
+	fm.jobsMutex.Unlock()
+	fm.savePendingJobs()
+
+	go func() {
+		err := jobRunners[jobType](fm, job, params)
+
+		job.mutex.Lock()
+		job.FinishedAt = time.Now()
+		if err != nil {
+			job.Status = "failed"
+			job.Error = err.Error()
+		} else {
+			job.Status = "completed"
+		}
+		job.mutex.Unlock()
+
+		fm.jobsMutex.Lock()
+		delete(fm.pendingJobs, job.ID)
+		fm.jobsMutex.Unlock()
+		fm.savePendingJobs()
+
+		log.Printf("Job %s (%s) finished: %s", job.ID, jobType, job.snapshot().Status)
+	}()
+
+	return job
+}
+
+func (fm *FileManager) listJobs(w http.ResponseWriter, r *http.Request) {
+	fm.jobsMutex.Lock()
+	jobs := make([]Job, 0, len(fm.jobs))
+	for _, job := range fm.jobs {
+		jobs = append(jobs, job.snapshot())
+	}
+	fm.jobsMutex.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.After(jobs[j].StartedAt)
+	})
+
+	respondJSON(w, http.StatusOK, jobs)
+}
+
+func (fm *FileManager) getJob(w http.ResponseWriter, r *http.Request, jobID string) {
+	fm.jobsMutex.Lock()
+	job, exists := fm.jobs[jobID]
+	fm.jobsMutex.Unlock()
+
+	if !exists {
+		respondError(w, r, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, job.snapshot())
+}
+
+// jobRunning reports whether a job of jobType is still running.
+func (fm *FileManager) jobRunning(jobType string) bool {
+	fm.jobsMutex.Lock()
+	defer fm.jobsMutex.Unlock()
+	for _, p := range fm.pendingJobs {
+		if p.Type == jobType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJobAccepted answers a request that started a background job.
+func (fm *FileManager) writeJobAccepted(w http.ResponseWriter, job *Job) {
+	w.Header().Set("Location", fm.appPath("/api/admin/jobs/"+job.ID))
+	respondJSON(w, http.StatusAccepted, job.snapshot())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+var landingTemplate = template.Must(template.New("landing").Funcs(parseFuncs).Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.File.Label}}</title>
+    {{with .Preview}}
+    <meta property="og:type" content="website">
+    <meta property="og:url" content="{{.URL}}">
+    <meta property="og:title" content="{{.Title}}">
+    <meta property="og:description" content="{{.Description}}">
+    {{if .Image}}<meta property="og:image" content="{{.Image}}">{{end}}
+    <meta name="twitter:card" content="{{if .Image}}summary_large_image{{else}}summary{{end}}">
+    <meta name="twitter:title" content="{{.Title}}">
+    <meta name="twitter:description" content="{{.Description}}">
+    {{if .Image}}<meta name="twitter:image" content="{{.Image}}">{{end}}
+    {{end}}
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; background: #f5f5f5; }
+        .container { max-width: 600px; margin: 40px auto; background: white; padding: 30px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); }
+        h1 { color: #007bff; font-size: 1.5em; word-break: break-all; }
+        .meta { color: #666; margin: 15px 0; }
+        .meta div { margin: 5px 0; }
+        .checksum { font-family: monospace; font-size: 0.8em; word-break: break-all; }
+        .btn { background: #007bff; color: white; padding: 12px 24px; border: none; border-radius: 4px; cursor: pointer; text-decoration: none; display: inline-block; font-size: 1em; }
+        .btn:hover { background: #0056b3; }
+        input[type=password] { padding: 10px; border: 1px solid #ddd; border-radius: 4px; margin-right: 10px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.File.Label}}</h1>
+        {{if .File.Title}}<div class="meta">{{displayName .File.OriginalName}}</div>{{end}}
+        {{if .File.Description}}{{markdown .File.Description}}{{end}}
+        <div class="meta">
+            <div>Size: {{formatBytes .File.Size}}</div>
+            <div>Expires: {{expiryTime .File.ExpiresAt}} ({{expiresIn .File.ExpiresAt}})</div>
+            {{if gt .File.MaxDownloads 0}}<div>Downloads remaining: {{.Remaining}}</div>{{end}}
+            {{with .Collected}}<div>Recipients: {{.}}</div>{{end}}
+            <div class="checksum">Checksum: {{.File.Checksum}}</div>
+        </div>
+        {{if and .Collected (or (eq .File.Status "limit_reached") (eq .File.Status "limit_reached_grace"))}}
+        <p>All recipients have collected this file.</p>
+        {{else if or (eq .File.Status "limit_reached") (eq .File.Status "limit_reached_grace")}}
+        <p>This file has reached its download limit.</p>
+        {{else if .RecipientProblem}}
+        <p>{{.RecipientProblem}}</p>
+        {{else if or .File.Password .ProtectedBy}}
+        <form action="{{downloadURL .File.ID}}" method="get">
+            {{with .Recipient}}<input type="hidden" name="recipient" value="{{.}}">{{end}}
+            {{if .File.Password}}<input type="password" name="password" placeholder="Password" required>{{end}}
+            {{range .ProtectedBy}}<input type="password" name="tag_password" placeholder="Password for {{.}}" required>{{end}}
+            <input type="submit" value="Download" class="btn">
+        </form>
+        {{else}}
+        <a href="{{downloadURL .File.ID}}{{with .Recipient}}?recipient={{.}}{{end}}" class="btn">Download</a>
+        {{end}}
+    </div>
+</body>
+</html>`))
+
+// landingPage renders a human-friendly share page for a file, linking to the
+// direct download URL.
+func (fm *FileManager) landingPage(w http.ResponseWriter, r *http.Request) {
+	if parts, err := pathSegments(r, "/f/"); err == nil && len(parts) == 2 && parts[1] == "preview" {
+		fm.previewImage(w, r, parts[0])
+		return
+	}
+	fileID, err := pathID(r, "/f/")
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fm.mutex.RLock()
+	fileInfo, exists := fm.files[fileID]
+	fm.mutex.RUnlock()
+
+	if !exists {
+		if !fm.writeTombstone(w, r, fileID, true) {
+			fm.writeNotFound(w, r, fileID)
+		}
+		return
+	}
+	if fileInfo.Status() == StatusExpired {
+		writeDownloadError(w, r, errFileExpired)
+		return
+	}
+	if wantsJSON(r) {
+		respondJSON(w, http.StatusOK, fm.fileView(r, fileInfo))
+		return
+	}
+
+	creds := fm.credentialsFor(r)
+	data := struct {
+		File             *FileInfo
+		Remaining        int
+		Collected        string
+		Recipient        string
+		RecipientProblem string
+		Preview          *linkPreview
+		ProtectedBy      []string
+	}{
+		File:      fileInfo,
+		Remaining: fileInfo.MaxDownloads - fileInfo.Downloads,
+		Recipient: creds.Recipient,
+	}
+	fm.mutex.RLock()
+	data.Collected = fileInfo.collectionStatus()
+	if err := fileInfo.checkRecipient(creds); err != nil {
+		data.RecipientProblem = problemFor(err).Hint
+	}
+	fm.mutex.RUnlock()
+	if !fm.hasAdminCredentials(r) {
+		data.ProtectedBy = fm.tagRules().protecting(fileInfo.Tags).names()
+	}
+	if fm.config().LinkPreviews {
+		data.Preview = fm.previewFor(r, fileInfo)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	fm.renderHTML(w, r, landingTemplate, data)
+}
+
+// linkPreview holds the OpenGraph and Twitter card fields of a share page.
+type linkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	Image       string
+}
+
+// previewImageTypes are the image types unfurlers render; others, SVG above
+// all, aren't served inline from our origin.
+var previewImageTypes = map[string]bool{
+	"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true,
+}
+
+// maxPreviewImageSize is the largest image offered as a preview, the limit
+// of the strictest common unfurler.
+const maxPreviewImageSize = 5 << 20
+
+// previewImageType returns the content type fileInfo is served with from
+// /f/{id}/preview, or "" when it has no preview image. That route doesn't
+// count downloads, so files whose downloads are limited or collected by
+// recipients have none.
+func (fm *FileManager) previewImageType(fileInfo *FileInfo) string {
+	if !fm.config().LinkPreviews || fileInfo.Password != "" || fm.tagRules().protects(fileInfo.Tags) {
+		return ""
+	}
+	if fileInfo.MaxDownloads != 0 || fileInfo.hasRecipients() || fileInfo.isLink() ||
+		fileInfo.Size > maxPreviewImageSize || fm.forceOpaqueDownload(fileInfo) {
+		return ""
+	}
+	contentType, _, _ := strings.Cut(fileInfo.effectiveContentType(), ";")
+	if !previewImageTypes[contentType] {
+		return ""
+	}
+	return contentType
+}
+
+// previewImage serves the image of a share page's preview. Unfurlers fetch it
+// whenever a link is pasted, so unlike /download/{id} it isn't counted as a
+// download or recorded as one.
+func (fm *FileManager) previewImage(w http.ResponseWriter, r *http.Request, fileID string) {
+	fileInfo, src := fm.openStored(fileID)
+	if src != nil {
+		defer src.Close()
+	}
+	var contentType string
+	if fileInfo != nil && fileInfo.Status() == StatusActive {
+		contentType = fm.previewImageType(fileInfo)
+	}
+	if contentType == "" {
+		respondError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "inline")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	fm.serveStored(w, r, fileInfo, src)
+}
+
+// previewFor describes fileInfo for link unfurlers. Password-protected files
+// and files under protected tags get a generic preview that doesn't reveal
+// the name, description or size.
+func (fm *FileManager) previewFor(r *http.Request, fileInfo *FileInfo) *linkPreview {
+	preview := &linkPreview{URL: fm.landingURL(r, fileInfo.ID)}
+	if fileInfo.Password != "" || fm.tagRules().protects(fileInfo.Tags) {
+		preview.Title = "Protected file"
+		preview.Description = "This file is password protected."
+		return preview
+	}
+
+	preview.Title = fileInfo.Label()
+	preview.Description = formatBytes(fileInfo.Size)
+	if fileInfo.Description != "" {
+		preview.Description = fileInfo.Description + " · " + preview.Description
+	}
+	if fm.previewImageType(fileInfo) != "" {
+		preview.Image = fm.landingURL(r, fileInfo.ID) + "/preview"
+	}
+	return preview
+}
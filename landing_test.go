@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPreviewImageDoesNotCountDownloads(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	image := append([]byte("\x89PNG\r\n\x1a\n"), testContent(1000)...)
+	status, body := uploadTestFile(t, server, "photo.png", image, nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+
+	resp, err := http.Get(server.URL + "/f/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	preview := server.URL + "/f/" + id + "/preview"
+	if !strings.Contains(string(page), `<meta property="og:image" content="`+preview+`">`) {
+		t.Fatalf("share page lacks og:image %s:\n%s", preview, page)
+	}
+
+	// Each unfurler fetches the image when the link is pasted
+	for range 3 {
+		req, _ := http.NewRequest("GET", preview, nil)
+		req.Header.Set("User-Agent", "Slackbot-LinkExpanding 1.0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" || !bytes.Equal(got, image) {
+			t.Fatalf("preview: status %d, type %q, %d bytes", resp.StatusCode, resp.Header.Get("Content-Type"), len(got))
+		}
+	}
+	if _, info := getJSON(t, server, "/info/"+id); info["downloads"] != 0.0 {
+		t.Errorf("downloads after fetching the preview = %v, want 0", info["downloads"])
+	}
+}
+
+func TestPreviewImageWithheld(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	image := append([]byte("\x89PNG\r\n\x1a\n"), testContent(1000)...)
+	for name, upload := range map[string]struct {
+		filename string
+		content  []byte
+		fields   url.Values
+	}{
+		"download limit": {"photo.png", image, url.Values{"max_downloads": {"1"}}},
+		"password":       {"photo.png", image, url.Values{"password": {"hunter2"}}},
+		"svg":            {"drawing.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), nil},
+		"not an image":   {"notes.txt", []byte("content"), nil},
+	} {
+		status, body := uploadTestFile(t, server, upload.filename, upload.content, upload.fields)
+		if status != http.StatusOK {
+			t.Fatalf("%s: upload: status %d, body %v", name, status, body)
+		}
+		id := body["id"].(string)
+		resp, err := http.Get(server.URL + "/f/" + id + "/preview")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: preview status %d, want 404", name, resp.StatusCode)
+		}
+	}
+}
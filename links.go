@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isLink reports whether the file is an external link rather than stored
+// content. Links have no bytes on disk, and usually no size or checksum.
+func (f *FileInfo) isLink() bool {
+	return f.LinkTarget != ""
+}
+
+// createLink handles POST /api/links: it registers an external URL that
+// /download/{id} redirects to once the usual password, expiry and download
+// limit checks pass. It takes the same form fields as an upload, with url in
+// place of the file.
+func (fm *FileManager) createLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Anyone who can create links can make this service redirect anywhere
+	if !fm.requireRole(w, r, roleEditor) {
+		return
+	}
+	if err := limitForm(r, 0); err != nil {
+		respondFormError(w, r, err, "Invalid form")
+		return
+	}
+
+	target, err := url.Parse(r.FormValue("url"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		respondError(w, r, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+
+	tags := parseTags(r.FormValue("tags"))
+	metadata, err := parseMetadata(r.FormValue("metadata"))
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if violations := fm.validateMetadata(metadata, tags); len(violations) > 0 {
+		writeViolations(w, r, violations)
+		return
+	}
+	maxDownloads, _ := strconv.Atoi(r.FormValue("max_downloads"))
+	ttl, err := resolveTTL(r.FormValue("ttl"), fm.config().DefaultTTL)
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := fm.resolveExpiresAt(r.FormValue("expires_at"), &ttl)
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	password := r.FormValue("password")
+	if password != "" {
+		if password, err = hashFilePassword(password); err != nil {
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	fileID := generateID()
+	if id := r.FormValue("id"); id != "" {
+		if err := fm.checkCustomID(id); err != nil {
+			status := http.StatusConflict
+			if errors.Is(err, errInvalidID) {
+				status = http.StatusBadRequest
+			}
+			respondError(w, r, err.Error(), status)
+			return
+		}
+		fileID = id
+	}
+
+	name := r.FormValue("filename")
+	if name == "" {
+		name = target.Host + target.Path
+		if i := strings.LastIndex(target.Path, "/"); i >= 0 && i < len(target.Path)-1 {
+			name = target.Path[i+1:]
+		}
+	}
+
+	now := time.Now()
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(ttl.TTL).UTC()
+	}
+	fileInfo := &FileInfo{
+		ID:           fileID,
+		Filename:     sanitizeFilename(normalizeName(name)),
+		OriginalName: normalizeName(name),
+		ContentType:  r.FormValue("content_type"),
+		UploadTime:   now,
+		ExpiresAt:    expiresAt,
+		TTLSource:    ttl.Source,
+		MaxDownloads: maxDownloads,
+		Password:     password,
+		UploaderIP:   fm.clientIP(r),
+		Tags:         tags,
+		Description:  r.FormValue("description"),
+		Metadata:     metadata,
+		LinkTarget:   target.String(),
+	}
+	// Size and checksum are only known if the caller tells us
+	if size, err := strconv.ParseInt(r.FormValue("size"), 10, 64); err == nil && size >= 0 {
+		fileInfo.Size = size
+	}
+	fileInfo.Checksum = r.FormValue("checksum")
+
+	fm.mutex.Lock()
+	if _, taken := fm.files[fileID]; taken {
+		fm.mutex.Unlock()
+		respondError(w, r, errIDTaken.Error(), http.StatusConflict)
+		return
+	}
+	fm.files[fileID] = fileInfo
+	fm.recordChange(changeCreated, fileID, fileInfo)
+	fm.mutex.Unlock()
+	fm.requestSave()
+
+	fm.recordEvent(r, "upload", fileInfo, fileID, "ok")
+	fm.writeUploadResponse(w, r, fileInfo)
+}
+
+// linkLocation returns where a link download redirects to. With
+// link_signing_key set, the URL carries an expires timestamp and an
+// HMAC-SHA256 signature over "<path><expires>" so a CDN edge can refuse
+// requests that didn't come through this service.
+func (fm *FileManager) linkLocation(fileInfo *FileInfo) string {
+	if fm.config().LinkSigningKey == "" {
+		return fileInfo.LinkTarget
+	}
+	target, err := url.Parse(fileInfo.LinkTarget)
+	if err != nil {
+		return fileInfo.LinkTarget
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(fm.config().LinkSigningTTL).Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(fm.config().LinkSigningKey))
+	mac.Write([]byte(target.EscapedPath() + expires))
+
+	query := target.Query()
+	query.Set("expires", expires)
+	query.Set("signature", hex.EncodeToString(mac.Sum(nil)))
+	target.RawQuery = query.Encode()
+	return target.String()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+type unixConnKey struct{}
+
+// listen opens the HTTP listener: a socket inherited from systemd when
+// LISTEN_FDS is set for this process, a Unix domain socket for
+// "unix:/path" addresses, and TCP otherwise.
+func listen(config Config) (net.Listener, error) {
+	if l, err := systemdListener(); l != nil || err != nil {
+		return l, err
+	}
+
+	addr := config.Listen
+	if addr == "" {
+		addr = ":" + config.Port
+	}
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if config.SocketMode != "" {
+		mode, _ := strconv.ParseUint(config.SocketMode, 8, 32)
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// systemdListener returns the first socket passed in by systemd, or nil when
+// the process wasn't socket-activated.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	syscall.CloseOnExec(listenFDsStart)
+	f := os.NewFile(listenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket: %w", err)
+	}
+	return l, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run that
+// didn't shut down cleanly. A socket something is still listening on is an
+// error rather than being taken over.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// markUnixConn tags requests that arrived over a Unix domain socket. Such
+// peers are always a local proxy, so they are trusted like trusted_proxies.
+func markUnixConn(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := c.(*net.UnixConn); ok {
+		return context.WithValue(ctx, unixConnKey{}, true)
+	}
+	return ctx
+}
+
+func viaUnixSocket(r *http.Request) bool {
+	unix, _ := r.Context().Value(unixConnKey{}).(bool)
+	return unix
+}
+
+// minTransferRate is the slowest client, in bytes per second, the derived
+// read and write timeouts still let move a max_file_size file.
+const minTransferRate = 256 * 1024
+
+// newHTTPServer returns the server for handler with the configured
+// timeouts. read_timeout and write_timeout default to the time a
+// max_file_size upload or download takes at minTransferRate, and at least
+// five minutes.
+func newHTTPServer(config Config, handler http.Handler) *http.Server {
+	transfer := max(5*time.Minute, time.Duration(config.MaxFileSize/minTransferRate)*time.Second)
+	server := &http.Server{
+		Handler:           handler,
+		ConnContext:       markUnixConn,
+		ReadHeaderTimeout: 30 * time.Second,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	if server.ReadTimeout == 0 {
+		server.ReadTimeout = transfer
+	}
+	if server.WriteTimeout == 0 {
+		server.WriteTimeout = transfer
+	}
+	return server
+}
+
+// keepWriting lifts write_timeout for a response that may rightly outlast
+// it: event streams, and archives and cold-tier files, whose time isn't
+// bounded by a max_file_size transfer. Writers that can't set deadlines
+// are left as they are.
+func keepWriting(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActivityStreamOutlastsWriteTimeout(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) { c.WriteTimeout = 200 * time.Millisecond })
+	defer fm.Close()
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = newHTTPServer(*fm.config(), fm.Handler())
+	server.Config.RegisterOnShutdown(fm.activity.closeStreams)
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/admin/activity/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream: status %d", resp.StatusCode)
+	}
+
+	// Past write_timeout, events still get through
+	time.Sleep(500 * time.Millisecond)
+	if status, _ := uploadTestFile(t, server, "late.txt", []byte("late"), nil); status != http.StatusOK {
+		t.Fatalf("upload: status %d", status)
+	}
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	received := false
+	for line := range lines {
+		if strings.HasPrefix(line, "event: upload") {
+			received = true
+			break
+		}
+	}
+	if !received {
+		t.Fatal("stream ended before the upload event")
+	}
+
+	// Shutdown ends the stream instead of waiting for it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	started := time.Now()
+	if err := server.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("shutdown took %s with a stream open", elapsed)
+	}
+	for range lines {
+	}
+}
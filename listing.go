@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// listingLimiter caps unauthenticated listing requests per client IP using
+// fixed one-minute windows.
+type listingLimiter struct {
+	mutex  sync.Mutex
+	window time.Time
+	counts map[string]int
+}
+
+// allow counts a request from ip and reports whether it is within limit for
+// the current minute, and if not, how long until the next window.
+func (l *listingLimiter) allow(ip string, limit int, now time.Time) (bool, time.Duration) {
+	window := now.Truncate(time.Minute)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !window.Equal(l.window) || l.counts == nil {
+		l.window = window
+		l.counts = make(map[string]int)
+	}
+	if l.counts[ip] >= limit {
+		return false, window.Add(time.Minute).Sub(now)
+	}
+	l.counts[ip]++
+	return true, 0
+}
+
+// exhausted reports whether ip has used up limit in the current minute,
+// without counting a request.
+func (l *listingLimiter) exhausted(ip string, limit int, now time.Time) (bool, time.Duration) {
+	window := now.Truncate(time.Minute)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !window.Equal(l.window) || l.counts[ip] < limit {
+		return false, 0
+	}
+	return true, window.Add(time.Minute).Sub(now)
+}
+
+// requireListingAccess guards the endpoints that enumerate files. With
+// public_listings off they need admin credentials, even when require_password
+// is off, and anonymous callers get a bare 401 that reveals nothing about the
+// stored files. Anonymous listing is rate limited per IP by
+// listing_rate_limit. API keys with the list scope are let through, limited
+// by their own rate limit, and see only the files their tag admits.
+func (fm *FileManager) requireListingAccess(w http.ResponseWriter, r *http.Request) bool {
+	if fm.hasAdminCredentials(r) {
+		return true
+	}
+	if presentedAPIKey(r) != "" {
+		_, ok := fm.authorizeKey(w, r, scopeList)
+		return ok
+	}
+	if fm.config().RequirePassword {
+		return fm.requireRole(w, r, roleViewer)
+	}
+	if !fm.config().PublicListings {
+		w.Header().Set("WWW-Authenticate", `Basic realm="uploads admin"`)
+		respondError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	if limit := fm.config().ListingRateLimit; limit > 0 {
+		if ok, retry := fm.listingLimiter.allow(fm.clientIP(r), limit, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			respondError(w, r, "Too many requests", http.StatusTooManyRequests)
+			return false
+		}
+	}
+	return true
+}
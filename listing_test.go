@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListingAccessMatrix(t *testing.T) {
+	type credentials int
+	const (
+		anonymous credentials = iota
+		admin
+		listKey
+		downloadKey
+	)
+	listings := []string{"/manage", "/search", "/stats", "/api/files", "/api/tags", "/api/changes"}
+	open := []string{"/download/{id}", "/f/{id}", "/info/{id}"}
+
+	for _, mode := range []struct {
+		name      string
+		configure func(*Config)
+		listing   map[credentials]int // status of the listing endpoints
+	}{
+		{"public", func(c *Config) {}, map[credentials]int{
+			anonymous: http.StatusOK, admin: http.StatusOK, listKey: http.StatusOK, downloadKey: http.StatusForbidden,
+		}},
+		{"locked down", func(c *Config) { c.PublicListings = false }, map[credentials]int{
+			anonymous: http.StatusUnauthorized, admin: http.StatusOK, listKey: http.StatusOK, downloadKey: http.StatusForbidden,
+		}},
+		{"locked down with require_password", func(c *Config) {
+			c.PublicListings = false
+			c.RequirePassword = true
+		}, map[credentials]int{
+			anonymous: http.StatusUnauthorized, admin: http.StatusOK, listKey: http.StatusOK, downloadKey: http.StatusForbidden,
+		}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			fm, server := newTestServer(t, func(c *Config) {
+				c.AdminPassword = "secret"
+				mode.configure(c)
+			})
+			fm.apiKeys.mutex.Lock()
+			fm.apiKeys.keys[hashAPIKey("upk_list")] = &APIKey{ID: "list", Scopes: []string{scopeList}}
+			fm.apiKeys.keys[hashAPIKey("upk_get")] = &APIKey{ID: "get", Scopes: []string{scopeDownload}}
+			fm.apiKeys.mutex.Unlock()
+
+			fileInfo, err := fm.storeFile(t.Context(), strings.NewReader("listed"), uploadRequest{
+				Filename: "private-report.txt", TTL: fm.config().DefaultTTL, TTLSource: ttlDefault,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			get := func(path string, as credentials) (int, string) {
+				t.Helper()
+				req, _ := http.NewRequest("GET", server.URL+strings.ReplaceAll(path, "{id}", fileInfo.ID), nil)
+				req.Header.Set("Accept", "application/json")
+				switch as {
+				case admin:
+					req.Header.Set("Authorization", "Bearer secret")
+				case listKey:
+					req.Header.Set("X-Api-Key", "upk_list")
+				case downloadKey:
+					req.Header.Set("X-Api-Key", "upk_get")
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				return resp.StatusCode, string(body)
+			}
+
+			for as, want := range mode.listing {
+				for _, path := range listings {
+					status, body := get(path, as)
+					if status != want {
+						t.Errorf("%s as %d: status %d, want %d", path, as, status, want)
+					}
+					// A refusal says nothing about what is stored
+					if status == http.StatusUnauthorized && (strings.Contains(body, fileInfo.ID) || strings.Contains(body, "private-report")) {
+						t.Errorf("%s as %d: refusal reveals the file: %s", path, as, body)
+					}
+				}
+			}
+
+			// Known IDs stay reachable without credentials in every mode
+			for _, path := range open {
+				if status, _ := get(path, anonymous); status != http.StatusOK {
+					t.Errorf("%s anonymously: status %d, want 200", path, status)
+				}
+			}
+
+			// /api/health answers everyone, but only shows the count to
+			// those who may list
+			_, body := get("/api/health", anonymous)
+			if public := fm.config().PublicListings; strings.Contains(body, `"file_count"`) != public {
+				t.Errorf("anonymous /api/health with public_listings %v: %s", public, body)
+			}
+			if _, body := get("/api/health", admin); !strings.Contains(body, `"file_count"`) {
+				t.Errorf("admin /api/health lacks the file count: %s", body)
+			}
+		})
+	}
+}
+
+func TestListingRateLimit(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) {
+		c.AdminPassword = "secret"
+		c.ListingRateLimit = 2
+	})
+	get := func(path, token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i, path := range []string{"/search", "/api/files"} {
+		if resp := get(path, ""); resp.StatusCode != http.StatusOK {
+			t.Fatalf("listing %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+	// The limit is per IP, across the listing endpoints
+	resp := get("/stats", "")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("third listing: status %d, Retry-After %q, want 429 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	// Admins aren't limited
+	if resp := get("/search", "secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("admin listing over the limit: status %d", resp.StatusCode)
+	}
+}
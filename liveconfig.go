@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"reflect"
+)
+
+// config returns the live configuration. A reload swaps in a new Config
+// rather than modifying the current one, so the returned value is safe to
+// read without locking; code that reads several settings that must agree
+// should call config once and keep the pointer.
+func (fm *FileManager) config() *Config {
+	return fm.cfg.Load()
+}
+
+// flagUncountedBots is the feature flag that keeps downloads by crawlers
+// and link previewers, told apart by their User-Agent, from counting
+// against max_downloads.
+const flagUncountedBots = "uncounted_bot_downloads"
+
+// flag reports whether the named entry of feature_flags is on. Unknown
+// flags are off, so experimental behavior stays disabled until a deployment
+// opts in.
+func (fm *FileManager) flag(name string) bool {
+	return fm.config().FeatureFlags[name]
+}
+
+// restartOnlySettings are bound at startup: listeners, routes, storage
+// locations and background timers. A reload keeps their current values.
+var restartOnlySettings = []string{
+	"Port", "Listen", "SocketMode", "GRPCPort", "UploadDir", "MetadataFile",
+	"MetadataBackend", "MetadataDatabase", "CacheDir", "CacheMaxBytes",
+	"CleanupInterval", "S3Credentials",
+	"ReceiptKeyFile", "ArchiveSpoolDir", "StorageBackend", "MemoryBudget",
+	"MetricsEnabled", "ColdStorageDir", "MissingFilesLimit",
+	"ReadTimeout", "WriteTimeout", "IdleTimeout",
+}
+
+// reloadConfig rereads config.json and swaps it in, as on SIGHUP. An invalid
+// file leaves the running configuration untouched.
+func (fm *FileManager) reloadConfig() {
+	next := loadConfig()
+	// Strict mode, which -strict may have turned on, outlives reloads
+	next.Strict = next.Strict || fm.config().Strict
+	if err := next.Validate(); err != nil {
+		log.Printf("Config reload rejected: %v", err)
+		return
+	}
+
+	current := fm.config()
+	cur, nxt := reflect.ValueOf(current).Elem(), reflect.ValueOf(&next).Elem()
+	for _, name := range restartOnlySettings {
+		if !reflect.DeepEqual(cur.FieldByName(name).Interface(), nxt.FieldByName(name).Interface()) {
+			log.Printf("Config reload: %s changes take effect after a restart", name)
+		}
+		nxt.FieldByName(name).Set(cur.FieldByName(name))
+	}
+
+	fm.cfg.Store(&next)
+	fm.loadCustomNotifications()
+	log.Printf("Configuration reloaded")
+}
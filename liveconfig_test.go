@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestConfigSwapDuringUploads(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+
+	stop := make(chan struct{})
+	var flipper sync.WaitGroup
+	flipper.Add(1)
+	go func() {
+		defer flipper.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			next := *fm.config()
+			next.MaxDownloads = i % 3
+			next.MaxFileSize = 1<<20 + int64(i%2)
+			next.FeatureFlags = map[string]bool{flagUncountedBots: i%2 == 0}
+			fm.cfg.Store(&next)
+		}
+	}()
+
+	var uploads sync.WaitGroup
+	for i := range 20 {
+		uploads.Add(1)
+		go func() {
+			defer uploads.Done()
+			status, body := uploadTestFile(t, server, fmt.Sprintf("f%d.txt", i), []byte("content"), nil)
+			if status != http.StatusOK {
+				t.Errorf("upload %d: status %d, body %v", i, status, body)
+				return
+			}
+			resp, err := http.Get(server.URL + "/download/" + body["id"].(string))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	uploads.Wait()
+	close(stop)
+	flipper.Wait()
+}
+
+func TestUncountedBotDownloadsFlag(t *testing.T) {
+	for _, flagged := range []bool{false, true} {
+		t.Run(fmt.Sprintf("flag=%v", flagged), func(t *testing.T) {
+			_, server := newTestServer(t, func(c *Config) {
+				c.FeatureFlags = map[string]bool{flagUncountedBots: flagged}
+			})
+			status, body := uploadTestFile(t, server, "shared.txt", []byte("content"), nil)
+			if status != http.StatusOK {
+				t.Fatalf("upload: status %d, body %v", status, body)
+			}
+			id := body["id"].(string)
+
+			for _, agent := range []string{"Slackbot-LinkExpanding 1.0", "curl/8.0"} {
+				req, _ := http.NewRequest("GET", server.URL+"/download/"+id, nil)
+				req.Header.Set("User-Agent", agent)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("download as %s: status %d", agent, resp.StatusCode)
+				}
+			}
+
+			want := 2.0
+			if flagged {
+				want = 1
+			}
+			if _, info := getJSON(t, server, "/info/"+id); info["downloads"] != want {
+				t.Errorf("downloads = %v, want %v", info["downloads"], want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// checksumMatch is one result of a checksum lookup.
+type checksumMatch struct {
+	publicFile
+	Protected   bool   `json:"protected"`
+	DownloadURL string `json:"download_url"`
+}
+
+// lookupChecksum handles GET /api/checksums/{algo}/{digest}: it answers
+// whether a live file with that content exists and where, so clients can skip
+// uploading what is already here. The newest match is returned, or all of
+// them with all=true. Password-protected files and files under protected tags
+// are only reported to admins, and without public_listings the endpoint is
+// admin-only.
+func (fm *FileManager) lookupChecksum(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != "GET" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(parts) != 2 {
+		respondError(w, r, "Expected /api/checksums/{algo}/{digest}", http.StatusNotFound)
+		return
+	}
+	admin := fm.hasAdminCredentials(r)
+	if !fm.config().PublicListings && !admin {
+		fm.requireRole(w, r, roleViewer)
+		return
+	}
+
+	algorithm, digest := strings.ToLower(parts[0]), parts[1]
+	hasher, err := newHasher(algorithm)
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != hasher.Size() {
+		respondError(w, r, "Invalid "+algorithm+" digest", http.StatusBadRequest)
+		return
+	}
+	checksum := formatChecksum(algorithm, sum)
+	rules := fm.tagRules()
+
+	fm.mutex.RLock()
+	var matches []*FileInfo
+	for _, fileInfo := range fm.files {
+		if fileInfo.Checksum != checksum || fileInfo.Status() != StatusActive {
+			continue
+		}
+		if (fileInfo.Password != "" || rules.protects(fileInfo.Tags)) && !admin {
+			continue
+		}
+		matches = append(matches, fileInfo)
+	}
+	fm.mutex.RUnlock()
+
+	if len(matches) == 0 {
+		respondError(w, r, "No file with this checksum", http.StatusNotFound)
+		return
+	}
+	sortFiles(matches, "upload_time")
+
+	results := make([]checksumMatch, len(matches))
+	for i, fileInfo := range matches {
+		results[i] = checksumMatch{
+			publicFile:  newPublicFile(fileInfo),
+			Protected:   fileInfo.Password != "" || rules.protects(fileInfo.Tags),
+			DownloadURL: fm.downloadURL(r, fileInfo.ID),
+		}
+	}
+
+	if r.URL.Query().Get("all") == "true" {
+		respondJSON(w, http.StatusOK, results)
+		return
+	}
+	respondJSON(w, http.StatusOK, results[0])
+}
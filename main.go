@@ -1,36 +1,161 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc"
 )
 
 func main() {
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && (!strings.HasPrefix(args[0], "-") || isCommandFlag(args[0])) {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serve(args)
+	case "put", "get", "ls", "rm", "stat":
+		if err := runClient(command, args); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	case "version", "-version", "--version":
+		fmt.Println(currentBuild())
+	case "print-config", "-print-config", "--print-config":
+		if err := printConfig(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	case "relocate-files", "-relocate-files", "--relocate-files":
+		if err := relocateFiles(args); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	case "help":
+		fmt.Print(cliUsage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, cliUsage)
+		os.Exit(2)
+	}
+}
+
+// isCommandFlag reports whether arg is a command spelled as a flag, e.g.
+// -version or --print-config.
+func isCommandFlag(arg string) bool {
+	switch strings.TrimLeft(arg, "-") {
+	case "version", "print-config", "relocate-files":
+		return true
+	}
+	return false
+}
+
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "refuse to start with an insecure configuration, like \"strict\": true")
+	fs.Parse(args)
+
 	config := loadConfig()
+	config.Strict = config.Strict || *strict
+	if err := config.Validate(); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
 	fm := NewFileManager(config)
 
 	// Ensure upload directory exists
-	os.MkdirAll(config.UploadDir, 0755)
-
-	// Routes
-	http.HandleFunc("/upload", fm.uploadFile)
-	http.HandleFunc("/download/", fm.downloadFile)
-	http.HandleFunc("/delete/", fm.deleteFile)
-	http.HandleFunc("/manage", fm.manageFiles)
-	http.HandleFunc("/search", fm.searchFiles)
-	http.HandleFunc("/stats", fm.getStats)
-	http.HandleFunc("/info/", fm.fileInfo)
-	http.HandleFunc("/bulk-delete", fm.bulkDelete)
-	http.HandleFunc("/api/", fm.apiHandler)
-	http.HandleFunc("/", fm.manageFiles)
-
-	// Graceful shutdown
-	log.Printf("Starting file upload service on port %s", config.Port)
+	fm.storage.MkdirAll("", 0755)
+
+	fm.registerRoutes()
+
+	var grpcServer *grpc.Server
+	if config.GRPCPort != "" {
+		grpcServer = fm.newGRPCServer()
+		go func() {
+			log.Printf("Starting gRPC service on port %s", config.GRPCPort)
+			if err := fm.serveGRPC(grpcServer); err != nil {
+				log.Fatal("gRPC server failed to start:", err)
+			}
+		}()
+	}
+
+	listener, err := listen(config)
+	if err != nil {
+		log.Fatal("Server failed to start: ", err)
+	}
+
+	fm.logBanner()
+	logSecurityReport(*fm.config())
+	log.Printf("Starting file upload service on %s", listener.Addr())
 	log.Printf("Upload directory: %s", config.UploadDir)
-	log.Printf("Management interface: http://localhost:%s/manage", config.Port)
+	if _, port, err := net.SplitHostPort(listener.Addr().String()); err == nil {
+		log.Printf("Management interface: http://localhost:%s/manage", port)
+	}
+
+	// Reload config.json on SIGHUP
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			fm.reloadConfig()
+		}
+	}()
+
+	server := newHTTPServer(config, fm.Handler())
+	server.RegisterOnShutdown(fm.activity.closeStreams)
+
+	// On SIGINT or SIGTERM, stop accepting connections, let requests in
+	// flight finish for up to shutdown_timeout and flush pending metadata
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		timeout := fm.config().ShutdownTimeout
+		log.Printf("Shutting down, waiting up to %s for requests in progress", timeout)
+
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		defer cancel()
+
+		grpcStopped := make(chan struct{})
+		go func() {
+			if grpcServer != nil {
+				grpcServer.GracefulStop()
+			}
+			close(grpcStopped)
+		}()
+		// Also closes the listener, which removes a Unix socket file
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Requests still running after %s, closing their connections", timeout)
+			server.Close()
+		}
+		// Without gRPC both are ready once the drain timed out
+		if grpcServer != nil {
+			select {
+			case <-grpcStopped:
+			case <-ctx.Done():
+				grpcServer.Stop()
+			}
+		}
+		fm.Close()
+		close(stopped)
+	}()
 
-	if err := http.ListenAndServe(":"+config.Port, nil); err != nil {
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal("Server failed to start:", err)
 	}
+	<-stopped
+	log.Printf("Shutdown complete")
 }
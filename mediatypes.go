@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+var errTypeNotAllowed = errors.New("file type not allowed")
+
+// typeVerdict is the outcome of checking a media type against allowed_types
+// and denied_types.
+type typeVerdict int
+
+const (
+	typeAdmitted   typeVerdict = iota
+	typeDenied                 // matches denied_types
+	typeNotAllowed             // allowed_types is set and doesn't match
+)
+
+// parseTypePattern checks an allowed_types or denied_types entry and returns
+// it in canonical form: an exact media type such as "image/png", a wildcard
+// such as "image/*", or "*/*". "image/" is accepted as "image/*", as older
+// configurations used prefixes.
+func parseTypePattern(pattern string) (string, error) {
+	p := strings.ToLower(strings.TrimSpace(pattern))
+	if strings.HasSuffix(p, "/") {
+		p += "*"
+	}
+	major, minor, ok := strings.Cut(p, "/")
+	if !ok || major == "" || minor == "" {
+		return "", fmt.Errorf("type pattern %q must be type/subtype, e.g. %q", pattern, major+"/*")
+	}
+	if major == "*" && minor != "*" {
+		return "", fmt.Errorf("type pattern %q: only */* may wildcard the type", pattern)
+	}
+	if _, params, err := mime.ParseMediaType(p); err != nil || len(params) > 0 {
+		return "", fmt.Errorf("type pattern %q is not a media type without parameters", pattern)
+	}
+	return p, nil
+}
+
+// matchesType reports whether a canonical pattern matches mediaType, which
+// must be lowercase and without parameters.
+func matchesType(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	major, ok := strings.CutSuffix(pattern, "/*")
+	return ok && strings.HasPrefix(mediaType, major+"/")
+}
+
+// matchesAnyType reports whether any pattern matches mediaType. Patterns
+// were checked by Validate, so malformed ones never match.
+func matchesAnyType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if canonical, err := parseTypePattern(pattern); err == nil && matchesType(canonical, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkType checks a Content-Type against denied_types first, then
+// allowed_types. Parameters such as charset are ignored, an empty type
+// counts as application/octet-stream, and a type that can't be parsed is
+// refused whenever either list is set.
+func (fm *FileManager) checkType(contentType string) typeVerdict {
+	config := fm.config()
+	if len(config.AllowedTypes) == 0 && len(config.DeniedTypes) == 0 {
+		return typeAdmitted
+	}
+	if strings.TrimSpace(contentType) == "" {
+		contentType = "application/octet-stream"
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return typeNotAllowed
+	}
+	if matchesAnyType(config.DeniedTypes, mediaType) {
+		return typeDenied
+	}
+	if len(config.AllowedTypes) > 0 && !matchesAnyType(config.AllowedTypes, mediaType) {
+		return typeNotAllowed
+	}
+	return typeAdmitted
+}
+
+// typeAllowed checks a client-declared content type.
+func (fm *FileManager) typeAllowed(contentType string) bool {
+	return fm.checkType(contentType) == typeAdmitted
+}
+
+// checkSniffedType checks the type sniffed from an upload's content, so a
+// declared type can't smuggle in what the lists exclude. Sniffed types that
+// match denied_types are always refused; ones allowed_types doesn't admit
+// are returned as a mismatch for type_mismatch_policy. Sniffing only says
+// "binary" or "text" for most content, and those results are not checked.
+func (fm *FileManager) checkSniffedType(sniffed string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(sniffed)
+	if err != nil || mediaType == "application/octet-stream" || mediaType == "text/plain" {
+		return "", nil
+	}
+	switch fm.checkType(mediaType) {
+	case typeDenied:
+		return "", fmt.Errorf("%w: detected %s", errTypeNotAllowed, mediaType)
+	case typeNotAllowed:
+		return fmt.Sprintf("detected %s, which allowed_types doesn't admit", mediaType), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestParseTypePattern(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"image/png":   "image/png",
+		" Image/PNG ": "image/png",
+		"image/*":     "image/*",
+		"image/":      "image/*",
+		"*/*":         "*/*",
+	} {
+		if got, err := parseTypePattern(pattern); err != nil || got != want {
+			t.Errorf("parseTypePattern(%q) = %q, %v, want %q", pattern, got, err, want)
+		}
+	}
+	for _, pattern := range []string{"image", "", "/png", "*/png", "text/plain; charset=utf-8", "image/png/x", "ima ge/png"} {
+		if got, err := parseTypePattern(pattern); err == nil {
+			t.Errorf("parseTypePattern(%q) = %q, want an error", pattern, got)
+		}
+	}
+
+	// Malformed patterns are refused at startup
+	for _, configure := range []func(*Config){
+		func(c *Config) { c.AllowedTypes = []string{"image"} },
+		func(c *Config) { c.DeniedTypes = []string{"video/*", "*/mp4"} },
+	} {
+		c := loadConfig()
+		configure(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate accepted allowed_types %q, denied_types %q", c.AllowedTypes, c.DeniedTypes)
+		}
+	}
+}
+
+func TestCheckType(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) {
+		c.AllowedTypes = []string{"image/*", "text/plain", "application/pdf"}
+		c.DeniedTypes = []string{"image/svg+xml"}
+	})
+	defer fm.Close()
+	for contentType, want := range map[string]typeVerdict{
+		"image/png":                        typeAdmitted,
+		"IMAGE/JPEG":                       typeAdmitted,
+		"text/plain; charset=utf-8":        typeAdmitted,
+		`text/plain; charset="utf-8"`:      typeAdmitted,
+		"application/pdf; name=report.pdf": typeAdmitted,
+		"image/svg+xml":                    typeDenied, // denied wins over image/*
+		"image/svg+xml; charset=utf-8":     typeDenied,
+		"application/x-image-exploit":      typeNotAllowed, // "image" is no substring match
+		"image":                            typeNotAllowed,
+		"text/plainx":                      typeNotAllowed,
+		"text/html":                        typeNotAllowed,
+		"":                                 typeNotAllowed, // counts as application/octet-stream
+		"text/plain; charset":              typeNotAllowed, // unparseable
+		"imagefoo/png":                     typeNotAllowed,
+	} {
+		if got := fm.checkType(contentType); got != want {
+			t.Errorf("checkType(%q) = %d, want %d", contentType, got, want)
+		}
+	}
+
+	// Everything except videos
+	fm = NewTestFileManager(func(c *Config) {
+		c.DeniedTypes = []string{"video/*"}
+	})
+	defer fm.Close()
+	for contentType, want := range map[string]typeVerdict{
+		"video/mp4":                typeDenied,
+		"video/webm; codecs=vp9":   typeDenied,
+		"application/octet-stream": typeAdmitted,
+		"":                         typeAdmitted,
+	} {
+		if got := fm.checkType(contentType); got != want {
+			t.Errorf("everything but videos: checkType(%q) = %d, want %d", contentType, got, want)
+		}
+	}
+}
+
+// uploadTyped uploads content declared as contentType.
+func uploadTyped(t *testing.T, server *httptest.Server, name, contentType string, content []byte) (int, map[string]interface{}) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, name))
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+	req, _ := http.NewRequest("POST", server.URL+"/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return doJSON(t, req)
+}
+
+func TestSniffedTypeChecked(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) {
+		c.AllowedTypes = []string{"image/*", "text/plain"}
+		c.DeniedTypes = []string{"text/html"}
+	})
+	png := append([]byte("\x89PNG\r\n\x1a\n"), testContent(100)...)
+
+	if status, body := uploadTyped(t, server, "photo.png", "image/png", png); status != http.StatusOK {
+		t.Errorf("PNG: status %d, body %v", status, body)
+	}
+	if status, body := uploadTyped(t, server, "report.pdf", "application/pdf", []byte("%PDF-1.4")); status != http.StatusBadRequest {
+		t.Errorf("PDF outside allowed_types: status %d, body %v, want 400", status, body)
+	}
+
+	// Declaring an allowed type doesn't get denied content in
+	status, body := uploadTyped(t, server, "page.txt", "text/plain; charset=utf-8", []byte("<html><script>alert(1)</script></html>"))
+	if status != http.StatusBadRequest || body["code"] != "type_not_allowed" || !strings.Contains(body["error"].(string), "text/html") {
+		t.Errorf("HTML sent as text: status %d, body %v, want 400 naming the detected type", status, body)
+	}
+
+	// Content allowed_types doesn't admit is a mismatch for
+	// type_mismatch_policy, which tags it by default
+	status, body = uploadTyped(t, server, "photo.png", "image/png", []byte("%PDF-1.4 not a picture"))
+	if status != http.StatusOK {
+		t.Fatalf("PDF named .png: status %d, body %v", status, body)
+	}
+	_, info := getJSON(t, server, "/info/"+body["id"].(string))
+	if !strings.Contains(fmt.Sprint(info["tags"]), typeMismatchTag) {
+		t.Errorf("PDF named .png tagged %v, want %s", info["tags"], typeMismatchTag)
+	}
+}
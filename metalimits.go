@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"unicode/utf8"
+)
+
+// maxMetadataKeyLength bounds metadata keys; they are names, not payloads.
+const maxMetadataKeyLength = 128
+
+// metadataLimitViolations checks metadata against max_metadata_keys and
+// max_metadata_value_length. A zero limit disables that check.
+func (fm *FileManager) metadataLimitViolations(metadata map[string]string) []string {
+	var violations []string
+	if max := fm.config().MaxMetadataKeys; max > 0 && len(metadata) > max {
+		violations = append(violations, fmt.Sprintf("too many keys: %d (limit %d)", len(metadata), max))
+	}
+	for key, value := range metadata {
+		if len(key) > maxMetadataKeyLength {
+			violations = append(violations, fmt.Sprintf("%.32s...: key longer than %d bytes", key, maxMetadataKeyLength))
+		}
+		if max := fm.config().MaxMetadataValueLen; max > 0 && len(value) > max {
+			violations = append(violations, fmt.Sprintf("%s: value is %d bytes (limit %d)", key, len(value), max))
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// compactMetadata trims records written before the metadata limits existed,
+// or under looser ones: overlong keys are dropped, values are truncated at a
+// character boundary and keys beyond the limit are evicted in reverse
+// alphabetical order. It runs as part of cleanup and reports whether
+// anything changed. Callers must hold fm.mutex.
+func (fm *FileManager) compactMetadata() bool {
+	maxKeys := fm.config().MaxMetadataKeys
+	maxValue := fm.config().MaxMetadataValueLen
+
+	changed := false
+	for _, fileInfo := range fm.files {
+		dropped, truncated := 0, 0
+		for key, value := range fileInfo.Metadata {
+			if len(key) > maxMetadataKeyLength {
+				delete(fileInfo.Metadata, key)
+				dropped++
+				continue
+			}
+			if maxValue > 0 && len(value) > maxValue {
+				fileInfo.Metadata[key] = truncateUTF8(value, maxValue)
+				truncated++
+			}
+		}
+		if maxKeys > 0 && len(fileInfo.Metadata) > maxKeys {
+			keys := make([]string, 0, len(fileInfo.Metadata))
+			for key := range fileInfo.Metadata {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys[maxKeys:] {
+				delete(fileInfo.Metadata, key)
+				dropped++
+			}
+		}
+		if dropped > 0 || truncated > 0 {
+			log.Printf("Compacted metadata of %s: dropped %d keys, truncated %d values", fileInfo.ID, dropped, truncated)
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestMetadataLimitsOnWrite(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) {
+		c.MaxMetadataKeys = 3
+		c.MaxMetadataValueLen = 8
+	})
+
+	for name, metadata := range map[string]string{
+		"too many keys":  `{"a":"1","b":"2","c":"3","d":"4"}`,
+		"value too long": `{"a":"123456789"}`,
+		"key too long":   `{"` + strings.Repeat("k", maxMetadataKeyLength+1) + `":"1"}`,
+	} {
+		status, body := uploadTestFile(t, server, "a.txt", []byte("content"), url.Values{"metadata": {metadata}})
+		if status != http.StatusUnprocessableEntity {
+			t.Errorf("upload with %s: status %d, body %v, want 422", name, status, body)
+		}
+	}
+
+	status, uploaded := uploadTestFile(t, server, "a.txt", []byte("content"), url.Values{"metadata": {`{"a":"1","b":"2"}`}})
+	if status != http.StatusOK {
+		t.Fatalf("upload within the limits: status %d, body %v", status, uploaded)
+	}
+	patch := func(metadata string) int {
+		t.Helper()
+		req, _ := http.NewRequest("PATCH", server.URL+"/api/files/"+uploaded["id"].(string), strings.NewReader(`{"metadata":`+metadata+`}`))
+		req.Header.Set("Content-Type", "application/json")
+		status, _ := doJSON(t, req)
+		return status
+	}
+	// The limit applies to the keys the file ends up with
+	if status := patch(`{"c":"3","d":"4"}`); status != http.StatusUnprocessableEntity {
+		t.Errorf("PATCH to four keys: status %d, want 422", status)
+	}
+	if status := patch(`{"c":"3"}`); status != http.StatusOK {
+		t.Errorf("PATCH to three keys: status %d, want 200", status)
+	}
+}
+
+func TestHugeMetadataCompactedAndPersisted(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) {
+		c.MaxMetadataKeys = 5
+		c.MaxMetadataValueLen = 16
+	})
+	defer fm.Close()
+	fileInfo, err := fm.storeFile(t.Context(), strings.NewReader("content"), uploadRequest{
+		Filename: "legacy.txt", TTL: fm.config().DefaultTTL, TTLSource: ttlDefault,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.flushPendingSave()
+
+	// A record from before the limits, as loaded from metadata_file
+	huge := make(map[string]string)
+	for i := range 1000 {
+		huge[fmt.Sprintf("k%03d", i)] = strings.Repeat("x", 4096)
+	}
+	huge[strings.Repeat("long", 100)] = "dropped"
+	huge["a-name"] = "a" + strings.Repeat("é", 20) // two bytes each
+	fm.mutex.Lock()
+	fileInfo.Metadata = huge
+	fm.mutex.Unlock()
+
+	fm.cleanup()
+	fm.flushPendingSave()
+
+	records, err := fm.index.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved FileInfo
+	if err := json.Unmarshal(records[fileInfo.ID], &saved); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a-name", "k000", "k001", "k002", "k003"}
+	if len(saved.Metadata) != len(want) {
+		t.Fatalf("saved metadata has %d keys, want %v", len(saved.Metadata), want)
+	}
+	for _, key := range want {
+		value, ok := saved.Metadata[key]
+		if !ok || len(value) > 16 || !utf8.ValidString(value) {
+			t.Errorf("saved %s = %q (%v), want a valid value of at most 16 bytes", key, value, ok)
+		}
+	}
+	if saved.Metadata["a-name"] != "a"+strings.Repeat("é", 7) {
+		t.Errorf("a-name truncated to %q, want whole characters", saved.Metadata["a-name"])
+	}
+
+	// Compacting again finds nothing to do
+	fm.mutex.Lock()
+	changed := fm.compactMetadata()
+	fm.mutex.Unlock()
+	if changed {
+		t.Error("a second compaction changed the compacted metadata")
+	}
+}
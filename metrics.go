@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// phaseBuckets are the upper bounds, in seconds, of the phase histograms.
+var phaseBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// histogram is a Prometheus histogram over phaseBuckets.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// phaseMetrics holds the upload and download phase timings served on
+// /metrics, keyed by operation and phase.
+type phaseMetrics struct {
+	mutex      sync.Mutex
+	histograms map[[2]string]*histogram
+}
+
+// observe records the phases of a timed upload or download and its total
+// duration. Other requests aren't observed.
+func (m *phaseMetrics) observe(timer *requestTimer, total time.Duration) {
+	if timer.operation == "" {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.histograms == nil {
+		m.histograms = make(map[[2]string]*histogram)
+	}
+	m.add(timer.operation, "total", total)
+	for _, p := range timer.phases {
+		m.add(timer.operation, p.name, p.duration)
+	}
+}
+
+func (m *phaseMetrics) add(operation, phase string, d time.Duration) {
+	key := [2]string{operation, phase}
+	h := m.histograms[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(phaseBuckets))}
+		m.histograms[key] = h
+	}
+	seconds := d.Seconds()
+	h.count++
+	h.sum += seconds
+	for i, bound := range phaseBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+}
+
+// serveMetrics handles GET /metrics in the Prometheus text format. It is
+// registered only with metrics_enabled.
+func (fm *FileManager) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m := &fm.metrics
+	m.mutex.Lock()
+	keys := make([][2]string, 0, len(m.histograms))
+	for key := range m.histograms {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+
+	var out strings.Builder
+	out.WriteString("# HELP uploads_phase_duration_seconds Time spent in each phase of uploads and downloads.\n")
+	out.WriteString("# TYPE uploads_phase_duration_seconds histogram\n")
+	for _, key := range keys {
+		h := m.histograms[key]
+		labels := fmt.Sprintf(`operation=%q,phase=%q`, key[0], key[1])
+		var cumulative uint64
+		for i, bound := range phaseBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&out, "uploads_phase_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, cumulative)
+		}
+		fmt.Fprintf(&out, "uploads_phase_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(&out, "uploads_phase_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(&out, "uploads_phase_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+	m.mutex.Unlock()
+	fm.writeStorageLatencyMetrics(&out)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(out.String()))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"cmp"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// isInvisible reports characters that render as nothing or reorder the text
+// around them. Bidi overrides in particular let "evil\u202Efdp.exe" display
+// as "evilexe.pdf".
+func isInvisible(r rune) bool {
+	switch {
+	case r >= 0x200B && r <= 0x200F, // zero-width space/joiners, LRM, RLM
+		r >= 0x202A && r <= 0x202E, // bidi embeddings and overrides
+		r >= 0x2066 && r <= 0x2069, // bidi isolates
+		r == 0x061C,                // Arabic letter mark
+		r == 0xFEFF,                // zero-width no-break space / BOM
+		r == 0x00AD:                // soft hyphen
+		return true
+	}
+	return unicode.IsControl(r)
+}
+
+// normalizeName returns the NFC form of s with invisible and bidi control
+// characters removed, so macOS-decomposed names match their composed
+// equivalents and names render the way they sort and compare.
+func normalizeName(s string) string {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "\uFFFD")
+	}
+	s = strings.Map(func(r rune) rune {
+		if isInvisible(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return norm.NFC.String(s)
+}
+
+// rawName records the exact bytes of a client-supplied name in an ASCII-safe
+// form for forensic purposes.
+func rawName(s string) string {
+	return strconv.QuoteToASCII(s)
+}
+
+// searchKey folds text for case-insensitive, normalization-insensitive
+// matching.
+func searchKey(s string) string {
+	return strings.ToLower(normalizeName(s))
+}
+
+// sortEntries puts files in the order every output listing several of them
+// uses: by entry name, then upload time, then ID, so the same files
+// always come out the same way however they were collected. Callers hold
+// fm.mutex for reading.
+func sortEntries(files []*FileInfo) {
+	slices.SortFunc(files, func(a, b *FileInfo) int {
+		return cmp.Or(
+			strings.Compare(searchKey(entryName(a)), searchKey(entryName(b))),
+			a.UploadTime.Compare(b.UploadTime),
+			strings.Compare(a.ID, b.ID),
+		)
+	})
+}
+
+// entryNames returns the name each of files gets inside an archive or
+// checksum list, in order: the base of its original name, or its ID when
+// that is empty. Names that clash with an earlier one, compared like
+// searchKey since archives are often unpacked on case-insensitive
+// filesystems, get " (2)", " (3)" and so on before the extension, e.g.
+// "report (2).pdf" and "backup (2).tar.gz". Sort files with sortEntries
+// first for names that don't change between calls.
+func entryNames(files []*FileInfo) []string {
+	names := make([]string, len(files))
+	taken := make(map[string]bool, len(files))
+	for i, fileInfo := range files {
+		name := entryName(fileInfo)
+		stem, ext := splitExtension(name)
+		for n := 2; taken[searchKey(name)]; n++ {
+			name = stem + " (" + strconv.Itoa(n) + ")" + ext
+		}
+		taken[searchKey(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+// entryName is the base of fileInfo's original name, without any directory
+// a client sent along with it.
+func entryName(fileInfo *FileInfo) string {
+	name := path.Base("/" + strings.ReplaceAll(normalizeName(fileInfo.OriginalName), "\\", "/"))
+	if name == "/" || name == "." || name == ".." {
+		return fileInfo.ID
+	}
+	return name
+}
+
+// splitExtension splits name before its extension, keeping compound ones
+// like .tar.gz whole. Dotfiles like .env have no extension.
+func splitExtension(name string) (stem, ext string) {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return name, ""
+	}
+	if j := strings.LastIndexByte(name[:i], '.'); j > 0 && strings.EqualFold(name[j:i], ".tar") {
+		i = j
+	}
+	return name[:i], name[i:]
+}
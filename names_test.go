@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntryNames(t *testing.T) {
+	files := func(names ...string) []*FileInfo {
+		out := make([]*FileInfo, len(names))
+		for i, name := range names {
+			out[i] = &FileInfo{ID: "id" + string(rune('a'+i)), OriginalName: name}
+		}
+		return out
+	}
+	tests := []struct {
+		name  string
+		files []*FileInfo
+		want  []string
+	}{
+		{"distinct", files("a.txt", "b.txt"), []string{"a.txt", "b.txt"}},
+		{"duplicate", files("report.pdf", "report.pdf", "report.pdf"), []string{"report.pdf", "report (2).pdf", "report (3).pdf"}},
+		{"case-insensitive", files("Report.PDF", "report.pdf"), []string{"Report.PDF", "report (2).pdf"}},
+		{"compound extension", files("backup.tar.gz", "backup.tar.gz"), []string{"backup.tar.gz", "backup (2).tar.gz"}},
+		{"compound extension uppercase", files("data.TAR.XZ", "data.tar.xz"), []string{"data.TAR.XZ", "data (2).tar.xz"}},
+		{"plain double extension", files("app.min.js", "app.min.js"), []string{"app.min.js", "app.min (2).js"}},
+		{"no extension", files("Makefile", "makefile"), []string{"Makefile", "makefile (2)"}},
+		{"dotfile", files(".env", ".env"), []string{".env", ".env (2)"}},
+		{"directories dropped", files("a/b/notes.md", `c\d\notes.md`), []string{"notes.md", "notes (2).md"}},
+		{"empty names use the ID", files("", "..", "/"), []string{"ida", "idb", "idc"}},
+		{"NFC and NFD collide", files("caf\u00e9.txt", "cafe\u0301.txt"), []string{"caf\u00e9.txt", "caf\u00e9 (2).txt"}},
+		{"unicode case folding", files("ÜBER.txt", "über.txt"), []string{"ÜBER.txt", "über (2).txt"}},
+		{"bidi override stripped", files("evil\u202Efdp.exe", "evilfdp.exe"), []string{"evilfdp.exe", "evilfdp (2).exe"}},
+		{"suffix already taken", files("x.txt", "x (2).txt", "x.txt"), []string{"x.txt", "x (2).txt", "x (3).txt"}},
+		{"CJK", files("報告.pdf", "報告.pdf"), []string{"報告.pdf", "報告 (2).pdf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entryNames(tt.files); !slices.Equal(got, tt.want) {
+				t.Errorf("entryNames = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitExtension(t *testing.T) {
+	tests := []struct{ name, stem, ext string }{
+		{"photo.jpg", "photo", ".jpg"},
+		{"backup.tar.gz", "backup", ".tar.gz"},
+		{"backup.Tar.Bz2", "backup", ".Tar.Bz2"},
+		{".tar.gz", ".tar", ".gz"},
+		{".bashrc", ".bashrc", ""},
+		{"README", "README", ""},
+		{"trailing.", "trailing", "."},
+	}
+	for _, tt := range tests {
+		if stem, ext := splitExtension(tt.name); stem != tt.stem || ext != tt.ext {
+			t.Errorf("splitExtension(%q) = %q, %q; want %q, %q", tt.name, stem, ext, tt.stem, tt.ext)
+		}
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []*FileInfo{
+		{ID: "c", OriginalName: "b.txt", UploadTime: base},
+		{ID: "b", OriginalName: "a.txt", UploadTime: base.Add(time.Hour)},
+		{ID: "a", OriginalName: "A.txt", UploadTime: base.Add(time.Hour)},
+		{ID: "d", OriginalName: "a.txt", UploadTime: base},
+	}
+	want := []string{"d", "a", "b", "c"}
+	orders := [][]*FileInfo{files, slices.Clone(files), {files[2], files[0], files[3], files[1]}}
+	slices.Reverse(orders[1])
+	for _, order := range orders {
+		sortEntries(order)
+		var ids []string
+		for _, fileInfo := range order {
+			ids = append(ids, fileInfo.ID)
+		}
+		if !slices.Equal(ids, want) {
+			t.Fatalf("sortEntries order = %v, want %v", ids, want)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"cafe\u0301.txt", "caf\u00E9.txt"}, // NFD from macOS
+		{"caf\u00E9.txt", "caf\u00E9.txt"},
+		{"invoice\u202Efdp.exe", "invoicefdp.exe"}, // right-to-left override
+		{"a\u200Bb\u2066c\u2069.txt", "abc.txt"},
+		{"\uFEFFbom.txt", "bom.txt"},
+		{"bad\xffbyte.txt", "bad\uFFFDbyte.txt"},
+	} {
+		if got := normalizeName(tc.in); got != tc.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+	if searchKey("CAFE\u0301") != searchKey("caf\u00E9") {
+		t.Error("search keys of the NFD and NFC forms differ")
+	}
+}
+
+func TestUploadNormalizesNames(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	const nfd, nfc = "cafe\u0301 menu.txt", "caf\u00E9 menu.txt"
+	status, uploaded := uploadTestFile(t, server, nfd, []byte("menu"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+	if uploaded["original_name"] != nfc {
+		t.Errorf("original_name %q, want the NFC form", uploaded["original_name"])
+	}
+	_, info := getJSON(t, server, "/info/"+id)
+	if metadata, _ := info["metadata"].(map[string]interface{}); metadata["raw_name"] != rawName(nfd) {
+		t.Errorf("raw_name %v, want the name as sent", info["metadata"])
+	}
+
+	// Either form of the query finds it
+	for _, query := range []string{"cafe\u0301", "caf\u00E9", "CAF\u00C9"} {
+		resp, err := http.Get(server.URL + "/search?q=" + url.QueryEscape(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&found)
+		resp.Body.Close()
+		if len(found) != 1 || found[0]["id"] != id {
+			t.Errorf("search for %q found %v", query, found)
+		}
+	}
+
+	// A right-to-left override can't make an executable look like a PDF
+	status, uploaded = uploadTestFile(t, server, "invoice\u202Efdp.exe", []byte("MZ"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	if uploaded["original_name"] != "invoicefdp.exe" {
+		t.Errorf("original_name %q, want the override removed", uploaded["original_name"])
+	}
+	resp, err := http.Get(server.URL + "/manage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "invoicefdp.exe") || strings.ContainsRune(string(page), '\u202E') {
+		t.Error("management page doesn't show the name without the override")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Representations a response can be negotiated to.
+const (
+	mediaText = "text/plain"
+	mediaJSON = "application/json"
+	mediaHTML = "text/html"
+)
+
+// negotiate picks the representation the Accept header prefers. Exact types
+// beat type/* and */* at the same quality, and plain text wins ties, so
+// curl's */* gets text, browsers get HTML and application/json gets JSON.
+// Without any acceptable representation the answer is text.
+func negotiate(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	best, bestQ, bestSpecificity := mediaText, 0.0, -1
+	for _, offer := range []string{mediaText, mediaJSON, mediaHTML} {
+		q, specificity := acceptQuality(accept, offer)
+		if q > bestQ || (q == bestQ && q > 0 && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = offer, q, specificity
+		}
+	}
+	return best
+}
+
+func wantsJSON(r *http.Request) bool {
+	return negotiate(r) == mediaJSON
+}
+
+func wantsHTML(r *http.Request) bool {
+	return negotiate(r) == mediaHTML
+}
+
+// acceptQuality returns the quality accept gives offer, taken from the most
+// specific media range matching it, and that range's specificity: 2 for the
+// type itself, 1 for type/* and 0 for */*. An empty header accepts anything.
+func acceptQuality(accept, offer string) (float64, int) {
+	if strings.TrimSpace(accept) == "" {
+		return 1, 0
+	}
+	q, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		s := -1
+		switch {
+		case name == offer:
+			s = 2
+		case name == "*/*":
+			s = 0
+		case strings.HasSuffix(name, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(name, "*")):
+			s = 1
+		}
+		if s <= specificity {
+			continue
+		}
+		rangeQ := 1.0
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && v >= 0 && v <= 1 {
+					rangeQ = v
+				}
+			}
+		}
+		q, specificity = rangeQ, s
+	}
+	return q, specificity
+}
+
+func respondJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func respondHTML(w http.ResponseWriter, status int, t *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	t.Execute(w, data)
+}
+
+func respondText(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	w.Write([]byte(text))
+}
+
+// respondError answers with message in the representation the client
+// prefers: {"error": message} for JSON clients, a short page for browsers
+// and the plain message otherwise.
+func respondError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	w.Header().Del("Content-Length")
+	switch negotiate(r) {
+	case mediaJSON:
+		respondJSON(w, status, map[string]string{"error": message})
+	case mediaHTML:
+		respondHTML(w, status, problemTemplate, problemResponse{downloadProblem: downloadProblem{Status: status, Message: message}})
+	default:
+		respondText(w, status, message)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+func TestNegotiate(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                                   mediaText,
+		"*/*":                                mediaText,
+		browserAccept:                        mediaHTML,
+		"application/json":                   mediaJSON,
+		"application/json, */*;q=0.1":        mediaJSON,
+		"text/*":                             mediaText,
+		"text/html;q=0.5, application/json":  mediaJSON,
+		"text/html, application/json;q=0.9":  mediaHTML,
+		"application/json;q=0, */*":          mediaText,
+		"text/plain;q=0, text/*":             mediaHTML,
+		"image/png":                          mediaText, // nothing acceptable
+		"APPLICATION/JSON; Q=1":              mediaJSON,
+		"application/json;q=bogus, */*;q=.5": mediaJSON,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		if got := negotiate(req); got != want {
+			t.Errorf("Accept %q negotiated %s, want %s", accept, got, want)
+		}
+	}
+}
+
+// TestAcceptMatrix hits every endpoint with the Accept headers of curl, a
+// browser and an API client. Pages are HTML unless JSON is asked for, data
+// endpoints are always JSON and errors follow the header.
+func TestAcceptMatrix(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	status, body := uploadTestFile(t, server, "a.txt", []byte("hello"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+
+	page := [3]string{mediaHTML, mediaHTML, mediaJSON}
+	data := [3]string{mediaJSON, mediaJSON, mediaJSON}
+	failure := [3]string{mediaText, mediaHTML, mediaJSON}
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		want         [3]string
+	}{
+		{"GET", "/", http.StatusOK, page},
+		{"GET", "/manage", http.StatusOK, page},
+		{"GET", "/f/" + id, http.StatusOK, page},
+		{"GET", "/search", http.StatusOK, data},
+		{"GET", "/stats", http.StatusOK, data},
+		{"GET", "/info/" + id, http.StatusOK, data},
+		{"GET", "/api/files", http.StatusOK, data},
+		{"GET", "/api/tags", http.StatusOK, data},
+		{"GET", "/api/health", http.StatusOK, data},
+		{"GET", "/api/changes", http.StatusOK, data},
+		{"GET", "/download/" + id, http.StatusOK, [3]string{"text/plain", "text/plain", "text/plain"}}, // the file itself
+		{"GET", "/info/nosuchfile", http.StatusNotFound, failure},
+		{"GET", "/f/nosuchfile", http.StatusNotFound, failure},
+		{"GET", "/download/nosuchfile", http.StatusNotFound, failure},
+		{"DELETE", "/delete/nosuchfile", http.StatusNotFound, failure},
+		{"GET", "/api/files/nosuchfile", http.StatusNotFound, failure},
+		{"GET", "/api/nosuchendpoint", http.StatusNotFound, failure},
+		{"GET", "/api/uploads/nosuchsession", http.StatusNotFound, failure},
+		{"GET", "/request/nosuchrequest", http.StatusNotFound, failure},
+		{"GET", "/admin/files/nosuchfile", http.StatusNotFound, failure},
+		{"POST", "/upload", http.StatusBadRequest, failure},
+		{"POST", "/bulk-delete", http.StatusBadRequest, failure},
+		{"PUT", "/api/files", http.StatusMethodNotAllowed, failure},
+	} {
+		for i, accept := range []string{"*/*", browserAccept, "application/json"} {
+			req, _ := http.NewRequest(tc.method, server.URL+tc.path, nil)
+			req.Header.Set("Accept", accept)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if contentType := resp.Header.Get("Content-Type"); resp.StatusCode != tc.status || !strings.HasPrefix(contentType, tc.want[i]) {
+				t.Errorf("%s %s with Accept %q: status %d, %s; want %d, %s", tc.method, tc.path, accept, resp.StatusCode, contentType, tc.status, tc.want[i])
+			}
+		}
+	}
+}
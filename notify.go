@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// notify posts an operational event to notify_webhook_url, if configured.
+// Delivery is best-effort and never blocks the caller.
+func (fm *FileManager) notify(event string, details map[string]interface{}) {
+	fm.notifyFile(event, nil, details)
+}
+
+// notifyFile is notify for an event about fileInfo, which its custom
+// templates can describe. When event has templates in
+// notification_template_dir, the rendered subject and text are sent along
+// with the details. Callers passing a file must not hold fm.mutex.
+func (fm *FileManager) notifyFile(event string, fileInfo *FileInfo, details map[string]interface{}) {
+	config := fm.config()
+	if config.NotifyWebhookURL == "" {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"event":     event,
+		"timestamp": time.Now().Format(time.RFC3339),
+		"details":   details,
+	}
+	if custom := fm.customNotification(event); custom.subject != nil || custom.body != nil {
+		base := ""
+		if config.BaseURL != "" {
+			base = fm.baseURL(nil)
+		}
+		if fileInfo != nil {
+			fm.mutex.RLock()
+		}
+		data := newNotificationData(event, fileInfo, details, base)
+		if fileInfo != nil {
+			fm.mutex.RUnlock()
+		}
+		message, _ := fm.renderNotification(nil, custom, nil, data)
+		payload["subject"], payload["text"] = message.Subject, message.Body
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding %s notification: %v", event, err)
+		return
+	}
+
+	go func() {
+		resp, err := notifyClient.Post(fm.config().NotifyWebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error delivering %s notification: %v", event, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Webhook rejected %s notification: %s", event, resp.Status)
+		}
+	}()
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// notificationEvents are the events that can have custom templates, with
+// sample details like the webhook sends for them. The samples make up the
+// synthetic event templates are checked and previewed against; file events
+// also get a sample file.
+var notificationEvents = map[string]struct {
+	file    bool // the event is about one file
+	email   bool // notify_email is sent for it
+	details map[string]interface{}
+}{
+	"upload": {file: true, email: true},
+	"file_request_upload": {file: true, email: true, details: map[string]interface{}{
+		"request_id": "3f2a9c", "title": "Quarterly reports", "file_id": "example", "filename": "report.pdf", "size": int64(1 << 20),
+	}},
+	"checksum_ready": {file: true, details: map[string]interface{}{
+		"id": "example", "filename": "report.pdf", "checksum": sampleChecksum,
+	}},
+	"integrity_error": {file: true, details: map[string]interface{}{
+		"file_id": "example", "filename": "report.pdf", "problem": "size on disk is 0 bytes, expected 1048576",
+	}},
+	"backup_failed": {details: map[string]interface{}{
+		"error": "no space left on device", "dir": "./backups",
+	}},
+	"persistence_failed": {details: map[string]interface{}{
+		"error": "permission denied", "last_success": time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC),
+	}},
+	"persistence_recovered":     {details: map[string]interface{}{"failures": 3}},
+	"storage_threshold_crossed": {details: sampleStorageDetails},
+	"storage_threshold_cleared": {details: sampleStorageDetails},
+	"inode_threshold_crossed":   {details: sampleInodeDetails},
+	"inode_threshold_cleared":   {details: sampleInodeDetails},
+}
+
+const sampleChecksum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+var (
+	sampleStorageDetails = map[string]interface{}{"threshold": 0.8, "used": int64(850 << 20), "max": int64(1 << 30), "ratio": 0.83}
+	sampleInodeDetails   = map[string]interface{}{"threshold": 0.8, "inodes_free": uint64(1500), "inodes_total": uint64(10000), "ratio": 0.85}
+)
+
+// notificationData is what notification templates are executed with. File
+// is nil for events that aren't about one file; the fields after it
+// describe that file ready for display. URL is only set in webhook messages
+// when base_url is.
+type notificationData struct {
+	Event   string
+	Time    time.Time
+	Details map[string]interface{}
+	File    *publicFile
+
+	Filename  string // the title, or the name it was uploaded with
+	URL       string // share page
+	Size      string // e.g. 1.5 MB
+	Expires   string
+	Checksum  string
+	Protected bool
+}
+
+// notificationTemplate is the subject and body of an event's message.
+type notificationTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// notificationMessage is a rendered notification.
+type notificationMessage struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// notificationTemplates are the custom templates from
+// notification_template_dir, by event.
+type notificationTemplates map[string]notificationTemplate
+
+// builtinUploadEmail is the email sent to notify_email, used for upload and
+// file_request_upload unless a custom template replaces it.
+var builtinUploadEmail = notificationTemplate{
+	subject: template.Must(newNotificationTemplate("subject").Parse(`File uploaded: {{.Filename}}`)),
+	body:    uploadEmailTemplate,
+}
+
+func newNotificationTemplate(name string) *template.Template {
+	return template.New(name).Funcs(template.FuncMap(parseFuncs))
+}
+
+// loadNotificationTemplates reads the custom templates in dir, named
+// {event}.subject.tmpl and {event}.body.tmpl; an event may override either
+// or both. Every template is executed against the synthetic event, so a
+// template that would fail when the event fires, or a file for an unknown
+// event, is reported here. An empty dir means no custom templates.
+func loadNotificationTemplates(dir string) (notificationTemplates, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("notification_template_dir: %w", err)
+	}
+	templates := make(notificationTemplates)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".tmpl")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		event, part, _ := strings.Cut(name, ".")
+		if _, known := notificationEvents[event]; !known {
+			return nil, fmt.Errorf("notification template %s: unknown event %q", entry.Name(), event)
+		}
+		if part != "subject" && part != "body" {
+			return nil, fmt.Errorf("notification template %s: expected %s.subject.tmpl or %s.body.tmpl", entry.Name(), event, event)
+		}
+		text, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("notification template %s: %w", entry.Name(), err)
+		}
+		t, err := parseNotificationPart(event, part, string(text))
+		if err != nil {
+			return nil, fmt.Errorf("notification template %s: %w", entry.Name(), err)
+		}
+		custom := templates[event]
+		if part == "subject" {
+			custom.subject = t
+		} else {
+			custom.body = t
+		}
+		templates[event] = custom
+	}
+	return templates, nil
+}
+
+// parseNotificationPart parses the subject or body template of event and
+// tries it on the synthetic event.
+func parseNotificationPart(event, part, text string) (*template.Template, error) {
+	t, err := newNotificationTemplate(part).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := executeNotification(t, sampleNotification(event, "https://files.example.com")); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func executeNotification(t *template.Template, data notificationData) (string, error) {
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// loadCustomNotifications swaps in the templates of notification_template_dir,
+// at startup and on reload. Validate has already checked them, so an error
+// here means the files changed in between; the previous set is kept then.
+func (fm *FileManager) loadCustomNotifications() {
+	templates, err := loadNotificationTemplates(fm.config().NotificationTemplates)
+	if err != nil {
+		log.Printf("Keeping the previous notification templates: %v", err)
+		return
+	}
+	fm.notifyTemplates.Store(&templates)
+}
+
+// customNotification returns the custom templates of event, if any.
+func (fm *FileManager) customNotification(event string) notificationTemplate {
+	if templates := fm.notifyTemplates.Load(); templates != nil {
+		return (*templates)[event]
+	}
+	return notificationTemplate{}
+}
+
+// renderNotification renders custom with the template functions bound to
+// r, which is nil outside of requests. Each part falls back to builtin,
+// which may be nil when the channel has no wording of its own; a custom
+// template that fails is logged and replaced by the built-in rather than
+// dropping the notification. It reports false when there is nothing to
+// render.
+func (fm *FileManager) renderNotification(r *http.Request, custom notificationTemplate, builtin *notificationTemplate, data notificationData) (notificationMessage, bool) {
+	if custom.subject == nil && custom.body == nil && builtin == nil {
+		return notificationMessage{}, false
+	}
+	if builtin == nil {
+		builtin = &notificationTemplate{}
+	}
+	funcs := template.FuncMap(fm.templateFuncs(r))
+	render := func(part string, t, fallback *template.Template) string {
+		if t != nil {
+			text, err := executeNotification(template.Must(t.Clone()).Funcs(funcs), data)
+			if err == nil {
+				return text
+			}
+			log.Printf("Error rendering the %s %s template, using the built-in one: %v", data.Event, part, err)
+		}
+		if fallback == nil {
+			return ""
+		}
+		text, err := executeNotification(fallback, data)
+		if err != nil {
+			log.Printf("Error rendering the built-in %s %s template: %v", data.Event, part, err)
+		}
+		return text
+	}
+	return notificationMessage{
+		// A subject is one header line, whatever the template produced
+		Subject: strings.Join(strings.Fields(render("subject", custom.subject, builtin.subject)), " "),
+		Body:    render("body", custom.body, builtin.body),
+	}, true
+}
+
+// newNotificationData describes fileInfo, if any, for the templates of
+// event; callers outside of Validate hold fm.mutex for reading. base is the
+// server's base URL for the share page link, or empty.
+func newNotificationData(event string, fileInfo *FileInfo, details map[string]interface{}, base string) notificationData {
+	data := notificationData{Event: event, Time: time.Now(), Details: details}
+	if fileInfo != nil {
+		file := newPublicFile(fileInfo)
+		data.File = &file
+		data.Filename = fileInfo.Label()
+		data.Size = formatBytes(fileInfo.Size)
+		data.Expires = fileInfo.ExpiresAt.UTC().Format(time.RFC1123)
+		data.Checksum = fileInfo.Checksum
+		data.Protected = fileInfo.Password != ""
+		if base != "" {
+			data.URL = base + "/f/" + url.PathEscape(fileInfo.ID)
+		}
+	}
+	return data
+}
+
+// sampleNotification is the synthetic event templates are checked and
+// previewed against, linking below base.
+func sampleNotification(event, base string) notificationData {
+	sample := notificationEvents[event]
+	var fileInfo *FileInfo
+	if sample.file {
+		now := time.Now().UTC().Truncate(time.Second)
+		fileInfo = &FileInfo{
+			ID:           "example",
+			OriginalName: "report.pdf",
+			Size:         1 << 20,
+			ContentType:  "application/pdf",
+			Checksum:     sampleChecksum,
+			UploadTime:   now,
+			ExpiresAt:    now.Add(24 * time.Hour),
+			Tags:         []string{"reports"},
+			Description:  "Quarterly report",
+			Metadata:     map[string]string{"pages": "12"},
+		}
+	}
+	return newNotificationData(event, fileInfo, sample.details, base)
+}
+
+// previewNotification handles POST /api/admin/notifications/preview:
+// {"event", "subject", "body"} renders the given template text, or the
+// event's current templates where it is left out, against the synthetic
+// event. Templates that don't parse or execute are answered with 422, so
+// they can be fixed before being deployed.
+func (fm *FileManager) previewNotification(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Event   string  `json:"event"`
+		Subject *string `json:"subject"`
+		Body    *string `json:"body"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256<<10)).Decode(&request); err != nil {
+		respondError(w, r, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if _, known := notificationEvents[request.Event]; !known {
+		events := make([]string, 0, len(notificationEvents))
+		for event := range notificationEvents {
+			events = append(events, event)
+		}
+		sort.Strings(events)
+		respondError(w, r, fmt.Sprintf("Unknown event %q, expected one of %s", request.Event, strings.Join(events, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	custom := fm.customNotification(request.Event)
+	for _, part := range []struct {
+		name   string
+		text   *string
+		target **template.Template
+	}{{"subject", request.Subject, &custom.subject}, {"body", request.Body, &custom.body}} {
+		if part.text == nil {
+			continue
+		}
+		t, err := parseNotificationPart(request.Event, part.name, *part.text)
+		if err != nil {
+			respondError(w, r, fmt.Sprintf("%s template: %v", part.name, err), http.StatusUnprocessableEntity)
+			return
+		}
+		*part.target = t
+	}
+
+	var builtin *notificationTemplate
+	if notificationEvents[request.Event].email {
+		builtin = &builtinUploadEmail
+	}
+	message, _ := fm.renderNotification(r, custom, builtin, sampleNotification(request.Event, fm.baseURL(r)))
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"event":   request.Event,
+		"subject": message.Subject,
+		"body":    message.Body,
+		"custom":  custom.subject != nil || custom.body != nil,
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// fileOrders are the sort orders offered by the listing endpoints. Files are
+// sorted by the key descending, with the ID as tie-breaker so the order is
+// total and cursors are unambiguous.
+var fileOrders = map[string]func(*FileInfo) int64{
+	"upload_time": func(f *FileInfo) int64 { return f.UploadTime.UnixNano() },
+	"size":        func(f *FileInfo) int64 { return f.Size },
+	"downloads":   func(f *FileInfo) int64 { return int64(f.Downloads) },
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// listCursor marks the last row of a page. It is handed to clients as an
+// opaque token and is only valid for the sort order it was created with.
+type listCursor struct {
+	Sort string `json:"s"`
+	Key  int64  `json:"k"`
+	ID   string `json:"id"`
+}
+
+func sortFiles(files []*FileInfo, order string) {
+	key := fileOrders[order]
+	sort.Slice(files, func(i, j int) bool {
+		ki, kj := key(files[i]), key(files[j])
+		if ki != kj {
+			return ki > kj
+		}
+		return files[i].ID < files[j].ID
+	})
+}
+
+func encodeCursor(order string, fileInfo *FileInfo) string {
+	data, _ := json.Marshal(listCursor{Sort: order, Key: fileOrders[order](fileInfo), ID: fileInfo.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token, order string) (listCursor, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || json.Unmarshal(data, &c) != nil || c.ID == "" {
+		return c, errInvalidCursor
+	}
+	if c.Sort != order {
+		return c, errors.New("cursor was created for a different sort order")
+	}
+	return c, nil
+}
+
+// pageAfter returns up to limit files following the cursor position in files,
+// which must be sorted by sortFiles, and the cursor for the next page ("" on
+// the last page). The position does not need to be a file that still exists,
+// so uploads and deletions elsewhere in the list never shift the page.
+func pageAfter(files []*FileInfo, c listCursor, limit int) ([]*FileInfo, string) {
+	key := fileOrders[c.Sort]
+	start := sort.Search(len(files), func(i int) bool {
+		k := key(files[i])
+		return k < c.Key || (k == c.Key && files[i].ID > c.ID)
+	})
+	return firstPage(files[start:], c.Sort, limit)
+}
+
+// firstPage returns up to limit files from the start of files and the cursor
+// for the next page.
+func firstPage(files []*FileInfo, order string, limit int) ([]*FileInfo, string) {
+	if len(files) <= limit {
+		return files, ""
+	}
+	files = files[:limit]
+	return files, encodeCursor(order, files[limit-1])
+}
+
+// pageLimit reads the limit= query parameter, falling back to 50 when it is
+// missing or outside 1..1000.
+func pageLimit(r *http.Request) int {
+	if parsed, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && parsed > 0 && parsed <= 1000 {
+		return parsed
+	}
+	return 50
+}
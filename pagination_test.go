@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// seedFiles adds n records with distinct upload times and sizes, newest and
+// largest last, and returns their IDs.
+func seedFiles(fm *FileManager, prefix string, n int, base time.Time) []string {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	ids := make([]string, n)
+	for i := range ids {
+		id := fmt.Sprintf("%s%03d", prefix, i)
+		fm.files[id] = &FileInfo{
+			ID:           id,
+			Filename:     id + ".txt",
+			OriginalName: id + ".txt",
+			Size:         int64(1000 + i),
+			UploadTime:   base.Add(time.Duration(i) * time.Second),
+			ExpiresAt:    base.Add(24 * time.Hour),
+		}
+		ids[i] = id
+	}
+	return ids
+}
+
+func removeSeeded(fm *FileManager, ids ...string) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	for _, id := range ids {
+		delete(fm.files, id)
+	}
+}
+
+func TestCursorPaginationWithMutations(t *testing.T) {
+	for _, endpoint := range []struct {
+		name  string
+		path  string
+		query url.Values
+	}{
+		{"api/files", "/api/files", url.Values{}},
+		{"search by size", "/search", url.Values{"sort": {"size"}}},
+	} {
+		t.Run(endpoint.name, func(t *testing.T) {
+			fm, server := newTestServer(t, nil)
+			base := time.Now().Add(-time.Hour)
+			ids := seedFiles(fm, "f", 20, base)
+
+			// Newest first: f019 ... f000. Pages are 4 files long.
+			stable := map[string]bool{}
+			for _, id := range ids {
+				stable[id] = true
+			}
+			deletedAhead := map[string]bool{}
+			seen := map[string]int{}
+			cursor := ""
+			for page := 0; ; page++ {
+				if page > 20 {
+					t.Fatal("pagination did not end")
+				}
+				query := url.Values{"limit": {"4"}}
+				for k, v := range endpoint.query {
+					query[k] = v
+				}
+				if cursor != "" {
+					query.Set("cursor", cursor)
+				}
+				status, body := getJSON(t, server, endpoint.path+"?"+query.Encode())
+				if status != 200 {
+					t.Fatalf("page %d: status %d, body %v", page, status, body)
+				}
+				files, _ := body["files"].([]interface{})
+				for _, file := range files {
+					seen[file.(map[string]interface{})["id"].(string)]++
+				}
+				next, _ := body["next_cursor"].(string)
+				if next == "" {
+					break
+				}
+				cursor = next
+
+				// Between pages: uploads ahead of the cursor's position,
+				// deletions of files already seen and of files not reached yet
+				added := seedFiles(fm, fmt.Sprintf("new%d-", page), 2, base.Add(time.Hour+time.Duration(page)*time.Minute))
+				for _, id := range added {
+					fm.mutex.Lock()
+					fm.files[id].Size = 5000 + int64(page)
+					fm.mutex.Unlock()
+				}
+				switch page {
+				case 0:
+					removeSeeded(fm, "f019", "f018")
+					delete(stable, "f019")
+					delete(stable, "f018")
+				case 1:
+					removeSeeded(fm, "f005", "f004")
+					delete(stable, "f005")
+					delete(stable, "f004")
+					deletedAhead["f005"], deletedAhead["f004"] = true, true
+				}
+			}
+
+			for id, n := range seen {
+				if n > 1 {
+					t.Errorf("%s listed %d times", id, n)
+				}
+				if deletedAhead[id] {
+					t.Errorf("%s listed after it was deleted", id)
+				}
+			}
+			for id := range stable {
+				if seen[id] != 1 {
+					t.Errorf("%s, present throughout, listed %d times", id, seen[id])
+				}
+			}
+		})
+	}
+}
+
+func TestCursorForOtherSortRejected(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	seedFiles(fm, "f", 5, time.Now().Add(-time.Hour))
+
+	status, body := getJSON(t, server, "/search?sort=size&limit=2")
+	cursor, _ := body["next_cursor"].(string)
+	if status != 200 || cursor == "" {
+		t.Fatalf("first page: status %d, body %v", status, body)
+	}
+	if status, _ := getJSON(t, server, "/search?sort=downloads&limit=2&cursor="+url.QueryEscape(cursor)); status != 400 {
+		t.Errorf("cursor for another order: status %d, want 400", status)
+	}
+	if status, _ := getJSON(t, server, "/search?limit=2&cursor=garbage"); status != 400 {
+		t.Errorf("malformed cursor: status %d, want 400", status)
+	}
+}
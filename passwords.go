@@ -0,0 +1,158 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxFilePassword is the longest password bcrypt can hash.
+const maxFilePassword = 72
+
+var (
+	errPasswordIncorrect = errors.New("incorrect password")
+	errPasswordTooLong   = errors.New("passwords can be at most 72 bytes")
+)
+
+// The password cache holds at most maxVerifiedPasswords matches, each for
+// up to verifiedPasswordTTL.
+const (
+	maxVerifiedPasswords = 4096
+	verifiedPasswordTTL  = 10 * time.Minute
+)
+
+// passwordCache remembers the file passwords that matched, as the SHA-256
+// of file ID, hash and password, so resumed and repeated downloads don't pay
+// for bcrypt every time. The least recently used entry goes first when it
+// is full. The zero value is ready to use.
+type passwordCache struct {
+	mutex   sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	byFile  map[string]map[[sha256.Size]byte]bool
+	lru     *list.List // of *verifiedPassword, most recently used first
+}
+
+type verifiedPassword struct {
+	sum     [sha256.Size]byte
+	fileID  string
+	expires time.Time
+}
+
+// verified reports whether sum matched recently.
+func (c *passwordCache) verified(sum [sha256.Size]byte, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[sum]
+	if !ok {
+		return false
+	}
+	if now.After(elem.Value.(*verifiedPassword).expires) {
+		c.remove(elem)
+		return false
+	}
+	c.lru.MoveToFront(elem)
+	return true
+}
+
+// remember records that sum matched for fileID.
+func (c *passwordCache) remember(fileID string, sum [sha256.Size]byte, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[[sha256.Size]byte]*list.Element)
+		c.byFile = make(map[string]map[[sha256.Size]byte]bool)
+		c.lru = list.New()
+	}
+	if elem, ok := c.entries[sum]; ok {
+		c.remove(elem)
+	}
+	for c.lru.Len() >= maxVerifiedPasswords {
+		c.remove(c.lru.Back())
+	}
+	c.entries[sum] = c.lru.PushFront(&verifiedPassword{sum: sum, fileID: fileID, expires: now.Add(verifiedPasswordTTL)})
+	if c.byFile[fileID] == nil {
+		c.byFile[fileID] = make(map[[sha256.Size]byte]bool)
+	}
+	c.byFile[fileID][sum] = true
+}
+
+// forget drops the entries of fileID, once it is removed or its password
+// changes.
+func (c *passwordCache) forget(fileID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for sum := range c.byFile[fileID] {
+		c.remove(c.entries[sum])
+	}
+}
+
+func (c *passwordCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*verifiedPassword)
+	delete(c.entries, entry.sum)
+	delete(c.byFile[entry.fileID], entry.sum)
+	if len(c.byFile[entry.fileID]) == 0 {
+		delete(c.byFile, entry.fileID)
+	}
+}
+
+// hashFilePassword returns the bcrypt hash stored for a file password.
+func hashFilePassword(password string) (string, error) {
+	if len(password) > maxFilePassword {
+		return "", errPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// isPasswordHash reports whether a stored password is already hashed;
+// metadata from older versions kept them in plain text.
+func isPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// checkPassword compares the password in creds with fileInfo's. It returns
+// errPasswordRequired when none was given and errPasswordIncorrect when it
+// doesn't match.
+func (fm *FileManager) checkPassword(fileInfo *FileInfo, creds downloadCredentials) error {
+	if fileInfo.Password == "" || creds.SkipPassword {
+		return nil
+	}
+	if creds.Password == "" {
+		return errPasswordRequired
+	}
+	now := time.Now()
+	sum := sha256.Sum256([]byte(fileInfo.ID + "\x00" + fileInfo.Password + "\x00" + creds.Password))
+	if fm.verifiedPasswords.verified(sum, now) {
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(fileInfo.Password), []byte(creds.Password)) != nil {
+		return errPasswordIncorrect
+	}
+	fm.verifiedPasswords.remember(fileInfo.ID, sum, now)
+	return nil
+}
+
+// hashPlainPasswords hashes the plain-text passwords of files loaded from
+// older metadata in place and reports how many there were.
+func hashPlainPasswords(files map[string]*FileInfo) int {
+	hashed := 0
+	for id, fileInfo := range files {
+		if fileInfo.Password == "" || isPasswordHash(fileInfo.Password) {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(fileInfo.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("Error hashing the password of %s: %v", id, err)
+			continue
+		}
+		fileInfo.Password = string(hash)
+		hashed++
+	}
+	return hashed
+}
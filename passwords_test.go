@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordCacheBounded(t *testing.T) {
+	var cache passwordCache
+	now := time.Now()
+	sum := func(i int) [sha256.Size]byte { return sha256.Sum256([]byte(fmt.Sprint(i))) }
+
+	for i := range maxVerifiedPasswords + 10 {
+		cache.remember(fmt.Sprintf("f%d", i%3), sum(i), now)
+	}
+	if n := cache.lru.Len(); n != maxVerifiedPasswords {
+		t.Errorf("%d entries, want at most %d", n, maxVerifiedPasswords)
+	}
+	if cache.verified(sum(0), now) {
+		t.Error("least recently used entry kept past the bound")
+	}
+	last := sum(maxVerifiedPasswords + 9)
+	if !cache.verified(last, now) {
+		t.Error("newest entry dropped")
+	}
+	if cache.verified(last, now.Add(verifiedPasswordTTL+time.Second)) {
+		t.Error("entry verified past its TTL")
+	}
+	if cache.verified(last, now) {
+		t.Error("expired entry kept")
+	}
+
+	for _, id := range []string{"f0", "f1", "f2"} {
+		cache.forget(id)
+	}
+	if len(cache.entries) != 0 || len(cache.byFile) != 0 || cache.lru.Len() != 0 {
+		t.Errorf("entries left after forgetting every file: %d, %d, %d", len(cache.entries), len(cache.byFile), cache.lru.Len())
+	}
+}
+
+func TestVerifiedPasswordsDroppedWithFile(t *testing.T) {
+	fm := NewTestFileManager(nil)
+	defer fm.Close()
+	hash, err := hashFilePassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedFiles(fm, "f", 2, time.Now())
+	fm.mutex.Lock()
+	for _, fileInfo := range fm.files {
+		fileInfo.Password = hash
+	}
+	kept, removed := fm.files["f000"], fm.files["f001"]
+	fm.mutex.Unlock()
+
+	creds := downloadCredentials{Password: "hunter2"}
+	for _, fileInfo := range []*FileInfo{kept, removed} {
+		if err := fm.checkPassword(fileInfo, creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fm.checkPassword(kept, downloadCredentials{Password: "wrong"}); err != errPasswordIncorrect {
+		t.Errorf("wrong password: %v", err)
+	}
+	if n := len(fm.verifiedPasswords.byFile); n != 2 {
+		t.Fatalf("%d files in the cache, want 2", n)
+	}
+
+	fm.removeFile(nil, removed.ID)
+	if _, ok := fm.verifiedPasswords.byFile[removed.ID]; ok {
+		t.Error("verified password kept after the file was removed")
+	}
+	if _, ok := fm.verifiedPasswords.byFile[kept.ID]; !ok {
+		t.Error("verified password of another file dropped")
+	}
+}
+
+func TestVerifiedPasswordsDroppedOnChange(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	status, uploaded := uploadTestFile(t, server, "secret.txt", []byte("psst"), url.Values{"password": {"hunter2"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+	fm.mutex.RLock()
+	fileInfo := fm.files[id]
+	fm.mutex.RUnlock()
+	if err := fm.checkPassword(fileInfo, downloadCredentials{Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("PATCH", server.URL+"/api/files/"+id, strings.NewReader(`{"password": "correct horse"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if status, body := doJSON(t, req); status != http.StatusOK {
+		t.Fatalf("PATCH: status %d, body %v", status, body)
+	}
+	if _, ok := fm.verifiedPasswords.byFile[id]; ok {
+		t.Error("verified password kept after the password changed")
+	}
+	if err := fm.checkPassword(fileInfo, downloadCredentials{Password: "hunter2"}); err != errPasswordIncorrect {
+		t.Errorf("old password after the change: %v", err)
+	}
+}
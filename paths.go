@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Storage keys are slash-separated paths relative to UploadDir. They are the
+// only form written to metadata, so a metadata file stays valid across
+// platforms and across changes to upload_dir; the storage backend resolves a
+// key at the point of access. filePath gives the OS path of a key in local
+// storage, for the proxy to serve with sendfile_mode.
+func (fm *FileManager) filePath(fileInfo *FileInfo) string {
+	return filepath.Join(fm.config().UploadDir, filepath.FromSlash(fileInfo.StorageKey))
+}
+
+// partsDir holds uploads while they are received. It lies below upload_dir,
+// so a finished upload is moved into place with a rename rather than copied.
+const partsDir = ".parts"
+
+// removeStaleParts deletes partial uploads left behind by a crash; it runs
+// at startup, before any upload can be in progress.
+func (fm *FileManager) removeStaleParts() {
+	if err := fm.storage.RemoveAll(partsDir); err != nil {
+		log.Printf("Error removing partial uploads: %v", err)
+	}
+}
+
+// deleteStoredFile removes a file's content from storage along with any
+// cached copy. Links have no content, so only their record goes.
+func (fm *FileManager) deleteStoredFile(fileInfo *FileInfo) error {
+	if fileInfo.isLink() {
+		return nil
+	}
+	fm.cache.invalidate(fileInfo.ID)
+	return fm.contentStorage(fileInfo).Remove(fileInfo.StorageKey)
+}
+
+// normalizeStorageKey converts a stored path from older metadata, which may be
+// absolute, prefixed with upload_dir, or written with backslashes on
+// Windows, into a storage key.
+func (fm *FileManager) normalizeStorageKey(stored string) string {
+	key, _ := storageKeyUnder(stored, fm.config().UploadDir)
+	return key
+}
+
+// storageKeyUnder converts stored into a storage key relative to dir. It
+// reports false when stored is an absolute path outside dir, which is then
+// returned with forward slashes but otherwise unchanged.
+func storageKeyUnder(stored, dir string) (string, bool) {
+	key := strings.ReplaceAll(stored, `\`, "/")
+
+	cleanDir := strings.ReplaceAll(filepath.Clean(dir), `\`, "/")
+	if absDir, err := filepath.Abs(dir); err == nil {
+		absDir = strings.ReplaceAll(absDir, `\`, "/")
+		if rest, ok := strings.CutPrefix(key, absDir+"/"); ok {
+			return rest, true
+		}
+	}
+	if rest, ok := strings.CutPrefix(path.Clean(key), cleanDir+"/"); ok {
+		return rest, true
+	}
+	if path.IsAbs(key) || filepath.IsAbs(stored) {
+		return key, false
+	}
+	return strings.TrimPrefix(key, "./"), true
+}
+
+// windowsReserved lists device names Windows refuses as file names, with or
+// without an extension. Windows also takes the superscript digits ¹, ² and
+// ³ as port numbers.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM0": true, "COM1": true, "COM2": true, "COM3": true, "COM4": true,
+	"COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"COM¹": true, "COM²": true, "COM³": true,
+	"LPT0": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true,
+	"LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	"LPT¹": true, "LPT²": true, "LPT³": true,
+}
+
+// unsafeNameChars are replaced in stored names: path separators, and the
+// characters Windows refuses in file names.
+var unsafeNameChars = strings.NewReplacer(
+	"/", "_", `\`, "_", "<", "_", ">", "_", ":", "_", `"`, "_", "|", "_", "?", "_", "*", "_",
+)
+
+// sanitizeFilename produces a name that can be created on any platform.
+func sanitizeFilename(name string) string {
+	// Windows silently strips trailing dots and spaces, so the file could
+	// never be opened again under the name we recorded
+	safe := strings.ReplaceAll(strings.TrimRight(name, ". "), " ", "_")
+	// Names such as S3 keys may contain separators; the stored file is flat
+	safe = unsafeNameChars.Replace(safe)
+	safe = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, safe)
+	if safe == "" {
+		safe = "file"
+	}
+
+	// Windows also matches a device name followed by spaces, as in
+	// "CON .txt", which the spaces' underscores stand for here
+	base, _, _ := strings.Cut(safe, ".")
+	if windowsReserved[strings.ToUpper(strings.TrimRight(base, "_"))] {
+		safe = "_" + safe
+	}
+	return safe
+}
+
+var errUnsafeName = errors.New("file name would be stored outside the upload directory")
+
+// checkUploadKey verifies that key names a file directly inside upload_dir
+// before anything is created under it. sanitizeFilename already flattens
+// names; this guards against a name that slips past it.
+func (fm *FileManager) checkUploadKey(key string) error {
+	dir := fm.config().UploadDir
+	rel, err := filepath.Rel(dir, filepath.Join(dir, filepath.FromSlash(key)))
+	if err != nil || rel != filepath.Base(rel) || rel == "." || rel == ".." {
+		return fmt.Errorf("%w: %q", errUnsafeName, key)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sanitizeCases are names Windows refuses or mangles, with what they are
+// stored as.
+var sanitizeCases = []struct{ name, want string }{
+	{"report.pdf", "report.pdf"},
+	{"my report.pdf", "my_report.pdf"},
+	{`a<b>c:d"e|f?g*h.txt`, "a_b_c_d_e_f_g_h.txt"},
+	{`dir/sub\file.txt`, "dir_sub_file.txt"},
+	{"notes.txt. . ", "notes.txt"},
+	{"tab\there\x00.txt", "tab_here_.txt"},
+	{"...", "file"},
+	{"", "file"},
+	{"CON", "_CON"},
+	{"con.txt", "_con.txt"},
+	{"Nul.tar.gz", "_Nul.tar.gz"},
+	{"CON .txt", "_CON_.txt"},
+	{"com1.log", "_com1.log"},
+	{"LPT9", "_LPT9"},
+	{"COM0.txt", "_COM0.txt"},
+	{"lpt¹.txt", "_lpt¹.txt"},
+	{"CONOUT$", "_CONOUT$"},
+	{"conin$.txt", "_conin$.txt"},
+	{"CONSOLE.txt", "CONSOLE.txt"},
+	{"COM10.txt", "COM10.txt"},
+	{"aux-notes.txt", "aux-notes.txt"},
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	for _, tc := range sanitizeCases {
+		if got := sanitizeFilename(tc.name); got != tc.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStoredNamesStayInUploadDir(t *testing.T) {
+	fm := NewTestFileManager(nil)
+	defer fm.Close()
+	for _, name := range []string{
+		"../x",
+		`..\x`,
+		"../../etc/cron.d/evil",
+		`..\..\Windows\win.ini`,
+		"/etc/passwd",
+		`C:\Windows\System32\drivers\etc\hosts`,
+		"a/../../b",
+		"..",
+		".",
+	} {
+		fileInfo, err := fm.storeFile(context.Background(), strings.NewReader("content"), uploadRequest{Filename: name, TTL: time.Hour})
+		if err != nil {
+			t.Errorf("storing %q: %v", name, err)
+			continue
+		}
+		if strings.ContainsAny(fileInfo.StorageKey, `/\`) {
+			t.Errorf("%q stored under key %q, want a flat name", name, fileInfo.StorageKey)
+		}
+		dir := fm.config().UploadDir
+		if rel, err := filepath.Rel(dir, fm.filePath(fileInfo)); err != nil || rel != filepath.Base(rel) || strings.HasPrefix(rel, "..") {
+			t.Errorf("%q stored at %q, outside %q", name, fm.filePath(fileInfo), dir)
+		}
+		if fileInfo.OriginalName != normalizeName(name) {
+			t.Errorf("%q kept as original name %q", name, fileInfo.OriginalName)
+		}
+	}
+}
+
+func TestCheckUploadKey(t *testing.T) {
+	fm := NewTestFileManager(nil)
+	defer fm.Close()
+	for key, ok := range map[string]bool{
+		"abc_report.pdf": true,
+		"abc_..x":        true,
+		"../x":           false,
+		"a/../../x":      false,
+		"sub/x":          false,
+		"..":             false,
+		".":              false,
+		"":               false,
+	} {
+		if err := fm.checkUploadKey(key); (err == nil) != ok || (err != nil && !errors.Is(err, errUnsafeName)) {
+			t.Errorf("checkUploadKey(%q) = %v, want ok %v", key, err, ok)
+		}
+	}
+}
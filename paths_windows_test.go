@@ -0,0 +1,34 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSanitizedNamesRoundTrip creates each sanitized name on a real Windows
+// filesystem and checks it is listed and opened under the same name.
+func TestSanitizedNamesRoundTrip(t *testing.T) {
+	for _, tc := range sanitizeCases {
+		dir := t.TempDir()
+		name := sanitizeFilename(tc.name)
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("creating %q (from %q): %v", name, tc.name, err)
+			continue
+		}
+		f.Close()
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("stat %q: %v", name, err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name() != name {
+			t.Errorf("created %q, directory lists %v", name, entries)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// persistenceState tracks whether metadata and uploads are reaching disk, so
+// a full disk or a permission change shows up in /api/health instead of only
+// in the logs.
+type persistenceState struct {
+	mutex               sync.Mutex
+	consecutiveFailures int
+	lastSuccess         time.Time
+	lastError           string
+}
+
+type PersistenceStatus struct {
+	Degraded            bool      `json:"degraded"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success,omitzero"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// recordPersistence updates the persistence state after a write. The first
+// failure in a row and the recovery that ends it are both announced.
+func (fm *FileManager) recordPersistence(err error) {
+	p := &fm.persistence
+	p.mutex.Lock()
+	failures := p.consecutiveFailures
+	if err == nil {
+		p.consecutiveFailures = 0
+		p.lastSuccess = time.Now()
+		p.lastError = ""
+	} else {
+		p.consecutiveFailures++
+		p.lastError = err.Error()
+	}
+	lastSuccess := p.lastSuccess
+	p.mutex.Unlock()
+
+	switch {
+	case err == nil && failures > 0:
+		log.Printf("Persistence recovered after %d failures", failures)
+		fm.notify("persistence_recovered", map[string]interface{}{"failures": failures})
+	case err != nil && failures == 0:
+		log.Printf("Persistence failing: %v", err)
+		fm.notify("persistence_failed", map[string]interface{}{
+			"error":        err.Error(),
+			"last_success": lastSuccess,
+		})
+	}
+}
+
+func (fm *FileManager) persistenceStatus() PersistenceStatus {
+	p := &fm.persistence
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return PersistenceStatus{
+		Degraded:            p.consecutiveFailures > 0,
+		ConsecutiveFailures: p.consecutiveFailures,
+		LastSuccess:         p.lastSuccess,
+		LastError:           p.lastError,
+	}
+}
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// isStorageError reports errors caused by the disk rather than the client,
+// e.g. a full disk, a read-only mount or changed permissions.
+func isStorageError(err error) bool {
+	return isDiskFull(err) || errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EROFS)
+}
+
+// storageFailure records storage errors against the persistence state and
+// returns err, naming the limit hit when it was the path length or inodes.
+func (fm *FileManager) storageFailure(err error) error {
+	err = fm.explainStorageError(err)
+	if isStorageError(err) {
+		fm.recordPersistence(err)
+	}
+	return err
+}
+
+// writeStorageError answers a failed upload, telling a full disk (507) and a
+// path too long for the filesystem (422) apart from other server-side
+// failures.
+func writeStorageError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errPathTooLong):
+		respondError(w, r, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, errNoInodes):
+		respondError(w, r, "Insufficient storage: no free inodes", http.StatusInsufficientStorage)
+	case isDiskFull(err):
+		respondError(w, r, "Insufficient storage", http.StatusInsufficientStorage)
+	case isStorageError(err):
+		respondError(w, r, "Server error: storage is not writable", http.StatusInternalServerError)
+	default:
+		respondError(w, r, "Server error", http.StatusInternalServerError)
+	}
+}
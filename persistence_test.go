@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// failingStorage fails every write with err while it is set, the way a
+// full disk or a read-only mount does.
+type failingStorage struct {
+	Storage
+	mutex sync.Mutex
+	err   error
+}
+
+func (s *failingStorage) fail(err error) {
+	s.mutex.Lock()
+	s.err = err
+	s.mutex.Unlock()
+}
+
+func (s *failingStorage) failure(op, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: key, Err: s.err}
+}
+
+func (s *failingStorage) OpenFile(key string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0 {
+		if err := s.failure("open", key); err != nil {
+			return nil, err
+		}
+	}
+	return s.Storage.OpenFile(key, flag, perm)
+}
+
+func (s *failingStorage) MkdirAll(key string, perm fs.FileMode) error {
+	if err := s.failure("mkdir", key); err != nil {
+		return err
+	}
+	return s.Storage.MkdirAll(key, perm)
+}
+
+// failingMetadata is failingStorage for the metadata store.
+type failingMetadata struct {
+	MetadataStore
+	storage *failingStorage
+}
+
+func (m failingMetadata) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := m.storage.failure("open", name); err != nil {
+		return err
+	}
+	return m.MetadataStore.WriteFile(name, data, perm)
+}
+
+// healthStatus returns the status and persistence section of /api/health.
+func healthStatus(t *testing.T, server *httptest.Server) (string, PersistenceStatus) {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/api/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var health struct {
+		Status      string            `json:"status"`
+		Persistence PersistenceStatus `json:"persistence"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	return health.Status, health.Persistence
+}
+
+func TestUploadStorageErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"disk full", syscall.ENOSPC, http.StatusInsufficientStorage},
+		{"permission denied", syscall.EACCES, http.StatusInternalServerError},
+		{"read-only filesystem", syscall.EROFS, http.StatusInternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fm := NewTestFileManager(nil)
+			failing := &failingStorage{Storage: fm.storage}
+			fm.storage = failing
+			server := httptest.NewServer(fm.Handler())
+			t.Cleanup(func() {
+				server.Close()
+				fm.Close()
+			})
+
+			failing.fail(tc.err)
+			if status, body := uploadTestFile(t, server, "a.txt", []byte("content"), nil); status != tc.status {
+				t.Fatalf("upload: status %d, body %v, want %d", status, body, tc.status)
+			}
+			status, persistence := healthStatus(t, server)
+			if status != "degraded" || persistence.ConsecutiveFailures != 1 || persistence.LastError == "" {
+				t.Errorf("health after the failure: %s, %+v", status, persistence)
+			}
+
+			// The next successful save clears it
+			failing.fail(nil)
+			if status, body := uploadTestFile(t, server, "a.txt", []byte("content"), nil); status != http.StatusOK {
+				t.Fatalf("upload after recovery: status %d, body %v", status, body)
+			}
+			if err := fm.saveMetadata(); err != nil {
+				t.Fatal(err)
+			}
+			if status, persistence := healthStatus(t, server); status != "healthy" || persistence.Degraded {
+				t.Errorf("health after recovery: %s, %+v", status, persistence)
+			}
+		})
+	}
+}
+
+func TestMetadataSaveFailureNotifiesOnce(t *testing.T) {
+	events := make(chan string, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct{ Event string }
+		json.NewDecoder(r.Body).Decode(&payload)
+		events <- payload.Event
+	}))
+	defer webhook.Close()
+
+	fm, server := newTestServer(t, func(c *Config) {
+		c.NotifyWebhookURL = webhook.URL
+	})
+	failing := &failingStorage{}
+	fm.index = jsonIndex{failingMetadata{fm.metadata, failing}, fm.config().MetadataFile}
+
+	failing.fail(syscall.ENOSPC)
+	for i := range 3 {
+		if err := fm.saveMetadata(); err == nil {
+			t.Fatalf("save %d succeeded on a full disk", i+1)
+		}
+	}
+	if _, persistence := healthStatus(t, server); persistence.ConsecutiveFailures != 3 {
+		t.Errorf("persistence %+v, want 3 failures", persistence)
+	}
+	failing.fail(nil)
+	if err := fm.saveMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := healthStatus(t, server); status != "healthy" {
+		t.Errorf("health after a successful save: %s", status)
+	}
+
+	// One event for the failures in a row and one for the recovery
+	var got []string
+	for range 2 {
+		select {
+		case event := <-events:
+			got = append(got, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("events %q, want two", got)
+		}
+	}
+	if fmt.Sprint(got) != "[persistence_failed persistence_recovered]" {
+		t.Errorf("events %q", got)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("extra event %q", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReadOnlyDirectories(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	dir := t.TempDir()
+	fm, server := newTestServer(t, nil)
+	fm.storage = localStorage{dir: filepath.Join(dir, "files")}
+	fm.index = jsonIndex{localMetadata{}, filepath.Join(dir, "metadata.json")}
+	if err := fm.storage.MkdirAll("", 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(filepath.Join(dir, "files"), 0555)
+	os.Chmod(dir, 0555)
+	t.Cleanup(func() {
+		os.Chmod(dir, 0755)
+		os.Chmod(filepath.Join(dir, "files"), 0755)
+	})
+
+	if status, body := uploadTestFile(t, server, "a.txt", []byte("content"), nil); status != http.StatusInternalServerError {
+		t.Errorf("upload to a read-only upload_dir: status %d, body %v, want 500", status, body)
+	}
+	if err := fm.saveMetadata(); err == nil {
+		t.Error("metadata saved into a read-only directory")
+	}
+	if status, persistence := healthStatus(t, server); status != "degraded" || persistence.ConsecutiveFailures != 2 {
+		t.Errorf("health: %s, %+v", status, persistence)
+	}
+
+	os.Chmod(dir, 0755)
+	os.Chmod(filepath.Join(dir, "files"), 0755)
+	if err := fm.saveMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := healthStatus(t, server); status != "healthy" {
+		t.Errorf("health after the directories are writable again: %s", status)
+	}
+}
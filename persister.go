@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// metadataPersister coalesces metadata saves requested by uploads, deletes,
+// downloads and other changes. Any number of requests between two writes
+// collapse into a single save, and saves happen at most once per
+// metadata_save_interval. changes counts the changes to the file index and
+// saved how many of them the last save covered, so nothing is written while
+// they agree.
+type metadataPersister struct {
+	requests chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+
+	changes atomic.Uint64
+	saved   atomic.Uint64
+}
+
+func newMetadataPersister() *metadataPersister {
+	return &metadataPersister{
+		requests: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// markDirty counts a change to the file index for the next save, without
+// asking for one.
+func (fm *FileManager) markDirty() {
+	fm.persister.changes.Add(1)
+}
+
+// metadataDirty reports whether the file index changed since it was last
+// saved.
+func (fm *FileManager) metadataDirty() bool {
+	return fm.persister.changes.Load() != fm.persister.saved.Load()
+}
+
+// requestSave marks the metadata dirty and has the persister save it soon.
+// It never blocks, so request handlers don't wait for the index to be
+// written.
+func (fm *FileManager) requestSave() {
+	fm.markDirty()
+	select {
+	case fm.persister.requests <- struct{}{}:
+	default:
+	}
+}
+
+func (fm *FileManager) runPersister() {
+	p := fm.persister
+	defer close(p.done)
+
+	var last time.Time
+	for {
+		select {
+		case <-p.requests:
+		case <-p.stop:
+			fm.flushPendingSave()
+			return
+		}
+
+		if wait := fm.config().MetadataSaveInterval - time.Since(last); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-p.stop:
+				// This save also covers any request queued meanwhile.
+				timer.Stop()
+				if err := fm.saveMetadata(); err != nil {
+					log.Printf("Error saving metadata: %v", err)
+				}
+				return
+			}
+		}
+
+		if err := fm.saveMetadata(); err != nil {
+			log.Printf("Error saving metadata: %v", err)
+		}
+		last = time.Now()
+	}
+}
+
+// flushPendingSave writes the metadata if it changed since the last save,
+// whether or not a save was requested.
+func (fm *FileManager) flushPendingSave() {
+	select {
+	case <-fm.persister.requests:
+	default:
+	}
+	if !fm.metadataDirty() {
+		return
+	}
+	if err := fm.saveMetadata(); err != nil {
+		log.Printf("Error saving metadata: %v", err)
+	}
+}
+
+// goRoutine runs a background routine that Close stops and waits for.
+func (fm *FileManager) goRoutine(routine func()) {
+	fm.routines.Add(1)
+	go func() {
+		defer fm.routines.Done()
+		routine()
+	}()
+}
+
+// tick waits for the ticker's next tick and reports false instead once
+// Close was called.
+func (fm *FileManager) tick(ticker *time.Ticker) bool {
+	select {
+	case <-ticker.C:
+		return true
+	case <-fm.stop:
+		return false
+	}
+}
+
+// sleep waits for d and reports false instead once Close was called.
+func (fm *FileManager) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-fm.stop:
+		return false
+	}
+}
+
+// Close stops the cleanup, save, backup and tiering routines and waits for
+// a run in progress to finish. It then stops the persister, which writes
+// any pending metadata changes once saves already under way are done,
+// saves the side stores and closes the metadata backend. Only the first
+// call does anything.
+func (fm *FileManager) Close() {
+	fm.closeOnce.Do(func() {
+		close(fm.stop)
+		fm.routines.Wait()
+
+		close(fm.persister.stop)
+		<-fm.persister.done
+		fm.saveActivity()
+		fm.saveAPIKeys()
+		fm.saveTombstones()
+		fm.saveFileRequests()
+		if err := fm.index.Close(); err != nil {
+			log.Printf("Error closing the metadata backend: %v", err)
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingIndex counts the saves of the index it wraps and keeps the
+// records of the last one.
+type countingIndex struct {
+	FileIndex
+	saves atomic.Int64
+
+	mutex sync.Mutex
+	last  map[string]json.RawMessage
+}
+
+func (c *countingIndex) Save(records map[string]json.RawMessage) error {
+	c.saves.Add(1)
+	c.mutex.Lock()
+	c.last = records
+	c.mutex.Unlock()
+	return c.FileIndex.Save(records)
+}
+
+func TestDownloadStormCoalescesSaves(t *testing.T) {
+	const (
+		interval  = 50 * time.Millisecond
+		downloads = 400
+		workers   = 40
+	)
+	fm := NewTestFileManager(func(c *Config) { c.MetadataSaveInterval = interval })
+	server := httptest.NewServer(fm.Handler())
+	defer server.Close()
+	defer fm.Close()
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: workers}}
+
+	status, uploaded := uploadTestFile(t, server, "popular.txt", []byte("everyone wants this"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+
+	// Let the upload's save go out before counting
+	time.Sleep(2 * interval)
+	index := &countingIndex{}
+	fm.saveMutex.Lock()
+	index.FileIndex = fm.index
+	fm.index = index
+	fm.saveMutex.Unlock()
+	baseline := runtime.NumGoroutine()
+
+	start := time.Now()
+	jobs := make(chan struct{})
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				resp, err := client.Get(server.URL + "/download/" + id)
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("download: status %d", resp.StatusCode)
+				}
+			}
+		}()
+	}
+	for range downloads {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// At most one save per interval, the first right away
+	time.Sleep(2 * interval)
+	bound := int64(time.Since(start)/interval) + 1
+	if saves := index.saves.Load(); saves == 0 || saves > bound {
+		t.Errorf("%d downloads in %v caused %d saves, want 1 to %d", downloads, elapsed, saves, bound)
+	}
+
+	index.mutex.Lock()
+	var saved FileInfo
+	json.Unmarshal(index.last[id], &saved)
+	index.mutex.Unlock()
+	if saved.Downloads != downloads {
+		t.Errorf("last save recorded %d downloads, want %d", saved.Downloads, downloads)
+	}
+
+	// The handlers and saves left nothing running behind
+	client.CloseIdleConnections()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("%d goroutines after the storm, %d before", n, baseline)
+	}
+}
+
+func TestCloseFlushesPendingSave(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) { c.MetadataSaveInterval = time.Hour })
+	index := &countingIndex{FileIndex: fm.index}
+	fm.index = index
+
+	fm.requestSave()
+	fm.requestSave()
+	fm.Close()
+	fm.Close()
+	if saves := index.saves.Load(); saves != 1 {
+		t.Errorf("Close after two requests saved %d times, want 1", saves)
+	}
+}
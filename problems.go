@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+)
+
+// downloadProblem describes why a file can't be downloaded or stored, for
+// humans and for clients that branch on Code.
+type downloadProblem struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"error"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// problemResponse is a problem as sent to the client. Failures on the
+// server's side carry an ErrorID, logged with their cause, for users to
+// quote to support.
+type problemResponse struct {
+	downloadProblem
+	ErrorID string `json:"error_id,omitempty"`
+}
+
+func problemFor(err error) downloadProblem {
+	switch err {
+	case errFileNotFound:
+		return downloadProblem{http.StatusNotFound, "file_not_found", "File not found",
+			"Check the link for typos."}
+	case errFileExpired:
+		return downloadProblem{http.StatusGone, "file_expired", "File expired",
+			"Ask the sender to upload it again."}
+	case errDownloadLimit:
+		return downloadProblem{http.StatusForbidden, "download_limit_reached", "Download limit reached",
+			"The file has been downloaded as often as the sender allowed."}
+	case errPasswordRequired:
+		return downloadProblem{http.StatusUnauthorized, "password_required", "Password required",
+			"Add the password the sender gave you."}
+	case errPasswordIncorrect:
+		return downloadProblem{http.StatusForbidden, "password_incorrect", "Incorrect password",
+			"Check the password the sender gave you."}
+	case errTagPasswordRequired:
+		return downloadProblem{http.StatusUnauthorized, "tag_password_required", "Password required",
+			"The file is in a protected category; add its password as tag_password."}
+	case errRecipientRequired:
+		return downloadProblem{http.StatusForbidden, "recipient_required", "Recipient link required",
+			"The file is shared with named recipients; use the link you were sent."}
+	case errRecipientCollected:
+		return downloadProblem{http.StatusGone, "recipient_collected", "Already collected",
+			"You have already downloaded this file with your link."}
+	case errIntegrity:
+		return downloadProblem{http.StatusInternalServerError, "integrity_error", "File failed an integrity check",
+			"The stored copy is damaged; ask the sender to upload it again."}
+	case errFileGone:
+		return downloadProblem{http.StatusGone, "file_deleted", "File was recently deleted",
+			"The file was removed before it expired."}
+	}
+	return downloadProblem{http.StatusInternalServerError, "server_error", "Server error", ""}
+}
+
+// uploadProblem maps the errors of storeFile to problems. Refusals keep
+// their message, which tells the client what to change.
+func uploadProblem(err error) downloadProblem {
+	switch {
+	case errors.Is(err, errFileTooLarge):
+		return downloadProblem{http.StatusRequestEntityTooLarge, "file_too_large", "File too large", ""}
+	case errors.Is(err, errDecompressionLimit):
+		return downloadProblem{http.StatusRequestEntityTooLarge, "decompression_limit", errDecompressionLimit.Error(), "Send the file uncompressed."}
+	case errors.Is(err, errUnsupportedEncoding):
+		return downloadProblem{http.StatusUnsupportedMediaType, "unsupported_encoding", err.Error(), "Send the body uncompressed or gzip-compressed."}
+	case errors.Is(err, errCorruptEncoding):
+		return downloadProblem{http.StatusBadRequest, "invalid_encoding", errCorruptEncoding.Error(), ""}
+	case errors.Is(err, errUploadRateLimit):
+		return downloadProblem{http.StatusTooManyRequests, "upload_rate_limited", err.Error(), "Wait for the time given in Retry-After."}
+	case errors.Is(err, errUploadByteLimit):
+		return downloadProblem{http.StatusTooManyRequests, "upload_bytes_limited", err.Error(), "Wait for the time given in Retry-After."}
+	case errors.Is(err, errUploaderQuota):
+		return downloadProblem{http.StatusTooManyRequests, "uploader_quota_exceeded", err.Error(), "Delete files you no longer need, or wait for them to expire."}
+	case errors.Is(err, errExceedsQuota):
+		return downloadProblem{http.StatusRequestEntityTooLarge, "exceeds_quota", err.Error(), "Wait for files to expire or be deleted, or send a smaller file."}
+	case errors.Is(err, errStorageFull):
+		return downloadProblem{http.StatusInsufficientStorage, "quota_exceeded", "Insufficient storage: quota exceeded", ""}
+	case errors.Is(err, errTypeMismatch):
+		return downloadProblem{http.StatusUnprocessableEntity, "type_mismatch", err.Error(), ""}
+	case errors.Is(err, errChecksumMismatch):
+		return downloadProblem{http.StatusUnprocessableEntity, "checksum_mismatch", err.Error(), ""}
+	case errors.Is(err, errPathTooLong):
+		return downloadProblem{http.StatusUnprocessableEntity, "path_too_long", err.Error(), "Use a shorter file name."}
+	case errors.Is(err, errUnsafeName):
+		return downloadProblem{http.StatusBadRequest, "invalid_filename", err.Error(), "Use a plain file name without path components."}
+	case errors.Is(err, errBlockedContent):
+		return downloadProblem{http.StatusUnavailableForLegalReasons, "blocked_content", err.Error(), ""}
+	case errors.Is(err, errPasswordTooLong):
+		return downloadProblem{http.StatusBadRequest, "password_too_long", err.Error(), ""}
+	case errors.Is(err, errInvalidID):
+		return downloadProblem{http.StatusBadRequest, "invalid_id", err.Error(), ""}
+	case errors.Is(err, errTypeNotAllowed):
+		return downloadProblem{http.StatusBadRequest, "type_not_allowed", err.Error(), ""}
+	case errors.Is(err, errIDReserved):
+		return downloadProblem{http.StatusConflict, "id_reserved", err.Error(), ""}
+	case errors.Is(err, errIDTaken):
+		return downloadProblem{http.StatusConflict, "id_taken", err.Error(), ""}
+	case errors.Is(err, errNoInodes):
+		return downloadProblem{http.StatusInsufficientStorage, "no_inodes", "Insufficient storage: no free inodes", ""}
+	case isDiskFull(err):
+		return downloadProblem{http.StatusInsufficientStorage, "disk_full", "Insufficient storage", ""}
+	case errors.Is(err, fs.ErrPermission):
+		return downloadProblem{http.StatusInternalServerError, "storage_permission", "Server error: storage is not writable", ""}
+	case isStorageError(err):
+		return downloadProblem{http.StatusInternalServerError, "storage_unavailable", "Server error: storage is not writable", ""}
+	}
+	return downloadProblem{http.StatusInternalServerError, "server_error", "Server error", ""}
+}
+
+var problemTemplate = template.Must(template.New("problem").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.Message}}</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; background: #f5f5f5; }
+        .container { max-width: 600px; margin: 40px auto; background: white; padding: 30px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); }
+        h1 { color: #dc3545; font-size: 1.5em; }
+        p { color: #666; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Message}}</h1>
+        {{if .Hint}}<p>{{.Hint}}</p>{{end}}
+        {{with .ErrorID}}<p>Error ID: <code>{{.}}</code></p>{{end}}
+    </div>
+</body>
+</html>
+`))
+
+// writeDownloadError answers a request whose download check failed and
+// reports whether it did. JSON clients get {"code", "error", "hint"}, browsers
+// a short page, and everyone else the plain message.
+func writeDownloadError(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == nil {
+		return false
+	}
+	writeProblem(w, r, problemResponse{downloadProblem: problemFor(err)})
+	return true
+}
+
+// writeProblem answers with problem: JSON clients get {"code", "error",
+// "hint", "error_id"}, browsers a short page, and everyone else the message.
+func writeProblem(w http.ResponseWriter, r *http.Request, problem problemResponse) {
+	switch negotiate(r) {
+	case mediaJSON:
+		respondJSON(w, problem.Status, problem)
+	case mediaHTML:
+		respondHTML(w, problem.Status, problemTemplate, problem)
+	default:
+		message := problem.Message
+		if problem.ErrorID != "" {
+			message += " (error ID " + problem.ErrorID + ")"
+		}
+		respondText(w, problem.Status, message)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDownloadErrorCodes(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.TagPasswords = map[string]string{"payroll": "s3cret"}
+	})
+	upload := func(name string, fields url.Values) string {
+		t.Helper()
+		status, body := uploadTestFile(t, server, name, []byte("content of "+name), fields)
+		if status != http.StatusOK {
+			t.Fatalf("upload %s: status %d, body %v", name, status, body)
+		}
+		return body["id"].(string)
+	}
+
+	expired := upload("expired.txt", nil)
+	fm.mutex.Lock()
+	fm.files[expired].ExpiresAt = time.Now().Add(-time.Minute)
+	fm.mutex.Unlock()
+
+	limited := upload("limited.txt", url.Values{"max_downloads": {"1"}})
+	if status := downloadStatus(t, server.URL, limited, nil); status != http.StatusOK {
+		t.Fatalf("first download of limited.txt: status %d", status)
+	}
+	locked := upload("locked.txt", url.Values{"password": {"hunter2"}})
+	payroll := upload("march.csv", url.Values{"tags": {"payroll"}})
+	shared := upload("shared.txt", url.Values{"recipients": {"2"}})
+	deleted := upload("deleted.txt", nil)
+	req, _ := http.NewRequest("DELETE", server.URL+"/delete/"+deleted, nil)
+	if status, body := doJSON(t, req); status != http.StatusOK && status != http.StatusNoContent {
+		t.Fatalf("delete: status %d, body %v", status, body)
+	}
+
+	get := func(path, accept string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		status int
+		code   string
+	}{
+		{"unknown", "/download/nosuchfile", http.StatusNotFound, "file_not_found"},
+		{"expired", "/download/" + expired, http.StatusGone, "file_expired"},
+		// The expired record is kept as a tombstone
+		{"expired again", "/download/" + expired, http.StatusGone, "file_expired"},
+		{"limit reached", "/download/" + limited, http.StatusForbidden, "download_limit_reached"},
+		{"password missing", "/download/" + locked, http.StatusUnauthorized, "password_required"},
+		{"password wrong", "/download/" + locked + "?password=guess", http.StatusForbidden, "password_incorrect"},
+		{"tag password missing", "/download/" + payroll, http.StatusUnauthorized, "tag_password_required"},
+		{"recipient missing", "/download/" + shared, http.StatusForbidden, "recipient_required"},
+		{"deleted", "/download/" + deleted, http.StatusGone, "file_deleted"},
+	} {
+		resp, body := get(tc.path, "application/json")
+		var problem downloadProblem
+		if err := json.Unmarshal([]byte(body), &problem); err != nil || resp.StatusCode != tc.status || problem.Code != tc.code || problem.Message == "" || problem.Hint == "" {
+			t.Errorf("%s over JSON: status %d, body %s, want %d with code %s", tc.name, resp.StatusCode, body, tc.status, tc.code)
+			continue
+		}
+
+		// Browsers get the same status with a friendly page instead
+		resp, body = get(tc.path, "text/html")
+		if resp.StatusCode != tc.status || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+			!strings.Contains(body, problem.Message) || !strings.Contains(body, problem.Hint) || strings.Contains(body, `"code"`) {
+			t.Errorf("%s over HTML: status %d, type %q, body %s", tc.name, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+	}
+
+	// Each share page tells its state apart from the others
+	for _, tc := range []struct {
+		name   string
+		id     string
+		status int
+		want   string
+	}{
+		{"unknown", "nosuchfile", http.StatusNotFound, "Check the link for typos."},
+		{"expired", expired, http.StatusGone, "Expired "},
+		{"limit reached", limited, http.StatusForbidden, "after its last allowed download"},
+		{"password", locked, http.StatusOK, `name="password"`},
+		{"tag password", payroll, http.StatusOK, `name="tag_password"`},
+		{"recipient missing", shared, http.StatusOK, "use the link you were sent"},
+		{"deleted", deleted, http.StatusGone, "Deleted "},
+	} {
+		resp, body := get("/f/"+tc.id, "text/html")
+		if resp.StatusCode != tc.status || !strings.Contains(body, tc.want) {
+			t.Errorf("share page of %s: status %d, want %d containing %q:\n%s", tc.name, resp.StatusCode, tc.status, tc.want, body)
+		}
+	}
+}
+
+// lockedBuffer collects log output written by handlers while the test
+// reads it.
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestUploadErrorCodes(t *testing.T) {
+	var logged lockedBuffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	fm := NewTestFileManager(func(c *Config) { c.MaxFileSize = 1 << 10 })
+	failing := &failingStorage{Storage: fm.storage}
+	fm.storage = failing
+	server := httptest.NewServer(fm.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		fm.Close()
+	})
+
+	for _, tc := range []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"disk full", syscall.ENOSPC, http.StatusInsufficientStorage, "disk_full"},
+		{"permission denied", syscall.EACCES, http.StatusInternalServerError, "storage_permission"},
+		{"read-only filesystem", syscall.EROFS, http.StatusInternalServerError, "storage_unavailable"},
+		{"other failure", syscall.EIO, http.StatusInternalServerError, "server_error"},
+	} {
+		failing.fail(tc.err)
+		status, body := uploadTestFile(t, server, "a.txt", []byte("content"), nil)
+		errorID, _ := body["error_id"].(string)
+		if status != tc.status || body["code"] != tc.code || errorID == "" {
+			t.Errorf("%s: status %d, body %v, want %d %s with an error_id", tc.name, status, body, tc.status, tc.code)
+			continue
+		}
+		// The log has the cause under the same ID
+		if line := "failed [error_id " + errorID + "]: creating "; !strings.Contains(logged.String(), line) || !strings.Contains(logged.String(), tc.err.Error()) {
+			t.Errorf("%s: log lacks %q with the cause:\n%s", tc.name, line, logged.String())
+		}
+	}
+
+	// Plain text and HTML responses carry the ID too
+	failing.fail(syscall.EACCES)
+	for accept, want := range map[string]string{"*/*": "(error ID ", "text/html": "Error ID: <code>"} {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "a.txt")
+		part.Write([]byte("content"))
+		form.Close()
+		req, _ := http.NewRequest("POST", server.URL+"/upload", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(string(page), want) {
+			t.Errorf("Accept %s: status %d, body %s, want the error ID", accept, resp.StatusCode, page)
+		}
+	}
+
+	// Refusals on the client's side need no ID
+	failing.fail(nil)
+	status, body := uploadTestFile(t, server, "big.bin", testContent(2<<10), nil)
+	if status != http.StatusRequestEntityTooLarge || body["code"] != "file_too_large" || body["error_id"] != nil {
+		t.Errorf("oversized upload: status %d, body %v, want 413 without an error_id", status, body)
+	}
+}
+
+func TestUploadToUnwritableDirectory(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	dir := t.TempDir()
+	fm, server := newTestServer(t, nil)
+	fm.storage = localStorage{dir: dir}
+	os.Chmod(dir, 0555)
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+
+	status, body := uploadTestFile(t, server, "a.txt", []byte("content"), nil)
+	if status != http.StatusInternalServerError || body["code"] != "storage_permission" || body["error_id"] == nil {
+		t.Errorf("upload into a read-only upload_dir: status %d, body %v, want 500 storage_permission", status, body)
+	}
+}
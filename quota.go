@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errStorageFull is returned for uploads that would take the stored bytes
+// past max_total_size.
+var errStorageFull = errors.New("storage quota exceeded")
+
+// errExceedsQuota refuses an upload whose Content-Length alone shows it
+// can't fit within max_total_size, before any of it is received.
+var errExceedsQuota = errors.New("the upload is larger than the storage left under max_total_size")
+
+// storageReservation is room under max_total_size set aside for an upload
+// in progress, so concurrent uploads can't all pass the quota check for the
+// same free space. storeFile takes the stored files out of it and the
+// handler releases what is left once the upload is over.
+type storageReservation struct {
+	size int64 // bytes still set aside, guarded by fm.mutex
+}
+
+// StorageUsage reports the stored bytes against max_total_size. Level is the
+// number of storage_warning_thresholds currently raised; it only drops once
+// usage falls storage_warning_hysteresis below a threshold.
+type StorageUsage struct {
+	Used       int64     `json:"used"`
+	Reserved   int64     `json:"reserved"` // by uploads in progress
+	Max        int64     `json:"max"`
+	Ratio      float64   `json:"ratio"`
+	Thresholds []float64 `json:"thresholds"`
+	Level      int       `json:"level"`
+	Warning    string    `json:"warning,omitempty"`
+}
+
+// storageAlerts tracks which warning thresholds have been announced, for
+// stored bytes or inodes, so each crossing notifies once.
+type storageAlerts struct {
+	mutex sync.Mutex
+	level int
+}
+
+// storedBytes sums the size of all stored content. Callers must hold
+// fm.mutex.
+func (fm *FileManager) storedBytes() int64 {
+	var total int64
+	for _, fileInfo := range fm.files {
+		if !fileInfo.isLink() {
+			total += fileInfo.Size
+		}
+	}
+	return total
+}
+
+// reserveStorage sets aside size bytes under max_total_size for an upload
+// that announced its length. With evict_on_full, files are evicted to make
+// room; otherwise an upload that doesn't fit beside the stored files and the
+// other reservations gets errExceedsQuota. Without max_total_size, or
+// without a length, the reservation is empty and storeFile checks the quota
+// once the size is known.
+func (fm *FileManager) reserveStorage(size int64) (*storageReservation, error) {
+	limit := fm.config().MaxTotalSize
+	if limit <= 0 || size <= 0 {
+		return &storageReservation{}, nil
+	}
+	if size > limit {
+		return nil, errExceedsQuota
+	}
+	fm.mutex.Lock()
+	evicted, fits := fm.makeRoom(size)
+	if !fits {
+		fm.mutex.Unlock()
+		return nil, errExceedsQuota
+	}
+	fm.reservedBytes += size
+	fm.mutex.Unlock()
+	fm.removeEvicted(evicted)
+	return &storageReservation{size: size}, nil
+}
+
+// reserveRoom sets aside up to want bytes for an append, as many as fit
+// under max_total_size when not all do. Without max_total_size the
+// reservation is empty, as nothing needs setting aside.
+func (fm *FileManager) reserveRoom(want int64) *storageReservation {
+	limit := fm.config().MaxTotalSize
+	if limit <= 0 || want <= 0 {
+		return &storageReservation{}
+	}
+	fm.mutex.Lock()
+	evicted, fits := fm.makeRoom(want)
+	size := want
+	if !fits {
+		size = max(limit-fm.storedBytes()-fm.reservedBytes, 0)
+	}
+	fm.reservedBytes += size
+	fm.mutex.Unlock()
+	fm.removeEvicted(evicted)
+	return &storageReservation{size: size}
+}
+
+// makeRoom reports whether size more bytes fit under max_total_size beside
+// the stored files and the reservations, evicting files to make them fit
+// when evict_on_full is set. Callers must hold fm.mutex and pass the
+// evicted files to removeEvicted after releasing it.
+func (fm *FileManager) makeRoom(size int64) (evicted []*FileInfo, fits bool) {
+	limit := fm.config().MaxTotalSize
+	if limit <= 0 {
+		return nil, true
+	}
+	over := fm.storedBytes() + fm.reservedBytes + size - limit
+	if over <= 0 {
+		return nil, true
+	}
+	if !fm.config().EvictOnFull {
+		return nil, false
+	}
+	evicted = fm.evictFiles(over)
+	return evicted, len(evicted) > 0
+}
+
+// removeEvicted deletes the content of the files makeRoom evicted.
+func (fm *FileManager) removeEvicted(evicted []*FileInfo) {
+	if len(evicted) == 0 {
+		return
+	}
+	for _, fileInfo := range evicted {
+		fm.deleteExpiredContent(fileInfo)
+	}
+	fm.requestSave()
+	fm.checkStorageThresholds()
+}
+
+// takeReservation takes up to size bytes out of res for a file being
+// stored and returns how many it took, which the file may use on top of
+// the free space. Callers must hold fm.mutex.
+func (fm *FileManager) takeReservation(res *storageReservation, size int64) int64 {
+	if res == nil {
+		return 0
+	}
+	taken := min(res.size, size)
+	res.size -= taken
+	fm.reservedBytes -= taken
+	return taken
+}
+
+// releaseStorage returns what is left of res to the free space. It is safe
+// to call more than once.
+func (fm *FileManager) releaseStorage(res *storageReservation) {
+	if res == nil {
+		return
+	}
+	fm.mutex.Lock()
+	fm.takeReservation(res, res.size)
+	fm.mutex.Unlock()
+}
+
+// admitStorage reserves room for the Content-Length of an upload request,
+// answering the request itself when it can't fit. The caller releases the
+// reservation once the upload is stored or has failed.
+func (fm *FileManager) admitStorage(w http.ResponseWriter, r *http.Request) (*storageReservation, bool) {
+	res, err := fm.reserveStorage(r.ContentLength)
+	if err != nil {
+		writeProblem(w, r, problemResponse{downloadProblem: uploadProblem(err)})
+		return nil, false
+	}
+	return res, true
+}
+
+// evictFiles unregisters stored files until at least need bytes are freed,
+// for evict_on_full: expired and used-up files first, then those closest to
+// expiry, oldest upload first among equals. Files with recipients still to
+// collect them and open appendable files are kept. When the files that may
+// go can't free enough, nothing is evicted. Callers must hold fm.mutex and
+// delete the content of the returned files after releasing it.
+func (fm *FileManager) evictFiles(need int64) []*FileInfo {
+	now := time.Now()
+	var candidates []*FileInfo
+	var available int64
+	for _, fileInfo := range fm.files {
+		if fileInfo.isLink() || fileInfo.Appendable || fileInfo.Size == 0 {
+			continue
+		}
+		if fileInfo.hasRecipients() && fileInfo.statusAt(now) == StatusActive {
+			continue
+		}
+		candidates = append(candidates, fileInfo)
+		available += fileInfo.Size
+	}
+	if available < need {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if inactiveA, inactiveB := a.statusAt(now) != StatusActive, b.statusAt(now) != StatusActive; inactiveA != inactiveB {
+			return inactiveA
+		}
+		if !a.ExpiresAt.Equal(b.ExpiresAt) {
+			return a.ExpiresAt.Before(b.ExpiresAt)
+		}
+		return a.UploadTime.Before(b.UploadTime)
+	})
+
+	var evicted []*FileInfo
+	for _, fileInfo := range candidates {
+		if need <= 0 {
+			break
+		}
+		delete(fm.files, fileInfo.ID)
+		fm.bury(fileInfo.ID, fileInfo, "evicted")
+		fm.recordChange(changeDeleted, fileInfo.ID, fileInfo)
+		log.Printf("Evicted file %s (%s, expiring %s) to make room under max_total_size",
+			fileInfo.ID, formatBytes(fileInfo.Size), fileInfo.ExpiresAt.Format(time.RFC3339))
+		fm.recordEvent(nil, "evict", fileInfo, fileInfo.ID, string(fileInfo.statusAt(now)))
+		evicted = append(evicted, fileInfo)
+		need -= fileInfo.Size
+	}
+	return evicted
+}
+
+// warningThresholds returns storage_warning_thresholds in ascending order.
+func (fm *FileManager) warningThresholds() []float64 {
+	thresholds := append([]float64(nil), fm.config().StorageWarnings...)
+	sort.Float64s(thresholds)
+	return thresholds
+}
+
+// storageUsage reports current usage. Without max_total_size only Used is
+// meaningful.
+func (fm *FileManager) storageUsage() StorageUsage {
+	fm.mutex.RLock()
+	used, reserved := fm.storedBytes(), fm.reservedBytes
+	fm.mutex.RUnlock()
+
+	usage := StorageUsage{Used: used, Reserved: reserved, Max: fm.config().MaxTotalSize, Thresholds: fm.warningThresholds()}
+	if usage.Max <= 0 {
+		return usage
+	}
+	usage.Ratio = float64(used) / float64(usage.Max)
+	fm.storageAlerts.mutex.Lock()
+	usage.Level = fm.storageAlerts.level
+	fm.storageAlerts.mutex.Unlock()
+
+	for i := len(usage.Thresholds) - 1; i >= 0; i-- {
+		if usage.Ratio >= usage.Thresholds[i] {
+			usage.Warning = fmt.Sprintf("storage is %.0f%% full (warning threshold %.0f%%); uploads are refused once it is full",
+				usage.Ratio*100, usage.Thresholds[i]*100)
+			break
+		}
+	}
+	return usage
+}
+
+// degraded reports whether the highest warning threshold is raised.
+func (u StorageUsage) degraded() bool {
+	return len(u.Thresholds) > 0 && u.Level == len(u.Thresholds)
+}
+
+// checkStorageThresholds raises and clears warning thresholds after usage
+// changed, notifying once per crossing. A threshold is cleared only when
+// usage drops storage_warning_hysteresis below it, so usage hovering around
+// it doesn't notify on every upload and delete. It must be called without
+// holding fm.mutex.
+func (fm *FileManager) checkStorageThresholds() {
+	defer fm.checkInodeThresholds()
+	usage := fm.storageUsage()
+	if usage.Max <= 0 {
+		return
+	}
+
+	details := func(threshold float64) map[string]interface{} {
+		return map[string]interface{}{
+			"threshold": threshold,
+			"used":      usage.Used,
+			"max":       usage.Max,
+			"ratio":     usage.Ratio,
+		}
+	}
+	fm.storageAlerts.update(usage.Ratio, usage.Thresholds, fm.config().StorageHysteresis,
+		func(threshold float64) {
+			log.Printf("Storage usage %.0f%% crossed the %.0f%% warning threshold", usage.Ratio*100, threshold*100)
+			fm.notify("storage_threshold_crossed", details(threshold))
+		},
+		func(threshold float64) {
+			log.Printf("Storage usage %.0f%% is back below the %.0f%% warning threshold", usage.Ratio*100, threshold*100)
+			fm.notify("storage_threshold_cleared", details(threshold))
+		})
+}
+
+// update moves the raised level to ratio, calling crossed or cleared for
+// each threshold passed on the way, in ascending thresholds.
+func (a *storageAlerts) update(ratio float64, thresholds []float64, hysteresis float64, crossed, cleared func(threshold float64)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.level = min(a.level, len(thresholds))
+	for a.level < len(thresholds) && ratio >= thresholds[a.level] {
+		a.level++
+		crossed(thresholds[a.level-1])
+	}
+	for a.level > 0 && ratio < thresholds[a.level-1]-hysteresis {
+		a.level--
+		cleared(thresholds[a.level])
+	}
+}
+
+// writeStorageWarning adds X-Storage-Warning to an upload response once
+// usage is past a warning threshold, and returns the warning.
+func (fm *FileManager) writeStorageWarning(w http.ResponseWriter) string {
+	warning := fm.storageUsage().Warning
+	if warning != "" {
+		w.Header().Set("X-Storage-Warning", warning)
+	}
+	return warning
+}
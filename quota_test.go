@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentUploadsReserveStorage(t *testing.T) {
+	const mb = 1 << 20
+	fm, server := newTestServer(t, func(c *Config) { c.MaxTotalSize = 100 * mb })
+
+	content := bytes.Repeat([]byte("x"), 60*mb)
+	statuses := make([]int, 2)
+	codes := make([]interface{}, 2)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var body map[string]interface{}
+			statuses[i], body = uploadTestFile(t, server, "big.bin", content, nil)
+			codes[i] = body["code"]
+		}()
+	}
+	wg.Wait()
+
+	stored, refused := 0, 0
+	for i, status := range statuses {
+		switch {
+		case status == http.StatusOK:
+			stored++
+		case status == http.StatusRequestEntityTooLarge && codes[i] == "exceeds_quota":
+			refused++
+		default:
+			t.Errorf("upload %d: status %d, code %v", i, status, codes[i])
+		}
+	}
+	if stored != 1 || refused != 1 {
+		t.Fatalf("%d stored and %d refused, want one of each (statuses %v)", stored, refused, statuses)
+	}
+
+	fm.mutex.RLock()
+	used, reserved := fm.storedBytes(), fm.reservedBytes
+	fm.mutex.RUnlock()
+	if used != 60*mb || reserved != 0 {
+		t.Fatalf("stored %d and reserved %d bytes, want %d and 0", used, reserved, 60*mb)
+	}
+}
+
+func TestReserveStorage(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) { c.MaxTotalSize = 100 })
+	defer fm.Close()
+
+	first, err := fm.reserveStorage(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fm.reserveStorage(60); !errors.Is(err, errExceedsQuota) {
+		t.Fatalf("second reservation: %v, want errExceedsQuota", err)
+	}
+	if room := fm.reserveRoom(60); room.size != 40 {
+		t.Fatalf("reserveRoom got %d bytes, want the 40 left", room.size)
+	} else {
+		fm.releaseStorage(room)
+	}
+	fm.releaseStorage(first)
+	fm.releaseStorage(first) // releasing twice gives nothing back twice
+	if fm.reservedBytes != 0 {
+		t.Fatalf("reserved %d bytes after releasing everything", fm.reservedBytes)
+	}
+	second, err := fm.reserveStorage(60)
+	if err != nil {
+		t.Fatalf("reservation after release: %v", err)
+	}
+	fm.releaseStorage(second)
+}
+
+func TestConcurrentAppendsReserveStorage(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) { c.MaxTotalSize = 100 << 10 })
+
+	ids := make([]string, 2)
+	for i := range ids {
+		status, body := uploadTestFile(t, server, "log.txt", []byte("start\n"), url.Values{"appendable": {"true"}})
+		if status != http.StatusOK {
+			t.Fatalf("upload: status %d, body %v", status, body)
+		}
+		ids[i] = body["id"].(string)
+	}
+
+	// Both appends have started writing before either is done
+	chunk := bytes.Repeat([]byte("y"), 60<<10)
+	statuses := make([]int, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		body, feed := io.Pipe()
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			feed.Write(chunk[:1])
+			time.Sleep(200 * time.Millisecond)
+			feed.Write(chunk[1:])
+			feed.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("PATCH", server.URL+"/put/"+id+"?append=true", body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.ContentLength = int64(len(chunk))
+			statuses[i], _ = doJSON(t, req)
+			body.Close()
+		}()
+	}
+	wg.Wait()
+
+	appended := 0
+	for _, status := range statuses {
+		if status == http.StatusOK {
+			appended++
+		}
+	}
+	fm.mutex.RLock()
+	used, reserved := fm.storedBytes(), fm.reservedBytes
+	fm.mutex.RUnlock()
+	if appended != 1 || used > 100<<10 || reserved != 0 {
+		t.Fatalf("%d appends succeeded (statuses %v), %d bytes stored, %d reserved", appended, statuses, used, reserved)
+	}
+}
+
+func TestEvictOnFull(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.MaxTotalSize = 100 << 10
+		c.EvictOnFull = true
+	})
+
+	// Open appendable files are never evicted
+	if status, body := uploadTestFile(t, server, "log.txt", make([]byte, 40<<10), url.Values{"appendable": {"true"}}); status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	ids := make([]string, 2)
+	for i, ttl := range []string{"7200", "3600"} {
+		status, body := uploadTestFile(t, server, "old.bin", make([]byte, 20<<10), url.Values{"ttl": {ttl}})
+		if status != http.StatusOK {
+			t.Fatalf("upload: status %d, body %v", status, body)
+		}
+		ids[i] = body["id"].(string)
+	}
+
+	// 80KB stored and 30KB more don't fit; the file closest to expiry goes
+	status, body := uploadTestFile(t, server, "new.bin", make([]byte, 30<<10), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload with eviction: status %d, body %v", status, body)
+	}
+	fm.mutex.RLock()
+	_, kept := fm.files[ids[0]]
+	_, evicted := fm.files[ids[1]]
+	fm.mutex.RUnlock()
+	if !kept || evicted {
+		t.Fatalf("kept the later expiry: %t, evicted the sooner one: %t", kept, !evicted)
+	}
+	if status, info := getJSON(t, server, "/info/"+ids[1]); status != http.StatusGone || info["reason"] != "evicted" {
+		t.Fatalf("info of the evicted file: status %d, body %v", status, info)
+	}
+
+	// Evicting every other file wouldn't make room: nothing is evicted
+	status, body = uploadTestFile(t, server, "huge.bin", make([]byte, 70<<10), nil)
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload larger than the evictable files: status %d, body %v", status, body)
+	}
+	fm.mutex.RLock()
+	count := len(fm.files)
+	fm.mutex.RUnlock()
+	if count != 3 {
+		t.Fatalf("%d files left, want 3", count)
+	}
+}
+
+func TestStorageWarningThresholds(t *testing.T) {
+	events := make(chan map[string]interface{}, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		events <- payload
+	}))
+	defer webhook.Close()
+	_, server := newTestServer(t, func(c *Config) {
+		c.MaxTotalSize = 100000
+		c.StorageWarnings = []float64{0.9, 0.8}
+		c.StorageHysteresis = 0.05
+		c.NotifyWebhookURL = webhook.URL
+	})
+
+	upload := func(size int, wantWarning bool) string {
+		t.Helper()
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "a.bin")
+		part.Write(testContent(size))
+		form.Close()
+		req, _ := http.NewRequest("POST", server.URL+"/upload", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var uploaded map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&uploaded)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("upload of %d bytes: status %d, body %v", size, resp.StatusCode, uploaded)
+		}
+		header := resp.Header.Get("X-Storage-Warning")
+		if warning, _ := uploaded["warning"].(string); (warning != "") != wantWarning || warning != header {
+			t.Errorf("upload of %d bytes: warning %q, X-Storage-Warning %q, want a warning %v", size, warning, header, wantWarning)
+		}
+		return uploaded["id"].(string)
+	}
+	remove := func(id string) {
+		t.Helper()
+		req, _ := http.NewRequest("DELETE", server.URL+"/delete/"+id, nil)
+		if status, body := doJSON(t, req); status != http.StatusOK {
+			t.Fatalf("delete: status %d, body %v", status, body)
+		}
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		for _, event := range want {
+			name, threshold, _ := strings.Cut(event, " ")
+			select {
+			case payload := <-events:
+				details, _ := payload["details"].(map[string]interface{})
+				if payload["event"] != name || fmt.Sprint(details["threshold"]) != threshold {
+					t.Errorf("event %v %v, want %s", payload["event"], details["threshold"], event)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s event", event)
+			}
+		}
+		select {
+		case payload := <-events:
+			t.Errorf("unexpected event %v", payload)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	health := func() string {
+		t.Helper()
+		_, body := getJSON(t, server, "/api/health")
+		return body["status"].(string)
+	}
+
+	upload(70000, false)
+	base := upload(6000, false) // 76%
+	expect()
+	mid := upload(6000, true) // 82%
+	expect("storage_threshold_crossed 0.8")
+	small := upload(1000, true) // 83%: still past 80%, nothing new to announce
+	expect()
+	if status := health(); status != "healthy" {
+		t.Errorf("health at 83%%: %s", status)
+	}
+	top := upload(8000, true) // 91%
+	expect("storage_threshold_crossed 0.9")
+	if status := health(); status != "degraded" {
+		t.Errorf("health at 91%%: %s, want degraded", status)
+	}
+
+	// 83% is more than the hysteresis below 90%, 76% is within it of 80%
+	remove(top)
+	expect("storage_threshold_cleared 0.9")
+	if status := health(); status != "healthy" {
+		t.Errorf("health at 83%%: %s", status)
+	}
+	remove(small)
+	remove(mid)
+	expect()
+	remove(base) // 70%
+	expect("storage_threshold_cleared 0.8")
+
+	// Each crossing up announces once more
+	upload(6000, false)
+	upload(6000, true)
+	expect("storage_threshold_crossed 0.8")
+
+	// The manage page shows the usage against the thresholds
+	resp, err := http.Get(server.URL + "/manage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{`class="storage-bar"`, "Warning thresholds: 80% 90%", `class="storage-fill level-1"`} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("manage page lacks %s", want)
+		}
+	}
+
+	// Past max_total_size uploads are refused
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "big.bin")
+	part.Write(testContent(20000))
+	form.Close()
+	req, _ := http.NewRequest("POST", server.URL+"/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if status, body := doJSON(t, req); status != http.StatusRequestEntityTooLarge || body["code"] != "exceeds_quota" {
+		t.Errorf("upload past max_total_size: status %d, body %v, want 413", status, body)
+	}
+	expect()
+}
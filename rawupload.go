@@ -0,0 +1,162 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported Content-Encoding, only gzip is accepted")
+	errCorruptEncoding     = errors.New("the body is not valid for its Content-Encoding")
+	errDecompressionLimit  = errors.New("the body expands more than max_decompression_ratio allows")
+)
+
+// decompressionAllowance is how far any upload may expand regardless of
+// max_decompression_ratio, as tiny bodies such as a compressed empty file
+// have ratios no real file would.
+const decompressionAllowance = 1 << 20
+
+// encodedBody is the body of a raw upload sent with a Content-Encoding,
+// read through its decoder. It counts the bytes received on the wire and
+// refuses to expand them beyond the ratio.
+type encodedBody struct {
+	Encoding string
+	wire     *countingBody
+	decoded  int64
+	ratio    float64
+	decoder  io.Reader
+}
+
+func (b *encodedBody) Read(p []byte) (int, error) {
+	n, err := b.decoder.Read(p)
+	b.decoded += int64(n)
+	if b.ratio > 0 && b.decoded > decompressionAllowance && float64(b.decoded) > b.ratio*float64(b.wire.bytes) {
+		return n, errDecompressionLimit
+	}
+	var corrupt flate.CorruptInputError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		err = errFileTooLarge
+	case errors.Is(err, gzip.ErrHeader), errors.Is(err, gzip.ErrChecksum), errors.As(err, &corrupt), errors.Is(err, io.ErrUnexpectedEOF):
+		err = fmt.Errorf("%w: %v", errCorruptEncoding, err)
+	}
+	return n, err
+}
+
+// WireSize is the number of bytes received so far, before decoding.
+func (b *encodedBody) WireSize() int64 {
+	return b.wire.bytes
+}
+
+// decodeUploadBody reads r's body according to its Content-Encoding:
+// identity, or none, passes it through, gzip is decompressed as it is read.
+// The encodedBody is nil for plain bodies. Any other encoding, or a list of
+// several, is refused with errUnsupportedEncoding.
+func (fm *FileManager) decodeUploadBody(w http.ResponseWriter, r *http.Request) (io.Reader, *encodedBody, error) {
+	config := fm.config()
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return r.Body, nil, nil
+	case "gzip", "x-gzip":
+	default:
+		return nil, nil, errUnsupportedEncoding
+	}
+
+	// The wire bytes can't exceed the size limit either
+	wire := &countingBody{ReadCloser: http.MaxBytesReader(w, r.Body, config.MaxFileSize)}
+	decoder, err := gzip.NewReader(wire)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, nil, errFileTooLarge
+		}
+		return nil, nil, fmt.Errorf("%w: %v", errCorruptEncoding, err)
+	}
+	// Concatenated gzip members are one file, like gunzip treats them
+	body := &encodedBody{Encoding: "gzip", wire: wire, ratio: config.MaxDecompressionRatio, decoder: decoder}
+	return body, body, nil
+}
+
+// putUpload handles PUT /upload/{filename}, which takes the file as the raw
+// body, e.g. from curl -T or --data-binary, optionally compressed with
+// Content-Encoding: gzip, and stores it decompressed. The /upload fields
+// come as query parameters; the form body parsing of POST /upload never
+// applies, whatever Content-Type the client sent.
+func (fm *FileManager) putUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	timerFrom(r.Context()).begin(opUpload)
+
+	parts, err := pathSegments(r, "/upload/")
+	if err != nil || len(parts) != 1 {
+		respondError(w, r, "malformed path: expected /upload/{filename}", http.StatusBadRequest)
+		return
+	}
+	key, ok := fm.authorizeKey(w, r, scopeUpload)
+	if !ok || !fm.requireUploadKey(w, r, key) || !fm.admitUploader(w, r, r.ContentLength) {
+		return
+	}
+	reservation, ok := fm.admitStorage(w, r)
+	if !ok {
+		return
+	}
+	defer fm.releaseStorage(reservation)
+
+	// curl --data-binary labels the body as a form; it never is one here
+	contentType := r.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		contentType = ""
+	}
+	if !fm.typeAllowed(contentType) {
+		respondError(w, r, "File type not allowed", http.StatusBadRequest)
+		return
+	}
+	// The query holds the fields a form would, under the same caps
+	query := r.URL.Query()
+	if err := limitQuery(query); err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Form, r.PostForm = query, url.Values{}
+	req, err := fm.uploadParams(r, key)
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if violations := fm.validateMetadata(req.Metadata, req.Tags); len(violations) > 0 {
+		writeViolations(w, r, violations)
+		return
+	}
+	req.Filename = parts[0]
+	req.ContentType = contentType
+	req.Reservation = reservation
+
+	body, encoded, err := fm.decodeUploadBody(w, r)
+	if err != nil {
+		if errors.Is(err, errUnsupportedEncoding) {
+			w.Header().Set("Accept-Encoding", "gzip")
+		}
+		fm.writeUploadError(w, r, req.Filename, err)
+		return
+	}
+	req.Encoded = encoded
+	timerFrom(r.Context()).mark(phaseReceive)
+
+	fileInfo, err := fm.storeFile(r.Context(), body, req)
+	if err != nil {
+		fm.writeUploadError(w, r, req.Filename, err)
+		return
+	}
+	fm.queueUploadEmail(r, "upload", fileInfo, nil, req)
+	fm.writeUploadResponse(w, r, fileInfo)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Receipt is the signed statement of what was stored and when.
+type Receipt struct {
+	FileID     string    `json:"file_id"`
+	Filename   string    `json:"filename"`
+	Checksum   string    `json:"checksum"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	Uploader   string    `json:"uploader"`
+	IssuedAt   time.Time `json:"issued_at"`
+}
+
+// SignedReceipt carries the exact signed bytes in Payload, so whitespace or
+// key order changes in transit can't break verification. Receipt is the
+// decoded payload, for reading.
+type SignedReceipt struct {
+	Receipt   Receipt `json:"receipt"`
+	Payload   string  `json:"payload"`   // base64 of the signed JSON
+	Signature string  `json:"signature"` // base64 Ed25519 signature of the payload
+	Algorithm string  `json:"algorithm"`
+	KeyID     string  `json:"key_id"`
+}
+
+// receiptSigner holds the server's Ed25519 key.
+type receiptSigner struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+// loadReceiptSigner reads the signing key from path in store, generating and
+// saving one on first start. Losing the key makes existing receipts unverifiable
+// against /api/public-key, so it is never regenerated over an unreadable
+// file.
+func loadReceiptSigner(store MetadataStore, path string) (*receiptSigner, error) {
+	data, err := store.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := store.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	return &receiptSigner{key: key, keyID: hex.EncodeToString(sum[:8])}, nil
+}
+
+func (s *receiptSigner) publicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+func (s *receiptSigner) sign(receipt Receipt) (SignedReceipt, error) {
+	payload, err := json.Marshal(receipt)
+	if err != nil {
+		return SignedReceipt{}, err
+	}
+	return SignedReceipt{
+		Receipt:   receipt,
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, payload)),
+		Algorithm: "ed25519",
+		KeyID:     s.keyID,
+	}, nil
+}
+
+// verify checks the signature over the payload and that the payload is the
+// receipt shown alongside it.
+func (s *receiptSigner) verify(signed SignedReceipt) error {
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return errors.New("payload is not valid base64")
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return errors.New("signature is not valid base64")
+	}
+	if !ed25519.Verify(s.publicKey(), payload, signature) {
+		return errors.New("signature does not match")
+	}
+	var receipt Receipt
+	if err := json.Unmarshal(payload, &receipt); err != nil {
+		return errors.New("payload is not a receipt")
+	}
+	if signed.Receipt != (Receipt{}) && !receiptsEqual(signed.Receipt, receipt) {
+		return errors.New("receipt differs from the signed payload")
+	}
+	return nil
+}
+
+func receiptsEqual(a, b Receipt) bool {
+	return a.FileID == b.FileID && a.Filename == b.Filename && a.Checksum == b.Checksum &&
+		a.Size == b.Size && a.UploadedAt.Equal(b.UploadedAt) && a.Uploader == b.Uploader &&
+		a.IssuedAt.Equal(b.IssuedAt)
+}
+
+// issueReceipt signs a receipt for fileInfo.
+func (fm *FileManager) issueReceipt(fileInfo *FileInfo) (SignedReceipt, error) {
+	if fm.receipts == nil {
+		return SignedReceipt{}, errors.New("receipt signing is unavailable")
+	}
+	if fileInfo.HashPending {
+		return SignedReceipt{}, errChecksumPending
+	}
+	return fm.receipts.sign(Receipt{
+		FileID:     fileInfo.ID,
+		Filename:   fileInfo.OriginalName,
+		Checksum:   fileInfo.Checksum,
+		Size:       fileInfo.Size,
+		UploadedAt: fileInfo.UploadTime.UTC(),
+		Uploader:   fileInfo.UploaderIP,
+		IssuedAt:   time.Now().UTC(),
+	})
+}
+
+// fileReceipt handles GET /api/files/{id}/receipt. Receipts name the
+// uploader, so only admins may fetch them after the fact.
+func (fm *FileManager) fileReceipt(w http.ResponseWriter, r *http.Request, fileID string) {
+	if r.Method != "GET" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !fm.requireRole(w, r, roleViewer) {
+		return
+	}
+
+	fm.mutex.RLock()
+	fileInfo, exists := fm.files[fileID]
+	fm.mutex.RUnlock()
+	if !exists {
+		fm.writeNotFound(w, r, fileID)
+		return
+	}
+
+	signed, err := fm.issueReceipt(fileInfo)
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	respondJSON(w, http.StatusOK, signed)
+}
+
+// publicKeyInfo handles GET /api/public-key.
+func (fm *FileManager) publicKeyInfo(w http.ResponseWriter, r *http.Request) {
+	if fm.receipts == nil {
+		respondError(w, r, "receipt signing is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(fm.receipts.publicKey())
+	if err != nil {
+		respondError(w, r, "Server error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{
+		"algorithm":  "ed25519",
+		"key_id":     fm.receipts.keyID,
+		"public_key": base64.StdEncoding.EncodeToString(fm.receipts.publicKey()),
+		"pem":        string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	})
+}
+
+// verifyReceipt handles POST /api/receipts/verify with a signed receipt as
+// the body. It works from the receipt alone, so receipts of files that have
+// long expired still verify.
+func (fm *FileManager) verifyReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fm.receipts == nil {
+		respondError(w, r, "receipt signing is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var signed SignedReceipt
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&signed); err != nil {
+		respondError(w, r, "Invalid receipt: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := map[string]interface{}{"valid": true}
+	if signed.KeyID != "" && signed.KeyID != fm.receipts.keyID {
+		result = map[string]interface{}{"valid": false, "error": "signed with a different key"}
+	} else if err := fm.receipts.verify(signed); err != nil {
+		result = map[string]interface{}{"valid": false, "error": err.Error()}
+	}
+	respondJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errRecipientRequired  = errors.New("recipient token required")
+	errRecipientCollected = errors.New("recipient has already collected the file")
+	errRecipientsLimit    = errors.New("recipients cannot be combined with max_downloads")
+)
+
+// maxRecipients is the most recipients one upload can name.
+const maxRecipients = 100
+
+var recipientTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,128}$`)
+
+// Recipient is one slot of a file shared with named recipients. Only the
+// SHA-256 of the recipient's token is kept, like API keys.
+type Recipient struct {
+	TokenHash string     `json:"token_hash"`
+	Collected *time.Time `json:"collected,omitempty"` // when the recipient's download completed
+}
+
+// parseRecipients reads the recipients form value: a number of recipients
+// to generate tokens for, or a comma-separated list of tokens chosen by the
+// uploader.
+func parseRecipients(raw string) ([]string, error) {
+	if n, err := strconv.Atoi(raw); err == nil {
+		if n < 1 || n > maxRecipients {
+			return nil, fmt.Errorf("recipients must be between 1 and %d", maxRecipients)
+		}
+		tokens := make([]string, n)
+		for i := range tokens {
+			bytes := make([]byte, 16)
+			rand.Read(bytes)
+			tokens[i] = hex.EncodeToString(bytes)
+		}
+		return tokens, nil
+	}
+
+	var tokens []string
+	seen := make(map[string]bool)
+	for _, token := range strings.Split(raw, ",") {
+		token = strings.TrimSpace(token)
+		if !recipientTokenPattern.MatchString(token) {
+			return nil, fmt.Errorf("invalid recipient token %q: use 8 to 128 letters, digits, - or _", token)
+		}
+		if seen[token] {
+			return nil, fmt.Errorf("duplicate recipient token %q", token)
+		}
+		seen[token] = true
+		tokens = append(tokens, token)
+	}
+	if len(tokens) > maxRecipients {
+		return nil, fmt.Errorf("recipients must be between 1 and %d", maxRecipients)
+	}
+	return tokens, nil
+}
+
+func hashRecipientToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecipients(tokens []string) []Recipient {
+	if len(tokens) == 0 {
+		return nil
+	}
+	recipients := make([]Recipient, len(tokens))
+	for i, token := range tokens {
+		recipients[i] = Recipient{TokenHash: hashRecipientToken(token)}
+	}
+	return recipients
+}
+
+// hasRecipients reports whether the file is shared with named recipients.
+func (f *FileInfo) hasRecipients() bool {
+	return len(f.Recipients) > 0
+}
+
+// collectedCount returns how many recipients have completed their download.
+func (f *FileInfo) collectedCount() int {
+	n := 0
+	for _, recipient := range f.Recipients {
+		if recipient.Collected != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// collectionStatus describes the file's progress for listings and the share
+// page, e.g. "2 of 3 collected", or is empty for files without recipients.
+func (f *FileInfo) collectionStatus() string {
+	if !f.hasRecipients() {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d collected", f.collectedCount(), len(f.Recipients))
+}
+
+// recipientSlot returns the index of the recipient holding token, or -1.
+func (f *FileInfo) recipientSlot(token string) int {
+	if token == "" {
+		return -1
+	}
+	hash := hashRecipientToken(token)
+	for i, recipient := range f.Recipients {
+		if subtle.ConstantTimeCompare([]byte(recipient.TokenHash), []byte(hash)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkRecipient lets a download of a file with recipients through only for
+// a recipient who hasn't collected it yet. Admins may download without a
+// token; their downloads don't use up a slot.
+func (f *FileInfo) checkRecipient(creds downloadCredentials) error {
+	if !f.hasRecipients() || creds.Admin && creds.Recipient == "" {
+		return nil
+	}
+	slot := f.recipientSlot(creds.Recipient)
+	switch {
+	case slot < 0:
+		return errRecipientRequired
+	case f.Recipients[slot].Collected != nil:
+		return errRecipientCollected
+	}
+	return nil
+}
+
+// collectDownload marks the slot of the recipient whose token came with a
+// completed download as consumed. Once every recipient has collected the
+// file it counts as used up and is kept for post_limit_grace at most.
+func (fm *FileManager) collectDownload(r *http.Request, fileInfo *FileInfo, token string) {
+	fm.mutex.Lock()
+	slot := fileInfo.recipientSlot(token)
+	if slot < 0 || fileInfo.Recipients[slot].Collected != nil {
+		fm.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	fileInfo.Recipients[slot].Collected = &now
+	all := fileInfo.collectedCount() == len(fileInfo.Recipients)
+	if grace := fm.config().PostLimitGrace; all && grace > 0 {
+		graceUntil := now.Add(grace)
+		fileInfo.GraceUntil = &graceUntil
+	}
+	status := fileInfo.collectionStatus()
+	fm.recordChange(changeUpdated, fileInfo.ID, fileInfo)
+	fm.mutex.Unlock()
+
+	log.Printf("Recipient %d of %s collected the file (%s)", slot+1, fileInfo.ID, status)
+	fm.recordEvent(r, "collect", fileInfo, fileInfo.ID, status)
+}
+
+// rangeReachesEnd reports whether a download with the given Range header
+// delivers the end of the file, so a download resumed with Range still
+// completes. Multi-range requests never do.
+func rangeReachesEnd(header string, size int64) bool {
+	if header == "" {
+		return true
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return false
+	}
+	start, end, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return false
+	}
+	if start == "" || end == "" {
+		return true
+	}
+	last, err := strconv.ParseInt(end, 10, 64)
+	return err == nil && last >= size-1
+}
+
+// recipientLinks returns the share page URL of each recipient, in the order
+// their tokens were given.
+func (fm *FileManager) recipientLinks(r *http.Request, fileID string, tokens []string) []string {
+	links := make([]string, len(tokens))
+	for i, token := range tokens {
+		links[i] = fm.landingURL(r, fileID) + "?recipient=" + token
+	}
+	return links
+}
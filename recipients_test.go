@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRecipients(t *testing.T) {
+	if tokens, err := parseRecipients("3"); err != nil || len(tokens) != 3 || tokens[0] == tokens[1] || !recipientTokenPattern.MatchString(tokens[2]) {
+		t.Errorf("parseRecipients(3) = %q, %v", tokens, err)
+	}
+	if tokens, err := parseRecipients(" alice-0001 ,bob_00002"); err != nil || fmt.Sprint(tokens) != "[alice-0001 bob_00002]" {
+		t.Errorf("parseRecipients(tokens) = %q, %v", tokens, err)
+	}
+	for _, raw := range []string{"0", "-1", "101", "short", "alice-0001,alice-0001", "alice-0001,", "has space1", strings.Repeat("x", 129)} {
+		if tokens, err := parseRecipients(raw); err == nil {
+			t.Errorf("parseRecipients(%q) = %q, want an error", raw, tokens)
+		}
+	}
+}
+
+func TestRangeReachesEnd(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":               true,
+		"bytes=0-":       true,
+		"bytes=50-":      true,
+		"bytes=-10":      true,
+		"bytes=0-99":     true,
+		"bytes=90-150":   true,
+		"bytes=0-98":     false,
+		"bytes=0-9,90-":  false,
+		"items=0-":       false,
+		"bytes=0-banana": false,
+	} {
+		if got := rangeReachesEnd(header, 100); got != want {
+			t.Errorf("rangeReachesEnd(%q, 100) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestRecipientsCollect(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) { c.AdminPassword = "secret" })
+	content := testContent(100)
+	status, uploaded := uploadTestFile(t, server, "handover.bin", content, url.Values{"recipients": {"alice-0001,bob-00002,carol-0003"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+	links := fmt.Sprint(uploaded["recipients"])
+	for _, token := range []string{"alice-0001", "bob-00002", "carol-0003"} {
+		if !strings.Contains(links, "/f/"+id+"?recipient="+token) {
+			t.Errorf("recipient links %s lack %s", links, token)
+		}
+	}
+
+	get := func(token, rangeHeader string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL+"/download/"+id+"?recipient="+token, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+	collected := func() string {
+		t.Helper()
+		_, info := getJSON(t, server, "/info/"+id)
+		s, _ := info["collected"].(string)
+		return s
+	}
+
+	if resp, _ := get("", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("download without a token: status %d, want 403", resp.StatusCode)
+	}
+	if resp, _ := get("mallory-01", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("download with an unknown token: status %d, want 403", resp.StatusCode)
+	}
+	if resp, _ := get("alice-0001", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("alice: status %d", resp.StatusCode)
+	}
+	if resp, _ := get("alice-0001", ""); resp.StatusCode != http.StatusGone {
+		t.Errorf("alice again: status %d, want 410", resp.StatusCode)
+	}
+	if got := collected(); got != "1 of 3 collected" {
+		t.Errorf("collected %q after alice", got)
+	}
+
+	// Admins download without using up a slot
+	req, _ := http.NewRequest("GET", server.URL+"/download/"+id, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin download: %v %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// The TTL doesn't apply while recipients remain
+	fm.mutex.Lock()
+	fm.files[id].ExpiresAt = time.Now().Add(-time.Hour)
+	fm.mutex.Unlock()
+	fm.cleanup()
+	resp, _ := get("bob-00002", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Downloads-Remaining") != "2" {
+		t.Fatalf("bob past the TTL: status %d, X-Downloads-Remaining %q", resp.StatusCode, resp.Header.Get("X-Downloads-Remaining"))
+	}
+
+	// Only a download that reaches the end of the file collects it
+	if resp, body := get("carol-0003", "bytes=0-9"); resp.StatusCode != http.StatusPartialContent || len(body) != 10 {
+		t.Fatalf("carol's first range: status %d, %d bytes", resp.StatusCode, len(body))
+	}
+	if got := collected(); got != "2 of 3 collected" {
+		t.Errorf("collected %q after a partial download", got)
+	}
+	page, err := http.Get(server.URL + "/f/" + id + "?recipient=carol-0003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	html, _ := io.ReadAll(page.Body)
+	page.Body.Close()
+	if !strings.Contains(string(html), "Recipients: 2 of 3 collected") {
+		t.Errorf("share page lacks the progress:\n%s", html)
+	}
+	if resp, _ := get("carol-0003", "bytes=10-"); resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("carol resuming: status %d", resp.StatusCode)
+	}
+
+	// Once everyone has it, the TTL applies again and cleanup removes it
+	if got := collected(); got != "3 of 3 collected" {
+		t.Errorf("collected %q after carol", got)
+	}
+	fm.cleanup()
+	fm.mutex.RLock()
+	_, kept := fm.files[id]
+	fm.mutex.RUnlock()
+	if kept {
+		t.Error("file kept after all recipients collected it")
+	}
+}
+
+func TestRecipientsAndDownloadLimits(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.AdminPassword = "secret"
+		c.PostLimitGrace = time.Hour
+	})
+	if status, body := uploadTestFile(t, server, "a.bin", []byte("content"), url.Values{"recipients": {"2"}, "max_downloads": {"1"}}); status != http.StatusBadRequest {
+		t.Errorf("recipients with max_downloads: status %d, body %v, want 400", status, body)
+	}
+	status, uploaded := uploadTestFile(t, server, "a.bin", []byte("content"), url.Values{"recipients": {"alice-0001"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+	admin := func(method, path, contentType, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		status, _ := doJSON(t, req)
+		return status
+	}
+	if status := admin("POST", "/api/admin/files/"+id+"/set-limit", "application/x-www-form-urlencoded", "max_downloads=3"); status != http.StatusBadRequest {
+		t.Errorf("set-limit on a file with recipients: status %d, want 400", status)
+	}
+	if status := admin("PATCH", "/api/files/"+id, "application/json", `{"max_downloads":3}`); status != http.StatusBadRequest {
+		t.Errorf("PATCH max_downloads on a file with recipients: status %d, want 400", status)
+	}
+
+	// With post_limit_grace the collected file waits, and resetting its
+	// downloads reopens the slot
+	if status := downloadStatus(t, server.URL, id, url.Values{"recipient": {"alice-0001"}}); status != http.StatusOK {
+		t.Fatalf("alice: status %d", status)
+	}
+	fm.cleanup()
+	fm.mutex.RLock()
+	fileStatus := fm.files[id].Status()
+	fm.mutex.RUnlock()
+	if fileStatus != StatusLimitGrace {
+		t.Fatalf("status after collection with a grace period: %s", fileStatus)
+	}
+	if status := admin("POST", "/api/admin/files/"+id+"/reset-downloads", "", ""); status != http.StatusOK {
+		t.Fatalf("reset-downloads: status %d", status)
+	}
+	if status := downloadStatus(t, server.URL, id, url.Values{"recipient": {"alice-0001"}}); status != http.StatusOK {
+		t.Errorf("alice after the reset: status %d", status)
+	}
+}
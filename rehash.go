@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+func init() {
+	jobRunners["rehash"] = runRehash
+}
+
+// throttledReader limits reads to roughly bytesPerSecond so background jobs
+// don't starve foreground downloads of disk bandwidth.
+type throttledReader struct {
+	r              io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	read           int64
+}
+
+func newThrottledReader(r io.Reader, bytesPerSecond int64) io.Reader {
+	if bytesPerSecond <= 0 {
+		return r
+	}
+	return &throttledReader{r: r, bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.bytesPerSecond {
+		p = p[:t.bytesPerSecond]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+
+	expected := time.Duration(float64(t.read) / float64(t.bytesPerSecond) * float64(time.Second))
+	if elapsed := time.Since(t.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+	return n, err
+}
+
+// runRehash computes the configured-algorithm checksum for every file that
+// lacks one. It only touches files still needing work, so rerunning it after
+// an interruption simply picks up where it stopped.
+func runRehash(fm *FileManager, job *Job, params map[string]string) error {
+	algorithm := fm.config().ChecksumAlgorithm
+	keepOld := params["keep_old"] == "true"
+
+	type target struct {
+		id    string
+		key   string
+		store Storage
+	}
+
+	fm.mutex.RLock()
+	var targets []target
+	for id, fileInfo := range fm.files {
+		if !fileInfo.isLink() && !fileInfo.HashPending && checksumAlgorithm(fileInfo.Checksum) != algorithm {
+			targets = append(targets, target{id: id, key: fileInfo.StorageKey, store: fm.contentStorage(fileInfo)})
+		}
+	}
+	fm.mutex.RUnlock()
+
+	job.setTotal(len(targets))
+
+	for i, t := range targets {
+		checksum, err := fm.rehashFile(t.store, t.key, fm.config().RehashBytesPerSecond)
+		if err == nil {
+			fm.mutex.Lock()
+			if fileInfo, exists := fm.files[t.id]; exists {
+				if keepOld && checksumAlgorithm(fileInfo.Checksum) == "sha256" {
+					if fileInfo.Metadata == nil {
+						fileInfo.Metadata = make(map[string]string)
+					}
+					fileInfo.Metadata["checksum_sha256"] = fileInfo.Checksum
+				}
+				fileInfo.Checksum = checksum
+			}
+			fm.mutex.Unlock()
+		}
+		job.advance(err)
+
+		// Persist progress regularly so a restart doesn't redo finished work
+		if (i+1)%50 == 0 {
+			fm.saveMetadata()
+		}
+	}
+
+	return fm.saveMetadata()
+}
+
+func (fm *FileManager) rehashFile(store Storage, key string, bytesPerSecond int64) (string, error) {
+	f, err := store.OpenFile(key, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return fm.calculateChecksum(newThrottledReader(f, bytesPerSecond))
+}
+
+func (fm *FileManager) startRehash(w http.ResponseWriter, r *http.Request) {
+	job := fm.startJob("rehash", map[string]string{
+		"keep_old": r.URL.Query().Get("keep_old"),
+	})
+	fm.writeJobAccepted(w, job)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// relocateFiles implements "uploads relocate-files <old> <new>": it rewrites
+// metadata paths recorded under the old upload directory as storage keys, so
+// they resolve against whatever upload_dir is configured, and with -move also
+// moves the files from old to new. The server must not be running.
+func relocateFiles(args []string) error {
+	fs := flag.NewFlagSet("relocate-files", flag.ContinueOnError)
+	move := fs.Bool("move", false, "also move the stored files from old to new")
+	positional, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("relocate-files expects the old and new upload directories\n\n%s", cliUsage)
+	}
+	oldDir, newDir := positional[0], positional[1]
+
+	config := loadConfig()
+	if config.StorageBackend == storageMemory {
+		return errors.New("the memory backend keeps no files to relocate")
+	}
+	index, err := newFileIndex(&config, localMetadata{})
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	records, err := index.Load()
+	if err != nil {
+		return err
+	}
+	files := make(map[string]*FileInfo, len(records))
+	for id, record := range records {
+		var fileInfo FileInfo
+		if err := json.Unmarshal(record, &fileInfo); err != nil {
+			return fmt.Errorf("reading %s: %w", id, err)
+		}
+		files[id] = &fileInfo
+	}
+
+	var rewritten, moved, outside int
+	for id, fileInfo := range files {
+		if fileInfo.isLink() {
+			continue
+		}
+		key, ok := storageKeyUnder(fileInfo.StorageKey, oldDir)
+		if !ok {
+			// Absolute, but under neither directory; leave it for loadMetadata
+			if key, ok = storageKeyUnder(fileInfo.StorageKey, newDir); !ok {
+				fmt.Fprintf(os.Stderr, "Skipping %s: %s is outside %s\n", id, fileInfo.StorageKey, oldDir)
+				outside++
+				continue
+			}
+		}
+		if key != fileInfo.StorageKey {
+			fileInfo.StorageKey = key
+			rewritten++
+		}
+		if !*move || fileInfo.tier() == tierCold {
+			continue
+		}
+		switch err := moveStoredFile(filepath.Join(oldDir, key), filepath.Join(newDir, key)); {
+		case err == nil:
+			moved++
+		case errors.Is(err, os.ErrNotExist):
+			// Already moved, or lost; loadMetadata reports it either way
+		default:
+			return fmt.Errorf("moving %s: %w", id, err)
+		}
+	}
+
+	for id, fileInfo := range files {
+		if records[id], err = fileInfo.record(); err != nil {
+			return err
+		}
+	}
+	if err := index.Save(records); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d files indexed, %d paths rewritten, %d files moved, %d skipped\n", len(files), rewritten, moved, outside)
+	if filepath.Clean(config.UploadDir) != filepath.Clean(newDir) {
+		fmt.Printf("Set upload_dir to %q in %s before starting the server\n", newDir, configFile)
+	}
+	return nil
+}
+
+// moveStoredFile renames src to dst, copying when they are on different
+// filesystems.
+func moveStoredFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSessionChunks bounds chunk numbers so a session can't be made to track
+// an arbitrary number of pieces.
+const maxSessionChunks = 10000
+
+// uploadSession is a resumable upload: the client sends numbered chunks in
+// any order, retries the ones that failed, and completes the session once
+// all are there. Sessions live in <upload_dir>/.sessions/<id>, one file per
+// chunk plus session.json, so they survive restarts.
+type uploadSession struct {
+	ID      string              `json:"id"`
+	Request uploadRequest       `json:"request"`
+	Created time.Time           `json:"created"`
+	Updated time.Time           `json:"updated"`
+	Chunks  map[int]*chunkState `json:"chunks"`
+
+	completing bool
+}
+
+// chunkState records a received chunk. Verified is set when the client sent
+// X-Chunk-SHA256 and the chunk matched it.
+type chunkState struct {
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	Verified bool   `json:"verified"`
+}
+
+type uploadSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+// sessionDir is the storage key below which a session's state and chunks
+// are kept.
+func (fm *FileManager) sessionDir(id string) string {
+	return path.Join(".sessions", id)
+}
+
+func (fm *FileManager) chunkPath(id string, index int) string {
+	return path.Join(fm.sessionDir(id), strconv.Itoa(index))
+}
+
+// saveSession writes the session state. Callers must hold the sessions mutex.
+func (fm *FileManager) saveSession(s *uploadSession) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStored(fm.storage, path.Join(fm.sessionDir(s.ID), "session.json"), data, 0600)
+}
+
+func (fm *FileManager) loadUploadSessions() {
+	store := &fm.sessions
+	store.sessions = make(map[string]*uploadSession)
+
+	names, err := fm.storage.ReadDir(".sessions")
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		data, err := readStored(fm.storage, path.Join(fm.sessionDir(name), "session.json"))
+		var s uploadSession
+		if err == nil {
+			err = json.Unmarshal(data, &s)
+		}
+		if err != nil || s.ID != name {
+			log.Printf("Removing unreadable upload session %s", name)
+			fm.storage.RemoveAll(fm.sessionDir(name))
+			continue
+		}
+		if s.Chunks == nil {
+			s.Chunks = make(map[int]*chunkState)
+		}
+		store.sessions[s.ID] = &s
+	}
+	if len(store.sessions) > 0 {
+		log.Printf("Loaded %d upload sessions", len(store.sessions))
+	}
+}
+
+// pruneUploadSessions removes sessions idle for longer than
+// upload_session_ttl.
+func (fm *FileManager) pruneUploadSessions() {
+	ttl := fm.config().UploadSessionTTL
+	if ttl <= 0 {
+		return
+	}
+	store := &fm.sessions
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for id, s := range store.sessions {
+		if !s.completing && time.Since(s.Updated) > ttl {
+			delete(store.sessions, id)
+			fm.storage.RemoveAll(fm.sessionDir(id))
+			log.Printf("Removed abandoned upload session %s (%s)", id, s.Request.Filename)
+		}
+	}
+}
+
+// uploadSessionsAPI handles /api/uploads. The session ID returned on creation
+// is the only credential needed for the other calls:
+//
+//	POST   /api/uploads                     start a session
+//	GET    /api/uploads/{id}                received chunks
+//	PUT    /api/uploads/{id}/chunks/{n}     send chunk n, counted from 0
+//	POST   /api/uploads/{id}/complete       assemble and store the file
+//	DELETE /api/uploads/{id}                abandon the session
+func (fm *FileManager) uploadSessionsAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == "POST":
+		fm.createUploadSession(w, r)
+	case len(parts) == 1 && r.Method == "GET":
+		fm.withSession(w, r, parts[0], func(s *uploadSession) {
+			fm.writeSessionStatus(w, r, s, http.StatusOK)
+		})
+	case len(parts) == 1 && r.Method == "DELETE":
+		fm.abortUploadSession(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "chunks" && r.Method == "PUT":
+		index, err := strconv.Atoi(parts[2])
+		if err != nil || index < 0 || index >= maxSessionChunks {
+			respondError(w, r, "Invalid chunk number", http.StatusBadRequest)
+			return
+		}
+		fm.putChunk(w, r, parts[0], index)
+	case len(parts) == 2 && parts[1] == "complete" && r.Method == "POST":
+		fm.completeUploadSession(w, r, parts[0])
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (fm *FileManager) createUploadSession(w http.ResponseWriter, r *http.Request) {
+	key, ok := fm.authorizeKey(w, r, scopeUpload)
+	// Sessions count as uploads; their bytes once they complete
+	if !ok || !fm.requireUploadKey(w, r, key) || !fm.admitUploader(w, r, 0) {
+		return
+	}
+
+	if err := limitForm(r, 0); err != nil {
+		respondFormError(w, r, err, "Invalid form")
+		return
+	}
+	req, err := fm.uploadParams(r, key)
+	if err != nil {
+		respondError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Filename = r.FormValue("filename")
+	req.ContentType = r.FormValue("content_type")
+	if req.Filename == "" {
+		respondError(w, r, "filename is required", http.StatusBadRequest)
+		return
+	}
+	if !fm.typeAllowed(req.ContentType) {
+		respondError(w, r, "File type not allowed", http.StatusBadRequest)
+		return
+	}
+	if req.ID != "" {
+		if err := fm.checkCustomID(req.ID); err != nil {
+			fm.writeUploadError(w, r, req.Filename, err)
+			return
+		}
+	}
+	if violations := fm.validateMetadata(req.Metadata, req.Tags); len(violations) > 0 {
+		writeViolations(w, r, violations)
+		return
+	}
+
+	now := time.Now()
+	s := &uploadSession{
+		ID:      generateID(),
+		Request: req,
+		Created: now,
+		Updated: now,
+		Chunks:  make(map[int]*chunkState),
+	}
+	if err := fm.storage.MkdirAll(fm.sessionDir(s.ID), 0700); err != nil {
+		writeStorageError(w, r, fm.storageFailure(err))
+		return
+	}
+
+	store := &fm.sessions
+	store.mutex.Lock()
+	err = fm.saveSession(s)
+	if err == nil {
+		store.sessions[s.ID] = s
+	}
+	store.mutex.Unlock()
+	if err != nil {
+		fm.storage.RemoveAll(fm.sessionDir(s.ID))
+		writeStorageError(w, r, fm.storageFailure(err))
+		return
+	}
+
+	fm.writeSessionStatus(w, r, s, http.StatusCreated)
+}
+
+// withSession runs fn with the session locked, answering 404 for unknown IDs.
+func (fm *FileManager) withSession(w http.ResponseWriter, r *http.Request, id string, fn func(*uploadSession)) {
+	store := &fm.sessions
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	s, exists := store.sessions[id]
+	if !exists {
+		respondError(w, r, "Upload session not found", http.StatusNotFound)
+		return
+	}
+	fn(s)
+}
+
+// putChunk stores one chunk. With X-Chunk-SHA256 the chunk is hashed as it
+// streams in and rejected with 422 if it doesn't match, leaving the rest of
+// the session intact so the client only resends that chunk.
+func (fm *FileManager) putChunk(w http.ResponseWriter, r *http.Request, id string, index int) {
+	expected := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Chunk-SHA256")))
+	if expected != "" {
+		if sum, err := hex.DecodeString(expected); err != nil || len(sum) != sha256.Size {
+			respondError(w, r, "X-Chunk-SHA256 must be a hex SHA-256 digest", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Other chunks count against max_file_size, a replaced one doesn't
+	store := &fm.sessions
+	store.mutex.Lock()
+	s, exists := store.sessions[id]
+	var completing bool
+	var received int64
+	if exists {
+		completing = s.completing
+		for i, chunk := range s.Chunks {
+			if i != index {
+				received += chunk.Size
+			}
+		}
+	}
+	store.mutex.Unlock()
+	if !exists {
+		respondError(w, r, "Upload session not found", http.StatusNotFound)
+		return
+	}
+	if completing {
+		respondError(w, r, "Upload session is being completed", http.StatusConflict)
+		return
+	}
+	limit := fm.config().MaxFileSize - received
+
+	tmpKey := path.Join(fm.sessionDir(id), ".chunk-"+generateID())
+	tmp, err := fm.storage.OpenFile(tmpKey, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		writeStorageError(w, r, fm.storageFailure(err))
+		return
+	}
+	defer fm.storage.Remove(tmpKey)
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), io.LimitReader(newContextReader(r.Context(), r.Body), limit+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if clientGone(r.Context(), err) {
+		fm.transfers.abortedUploads.Add(1)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, fm.storageFailure(err))
+		return
+	}
+	if size > limit {
+		respondError(w, r, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if expected != "" && actual != expected {
+		log.Printf("Rejected chunk %d of upload session %s: checksum mismatch", index, id)
+		respondJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":    "chunk checksum mismatch",
+			"chunk":    index,
+			"expected": expected,
+			"actual":   actual,
+		})
+		return
+	}
+
+	fm.withSession(w, r, id, func(s *uploadSession) {
+		if s.completing {
+			respondError(w, r, "Upload session is being completed", http.StatusConflict)
+			return
+		}
+		if err := fm.storage.Rename(tmpKey, fm.chunkPath(id, index)); err != nil {
+			writeStorageError(w, r, fm.storageFailure(err))
+			return
+		}
+		s.Chunks[index] = &chunkState{Size: size, SHA256: actual, Verified: expected != ""}
+		s.Updated = time.Now()
+		if err := fm.saveSession(s); err != nil {
+			writeStorageError(w, r, fm.storageFailure(err))
+			return
+		}
+		fm.writeSessionStatus(w, r, s, http.StatusOK)
+	})
+}
+
+// completeUploadSession stores the chunks, in order, as one file. The
+// session's checksum, if any, is verified by storeFile; on a mismatch the
+// session is kept so bad chunks can be resent.
+func (fm *FileManager) completeUploadSession(w http.ResponseWriter, r *http.Request, id string) {
+	store := &fm.sessions
+	store.mutex.Lock()
+	s, exists := store.sessions[id]
+	var busy bool
+	var missing []int
+	var received int64
+	if exists {
+		busy = s.completing
+		missing = s.missingChunks()
+		if !busy && len(missing) == 0 {
+			s.completing = true
+		}
+		for _, chunk := range s.Chunks {
+			received += chunk.Size
+		}
+	}
+	store.mutex.Unlock()
+
+	switch {
+	case !exists:
+		respondError(w, r, "Upload session not found", http.StatusNotFound)
+		return
+	case busy:
+		respondError(w, r, "Upload session is being completed", http.StatusConflict)
+		return
+	case len(missing) > 0:
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":   "missing chunks",
+			"missing": missing,
+		})
+		return
+	}
+
+	// The chunks give the exact size, so the file's room is reserved first
+	req := s.Request
+	reservation, err := fm.reserveStorage(received)
+	var fileInfo *FileInfo
+	if err == nil {
+		req.Reservation = reservation
+		src := &sessionReader{fm: fm, id: id, count: len(s.Chunks)}
+		fileInfo, err = fm.storeFile(r.Context(), src, req)
+		src.Close()
+		fm.releaseStorage(reservation)
+	}
+
+	store.mutex.Lock()
+	s.completing = false
+	if err == nil {
+		delete(store.sessions, id)
+	}
+	store.mutex.Unlock()
+
+	if err != nil {
+		fm.writeUploadError(w, r, s.Request.Filename, err)
+		return
+	}
+	fm.storage.RemoveAll(fm.sessionDir(id))
+	fm.queueUploadEmail(r, "upload", fileInfo, nil, s.Request)
+	fm.writeUploadResponse(w, r, fileInfo)
+}
+
+func (fm *FileManager) abortUploadSession(w http.ResponseWriter, r *http.Request, id string) {
+	store := &fm.sessions
+	store.mutex.Lock()
+	s, exists := store.sessions[id]
+	busy := exists && s.completing
+	if exists && !busy {
+		delete(store.sessions, id)
+	}
+	store.mutex.Unlock()
+
+	switch {
+	case !exists:
+		respondError(w, r, "Upload session not found", http.StatusNotFound)
+	case busy:
+		respondError(w, r, "Upload session is being completed", http.StatusConflict)
+	default:
+		fm.storage.RemoveAll(fm.sessionDir(id))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// missingChunks lists the gaps below the highest chunk received, or chunk 0
+// when nothing has arrived yet.
+func (s *uploadSession) missingChunks() []int {
+	if len(s.Chunks) == 0 {
+		return []int{0}
+	}
+	highest := 0
+	for index := range s.Chunks {
+		highest = max(highest, index)
+	}
+	var missing []int
+	for index := 0; index < highest; index++ {
+		if s.Chunks[index] == nil {
+			missing = append(missing, index)
+		}
+	}
+	return missing
+}
+
+// sessionReader reads a session's chunks in order, opening one at a time.
+type sessionReader struct {
+	fm    *FileManager
+	id    string
+	count int
+	next  int
+	file  File
+}
+
+func (c *sessionReader) Read(p []byte) (int, error) {
+	for {
+		if c.file == nil {
+			if c.next == c.count {
+				return 0, io.EOF
+			}
+			f, err := c.fm.storage.OpenFile(c.fm.chunkPath(c.id, c.next), os.O_RDONLY, 0)
+			if err != nil {
+				return 0, err
+			}
+			c.file = f
+			c.next++
+		}
+		n, err := c.file.Read(p)
+		if err == io.EOF {
+			c.file.Close()
+			c.file = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *sessionReader) Close() {
+	if c.file != nil {
+		c.file.Close()
+	}
+}
+
+// sessionChunk is a received chunk as reported by the API.
+type sessionChunk struct {
+	Index int `json:"index"`
+	chunkState
+}
+
+func (fm *FileManager) writeSessionStatus(w http.ResponseWriter, r *http.Request, s *uploadSession, status int) {
+	chunks := make([]sessionChunk, 0, len(s.Chunks))
+	var received int64
+	for index, chunk := range s.Chunks {
+		chunks = append(chunks, sessionChunk{index, *chunk})
+		received += chunk.Size
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Index < chunks[j].Index })
+
+	response := map[string]interface{}{
+		"id":         s.ID,
+		"filename":   s.Request.Filename,
+		"upload_url": fm.baseURL(r) + "/api/uploads/" + s.ID,
+		"received":   received,
+		"chunks":     chunks,
+		"missing":    s.missingChunks(),
+		"created":    s.Created,
+		"updated":    s.Updated,
+	}
+	if ttl := fm.config().UploadSessionTTL; ttl > 0 {
+		response["expires_at"] = s.Updated.Add(ttl)
+	}
+	respondJSON(w, status, response)
+}
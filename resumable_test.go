@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// startSession opens an upload session for filename and returns its ID.
+func startSession(t *testing.T, server *httptest.Server, filename string, fields url.Values) string {
+	t.Helper()
+	if fields == nil {
+		fields = url.Values{}
+	}
+	fields.Set("filename", filename)
+	req, _ := http.NewRequest("POST", server.URL+"/api/uploads", strings.NewReader(fields.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	status, body := doJSON(t, req)
+	if status != http.StatusCreated {
+		t.Fatalf("start session: status %d, body %v", status, body)
+	}
+	return body["id"].(string)
+}
+
+// sendChunk sends content as chunk index, with digest as X-Chunk-SHA256 if
+// it isn't empty.
+func sendChunk(t *testing.T, server *httptest.Server, id string, index int, content []byte, digest string) (int, map[string]interface{}) {
+	t.Helper()
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/api/uploads/%s/chunks/%d", server.URL, id, index), bytes.NewReader(content))
+	if digest != "" {
+		req.Header.Set("X-Chunk-SHA256", digest)
+	}
+	return doJSON(t, req)
+}
+
+func TestCorruptChunkRejected(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	content := testContent(3 << 10)
+	chunks := [][]byte{content[:1024], content[1024:2048], content[2048:]}
+	id := startSession(t, server, "release.bin", url.Values{"checksum": {"sha256:" + sha256Hex(content)}})
+
+	for index, chunk := range chunks {
+		if index == 1 {
+			continue
+		}
+		if status, body := sendChunk(t, server, id, index, chunk, sha256Hex(chunk)); status != http.StatusOK {
+			t.Fatalf("chunk %d: status %d, body %v", index, status, body)
+		}
+	}
+
+	// A chunk flipped in transit is turned away on its own
+	corrupt := bytes.Clone(chunks[1])
+	corrupt[100] ^= 0xff
+	status, body := sendChunk(t, server, id, 1, corrupt, sha256Hex(chunks[1]))
+	if status != http.StatusUnprocessableEntity || body["chunk"] != 1.0 || body["expected"] != sha256Hex(chunks[1]) || body["actual"] != sha256Hex(corrupt) {
+		t.Fatalf("corrupt chunk: status %d, body %v, want 422 naming both digests", status, body)
+	}
+	req, _ := http.NewRequest("POST", server.URL+"/api/uploads/"+id+"/complete", nil)
+	if status, body := doJSON(t, req); status != http.StatusConflict || fmt.Sprint(body["missing"]) != "[1]" {
+		t.Fatalf("complete without chunk 1: status %d, body %v, want 409 missing [1]", status, body)
+	}
+
+	// Resending only that chunk finishes the same session
+	if status, body := sendChunk(t, server, id, 1, chunks[1], strings.ToUpper(sha256Hex(chunks[1]))); status != http.StatusOK {
+		t.Fatalf("resent chunk: status %d, body %v", status, body)
+	}
+	_, session := getJSON(t, server, "/api/uploads/"+id)
+	for _, chunk := range session["chunks"].([]interface{}) {
+		if chunk := chunk.(map[string]interface{}); chunk["verified"] != true {
+			t.Errorf("chunk %v not recorded as verified", chunk["index"])
+		}
+	}
+	req, _ = http.NewRequest("POST", server.URL+"/api/uploads/"+id+"/complete", nil)
+	status, uploaded := doJSON(t, req)
+	if status != http.StatusOK {
+		t.Fatalf("complete: status %d, body %v", status, uploaded)
+	}
+	resp, err := http.Get(server.URL + "/download/" + uploaded["id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(got, content) {
+		t.Error("assembled file differs from what was sent")
+	}
+}
+
+func TestUnverifiedChunkCaughtByFileChecksum(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	content := testContent(2048)
+	id := startSession(t, server, "release.bin", url.Values{"checksum": {"sha256:" + sha256Hex(content)}})
+
+	if status, body := sendChunk(t, server, id, 0, []byte("nope"), "not-hex"); status != http.StatusBadRequest {
+		t.Errorf("malformed X-Chunk-SHA256: status %d, body %v, want 400", status, body)
+	}
+
+	// Without X-Chunk-SHA256 the corruption is only found on completion
+	corrupt := bytes.Clone(content[1024:])
+	corrupt[0] ^= 0xff
+	sendChunk(t, server, id, 0, content[:1024], "")
+	if status, body := sendChunk(t, server, id, 1, corrupt, ""); status != http.StatusOK {
+		t.Fatalf("unverified chunk: status %d, body %v", status, body)
+	}
+	_, session := getJSON(t, server, "/api/uploads/"+id)
+	if chunk := session["chunks"].([]interface{})[1].(map[string]interface{}); chunk["verified"] != false || chunk["sha256"] != sha256Hex(corrupt) {
+		t.Errorf("unverified chunk recorded as %v", chunk)
+	}
+	req, _ := http.NewRequest("POST", server.URL+"/api/uploads/"+id+"/complete", nil)
+	if status, body := doJSON(t, req); status != http.StatusUnprocessableEntity || body["code"] != "checksum_mismatch" {
+		t.Fatalf("complete with a corrupt chunk: status %d, body %v, want 422", status, body)
+	}
+
+	// The session survives the mismatch
+	if status, body := sendChunk(t, server, id, 1, content[1024:], sha256Hex(content[1024:])); status != http.StatusOK {
+		t.Fatalf("resent chunk: status %d, body %v", status, body)
+	}
+	req, _ = http.NewRequest("POST", server.URL+"/api/uploads/"+id+"/complete", nil)
+	if status, body := doJSON(t, req); status != http.StatusOK {
+		t.Fatalf("complete after resending: status %d, body %v", status, body)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	errRevisionMismatch = errors.New("the file changed since it was fetched")
+	errIfMatchRequired  = errors.New("If-Match is required to modify files")
+)
+
+// preconditionError is a failed If-Match check, carrying the revision the
+// client should re-fetch and merge with.
+type preconditionError struct {
+	err      error
+	revision int64
+}
+
+func (e *preconditionError) Error() string { return e.err.Error() }
+func (e *preconditionError) Unwrap() error { return e.err }
+
+// ETag identifies the file's revision, which recordChange bumps whenever
+// the record is updated. Plain download counts don't change it.
+func (f *FileInfo) ETag() string {
+	return revisionETag(f.Revision)
+}
+
+func revisionETag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// checkIfMatch compares a request's If-Match header with fileInfo's
+// revision. Requests without one pass unless require_if_match is set.
+// Callers must hold fm.mutex and keep it until the change is recorded, so
+// two requests sent with the same ETag can't both pass.
+func (fm *FileManager) checkIfMatch(header string, fileInfo *FileInfo) error {
+	if header == "" {
+		if fm.config().RequireIfMatch {
+			return &preconditionError{errIfMatchRequired, fileInfo.Revision}
+		}
+		return nil
+	}
+	etag := fileInfo.ETag()
+	for _, candidate := range strings.Split(header, ",") {
+		// Weak tags never match, as If-Match compares strongly
+		if candidate = strings.TrimSpace(candidate); candidate == "*" || candidate == etag {
+			return nil
+		}
+	}
+	return &preconditionError{errRevisionMismatch, fileInfo.Revision}
+}
+
+// writePreconditionError answers a request that failed checkIfMatch with
+// 412, or 428 when If-Match was missing, and the current revision.
+func writePreconditionError(w http.ResponseWriter, r *http.Request, err error) {
+	var precondition *preconditionError
+	if !errors.As(err, &precondition) {
+		respondError(w, r, "Server error", http.StatusInternalServerError)
+		return
+	}
+	etag := revisionETag(precondition.revision)
+	w.Header().Set("ETag", etag)
+	status, code := http.StatusPreconditionFailed, "revision_mismatch"
+	if errors.Is(err, errIfMatchRequired) {
+		status, code = http.StatusPreconditionRequired, "if_match_required"
+	}
+	if !wantsJSON(r) {
+		respondError(w, r, err.Error(), status)
+		return
+	}
+	respondJSON(w, status, map[string]interface{}{
+		"code":     code,
+		"error":    err.Error(),
+		"hint":     "Fetch the file again, reapply your change and send it with If-Match: " + etag,
+		"revision": precondition.revision,
+		"etag":     etag,
+	})
+}
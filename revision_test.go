@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fileETag returns the ETag of /info/{id}, checking /api/files/{id} sends
+// the same.
+func fileETag(t *testing.T, server *httptest.Server, id string) string {
+	t.Helper()
+	var etags []string
+	for _, path := range []string{"/info/", "/api/files/"} {
+		resp, err := http.Get(server.URL + path + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		etags = append(etags, resp.Header.Get("ETag"))
+	}
+	if etags[0] == "" || etags[0] != etags[1] {
+		t.Fatalf("ETags of /info and /api/files: %q", etags)
+	}
+	return etags[0]
+}
+
+// raceRequests sends the requests built by newRequest at once and returns
+// their statuses and bodies.
+func raceRequests(t *testing.T, n int, newRequest func(i int) *http.Request) ([]int, []map[string]interface{}) {
+	t.Helper()
+	statuses := make([]int, n)
+	bodies := make([]map[string]interface{}, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range statuses {
+		req := newRequest(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			statuses[i], bodies[i] = doJSON(t, req)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return statuses, bodies
+}
+
+func TestConcurrentPatchesIfMatch(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	status, body := uploadTestFile(t, server, "notes.txt", []byte("content"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+
+	for round := 0; round < 10; round++ {
+		etag := fileETag(t, server, id)
+		statuses, bodies := raceRequests(t, 2, func(i int) *http.Request {
+			req, _ := http.NewRequest("PATCH", server.URL+"/api/files/"+id, strings.NewReader(fmt.Sprintf(`{"description":"edit %d.%d"}`, round, i)))
+			req.Header.Set("If-Match", etag)
+			return req
+		})
+		winner, loser := 0, 1
+		if statuses[0] != http.StatusOK {
+			winner, loser = 1, 0
+		}
+		if statuses[winner] != http.StatusOK || statuses[loser] != http.StatusPreconditionFailed {
+			t.Fatalf("round %d: statuses %v, want one 200 and one 412", round, statuses)
+		}
+		current := fileETag(t, server, id)
+		if problem := bodies[loser]; problem["code"] != "revision_mismatch" || problem["etag"] != current || current == etag {
+			t.Fatalf("round %d: 412 body %v, current ETag %s", round, problem, current)
+		}
+		// The winner's edit is the one kept
+		if _, info := getJSON(t, server, "/info/"+id); info["description"] != fmt.Sprintf("edit %d.%d", round, winner) {
+			t.Fatalf("round %d: description %v, want the winner's", round, info["description"])
+		}
+	}
+}
+
+func TestConcurrentAppendsIfMatch(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	status, body := uploadTestFile(t, server, "log.txt", []byte("start\n"), url.Values{"appendable": {"true"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+
+	etag := fileETag(t, server, id)
+	statuses, _ := raceRequests(t, 2, func(i int) *http.Request {
+		req, _ := http.NewRequest("PATCH", server.URL+"/put/"+id+"?append=true", strings.NewReader(fmt.Sprintf("line %d\n", i)))
+		req.Header.Set("If-Match", etag)
+		return req
+	})
+	ok, failed := 0, 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusOK:
+			ok++
+		case http.StatusPreconditionFailed:
+			failed++
+		}
+	}
+	if ok != 1 || failed != 1 {
+		t.Fatalf("appends with the same If-Match: statuses %v, want one 200 and one 412", statuses)
+	}
+}
+
+func TestIfMatchForms(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	status, body := uploadTestFile(t, server, "notes.txt", []byte("content"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+	etag := fileETag(t, server, id)
+
+	// Downloads don't change the revision
+	downloadStatus(t, server.URL, id, nil)
+	if got := fileETag(t, server, id); got != etag {
+		t.Fatalf("ETag after a download: %s, want %s", got, etag)
+	}
+
+	setLimit := func(ifMatch string, limit int) (int, map[string]interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest("POST", server.URL+"/api/admin/files/"+id+"/set-limit", strings.NewReader(url.Values{"max_downloads": {fmt.Sprint(limit)}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		return doJSON(t, req)
+	}
+	for _, tc := range []struct {
+		ifMatch string
+		want    int
+	}{
+		{`W/` + etag, http.StatusPreconditionFailed}, // weak tags never match
+		{`"999"`, http.StatusPreconditionFailed},
+		{`"999", ` + etag, http.StatusOK},
+		{"*", http.StatusOK},
+		{"", http.StatusOK}, // unconditional requests keep working
+	} {
+		if status, body := setLimit(tc.ifMatch, 5); status != tc.want {
+			t.Errorf("If-Match %q: status %d, body %v, want %d", tc.ifMatch, status, body, tc.want)
+		}
+		if tc.want == http.StatusOK {
+			etag = fileETag(t, server, id)
+		}
+	}
+
+	// require_if_match refuses unconditional changes with 428
+	config := *fm.config()
+	config.RequireIfMatch = true
+	fm.cfg.Store(&config)
+	if status, body := setLimit("", 5); status != http.StatusPreconditionRequired || body["code"] != "if_match_required" || body["etag"] != etag {
+		t.Errorf("without If-Match: status %d, body %v, want 428 with the ETag", status, body)
+	}
+	if status, body := setLimit(etag, 6); status != http.StatusOK {
+		t.Errorf("with If-Match: status %d, body %v", status, body)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	errInvalidID     = errors.New("custom IDs must be 3-64 letters, digits, '-' or '_'")
+	errIDReserved    = errors.New("ID is reserved")
+	errIDTaken       = errors.New("ID is already in use")
+	errMalformedPath = errors.New("malformed path")
+)
+
+var customIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+// registerRoutes sets up the HTTP routes, then moves files whose IDs the
+// routes now claim.
+func (fm *FileManager) registerRoutes() {
+	fm.handle("/upload", fm.uploadFile)
+	fm.handle("/upload/", fm.putUpload)
+	fm.handle("/download/", fm.downloadFile)
+	fm.handle("/delete/", fm.deleteFile)
+	fm.handle("/put/", fm.putHandler)
+	fm.handle("/manage", fm.manageFiles)
+	fm.handle("/search", fm.searchFiles)
+	fm.handle("/stats", fm.getStats)
+	fm.handle("/info/", fm.fileInfo)
+	fm.handle("/f/", fm.landingPage)
+	fm.handle("/request/", fm.requestPage)
+	fm.handle("/bulk-delete", fm.bulkDelete)
+	fm.handle("/api/", fm.apiHandler)
+	fm.handle("/admin/files/", fm.adminFilePage)
+	fm.handle("/login", fm.login)
+	fm.handle("/logout", fm.logout)
+	if len(fm.config().S3Credentials) > 0 {
+		fm.handle("/s3", fm.s3Handler)
+		fm.handle("/s3/", fm.s3Handler)
+	}
+	if fm.config().MetricsEnabled {
+		fm.handle("/metrics", fm.serveMetrics)
+	}
+	fm.mux.HandleFunc("/", fm.timed(fm.manageFiles))
+
+	// Files uploaded before a route existed must not shadow it
+	fm.renameReservedIDs()
+}
+
+// Handler returns the routes set up by registerRoutes, served below
+// path_prefix when one is configured. The bare prefix redirects to the
+// prefix with a trailing slash, and with health_at_root /api/health answers
+// at the root as well, for load balancers that probe there.
+func (fm *FileManager) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := fm.config()
+		prefix := config.PathPrefix
+		switch {
+		case prefix == "":
+			fm.mux.ServeHTTP(w, r)
+		case r.URL.Path == prefix:
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			status := http.StatusMovedPermanently
+			if r.Method != "GET" && r.Method != "HEAD" {
+				status = http.StatusPermanentRedirect // keeps the method and body
+			}
+			http.Redirect(w, r, target, status)
+		case strings.HasPrefix(r.URL.Path, prefix+"/"):
+			http.StripPrefix(prefix, fm.mux).ServeHTTP(w, r)
+		case config.HealthAtRoot && r.URL.Path == "/api/health":
+			fm.mux.ServeHTTP(w, r)
+		default:
+			respondError(w, r, "Not found", http.StatusNotFound)
+		}
+	})
+}
+
+// handle registers a timed route and reserves its first path segment, so
+// the reserved-ID list follows the routes instead of being maintained by
+// hand.
+func (fm *FileManager) handle(pattern string, handler http.HandlerFunc) {
+	fm.mux.HandleFunc(pattern, fm.timed(handler))
+	if segment := routeSegment(pattern); segment != "" {
+		fm.reservedIDs[strings.ToLower(segment)] = true
+	}
+}
+
+// pathSegments splits the request path after prefix into its decoded
+// segments, ignoring a trailing slash. Segments are unescaped one by one, so
+// %41 always reads as A and an encoded slash can't open another segment.
+// Empty segments, "." and "..", invalid escapes and escapes that decode to
+// a separator or control character are refused with errMalformedPath.
+func pathSegments(r *http.Request, prefix string) ([]string, error) {
+	raw, ok := strings.CutPrefix(r.URL.EscapedPath(), prefix)
+	if !ok {
+		return nil, errMalformedPath
+	}
+	raw = strings.TrimSuffix(raw, "/")
+	if raw == "" {
+		return nil, nil
+	}
+	parts := strings.Split(raw, "/")
+	for i, part := range parts {
+		segment, err := url.PathUnescape(part)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("%w: invalid escape in %q", errMalformedPath, part)
+		case segment == "" || segment == "." || segment == "..":
+			return nil, fmt.Errorf("%w: empty or relative segment", errMalformedPath)
+		case strings.ContainsFunc(segment, func(c rune) bool { return c == '/' || c == '\\' || unicode.IsControl(c) }):
+			return nil, fmt.Errorf("%w: %q contains a separator or control character", errMalformedPath, part)
+		}
+		parts[i] = segment
+	}
+	return parts, nil
+}
+
+// pathID returns the file ID that makes up the rest of the request path
+// after prefix, as in /download/{id}.
+func pathID(r *http.Request, prefix string) (string, error) {
+	parts, err := pathSegments(r, prefix)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) != 1 {
+		return "", fmt.Errorf("%w: expected %s{id}", errMalformedPath, prefix)
+	}
+	return parts[0], nil
+}
+
+// routeSegment returns the first path segment of a route pattern.
+func routeSegment(pattern string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(pattern, "/"), "/")
+	return segment
+}
+
+// isReservedID reports whether id matches, case-insensitively, a route
+// segment or an entry of reserved_ids.
+func (fm *FileManager) isReservedID(id string) bool {
+	id = strings.ToLower(id)
+	if fm.reservedIDs[id] {
+		return true
+	}
+	for _, reserved := range fm.config().ReservedIDs {
+		if strings.EqualFold(reserved, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCustomID validates a client-chosen file ID.
+func (fm *FileManager) checkCustomID(id string) error {
+	if !customIDPattern.MatchString(id) {
+		return errInvalidID
+	}
+	if fm.isReservedID(id) {
+		return fmt.Errorf("%w: %q collides with a route or reserved word", errIDReserved, id)
+	}
+	return nil
+}
+
+// renameReservedIDs re-keys files whose ID became reserved, e.g. by a route
+// added after they were uploaded, by appending a numeric suffix. It runs once
+// all routes are registered.
+func (fm *FileManager) renameReservedIDs() {
+	fm.mutex.Lock()
+	renamed := 0
+	for id, fileInfo := range fm.files {
+		if !fm.isReservedID(id) {
+			continue
+		}
+		newID := id
+		for n := 1; fm.files[newID] != nil || fm.isReservedID(newID); n++ {
+			newID = fmt.Sprintf("%s-%d", id, n)
+		}
+		delete(fm.files, id)
+		fm.recordChange(changeDeleted, id, fileInfo)
+		fileInfo.ID = newID
+		fm.files[newID] = fileInfo
+		fm.recordChange(changeCreated, newID, fileInfo)
+		renamed++
+		log.Printf("File ID %q shadows a route, renamed to %q", id, newID)
+	}
+	fm.mutex.Unlock()
+
+	if renamed > 0 {
+		fm.saveMetadata()
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNewRouteIsReserved(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) {
+		c.ReservedIDs = []string{"Billing"}
+	})
+	if err := fm.checkCustomID("widgets"); err != nil {
+		t.Fatalf("widgets before its route exists: %v", err)
+	}
+
+	// Registering a route is all it takes to reserve its first segment
+	fm.handle("/widgets/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("widget route"))
+	})
+	if err := fm.checkCustomID("widgets"); !errors.Is(err, errIDReserved) {
+		t.Errorf("widgets after registering /widgets/: %v, want errIDReserved", err)
+	}
+
+	server := httptest.NewServer(fm.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		fm.Close()
+	})
+	for _, id := range []string{"WIDGETS", "manage", "Api", "download", "billing"} {
+		status, body := uploadTestFile(t, server, "a.txt", []byte("content"), url.Values{"id": {id}})
+		if status != http.StatusConflict || body["code"] != "id_reserved" || !strings.Contains(body["error"].(string), id) {
+			t.Errorf("upload with id %q: status %d, body %v, want 409 naming the ID", id, status, body)
+		}
+	}
+	if status, body := uploadTestFile(t, server, "a.txt", []byte("content"), url.Values{"id": {"gadgets"}}); status != http.StatusOK {
+		t.Errorf("upload with a free id: status %d, body %v", status, body)
+	}
+}
+
+func TestRenameReservedIDs(t *testing.T) {
+	fm := NewTestFileManager(nil)
+	for _, id := range []string{"reports", "reports-1"} {
+		if _, err := fm.storeFile(t.Context(), strings.NewReader(id), uploadRequest{
+			ID: id, Filename: id + ".txt", TTL: fm.config().DefaultTTL, TTLSource: ttlDefault,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A route added after the upload takes over its ID on the next start
+	fm.handle("/reports", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("report route"))
+	})
+	fm.renameReservedIDs()
+	server := httptest.NewServer(fm.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		fm.Close()
+	})
+
+	fm.mutex.RLock()
+	_, kept := fm.files["reports-1"]
+	renamed := fm.files["reports-2"]
+	_, shadowing := fm.files["reports"]
+	fm.mutex.RUnlock()
+	if shadowing || !kept || renamed == nil || renamed.ID != "reports-2" || renamed.OriginalName != "reports.txt" {
+		t.Fatalf("after renaming: reports %v, reports-1 %v, reports-2 %+v", shadowing, kept, renamed)
+	}
+
+	for path, want := range map[string]string{"/reports": "report route", "/download/reports-2": "reports"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("%s: %q, want %q", path, body, want)
+		}
+	}
+}
+
+func TestPathSegments(t *testing.T) {
+	for path, want := range map[string]string{
+		"/download/abc":       "[abc]",
+		"/download/abc/":      "[abc]",
+		"/download/%61bc":     "[abc]",
+		"/download/a%20b":     "[a b]",
+		"/download/":          "[]",
+		"/api/files/abc/info": "[files abc info]",
+		"/download/abc%2Fdef": "error",
+		"/download/abc%5Cdef": "error",
+		"/download/%2e%2e":    "error",
+		"/download/abc%00":    "error",
+		"/download/abc%0a":    "error",
+		"/download//abc":      "error",
+		"/download/abc//":     "error",
+		"/elsewhere/abc":      "error",
+	} {
+		prefix := "/download/"
+		if strings.HasPrefix(path, "/api/") {
+			prefix = "/api/"
+		}
+		r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		parts, err := pathSegments(r, prefix)
+		got := fmt.Sprint(parts)
+		if err != nil {
+			got = "error"
+			if !errors.Is(err, errMalformedPath) {
+				t.Errorf("%s: %v, want errMalformedPath", path, err)
+			}
+		}
+		if got != want {
+			t.Errorf("pathSegments(%s) = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestMalformedPathsOnEveryRoute(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	if _, err := fm.storeFile(t.Context(), strings.NewReader("content"), uploadRequest{
+		ID: "abc", Filename: "a.txt", TTL: fm.config().DefaultTTL, TTLSource: ttlDefault,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	status := func(method, path string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, route := range []struct{ method, prefix, suffix string }{
+		{"GET", "/download/", ""},
+		{"GET", "/info/", ""},
+		{"GET", "/f/", ""},
+		{"GET", "/f/", "/preview"},
+		{"GET", "/admin/files/", ""},
+		{"GET", "/api/files/", ""},
+		{"GET", "/api/admin/files/", ""},
+		{"DELETE", "/delete/", ""},
+	} {
+		for _, id := range []string{"abc%2Fdef", "abc%5Cdef", "%2e%2e", "abc%00", "abc/extra/more"} {
+			path := route.prefix + id + route.suffix
+			if got := status(route.method, path); got != http.StatusBadRequest && got != http.StatusNotFound {
+				t.Errorf("%s %s: status %d, want 400 or 404", route.method, path, got)
+			}
+		}
+		// Trailing slashes and escaped letters reach the file
+		if route.method == "DELETE" || route.suffix != "" {
+			continue
+		}
+		for _, id := range []string{"abc/", "%61bc"} {
+			if got := status(route.method, route.prefix+id); got != http.StatusOK {
+				t.Errorf("%s %s%s: status %d, want 200", route.method, route.prefix, id, got)
+			}
+		}
+	}
+	if got := status("DELETE", "/delete/%61bc/"); got != http.StatusOK {
+		t.Errorf("DELETE /delete/%%61bc/: status %d, want 200", got)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) { c.PathPrefix = "/uploads" })
+	// The helpers only use the URL, which now ends in the prefix
+	prefixed := &httptest.Server{URL: server.URL + "/uploads"}
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	request := func(method, path string, accept string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := noRedirects.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	status, body := uploadTestFile(t, prefixed, "notes.txt", []byte("content"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload below the prefix: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+	for field, want := range map[string]string{
+		"landing_url":  server.URL + "/uploads/f/" + id,
+		"download_url": server.URL + "/uploads/download/" + id,
+		"delete_url":   server.URL + "/uploads/delete/" + id,
+	} {
+		if body[field] != want {
+			t.Errorf("%s = %v, want %s", field, body[field], want)
+		}
+	}
+	if status, body := uploadTestFile(t, server, "notes.txt", []byte("content"), nil); status != http.StatusNotFound {
+		t.Errorf("upload at the root: status %d, body %v, want 404", status, body)
+	}
+
+	// Every route answers below the prefix and nowhere else
+	for _, route := range []string{
+		"/", "/manage", "/search", "/stats", "/info/" + id, "/f/" + id, "/download/" + id,
+		"/admin/files/" + id, "/login", "/api/files", "/api/files/" + id, "/api/tags",
+		"/api/health", "/api/changes", "/api/capabilities", "/api/admin/jobs",
+	} {
+		if resp, body := request("GET", "/uploads"+route, ""); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET /uploads%s: status %d, body %s", route, resp.StatusCode, body)
+		}
+		if resp, _ := request("GET", route, ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s outside the prefix: status %d, want 404", route, resp.StatusCode)
+		}
+	}
+	if resp, _ := request("GET", "/uploadsmanage", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("a path merely starting with the prefix: status %d", resp.StatusCode)
+	}
+
+	// The bare prefix redirects, keeping the query and a POST's method
+	if resp, _ := request("GET", "/uploads?tag=a", ""); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/uploads/?tag=a" {
+		t.Errorf("GET /uploads: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp, _ := request("POST", "/uploads", ""); resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != "/uploads/" {
+		t.Errorf("POST /uploads: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// Links, forms, redirects and Location headers carry the prefix
+	_, page := request("GET", "/uploads/manage", "text/html")
+	for _, want := range []string{
+		`action="/uploads/upload"`, `href="/uploads/download/` + id + `"`,
+		`action="/uploads/delete/` + id + `"`, `href="/uploads/admin/files/` + id + `"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("manage page lacks %s", want)
+		}
+	}
+	if _, page := request("GET", "/uploads/f/"+id, "text/html"); !strings.Contains(page, `href="`+server.URL+`/uploads/download/`+id+`"`) {
+		t.Errorf("share page lacks the prefixed download link:\n%s", page)
+	}
+	if _, page := request("GET", "/uploads/admin/files/"+id, "text/html"); !strings.Contains(page, `action="/uploads/api/admin/files/`+id+`/extend"`) {
+		t.Errorf("admin file page lacks the prefixed form actions")
+	}
+	if resp, _ := request("POST", "/uploads/api/admin/verify", ""); resp.StatusCode != http.StatusAccepted || !strings.HasPrefix(resp.Header.Get("Location"), "/uploads/api/admin/jobs/") {
+		t.Errorf("job Location %q", resp.Header.Get("Location"))
+	}
+	if resp, _ := request("POST", "/uploads/delete/"+id, "text/html"); resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/uploads/manage" {
+		t.Errorf("delete from the manage page: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestPathPrefixBaseURL(t *testing.T) {
+	for _, baseURL := range []string{"https://example.com", "https://example.com/uploads", "https://example.com/uploads/"} {
+		_, server := newTestServer(t, func(c *Config) {
+			c.PathPrefix = "/uploads"
+			c.BaseURL = baseURL
+		})
+		status, body := uploadTestFile(t, &httptest.Server{URL: server.URL + "/uploads"}, "a.txt", []byte("a"), nil)
+		if status != http.StatusOK {
+			t.Fatalf("upload: status %d, body %v", status, body)
+		}
+		if want := "https://example.com/uploads/f/" + body["id"].(string); body["landing_url"] != want {
+			t.Errorf("base_url %s: landing_url %v, want %s", baseURL, body["landing_url"], want)
+		}
+	}
+}
+
+func TestHealthAtRoot(t *testing.T) {
+	for _, atRoot := range []bool{false, true} {
+		_, server := newTestServer(t, func(c *Config) {
+			c.PathPrefix = "/uploads"
+			c.HealthAtRoot = atRoot
+		})
+		if status, _ := getJSON(t, server, "/uploads/api/health"); status != http.StatusOK {
+			t.Errorf("health_at_root %v: prefixed health status %d", atRoot, status)
+		}
+		want := http.StatusNotFound
+		if atRoot {
+			want = http.StatusOK
+		}
+		if status, _ := getJSON(t, server, "/api/health"); status != want {
+			t.Errorf("health_at_root %v: root health status %d, want %d", atRoot, status, want)
+		}
+		if status, _ := getJSON(t, server, "/api/files"); status != http.StatusNotFound {
+			t.Errorf("health_at_root %v: /api/files at the root answered %d", atRoot, status)
+		}
+	}
+}
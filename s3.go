@@ -0,0 +1,830 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The S3 gateway exposes a minimal, path-style S3 API under /s3/ so tools
+// such as rclone and awscli can use the service directly. Buckets map to
+// tags and object keys to original names; when several live files share a
+// key, the newest one is the object.
+
+const (
+	sigV4Algorithm           = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat          = "20060102T150405Z"
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptyPayloadHash         = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3MaxClockSkew           = 15 * time.Minute
+	s3MaxChunkSize           = 16 * 1024 * 1024
+	s3DefaultMaxKeys         = 1000
+)
+
+// s3ETagKey is the metadata key holding the MD5 of objects uploaded through
+// the gateway.
+const s3ETagKey = "s3_etag"
+
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+var (
+	errS3AccessDenied      = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3InvalidAccessKey  = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+	errS3SignatureMismatch = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errS3TimeSkewed        = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	errS3ExpiredRequest    = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errS3MalformedAuth     = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	errS3NoSuchKey         = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errS3TooLarge          = &s3Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size."}
+	errS3BadDigest         = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received."}
+	errS3MetadataTooLarge  = &s3Error{http.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size."}
+	errS3ContentSHA256     = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errS3IncompleteBody    = &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body is malformed or incomplete."}
+	errS3InvalidType       = &s3Error{http.StatusBadRequest, "InvalidArgument", "File type not allowed"}
+	errS3NotImplemented    = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	errS3MethodNotAllowed  = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errS3InternalError     = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+)
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, e *s3Error) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.Status)
+	if r.Method == "HEAD" {
+		return
+	}
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
+
+func writeS3XML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+// sigV4 holds what is needed to check the chunk signatures of a streaming
+// upload once the request itself has been authenticated.
+type sigV4 struct {
+	key         []byte
+	amzDate     string
+	scope       string
+	signature   string
+	payloadHash string
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsEscape applies the URI encoding SigV4 expects: everything but the
+// unreserved characters is percent-encoded, and '/' only when escapeSlash.
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		value := r.Host
+		if name != "host" {
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		b.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	return b.String()
+}
+
+// authenticateS3 verifies an AWS Signature Version 4 request, signed either
+// in the Authorization header or as a presigned URL, against s3_credentials.
+func (fm *FileManager) authenticateS3(r *http.Request) (*sigV4, *s3Error) {
+	query := r.URL.Query()
+
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" "); ok {
+		for _, field := range strings.Split(auth, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return nil, &s3Error{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+		}
+	} else if query.Get("X-Amz-Algorithm") == sigV4Algorithm {
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = unsignedPayload
+	} else {
+		return nil, errS3AccessDenied
+	}
+
+	// Credential is <access key>/<date>/<region>/s3/aws4_request
+	scopeParts := strings.Split(credential, "/")
+	if len(scopeParts) != 5 || scopeParts[3] != "s3" || scopeParts[4] != "aws4_request" ||
+		signedHeaders == "" || signature == "" {
+		return nil, errS3MalformedAuth
+	}
+	accessKey, date, region := scopeParts[0], scopeParts[1], scopeParts[2]
+
+	secret, ok := fm.config().S3Credentials[accessKey]
+	if !ok {
+		return nil, errS3InvalidAccessKey
+	}
+
+	signedAt, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, date) {
+		return nil, errS3MalformedAuth
+	}
+	if expires := query.Get("X-Amz-Expires"); expires != "" {
+		seconds, err := strconv.Atoi(expires)
+		if err != nil || time.Now().After(signedAt.Add(time.Duration(seconds)*time.Second)) {
+			return nil, errS3ExpiredRequest
+		}
+	} else if skew := time.Since(signedAt); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		return nil, errS3TimeSkewed
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		awsEscape(r.URL.Path, false),
+		canonicalQuery(query),
+		canonicalHeaders(r, strings.Split(signedHeaders, ";")),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join(scopeParts[1:], "/")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, errS3SignatureMismatch
+	}
+
+	return &sigV4{key: key, amzDate: amzDate, scope: scope, signature: signature, payloadHash: payloadHash}, nil
+}
+
+// chunkSignature signs one chunk of a STREAMING-AWS4-HMAC-SHA256-PAYLOAD body,
+// chained to the previous chunk's signature.
+func (s *sigV4) chunkSignature(previous string, chunk []byte) string {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm + "-PAYLOAD", s.amzDate, s.scope, previous, emptyPayloadHash, sha256Hex(chunk),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(s.key, stringToSign))
+}
+
+var (
+	errS3BadChunk       = errors.New("malformed aws-chunked body")
+	errS3ChunkSignature = errors.New("chunk signature mismatch")
+	errS3PayloadHash    = errors.New("payload hash mismatch")
+)
+
+// awsChunkedReader decodes an aws-chunked request body. When sig is set every
+// chunk signature is verified; trailers are read and discarded.
+type awsChunkedReader struct {
+	r       *bufio.Reader
+	sig     *sigV4
+	prevSig string
+	buf     []byte
+	done    bool
+}
+
+func newAWSChunkedReader(body io.Reader, sig *sigV4) *awsChunkedReader {
+	c := &awsChunkedReader{r: bufio.NewReader(body), sig: sig}
+	if sig != nil {
+		c.prevSig = sig.signature
+	}
+	return c
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *awsChunkedReader) nextChunk() error {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return errS3BadChunk
+	}
+	sizeHex, extension, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return errS3BadChunk
+	}
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(c.r, chunk); err != nil {
+		return errS3BadChunk
+	}
+
+	if c.sig != nil {
+		expected := c.sig.chunkSignature(c.prevSig, chunk)
+		signature, _ := strings.CutPrefix(extension, "chunk-signature=")
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return errS3ChunkSignature
+		}
+		c.prevSig = expected
+	}
+
+	if size == 0 {
+		// Skip trailers up to the terminating empty line
+		c.done = true
+		for {
+			line, err := c.r.ReadSlice('\n')
+			if err != nil || strings.TrimSpace(string(line)) == "" {
+				return nil
+			}
+		}
+	}
+
+	if crlf, err := c.r.ReadSlice('\n'); err != nil || string(crlf) != "\r\n" {
+		return errS3BadChunk
+	}
+	c.buf = chunk
+	return nil
+}
+
+// hashingReader hashes everything read through it.
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	return n, err
+}
+
+// s3Handler serves /s3/{bucket}/{key}, and ListBuckets on /s3 itself.
+func (fm *FileManager) s3Handler(w http.ResponseWriter, r *http.Request) {
+	sig, authErr := fm.authenticateS3(r)
+	if authErr != nil {
+		writeS3Error(w, r, authErr)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/s3"), "/"), "/")
+
+	// Sub-resources such as ?acl, ?uploads or ?tagging are not supported
+	for name := range r.URL.Query() {
+		switch name {
+		case "list-type", "prefix", "delimiter", "max-keys", "continuation-token",
+			"start-after", "marker", "encoding-type", "fetch-owner", "x-id":
+		default:
+			if !strings.HasPrefix(name, "X-Amz-") {
+				writeS3Error(w, r, errS3NotImplemented)
+				return
+			}
+		}
+	}
+
+	switch {
+	case bucket == "":
+		if r.Method != "GET" {
+			writeS3Error(w, r, errS3MethodNotAllowed)
+			return
+		}
+		fm.s3ListBuckets(w, r)
+	case key == "":
+		switch r.Method {
+		case "GET":
+			fm.s3ListObjects(w, r, bucket)
+		case "HEAD", "PUT":
+			// Buckets are tags, so they always exist and need no creating
+			w.WriteHeader(http.StatusOK)
+		default:
+			writeS3Error(w, r, errS3MethodNotAllowed)
+		}
+	default:
+		switch r.Method {
+		case "GET", "HEAD":
+			fm.s3GetObject(w, r, bucket, key)
+		case "PUT":
+			fm.s3PutObject(w, r, sig, bucket, key)
+		case "DELETE":
+			fm.s3DeleteObject(w, r, bucket, key)
+		default:
+			writeS3Error(w, r, errS3MethodNotAllowed)
+		}
+	}
+}
+
+// s3Objects returns the live objects in bucket keyed by object key, keeping
+// the newest file for each key. Callers must hold fm.mutex.
+func (fm *FileManager) s3Objects(bucket string) map[string]*FileInfo {
+	now := time.Now()
+	objects := make(map[string]*FileInfo)
+	for _, fileInfo := range fm.files {
+		if fileInfo.statusAt(now) != StatusActive || fileInfo.isLink() || !hasAnyTag(fileInfo.Tags, []string{bucket}) {
+			continue
+		}
+		if existing, ok := objects[fileInfo.OriginalName]; !ok || fileInfo.UploadTime.After(existing.UploadTime) {
+			objects[fileInfo.OriginalName] = fileInfo
+		}
+	}
+	return objects
+}
+
+// s3ETag is the MD5 recorded for gateway uploads. Files uploaded any other
+// way only have our own checksum, which is returned with its algorithm
+// spelled out so S3 clients don't mistake it for an MD5.
+func s3ETag(fileInfo *FileInfo) string {
+	if md5 := fileInfo.Metadata[s3ETagKey]; md5 != "" {
+		return `"` + md5 + `"`
+	}
+	algorithm := checksumAlgorithm(fileInfo.Checksum)
+	_, digest, found := strings.Cut(fileInfo.Checksum, ":")
+	if !found {
+		digest = fileInfo.Checksum
+	}
+	return `"` + algorithm + ":" + digest + `"`
+}
+
+// s3DownloadError maps the refusals of claimDownload to S3 errors. Signed
+// requests can't carry file, tag or recipient passwords, so files needing
+// one are denied.
+func s3DownloadError(err error) *s3Error {
+	switch {
+	case errors.Is(err, errPasswordRequired), errors.Is(err, errPasswordIncorrect),
+		errors.Is(err, errTagPasswordRequired), errors.Is(err, errRecipientRequired),
+		errors.Is(err, errRecipientCollected):
+		return errS3AccessDenied
+	}
+	return errS3NoSuchKey
+}
+
+// s3GetObject serves GetObject and HeadObject. GETs go through the same
+// checks and counting as /download, so a last allowed download removes the
+// file once it has been sent.
+func (fm *FileManager) s3GetObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	fm.mutex.RLock()
+	object, exists := fm.s3Objects(bucket)[normalizeName(key)]
+	fm.mutex.RUnlock()
+	if !exists {
+		writeS3Error(w, r, errS3NoSuchKey)
+		return
+	}
+
+	// HEAD and ranges resuming a download don't count, like on /download
+	resolveIfRange(r, s3ETag(object), object.UploadTime)
+	counted := r.Method == "GET" && rangeStartsDownload(r.Header.Get("Range"), object.Size)
+	var fileInfo *FileInfo
+	var last bool
+	var err error
+	if counted {
+		fileInfo, last, err = fm.claimDownload(object.ID, downloadCredentials{})
+	} else {
+		fileInfo, err = fm.checkDownload(object.ID, downloadCredentials{})
+	}
+	if err != nil {
+		if r.Method == "GET" {
+			fm.recordEvent(r, "download", nil, object.ID, downloadOutcome(err))
+		}
+		writeS3Error(w, r, s3DownloadError(err))
+		return
+	}
+
+	f, err := fm.openContent(fileInfo)
+	if err != nil {
+		if counted {
+			fm.finishDownload(fileInfo, false)
+		}
+		writeS3Error(w, r, errS3InternalError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("ETag", s3ETag(fileInfo))
+	w.Header().Set("Content-Type", fm.detectContentType(fileInfo))
+	if fileInfo.Checksum != "" {
+		w.Header().Set("X-Checksum", fileInfo.Checksum)
+	}
+	w.Header().Set("Expires", fileInfo.ExpiresAt.UTC().Format(http.TimeFormat))
+	for name, value := range fileInfo.Metadata {
+		if name != s3ETagKey {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+	}
+
+	// ServeContent handles Range, If-Range and conditional requests
+	http.ServeContent(w, r, "", fileInfo.UploadTime, f)
+	if r.Method == "HEAD" {
+		return
+	}
+	outcome := "ok"
+	if responseCut(w, r) {
+		fm.transfers.abortedDownloads.Add(1)
+		outcome = "aborted"
+	}
+	fm.recordEvent(r, "download", fileInfo, fileInfo.ID, outcome)
+	if counted {
+		// Persist the new count, or remove a file that is used up
+		fm.finishDownload(fileInfo, last && outcome == "ok")
+	}
+}
+
+func (fm *FileManager) s3PutObject(w http.ResponseWriter, r *http.Request, sig *sigV4, bucket, key string) {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		writeS3Error(w, r, errS3NotImplemented)
+		return
+	}
+
+	var body io.Reader
+	switch sig.payloadHash {
+	case streamingPayload:
+		body = newAWSChunkedReader(r.Body, sig)
+	case streamingUnsignedTrailer:
+		body = newAWSChunkedReader(r.Body, nil)
+	case unsignedPayload:
+		body = r.Body
+	default:
+		if len(sig.payloadHash) != sha256.Size*2 {
+			writeS3Error(w, r, errS3NotImplemented)
+			return
+		}
+		body = r.Body
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if !fm.typeAllowed(contentType) {
+		writeS3Error(w, r, errS3InvalidType)
+		return
+	}
+
+	metadata := make(map[string]string)
+	var metadataSize int
+	for name, values := range r.Header {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok && key != s3ETagKey {
+			if len(values) > 1 {
+				writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", name + " is repeated"})
+				return
+			}
+			metadata[key] = values[0]
+			metadataSize += len(key) + len(values[0])
+		}
+	}
+	if metadataSize > maxMetadataForm {
+		writeS3Error(w, r, errS3MetadataTooLarge)
+		return
+	}
+	tags := []string{bucket}
+	if violations := fm.validateMetadata(metadata, tags); len(violations) > 0 {
+		writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", strings.Join(violations, "; ")})
+		return
+	}
+
+	// Streaming uploads announce the decoded size in their own header
+	size := r.ContentLength
+	if body != r.Body {
+		size, _ = strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	}
+	reservation, err := fm.reserveStorage(size)
+	if err != nil {
+		writeS3Error(w, r, &s3Error{http.StatusRequestEntityTooLarge, "EntityTooLarge", err.Error()})
+		return
+	}
+	defer fm.releaseStorage(reservation)
+
+	md5Reader := &hashingReader{r: body, h: md5.New()}
+	shaReader := &hashingReader{r: md5Reader, h: sha256.New()}
+
+	fileInfo, err := fm.storeFile(r.Context(), shaReader, uploadRequest{
+		Filename:    key,
+		ContentType: contentType,
+		TTL:         fm.config().DefaultTTL,
+		TTLSource:   ttlDefault,
+		Tags:        tags,
+		Metadata:    metadata,
+		UploaderIP:  fm.clientIP(r),
+		UserAgent:   r.UserAgent(),
+		Reservation: reservation,
+	})
+	switch {
+	case errors.Is(err, errFileTooLarge):
+		writeS3Error(w, r, errS3TooLarge)
+		return
+	case isDiskFull(err), errors.Is(err, errStorageFull):
+		writeS3Error(w, r, &s3Error{http.StatusInsufficientStorage, "InsufficientStorage", "Insufficient storage to complete the request."})
+		return
+	case errors.Is(err, errS3ChunkSignature):
+		writeS3Error(w, r, errS3SignatureMismatch)
+		return
+	case errors.Is(err, errS3BadChunk):
+		writeS3Error(w, r, errS3IncompleteBody)
+		return
+	case errors.Is(err, errTypeMismatch), errors.Is(err, errTypeNotAllowed):
+		writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", err.Error()})
+		return
+	case errors.Is(err, errPathTooLong):
+		writeS3Error(w, r, &s3Error{http.StatusBadRequest, "KeyTooLongError", err.Error()})
+		return
+	case errors.Is(err, errBlockedContent):
+		writeS3Error(w, r, &s3Error{http.StatusForbidden, "AccessDenied", err.Error()})
+		return
+	case clientGone(r.Context(), err):
+		fm.transfers.abortedUploads.Add(1)
+		return
+	case err != nil:
+		writeS3Error(w, r, errS3InternalError)
+		return
+	}
+
+	md5Sum := md5Reader.h.Sum(nil)
+	if len(sig.payloadHash) == sha256.Size*2 && hex.EncodeToString(shaReader.h.Sum(nil)) != sig.payloadHash {
+		fm.removeFile(r, fileInfo.ID)
+		writeS3Error(w, r, errS3ContentSHA256)
+		return
+	}
+	if want := r.Header.Get("Content-MD5"); want != "" && want != base64.StdEncoding.EncodeToString(md5Sum) {
+		fm.removeFile(r, fileInfo.ID)
+		writeS3Error(w, r, errS3BadDigest)
+		return
+	}
+
+	// Overwrite semantics: the new file replaces older ones with this key
+	fm.mutex.Lock()
+	fileInfo.Metadata[s3ETagKey] = hex.EncodeToString(md5Sum)
+	var replaced []string
+	for id, other := range fm.files {
+		if id != fileInfo.ID && other.OriginalName == fileInfo.OriginalName && hasAnyTag(other.Tags, tags) {
+			replaced = append(replaced, id)
+		}
+	}
+	fm.mutex.Unlock()
+
+	for _, id := range replaced {
+		fm.removeFile(r, id)
+	}
+	fm.requestSave()
+
+	w.Header().Set("ETag", s3ETag(fileInfo))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (fm *FileManager) s3DeleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	fm.mutex.RLock()
+	var ids []string
+	for id, fileInfo := range fm.files {
+		if fileInfo.OriginalName == normalizeName(key) && hasAnyTag(fileInfo.Tags, []string{bucket}) {
+			ids = append(ids, id)
+		}
+	}
+	fm.mutex.RUnlock()
+
+	for _, id := range ids {
+		fm.removeFile(r, id)
+	}
+
+	// S3 reports success whether or not the key existed
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	IsTruncated           bool
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	Contents              []s3Object
+	CommonPrefixes        []s3Prefix
+}
+
+// s3ListObjects implements ListObjectsV2, and V1 for clients that still
+// default to it. Continuation tokens are the base64 of the last key returned.
+func (fm *FileManager) s3ListObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	maxKeys := s3DefaultMaxKeys
+	if m := query.Get("max-keys"); m != "" {
+		if parsed, err := strconv.Atoi(m); err == nil && parsed >= 0 && parsed < s3DefaultMaxKeys {
+			maxKeys = parsed
+		}
+	}
+
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.URLEncoding.DecodeString(token)
+			if err != nil {
+				writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"})
+				return
+			}
+			after = string(decoded)
+		}
+	}
+
+	fm.mutex.RLock()
+	objects := fm.s3Objects(bucket)
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := s3ListResult{
+		Name:      bucket,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+	seenPrefixes := make(map[string]bool)
+	lastKey := ""
+	count := 0
+	for _, key := range keys {
+		if key <= after {
+			continue
+		}
+
+		// Keys sharing a prefix up to the delimiter roll up into one entry
+		commonPrefix := ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if commonPrefix != "" && seenPrefixes[commonPrefix] {
+			continue
+		}
+
+		if count == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		count++
+
+		if commonPrefix != "" {
+			seenPrefixes[commonPrefix] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{Prefix: commonPrefix})
+			// Resume after every key under this prefix
+			lastKey = commonPrefix + "\U0010FFFF"
+			continue
+		}
+
+		fileInfo := objects[key]
+		result.Contents = append(result.Contents, s3Object{
+			Key:          key,
+			LastModified: fileInfo.UploadTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         s3ETag(fileInfo),
+			Size:         fileInfo.Size,
+			StorageClass: "STANDARD",
+		})
+		lastKey = key
+	}
+	fm.mutex.RUnlock()
+
+	if v2 {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		result.KeyCount = &count
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(lastKey))
+		}
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+		if result.IsTruncated {
+			result.NextMarker = lastKey
+		}
+	}
+
+	writeS3XML(w, result)
+}
+
+// s3ListBuckets lists every tag in use as a bucket.
+func (fm *FileManager) s3ListBuckets(w http.ResponseWriter, r *http.Request) {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+
+	fm.mutex.RLock()
+	created := make(map[string]time.Time)
+	for _, fileInfo := range fm.files {
+		for _, tag := range fileInfo.Tags {
+			if first, ok := created[tag]; !ok || fileInfo.UploadTime.Before(first) {
+				created[tag] = fileInfo.UploadTime
+			}
+		}
+	}
+	fm.mutex.RUnlock()
+
+	var buckets []bucket
+	for name, t := range created {
+		buckets = append(buckets, bucket{Name: name, CreationDate: t.UTC().Format("2006-01-02T15:04:05.000Z")})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+
+	writeS3XML(w, struct {
+		XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+		Owner   struct{ ID, DisplayName string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Buckets: buckets})
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// s3Get calls s3GetObject directly, past the signature check.
+func s3Get(fm *FileManager, method, bucket, key string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	fm.s3GetObject(rec, httptest.NewRequest(method, "/s3/"+bucket+"/"+key, nil), bucket, key)
+	return rec
+}
+
+func TestS3GetPersistsDownloadCount(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	status, uploaded := uploadTestFile(t, server, "report.txt", []byte("quarterly"), url.Values{"tags": {"reports"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+
+	changes := fm.persister.changes.Load()
+	if rec := s3Get(fm, "GET", "reports", "report.txt"); rec.Code != http.StatusOK || rec.Body.String() != "quarterly" {
+		t.Fatalf("GetObject: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	fm.mutex.RLock()
+	downloads := fm.files[id].Downloads
+	fm.mutex.RUnlock()
+	if downloads != 1 {
+		t.Fatalf("downloads = %d, want 1", downloads)
+	}
+	if fm.persister.changes.Load() == changes {
+		t.Fatal("GetObject counted a download without marking the metadata dirty")
+	}
+
+	// HeadObject doesn't count
+	if rec := s3Get(fm, "HEAD", "reports", "report.txt"); rec.Code != http.StatusOK {
+		t.Fatalf("HeadObject: status %d", rec.Code)
+	}
+	fm.mutex.RLock()
+	downloads = fm.files[id].Downloads
+	fm.mutex.RUnlock()
+	if downloads != 1 {
+		t.Fatalf("downloads after HEAD = %d, want 1", downloads)
+	}
+}
+
+func TestS3GetAppliesDownloadChecks(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	status, uploaded := uploadTestFile(t, server, "once.txt", []byte("single"), url.Values{"tags": {"b"}, "max_downloads": {"1"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+	if status, _ := uploadTestFile(t, server, "locked.txt", []byte("secret"), url.Values{"tags": {"b"}, "password": {"hunter2"}}); status != http.StatusOK {
+		t.Fatalf("upload of locked.txt: status %d", status)
+	}
+
+	if rec := s3Get(fm, "GET", "b", "once.txt"); rec.Code != http.StatusOK {
+		t.Fatalf("GetObject: status %d", rec.Code)
+	}
+	fm.mutex.RLock()
+	_, exists := fm.files[id]
+	fm.mutex.RUnlock()
+	if exists {
+		t.Fatal("file still registered after its last allowed S3 download")
+	}
+	if rec := s3Get(fm, "GET", "b", "once.txt"); rec.Code != http.StatusNotFound {
+		t.Fatalf("GetObject after the last download: status %d, want 404", rec.Code)
+	}
+	if rec := s3Get(fm, "GET", "b", "locked.txt"); rec.Code != http.StatusForbidden {
+		t.Fatalf("GetObject of a password-protected file: status %d, want 403", rec.Code)
+	}
+}
+
+const (
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3Secret    = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+)
+
+// s3Client signs requests the way SigV4 clients such as rclone do, written
+// out from the AWS documentation rather than with the gateway's helpers.
+type s3Client struct {
+	t      *testing.T
+	server string
+	secret string
+}
+
+func newS3Client(t *testing.T) (*FileManager, *s3Client) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.S3Credentials = map[string]string{testS3AccessKey: testS3Secret}
+	})
+	return fm, &s3Client{t: t, server: server.URL, secret: testS3Secret}
+}
+
+func s3Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds the SigV4 headers to req for payloadHash, returning the signing
+// key and signature for chunked bodies.
+func (c *s3Client) sign(req *http.Request, payloadHash string) (key []byte, scope, amzDate, signature string) {
+	now := time.Now().UTC()
+	amzDate = now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope = date + "/us-east-1/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var query []string
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			query = append(query, url.QueryEscape(name)+"="+strings.ReplaceAll(url.QueryEscape(value), "+", "%20"))
+		}
+	}
+	sort.Strings(query)
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(query, "&"),
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		payloadHash,
+	}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + s3Hash([]byte(canonical))
+
+	key = s3HMAC([]byte("AWS4"+c.secret), date)
+	for _, part := range []string{"us-east-1", "s3", "aws4_request"} {
+		key = s3HMAC(key, part)
+	}
+	signature = hex.EncodeToString(s3HMAC(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		testS3AccessKey, scope, signature))
+	return key, scope, amzDate, signature
+}
+
+// do sends a request signed over payloadHash, the SHA-256 of body when empty.
+func (c *s3Client) do(method, path string, body []byte, payloadHash string, header http.Header) (*http.Response, []byte) {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.server+path, bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if payloadHash == "" {
+		payloadHash = s3Hash(body)
+	}
+	c.sign(req, payloadHash)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, data
+}
+
+func (c *s3Client) list(query string) s3ListResult {
+	c.t.Helper()
+	resp, body := c.do("GET", "/s3/photos?"+query, nil, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("ListObjects?%s: status %d, body %s", query, resp.StatusCode, body)
+	}
+	var result s3ListResult
+	if err := xml.Unmarshal(body, &result); err != nil {
+		c.t.Fatal(err)
+	}
+	return result
+}
+
+func listedKeys(result s3ListResult) []string {
+	var keys []string
+	for _, object := range result.Contents {
+		keys = append(keys, object.Key)
+	}
+	return keys
+}
+
+func TestS3PutAndList(t *testing.T) {
+	_, c := newS3Client(t)
+
+	put := func(key string, content []byte, payloadHash string) string {
+		t.Helper()
+		sum := md5.Sum(content)
+		resp, body := c.do("PUT", "/s3/photos/"+key, content, payloadHash,
+			http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("PutObject %s: status %d, body %s", key, resp.StatusCode, body)
+		}
+		if etag := resp.Header.Get("ETag"); etag != `"`+hex.EncodeToString(sum[:])+`"` {
+			t.Errorf("PutObject %s: ETag %s, want the quoted MD5", key, etag)
+		}
+		return resp.Header.Get("ETag")
+	}
+	put("2024/a.txt", []byte("first version"), "")
+	put("2024/b.txt", []byte("unsigned payload"), "UNSIGNED-PAYLOAD")
+	put("readme.txt", []byte("read me"), "")
+	// Overwriting a key replaces the object rather than adding another
+	etag := put("2024/a.txt", []byte("second version"), "")
+
+	result := c.list("list-type=2")
+	if keys := listedKeys(result); !slices.Equal(keys, []string{"2024/a.txt", "2024/b.txt", "readme.txt"}) {
+		t.Fatalf("ListObjectsV2 keys %q", keys)
+	}
+	if object := result.Contents[0]; object.ETag != etag || object.Size != int64(len("second version")) {
+		t.Errorf("2024/a.txt listed as %+v, want the second version", object)
+	}
+	if result.KeyCount == nil || *result.KeyCount != 3 || result.IsTruncated {
+		t.Errorf("KeyCount %v, IsTruncated %v", result.KeyCount, result.IsTruncated)
+	}
+
+	result = c.list("list-type=2&delimiter=%2F")
+	if keys := listedKeys(result); !slices.Equal(keys, []string{"readme.txt"}) ||
+		len(result.CommonPrefixes) != 1 || result.CommonPrefixes[0].Prefix != "2024/" {
+		t.Errorf("delimited listing: keys %q, prefixes %v", keys, result.CommonPrefixes)
+	}
+	if keys := listedKeys(c.list("list-type=2&prefix=2024%2F")); !slices.Equal(keys, []string{"2024/a.txt", "2024/b.txt"}) {
+		t.Errorf("prefixed listing %q", keys)
+	}
+
+	// Paging one key at a time visits every key once
+	var paged []string
+	token := ""
+	for range 5 {
+		query := "list-type=2&max-keys=1"
+		if token != "" {
+			query += "&continuation-token=" + url.QueryEscape(token)
+		}
+		result := c.list(query)
+		paged = append(paged, listedKeys(result)...)
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if !slices.Equal(paged, []string{"2024/a.txt", "2024/b.txt", "readme.txt"}) {
+		t.Errorf("paged keys %q", paged)
+	}
+
+	resp, body := c.do("GET", "/s3/photos/2024/a.txt", nil, "", http.Header{"Range": {"bytes=0-5"}})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "second" {
+		t.Errorf("ranged GetObject: status %d, body %q", resp.StatusCode, body)
+	}
+
+	if resp, _ := c.do("DELETE", "/s3/photos/2024/a.txt", nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DeleteObject: status %d", resp.StatusCode)
+	}
+	resp, body = c.do("GET", "/s3/photos/2024/a.txt", nil, "", nil)
+	if resp.StatusCode != http.StatusNotFound || !bytes.Contains(body, []byte("<Code>NoSuchKey</Code>")) {
+		t.Errorf("GetObject after delete: status %d, body %s", resp.StatusCode, body)
+	}
+}
+
+func TestS3ChunkedPut(t *testing.T) {
+	_, c := newS3Client(t)
+	chunks := [][]byte{testContent(64 << 10), testContent(1000), {}}
+
+	body := func(tamper bool) []byte {
+		req, _ := http.NewRequest("PUT", c.server+"/s3/photos/chunked.bin", nil)
+		key, scope, amzDate, previous := c.sign(req, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+		var b bytes.Buffer
+		for _, chunk := range chunks {
+			stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256-PAYLOAD", amzDate, scope, previous, s3Hash(nil), s3Hash(chunk)}, "\n")
+			previous = hex.EncodeToString(s3HMAC(key, stringToSign))
+			if tamper && len(chunk) == 1000 {
+				chunk = bytes.ToUpper(chunk)
+			}
+			fmt.Fprintf(&b, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), previous, chunk)
+		}
+		req.Body = io.NopCloser(&b)
+		req.Header.Set("X-Amz-Decoded-Content-Length", fmt.Sprint(len(chunks[0])+len(chunks[1])))
+		req.Header.Set("Content-Encoding", "aws-chunked")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if want := map[bool]int{false: http.StatusOK, true: http.StatusForbidden}[tamper]; resp.StatusCode != want {
+			t.Fatalf("chunked PutObject (tampered %v): status %d, want %d, body %s", tamper, resp.StatusCode, want, data)
+		}
+		return data
+	}
+
+	body(false)
+	resp, content := c.do("GET", "/s3/photos/chunked.bin", nil, "", nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(content, append(slices.Clone(chunks[0]), chunks[1]...)) {
+		t.Errorf("GetObject of the chunked upload: status %d, %d bytes", resp.StatusCode, len(content))
+	}
+
+	// A chunk that doesn't match its signature fails the upload
+	if data := body(true); !bytes.Contains(data, []byte("<Code>SignatureDoesNotMatch</Code>")) {
+		t.Errorf("tampered chunk: %s", data)
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	_, c := newS3Client(t)
+
+	expect := func(what string, resp *http.Response, body []byte, status int, code string) {
+		t.Helper()
+		if resp.StatusCode != status || !bytes.Contains(body, []byte("<Code>"+code+"</Code>")) {
+			t.Errorf("%s: status %d, body %s, want %d %s", what, resp.StatusCode, body, status, code)
+		}
+	}
+
+	resp, err := http.Get(c.server + "/s3/photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	expect("unsigned request", resp, body, http.StatusForbidden, "AccessDenied")
+
+	c.secret = "wrong"
+	resp, body = c.do("GET", "/s3/photos", nil, "", nil)
+	expect("wrong secret", resp, body, http.StatusForbidden, "SignatureDoesNotMatch")
+	c.secret = testS3Secret
+
+	resp, body = c.do("GET", "/s3/photos?acl=", nil, "", nil)
+	expect("GetBucketAcl", resp, body, http.StatusNotImplemented, "NotImplemented")
+
+	resp, body = c.do("POST", "/s3/photos/a.txt", nil, "", nil)
+	expect("POST on an object", resp, body, http.StatusMethodNotAllowed, "MethodNotAllowed")
+
+	resp, body = c.do("PUT", "/s3/photos/a.txt", []byte("content"), s3Hash([]byte("other content")), nil)
+	expect("payload hash mismatch", resp, body, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+
+	resp, body = c.do("PUT", "/s3/photos/a.txt", []byte("content"), "", http.Header{"Content-Md5": {"1B2M2Y8AsgTpgAmY7PhCfg=="}})
+	expect("Content-MD5 mismatch", resp, body, http.StatusBadRequest, "BadDigest")
+
+	// Neither failed upload left an object behind
+	if keys := listedKeys(c.list("list-type=2")); len(keys) != 0 {
+		t.Errorf("objects after failed uploads: %q", keys)
+	}
+}
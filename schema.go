@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetadataField describes one allowed key in FileInfo.Metadata.
+type MetadataField struct {
+	Type        string   `json:"type"`              // string, int, number or bool
+	Pattern     string   `json:"pattern,omitempty"` // optional regexp the value must fully match
+	Required    bool     `json:"required"`
+	RequiredFor []string `json:"required_for_tags,omitempty"` // limit Required to files carrying one of these tags
+	Description string   `json:"description,omitempty"`
+}
+
+func (f MetadataField) validate(key string) error {
+	switch f.Type {
+	case "", "string", "int", "number", "bool":
+	default:
+		return fmt.Errorf("metadata_schema.%s: unknown type %q", key, f.Type)
+	}
+	if f.Pattern != "" {
+		if _, err := regexp.Compile(f.Pattern); err != nil {
+			return fmt.Errorf("metadata_schema.%s: invalid pattern: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// parseMetadata decodes the "metadata" form value, a JSON object of string
+// values. An empty value yields an empty map.
+func parseMetadata(raw string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if raw == "" {
+		return metadata, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &metadata); err != nil {
+		return nil, fmt.Errorf("metadata must be a JSON object of strings: %v", err)
+	}
+	return metadata, nil
+}
+
+// validateMetadata checks user-supplied metadata against the size limits and
+// the configured schema and returns every violation found. With no schema
+// configured any keys are accepted.
+func (fm *FileManager) validateMetadata(metadata map[string]string, tags []string) []string {
+	violations := fm.metadataLimitViolations(metadata)
+	schema := fm.config().MetadataSchema
+	if len(schema) == 0 {
+		return violations
+	}
+
+	for key, value := range metadata {
+		field, ok := schema[key]
+		if !ok {
+			violations = append(violations, fmt.Sprintf("%s: unknown key", key))
+			continue
+		}
+		if msg := checkMetadataValue(field, value); msg != "" {
+			violations = append(violations, fmt.Sprintf("%s: %s", key, msg))
+		}
+	}
+
+	for key, field := range schema {
+		if !field.Required {
+			continue
+		}
+		if _, ok := metadata[key]; ok {
+			continue
+		}
+		if len(field.RequiredFor) > 0 && !hasAnyTag(tags, field.RequiredFor) {
+			continue
+		}
+		violations = append(violations, fmt.Sprintf("%s: required", key))
+	}
+
+	sort.Strings(violations)
+	return violations
+}
+
+func checkMetadataValue(field MetadataField, value string) string {
+	switch field.Type {
+	case "int":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "must be an integer"
+		}
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "must be a number"
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "must be a boolean"
+		}
+	}
+
+	if field.Pattern != "" {
+		re := regexp.MustCompile("^(?:" + field.Pattern + ")$")
+		if !re.MatchString(value) {
+			return fmt.Sprintf("must match %s", field.Pattern)
+		}
+	}
+	return ""
+}
+
+func hasAnyTag(tags, wanted []string) bool {
+	for _, t := range tags {
+		for _, w := range wanted {
+			if strings.EqualFold(t, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeViolations reports metadata validation failures with 422.
+func writeViolations(w http.ResponseWriter, r *http.Request, violations []string) {
+	if wantsJSON(r) {
+		respondJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":      "metadata validation failed",
+			"violations": violations,
+		})
+		return
+	}
+	respondError(w, r, "Metadata validation failed:\n"+strings.Join(violations, "\n"), http.StatusUnprocessableEntity)
+}
+
+func (fm *FileManager) metadataSchema(w http.ResponseWriter, r *http.Request) {
+	schema := fm.config().MetadataSchema
+	if schema == nil {
+		schema = map[string]MetadataField{}
+	}
+	respondJSON(w, http.StatusOK, schema)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// minAdminPasswordLength is the shortest admin_password strict mode accepts.
+const minAdminPasswordLength = 12
+
+// commonPasswords are refused as admin_password in strict mode whatever
+// their length.
+var commonPasswords = []string{
+	"password", "password123", "admin", "administrator", "changeme", "secret",
+	"letmein", "qwerty", "123456", "12345678", "123456789012", "passw0rd",
+}
+
+var errUploadKeyRequired = errors.New("an API key is required to upload")
+
+// securityCheck is one item of the security report logged at startup.
+type securityCheck struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// securityChecks evaluates the settings that leave a server open to abuse
+// on the public Internet. With strict set, Validate refuses a configuration
+// that fails any of them; otherwise they are only reported.
+func (c Config) securityChecks() []securityCheck {
+	check := func(name string, passed bool, ok, problem string) securityCheck {
+		if passed {
+			return securityCheck{name, true, ok}
+		}
+		return securityCheck{name, false, problem}
+	}
+	credentials := "admin_password or admins must be set"
+	if c.AdminPassword != "" {
+		credentials = weakPassword(c.AdminPassword)
+	} else if len(c.Admins) > 0 {
+		credentials = ""
+	}
+	return []securityCheck{
+		check("require_password", c.RequirePassword,
+			"the management interface needs admin credentials",
+			"anyone can list, change and delete files"),
+		check("admin_credentials", credentials == "",
+			"admin credentials are set",
+			credentials),
+		check("allowed_origins", !slices.Contains(c.AllowedOrigins, "*"),
+			"CORS is limited to the configured origins",
+			`"*" lets any website call the API from a visitor's browser`),
+		check("max_file_size", c.MaxFileSize > 0,
+			fmt.Sprintf("uploads are limited to %s", formatBytes(c.MaxFileSize)),
+			"uploads of any size are accepted"),
+		check("max_total_size", c.MaxTotalSize > 0,
+			fmt.Sprintf("storage is limited to %s", formatBytes(c.MaxTotalSize)),
+			"uploads can fill the disk"),
+		check("delete_by_get", c.Strict,
+			"GET /delete/{id} is refused",
+			"GET /delete/{id} deletes files, so a link or prefetch can delete them"),
+		check("anonymous_uploads", c.Strict,
+			"uploads need an API key or admin credentials",
+			"anyone can upload without an API key"),
+	}
+}
+
+// weakPassword describes why password is too easy to guess for strict mode,
+// or returns "" when it isn't.
+func weakPassword(password string) string {
+	switch {
+	case len(password) < minAdminPasswordLength:
+		return fmt.Sprintf("admin_password is shorter than %d characters", minAdminPasswordLength)
+	case slices.Contains(commonPasswords, strings.ToLower(password)):
+		return "admin_password is a common password"
+	case strings.Count(password, password[:1]) == len(password):
+		return "admin_password repeats a single character"
+	}
+	return ""
+}
+
+// strictViolations lists the failed security checks, for Validate in strict
+// mode.
+func (c Config) strictViolations() error {
+	var failed []string
+	for _, check := range c.securityChecks() {
+		if !check.Passed {
+			failed = append(failed, check.Name+": "+check.Detail)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("strict mode: %s", strings.Join(failed, "; "))
+}
+
+// logSecurityReport logs the outcome of every security check at startup.
+// In strict mode they have all passed, as Validate checked them; otherwise
+// each failure is logged as a warning.
+func logSecurityReport(c Config) {
+	mode := "off"
+	if c.Strict {
+		mode = "on"
+	}
+	log.Printf("Security report (strict mode %s):", mode)
+	for _, check := range c.securityChecks() {
+		if check.Passed {
+			log.Printf("  ok       %s: %s", check.Name, check.Detail)
+		} else {
+			log.Printf("  WARNING  %s: %s", check.Name, check.Detail)
+		}
+	}
+}
+
+// warnOpenAdmin warns loudly at startup when API keys or admin users are
+// set up while require_password is off: they suggest the admin routes are
+// guarded, but every one of them answers anyone.
+func (fm *FileManager) warnOpenAdmin() {
+	if fm.config().RequirePassword {
+		return
+	}
+	fm.apiKeys.mutex.Lock()
+	keys := len(fm.apiKeys.keys)
+	fm.apiKeys.mutex.Unlock()
+	fm.adminUsers.mutex.Lock()
+	users := len(fm.adminUsers.users)
+	fm.adminUsers.mutex.Unlock()
+	if keys == 0 && users == 0 {
+		return
+	}
+	log.Printf("WARNING: %d API keys and %d admin users are set up, but require_password is off. "+
+		"Every /api/admin route, including keys, users, config and backups, is open to anyone; "+
+		`set "require_password": true`, keys, users)
+}
+
+// requireUploadKey refuses uploads without an API key or admin credentials
+// in strict mode, answering the request itself. key is what authorizeKey
+// returned.
+func (fm *FileManager) requireUploadKey(w http.ResponseWriter, r *http.Request, key *APIKey) bool {
+	if key != nil || !fm.config().Strict || fm.hasAdminCredentials(r) {
+		return true
+	}
+	respondError(w, r, errUploadKeyRequired.Error(), http.StatusUnauthorized)
+	return false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+)
+
+// Ways of handing the transfer of a download to the fronting web server.
+const (
+	sendfileNone      = "none"
+	sendfileXAccel    = "x-accel"    // nginx
+	sendfileXSendfile = "x-sendfile" // Apache mod_xsendfile, lighttpd
+)
+
+// offloadDownload hands the body of a download to the reverse proxy by
+// answering with an internal-redirect header instead of the content. It only
+// does so for requests that came through a trusted proxy, since anything
+// else would receive an empty response; otherwise it returns false and the
+// caller streams the file itself, as it does for files in cold storage,
+// which the proxy can't see. The proxy serves ranges and HEAD requests.
+func (fm *FileManager) offloadDownload(w http.ResponseWriter, r *http.Request, fileInfo *FileInfo) bool {
+	mode := fm.config().SendfileMode
+	if mode == "" || mode == sendfileNone || fileInfo.tier() == tierCold || !fm.isTrustedProxy(r) {
+		return false
+	}
+
+	switch mode {
+	case sendfileXAccel:
+		location := path.Join("/", fm.config().SendfileLocation, fileInfo.StorageKey)
+		w.Header().Set("X-Accel-Redirect", (&url.URL{Path: location}).EscapedPath())
+	case sendfileXSendfile:
+		abs, err := filepath.Abs(fm.filePath(fileInfo))
+		if err != nil {
+			return false
+		}
+		w.Header().Set("X-Sendfile", abs)
+	default:
+		return false
+	}
+	w.WriteHeader(http.StatusOK)
+	return true
+}
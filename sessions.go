@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionCookie carries the token of an admin signed in through /login.
+const sessionCookie = "uploads_session"
+
+// adminSession is a signed-in admin. Sessions live in memory only, so a
+// restart signs everyone out. secret is what the admin signed in with, the
+// user's password hash or the SHA-256 of admin_password, so that changing
+// it, like removing the user, ends their sessions.
+type adminSession struct {
+	username string // empty for admin_password
+	secret   string
+	expires  time.Time
+}
+
+// adminSessionStore holds the sessions by the SHA-256 of their token, so
+// the tokens themselves are never kept.
+type adminSessionStore struct {
+	mutex    sync.Mutex
+	sessions map[[sha256.Size]byte]adminSession
+}
+
+func (s *adminSessionStore) create(session adminSession) string {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[[sha256.Size]byte]adminSession)
+	}
+	now := time.Now()
+	for key, existing := range s.sessions {
+		if now.After(existing.expires) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[sha256.Sum256([]byte(token))] = session
+	return token
+}
+
+func (s *adminSessionStore) get(token string) (adminSession, bool) {
+	key := sha256.Sum256([]byte(token))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, ok := s.sessions[key]
+	if ok && time.Now().After(session.expires) {
+		delete(s.sessions, key)
+		return adminSession{}, false
+	}
+	return session, ok
+}
+
+func (s *adminSessionStore) remove(token string) {
+	s.mutex.Lock()
+	delete(s.sessions, sha256.Sum256([]byte(token)))
+	s.mutex.Unlock()
+}
+
+// sessionSecret returns what a session of username must still match, or ""
+// when they can't sign in any more.
+func (fm *FileManager) sessionSecret(username string) string {
+	config := fm.config()
+	if username == "" {
+		if config.AdminPassword == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(config.AdminPassword))
+		return base64.RawStdEncoding.EncodeToString(sum[:])
+	}
+	s := &fm.adminUsers
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if user, exists := s.lookup(config, username); exists {
+		return user.PasswordHash
+	}
+	return ""
+}
+
+// sessionAdmin returns the admin whose session cookie r carries, or nil.
+func (fm *FileManager) sessionAdmin(r *http.Request) *AdminUser {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	session, ok := fm.adminSessions.get(cookie.Value)
+	if !ok {
+		return nil
+	}
+	if secret := fm.sessionSecret(session.username); secret == "" || secret != session.secret {
+		fm.adminSessions.remove(cookie.Value)
+		return nil
+	}
+	if session.username == "" {
+		return &passwordAdmin
+	}
+	s := &fm.adminUsers
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, _ := s.lookup(fm.config(), session.username)
+	view := *user
+	view.PasswordHash = ""
+	return &view
+}
+
+// checkLogin returns the admin that username and password sign in as, or
+// nil. As with Basic auth, admin_password signs in with any username.
+func (fm *FileManager) checkLogin(username, password string) *AdminUser {
+	if user := fm.adminUsers.verify(fm.config(), username, password); user != nil {
+		return user
+	}
+	if fm.adminPasswordMatches(password) {
+		return &passwordAdmin
+	}
+	return nil
+}
+
+// loginThrottled reports whether the client IP has failed to sign in
+// login_rate_limit times this minute, and if so, for how much longer it is
+// turned away.
+func (fm *FileManager) loginThrottled(r *http.Request) (bool, time.Duration) {
+	limit := fm.config().LoginRateLimit
+	if limit == 0 {
+		return false, 0
+	}
+	return fm.loginLimiter.exhausted(fm.clientIP(r), limit, time.Now())
+}
+
+// loginAllowed writes 429 and returns false when the client IP is throttled.
+func (fm *FileManager) loginAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if throttled, retry := fm.loginThrottled(r); throttled {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		respondError(w, r, "Too many failed logins", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// loginFailed counts a failed sign-in against the client IP.
+func (fm *FileManager) loginFailed(r *http.Request) {
+	if limit := fm.config().LoginRateLimit; limit > 0 {
+		ip := fm.clientIP(r)
+		if ok, _ := fm.loginLimiter.allow(ip, limit, time.Now()); !ok {
+			log.Printf("Too many failed logins from %s", ip)
+		}
+	}
+}
+
+// loginNext returns the route to return to after signing in: the next
+// parameter when it is one of our paths, /manage otherwise.
+func loginNext(r *http.Request) string {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/manage"
+	}
+	return next
+}
+
+// loginRedirect sends a browser that isn't signed in to /login, to come back
+// to the page it asked for.
+func (fm *FileManager) loginRedirect(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Path
+	if r.URL.RawQuery != "" {
+		next += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, fm.appPath("/login?next="+url.QueryEscape(next)), http.StatusSeeOther)
+}
+
+// login handles /login: GET shows the sign-in form and POST checks the
+// username and password, then sets a session cookie valid for
+// admin_session_ttl and redirects to next.
+func (fm *FileManager) login(w http.ResponseWriter, r *http.Request) {
+	page := loginPage{Next: loginNext(r)}
+	switch r.Method {
+	case "GET", "HEAD":
+		respondHTML(w, http.StatusOK, loginTemplate, page)
+		return
+	case "POST":
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !fm.loginAllowed(w, r) {
+		return
+	}
+
+	username := r.FormValue("username")
+	admin := fm.checkLogin(username, r.FormValue("password"))
+	if admin == nil {
+		fm.loginFailed(r)
+		log.Printf("Failed login as %q from %s", username, fm.clientIP(r))
+		if wantsHTML(r) {
+			page.Username, page.Error = username, "Incorrect username or password"
+			respondHTML(w, http.StatusUnauthorized, loginTemplate, page)
+			return
+		}
+		respondError(w, r, "Incorrect username or password", http.StatusUnauthorized)
+		return
+	}
+
+	session := adminSession{expires: time.Now().Add(fm.config().AdminSessionTTL)}
+	if admin != &passwordAdmin {
+		session.username = admin.Username
+	}
+	session.secret = fm.sessionSecret(session.username)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    fm.adminSessions.create(session),
+		Path:     fm.appPath("/"),
+		Expires:  session.expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(fm.baseURL(r), "https://"),
+		SameSite: http.SameSiteStrictMode,
+	})
+	fm.activity.record(ActivityEvent{Type: "login", Actor: fm.clientIP(r), User: admin.Username, UserAgent: r.UserAgent(), Outcome: "ok"})
+
+	if wantsJSON(r) {
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"username":   admin.Username,
+			"role":       admin.Role,
+			"expires_at": session.expires,
+		})
+		return
+	}
+	http.Redirect(w, r, fm.appPath(page.Next), http.StatusSeeOther)
+}
+
+// logout handles POST /logout, ending the session of the cookie.
+func (fm *FileManager) logout(w http.ResponseWriter, r *http.Request) {
+	// A GET could sign admins out from a link or image on any page
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		fm.adminSessions.remove(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: fm.appPath("/"), MaxAge: -1, HttpOnly: true})
+	if wantsJSON(r) {
+		respondJSON(w, http.StatusOK, map[string]string{"status": "signed_out"})
+		return
+	}
+	http.Redirect(w, r, fm.appPath("/login"), http.StatusSeeOther)
+}
+
+type loginPage struct {
+	Next     string
+	Username string
+	Error    string
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>Sign in</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; background: #f5f5f5; }
+        .container { max-width: 400px; margin: 40px auto; background: white; padding: 30px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); }
+        h1 { color: #007bff; font-size: 1.5em; }
+        .error { color: #dc3545; margin: 15px 0; }
+        .form-group { margin: 15px 0; }
+        input[type=text], input[type=password] { width: 100%; padding: 8px; border: 1px solid #ddd; border-radius: 4px; box-sizing: border-box; }
+        .btn { background: #007bff; color: white; padding: 12px 24px; border: none; border-radius: 4px; cursor: pointer; font-size: 1em; }
+        .btn:hover { background: #0056b3; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>Sign in</h1>
+        {{with .Error}}<div class="error">{{.}}</div>{{end}}
+        <form method="post">
+            <input type="hidden" name="next" value="{{.Next}}">
+            <div class="form-group"><input type="text" name="username" value="{{.Username}}" placeholder="Username" autocomplete="username"></div>
+            <div class="form-group"><input type="password" name="password" placeholder="Password" autocomplete="current-password" required></div>
+            <input type="submit" value="Sign in" class="btn">
+        </form>
+    </div>
+</body>
+</html>
+`))
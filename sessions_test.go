@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLogoutRequiresPost(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) {
+		c.RequirePassword = true
+		c.AdminPassword = "secret"
+	})
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	resp, err := client.PostForm(server.URL+"/login", url.Values{"username": {"admin"}, "password": {"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var session *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookie {
+			session = cookie
+		}
+	}
+	if session == nil {
+		t.Fatalf("login: status %d, no session cookie", resp.StatusCode)
+	}
+	signedIn := func() bool {
+		req, _ := http.NewRequest("GET", server.URL+"/stats", nil)
+		req.AddCookie(session)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+	if !signedIn() {
+		t.Fatal("session cookie not accepted")
+	}
+
+	// A link or image elsewhere can't end the session
+	req, _ := http.NewRequest("GET", server.URL+"/logout", nil)
+	req.AddCookie(session)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "POST" {
+		t.Errorf("GET /logout: status %d, Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	if !signedIn() {
+		t.Fatal("GET /logout ended the session")
+	}
+
+	req, _ = http.NewRequest("POST", server.URL+"/logout", strings.NewReader(""))
+	req.AddCookie(session)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("POST /logout: status %d", resp.StatusCode)
+	}
+	if signedIn() {
+		t.Error("session still valid after POST /logout")
+	}
+}
+
+func TestAdminsNeedRequirePassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := defaultConfig()
+	config.Admins = []AdminUser{{Username: "alice", PasswordHash: string(hash), Role: roleOwner}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "require_password") {
+		t.Errorf("admins without require_password: %v, want it refused", err)
+	}
+	config.RequirePassword = true
+	if err := config.Validate(); err != nil {
+		t.Errorf("admins with require_password: %v", err)
+	}
+}
+
+func TestOpenAdminWarning(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, requirePassword := range []bool{false, true} {
+		logged.Reset()
+		fm := NewTestFileManager(func(c *Config) {
+			c.RequirePassword = requirePassword
+			c.AdminPassword = "secret"
+		})
+		fm.apiKeys.mutex.Lock()
+		fm.apiKeys.keys[hashAPIKey("upk_ci")] = &APIKey{ID: "ci", Scopes: []string{scopeUpload}}
+		fm.apiKeys.mutex.Unlock()
+		fm.warnOpenAdmin()
+		fm.Close()
+
+		warned := strings.Contains(logged.String(), "WARNING: 1 API keys and 0 admin users are set up, but require_password is off")
+		if warned == requirePassword {
+			t.Errorf("require_password %v: warned %v, log:\n%s", requirePassword, warned, logged.String())
+		}
+	}
+}
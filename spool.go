@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// archiveSpool keeps generated archives on disk for a while so a client
+// whose download broke off can resume it with a Range request instead of
+// starting over. Archives are deterministic, so an entry is keyed by what
+// went into it and a rebuilt spool file has the same bytes and ETag.
+type archiveSpool struct {
+	mutex   sync.Mutex
+	dir     string
+	entries map[string]*spoolEntry
+	size    int64 // bytes reserved by all entries, including ones being built
+}
+
+type spoolEntry struct {
+	path     string
+	size     int64
+	ready    bool
+	lastUsed time.Time
+}
+
+// newArchiveSpool prepares <dir>/uploads-archive-spool, dropping spool files
+// left by a previous run. An empty dir means the system temp directory.
+func newArchiveSpool(dir string) (*archiveSpool, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	dir = filepath.Join(dir, "uploads-archive-spool")
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &archiveSpool{dir: dir, entries: make(map[string]*spoolEntry)}, nil
+}
+
+// open returns the finished spool file for key, or nil.
+func (s *archiveSpool) open(key string) *os.File {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || !entry.ready {
+		return nil
+	}
+	f, err := os.Open(entry.path)
+	if err != nil {
+		return nil
+	}
+	entry.lastUsed = time.Now()
+	return f
+}
+
+// reserve claims size bytes of the budget for building the archive key.
+// It fails when the budget is used up or another request is building the
+// same archive; the caller then streams the archive instead.
+func (s *archiveSpool) reserve(key string, size, budget int64) (*spoolEntry, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.entries[key]; exists {
+		return nil, false
+	}
+	if budget > 0 && s.size+size > budget {
+		return nil, false
+	}
+	entry := &spoolEntry{
+		path:     filepath.Join(s.dir, key+".zip"),
+		size:     size,
+		lastUsed: time.Now(),
+	}
+	s.entries[key] = entry
+	s.size += size
+	return entry, true
+}
+
+// finish marks a built archive as servable, accounting for its actual size.
+func (s *archiveSpool) finish(key string, entry *spoolEntry, size int64) {
+	s.mutex.Lock()
+	s.size += size - entry.size
+	entry.size = size
+	entry.ready = true
+	s.mutex.Unlock()
+}
+
+// abort releases a reservation whose archive couldn't be built.
+func (s *archiveSpool) abort(key string, entry *spoolEntry) {
+	s.mutex.Lock()
+	if s.entries[key] == entry {
+		delete(s.entries, key)
+		s.size -= entry.size
+	}
+	s.mutex.Unlock()
+	os.Remove(entry.path)
+}
+
+// prune deletes spool files unused for longer than ttl.
+func (s *archiveSpool) prune(ttl time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, entry := range s.entries {
+		if entry.ready && time.Since(entry.lastUsed) > ttl {
+			if err := removeContent(entry.path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error deleting spooled archive %s: %v", entry.path, err)
+			}
+			delete(s.entries, key)
+			s.size -= entry.size
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// statFilesystem reports free and total space and inodes of the filesystem
+// holding dir.
+func statFilesystem(dir string) (FilesystemUsage, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return FilesystemUsage{}, false
+	}
+	return FilesystemUsage{
+		BytesFree:   uint64(st.Bavail) * uint64(st.Bsize),
+		BytesTotal:  uint64(st.Blocks) * uint64(st.Bsize),
+		InodesFree:  uint64(st.Ffree),
+		InodesTotal: uint64(st.Files),
+	}, true
+}
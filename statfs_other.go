@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+// statFilesystem is not available on this platform; free space and inodes
+// are then only noticed when a write fails.
+func statFilesystem(dir string) (FilesystemUsage, bool) {
+	return FilesystemUsage{}, false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// FileStatus is the lifecycle state of a stored file. It is always derived
+// from the file's fields, never stored, so every code path agrees on it.
+type FileStatus string
+
+const (
+	StatusActive       FileStatus = "active"
+	StatusExpired      FileStatus = "expired"
+	StatusLimitReached FileStatus = "limit_reached"
+	// StatusLimitGrace is a file at its download limit that is kept until
+	// GraceUntil (post_limit_grace), so an admin can still raise the limit.
+	StatusLimitGrace FileStatus = "limit_reached_grace"
+)
+
+// validStatus reports whether s names a known status, for use in filters.
+func validStatus(s string) bool {
+	switch FileStatus(s) {
+	case StatusActive, StatusExpired, StatusLimitReached, StatusLimitGrace:
+		return true
+	}
+	return false
+}
+
+// Status returns the file's current state. Expiry takes precedence over the
+// download limit, except for files shared with recipients: they don't expire
+// while a recipient has yet to collect them, and are used up once all have.
+func (f *FileInfo) Status() FileStatus {
+	return f.statusAt(time.Now())
+}
+
+func (f *FileInfo) statusAt(now time.Time) FileStatus {
+	switch {
+	case f.hasRecipients() && f.collectedCount() < len(f.Recipients):
+		return StatusActive
+	case now.After(f.ExpiresAt):
+		return StatusExpired
+	case f.hasRecipients(), f.MaxDownloads > 0 && f.Downloads >= f.MaxDownloads:
+		if f.GraceUntil != nil && now.Before(*f.GraceUntil) {
+			return StatusLimitGrace
+		}
+		return StatusLimitReached
+	default:
+		return StatusActive
+	}
+}
+
+// storedFileInfo is FileInfo as written to the metadata file, without the
+// derived fields added by MarshalJSON.
+type storedFileInfo FileInfo
+
+// MarshalJSON adds the derived status to the serialized file and reports the
+// effective content type. The download password, uploader address and
+// storage path are left out; adminFileInfo adds the uploader address back.
+func (f FileInfo) MarshalJSON() ([]byte, error) {
+	return f.marshalView(false)
+}
+
+func (f FileInfo) marshalView(admin bool) ([]byte, error) {
+	stored := storedFileInfo(f)
+	stored.ContentType = f.effectiveContentType()
+	var uploaderIP *string
+	if admin {
+		uploaderIP = &f.UploaderIP
+	}
+	// The outer fields shadow the stored ones of the same name
+	return json.Marshal(struct {
+		storedFileInfo
+		Password   *string    `json:"password,omitempty"`
+		UploaderIP *string    `json:"uploader_ip,omitempty"`
+		StorageKey *string    `json:"path,omitempty"`
+		Protected  bool       `json:"password_protected,omitempty"`
+		Status     FileStatus `json:"status"`
+		Collected  string     `json:"collected,omitempty"`
+	}{
+		storedFileInfo: stored,
+		UploaderIP:     uploaderIP,
+		Protected:      f.Password != "",
+		Status:         f.Status(),
+		Collected:      f.collectionStatus(),
+	})
+}
+
+// adminFileInfo is a file as admins see it in API responses, with the
+// uploader's address.
+type adminFileInfo FileInfo
+
+func (f adminFileInfo) MarshalJSON() ([]byte, error) {
+	return FileInfo(f).marshalView(true)
+}
+
+// fileView returns fileInfo as r may see it: as an adminFileInfo when r
+// carries admin credentials.
+func (fm *FileManager) fileView(r *http.Request, fileInfo *FileInfo) interface{} {
+	if fm.hasAdminCredentials(r) {
+		return (*adminFileInfo)(fileInfo)
+	}
+	return fileInfo
+}
+
+// fileViews is fileView for a list of files.
+func (fm *FileManager) fileViews(r *http.Request, files []*FileInfo) interface{} {
+	if fm.hasAdminCredentials(r) {
+		return adminViews(files)
+	}
+	return files
+}
+
+func adminViews(files []*FileInfo) []*adminFileInfo {
+	views := make([]*adminFileInfo, len(files))
+	for i, fileInfo := range files {
+		views[i] = (*adminFileInfo)(fileInfo)
+	}
+	return views
+}
+
+// statusFilter reads the optional status= query parameter. It answers the
+// request itself and returns false when the value is unknown.
+func statusFilter(w http.ResponseWriter, r *http.Request) (FileStatus, bool) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !validStatus(status) {
+		respondError(w, r, "Unknown status: "+status, http.StatusBadRequest)
+		return "", false
+	}
+	return FileStatus(status), true
+}
+
+// showExpired reports whether a listing should include files that have
+// expired but not yet been removed by cleanup. They are hidden by default so
+// listings don't change when the cleanup timer fires; admins can ask for them
+// with include_expired=true.
+func (fm *FileManager) showExpired(r *http.Request) bool {
+	return r.URL.Query().Get("include_expired") == "true" && fm.hasAdminCredentials(r)
+}
+
+// expireFile unregisters a file that is no longer downloadable and reports
+// whether it was still registered, so concurrent removals act only once. It
+// is shared by cleanup and the lazy removal on download so both leave the
+// same trail. Callers must hold fm.mutex, and call deleteExpiredContent
+// after releasing it.
+func (fm *FileManager) expireFile(fileID string, fileInfo *FileInfo, status FileStatus) bool {
+	if fm.files[fileID] != fileInfo {
+		return false
+	}
+	delete(fm.files, fileID)
+	fm.bury(fileID, fileInfo, string(status))
+	fm.recordChange(changeExpired, fileID, fileInfo)
+	log.Printf("Cleaned up file: %s (reason: %s)", fileInfo.Filename, status)
+	fm.recordEvent(nil, "expire", fileInfo, fileID, string(status))
+	return true
+}
+
+// finishDownload records a counted download: it persists the new count, or
+// removes the file right away when the download was the last one allowed
+// and has been served, rather than at the next cleanup run. A file whose
+// limit an admin raised in the meantime is kept.
+func (fm *FileManager) finishDownload(fileInfo *FileInfo, last bool) {
+	if !last {
+		fm.persistDownload(fileInfo)
+		return
+	}
+	fm.mutex.Lock()
+	removed := fileInfo.Status() == StatusLimitReached && fm.expireFile(fileInfo.ID, fileInfo, StatusLimitReached)
+	fm.mutex.Unlock()
+	if !removed {
+		fm.persistDownload(fileInfo)
+		return
+	}
+	fm.deleteExpiredContent(fileInfo)
+	fm.requestSave()
+}
+
+func (fm *FileManager) deleteExpiredContent(fileInfo *FileInfo) {
+	if err := fm.deleteStoredFile(fileInfo); err != nil {
+		log.Printf("Error deleting file %s: %v", fileInfo.StorageKey, err)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"uploads/uploadspb"
+)
+
+func TestStatusMatrix(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	pending := []Recipient{{}, {}}
+	partly := []Recipient{{Collected: &past}, {}}
+	collected := []Recipient{{Collected: &past}, {Collected: &past}}
+
+	tests := []struct {
+		name string
+		file FileInfo
+		want FileStatus
+	}{
+		{"fresh", FileInfo{ExpiresAt: future}, StatusActive},
+		{"unlimited downloads", FileInfo{ExpiresAt: future, Downloads: 100}, StatusActive},
+		{"below the limit", FileInfo{ExpiresAt: future, MaxDownloads: 3, Downloads: 2}, StatusActive},
+		{"at the limit", FileInfo{ExpiresAt: future, MaxDownloads: 3, Downloads: 3}, StatusLimitReached},
+		{"past the limit", FileInfo{ExpiresAt: future, MaxDownloads: 3, Downloads: 4}, StatusLimitReached},
+		{"in grace", FileInfo{ExpiresAt: future, MaxDownloads: 1, Downloads: 1, GraceUntil: &future}, StatusLimitGrace},
+		{"grace over", FileInfo{ExpiresAt: future, MaxDownloads: 1, Downloads: 1, GraceUntil: &past}, StatusLimitReached},
+		{"grace without the limit", FileInfo{ExpiresAt: future, GraceUntil: &future}, StatusActive},
+		{"expired", FileInfo{ExpiresAt: past}, StatusExpired},
+		{"expired at the limit", FileInfo{ExpiresAt: past, MaxDownloads: 1, Downloads: 1}, StatusExpired},
+		{"expired in grace", FileInfo{ExpiresAt: past, MaxDownloads: 1, Downloads: 1, GraceUntil: &future}, StatusExpired},
+		{"expires exactly now", FileInfo{ExpiresAt: now}, StatusActive},
+		{"recipients pending", FileInfo{ExpiresAt: future, Recipients: pending}, StatusActive},
+		{"recipients pending past expiry", FileInfo{ExpiresAt: past, Recipients: partly}, StatusActive},
+		{"recipients pending past the limit", FileInfo{ExpiresAt: future, MaxDownloads: 1, Downloads: 1, Recipients: pending}, StatusActive},
+		{"recipients collected", FileInfo{ExpiresAt: future, Recipients: collected}, StatusLimitReached},
+		{"recipients collected in grace", FileInfo{ExpiresAt: future, Recipients: collected, GraceUntil: &future}, StatusLimitGrace},
+		{"recipients collected past expiry", FileInfo{ExpiresAt: past, Recipients: collected}, StatusExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.file.statusAt(now); got != tt.want {
+				t.Errorf("statusAt = %q, want %q", got, tt.want)
+			}
+			if !validStatus(string(tt.want)) {
+				t.Errorf("validStatus(%q) = false", tt.want)
+			}
+		})
+	}
+	if validStatus("trashed") {
+		t.Error(`validStatus("trashed") = true`)
+	}
+}
+
+func TestStatusInJSON(t *testing.T) {
+	for _, fileInfo := range []*FileInfo{
+		{ExpiresAt: time.Now().Add(time.Hour)},
+		{ExpiresAt: time.Now().Add(-time.Hour)},
+		{ExpiresAt: time.Now().Add(time.Hour), MaxDownloads: 1, Downloads: 1},
+	} {
+		data, err := json.Marshal(fileInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct{ Status FileStatus }
+		json.Unmarshal(data, &decoded)
+		if want := fileInfo.Status(); decoded.Status != want {
+			t.Errorf("status in %s = %q, want %q", data, decoded.Status, want)
+		}
+	}
+}
+
+func TestExpiredHiddenBeforeCleanup(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.AdminPassword = "secret"
+		// Cached totals may lag by up to stats_max_staleness, see
+		// aggregates.go
+		c.StatsMaxStaleness = 0
+	})
+	store := func(name string, expiresAt time.Time) string {
+		t.Helper()
+		fileInfo, err := fm.storeFile(t.Context(), strings.NewReader(name), uploadRequest{
+			Filename: name, TTL: time.Hour, TTLSource: ttlDefault,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fm.mutex.Lock()
+		fileInfo.ExpiresAt = expiresAt
+		fm.mutex.Unlock()
+		return fileInfo.ID
+	}
+	alive := store("alive.txt", time.Now().Add(time.Hour))
+	expiresAt := time.Now().Add(time.Second)
+	boundary := store("boundary.txt", expiresAt)
+
+	get := func(path string, admin bool) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("Accept", "application/json")
+		if admin {
+			req.Header.Set("Authorization", "Bearer secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	totalFiles := func(admin bool, query string) int {
+		t.Helper()
+		var stats UploadStats
+		json.Unmarshal([]byte(get("/stats"+query, admin)), &stats)
+		return stats.TotalFiles
+	}
+	grpcClient := newTestGRPC(t, fm)
+	grpcIDs := func() string {
+		t.Helper()
+		resp, err := grpcClient.ListFiles(withToken(context.Background(), "secret"), &uploadspb.ListFilesRequest{Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, f := range resp.GetFiles() {
+			ids = append(ids, f.GetId())
+		}
+		return strings.Join(ids, ",")
+	}
+
+	// What each view shows, as a check on whether boundary appears
+	views := map[string]func() bool{
+		"/api/files": func() bool { return strings.Contains(get("/api/files", false), boundary) },
+		"/search":    func() bool { return strings.Contains(get("/search", false), boundary) },
+		"/manage":    func() bool { return strings.Contains(get("/manage", false), boundary) },
+		"/stats":     func() bool { return totalFiles(false, "") == 2 },
+		"ListFiles":  func() bool { return strings.Contains(grpcIDs(), boundary) },
+	}
+	for name, shows := range views {
+		if !shows() {
+			t.Errorf("%s hides boundary.txt before it expires", name)
+		}
+	}
+
+	// Past the expiry, with no cleanup run in between
+	time.Sleep(time.Until(expiresAt) + 50*time.Millisecond)
+	for name, shows := range views {
+		if shows() {
+			t.Errorf("%s still shows boundary.txt after it expired", name)
+		}
+	}
+	if !strings.Contains(get("/search", false), alive) {
+		t.Error("/search lost the file that is still alive")
+	}
+
+	// include_expired=true is honored for admins only
+	for _, path := range []string{"/api/files", "/search", "/manage"} {
+		if strings.Contains(get(path+"?include_expired=true", false), boundary) {
+			t.Errorf("%s?include_expired=true shows an expired file to anonymous callers", path)
+		}
+		if !strings.Contains(get(path+"?include_expired=true", true), boundary) {
+			t.Errorf("%s?include_expired=true hides the expired file from admins", path)
+		}
+	}
+	if n := totalFiles(true, "?include_expired=true"); n != 2 {
+		t.Errorf("admin /stats?include_expired=true counts %d files, want 2", n)
+	}
+
+	// A download removes it the way cleanup would have
+	resp, err := http.Get(server.URL + "/download/" + boundary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("download after expiry: status %d, want 410", resp.StatusCode)
+	}
+	fm.mutex.RLock()
+	_, registered := fm.files[boundary]
+	fm.mutex.RUnlock()
+	if registered {
+		t.Error("the expired file is still registered after the download")
+	}
+	var events []ActivityEvent
+	for _, event := range fm.activity.latest(10) {
+		if event.FileID == boundary && event.Type == "expire" {
+			events = append(events, event)
+		}
+	}
+	if len(events) != 1 || events[0].Outcome != string(StatusExpired) {
+		t.Errorf("expire events %+v, want one", events)
+	}
+	if body := get("/api/changes", true); !strings.Contains(body, `"expired"`) || !strings.Contains(body, boundary) {
+		t.Errorf("/api/changes doesn't record the expiry: %s", body)
+	}
+	if body := get("/info/"+boundary, false); !strings.Contains(body, "file_expired") {
+		t.Errorf("/info after the lazy removal: %s", body)
+	}
+}
+
+func TestPostLimitGrace(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.PostLimitGrace = time.Hour
+	})
+	status, uploaded := uploadTestFile(t, server, "build.zip", []byte("release"), url.Values{"max_downloads": {"1"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+	listed := func() string {
+		t.Helper()
+		_, list := getJSON(t, server, "/api/files?status=limit_reached_grace")
+		files, _ := list["files"].([]interface{})
+		if len(files) != 1 {
+			return ""
+		}
+		return files[0].(map[string]interface{})["status"].(string)
+	}
+
+	if status := downloadStatus(t, server.URL, id, nil); status != http.StatusOK {
+		t.Fatalf("download: status %d", status)
+	}
+	// The limit is reached: the link stops working, but the file stays
+	if status := downloadStatus(t, server.URL, id, nil); status != http.StatusForbidden {
+		t.Errorf("download past the limit: status %d, want 403", status)
+	}
+	fm.cleanup()
+	if status := listed(); status != string(StatusLimitGrace) {
+		t.Fatalf("after cleanup in grace: listed as %q", status)
+	}
+	_, view := getJSON(t, server, "/api/admin/files/"+id)
+	if view["status"] != string(StatusLimitGrace) || view["grace_until"] == nil {
+		t.Errorf("admin view %v, want the grace period", view)
+	}
+
+	// Raising the limit re-enables it, until it is used up again
+	setLimit := func(limit string) {
+		t.Helper()
+		req, _ := http.NewRequest("POST", server.URL+"/api/admin/files/"+id+"/set-limit", strings.NewReader(url.Values{"max_downloads": {limit}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if status, body := doJSON(t, req); status != http.StatusOK || body["status"] != string(StatusActive) {
+			t.Fatalf("set-limit %s: status %d, body %v", limit, status, body)
+		}
+	}
+	setLimit("2")
+	if status := downloadStatus(t, server.URL, id, nil); status != http.StatusOK {
+		t.Errorf("download after raising the limit: status %d", status)
+	}
+	if status := listed(); status != string(StatusLimitGrace) {
+		t.Errorf("after the raised limit is used up: listed as %q", status)
+	}
+
+	// Once the grace period is over, cleanup removes it
+	fm.mutex.Lock()
+	over := time.Now().Add(-time.Second)
+	fm.files[id].GraceUntil = &over
+	fm.mutex.Unlock()
+	fm.cleanup()
+	fm.mutex.RLock()
+	_, kept := fm.files[id]
+	fm.mutex.RUnlock()
+	if kept {
+		t.Fatal("file kept after its grace period")
+	}
+	if n := len(storedKeys(fm)); n != 0 {
+		t.Errorf("%d stored files left after the grace period", n)
+	}
+	if status := downloadStatus(t, server.URL, id, nil); status != http.StatusForbidden {
+		t.Errorf("download after removal: status %d, want 403", status)
+	}
+}
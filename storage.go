@@ -0,0 +1,575 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Storage backends selectable with storage_backend.
+const (
+	storageLocal  = "local"
+	storageMemory = "memory"
+)
+
+// File is the part of *os.File the handlers use on stored content, so
+// content can live somewhere other than the local disk.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// Storage holds uploaded content and upload sessions under storage keys,
+// slash-separated paths relative to upload_dir. Methods mirror their os
+// counterparts, including fs.ErrNotExist for missing keys.
+type Storage interface {
+	OpenFile(key string, flag int, perm fs.FileMode) (File, error)
+	Stat(key string) (fs.FileInfo, error)
+	Rename(from, to string) error
+	Remove(key string) error
+	RemoveAll(key string) error
+	MkdirAll(key string, perm fs.FileMode) error
+	// ReadDir returns the names directly below key, sorted.
+	ReadDir(key string) ([]string, error)
+	// Locate describes where a key's content lives, for admins.
+	Locate(key string) string
+}
+
+// MetadataStore holds metadata_file and the side stores kept next to it,
+// addressed by their configured paths.
+type MetadataStore interface {
+	ReadFile(name string) ([]byte, error)
+	// WriteFile replaces name as a whole: readers and crashes see either
+	// the old content or the new.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	// Backup makes backup a copy of name, if name exists.
+	Backup(name, backup string) error
+}
+
+// openContent opens a file's stored content for reading.
+func (fm *FileManager) openContent(fileInfo *FileInfo) (File, error) {
+	return fm.contentStorage(fileInfo).OpenFile(fileInfo.StorageKey, os.O_RDONLY, 0)
+}
+
+// writeStored replaces key's content with data.
+func writeStored(s Storage, key string, data []byte, perm fs.FileMode) error {
+	f, err := s.OpenFile(key, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readStored returns key's content.
+func readStored(s Storage, key string) ([]byte, error) {
+	f, err := s.OpenFile(key, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// newStorage returns the backends selected by storage_backend.
+func newStorage(config Config) (Storage, MetadataStore) {
+	if config.StorageBackend == storageMemory {
+		return newMemoryStorage(config.MemoryBudget), newMemoryMetadata()
+	}
+	return localStorage{dir: config.UploadDir}, localMetadata{}
+}
+
+// NewTestFileManager returns a FileManager on the memory backend with its
+// routes registered, for this package's tests that drive Handler through
+// httptest. It lives in package main, so it can't be imported from other
+// modules. configure, if not nil, adjusts the default config first; the
+// storage backend is always memory. Close it when done.
+func NewTestFileManager(configure func(*Config)) *FileManager {
+	config := defaultConfig()
+	if configure != nil {
+		configure(&config)
+	}
+	config.StorageBackend = storageMemory
+	if err := config.Validate(); err != nil {
+		panic("NewTestFileManager: " + err.Error())
+	}
+	fm := NewFileManager(config)
+	fm.registerRoutes()
+	return fm
+}
+
+// localStorage keeps content in files below upload_dir.
+type localStorage struct {
+	dir string
+}
+
+func (s localStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s localStorage) OpenFile(key string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(s.path(key), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s localStorage) Stat(key string) (fs.FileInfo, error) {
+	return os.Stat(s.path(key))
+}
+
+func (s localStorage) Rename(from, to string) error {
+	return os.Rename(s.path(from), s.path(to))
+}
+
+func (s localStorage) Remove(key string) error {
+	return removeContent(s.path(key))
+}
+
+func (s localStorage) RemoveAll(key string) error {
+	return os.RemoveAll(s.path(key))
+}
+
+func (s localStorage) MkdirAll(key string, perm fs.FileMode) error {
+	return os.MkdirAll(s.path(key), perm)
+}
+
+func (s localStorage) ReadDir(key string) ([]string, error) {
+	entries, err := os.ReadDir(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+func (s localStorage) Locate(key string) string {
+	p := s.path(key)
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
+
+type localMetadata struct{}
+
+func (localMetadata) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// WriteFile writes name.tmp and syncs it before renaming it over name, so a
+// crash or a full disk mid-write leaves name as it was.
+func (localMetadata) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	temp := name + ".tmp"
+	f, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, name)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	// Makes the rename itself durable; not every platform can sync a directory
+	if dir, err := os.Open(filepath.Dir(name)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// Backup links backup to name, which WriteFile then replaces rather than
+// rewrites. Where hard links aren't supported, name is copied.
+func (localMetadata) Backup(name, backup string) error {
+	if err := os.Remove(backup); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err := os.Link(name, backup)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return localMetadata{}.WriteFile(backup, data, 0644)
+}
+
+// memoryStorage keeps content in memory, within a byte budget. Nothing
+// survives a restart. Like an unlinked file on disk, content removed while
+// open stays readable through the open handles.
+type memoryStorage struct {
+	mutex  sync.Mutex
+	files  map[string]*memoryContent
+	budget int64
+	used   int64 // bytes held, including removed open content
+}
+
+type memoryContent struct {
+	data    []byte
+	modTime time.Time
+	opened  int  // open handles
+	removed bool // no longer reachable by key
+}
+
+func newMemoryStorage(budget int64) *memoryStorage {
+	return &memoryStorage{files: make(map[string]*memoryContent), budget: budget}
+}
+
+func cleanKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+func notExist(op, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+}
+
+func (s *memoryStorage) OpenFile(key string, flag int, perm fs.FileMode) (File, error) {
+	key = cleanKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	content, exists := s.files[key]
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, notExist("open", key)
+	case !exists:
+		content = &memoryContent{modTime: time.Now()}
+		s.files[key] = content
+	case flag&os.O_TRUNC != 0:
+		s.used -= int64(len(content.data))
+		content.data = nil
+		content.modTime = time.Now()
+	}
+	content.opened++
+	return &memoryFile{storage: s, name: key, content: content, flag: flag}, nil
+}
+
+func (s *memoryStorage) Stat(key string) (fs.FileInfo, error) {
+	key = cleanKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	content, exists := s.files[key]
+	if !exists {
+		return nil, notExist("stat", key)
+	}
+	return memoryFileInfo{name: path.Base(key), size: int64(len(content.data)), modTime: content.modTime}, nil
+}
+
+func (s *memoryStorage) Rename(from, to string) error {
+	from, to = cleanKey(from), cleanKey(to)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	content, exists := s.files[from]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: fs.ErrNotExist}
+	}
+	if replaced, exists := s.files[to]; exists && replaced != content {
+		s.drop(replaced)
+	}
+	delete(s.files, from)
+	s.files[to] = content
+	return nil
+}
+
+func (s *memoryStorage) Remove(key string) error {
+	key = cleanKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	content, exists := s.files[key]
+	if !exists {
+		return notExist("remove", key)
+	}
+	delete(s.files, key)
+	s.drop(content)
+	return nil
+}
+
+func (s *memoryStorage) RemoveAll(key string) error {
+	key = cleanKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for name, content := range s.files {
+		if name == key || strings.HasPrefix(name, key+"/") {
+			delete(s.files, name)
+			s.drop(content)
+		}
+	}
+	return nil
+}
+
+// drop releases content no key refers to any more, once it is closed.
+// Callers hold the mutex.
+func (s *memoryStorage) drop(content *memoryContent) {
+	content.removed = true
+	if content.opened == 0 {
+		s.used -= int64(len(content.data))
+		content.data = nil
+	}
+}
+
+// MkdirAll does nothing: directories exist implicitly as key prefixes.
+func (s *memoryStorage) MkdirAll(key string, perm fs.FileMode) error {
+	return nil
+}
+
+func (s *memoryStorage) ReadDir(key string) ([]string, error) {
+	prefix := cleanKey(key) + "/"
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seen := make(map[string]bool)
+	var names []string
+	for name := range s.files {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		child, _, _ := strings.Cut(rest, "/")
+		if !seen[child] {
+			seen[child] = true
+			names = append(names, child)
+		}
+	}
+	if len(names) == 0 {
+		return nil, notExist("readdir", key)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memoryStorage) Locate(key string) string {
+	return "memory:" + cleanKey(key)
+}
+
+// memoryFile is an open handle on memory content.
+type memoryFile struct {
+	storage *memoryStorage
+	name    string
+	content *memoryContent
+	flag    int
+	offset  int64
+	closed  bool
+}
+
+func (f *memoryFile) check(write bool) error {
+	switch {
+	case f.closed:
+		return os.ErrClosed
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0,
+		!write && f.flag&os.O_WRONLY != 0:
+		return &fs.PathError{Op: "access", Path: f.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memoryFile) Name() string {
+	return f.name
+}
+
+func (f *memoryFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.storage.mutex.Lock()
+	defer f.storage.mutex.Unlock()
+	data := f.content.data
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memoryFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// WriteAt refuses writes that would take the storage past its budget, with
+// the error a full disk gives.
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	s := f.storage
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	end := off + int64(len(p))
+	if grow := end - int64(len(f.content.data)); grow > 0 {
+		if s.used+grow > s.budget {
+			return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+		}
+		s.used += grow
+		f.content.data = append(f.content.data, make([]byte, grow)...)
+	}
+	copy(f.content.data[off:], p)
+	f.content.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.storage.mutex.Lock()
+		offset += int64(len(f.content.data))
+		f.storage.mutex.Unlock()
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memoryFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	f.storage.mutex.Lock()
+	defer f.storage.mutex.Unlock()
+	return memoryFileInfo{name: path.Base(f.name), size: int64(len(f.content.data)), modTime: f.content.modTime}, nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	if err := f.check(true); err != nil {
+		return err
+	}
+	s := f.storage
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current := int64(len(f.content.data))
+	switch {
+	case size < 0:
+		return fmt.Errorf("truncate %s: negative size", f.name)
+	case size > current && s.used+size-current > s.budget:
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: syscall.ENOSPC}
+	case size > current:
+		f.content.data = append(f.content.data, make([]byte, size-current)...)
+	default:
+		f.content.data = f.content.data[:size]
+	}
+	s.used += size - current
+	f.content.modTime = time.Now()
+	return nil
+}
+
+func (f *memoryFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	s := f.storage
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if f.content.opened--; f.content.opened == 0 && f.content.removed {
+		s.used -= int64(len(f.content.data))
+		f.content.data = nil
+	}
+	return nil
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memoryFileInfo) Name() string       { return i.name }
+func (i memoryFileInfo) Size() int64        { return i.size }
+func (i memoryFileInfo) Mode() fs.FileMode  { return 0644 }
+func (i memoryFileInfo) ModTime() time.Time { return i.modTime }
+func (i memoryFileInfo) IsDir() bool        { return false }
+func (i memoryFileInfo) Sys() interface{}   { return nil }
+
+// memoryMetadata keeps metadata and the side stores in memory.
+type memoryMetadata struct {
+	mutex sync.Mutex
+	files map[string][]byte
+}
+
+func newMemoryMetadata() *memoryMetadata {
+	return &memoryMetadata{files: make(map[string][]byte)}
+}
+
+func (m *memoryMetadata) ReadFile(name string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, exists := m.files[name]
+	if !exists {
+		return nil, notExist("open", name)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *memoryMetadata) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memoryMetadata) Backup(name, backup string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if data, exists := m.files[name]; exists {
+		m.files[backup] = data
+	}
+	return nil
+}
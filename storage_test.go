@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a NewTestFileManager behind httptest, both closed
+// when the test ends.
+func newTestServer(t *testing.T, configure func(*Config)) (*FileManager, *httptest.Server) {
+	t.Helper()
+	fm := NewTestFileManager(configure)
+	server := httptest.NewServer(fm.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		fm.Close()
+	})
+	return fm, server
+}
+
+// uploadTestFile posts content as a form upload with fields and returns the
+// response status and its decoded JSON body.
+func uploadTestFile(t *testing.T, server *httptest.Server, name string, content []byte, fields url.Values) (int, map[string]interface{}) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, values := range fields {
+		for _, value := range values {
+			form.WriteField(key, value)
+		}
+	}
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+
+	req, err := http.NewRequest("POST", server.URL+"/upload", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return doJSON(t, req)
+}
+
+// doJSON sends req and returns the response status and its decoded JSON
+// body, nil when the body is empty.
+func doJSON(t *testing.T, req *http.Request) (int, map[string]interface{}) {
+	t.Helper()
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", req.Method, req.URL.Path, data, err)
+		}
+	}
+	return resp.StatusCode, decoded
+}
+
+// getJSON is doJSON for a GET of path.
+func getJSON(t *testing.T, server *httptest.Server, path string) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest("GET", server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doJSON(t, req)
+}
+
+func TestMemoryBackendLifecycle(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	content := []byte("hello from memory")
+
+	status, uploaded := uploadTestFile(t, server, "hello.txt", content, nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+
+	status, info := getJSON(t, server, "/info/"+id)
+	if status != http.StatusOK || info["original_name"] != "hello.txt" || info["size"] != float64(len(content)) {
+		t.Fatalf("info: status %d, body %v", status, info)
+	}
+
+	resp, err := http.Get(server.URL + "/download/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(downloaded, content) {
+		t.Fatalf("download: status %d, body %q", resp.StatusCode, downloaded)
+	}
+
+	status, stats := getJSON(t, server, "/stats")
+	if status != http.StatusOK || stats["total_files"] != float64(1) || stats["total_downloads"] != float64(1) {
+		t.Fatalf("stats: status %d, body %v", status, stats)
+	}
+
+	// Cleanup removes an expired file and its content like on disk
+	fm.mutex.Lock()
+	fileInfo := fm.files[id]
+	fileInfo.ExpiresAt = time.Now().Add(-time.Minute)
+	fm.mutex.Unlock()
+	fm.cleanup()
+
+	if status, _ := getJSON(t, server, "/info/"+id); status == http.StatusOK {
+		t.Fatalf("info after cleanup: status %d", status)
+	}
+	if _, err := fm.storage.Stat(fileInfo.StorageKey); err == nil {
+		t.Fatalf("content of %s left in storage after cleanup", id)
+	}
+}
+
+func TestMemoryBudgetRefusesUploads(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) { c.MemoryBudget = 1024 })
+
+	status, body := uploadTestFile(t, server, "big.bin", make([]byte, 4096), nil)
+	if status != http.StatusInsufficientStorage || body["code"] != "disk_full" {
+		t.Fatalf("upload past the budget: status %d, body %v", status, body)
+	}
+	status, body = uploadTestFile(t, server, "small.bin", make([]byte, 512), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload within the budget: status %d, body %v", status, body)
+	}
+}
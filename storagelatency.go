@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage operations whose latency is sampled, see timedStorage.
+const (
+	storageOpCreate = "create"
+	storageOpOpen   = "open"
+	storageOpRemove = "remove"
+)
+
+var storageOps = []string{storageOpCreate, storageOpOpen, storageOpRemove}
+
+const (
+	// latencyWeight is how much each sample moves an operation's average.
+	latencyWeight = 0.2
+	// latencyMinSamples is how many samples an operation needs before its
+	// average can mark the service degraded.
+	latencyMinSamples = 5
+)
+
+// timedStorage samples the latency of the Storage it wraps, so every
+// backend is measured the same way. Creating, opening and removing files
+// are timed; reads and writes through the returned files are not.
+type timedStorage struct {
+	Storage
+	fm *FileManager
+}
+
+func (s timedStorage) OpenFile(key string, flag int, perm fs.FileMode) (File, error) {
+	op := storageOpOpen
+	if flag&os.O_CREATE != 0 {
+		op = storageOpCreate
+	}
+	defer s.fm.observeStorage(op, time.Now())
+	return s.Storage.OpenFile(key, flag, perm)
+}
+
+func (s timedStorage) Remove(key string) error {
+	defer s.fm.observeStorage(storageOpRemove, time.Now())
+	return s.Storage.Remove(key)
+}
+
+func (s timedStorage) RemoveAll(key string) error {
+	defer s.fm.observeStorage(storageOpRemove, time.Now())
+	return s.Storage.RemoveAll(key)
+}
+
+// latencyAverage is the exponentially weighted moving average of one
+// operation's latency.
+type latencyAverage struct {
+	average  time.Duration
+	samples  int64
+	degraded bool
+}
+
+// storageLatency holds the averages of the operations sampled so far.
+type storageLatency struct {
+	mutex sync.Mutex
+	ops   map[string]*latencyAverage
+}
+
+// StorageLatency is one operation's entry under storage_latency in
+// /api/health.
+type StorageLatency struct {
+	AverageMS   float64 `json:"average_ms"`
+	ThresholdMS float64 `json:"threshold_ms,omitempty"`
+	Samples     int64   `json:"samples"`
+	Degraded    bool    `json:"degraded"`
+
+	average time.Duration
+}
+
+// observeStorage adds the time since start to op's average. An operation is
+// degraded while its average is above its storage_latency_thresholds entry,
+// once it has latencyMinSamples samples; each change is logged.
+func (fm *FileManager) observeStorage(op string, start time.Time) {
+	elapsed := time.Since(start)
+	limit := fm.config().StorageLatencyLimits[op]
+
+	l := &fm.latency
+	l.mutex.Lock()
+	if l.ops == nil {
+		l.ops = make(map[string]*latencyAverage)
+	}
+	a := l.ops[op]
+	if a == nil {
+		a = &latencyAverage{average: elapsed}
+		l.ops[op] = a
+	}
+	a.average += time.Duration(latencyWeight * float64(elapsed-a.average))
+	a.samples++
+	degraded := limit > 0 && a.samples >= latencyMinSamples && a.average > limit
+	changed := degraded != a.degraded
+	a.degraded = degraded
+	average := a.average
+	l.mutex.Unlock()
+
+	switch {
+	case changed && degraded:
+		log.Printf("Storage %s latency averages %v, above the %v threshold", op, average.Round(time.Microsecond), limit)
+	case changed:
+		log.Printf("Storage %s latency averages %v, back below the %v threshold", op, average.Round(time.Microsecond), limit)
+	}
+}
+
+// storageLatencyStatus returns the average latency of each storage
+// operation and whether any is degraded.
+func (fm *FileManager) storageLatencyStatus() (map[string]StorageLatency, bool) {
+	limits := fm.config().StorageLatencyLimits
+	status := make(map[string]StorageLatency, len(storageOps))
+	degraded := false
+
+	l := &fm.latency
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, op := range storageOps {
+		entry := StorageLatency{ThresholdMS: milliseconds(limits[op])}
+		if a := l.ops[op]; a != nil {
+			entry.AverageMS = milliseconds(a.average)
+			entry.average = a.average
+			entry.Samples = a.samples
+			entry.Degraded = a.degraded
+		}
+		degraded = degraded || entry.Degraded
+		status[op] = entry
+	}
+	return status, degraded
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// writeStorageLatencyMetrics adds the storage latency averages to /metrics.
+func (fm *FileManager) writeStorageLatencyMetrics(out *strings.Builder) {
+	status, _ := fm.storageLatencyStatus()
+	out.WriteString("# HELP uploads_storage_latency_seconds Moving average of the time storage operations take.\n")
+	out.WriteString("# TYPE uploads_storage_latency_seconds gauge\n")
+	for _, op := range storageOps {
+		fmt.Fprintf(out, "uploads_storage_latency_seconds{operation=%q} %g\n", op, status[op].average.Seconds())
+	}
+	out.WriteString("# HELP uploads_storage_operations_total Storage operations timed for uploads_storage_latency_seconds.\n")
+	out.WriteString("# TYPE uploads_storage_operations_total counter\n")
+	for _, op := range storageOps {
+		fmt.Fprintf(out, "uploads_storage_operations_total{operation=%q} %d\n", op, status[op].Samples)
+	}
+	out.WriteString("# HELP uploads_storage_latency_degraded Whether an operation's average latency is above its threshold.\n")
+	out.WriteString("# TYPE uploads_storage_latency_degraded gauge\n")
+	for _, op := range storageOps {
+		degraded := 0
+		if status[op].Degraded {
+			degraded = 1
+		}
+		fmt.Fprintf(out, "uploads_storage_latency_degraded{operation=%q} %d\n", op, degraded)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowStorage delays every file open and remove by delay, the way a slow
+// network mount does.
+type slowStorage struct {
+	Storage
+	delay atomic.Int64
+}
+
+func (s *slowStorage) wait() {
+	time.Sleep(time.Duration(s.delay.Load()))
+}
+
+func (s *slowStorage) OpenFile(key string, flag int, perm fs.FileMode) (File, error) {
+	s.wait()
+	return s.Storage.OpenFile(key, flag, perm)
+}
+
+func (s *slowStorage) Remove(key string) error {
+	s.wait()
+	return s.Storage.Remove(key)
+}
+
+func TestSlowStorageDegradesHealth(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) {
+		c.MetricsEnabled = true
+		c.StorageLatencyLimits = map[string]time.Duration{storageOpCreate: 5 * time.Millisecond, storageOpRemove: 0}
+	})
+	slow := &slowStorage{Storage: fm.storage.(timedStorage).Storage}
+	fm.storage = timedStorage{slow, fm}
+
+	// Uploads are timed through the wrapper
+	if status, body := uploadTestFile(t, server, "a.txt", []byte("content"), nil); status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	_, health := getJSON(t, server, "/api/health")
+	latency := health["storage_latency"].(map[string]interface{})
+	if create := latency[storageOpCreate].(map[string]interface{}); create["samples"].(float64) < 1 || create["threshold_ms"] != 5.0 {
+		t.Fatalf("create latency after an upload: %v", create)
+	}
+
+	create := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			f, err := fm.storage.OpenFile("probe", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+		}
+	}
+	healthOf := func() (string, map[string]interface{}) {
+		t.Helper()
+		_, health := getJSON(t, server, "/api/health")
+		latency := health["storage_latency"].(map[string]interface{})
+		return health["status"].(string), latency[storageOpCreate].(map[string]interface{})
+	}
+
+	// Slow creates degrade the service once there are enough samples
+	fm.latency.mutex.Lock()
+	fm.latency.ops = nil
+	fm.latency.mutex.Unlock()
+	slow.delay.Store(int64(20 * time.Millisecond))
+	create(latencyMinSamples - 1)
+	if status, entry := healthOf(); status != "healthy" || entry["degraded"] != false {
+		t.Fatalf("after %d slow creates: %s, %v", latencyMinSamples-1, status, entry)
+	}
+	create(1)
+	status, entry := healthOf()
+	if status != "degraded" || entry["degraded"] != true || entry["average_ms"].(float64) < 5 {
+		t.Fatalf("after %d slow creates: %s, %v", latencyMinSamples, status, entry)
+	}
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		`uploads_storage_latency_degraded{operation="create"} 1`,
+		`uploads_storage_latency_degraded{operation="open"} 0`,
+		`uploads_storage_operations_total{operation="create"} 5`,
+	} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+
+	// A threshold of 0 never degrades
+	slow.delay.Store(int64(20 * time.Millisecond))
+	for i := 0; i < latencyMinSamples; i++ {
+		fm.storage.Remove("missing")
+	}
+	_, health = getJSON(t, server, "/api/health")
+	if remove := health["storage_latency"].(map[string]interface{})[storageOpRemove].(map[string]interface{}); remove["degraded"] != false {
+		t.Errorf("remove without a threshold: %v", remove)
+	}
+
+	// Fast creates bring the average back down and the service recovers
+	slow.delay.Store(0)
+	create(20)
+	if status, entry := healthOf(); status != "healthy" || entry["degraded"] != false {
+		t.Fatalf("after fast creates: %s, %v", status, entry)
+	}
+}
+
+func TestStorageLatencyThresholdsValidated(t *testing.T) {
+	for _, limits := range []map[string]time.Duration{
+		{"rename": time.Second},
+		{storageOpOpen: -time.Second},
+	} {
+		config := defaultConfig()
+		config.StorageLatencyLimits = limits
+		if err := config.Validate(); err == nil {
+			t.Errorf("storage_latency_thresholds %v accepted", limits)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errTagPasswordRequired is returned for downloads of a file under a
+// protected tag when the request doesn't carry that tag's password.
+var errTagPasswordRequired = errors.New("tag password required")
+
+// Tag protection sources: tag_passwords in config.json, or the admin API.
+const (
+	protectionConfig = "config"
+	protectionAdmin  = "admin"
+)
+
+// TagProtection is a rule requiring a password to download any file tagged
+// with Tag or, with tag_hierarchy, a tag below it. Passwords are never shown.
+type TagProtection struct {
+	Tag    string     `json:"tag"`
+	Source string     `json:"source"`
+	Added  *time.Time `json:"added,omitempty"` // rules from the admin API only
+}
+
+type tagRule struct {
+	TagProtection
+	password string // a bcrypt hash, or plain text from tag_passwords
+	filter   tagFilter
+}
+
+// tagRules is a rule set in tag order, so files under several protected
+// tags are always checked the same way.
+type tagRules []tagRule
+
+// storedTagRule is the on-disk form of a rule added through the admin API.
+// Password is a bcrypt hash; files from older versions kept it in plain
+// text, which loadTagRules hashes.
+type storedTagRule struct {
+	Tag      string    `json:"tag"`
+	Password string    `json:"password"`
+	Added    time.Time `json:"added"`
+}
+
+// tagRuleStore holds the rules added through the admin API, keyed by the
+// lowercased tag.
+type tagRuleStore struct {
+	mutex sync.RWMutex
+	rules map[string]storedTagRule
+}
+
+// downloadCredentials is what a client presented to unlock a file.
+type downloadCredentials struct {
+	Password     string   // the file's own password
+	TagPasswords []string // passwords of protected tags
+	Admin        bool     // admin credentials pass tag protection
+	SkipPassword bool     // the file's own password isn't needed either
+	Recipient    string   // token of a recipient, see recipients.go
+}
+
+// credentialsFor reads the password, tag_password and recipient query
+// parameters; tag_password may be repeated for files under several
+// protected tags.
+func (fm *FileManager) credentialsFor(r *http.Request) downloadCredentials {
+	query := r.URL.Query()
+	return downloadCredentials{
+		Password:     filePassword(r),
+		TagPasswords: query["tag_password"],
+		Admin:        fm.hasAdminCredentials(r),
+		Recipient:    query.Get("recipient"),
+	}
+}
+
+// filePassword reads a file's password from the X-File-Password header, which
+// keeps it out of access logs, or from the password query parameter.
+func filePassword(r *http.Request) string {
+	if password := r.Header.Get("X-File-Password"); password != "" {
+		return password
+	}
+	return r.URL.Query().Get("password")
+}
+
+// tagRules returns the protection rules in effect. A rule added through the
+// admin API replaces a tag_passwords entry for the same tag.
+func (fm *FileManager) tagRules() tagRules {
+	byTag := make(map[string]tagRule)
+	for tag, password := range fm.config().TagPasswords {
+		if tag = normalizeTag(tag); tag != "" {
+			byTag[strings.ToLower(tag)] = tagRule{
+				TagProtection: TagProtection{Tag: tag, Source: protectionConfig},
+				password:      password,
+			}
+		}
+	}
+	s := &fm.tagProtection
+	s.mutex.RLock()
+	for lower, stored := range s.rules {
+		added := stored.Added
+		byTag[lower] = tagRule{
+			TagProtection: TagProtection{Tag: stored.Tag, Source: protectionAdmin, Added: &added},
+			password:      stored.Password,
+		}
+	}
+	s.mutex.RUnlock()
+
+	rules := make(tagRules, 0, len(byTag))
+	for _, rule := range byTag {
+		rule.filter = fm.newTagFilter(rule.Tag, false)
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return strings.ToLower(rules[i].Tag) < strings.ToLower(rules[j].Tag) })
+	return rules
+}
+
+// protecting returns the rules that apply to a file with tags.
+func (rules tagRules) protecting(tags []string) tagRules {
+	var matched tagRules
+	for _, rule := range rules {
+		if rule.filter.matches(tags) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+// protects reports whether any rule applies to a file with tags.
+func (rules tagRules) protects(tags []string) bool {
+	return len(rules.protecting(tags)) > 0
+}
+
+// names returns the tags of the rules.
+func (rules tagRules) names() []string {
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = rule.Tag
+	}
+	return names
+}
+
+// unlock checks creds against every rule protecting fileInfo; all of them
+// must be satisfied by one of the tag passwords. Matches are remembered in
+// verified, as file passwords are.
+func (rules tagRules) unlock(fileInfo *FileInfo, creds downloadCredentials, verified *passwordCache) error {
+	if creds.Admin {
+		return nil
+	}
+	for _, rule := range rules.protecting(fileInfo.Tags) {
+		unlocked := false
+		for _, password := range creds.TagPasswords {
+			if rule.matches(password, verified) {
+				unlocked = true
+				break
+			}
+		}
+		if !unlocked {
+			return errTagPasswordRequired
+		}
+	}
+	return nil
+}
+
+// matches reports whether password is the rule's. tag_passwords may hold
+// plain text, like admin_password, or a bcrypt hash.
+func (rule tagRule) matches(password string, verified *passwordCache) bool {
+	if !isPasswordHash(rule.password) {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(rule.password)) == 1
+	}
+	now := time.Now()
+	sum := sha256.Sum256([]byte("tag\x00" + rule.Tag + "\x00" + rule.password + "\x00" + password))
+	if verified.verified(sum, now) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(rule.password), []byte(password)) != nil {
+		return false
+	}
+	verified.remember(tagCacheKey(rule.Tag), sum, now)
+	return true
+}
+
+// tagCacheKey files a tag's verified passwords in the password cache apart
+// from any file ID, which can't contain a colon.
+func tagCacheKey(tag string) string {
+	return "tag:" + strings.ToLower(tag)
+}
+
+// hiddenTags returns the rules whose files are left out of listings for r:
+// all of them, unless r carries admin credentials.
+func (fm *FileManager) hiddenTags(r *http.Request) tagRules {
+	if fm.hasAdminCredentials(r) {
+		return nil
+	}
+	return fm.tagRules()
+}
+
+func (fm *FileManager) tagRulesFile() string {
+	return fm.config().MetadataFile + ".tag-rules"
+}
+
+func (fm *FileManager) loadTagRules() {
+	s := &fm.tagProtection
+	s.rules = make(map[string]storedTagRule)
+	data, err := fm.metadata.ReadFile(fm.tagRulesFile())
+	if err != nil {
+		return
+	}
+	var rules []storedTagRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		log.Printf("Error loading tag protection rules: %v", err)
+		return
+	}
+	hashed := 0
+	for _, rule := range rules {
+		if !isPasswordHash(rule.Password) {
+			hash, err := bcrypt.GenerateFromPassword([]byte(rule.Password), bcrypt.DefaultCost)
+			if err != nil {
+				// Left out rather than kept in plain text; the tag is
+				// unprotected until the rule is added again
+				log.Printf("Error hashing the password of tag %q, dropping its rule: %v", rule.Tag, err)
+				continue
+			}
+			rule.Password = string(hash)
+			hashed++
+		}
+		s.rules[strings.ToLower(rule.Tag)] = rule
+	}
+	if hashed > 0 {
+		if err := fm.saveTagRules(); err != nil {
+			log.Printf("Error saving hashed tag protection rules: %v", err)
+		} else {
+			log.Printf("Hashed the plain-text passwords of %d protected tags", hashed)
+		}
+	}
+}
+
+func (fm *FileManager) saveTagRules() error {
+	s := &fm.tagProtection
+	s.mutex.RLock()
+	rules := make([]storedTagRule, 0, len(s.rules))
+	for _, rule := range s.rules {
+		rules = append(rules, rule)
+	}
+	s.mutex.RUnlock()
+	sort.Slice(rules, func(i, j int) bool { return strings.ToLower(rules[i].Tag) < strings.ToLower(rules[j].Tag) })
+
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fm.metadata.WriteFile(fm.tagRulesFile(), data, 0600)
+}
+
+// tagProtectionAPI handles /api/admin/tag-protection. GET lists the rules,
+// PUT /{tag} with {"password": "..."} protects a tag and DELETE /{tag}
+// removes a rule added here. Tags may contain slashes, so everything after
+// the prefix is the tag.
+func (fm *FileManager) tagProtectionAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	tag := normalizeTag(strings.Join(parts, tagSeparator))
+	s := &fm.tagProtection
+
+	switch {
+	case tag == "" && r.Method == "GET":
+		rules := fm.tagRules()
+		protections := make([]TagProtection, len(rules))
+		for i, rule := range rules {
+			protections[i] = rule.TagProtection
+		}
+		respondJSON(w, http.StatusOK, protections)
+
+	case tag != "" && r.Method == "PUT":
+		var request struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&request); err != nil {
+			respondError(w, r, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if request.Password == "" {
+			respondError(w, r, "password must not be empty", http.StatusBadRequest)
+			return
+		}
+		hash, err := hashFilePassword(request.Password)
+		if errors.Is(err, errPasswordTooLong) {
+			respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			respondError(w, r, "Server error", http.StatusInternalServerError)
+			return
+		}
+		s.mutex.Lock()
+		s.rules[strings.ToLower(tag)] = storedTagRule{Tag: tag, Password: hash, Added: time.Now()}
+		s.mutex.Unlock()
+		fm.verifiedPasswords.forget(tagCacheKey(tag))
+		if err := fm.saveTagRules(); err != nil {
+			writeStorageError(w, r, fm.storageFailure(err))
+			return
+		}
+		log.Printf("Tag %q is now password protected", tag)
+		w.WriteHeader(http.StatusNoContent)
+
+	case tag != "" && r.Method == "DELETE":
+		s.mutex.Lock()
+		_, exists := s.rules[strings.ToLower(tag)]
+		delete(s.rules, strings.ToLower(tag))
+		s.mutex.Unlock()
+		fm.verifiedPasswords.forget(tagCacheKey(tag))
+		if !exists {
+			for _, rule := range fm.tagRules() {
+				if strings.EqualFold(rule.Tag, tag) {
+					respondError(w, r, "Tag is protected in config.json (tag_passwords)", http.StatusConflict)
+					return
+				}
+			}
+			respondError(w, r, "Tag not protected", http.StatusNotFound)
+			return
+		}
+		if err := fm.saveTagRules(); err != nil {
+			writeStorageError(w, r, fm.storageFailure(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
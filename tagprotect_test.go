@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// downloadStatus fetches a file with the given query and returns the status.
+func downloadStatus(t *testing.T, server string, id string, query url.Values) int {
+	t.Helper()
+	resp, err := http.Get(server + "/download/" + id + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestTagPasswordsStoredHashed(t *testing.T) {
+	fm, server := newTestServer(t, func(c *Config) { c.AdminPassword = "secret" })
+
+	req, _ := http.NewRequest("PUT", server.URL+"/api/admin/tag-protection/payroll", strings.NewReader(`{"password": "s3cret"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	if status, body := doJSON(t, req); status != http.StatusNoContent {
+		t.Fatalf("PUT tag protection: status %d, body %v", status, body)
+	}
+	data, err := fm.metadata.ReadFile(fm.tagRulesFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("s3cret")) {
+		t.Fatalf("tag password saved in plain text: %s", data)
+	}
+	var stored []storedTagRule
+	if err := json.Unmarshal(data, &stored); err != nil || len(stored) != 1 || !isPasswordHash(stored[0].Password) {
+		t.Fatalf("saved rules %s, want one with a bcrypt hash", data)
+	}
+
+	status, uploaded := uploadTestFile(t, server, "march.csv", []byte("salaries"), url.Values{"tags": {"payroll"}})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+	if status := downloadStatus(t, server.URL, id, url.Values{"tag_password": {"guess"}}); status != http.StatusUnauthorized {
+		t.Errorf("download with a wrong tag password: status %d, want 401", status)
+	}
+	// Twice, the second time from the cache of verified passwords
+	for range 2 {
+		if status := downloadStatus(t, server.URL, id, url.Values{"tag_password": {"s3cret"}}); status != http.StatusOK {
+			t.Errorf("download with the tag password: status %d", status)
+		}
+	}
+
+	// Longer than bcrypt can hash
+	req, _ = http.NewRequest("PUT", server.URL+"/api/admin/tag-protection/hr", strings.NewReader(`{"password": "`+strings.Repeat("x", 73)+`"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	if status, _ := doJSON(t, req); status != http.StatusBadRequest {
+		t.Errorf("PUT with a 73-byte password: status %d, want 400", status)
+	}
+}
+
+func TestPlainTagRulesHashedOnLoad(t *testing.T) {
+	fm := NewTestFileManager(nil)
+	defer fm.Close()
+	plain := `[{"tag": "payroll", "password": "s3cret", "added": "2024-01-02T03:04:05Z"}]`
+	if err := fm.metadata.WriteFile(fm.tagRulesFile(), []byte(plain), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fm.loadTagRules()
+
+	data, err := fm.metadata.ReadFile(fm.tagRulesFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("s3cret")) {
+		t.Errorf("plain-text rule not rewritten hashed: %s", data)
+	}
+	fileInfo := &FileInfo{ID: "f1", Tags: []string{"payroll"}}
+	rules := fm.tagRules()
+	if err := rules.unlock(fileInfo, downloadCredentials{TagPasswords: []string{"s3cret"}}, &fm.verifiedPasswords); err != nil {
+		t.Errorf("migrated rule refuses its password: %v", err)
+	}
+	if err := rules.unlock(fileInfo, downloadCredentials{TagPasswords: []string{"guess"}}, &fm.verifiedPasswords); err != errTagPasswordRequired {
+		t.Errorf("migrated rule with a wrong password: %v, want %v", err, errTagPasswordRequired)
+	}
+}
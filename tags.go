@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tags may encode structure with "/", e.g. project/alpha/ci. With
+// tag_hierarchy on, a tag filter matches the tag itself and everything below
+// it; exact_tag=true on a request, or tag_hierarchy off, compares whole tags
+// for deployments whose tags merely contain slashes.
+const tagSeparator = "/"
+
+// normalizeTag trims whitespace around the tag and its segments and drops
+// empty segments, so " project//alpha/ " becomes "project/alpha".
+func normalizeTag(tag string) string {
+	segments := strings.Split(strings.TrimSpace(tag), tagSeparator)
+	kept := segments[:0]
+	for _, segment := range segments {
+		if segment = strings.TrimSpace(segment); segment != "" {
+			kept = append(kept, segment)
+		}
+	}
+	return strings.Join(kept, tagSeparator)
+}
+
+// normalizeTags normalizes each tag, dropping empty ones and duplicates
+// (case-insensitively, keeping the first spelling).
+func normalizeTags(tags []string) []string {
+	if tags == nil {
+		return nil
+	}
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag = normalizeTag(tag); tag != "" && !hasAnyTag(normalized, []string{tag}) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+// parseTags splits a comma-separated tags form value.
+func parseTags(tagsStr string) []string {
+	if tagsStr == "" {
+		return nil
+	}
+	return normalizeTags(strings.Split(tagsStr, ","))
+}
+
+// tagFilter is a tag query: a tag and whether its subtree matches too.
+type tagFilter struct {
+	Tag     string
+	Subtree bool
+}
+
+// tagFilterFor reads the tag and exact_tag query parameters.
+func (fm *FileManager) tagFilterFor(r *http.Request) tagFilter {
+	return fm.newTagFilter(r.URL.Query().Get("tag"), r.URL.Query().Get("exact_tag") == "true")
+}
+
+func (fm *FileManager) newTagFilter(tag string, exact bool) tagFilter {
+	return tagFilter{
+		Tag:     normalizeTag(tag),
+		Subtree: fm.config().TagHierarchy && !exact,
+	}
+}
+
+// matchesTag reports whether tag is the filter's tag or, for subtree
+// filters, one of its descendants. "project/al" doesn't match
+// "project/alpha": only whole segments count.
+func (f tagFilter) matchesTag(tag string) bool {
+	if strings.EqualFold(tag, f.Tag) {
+		return true
+	}
+	return f.Subtree && len(tag) > len(f.Tag) &&
+		strings.EqualFold(tag[:len(f.Tag)], f.Tag) &&
+		strings.HasPrefix(tag[len(f.Tag):], tagSeparator)
+}
+
+// matches reports whether any of tags matches. An empty filter matches
+// everything.
+func (f tagFilter) matches(tags []string) bool {
+	if f.Tag == "" {
+		return true
+	}
+	for _, tag := range tags {
+		if f.matchesTag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// TagNode is a tag in the GET /api/tags tree. Files and Size roll up the
+// node's whole subtree, counting each file once; OwnFiles counts the files
+// tagged with exactly this tag.
+type TagNode struct {
+	Name     string     `json:"name"`
+	Path     string     `json:"path"`
+	Files    int        `json:"files"`
+	Size     int64      `json:"size"`
+	OwnFiles int        `json:"own_files"`
+	Children []*TagNode `json:"children,omitempty"`
+}
+
+// tagTree builds the tag tree of files. Without hierarchy every tag is a
+// root. Tags differing only in case share a node named after the first
+// spelling seen.
+func tagTree(files []*FileInfo, hierarchy bool) []*TagNode {
+	root := &TagNode{}
+	index := make(map[string]*TagNode)
+
+	for _, fileInfo := range files {
+		counted := make(map[*TagNode]bool)
+		for _, tag := range fileInfo.Tags {
+			if tag = normalizeTag(tag); tag == "" {
+				continue
+			}
+			segments := []string{tag}
+			if hierarchy {
+				segments = strings.Split(tag, tagSeparator)
+			}
+			parent := root
+			for _, segment := range segments {
+				path := segment
+				if parent != root {
+					path = parent.Path + tagSeparator + segment
+				}
+				node, ok := index[strings.ToLower(path)]
+				if !ok {
+					node = &TagNode{Name: segment, Path: path}
+					index[strings.ToLower(path)] = node
+					parent.Children = append(parent.Children, node)
+				}
+				if !counted[node] {
+					counted[node] = true
+					node.Files++
+					node.Size += fileInfo.Size
+				}
+				parent = node
+			}
+			parent.OwnFiles++
+		}
+	}
+
+	var sortNodes func(nodes []*TagNode)
+	sortNodes = func(nodes []*TagNode) {
+		sort.Slice(nodes, func(i, j int) bool { return strings.ToLower(nodes[i].Name) < strings.ToLower(nodes[j].Name) })
+		for _, node := range nodes {
+			sortNodes(node.Children)
+		}
+	}
+	sortNodes(root.Children)
+	return root.Children
+}
+
+// listTags handles GET /api/tags: the tag tree of the files the request may
+// list, or with tag= only that node's subtree.
+func (fm *FileManager) listTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !fm.requireListingAccess(w, r) {
+		return
+	}
+
+	filter := statsFilter{IncludeExpired: fm.showExpired(r), Key: fm.requestKey(r), Hidden: fm.hiddenTags(r)}
+	hierarchy := fm.config().TagHierarchy && r.URL.Query().Get("exact_tag") != "true"
+
+	cached, _ := fm.aggregate("tags\x00"+strconv.FormatBool(hierarchy)+"\x00"+filter.cacheKey(), func() interface{} {
+		fm.mutex.RLock()
+		files := make([]*FileInfo, 0, len(fm.files))
+		for _, fileInfo := range fm.files {
+			if filter.matches(fileInfo) {
+				files = append(files, fileInfo)
+			}
+		}
+		fm.mutex.RUnlock()
+		return tagTree(files, hierarchy)
+	})
+	tree := cached.([]*TagNode)
+	if tag := normalizeTag(r.URL.Query().Get("tag")); tag != "" {
+		tree = findTagNode(tree, tag)
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"tags": tree})
+}
+
+// findTagNode returns the node at path as a one-element tree, or an empty
+// tree.
+func findTagNode(nodes []*TagNode, path string) []*TagNode {
+	for _, node := range nodes {
+		if strings.EqualFold(node.Path, path) {
+			return []*TagNode{node}
+		}
+	}
+	for _, node := range nodes {
+		if strings.HasPrefix(strings.ToLower(path), strings.ToLower(node.Path)+tagSeparator) {
+			return findTagNode(node.Children, path)
+		}
+	}
+	return []*TagNode{}
+}
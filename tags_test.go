@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	for raw, want := range map[string]string{
+		" project//alpha/ ":   "project/alpha",
+		"project / alpha /ci": "project/alpha/ci",
+		"/":                   "",
+		"  ":                  "",
+		"plain":               "plain",
+	} {
+		if got := normalizeTag(raw); got != want {
+			t.Errorf("normalizeTag(%q) = %q, want %q", raw, got, want)
+		}
+	}
+	if got := parseTags("a/b, A//B ,, c,/"); !slices.Equal(got, []string{"a/b", "c"}) {
+		t.Errorf("parseTags = %q, want the first spelling of each tag", got)
+	}
+}
+
+func TestTagFilterPrefixes(t *testing.T) {
+	subtree := tagFilter{Tag: "project/alpha", Subtree: true}
+	exact := tagFilter{Tag: "project/alpha"}
+	for tag, want := range map[string][2]bool{ // subtree, exact
+		"project/alpha":       {true, true},
+		"Project/Alpha":       {true, true},
+		"project/alpha/ci":    {true, false},
+		"project/alphabet":    {false, false}, // only whole segments count
+		"project/al":          {false, false},
+		"project":             {false, false},
+		"other/project/alpha": {false, false},
+	} {
+		if got := subtree.matchesTag(tag); got != want[0] {
+			t.Errorf("subtree filter on %q: %v", tag, got)
+		}
+		if got := exact.matchesTag(tag); got != want[1] {
+			t.Errorf("exact filter on %q: %v", tag, got)
+		}
+	}
+	if !(tagFilter{}).matches(nil) {
+		t.Error("an empty filter doesn't match an untagged file")
+	}
+}
+
+func TestTagTreeRollup(t *testing.T) {
+	files := []*FileInfo{
+		{Size: 100, Tags: []string{"project/alpha/ci", "project/alpha/docs"}},
+		{Size: 10, Tags: []string{"project/alpha"}},
+		{Size: 1, Tags: []string{"project/beta", "Project/Alpha/CI"}},
+		{Size: 1000, Tags: []string{"misc"}},
+	}
+	tree := tagTree(files, true)
+	node := func(path string) *TagNode {
+		t.Helper()
+		found := findTagNode(tree, path)
+		if len(found) != 1 {
+			t.Fatalf("no node %s in the tree", path)
+		}
+		return found[0]
+	}
+
+	// A file under two tags of a subtree counts once in each ancestor
+	for _, tc := range []struct {
+		path            string
+		files, ownFiles int
+		size            int64
+	}{
+		{"project", 3, 0, 111},
+		{"project/alpha", 3, 1, 111},
+		{"project/alpha/ci", 2, 2, 101},
+		{"project/alpha/docs", 1, 1, 100},
+		{"project/beta", 1, 1, 1},
+		{"misc", 1, 1, 1000},
+	} {
+		if n := node(tc.path); n.Files != tc.files || n.OwnFiles != tc.ownFiles || n.Size != tc.size {
+			t.Errorf("%s: %d files (%d own), %d bytes, want %d (%d own), %d", tc.path, n.Files, n.OwnFiles, n.Size, tc.files, tc.ownFiles, tc.size)
+		}
+	}
+	if ci := node("project/alpha/ci"); ci.Name != "ci" {
+		t.Errorf("node named %q, want the first spelling", ci.Name)
+	}
+	if len(tree) != 2 || tree[0].Name != "misc" || tree[1].Name != "project" {
+		t.Errorf("roots %v, want misc and project in order", tree)
+	}
+
+	// Without hierarchy each tag stands alone
+	flat := tagTree(files, false)
+	if len(flat) != 5 || len(findTagNode(flat, "project")) != 0 {
+		t.Errorf("flat tree has %d roots", len(flat))
+	}
+}
+
+func TestTagHierarchyQueries(t *testing.T) {
+	for _, hierarchy := range []bool{true, false} {
+		name := "hierarchy"
+		if !hierarchy {
+			name = "flat"
+		}
+		t.Run(name, func(t *testing.T) {
+			_, server := newTestServer(t, func(c *Config) { c.TagHierarchy = hierarchy })
+			ids := make(map[string]string)
+			for name, tags := range map[string]string{
+				"ci.log":    " project//alpha/ci ",
+				"alpha.txt": "project/alpha",
+				"bet.txt":   "project/alphabet",
+				"beta.txt":  "project/beta",
+			} {
+				status, body := uploadTestFile(t, server, name, []byte(name), url.Values{"tags": {tags}})
+				if status != http.StatusOK {
+					t.Fatalf("upload %s: status %d, body %v", name, status, body)
+				}
+				ids[name] = body["id"].(string)
+			}
+			if _, info := getJSON(t, server, "/info/"+ids["ci.log"]); strings.Join(tagList(info), ",") != "project/alpha/ci" {
+				t.Errorf("tags stored as %v, want them normalized", info["tags"])
+			}
+
+			search := func(query string) []string {
+				t.Helper()
+				resp, err := http.Get(server.URL + "/search?" + query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				var found []map[string]interface{}
+				json.NewDecoder(resp.Body).Decode(&found)
+				var names []string
+				for _, file := range found {
+					names = append(names, file["original_name"].(string))
+				}
+				slices.Sort(names)
+				return names
+			}
+			wantAlpha := []string{"alpha.txt"}
+			if hierarchy {
+				wantAlpha = []string{"alpha.txt", "ci.log"}
+			}
+			if got := search("tag=project/alpha"); !slices.Equal(got, wantAlpha) {
+				t.Errorf("tag=project/alpha found %q, want %q", got, wantAlpha)
+			}
+			if got := search("tag=project/alpha&exact_tag=true"); !slices.Equal(got, []string{"alpha.txt"}) {
+				t.Errorf("exact tag=project/alpha found %q", got)
+			}
+			if got := search("tag=project/al"); len(got) != 0 {
+				t.Errorf("tag=project/al found %q, want nothing", got)
+			}
+
+			// PATCH normalizes like upload does
+			req, _ := http.NewRequest("PATCH", server.URL+"/api/files/"+ids["beta.txt"], strings.NewReader(`{"tags":["project/ alpha /beta"]}`))
+			req.Header.Set("Content-Type", "application/json")
+			if status, body := doJSON(t, req); status != http.StatusOK || strings.Join(tagList(body), ",") != "project/alpha/beta" {
+				t.Errorf("PATCH tags: status %d, tags %v", status, body["tags"])
+			}
+
+			_, tags := getJSON(t, server, "/api/tags?tag=project/alpha")
+			nodes := tags["tags"].([]interface{})
+			if hierarchy {
+				if len(nodes) != 1 || nodes[0].(map[string]interface{})["files"] != 3.0 || len(nodes[0].(map[string]interface{})["children"].([]interface{})) != 2 {
+					t.Errorf("/api/tags?tag=project/alpha = %v, want the subtree of three files", nodes)
+				}
+			} else if len(nodes) != 1 || nodes[0].(map[string]interface{})["files"] != 1.0 {
+				t.Errorf("flat /api/tags?tag=project/alpha = %v, want the tag alone", nodes)
+			}
+
+			// Bulk delete takes the same subtree
+			req, _ = http.NewRequest("POST", server.URL+"/bulk-delete", strings.NewReader(`{"tag":"project/alpha"}`))
+			_, deleted := doJSON(t, req)
+			want := 1.0
+			if hierarchy {
+				want = 3
+			}
+			if deleted["deleted"] != want {
+				t.Errorf("bulk delete of project/alpha removed %v files, want %v", deleted["deleted"], want)
+			}
+			if got := search("tag=project/alphabet"); !slices.Equal(got, []string{"bet.txt"}) {
+				t.Errorf("after the bulk delete project/alphabet has %q", got)
+			}
+		})
+	}
+}
+
+// tagList returns the tags of a file as returned by the API.
+func tagList(file map[string]interface{}) []string {
+	var tags []string
+	for _, tag := range file["tags"].([]interface{}) {
+		tags = append(tags, tag.(string))
+	}
+	return tags
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// templateHelper is a function available to the HTML templates. The list
+// is served on /api/template-functions in dev_mode.
+type templateHelper struct {
+	Name        string      `json:"name"`
+	Signature   string      `json:"signature"`
+	Description string      `json:"description"`
+	Func        interface{} `json:"-"`
+}
+
+// templateHelpers returns every template function, with the URL builders
+// bound to r so they honor base_url and trusted proxy headers. fm and r
+// may be nil when the functions are only needed to parse a template.
+func (fm *FileManager) templateHelpers(r *http.Request) []templateHelper {
+	base := func() string {
+		if fm == nil || r == nil {
+			return ""
+		}
+		return fm.baseURL(r)
+	}
+	return []templateHelper{
+		{"formatBytes", "formatBytes size", "A size in bytes as e.g. 1.5 MB", formatBytes},
+		{"displayName", "displayName name", "A file name normalized for display", normalizeName},
+		{"join", "join list separator", "strings.Join", strings.Join},
+		{"substr", "substr s start length", "Up to length bytes of s from start", substr},
+		{"percent", "percent ratio", "A ratio as a whole percentage, e.g. 42%", percent},
+		{"barWidth", "barWidth ratio", "A ratio capped at 1 as a CSS width", barWidth},
+		{"duration", "duration d", "A duration as its two largest units, e.g. 2d 3h; negative ones get a minus sign", formatDuration},
+		{"expiryTime", "expiryTime time", "A time in expiry_timezone with the zone named, e.g. 2025-03-31 23:59:59 CEST", func(t time.Time) string {
+			return formatExpiry(t, fm.expiryLocation())
+		}},
+		{"expiresIn", "expiresIn time", `"in 2d 3h" until time, or "expired" once it has passed`, expiresIn},
+		{"relativeTime", "relativeTime time", `A time relative to now, e.g. "5m ago" or "in 2h"; "never" for the zero time`, func(t time.Time) string {
+			return relativeTime(t, time.Now())
+		}},
+		{"json", "json value", "value as JSON, for embedding in a <script> block", toJSON},
+		{"markdown", "markdown text", "A safe subset of Markdown as HTML: paragraphs, line breaks, **bold**, *italic*, `code` and http(s) links; everything else is escaped", markdown},
+		{"gravatarHash", "gravatarHash email", "The Gravatar hash of an email address", gravatarHash},
+		{"identicon", "identicon seed", "A 5x5 SVG identicon derived from seed", identicon},
+		{"downloadURL", "downloadURL id", "The absolute download URL of a file", func(id string) string {
+			return base() + "/download/" + url.PathEscape(id)
+		}},
+		{"landingURL", "landingURL id", "The absolute share page URL of a file", func(id string) string {
+			return base() + "/f/" + url.PathEscape(id)
+		}},
+		{"absURL", "absURL path", "path made absolute against base_url", func(path string) string {
+			return base() + "/" + strings.TrimPrefix(path, "/")
+		}},
+		{"path", "path route", "route below path_prefix, for links within the server", func(route string) string {
+			if fm == nil {
+				return route
+			}
+			return fm.appPath(route)
+		}},
+	}
+}
+
+func (fm *FileManager) templateFuncs(r *http.Request) template.FuncMap {
+	funcs := make(template.FuncMap)
+	for _, helper := range fm.templateHelpers(r) {
+		funcs[helper.Name] = helper.Func
+	}
+	return funcs
+}
+
+// parseFuncs are the template functions needed to parse a template. They
+// are rebound to the request by renderHTML.
+var parseFuncs = (*FileManager)(nil).templateFuncs(nil)
+
+// renderHTML executes t with the template functions bound to r.
+func (fm *FileManager) renderHTML(w io.Writer, r *http.Request, t *template.Template, data interface{}) error {
+	bound, err := t.Clone()
+	if err != nil {
+		return err
+	}
+	return bound.Funcs(fm.templateFuncs(r)).Execute(w, data)
+}
+
+// templateFunctions handles GET /api/template-functions, listing the
+// template helpers. It only exists in dev_mode.
+func (fm *FileManager) templateFunctions(w http.ResponseWriter, r *http.Request) {
+	if !fm.config().DevMode {
+		respondError(w, r, "Unknown API endpoint", http.StatusNotFound)
+		return
+	}
+	respondJSON(w, http.StatusOK, fm.templateHelpers(r))
+}
+
+func substr(s string, start, length int) string {
+	if start < 0 || length <= 0 || start >= len(s) {
+		return ""
+	}
+	return s[start:min(start+length, len(s))]
+}
+
+func percent(ratio float64) string {
+	return fmt.Sprintf("%.0f%%", ratio*100)
+}
+
+func barWidth(ratio float64) template.CSS {
+	return template.CSS(fmt.Sprintf("%.1f%%", max(min(ratio, 1), 0)*100))
+}
+
+// formatDuration is humanizeDuration for durations that may be negative.
+func formatDuration(d time.Duration) string {
+	if d < 0 {
+		if d == time.Duration(-1<<63) {
+			d++ // -d would overflow
+		}
+		return "-" + humanizeDuration(-d)
+	}
+	return humanizeDuration(d)
+}
+
+func expiresIn(t time.Time) string {
+	left := time.Until(t)
+	if left <= 0 {
+		return "expired"
+	}
+	return "in " + humanizeDuration(left)
+}
+
+func relativeTime(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	d := now.Sub(t)
+	switch {
+	case d > -time.Second && d < time.Second:
+		return "just now"
+	case d > 0:
+		return humanizeDuration(d) + " ago"
+	default:
+		return "in " + formatDuration(-d)
+	}
+}
+
+func toJSON(v interface{}) (template.JS, error) {
+	data, err := json.Marshal(v)
+	return template.JS(data), err
+}
+
+var (
+	markdownCode   = regexp.MustCompile("`([^`\n]+)`")
+	markdownBold   = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	markdownItalic = regexp.MustCompile(`\*([^*\n]+)\*`)
+	markdownLink   = regexp.MustCompile(`\[([^\]\n]+)\]\((https?://[^\s)"<>]+)\)`)
+	markdownBreak  = regexp.MustCompile(`\n\s*\n`)
+)
+
+// markdown renders a small, safe subset of Markdown. The text is escaped
+// first, so the only markup in the result is what the rules below add, and
+// links are limited to http and https.
+func markdown(text string) template.HTML {
+	var out strings.Builder
+	text = strings.ReplaceAll(text, "\x00", "")
+	for _, paragraph := range markdownBreak.Split(strings.TrimSpace(text), -1) {
+		if paragraph == "" {
+			continue
+		}
+		p := html.EscapeString(paragraph)
+		var codes []string
+		p = markdownCode.ReplaceAllStringFunc(p, func(m string) string {
+			codes = append(codes, "<code>"+m[1:len(m)-1]+"</code>")
+			return fmt.Sprintf("\x00%d\x00", len(codes)-1)
+		})
+		p = markdownLink.ReplaceAllString(p, `<a href="$2" rel="nofollow noopener">$1</a>`)
+		p = markdownBold.ReplaceAllString(p, "<strong>$1</strong>")
+		p = markdownItalic.ReplaceAllString(p, "<em>$1</em>")
+		for i, code := range codes {
+			p = strings.Replace(p, fmt.Sprintf("\x00%d\x00", i), code, 1)
+		}
+		p = strings.ReplaceAll(p, "\n", "<br>\n")
+		out.WriteString("<p>" + p + "</p>\n")
+	}
+	return template.HTML(out.String())
+}
+
+func gravatarHash(email string) string {
+	sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+// identicon draws a horizontally symmetric 5x5 grid, colored and filled
+// from the SHA-256 of seed.
+func identicon(seed string) template.HTML {
+	sum := sha256.Sum256([]byte(seed))
+	color := fmt.Sprintf("#%02x%02x%02x", sum[0], sum[1], sum[2])
+	var out strings.Builder
+	out.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 5 5" width="40" height="40" shape-rendering="crispEdges">`)
+	for row := 0; row < 5; row++ {
+		for col := 0; col < 3; col++ {
+			if sum[3+row*3+col]%2 == 0 {
+				continue
+			}
+			fmt.Fprintf(&out, `<rect x="%d" y="%d" width="1" height="1" fill="%s"/>`, col, row, color)
+			if col < 2 {
+				fmt.Fprintf(&out, `<rect x="%d" y="%d" width="1" height="1" fill="%s"/>`, 4-col, row, color)
+			}
+		}
+	}
+	out.WriteString(`</svg>`)
+	return template.HTML(out.String())
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	for size, want := range map[int64]string{
+		0:             "0 B",
+		1023:          "1023 B",
+		1024:          "1.0 KB",
+		1536:          "1.5 KB",
+		1 << 40:       "1.0 TB",
+		math.MaxInt64: "8.0 EB",
+	} {
+		if got := formatBytes(size); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", size, got, want)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{500 * time.Millisecond, "1s"},
+		{90 * time.Second, "1m 30s"},
+		{26*time.Hour + 3*time.Minute, "1d 2h"},
+		{-time.Second, "-1s"},
+		{-50 * time.Hour, "-2d 2h"},
+		{math.MaxInt64, "106751d 23h"},
+		{math.MinInt64, "-106751d 23h"}, // negating it would overflow
+	} {
+		if got := formatDuration(tc.d); got != tc.want {
+			t.Errorf("formatDuration(%v) = %q, want %q", tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestRelativeTimes(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Time{}, "never"},
+		{now, "just now"},
+		{now.Add(-500 * time.Millisecond), "just now"},
+		{now.Add(-5 * time.Minute), "5m ago"},
+		{now.Add(2 * time.Hour), "in 2h"},
+	} {
+		if got := relativeTime(tc.t, now); got != tc.want {
+			t.Errorf("relativeTime(now%+v) = %q, want %q", tc.t.Sub(now), got, tc.want)
+		}
+	}
+	if got := expiresIn(now.Add(-time.Hour)); got != "expired" {
+		t.Errorf("expiresIn an hour ago = %q", got)
+	}
+	if got := expiresIn(now.Add(49 * time.Hour)); got != "in 2d 1h" {
+		t.Errorf("expiresIn 49h = %q", got)
+	}
+}
+
+func TestTextHelpers(t *testing.T) {
+	for _, tc := range []struct {
+		start, length int
+		want          string
+	}{
+		{1, 3, "ell"},
+		{3, 10, "lo"},
+		{-1, 2, ""},
+		{9, 1, ""},
+		{0, 0, ""},
+	} {
+		if got := substr("hello", tc.start, tc.length); got != tc.want {
+			t.Errorf("substr(hello, %d, %d) = %q, want %q", tc.start, tc.length, got, tc.want)
+		}
+	}
+	if got := percent(0.426); got != "43%" {
+		t.Errorf("percent(0.426) = %q", got)
+	}
+	for ratio, want := range map[float64]string{1.7: "100.0%", -0.2: "0.0%", 0.25: "25.0%"} {
+		if got := barWidth(ratio); string(got) != want {
+			t.Errorf("barWidth(%v) = %q, want %q", ratio, got, want)
+		}
+	}
+	if got, err := toJSON(map[string]string{"a": "</script>"}); err != nil || strings.Contains(string(got), "</script>") {
+		t.Errorf("toJSON = %s, %v; want the closing tag escaped", got, err)
+	}
+	if _, err := toJSON(make(chan int)); err == nil {
+		t.Error("toJSON of a channel succeeded")
+	}
+	if got := gravatarHash(" MyEmailAddress@example.com "); got != "0bc83cb571cd1c50ba6f3e8a78ef1346" {
+		t.Errorf("gravatarHash = %s", got)
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	got := string(markdown("**bold** *it* `<x>` [bad](javascript:alert(1)) [ok](https://example.com/?a=1&b=2)\n\n<script>\nnext\x00"))
+	for _, want := range []string{
+		"<p><strong>bold</strong> <em>it</em> <code>&lt;x&gt;</code>",
+		"[bad](javascript:alert(1))",
+		`<a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener">ok</a></p>`,
+		"<p>&lt;script&gt;<br>\nnext</p>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("markdown lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "<script>") || strings.Contains(got, "\x00") {
+		t.Errorf("markdown let markup through:\n%s", got)
+	}
+	if got := markdown(" \n\n "); got != "" {
+		t.Errorf("markdown of blank text = %q", got)
+	}
+}
+
+func TestIdenticon(t *testing.T) {
+	svg := string(identicon("someone@example.com"))
+	if svg != string(identicon("someone@example.com")) || svg == string(identicon("other@example.com")) {
+		t.Error("identicon isn't derived from the seed alone")
+	}
+	// Every cell left of the middle column is mirrored on the right
+	for col, mirror := range map[string]string{`x="0"`: `x="4"`, `x="1"`: `x="3"`} {
+		if strings.Count(svg, col) != strings.Count(svg, mirror) {
+			t.Errorf("identicon isn't symmetric: %d cells at %s, %d at %s", strings.Count(svg, col), col, strings.Count(svg, mirror), mirror)
+		}
+	}
+	if !strings.HasPrefix(svg, "<svg") || !strings.HasSuffix(svg, "</svg>") {
+		t.Errorf("identicon isn't an SVG: %s", svg)
+	}
+}
+
+func TestTemplateURLHelpers(t *testing.T) {
+	fm := NewTestFileManager(func(c *Config) {
+		c.BaseURL = "https://files.example.com/"
+		c.PathPrefix = "/share"
+	})
+	defer fm.Close()
+	funcs := fm.templateFuncs(httptest.NewRequest("GET", "http://internal:8080/", nil))
+	for _, tc := range []struct {
+		name, arg, want string
+	}{
+		{"downloadURL", "a b", "https://files.example.com/share/download/a%20b"},
+		{"landingURL", "abc", "https://files.example.com/share/f/abc"},
+		{"absURL", "/static/app.css", "https://files.example.com/share/static/app.css"},
+		{"path", "/manage", "/share/manage"},
+	} {
+		if got := funcs[tc.name].(func(string) string)(tc.arg); got != tc.want {
+			t.Errorf("%s(%q) = %q, want %q", tc.name, tc.arg, got, tc.want)
+		}
+	}
+
+	// Parsing doesn't need a server or a request
+	if got := parseFuncs["downloadURL"].(func(string) string)("abc"); got != "/download/abc" {
+		t.Errorf("unbound downloadURL = %q", got)
+	}
+}
+
+func TestBuiltinTemplatesUseHelpers(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) { c.BaseURL = "https://files.example.com" })
+	status, body := uploadTestFile(t, server, "report.pdf", testContent(1536), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+
+	resp, err := http.Get(server.URL + "/f/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{"Size: 1.5 KB", `href="https://files.example.com/download/` + id + `"`} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("share page lacks %s", want)
+		}
+	}
+}
+
+func TestTemplateFunctionsListing(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	if status, body := getJSON(t, server, "/api/template-functions"); status != http.StatusNotFound {
+		t.Fatalf("outside dev_mode: status %d, body %v, want 404", status, body)
+	}
+
+	config := *fm.config()
+	config.DevMode = true
+	fm.cfg.Store(&config)
+	resp, err := http.Get(server.URL + "/api/template-functions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var helpers []templateHelper
+	if err := json.NewDecoder(resp.Body).Decode(&helpers); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("in dev_mode: status %d, %v", resp.StatusCode, err)
+	}
+	listed := make(map[string]bool)
+	for _, helper := range helpers {
+		if helper.Signature == "" || helper.Description == "" {
+			t.Errorf("%s is listed without a signature or description", helper.Name)
+		}
+		listed[helper.Name] = true
+	}
+	for name := range parseFuncs {
+		if !listed[name] {
+			t.Errorf("%s isn't listed", name)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+func init() {
+	jobRunners["tier"] = runTier
+}
+
+// Storage tiers. Files are stored hot, below upload_dir; the tier job moves
+// files nobody has used for cold_after to cold_storage_dir, under the same
+// storage key, and FileInfo.Tier records which backend holds them.
+const (
+	tierHot  = "hot"
+	tierCold = "cold"
+)
+
+var (
+	errNoColdStorage = errors.New("cold storage is not configured")
+	errNotTierable   = errors.New("links and appendable files stay in hot storage")
+	errMigrating     = errors.New("file is already being moved")
+)
+
+// tierMigrations keeps two moves of the same file from racing each other.
+type tierMigrations struct {
+	mutex  sync.Mutex
+	active map[string]bool
+}
+
+func (m *tierMigrations) begin(id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.active[id] {
+		return false
+	}
+	if m.active == nil {
+		m.active = make(map[string]bool)
+	}
+	m.active[id] = true
+	return true
+}
+
+func (m *tierMigrations) end(id string) {
+	m.mutex.Lock()
+	delete(m.active, id)
+	m.mutex.Unlock()
+}
+
+// tier names the tier holding fileInfo's content.
+func (f *FileInfo) tier() string {
+	if f.Tier == tierCold {
+		return tierCold
+	}
+	return tierHot
+}
+
+// contentStorage returns the backend holding fileInfo's content.
+func (fm *FileManager) contentStorage(fileInfo *FileInfo) Storage {
+	if fileInfo.Tier == tierCold && fm.cold != nil {
+		return fm.cold
+	}
+	return fm.storage
+}
+
+// coldDue reports whether the tiering policy sends fileInfo to cold storage:
+// it is active, at least cold_min_size bytes, and has been neither uploaded
+// nor downloaded for cold_after.
+func coldDue(config *Config, fileInfo *FileInfo, now time.Time) bool {
+	if config.ColdAfter <= 0 || fileInfo.tier() == tierCold || fileInfo.isLink() || fileInfo.Appendable || fileInfo.HashPending ||
+		fileInfo.Size < config.ColdMinSize || fileInfo.statusAt(now) != StatusActive {
+		return false
+	}
+	lastUsed := fileInfo.UploadTime
+	if fileInfo.LastDownload.After(lastUsed) {
+		lastUsed = fileInfo.LastDownload
+	}
+	return now.Sub(lastUsed) >= config.ColdAfter
+}
+
+// moveTier moves fileInfo's content to tier. The copy is hashed as it is
+// written and read back afterwards; the source copy is only removed once
+// both hashes agree, and agree with the recorded checksum when it uses the
+// configured algorithm. Reads are limited to bytesPerSecond when positive.
+func (fm *FileManager) moveTier(fileInfo *FileInfo, tier string, bytesPerSecond int64) error {
+	if fm.cold == nil {
+		return errNoColdStorage
+	}
+	if !fm.migrations.begin(fileInfo.ID) {
+		return errMigrating
+	}
+	defer fm.migrations.end(fileInfo.ID)
+
+	fm.mutex.RLock()
+	current, key, checksum, appendable := fileInfo.tier(), fileInfo.StorageKey, fileInfo.Checksum, fileInfo.Appendable
+	fm.mutex.RUnlock()
+	if current == tier {
+		return nil
+	}
+	if fileInfo.isLink() || appendable {
+		return errNotTierable
+	}
+	from, to := fm.storage, fm.cold
+	if tier == tierHot {
+		from, to = fm.cold, fm.storage
+	}
+
+	src, err := from.OpenFile(key, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := to.MkdirAll(path.Dir(key), 0755); err != nil {
+		return err
+	}
+	dst, err := to.OpenFile(key, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	sent, err := fm.calculateChecksum(newThrottledReader(io.TeeReader(src, dst), bytesPerSecond))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fm.verifyCopy(to, key, sent, checksum, bytesPerSecond)
+	}
+	if err != nil {
+		to.Remove(key)
+		return err
+	}
+
+	fm.mutex.Lock()
+	if fm.files[fileInfo.ID] != fileInfo {
+		// Deleted or replaced while being copied
+		fm.mutex.Unlock()
+		to.Remove(key)
+		return errFileNotFound
+	}
+	fileInfo.Tier = tier
+	if tier == tierHot {
+		fileInfo.Tier = ""
+	}
+	fm.recordChange(changeUpdated, fileInfo.ID, fileInfo)
+	fm.mutex.Unlock()
+
+	if err := from.Remove(key); err != nil {
+		log.Printf("Error removing %s copy of %s: %v", current, fileInfo.ID, err)
+	}
+	log.Printf("Moved %s (%s) to %s storage", fileInfo.ID, fileInfo.OriginalName, tier)
+	return nil
+}
+
+// verifyCopy rehashes the copy written under key and compares it with sent,
+// the hash of what was read from the source, and with recorded.
+func (fm *FileManager) verifyCopy(to Storage, key, sent, recorded string, bytesPerSecond int64) error {
+	if checksumAlgorithm(recorded) == checksumAlgorithm(sent) && recorded != sent {
+		return fmt.Errorf("source of %s does not match its checksum", key)
+	}
+	stored, err := fm.rehashFile(to, key, bytesPerSecond)
+	if err != nil {
+		return err
+	}
+	if stored != sent {
+		return fmt.Errorf("copy of %s failed verification", key)
+	}
+	return nil
+}
+
+// rehydrate moves a cold file back to hot storage after it was downloaded,
+// with rehydrate_on_access.
+func (fm *FileManager) rehydrate(fileInfo *FileInfo) {
+	if err := fm.moveTier(fileInfo, tierHot, 0); err != nil && err != errMigrating {
+		log.Printf("Error rehydrating %s: %v", fileInfo.ID, err)
+		return
+	}
+	fm.requestSave()
+}
+
+// runTier moves every file the tiering policy selects to cold storage.
+func runTier(fm *FileManager, job *Job, params map[string]string) error {
+	if fm.cold == nil {
+		return errNoColdStorage
+	}
+	config := fm.config()
+	targets := fm.coldTargets(config)
+
+	job.setTotal(len(targets))
+	for i, fileInfo := range targets {
+		err := fm.moveTier(fileInfo, tierCold, config.RehashBytesPerSecond)
+		if err != nil {
+			log.Printf("Error moving %s to cold storage: %v", fileInfo.ID, err)
+		}
+		job.advance(err)
+
+		// Persist progress regularly so a restart doesn't redo finished work
+		if (i+1)%50 == 0 {
+			fm.saveMetadata()
+		}
+	}
+	return fm.saveMetadata()
+}
+
+func (fm *FileManager) coldTargets(config *Config) []*FileInfo {
+	now := time.Now()
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	var targets []*FileInfo
+	for _, fileInfo := range fm.files {
+		if coldDue(config, fileInfo, now) {
+			targets = append(targets, fileInfo)
+		}
+	}
+	return targets
+}
+
+// tieringRoutine starts the tier job whenever files are due for cold storage
+// and the previous run has finished.
+func (fm *FileManager) tieringRoutine() {
+	ticker := time.NewTicker(fm.config().CleanupInterval)
+	defer ticker.Stop()
+
+	for fm.tick(ticker) {
+		if config := fm.config(); config.ColdAfter > 0 && !fm.jobRunning("tier") && len(fm.coldTargets(config)) > 0 {
+			fm.startJob("tier", nil)
+		}
+	}
+}
+
+func (fm *FileManager) startTier(w http.ResponseWriter, r *http.Request) {
+	if fm.cold == nil {
+		respondError(w, r, "Cold storage is not configured", http.StatusConflict)
+		return
+	}
+	fm.writeJobAccepted(w, fm.startJob("tier", nil))
+}
+
+// adminMoveTier serves the archive and rehydrate actions of the admin file
+// API, which move one file to cold or hot storage regardless of the policy.
+func (fm *FileManager) adminMoveTier(w http.ResponseWriter, r *http.Request, fileID, action string) {
+	fm.mutex.RLock()
+	fileInfo, exists := fm.files[fileID]
+	fm.mutex.RUnlock()
+	if !exists {
+		respondError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+
+	tier := tierCold
+	if action == "rehydrate" {
+		tier = tierHot
+	}
+	switch err := fm.moveTier(fileInfo, tier, 0); err {
+	case nil:
+	case errNoColdStorage, errNotTierable, errMigrating:
+		respondError(w, r, err.Error(), http.StatusConflict)
+		return
+	case errFileNotFound:
+		respondError(w, r, "File not found", http.StatusNotFound)
+		return
+	default:
+		writeStorageError(w, r, err)
+		return
+	}
+	fm.requestSave()
+
+	view, exists := fm.adminFileView(fileID)
+	if !exists {
+		respondError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+	if wantsJSON(r) {
+		respondJSON(w, http.StatusOK, view)
+		return
+	}
+	http.Redirect(w, r, fm.appPath("/admin/files/"+fileID), http.StatusSeeOther)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations whose phases are timed, see requestTimer.
+const (
+	opUpload   = "upload"
+	opDownload = "download"
+)
+
+// Upload phases: receiving the body, hashing it, writing it to storage and
+// saving the metadata. Download phases: opening and checking the file, and
+// the time to the first byte of the response.
+const (
+	phaseReceive   = "receive"
+	phaseHash      = "hash"
+	phaseStore     = "store"
+	phasePersist   = "persist"
+	phaseOpen      = "open"
+	phaseFirstByte = "first_byte"
+)
+
+// requestTimer collects the phase timings of one request. A nil timer
+// ignores all calls, so code shared with untimed paths needn't check.
+type requestTimer struct {
+	mutex     sync.Mutex
+	start     time.Time
+	last      time.Time
+	operation string
+	fileID    string
+	phases    []phaseTiming
+}
+
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+}
+
+type timerKey struct{}
+
+func timerFrom(ctx context.Context) *requestTimer {
+	timer, _ := ctx.Value(timerKey{}).(*requestTimer)
+	return timer
+}
+
+// begin names the operation being timed, unless an outer handler already
+// did.
+func (t *requestTimer) begin(operation string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.operation == "" {
+		t.operation = operation
+	}
+}
+
+// mark ends phase at the current time: it is charged with the time since
+// the previous mark. Phases marked more than once add up.
+func (t *requestTimer) mark(phase string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	t.add(phase, now.Sub(t.last))
+	t.last = now
+}
+
+// firstByte records the time from the start of a download to the first
+// byte of its response, without moving the phase boundary.
+func (t *requestTimer) firstByte() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.operation != opDownload {
+		return
+	}
+	for _, p := range t.phases {
+		if p.name == phaseFirstByte {
+			return
+		}
+	}
+	t.add(phaseFirstByte, time.Since(t.start))
+}
+
+func (t *requestTimer) add(phase string, d time.Duration) {
+	for i := range t.phases {
+		if t.phases[i].name == phase {
+			t.phases[i].duration += d
+			return
+		}
+	}
+	t.phases = append(t.phases, phaseTiming{phase, d})
+}
+
+// setFile records the ID of the file the request is about.
+func (t *requestTimer) setFile(fileID string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.fileID = fileID
+}
+
+// timedResponseWriter counts the bytes of a response and notes when the
+// first one is written, and keeps the first error writing it, see
+// responseCut.
+type timedResponseWriter struct {
+	http.ResponseWriter
+	timer  *requestTimer
+	status int
+	bytes  int64
+	err    error
+}
+
+func (w *timedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timedResponseWriter) Write(p []byte) (int, error) {
+	if w.bytes == 0 && len(p) > 0 {
+		w.timer.firstByte()
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	if w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// ReadFrom keeps the sendfile fast path of the underlying writer.
+func (w *timedResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.timer.firstByte()
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, src)
+	}
+	w.bytes += n
+	if w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *timedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *timedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// timed wraps a handler so its duration and phase timings are logged when
+// the request takes longer than slow_request_threshold or moves more than
+// large_transfer_threshold bytes either way, and observed by the phase
+// histograms when metrics are enabled.
+func (fm *FileManager) timed(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		timer := &requestTimer{start: start, last: start}
+		tw := &timedResponseWriter{ResponseWriter: w, timer: timer}
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+		handler(tw, r.WithContext(context.WithValue(r.Context(), timerKey{}, timer)))
+
+		total := time.Since(start)
+		var received int64
+		if body != nil {
+			received = body.bytes
+		}
+		timer.mutex.Lock()
+		defer timer.mutex.Unlock()
+		config := fm.config()
+		if config.MetricsEnabled {
+			fm.metrics.observe(timer, total)
+		}
+
+		slow := config.SlowRequestThreshold > 0 && total >= config.SlowRequestThreshold
+		large := config.LargeTransferBytes > 0 && max(received, tw.bytes) >= config.LargeTransferBytes
+		if !slow && !large {
+			return
+		}
+		status := tw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		kind := "slow_request"
+		if !slow {
+			kind = "large_transfer"
+		}
+		var entry strings.Builder
+		fmt.Fprintf(&entry, "%s method=%s path=%q status=%d ip=%s", kind, r.Method, r.URL.Path, status, fm.clientIP(r))
+		if timer.fileID != "" {
+			fmt.Fprintf(&entry, " file=%s", timer.fileID)
+		}
+		fmt.Fprintf(&entry, " bytes_in=%d bytes_out=%d total=%s", received, tw.bytes, total.Round(time.Microsecond))
+		for _, p := range timer.phases {
+			fmt.Fprintf(&entry, " %s=%s", p.name, p.duration.Round(time.Microsecond))
+		}
+		if r.Context().Err() != nil {
+			entry.WriteString(" aborted=true")
+		}
+		log.Print(entry.String())
+	}
+}
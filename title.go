@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxTitleLength is the longest title accepted, in characters.
+const maxTitleLength = 200
+
+var errTitleTooLong = errors.New("title must be at most 200 characters")
+
+// parseTitle cleans up a display title: surrounding space is trimmed and
+// control characters, line breaks included, become spaces. Templates escape
+// titles like any other text.
+func parseTitle(raw string) (string, error) {
+	title := strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, raw))
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return "", errTitleTooLong
+	}
+	return title, nil
+}
+
+// Label is the name a file is listed under: its title when it has one,
+// otherwise the name it was uploaded with. Downloads always use the latter.
+func (f *FileInfo) Label() string {
+	if f.Title != "" {
+		return f.Title
+	}
+	return normalizeName(f.OriginalName)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// errFileGone is returned for files removed within tombstone_window, so
+// clients that raced a delete get 410 Gone instead of a bare 404.
+var errFileGone = errors.New("file was recently deleted")
+
+// tombstone remembers why and when a file was removed, and enough about it
+// for recipients of a dead link to tell what it was. Files that needed a
+// password keep only the removal.
+type tombstone struct {
+	DeletedAt    time.Time `json:"deleted_at"`
+	Reason       string    `json:"reason"` // "deleted", "expired", "limit_reached" or "evicted"
+	OriginalName string    `json:"original_name,omitempty"`
+	Title        string    `json:"title,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Uploader     string    `json:"uploader,omitempty"` // name of the API key it was uploaded with
+}
+
+// bury records the removal of fileID. Every removal path goes through it:
+// deletes, bulk deletes, expiry by TTL or download limit, and eviction by
+// evict_on_full, so it also drops the file's verified passwords. Callers
+// must hold fm.mutex.
+func (fm *FileManager) bury(fileID string, fileInfo *FileInfo, reason string) {
+	fm.verifiedPasswords.forget(fileID)
+	if fm.config().TombstoneWindow <= 0 {
+		return
+	}
+	if fm.tombstones == nil {
+		fm.tombstones = make(map[string]tombstone)
+	}
+	t := tombstone{DeletedAt: time.Now(), Reason: reason, ExpiresAt: fileInfo.ExpiresAt}
+	if fileInfo.Password == "" && !fm.tagRules().protects(fileInfo.Tags) {
+		t.OriginalName = fileInfo.OriginalName
+		t.Title = fileInfo.Title
+		t.Size = fileInfo.Size
+		t.Uploader = fm.apiKeys.name(fileInfo.KeyID)
+	}
+	fm.tombstones[fileID] = t
+	fm.buried = true
+}
+
+// tombstoneFor returns the tombstone of a recently removed file. Callers must
+// hold fm.mutex for reading.
+func (fm *FileManager) tombstoneFor(fileID string) (tombstone, bool) {
+	t, ok := fm.tombstones[fileID]
+	if !ok || time.Since(t.DeletedAt) > fm.config().TombstoneWindow {
+		return tombstone{}, false
+	}
+	return t, true
+}
+
+// missingFileError explains why fileID isn't there: errFileNotFound when it
+// never existed or was removed before the tombstone window, otherwise the
+// reason it was removed.
+func (fm *FileManager) missingFileError(fileID string) error {
+	fm.mutex.RLock()
+	t, gone := fm.tombstoneFor(fileID)
+	fm.mutex.RUnlock()
+	if !gone {
+		return errFileNotFound
+	}
+	switch FileStatus(t.Reason) {
+	case StatusExpired:
+		return errFileExpired
+	case StatusLimitReached:
+		return errDownloadLimit
+	}
+	return errFileGone
+}
+
+// writeNotFound answers a request for a file that doesn't exist.
+func (fm *FileManager) writeNotFound(w http.ResponseWriter, r *http.Request, fileID string) {
+	writeDownloadError(w, r, fm.missingFileError(fileID))
+}
+
+// tombstoneInfo is the answer of /info and the share page for a removed
+// file: the download error together with what is known about the file.
+type tombstoneInfo struct {
+	downloadProblem
+	ID     string     `json:"id"`
+	Status FileStatus `json:"status"`
+	tombstone
+}
+
+// writeTombstone answers /info and share page requests for fileID if it was
+// removed within tombstone_window, and reports whether it did.
+func (fm *FileManager) writeTombstone(w http.ResponseWriter, r *http.Request, fileID string, page bool) bool {
+	fm.mutex.RLock()
+	t, gone := fm.tombstoneFor(fileID)
+	fm.mutex.RUnlock()
+	if !gone {
+		return false
+	}
+	info := tombstoneInfo{
+		downloadProblem: problemFor(fm.missingFileError(fileID)),
+		ID:              fileID,
+		Status:          FileStatus(t.Reason),
+		tombstone:       t,
+	}
+	if info.Status != StatusLimitReached {
+		info.Status = StatusExpired
+	}
+	if page && !wantsJSON(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(info.downloadProblem.Status)
+		fm.renderHTML(w, r, tombstoneTemplate, info)
+		return true
+	}
+	respondJSON(w, info.downloadProblem.Status, info)
+	return true
+}
+
+// pruneTombstones permanently forgets removals older than the window.
+// Callers must hold fm.mutex.
+func (fm *FileManager) pruneTombstones() {
+	window := fm.config().TombstoneWindow
+	for id, t := range fm.tombstones {
+		if time.Since(t.DeletedAt) > window {
+			delete(fm.tombstones, id)
+			fm.buried = true
+		}
+	}
+}
+
+func (fm *FileManager) tombstonesFile() string {
+	return fm.config().MetadataFile + ".tombstones"
+}
+
+func (fm *FileManager) loadTombstones() {
+	data, err := fm.metadata.ReadFile(fm.tombstonesFile())
+	if err != nil {
+		return
+	}
+	var tombstones map[string]tombstone
+	if err := json.Unmarshal(data, &tombstones); err != nil {
+		log.Printf("Error loading tombstones: %v", err)
+		return
+	}
+	fm.mutex.Lock()
+	fm.tombstones = tombstones
+	fm.pruneTombstones()
+	fm.mutex.Unlock()
+}
+
+// saveTombstones writes the tombstones if they changed since the last save.
+func (fm *FileManager) saveTombstones() {
+	fm.mutex.Lock()
+	if !fm.buried {
+		fm.mutex.Unlock()
+		return
+	}
+	data, err := json.Marshal(fm.tombstones)
+	fm.buried = false
+	fm.mutex.Unlock()
+	if err != nil {
+		log.Printf("Error encoding tombstones: %v", err)
+		return
+	}
+	if err := fm.metadata.WriteFile(fm.tombstonesFile(), data, 0644); err != nil {
+		log.Printf("Error saving tombstones: %v", err)
+	}
+}
+
+var tombstoneTemplate = template.Must(template.New("tombstone").Funcs(parseFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.Message}}</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; background: #f5f5f5; }
+        .container { max-width: 600px; margin: 40px auto; background: white; padding: 30px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); }
+        h1 { color: #dc3545; font-size: 1.5em; word-break: break-all; }
+        .meta { color: #666; margin: 8px 0; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{if .OriginalName}}{{or .Title (displayName .OriginalName)}}{{else}}{{.Message}}{{end}}</h1>
+        {{if .OriginalName}}<div class="meta"><strong>{{.Message}}</strong></div>{{end}}
+        {{if .Size}}<div class="meta">Size: {{formatBytes .Size}}</div>{{end}}
+        {{if eq .Reason "deleted"}}<div class="meta">Deleted {{relativeTime .DeletedAt}}</div>
+        {{else if eq .Reason "expired"}}<div class="meta">Expired {{relativeTime .ExpiresAt}}</div>
+        {{else}}<div class="meta">Removed {{relativeTime .DeletedAt}} after its last allowed download</div>{{end}}
+        {{with .Uploader}}<div class="meta">Uploaded by: {{.}}</div>{{end}}
+        {{if .Hint}}<p>{{.Hint}}</p>{{end}}
+    </div>
+</body>
+</html>
+`))
+
+// openStored opens the content of fileID before the download checks run.
+// Holding the handle keeps the bytes readable until the response is done even
+// if the file is deleted meanwhile: on POSIX systems unlinking an open file
+// only removes its name. It returns the record the handle belongs to, and a
+// nil handle for links and missing content.
+func (fm *FileManager) openStored(fileID string) (*FileInfo, File) {
+	fm.mutex.RLock()
+	fileInfo, exists := fm.files[fileID]
+	fm.mutex.RUnlock()
+	if !exists || fileInfo.isLink() {
+		return fileInfo, nil
+	}
+	f, err := fm.openContent(fileInfo)
+	if err != nil {
+		return fileInfo, nil
+	}
+	return fileInfo, f
+}
+
+// Windows refuses to delete files that are open, such as ones being
+// downloaded. Those deletions are queued and retried by cleanup.
+var deferredDeletes struct {
+	sync.Mutex
+	paths []string
+}
+
+func removeContent(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) && runtime.GOOS == "windows" {
+		deferredDeletes.Lock()
+		deferredDeletes.paths = append(deferredDeletes.paths, path)
+		deferredDeletes.Unlock()
+		return nil
+	}
+	return err
+}
+
+// retryDeferredDeletes removes content whose deletion had to wait for
+// downloads to finish.
+func retryDeferredDeletes() {
+	deferredDeletes.Lock()
+	paths := deferredDeletes.paths
+	deferredDeletes.paths = nil
+	deferredDeletes.Unlock()
+
+	for _, path := range paths {
+		if err := removeContent(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting file %s: %v", path, err)
+		}
+	}
+}
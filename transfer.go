@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// transferStats counts transfers cut short by the client.
+type transferStats struct {
+	abortedUploads   atomic.Int64
+	abortedDownloads atomic.Int64
+}
+
+// contextReader fails reads once ctx is done, so copy loops stop promptly
+// when the client goes away instead of waiting for the connection to error.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// clientGone reports whether err means the request was canceled, normally by
+// the client disconnecting.
+func clientGone(ctx context.Context, err error) bool {
+	return ctx.Err() != nil && err != nil
+}
+
+// responseCut reports whether the response to r was cut short by the
+// client: the request was canceled, or writing the response failed. A
+// client hanging up mid-transfer can fail a write before the server notices
+// the closed connection and cancels the request.
+func responseCut(w http.ResponseWriter, r *http.Request) bool {
+	if r.Context().Err() != nil {
+		return true
+	}
+	for {
+		if tw, ok := w.(*timedResponseWriter); ok {
+			return tw.err != nil
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = unwrapper.Unwrap()
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// storedKeys lists the content held by fm's memory storage.
+func storedKeys(fm *FileManager) []string {
+	storage := fm.storage.(timedStorage).Storage.(*memoryStorage)
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	var keys []string
+	for key := range storage.files {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestCanceledUploadLeavesNothing(t *testing.T) {
+	for _, upload := range []struct {
+		name string
+		// request returns the upload with the content read from content
+		request func(url string, content io.Reader) *http.Request
+	}{
+		{"raw", func(url string, content io.Reader) *http.Request {
+			req, _ := http.NewRequest("PUT", url+"/upload/big.bin", content)
+			req.ContentLength = 1 << 20
+			return req
+		}},
+		{"form", func(url string, content io.Reader) *http.Request {
+			var head bytes.Buffer
+			form := multipart.NewWriter(&head)
+			form.CreateFormFile("file", "big.bin")
+			req, _ := http.NewRequest("POST", url+"/upload", io.MultiReader(&head, content))
+			req.Header.Set("Content-Type", form.FormDataContentType())
+			return req
+		}},
+	} {
+		t.Run(upload.name, func(t *testing.T) {
+			fm, server := newTestServer(t, nil)
+
+			feed, body := io.Pipe()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req := upload.request(server.URL, feed).WithContext(ctx)
+
+			done := make(chan error, 1)
+			go func() {
+				resp, err := http.DefaultClient.Do(req)
+				if err == nil {
+					resp.Body.Close()
+				}
+				done <- err
+			}()
+
+			// Send part of the content, then hang up
+			if _, err := body.Write(bytes.Repeat([]byte("x"), 256<<10)); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			body.CloseWithError(context.Canceled)
+			if err := <-done; err == nil {
+				t.Fatal("upload completed despite the cancel")
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for fm.transfers.abortedUploads.Load() == 0 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if n := fm.transfers.abortedUploads.Load(); n != 1 {
+				t.Errorf("aborted uploads = %d, want 1", n)
+			}
+			fm.mutex.RLock()
+			files := len(fm.files)
+			fm.mutex.RUnlock()
+			if files != 0 {
+				t.Errorf("%d files in the index after a canceled upload", files)
+			}
+			if keys := storedKeys(fm); len(keys) != 0 {
+				t.Errorf("content left in storage after a canceled upload: %q", keys)
+			}
+		})
+	}
+}
+
+func TestCanceledDownloadIsCounted(t *testing.T) {
+	fm, server := newTestServer(t, nil)
+	// Larger than the socket buffers take in, so the server is still writing
+	put, _ := http.NewRequest("PUT", server.URL+"/upload/big.bin", bytes.NewReader(make([]byte, 48<<20)))
+	status, uploaded := doJSON(t, put)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, uploaded)
+	}
+	id := uploaded["id"].(string)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/download/"+id, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Read(make([]byte, 1024))
+	cancel()
+	resp.Body.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for fm.transfers.abortedDownloads.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := fm.transfers.abortedDownloads.Load(); n != 1 {
+		t.Errorf("aborted downloads = %d, want 1", n)
+	}
+	if status, _ := getJSON(t, server, "/info/"+id); status != http.StatusOK {
+		t.Errorf("info after a canceled download: status %d", status)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Policies for uploads whose content does not match their extension.
+const (
+	mismatchTag        = "tag"        // record it and add the type-mismatch tag
+	mismatchAttachment = "attachment" // record it and always serve as an opaque download
+	mismatchReject     = "reject"     // refuse the upload with 422
+)
+
+const (
+	typeMismatchTag = "type-mismatch"
+	typeMismatchKey = "type_mismatch"
+)
+
+var errTypeMismatch = errors.New("file content does not match its extension")
+
+// extensionTypes maps file extensions to the types http.DetectContentType
+// reports for genuine files of that kind. Extensions not listed here are not
+// checked, since sniffing can't tell them apart reliably.
+var extensionTypes = map[string][]string{
+	".pdf":  {"application/pdf"},
+	".png":  {"image/png"},
+	".jpg":  {"image/jpeg"},
+	".jpeg": {"image/jpeg"},
+	".gif":  {"image/gif"},
+	".webp": {"image/webp"},
+	".bmp":  {"image/bmp"},
+	".ico":  {"image/x-icon"},
+	".zip":  {"application/zip"},
+	".docx": {"application/zip"},
+	".xlsx": {"application/zip"},
+	".pptx": {"application/zip"},
+	".gz":   {"application/x-gzip"},
+	".rar":  {"application/x-rar-compressed"},
+	".mp3":  {"audio/mpeg"},
+	".wav":  {"audio/wave"},
+	".ogg":  {"application/ogg", "audio/ogg"},
+	".mp4":  {"video/mp4"},
+	".webm": {"video/webm"},
+	".txt":  {"text/plain"},
+	".csv":  {"text/plain"},
+	".json": {"text/plain"},
+}
+
+// detectTypeMismatch sniffs head and describes the mismatch with the type the
+// filename implies, or returns "" when they agree or the extension isn't
+// checked.
+func detectTypeMismatch(filename string, head []byte) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	expected, checked := extensionTypes[ext]
+	if !checked || len(head) == 0 {
+		return ""
+	}
+
+	detected, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	for _, t := range expected {
+		if t == detected {
+			return ""
+		}
+	}
+	return fmt.Sprintf("detected %s for a %s file", detected, ext)
+}
+
+// checkContentType applies denied_types and allowed_types to the sniffed
+// type of an upload whose leading bytes are in f, then type_mismatch_policy,
+// updating metadata and tags as the policy requires.
+func (fm *FileManager) checkContentType(f File, filename string, metadata map[string]string, tags []string) ([]string, error) {
+	head := make([]byte, 512)
+	n, _ := f.ReadAt(head, 0)
+	var findings []string
+	if n > 0 {
+		disallowed, err := fm.checkSniffedType(http.DetectContentType(head[:n]))
+		if err != nil {
+			return nil, err
+		}
+		if disallowed != "" {
+			findings = append(findings, disallowed)
+		}
+	}
+	if mismatch := detectTypeMismatch(filename, head[:n]); mismatch != "" {
+		findings = append([]string{mismatch}, findings...)
+	}
+	if len(findings) == 0 {
+		return tags, nil
+	}
+	mismatch := strings.Join(findings, "; ")
+
+	switch fm.config().TypeMismatchPolicy {
+	case mismatchReject:
+		return nil, fmt.Errorf("%w: %s", errTypeMismatch, mismatch)
+	case mismatchTag:
+		if !hasAnyTag(tags, []string{typeMismatchTag}) {
+			tags = append(tags, typeMismatchTag)
+		}
+	}
+	metadata[typeMismatchKey] = mismatch
+	return tags, nil
+}
+
+// forceOpaqueDownload reports whether a file must be served as an untyped
+// attachment, so a browser never renders content disguised by its name.
+func (fm *FileManager) forceOpaqueDownload(fileInfo *FileInfo) bool {
+	return fm.config().TypeMismatchPolicy == mismatchAttachment && fileInfo.Metadata[typeMismatchKey] != ""
+}
+
+// typeMismatchReport lists files whose stored content disagrees with their
+// extension. Files uploaded before the check existed are sniffed from disk.
+func (fm *FileManager) typeMismatchReport(w http.ResponseWriter, r *http.Request) {
+	type mismatchedFile struct {
+		ID           string `json:"id"`
+		OriginalName string `json:"original_name"`
+		Mismatch     string `json:"mismatch"`
+	}
+
+	fm.mutex.RLock()
+	files := make([]*FileInfo, 0, len(fm.files))
+	for _, fileInfo := range fm.files {
+		files = append(files, fileInfo)
+	}
+	fm.mutex.RUnlock()
+
+	report := []mismatchedFile{}
+	for _, fileInfo := range files {
+		fm.mutex.RLock()
+		mismatch := fileInfo.Metadata[typeMismatchKey]
+		fm.mutex.RUnlock()
+		if mismatch == "" {
+			mismatch = fm.sniffMismatch(fileInfo)
+		}
+		if mismatch != "" {
+			report = append(report, mismatchedFile{fileInfo.ID, fileInfo.OriginalName, mismatch})
+		}
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].OriginalName < report[j].OriginalName
+	})
+
+	respondJSON(w, http.StatusOK, report)
+}
+
+func (fm *FileManager) sniffMismatch(fileInfo *FileInfo) string {
+	f, err := fm.openContent(fileInfo)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return ""
+	}
+	return detectTypeMismatch(fileInfo.OriginalName, head[:n])
+}
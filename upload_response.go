@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// responseField reports whether the named optional field is enabled in
+// upload_response_fields.
+func (fm *FileManager) responseField(name string) bool {
+	for _, f := range fm.config().ResponseFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// curlCommand builds a copy-pasteable one-liner that saves the file under its
+// original name. Protected files get a placeholder the recipient must fill in.
+func curlCommand(downloadURL string, fileInfo *FileInfo) string {
+	url := downloadURL
+	if fileInfo.Password != "" {
+		url += "?password=PASSWORD"
+	}
+	flags := "-o"
+	if fileInfo.isLink() {
+		flags = "-L -o" // follow the redirect to the link target
+	}
+	return fmt.Sprintf("curl %s %s %s", flags, shellQuote(fileInfo.OriginalName), shellQuote(url))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// humanizeDuration renders a duration as its two most significant units,
+// e.g. "2d 3h", "45m" or "30s".
+func humanizeDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d < time.Second {
+		return "0s"
+	}
+
+	days := int(d / (24 * time.Hour))
+	d -= time.Duration(days) * 24 * time.Hour
+	hours := int(d / time.Hour)
+	d -= time.Duration(hours) * time.Hour
+	minutes := int(d / time.Minute)
+	d -= time.Duration(minutes) * time.Minute
+	seconds := int(d / time.Second)
+
+	units := []struct {
+		value int
+		unit  string
+	}{{days, "d"}, {hours, "h"}, {minutes, "m"}, {seconds, "s"}}
+
+	var parts []string
+	for i, u := range units {
+		if u.value == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d%s", u.value, u.unit))
+		if i+1 < len(units) && units[i+1].value > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", units[i+1].value, units[i+1].unit))
+		}
+		break
+	}
+	return strings.Join(parts, " ")
+}
+
+func (fm *FileManager) writeUploadResponse(w http.ResponseWriter, r *http.Request, fileInfo *FileInfo) {
+	downloadURL := fm.downloadURL(r, fileInfo.ID)
+	landingURL := fm.landingURL(r, fileInfo.ID)
+	expiresIn := humanizeDuration(time.Until(fileInfo.ExpiresAt))
+	warning := fm.writeStorageWarning(w)
+	duplicate := w.Header().Get("X-Duplicate-Submission") == "true"
+
+	if wantsJSON(r) {
+		response := map[string]interface{}{
+			"id":            fileInfo.ID,
+			"filename":      fileInfo.Filename,
+			"original_name": fileInfo.OriginalName,
+			"title":         fileInfo.Title,
+			"size":          fileInfo.Size,
+			"checksum":      fileInfo.Checksum,
+			"download_url":  downloadURL,
+			"expires_at":    fileInfo.ExpiresAt.Format(time.RFC3339),
+			"ttl_source":    fileInfo.TTLSource,
+			"max_downloads": fileInfo.MaxDownloads,
+			"status":        fileInfo.Status(),
+		}
+		if fileInfo.HashPending {
+			// Filled in on /info once the checksum job has run
+			response["checksum"] = nil
+			response["checksum_pending"] = true
+		}
+		if fm.responseField("landing_url") {
+			response["landing_url"] = landingURL
+		}
+		if fm.responseField("curl") {
+			response["curl_command"] = curlCommand(downloadURL, fileInfo)
+		}
+		if fm.responseField("expires_in") {
+			response["expires_in"] = expiresIn
+		}
+		if fm.responseField("delete_url") {
+			response["delete_url"] = fm.deleteURL(r, fileInfo.ID)
+		}
+		if len(fileInfo.recipientTokens) > 0 {
+			response["recipients"] = fm.recipientLinks(r, fileInfo.ID, fileInfo.recipientTokens)
+		}
+		if duplicate {
+			response["duplicate_submission"] = true
+		}
+		if warning != "" {
+			response["warning"] = warning
+		}
+		if r.FormValue("receipt") == "true" {
+			if receipt, err := fm.issueReceipt(fileInfo); err == nil {
+				response["receipt"] = receipt
+			}
+		}
+		respondJSON(w, http.StatusOK, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.URL.Query().Get("quiet") == "1" {
+		fmt.Fprintln(w, downloadURL)
+		return
+	}
+
+	if duplicate {
+		fmt.Fprintf(w, "Duplicate submission: this file was just uploaded, here it is again.\n\n")
+	} else {
+		fmt.Fprintf(w, "File uploaded successfully!\n\n")
+	}
+	if fm.responseField("landing_url") {
+		fmt.Fprintf(w, "Share page:   %s\n", landingURL)
+	}
+	fmt.Fprintf(w, "Download URL: %s\n", downloadURL)
+	if fm.responseField("curl") {
+		fmt.Fprintf(w, "Command line: %s\n", curlCommand(downloadURL, fileInfo))
+	}
+	if fm.responseField("delete_url") {
+		fmt.Fprintf(w, "Delete URL:   %s (POST or DELETE)\n", fm.deleteURL(r, fileInfo.ID))
+	}
+	fmt.Fprintf(w, "Expires:      %s", fileInfo.ExpiresAt.Format("2006-01-02 15:04:05"))
+	if fm.responseField("expires_in") {
+		fmt.Fprintf(w, " (in %s)", expiresIn)
+	}
+	if fileInfo.TTLSource == ttlDefault {
+		fmt.Fprintf(w, ", default_ttl as no ttl was given")
+	}
+	if fileInfo.HashPending {
+		fmt.Fprintf(w, "\nChecksum:     pending, see %s\n", fm.baseURL(r)+"/info/"+fileInfo.ID)
+	} else {
+		fmt.Fprintf(w, "\nChecksum:     %s\n", fileInfo.Checksum)
+	}
+	if links := fm.recipientLinks(r, fileInfo.ID, fileInfo.recipientTokens); len(links) > 0 {
+		fmt.Fprintf(w, "\nRecipient links, one per recipient:\n")
+		for _, link := range links {
+			fmt.Fprintf(w, "  %s\n", link)
+		}
+	}
+	if warning != "" {
+		fmt.Fprintf(w, "\nWarning: %s\n", warning)
+	}
+}
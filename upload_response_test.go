@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUploadResponseDeleteURL(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	status, body := uploadTestFile(t, server, "notes.txt", []byte("content"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	id := body["id"].(string)
+	deleteURL, _ := body["delete_url"].(string)
+	if deleteURL != server.URL+"/delete/"+id {
+		t.Fatalf("delete_url = %q, want the file's /delete/ URL", deleteURL)
+	}
+
+	if text := putPlain(t, server.URL+"/upload/plain.txt"); !strings.Contains(text, "Delete URL:   "+server.URL+"/delete/") {
+		t.Errorf("plain response lacks the delete URL: %q", text)
+	}
+
+	req, _ := http.NewRequest("DELETE", deleteURL, nil)
+	if status, body := doJSON(t, req); status != http.StatusOK || body["status"] != "deleted" {
+		t.Errorf("DELETE delete_url: status %d, body %v", status, body)
+	}
+	if status, _ := getJSON(t, server, "/info/"+id); status != http.StatusGone {
+		t.Errorf("info after deleting through delete_url: status %d, want 410", status)
+	}
+}
+
+func TestUploadResponseFieldsOmitDeleteURL(t *testing.T) {
+	_, server := newTestServer(t, func(c *Config) { c.ResponseFields = []string{"landing_url"} })
+	status, body := uploadTestFile(t, server, "notes.txt", []byte("content"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, body %v", status, body)
+	}
+	if _, ok := body["delete_url"]; ok {
+		t.Errorf("delete_url sent though not in upload_response_fields: %v", body)
+	}
+
+	// The plain-text response follows the same setting
+	if text := putPlain(t, server.URL+"/upload/plain.txt"); strings.Contains(text, "/delete/") {
+		t.Errorf("plain response lists a delete URL: %q", text)
+	}
+}
+
+// putPlain uploads a small file with PUT and returns the plain-text response.
+func putPlain(t *testing.T, url string) string {
+	t.Helper()
+	req, _ := http.NewRequest("PUT", url, strings.NewReader("content"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	text, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT %s: status %d, body %q", url, resp.StatusCode, text)
+	}
+	return string(text)
+}
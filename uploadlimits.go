@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errUploadRateLimit = errors.New("too many uploads from this address, try again later")
+	errUploadByteLimit = errors.New("this address has uploaded too much data this hour, try again later")
+	errUploaderQuota   = errors.New("this address's stored files take up too much space")
+)
+
+// topUploaderCount is how many uploaders /stats reports to admins.
+const topUploaderCount = 10
+
+// uploadLimiter tracks the uploads of each client IP in fixed windows, a
+// minute for upload_rate_limit and an hour for upload_bytes_per_hour. Each
+// client has its own windows; prune drops the clients whose windows have
+// all ended.
+type uploadLimiter struct {
+	mutex   sync.Mutex
+	clients map[string]*uploaderWindows
+}
+
+type uploaderWindows struct {
+	minute  time.Time // start of the current minute window
+	uploads int
+	hour    time.Time // start of the current hour window
+	bytes   int64
+}
+
+// current rolls the windows of ip forward to now. Callers hold l.mutex.
+func (l *uploadLimiter) current(ip string, now time.Time) *uploaderWindows {
+	if l.clients == nil {
+		l.clients = make(map[string]*uploaderWindows)
+	}
+	windows := l.clients[ip]
+	if windows == nil {
+		windows = &uploaderWindows{minute: now, hour: now}
+		l.clients[ip] = windows
+	}
+	if now.Sub(windows.minute) >= time.Minute {
+		windows.minute, windows.uploads = now, 0
+	}
+	if now.Sub(windows.hour) >= time.Hour {
+		windows.hour, windows.bytes = now, 0
+	}
+	return windows
+}
+
+// admit counts an upload of size bytes from ip, which may be 0 when the size
+// isn't known in advance, and reports whether it is within the limits, and
+// if not, how long until it would be. Limits of 0 are off.
+func (l *uploadLimiter) admit(ip string, size int64, perMinute int, bytesPerHour int64, now time.Time) (time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	windows := l.current(ip, now)
+	if perMinute > 0 && windows.uploads >= perMinute {
+		return windows.minute.Add(time.Minute).Sub(now), errUploadRateLimit
+	}
+	if bytesPerHour > 0 && (windows.bytes >= bytesPerHour || windows.bytes+size > bytesPerHour) {
+		return windows.hour.Add(time.Hour).Sub(now), errUploadByteLimit
+	}
+	windows.uploads++
+	return 0, nil
+}
+
+// addBytes counts a stored upload against ip's hourly byte limit.
+func (l *uploadLimiter) addBytes(ip string, size int64, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.current(ip, now).bytes += size
+}
+
+// usage returns the uploads of ip in its current minute and its bytes in
+// its current hour.
+func (l *uploadLimiter) usage(ip string, now time.Time) (int, int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	windows := l.clients[ip]
+	if windows == nil {
+		return 0, 0
+	}
+	var uploads int
+	var bytes int64
+	if now.Sub(windows.minute) < time.Minute {
+		uploads = windows.uploads
+	}
+	if now.Sub(windows.hour) < time.Hour {
+		bytes = windows.bytes
+	}
+	return uploads, bytes
+}
+
+// prune forgets the clients whose windows have all ended, so the state
+// only holds the last hour's uploaders.
+func (l *uploadLimiter) prune(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for ip, windows := range l.clients {
+		if now.Sub(windows.hour) >= time.Hour && now.Sub(windows.minute) >= time.Minute {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// uploaderFiles sums the unexpired files stored from ip and finds the
+// soonest of their expiries.
+func (fm *FileManager) uploaderFiles(ip string) (files int, size int64, nextExpiry time.Time) {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	for _, fileInfo := range fm.files {
+		if uploaderHost(fileInfo.UploaderIP) != ip || fileInfo.Status() == StatusExpired {
+			continue
+		}
+		files++
+		size += fileInfo.Size
+		if nextExpiry.IsZero() || fileInfo.ExpiresAt.Before(nextExpiry) {
+			nextExpiry = fileInfo.ExpiresAt
+		}
+	}
+	return files, size, nextExpiry
+}
+
+// admitUploader applies the per-client upload limits to an upload of size
+// bytes, 0 when the client didn't say, answering the request itself with
+// 429 and Retry-After when one is reached. Admins aren't limited.
+func (fm *FileManager) admitUploader(w http.ResponseWriter, r *http.Request, size int64) bool {
+	config := fm.config()
+	if config.UploadRateLimit <= 0 && config.UploadBytesPerHour <= 0 && config.MaxBytesPerUploader <= 0 {
+		return true
+	}
+	if fm.hasAdminCredentials(r) {
+		return true
+	}
+	if size < 0 {
+		size = 0
+	}
+	ip := fm.clientIP(r)
+	now := time.Now()
+
+	var retry time.Duration
+	var err error
+	if limit := config.MaxBytesPerUploader; limit > 0 {
+		// Stored bytes only go down as files expire or are deleted
+		if _, stored, nextExpiry := fm.uploaderFiles(ip); stored >= limit || stored+size > limit {
+			retry, err = time.Until(nextExpiry), errUploaderQuota
+		}
+	}
+	if err == nil {
+		retry, err = fm.uploadLimits.admit(ip, size, config.UploadRateLimit, config.UploadBytesPerHour, now)
+	}
+	if err == nil {
+		return true
+	}
+	if retry < 0 {
+		retry = 0
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+	writeProblem(w, r, problemResponse{downloadProblem: uploadProblem(err)})
+	return false
+}
+
+// UploaderStats is a client's share of the stored files and of the upload
+// limits, for admins.
+type UploaderStats struct {
+	IP            string `json:"ip"`
+	Files         int    `json:"files"`
+	Size          int64  `json:"size"`
+	UploadsMinute int    `json:"uploads_last_minute"`
+	BytesHour     int64  `json:"bytes_this_hour"`
+}
+
+// topUploaders returns the clients with the most stored bytes, along with
+// any that are uploading right now.
+func (fm *FileManager) topUploaders() []UploaderStats {
+	byIP := make(map[string]*UploaderStats)
+	stats := func(ip string) *UploaderStats {
+		if byIP[ip] == nil {
+			byIP[ip] = &UploaderStats{IP: ip}
+		}
+		return byIP[ip]
+	}
+	fm.mutex.RLock()
+	for _, fileInfo := range fm.files {
+		if fileInfo.UploaderIP == "" {
+			continue
+		}
+		s := stats(uploaderHost(fileInfo.UploaderIP))
+		s.Files++
+		s.Size += fileInfo.Size
+	}
+	fm.mutex.RUnlock()
+
+	now := time.Now()
+	l := &fm.uploadLimits
+	l.mutex.Lock()
+	recent := make([]string, 0, len(l.clients))
+	for ip := range l.clients {
+		recent = append(recent, ip)
+	}
+	l.mutex.Unlock()
+	for _, ip := range recent {
+		s := stats(ip)
+		s.UploadsMinute, s.BytesHour = l.usage(ip, now)
+	}
+
+	top := make([]UploaderStats, 0, len(byIP))
+	for _, s := range byIP {
+		top = append(top, *s)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Size != top[j].Size {
+			return top[i].Size > top[j].Size
+		}
+		if top[i].BytesHour != top[j].BytesHour {
+			return top[i].BytesHour > top[j].BytesHour
+		}
+		return top[i].IP < top[j].IP
+	})
+	if len(top) > topUploaderCount {
+		top = top[:topUploaderCount]
+	}
+	return top
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// isTrustedProxy reports whether the request arrived directly from one of
+// the configured trusted proxies. Entries may be plain IPs or CIDR ranges.
+// Connections over a Unix domain socket always count as trusted.
+func (fm *FileManager) isTrustedProxy(r *http.Request) bool {
+	if viaUnixSocket(r) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, entry := range fm.config().TrustedProxies {
+		if strings.Contains(entry, "/") {
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if trusted := net.ParseIP(entry); trusted != nil && trusted.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// baseURL returns the externally visible scheme and host for generated links.
+// A configured base_url always wins; otherwise X-Forwarded-Proto and
+// X-Forwarded-Host are honored only when the request came from a trusted proxy.
+func (fm *FileManager) baseURL(r *http.Request) string {
+	if fm.config().BaseURL != "" {
+		return fm.withPathPrefix(strings.TrimSuffix(fm.config().BaseURL, "/"))
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if fm.isTrustedProxy(r) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+		}
+		if fwdHost := r.Header.Get("X-Forwarded-Host"); fwdHost != "" {
+			host = strings.TrimSpace(strings.Split(fwdHost, ",")[0])
+		}
+	}
+
+	return fm.withPathPrefix(scheme + "://" + host)
+}
+
+// withPathPrefix appends path_prefix to an origin, unless base_url already
+// ends with it.
+func (fm *FileManager) withPathPrefix(base string) string {
+	prefix := fm.config().PathPrefix
+	if strings.HasSuffix(base, prefix) {
+		return base
+	}
+	return base + prefix
+}
+
+// appPath returns the path of one of our routes as clients see it, below
+// path_prefix, for links and redirects within the server.
+func (fm *FileManager) appPath(route string) string {
+	return fm.config().PathPrefix + route
+}
+
+func (fm *FileManager) downloadURL(r *http.Request, fileID string) string {
+	return fm.baseURL(r) + "/download/" + fileID
+}
+
+func (fm *FileManager) landingURL(r *http.Request, fileID string) string {
+	return fm.baseURL(r) + "/f/" + fileID
+}
+
+func (fm *FileManager) deleteURL(r *http.Request, fileID string) string {
+	return fm.baseURL(r) + "/delete/" + fileID
+}
+
+// uploaderHost is the IP of an uploader_ip, which files uploaded before it
+// was recorded through clientIP carry with a port.
+func uploaderHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// clientIP returns the address of the client, taking the nearest hop of
+// X-Forwarded-For when the request came through a trusted proxy.
+func (fm *FileManager) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if fm.isTrustedProxy(r) {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	return host
+}
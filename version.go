@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// BuildInfo identifies the running binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// currentBuild returns the ldflags values, falling back to the VCS stamp the
+// go tool embeds when building from a checkout.
+func currentBuild() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("uploads %s (commit %s, built %s, %s)", b.Version, b.Commit, b.BuildDate, b.GoVersion)
+}
+
+// features describes what the running configuration has switched on.
+func (fm *FileManager) features() map[string]interface{} {
+	config := fm.config()
+	auth := "none"
+	if config.AdminPassword != "" {
+		auth = "admin_password"
+	}
+	return map[string]interface{}{
+		"storage_backend":  config.StorageBackend,
+		"auth":             auth,
+		"encryption":       false,
+		"grpc":             config.GRPCPort != "",
+		"s3":               len(config.S3Credentials) > 0,
+		"download_cache":   config.CacheDir != "",
+		"sendfile":         config.SendfileMode,
+		"public_listings":  config.PublicListings,
+		"notifications":    config.NotifyWebhookURL != "",
+		"checksum":         config.ChecksumAlgorithm,
+		"require_password": config.RequirePassword,
+		"strict":           config.Strict,
+		"flags":            config.FeatureFlags,
+	}
+}
+
+func (fm *FileManager) logBanner() {
+	log.Print(currentBuild())
+	features, _ := json.Marshal(fm.features())
+	log.Printf("Features: %s", features)
+}
+
+// versionInfo handles GET /api/version.
+func (fm *FileManager) versionInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	respondJSON(w, http.StatusOK, struct {
+		BuildInfo
+		Features map[string]interface{} `json:"features"`
+	}{currentBuild(), fm.features()})
+}